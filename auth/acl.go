@@ -0,0 +1,208 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var _ Authorizer = (*aclAuthorizer)(nil)
+
+// aclRule grants access to the topics matching filter. If pattern is set then %c
+// and %u in the filter are replaced with the client ID and username first.
+type aclRule struct {
+	access  Access
+	filter  string
+	pattern bool
+}
+
+// aclAuthorizer is an Authorizer that goes by an access control list. Access is
+// only allowed if there's a rule for it, either one for everyone or one for the
+// client's username.
+type aclAuthorizer struct {
+	all   []aclRule
+	users map[string][]aclRule
+}
+
+// NewFileAuthorizer reads the access control list in the file at path. It has to
+// be registered, e.g., RegisterAuthorizer("acl", a), before a server can use it.
+// The file is made of lines like these:
+//
+//	# Comments start with #. Rules before the first user line apply to everyone.
+//	topic read $SYS/#
+//
+//	# Rules for the clients connecting with username alice.
+//	user alice
+//	topic readwrite alice/#
+//	topic write sensors/+/temperature
+//
+//	# %c is replaced with the client ID and %u with the username.
+//	pattern readwrite clients/%c/#
+//
+// The access is one of read, write or readwrite. If left out it's readwrite. A
+// topic filter in a rule covers SUBSCRIBE topic filters that match a subset of
+// what it matches, e.g., "sensors/#" covers "sensors/+/temperature".
+func NewFileAuthorizer(path string) (*aclAuthorizer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return newACLAuthorizer(f)
+}
+
+func newACLAuthorizer(r io.Reader) (*aclAuthorizer, error) {
+	this := &aclAuthorizer{
+		users: make(map[string][]aclRule),
+	}
+
+	var (
+		user    string
+		hasUser bool
+		lineno  int
+	)
+
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		lineno++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		switch fields[0] {
+		case "user":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("auth/NewFileAuthorizer: Line %d: Expecting \"user <username>\"", lineno)
+			}
+
+			user, hasUser = fields[1], true
+
+		case "topic", "pattern":
+			rule := aclRule{access: ReadWrite, pattern: fields[0] == "pattern"}
+
+			switch len(fields) {
+			case 2:
+				rule.filter = fields[1]
+
+			case 3:
+				switch fields[1] {
+				case "read":
+					rule.access = Read
+				case "write":
+					rule.access = Write
+				case "readwrite":
+					rule.access = ReadWrite
+				default:
+					return nil, fmt.Errorf("auth/NewFileAuthorizer: Line %d: Unknown access %q", lineno, fields[1])
+				}
+
+				rule.filter = fields[2]
+
+			default:
+				return nil, fmt.Errorf("auth/NewFileAuthorizer: Line %d: Expecting \"%s [read|write|readwrite] <topic>\"", lineno, fields[0])
+			}
+
+			if hasUser {
+				this.users[user] = append(this.users[user], rule)
+			} else {
+				this.all = append(this.all, rule)
+			}
+
+		default:
+			return nil, fmt.Errorf("auth/NewFileAuthorizer: Line %d: Unknown keyword %q", lineno, fields[0])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+func (this *aclAuthorizer) Authorize(clientId, username string, topic []byte, access Access) error {
+	t := string(topic)
+
+	for _, rules := range [][]aclRule{this.all, this.users[username]} {
+		for _, rule := range rules {
+			if rule.access&access != access {
+				continue
+			}
+
+			filter := rule.filter
+
+			if rule.pattern {
+				// A client ID or username with wildcards or separators in it could
+				// be used to get at other clients' topics.
+				if strings.ContainsAny(clientId+username, "+#/") {
+					continue
+				}
+
+				filter = strings.NewReplacer("%c", clientId, "%u", username).Replace(filter)
+			}
+
+			if aclMatch(filter, t) {
+				return nil
+			}
+		}
+	}
+
+	return ErrNotAuthorized
+}
+
+// aclMatch returns true if the rule's topic filter covers the topic, which can be
+// a topic name or a topic filter. A wildcard in the topic is only covered by the
+// same, or a broader, wildcard in the rule. Topics starting with $ are not matched
+// by a wildcard at the first level.
+func aclMatch(filter, topic string) bool {
+	fl := strings.Split(filter, "/")
+	tl := strings.Split(topic, "/")
+
+	for i, f := range fl {
+		if i == 0 && (f == "#" || f == "+") && strings.HasPrefix(topic, "$") {
+			return false
+		}
+
+		if f == "#" {
+			return true
+		}
+
+		if i >= len(tl) {
+			return false
+		}
+
+		switch {
+		case f == "+":
+			if tl[i] == "#" {
+				return false
+			}
+
+		case f != tl[i]:
+			return false
+		}
+	}
+
+	return len(fl) == len(tl)
+}
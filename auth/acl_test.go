@@ -0,0 +1,122 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testACL = `
+# Everyone
+topic read public/#
+topic read $SYS/broker/uptime
+pattern readwrite clients/%c/#
+
+user alice
+topic readwrite alice/#
+topic write sensors/+/temperature
+
+user bob
+topic sensors/#
+`
+
+func TestACLAuthorizer(t *testing.T) {
+	a, err := newACLAuthorizer(strings.NewReader(testACL))
+	require.NoError(t, err)
+
+	allowed := []struct {
+		clientId, username, topic string
+		access                    Access
+	}{
+		{"c1", "", "public/news", Read},
+		{"c1", "", "public/#", Read},
+		{"c1", "", "public", Read},
+		{"c1", "", "$SYS/broker/uptime", Read},
+		{"c1", "", "clients/c1/status", ReadWrite},
+		{"c1", "alice", "alice/inbox", Write},
+		{"c1", "alice", "alice/+/x", Read},
+		{"c1", "alice", "sensors/kitchen/temperature", Write},
+		{"c1", "bob", "sensors/+/temperature", Read},
+		{"c1", "bob", "sensors/kitchen/humidity", Write},
+	}
+
+	for _, c := range allowed {
+		require.NoError(t, a.Authorize(c.clientId, c.username, []byte(c.topic), c.access), c.topic)
+	}
+
+	denied := []struct {
+		clientId, username, topic string
+		access                    Access
+	}{
+		{"c1", "", "public/news", Write},
+		{"c1", "", "#", Read},
+		{"c1", "", "$SYS/#", Read},
+		{"c1", "", "clients/c2/status", Read},
+		{"c1", "", "alice/inbox", Read},
+		{"c1", "alice", "sensors/kitchen/temperature", Read},
+		{"c1", "alice", "sensors/+/temperature", Read},
+		{"c1", "alice", "sensors/kitchen/temperature/x", Write},
+		{"c1", "bob", "alice/inbox", Write},
+		{"c1/x", "", "clients/c1/x/status", Read},
+		{"+", "", "clients/+/status", Read},
+	}
+
+	for _, c := range denied {
+		require.Equal(t, ErrNotAuthorized, a.Authorize(c.clientId, c.username, []byte(c.topic), c.access), c.topic)
+	}
+}
+
+func TestACLAuthorizerInvalid(t *testing.T) {
+	for _, acl := range []string{
+		"topic",
+		"topic delete abc",
+		"topic read abc def",
+		"user",
+		"user a b",
+		"group admins",
+	} {
+		_, err := newACLAuthorizer(strings.NewReader(acl))
+		require.Error(t, err, acl)
+	}
+}
+
+func TestFileAuthorizer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "surgemq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "acl")
+	require.NoError(t, ioutil.WriteFile(path, []byte(testACL), 0600))
+
+	a, err := NewFileAuthorizer(path)
+	require.NoError(t, err)
+
+	RegisterAuthorizer("acl", a)
+	defer UnregisterAuthorizer("acl")
+
+	mgr, err := NewAuthorizerManager("acl")
+	require.NoError(t, err)
+	require.NoError(t, mgr.Authorize("c1", "", []byte("public/news"), Read))
+	require.Error(t, mgr.Authorize("c1", "", []byte("public/news"), Write))
+
+	_, err = NewFileAuthorizer(filepath.Join(dir, "nothere"))
+	require.Error(t, err)
+}
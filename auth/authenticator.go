@@ -17,12 +17,18 @@ package auth
 import (
 	"errors"
 	"fmt"
+	"sync"
 )
 
 var (
 	ErrAuthFailure          = errors.New("auth: Authentication failure")
 	ErrAuthProviderNotFound = errors.New("auth: Authentication provider not found")
 
+	// ErrAuthMethodNotSupported is returned by StartAuth for the authentication methods
+	// the provider doesn't support, which is all of them if it's not an
+	// EnhancedAuthenticator.
+	ErrAuthMethodNotSupported = errors.New("auth: Authentication method not supported")
+
 	providers = make(map[string]Authenticator)
 )
 
@@ -30,6 +36,31 @@ type Authenticator interface {
 	Authenticate(id string, cred interface{}) error
 }
 
+// ClaimsAuthenticator is implemented by authenticators that find out more about a
+// client than whether its credentials are good, e.g., the claims in a JWT. The
+// claims are handed to the Authorizer, if it's a ClaimsAuthorizer, so it can scope
+// the topics the client can use by them.
+type ClaimsAuthenticator interface {
+	AuthenticateClaims(id string, cred interface{}) (map[string]interface{}, error)
+}
+
+// EnhancedAuthenticator is implemented by authenticators that support the enhanced
+// authentication of MQTT 5.0, where the client and the server go back and forth with
+// challenges and responses under an authentication method, e.g., SCRAM-SHA-256,
+// instead of the client sending a username and password.
+type EnhancedAuthenticator interface {
+	// StartAuth starts authenticating the client with the ID given by method, or
+	// returns ErrAuthMethodNotSupported if it doesn't know it.
+	StartAuth(id, method string) (AuthExchange, error)
+}
+
+// AuthExchange is the exchange authenticating a client, started by StartAuth.
+type AuthExchange interface {
+	// Next takes the authentication data from the client, and returns what to send
+	// back, and whether the client is authenticated, or an error if it isn't.
+	Next(data []byte) (resp []byte, done bool, err error)
+}
+
 func Register(name string, provider Authenticator) {
 	if provider == nil {
 		panic("auth: Register provide is nil")
@@ -47,7 +78,8 @@ func Unregister(name string) {
 }
 
 type Manager struct {
-	p Authenticator
+	p  Authenticator
+	mu sync.RWMutex
 }
 
 func NewManager(providerName string) (*Manager, error) {
@@ -59,6 +91,51 @@ func NewManager(providerName string) (*Manager, error) {
 	return &Manager{p: p}, nil
 }
 
+// SetProvider switches the manager to the provider registered as providerName, e.g.,
+// because the configuration changed, or the provider was registered again with new
+// settings. The clients authenticated already are not checked again.
+func (this *Manager) SetProvider(providerName string) error {
+	p, ok := providers[providerName]
+	if !ok {
+		return fmt.Errorf("auth: unknown provider %q", providerName)
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.p = p
+
+	return nil
+}
+
 func (this *Manager) Authenticate(id string, cred interface{}) error {
-	return this.p.Authenticate(id, cred)
+	return this.provider().Authenticate(id, cred)
+}
+
+// AuthenticateClaims returns no claims if the provider is not a ClaimsAuthenticator.
+func (this *Manager) AuthenticateClaims(id string, cred interface{}) (map[string]interface{}, error) {
+	p := this.provider()
+
+	if cp, ok := p.(ClaimsAuthenticator); ok {
+		return cp.AuthenticateClaims(id, cred)
+	}
+
+	return nil, p.Authenticate(id, cred)
+}
+
+// StartAuth returns ErrAuthMethodNotSupported if the provider is not an
+// EnhancedAuthenticator.
+func (this *Manager) StartAuth(id, method string) (AuthExchange, error) {
+	if ep, ok := this.provider().(EnhancedAuthenticator); ok {
+		return ep.StartAuth(id, method)
+	}
+
+	return nil, ErrAuthMethodNotSupported
+}
+
+func (this *Manager) provider() Authenticator {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return this.p
 }
@@ -0,0 +1,138 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Access is what a client wants to do with a topic.
+type Access byte
+
+const (
+	// Read is for subscribing to a topic filter, i.e., receiving the messages
+	// published to the topics it matches.
+	Read Access = 1 << iota
+
+	// Write is for publishing messages to a topic.
+	Write
+
+	// ReadWrite is for both.
+	ReadWrite = Read | Write
+)
+
+func (this Access) String() string {
+	switch this {
+	case Read:
+		return "read"
+	case Write:
+		return "write"
+	case ReadWrite:
+		return "readwrite"
+	}
+
+	return fmt.Sprintf("Access(%d)", byte(this))
+}
+
+var (
+	ErrNotAuthorized = errors.New("auth: Not authorized")
+
+	authorizers = make(map[string]Authorizer)
+)
+
+// Authorizer decides what an authenticated client is allowed to do. It's asked
+// for every topic filter in a SUBSCRIBE message, with Read access, and for every
+// PUBLISH message, including will messages, with Write access. Authorize returns
+// nil if the access is allowed, and an error, e.g., ErrNotAuthorized, otherwise.
+type Authorizer interface {
+	Authorize(clientId, username string, topic []byte, access Access) error
+}
+
+// ClaimsAuthorizer is implemented by authorizers that can go by the claims the
+// client was authenticated with by a ClaimsAuthenticator.
+type ClaimsAuthorizer interface {
+	AuthorizeClaims(clientId, username string, claims map[string]interface{}, topic []byte, access Access) error
+}
+
+func RegisterAuthorizer(name string, provider Authorizer) {
+	if provider == nil {
+		panic("auth: RegisterAuthorizer provide is nil")
+	}
+
+	if _, dup := authorizers[name]; dup {
+		panic("auth: RegisterAuthorizer called twice for provider " + name)
+	}
+
+	authorizers[name] = provider
+}
+
+func UnregisterAuthorizer(name string) {
+	delete(authorizers, name)
+}
+
+type AuthorizerManager struct {
+	p  Authorizer
+	mu sync.RWMutex
+}
+
+func NewAuthorizerManager(providerName string) (*AuthorizerManager, error) {
+	p, ok := authorizers[providerName]
+	if !ok {
+		return nil, fmt.Errorf("auth: unknown authorizer provider %q", providerName)
+	}
+
+	return &AuthorizerManager{p: p}, nil
+}
+
+// SetProvider switches the manager to the provider registered as providerName, e.g.,
+// an access control list registered again once its file has changed. It applies
+// right away, to the clients connected already too.
+func (this *AuthorizerManager) SetProvider(providerName string) error {
+	p, ok := authorizers[providerName]
+	if !ok {
+		return fmt.Errorf("auth: unknown authorizer provider %q", providerName)
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.p = p
+
+	return nil
+}
+
+func (this *AuthorizerManager) Authorize(clientId, username string, topic []byte, access Access) error {
+	return this.provider().Authorize(clientId, username, topic, access)
+}
+
+// AuthorizeClaims ignores the claims if the provider is not a ClaimsAuthorizer.
+func (this *AuthorizerManager) AuthorizeClaims(clientId, username string, claims map[string]interface{}, topic []byte, access Access) error {
+	p := this.provider()
+
+	if cp, ok := p.(ClaimsAuthorizer); ok {
+		return cp.AuthorizeClaims(clientId, username, claims, topic, access)
+	}
+
+	return p.Authorize(clientId, username, topic, access)
+}
+
+func (this *AuthorizerManager) provider() Authorizer {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return this.p
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+)
+
+var (
+	ErrCertAuthNotSupported = errors.New("auth: Authenticator does not support certificates")
+)
+
+// CertAuthenticator is implemented by authenticators that can tell who a client is
+// from the certificate it connected with over TLS, instead of the username and
+// password in the CONNECT message. AuthenticateCert returns the client's identity,
+// which is used as its username from then on, e.g., by the Authorizer.
+type CertAuthenticator interface {
+	AuthenticateCert(state *tls.ConnectionState) (string, error)
+}
+
+// AuthenticateCert returns ErrCertAuthNotSupported if the provider can't do it, in
+// which case the client should be authenticated with Authenticate() instead.
+func (this *Manager) AuthenticateCert(state *tls.ConnectionState) (string, error) {
+	if p, ok := this.p.(CertAuthenticator); ok {
+		return p.AuthenticateCert(state)
+	}
+
+	return "", ErrCertAuthNotSupported
+}
+
+// CertField is the part of a client certificate that identifies the client.
+type CertField int
+
+const (
+	// CommonName is the CN of the certificate subject.
+	CommonName CertField = iota
+
+	// DNSName is the first DNS name in the subject alternative names.
+	DNSName
+
+	// EmailAddress is the first email address in the subject alternative names.
+	EmailAddress
+
+	// URI is the first URI in the subject alternative names.
+	URI
+)
+
+var _ Authenticator = (*certAuthenticator)(nil)
+var _ CertAuthenticator = (*certAuthenticator)(nil)
+
+type certAuthenticator struct {
+	field      CertField
+	identities map[string]bool
+}
+
+// NewCertAuthenticator returns an authenticator that lets clients in based on the
+// certificate they connected with, and identifies them by field. If identities are
+// listed then only the clients with those identities are let in, otherwise any
+// client with a certificate the server verified is. For the certificates to be
+// verified, the server's TLSConfig should have ClientAuth set to
+// tls.RequireAndVerifyClientCert or tls.VerifyClientCertIfGiven. Clients without a
+// certificate are turned away. It has to be registered, e.g., Register("cert", a),
+// before a server can use it.
+func NewCertAuthenticator(field CertField, identities ...string) *certAuthenticator {
+	this := &certAuthenticator{field: field}
+
+	if len(identities) > 0 {
+		this.identities = make(map[string]bool)
+
+		for _, id := range identities {
+			this.identities[id] = true
+		}
+	}
+
+	return this
+}
+
+// Authenticate always fails, since the client didn't connect with a certificate.
+func (this *certAuthenticator) Authenticate(id string, cred interface{}) error {
+	return ErrAuthFailure
+}
+
+func (this *certAuthenticator) AuthenticateCert(state *tls.ConnectionState) (string, error) {
+	// Only certificates that chain up to one of the server's CAs are any good.
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", ErrAuthFailure
+	}
+
+	id := certIdentity(state.VerifiedChains[0][0], this.field)
+	if id == "" {
+		return "", ErrAuthFailure
+	}
+
+	if this.identities != nil && !this.identities[id] {
+		return "", ErrAuthFailure
+	}
+
+	return id, nil
+}
+
+func certIdentity(cert *x509.Certificate, field CertField) string {
+	switch field {
+	case CommonName:
+		return cert.Subject.CommonName
+
+	case DNSName:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+
+	case EmailAddress:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+
+	case URI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertAuthenticator(t *testing.T) {
+	u, err := url.Parse("spiffe://surgemq/sensor")
+	require.NoError(t, err)
+
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "sensor1"},
+		DNSNames:       []string{"sensor1.example.com", "sensor1"},
+		EmailAddresses: []string{"sensor1@example.com"},
+		URIs:           []*url.URL{u},
+	}
+
+	verified := &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}
+
+	for field, expected := range map[CertField]string{
+		CommonName:   "sensor1",
+		DNSName:      "sensor1.example.com",
+		EmailAddress: "sensor1@example.com",
+		URI:          "spiffe://surgemq/sensor",
+	} {
+		id, err := NewCertAuthenticator(field).AuthenticateCert(verified)
+		require.NoError(t, err)
+		require.Equal(t, expected, id)
+	}
+
+	a := NewCertAuthenticator(CommonName, "sensor1", "sensor2")
+
+	id, err := a.AuthenticateCert(verified)
+	require.NoError(t, err)
+	require.Equal(t, "sensor1", id)
+
+	_, err = NewCertAuthenticator(CommonName, "sensor2").AuthenticateCert(verified)
+	require.Equal(t, ErrAuthFailure, err)
+
+	// Not verified by the server
+	_, err = a.AuthenticateCert(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	require.Equal(t, ErrAuthFailure, err)
+
+	_, err = NewCertAuthenticator(DNSName).AuthenticateCert(&tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "sensor1"}}}},
+	})
+	require.Equal(t, ErrAuthFailure, err)
+
+	require.Equal(t, ErrAuthFailure, a.Authenticate("surgemq", "verysecret"))
+
+	Register("cert", a)
+	defer Unregister("cert")
+
+	mgr, err := NewManager("cert")
+	require.NoError(t, err)
+
+	id, err = mgr.AuthenticateCert(verified)
+	require.NoError(t, err)
+	require.Equal(t, "sensor1", id)
+
+	mgr, err = NewManager("mockSuccess")
+	require.NoError(t, err)
+
+	_, err = mgr.AuthenticateCert(verified)
+	require.Equal(t, ErrCertAuthNotSupported, err)
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+var _ Authorizer = (*claimsAuthorizer)(nil)
+var _ ClaimsAuthorizer = (*claimsAuthorizer)(nil)
+
+// claimsAuthorizer is an Authorizer that goes by the topic filters listed in the
+// client's claims, e.g., from its JWT.
+type claimsAuthorizer struct {
+	read  string
+	write string
+}
+
+// NewClaimsAuthorizer returns an authorizer that lets a client subscribe to the
+// topic filters listed in its read claim, and publish to the ones in its write
+// claim, e.g., NewClaimsAuthorizer("subscribe", "publish") for a JWT like this:
+//
+//	{"sub": "sensor1", "subscribe": ["commands/sensor1/#"], "publish": ["sensors/sensor1/+"]}
+//
+// The topic filters are matched the same as in an access control list, see
+// NewFileAuthorizer. A claim can also be a single topic filter. Clients without
+// claims are not allowed anything. It has to be registered, e.g.,
+// RegisterAuthorizer("claims", a), before a server can use it.
+func NewClaimsAuthorizer(read, write string) *claimsAuthorizer {
+	return &claimsAuthorizer{read: read, write: write}
+}
+
+func (this *claimsAuthorizer) Authorize(clientId, username string, topic []byte, access Access) error {
+	return ErrNotAuthorized
+}
+
+func (this *claimsAuthorizer) AuthorizeClaims(clientId, username string, claims map[string]interface{}, topic []byte, access Access) error {
+	if access&Read != 0 && !claimsMatch(claims[this.read], string(topic)) {
+		return ErrNotAuthorized
+	}
+
+	if access&Write != 0 && !claimsMatch(claims[this.write], string(topic)) {
+		return ErrNotAuthorized
+	}
+
+	return nil
+}
+
+// claimsMatch returns true if the claim is a topic filter, or a list of them, that
+// covers the topic.
+func claimsMatch(claim interface{}, topic string) bool {
+	switch c := claim.(type) {
+	case string:
+		return aclMatch(c, topic)
+
+	case []interface{}:
+		for _, f := range c {
+			if s, ok := f.(string); ok && aclMatch(s, topic) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
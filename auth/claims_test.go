@@ -0,0 +1,53 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimsAuthorizer(t *testing.T) {
+	a := NewClaimsAuthorizer("subscribe", "publish")
+
+	claims := map[string]interface{}{
+		"sub":       "sensor1",
+		"subscribe": []interface{}{"commands/sensor1/#", "broadcast"},
+		"publish":   "sensors/sensor1/+",
+	}
+
+	require.NoError(t, a.AuthorizeClaims("c1", "sensor1", claims, []byte("commands/sensor1/reboot"), Read))
+	require.NoError(t, a.AuthorizeClaims("c1", "sensor1", claims, []byte("broadcast"), Read))
+	require.NoError(t, a.AuthorizeClaims("c1", "sensor1", claims, []byte("sensors/sensor1/temperature"), Write))
+
+	require.Equal(t, ErrNotAuthorized, a.AuthorizeClaims("c1", "sensor1", claims, []byte("commands/#"), Read))
+	require.Equal(t, ErrNotAuthorized, a.AuthorizeClaims("c1", "sensor1", claims, []byte("broadcast"), Write))
+	require.Equal(t, ErrNotAuthorized, a.AuthorizeClaims("c1", "sensor1", claims, []byte("sensors/sensor1/temperature"), ReadWrite))
+	require.Equal(t, ErrNotAuthorized, a.AuthorizeClaims("c1", "sensor1", nil, []byte("broadcast"), Read))
+	require.Equal(t, ErrNotAuthorized, a.Authorize("c1", "sensor1", []byte("broadcast"), Read))
+
+	RegisterAuthorizer("claims", a)
+	defer UnregisterAuthorizer("claims")
+
+	mgr, err := NewAuthorizerManager("claims")
+	require.NoError(t, err)
+	require.NoError(t, mgr.AuthorizeClaims("c1", "sensor1", claims, []byte("broadcast"), Read))
+
+	// Authorizers that don't do claims just ignore them
+	mgr, err = NewAuthorizerManager("mockAllow")
+	require.NoError(t, err)
+	require.NoError(t, mgr.AuthorizeClaims("c1", "sensor1", nil, []byte("broadcast"), Read))
+}
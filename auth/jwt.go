@@ -0,0 +1,459 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("auth: Invalid token")
+	ErrTokenExpired = errors.New("auth: Token expired")
+)
+
+var _ Authenticator = (*jwtAuthenticator)(nil)
+var _ ClaimsAuthenticator = (*jwtAuthenticator)(nil)
+
+// The signing algorithms supported, and the hash each of them uses.
+var jwtAlgs = map[string]crypto.Hash{
+	"HS256": crypto.SHA256,
+	"HS384": crypto.SHA384,
+	"HS512": crypto.SHA512,
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// The curve each of the ECDSA algorithms has to be used with, as RFC 7518 has it.
+var jwtCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+// jwtAuthenticator is an Authenticator that takes the password in the CONNECT
+// message to be a JSON Web Token. The token is good if it's signed with the key, or
+// one of the keys from the JWKS URL, and has an exp claim that has not passed.
+type jwtAuthenticator struct {
+	// If set then the iss claim must be this
+	Issuer string
+
+	// If set then the aud claim must be, or include, this
+	Audience string
+
+	// If set then tokens without an exp claim are good too, forever. Otherwise
+	// they're turned away.
+	AllowNoExpiry bool
+
+	// The key all tokens are signed with, if not using a JWKS URL
+	key interface{}
+
+	// Where to get the keys from, by key ID, and how often to get them again
+	jwksURL     string
+	jwksRefresh time.Duration
+
+	// The keys from the JWKS URL, when they were fetched, and the error from the
+	// last time they were. fetching is closed once the fetch going on, if any, is
+	// done. Protected by mu, which isn't held while fetching.
+	keys     map[string]interface{}
+	fetched  time.Time
+	fetchErr error
+	fetching chan struct{}
+	mu       sync.Mutex
+
+	// Returns the current time, so tests can change it
+	now func() time.Time
+}
+
+// NewJWTAuthenticator returns an authenticator for tokens signed with key. The key
+// is a []byte for the HS256, HS384 and HS512 algorithms, a *rsa.PublicKey for
+// RS256, RS384 and RS512, and a *ecdsa.PublicKey for ES256, ES384 and ES512.
+// Tokens signed with any other kind of key than this one are turned away, as are
+// the ones without an exp claim, unless AllowNoExpiry is set. If the client sends
+// a username it must match the sub claim. It has to be registered, e.g.,
+// Register("jwt", a), before a server can use it.
+func NewJWTAuthenticator(key interface{}) *jwtAuthenticator {
+	return &jwtAuthenticator{
+		key: key,
+		now: time.Now,
+	}
+}
+
+// NewJWKSAuthenticator is like NewJWTAuthenticator, except that the keys are the
+// RSA and EC keys in the JSON Web Key Set at url. The token's kid header picks the
+// key. The keys are fetched when first needed, then again every refresh, or when a
+// token comes in with a key ID not seen before, but no more than once a minute.
+func NewJWKSAuthenticator(url string, refresh time.Duration) *jwtAuthenticator {
+	return &jwtAuthenticator{
+		jwksURL:     url,
+		jwksRefresh: refresh,
+		now:         time.Now,
+	}
+}
+
+func (this *jwtAuthenticator) Authenticate(id string, cred interface{}) error {
+	_, err := this.AuthenticateClaims(id, cred)
+	return err
+}
+
+// AuthenticateClaims returns the claims in the token, for the Authorizer to use,
+// e.g., a ClaimsAuthorizer.
+func (this *jwtAuthenticator) AuthenticateClaims(id string, cred interface{}) (map[string]interface{}, error) {
+	token, ok := cred.(string)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	claims, err := this.parse(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if sub, _ := claims["sub"].(string); id != "" && id != sub {
+		return nil, ErrAuthFailure
+	}
+
+	return claims, nil
+}
+
+// parse checks the token's signature and claims, and returns the claims.
+func (this *jwtAuthenticator) parse(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	if err := jwtDecode(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	hash, ok := jwtAlgs[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("auth/jwt: Unsupported algorithm %q", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	key, err := this.keyFor(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := jwtVerify(header.Alg, hash, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+
+	if err := jwtDecode(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if err := this.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (this *jwtAuthenticator) checkClaims(claims map[string]interface{}) error {
+	now := float64(this.now().Unix())
+
+	exp, ok := claims["exp"].(float64)
+	if !ok && !this.AllowNoExpiry {
+		return ErrInvalidToken
+	}
+
+	if ok && now >= exp {
+		return ErrTokenExpired
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return ErrInvalidToken
+	}
+
+	if this.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != this.Issuer {
+			return ErrInvalidToken
+		}
+	}
+
+	if this.Audience != "" {
+		switch aud := claims["aud"].(type) {
+		case string:
+			if aud == this.Audience {
+				return nil
+			}
+
+		case []interface{}:
+			for _, a := range aud {
+				if a == this.Audience {
+					return nil
+				}
+			}
+		}
+
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+// keyFor returns the key for the key ID, fetching the keys from the JWKS URL if
+// need be. The key is returned right away if it's known, even if the keys are due
+// to be fetched again. Otherwise it waits for them.
+func (this *jwtAuthenticator) keyFor(kid string) (interface{}, error) {
+	if this.jwksURL == "" {
+		return this.key, nil
+	}
+
+	this.mu.Lock()
+	age := this.now().Sub(this.fetched)
+	key, ok := this.keys[kid]
+	stale := this.keys == nil || (this.jwksRefresh > 0 && age >= this.jwksRefresh) || (!ok && age >= time.Minute)
+	this.mu.Unlock()
+
+	if stale {
+		done := this.refresh()
+
+		if !ok {
+			<-done
+
+			this.mu.Lock()
+			key, ok = this.keys[kid]
+			err := this.fetchErr
+			this.mu.Unlock()
+
+			// Keep going with the keys we have, the next token will try again.
+			if !ok && err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("auth/jwt: Unknown key ID %q", kid)
+	}
+
+	return key, nil
+}
+
+// refresh fetches the keys from the JWKS URL, unless they're already being fetched,
+// and returns a channel that's closed once they are.
+func (this *jwtAuthenticator) refresh() <-chan struct{} {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.fetching != nil {
+		return this.fetching
+	}
+
+	done := make(chan struct{})
+	this.fetching = done
+
+	go func() {
+		keys, err := fetchJWKS(this.jwksURL)
+
+		this.mu.Lock()
+		if err == nil {
+			this.keys = keys
+			this.fetched = this.now()
+		}
+		this.fetchErr = err
+		this.fetching = nil
+		this.mu.Unlock()
+
+		close(done)
+	}()
+
+	return done
+}
+
+func jwtVerify(alg string, hash crypto.Hash, key interface{}, signed string, sig []byte) error {
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case []byte:
+		if alg[:2] != "HS" {
+			break
+		}
+
+		mac := hmac.New(hash.New, k)
+		mac.Write([]byte(signed))
+
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return ErrInvalidToken
+		}
+
+		return nil
+
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			break
+		}
+
+		if err := rsa.VerifyPKCS1v15(k, hash, digest, sig); err != nil {
+			return ErrInvalidToken
+		}
+
+		return nil
+
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			break
+		}
+
+		// Otherwise an ES512 token could be verified with a P-256 key
+		if k.Curve.Params().Name != jwtCurves[alg] {
+			return ErrInvalidToken
+		}
+
+		// The signature is r and s back to back, each the size of the curve.
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return ErrInvalidToken
+		}
+
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+
+		if !ecdsa.Verify(k, digest, r, s) {
+			return ErrInvalidToken
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("auth/jwt: Algorithm %q does not go with the key", alg)
+}
+
+func jwtDecode(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+// fetchJWKS gets the RSA and EC public keys in the JSON Web Key Set at url, by key
+// ID. Other keys are skipped.
+func fetchJWKS(url string) (map[string]interface{}, error) {
+	resp, err := jwksClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth/jwt: Error fetching %s: %s", url, resp.Status)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, fmt.Errorf("auth/jwt: Error decoding %s: %v", url, err)
+	}
+
+	keys := make(map[string]interface{})
+
+	for _, k := range jwks.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+
+		case "EC":
+			var curve elliptic.Curve
+
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+
+			keys[k.Kid] = &ecdsa.PublicKey{
+				Curve: curve,
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+
+	return keys, nil
+}
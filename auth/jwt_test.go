@@ -0,0 +1,325 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWTAuthenticatorHMAC(t *testing.T) {
+	key := []byte("verysecret")
+	a := NewJWTAuthenticator(key)
+
+	token := newToken(t, "HS256", "", key, map[string]interface{}{
+		"sub": "sensor1",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	claims, err := a.AuthenticateClaims("sensor1", token)
+	require.NoError(t, err)
+	require.Equal(t, "sensor1", claims["sub"])
+
+	// No username is fine, a different one is not
+	require.NoError(t, a.Authenticate("", token))
+	require.Equal(t, ErrAuthFailure, a.Authenticate("sensor2", token))
+
+	// Signed with some other key
+	other := newToken(t, "HS256", "", []byte("notsosecret"), map[string]interface{}{"sub": "sensor1"})
+	require.Equal(t, ErrInvalidToken, a.Authenticate("sensor1", other))
+
+	expired := newToken(t, "HS512", "", key, map[string]interface{}{
+		"sub": "sensor1",
+		"exp": time.Now().Add(-time.Minute).Unix(),
+	})
+	require.Equal(t, ErrTokenExpired, a.Authenticate("sensor1", expired))
+
+	early := newToken(t, "HS384", "", key, map[string]interface{}{
+		"sub": "sensor1",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"nbf": time.Now().Add(time.Minute).Unix(),
+	})
+	require.Equal(t, ErrInvalidToken, a.Authenticate("sensor1", early))
+
+	// Tokens that never expire are only good if allowed
+	forever := newToken(t, "HS256", "", key, map[string]interface{}{"sub": "sensor1"})
+	require.Equal(t, ErrInvalidToken, a.Authenticate("sensor1", forever))
+
+	a.AllowNoExpiry = true
+	require.NoError(t, a.Authenticate("sensor1", forever))
+	a.AllowNoExpiry = false
+
+	for _, bad := range []interface{}{"", "a.b", "a.b.c", token + "x", []byte(token), nil} {
+		require.Error(t, a.Authenticate("sensor1", bad))
+	}
+
+	// An unsigned token is never good
+	none := jwtEncode(t, map[string]string{"alg": "none"}) + "." + jwtEncode(t, map[string]string{"sub": "sensor1"}) + "."
+	require.Error(t, a.Authenticate("sensor1", none))
+}
+
+func TestJWTAuthenticatorKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	claims := map[string]interface{}{"sub": "sensor1", "exp": time.Now().Add(time.Hour).Unix()}
+
+	a := NewJWTAuthenticator(&rsaKey.PublicKey)
+	require.NoError(t, a.Authenticate("sensor1", newToken(t, "RS256", "", rsaKey, claims)))
+	require.NoError(t, a.Authenticate("sensor1", newToken(t, "RS512", "", rsaKey, claims)))
+
+	// The algorithm has to go with the key, or a public key could be used as an HMAC
+	// secret.
+	require.Error(t, a.Authenticate("sensor1", newToken(t, "HS256", "", []byte("verysecret"), claims)))
+
+	a = NewJWTAuthenticator(&ecKey.PublicKey)
+	require.NoError(t, a.Authenticate("sensor1", newToken(t, "ES256", "", ecKey, claims)))
+	require.Error(t, a.Authenticate("sensor1", newToken(t, "RS256", "", rsaKey, claims)))
+
+	// The curve has to go with the algorithm too
+	require.Equal(t, ErrInvalidToken, a.Authenticate("sensor1", newToken(t, "ES512", "", ecKey, claims)))
+	require.Equal(t, ErrInvalidToken, a.Authenticate("sensor1", newToken(t, "ES384", "", ecKey, claims)))
+
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+
+	a = NewJWTAuthenticator(&p384Key.PublicKey)
+	require.NoError(t, a.Authenticate("sensor1", newToken(t, "ES384", "", p384Key, claims)))
+	require.Equal(t, ErrInvalidToken, a.Authenticate("sensor1", newToken(t, "ES256", "", p384Key, claims)))
+}
+
+func TestJWTAuthenticatorIssuerAudience(t *testing.T) {
+	key := []byte("verysecret")
+
+	a := NewJWTAuthenticator(key)
+	a.Issuer = "https://auth.example.com"
+	a.Audience = "surgemq"
+	a.AllowNoExpiry = true
+
+	good := []map[string]interface{}{
+		{"iss": "https://auth.example.com", "aud": "surgemq"},
+		{"iss": "https://auth.example.com", "aud": []string{"other", "surgemq"}},
+	}
+
+	for _, claims := range good {
+		require.NoError(t, a.Authenticate("", newToken(t, "HS256", "", key, claims)))
+	}
+
+	bad := []map[string]interface{}{
+		{"aud": "surgemq"},
+		{"iss": "https://auth.example.com"},
+		{"iss": "https://auth.example.com", "aud": "other"},
+		{"iss": "https://other.example.com", "aud": "surgemq"},
+	}
+
+	for _, claims := range bad {
+		require.Equal(t, ErrInvalidToken, a.Authenticate("", newToken(t, "HS256", "", key, claims)))
+	}
+}
+
+func TestJWKSAuthenticator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa1", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+			{"kty": "oct", "kid": "hmac1", "k": b64([]byte("verysecret"))},
+		},
+	}
+
+	var fetches int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer ts.Close()
+
+	now := time.Now()
+
+	a := NewJWKSAuthenticator(ts.URL, time.Hour)
+	a.now = func() time.Time { return now }
+
+	claims := map[string]interface{}{"sub": "sensor1", "exp": now.Add(time.Hour * 3).Unix()}
+
+	require.NoError(t, a.Authenticate("sensor1", newToken(t, "RS256", "rsa1", rsaKey, claims)))
+	require.NoError(t, a.Authenticate("sensor1", newToken(t, "ES256", "ec1", ecKey, claims)))
+	require.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	// Only public keys are taken from the key set
+	require.Error(t, a.Authenticate("sensor1", newToken(t, "HS256", "hmac1", []byte("verysecret"), claims)))
+
+	// Signed with the RSA key, but asks for the EC one
+	require.Error(t, a.Authenticate("sensor1", newToken(t, "RS256", "ec1", rsaKey, claims)))
+
+	// An unknown key ID only gets the keys again once a minute
+	require.Error(t, a.Authenticate("sensor1", newToken(t, "RS256", "rsa2", rsaKey, claims)))
+	require.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	now = now.Add(time.Minute)
+	require.Error(t, a.Authenticate("sensor1", newToken(t, "RS256", "rsa2", rsaKey, claims)))
+	require.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+
+	// Known keys are still good while the keys are fetched again
+	now = now.Add(time.Hour)
+	require.NoError(t, a.Authenticate("sensor1", newToken(t, "RS256", "rsa1", rsaKey, claims)))
+
+	for i := 0; i < 100 && atomic.LoadInt32(&fetches) < 3; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	require.Equal(t, int32(3), atomic.LoadInt32(&fetches))
+
+	// The key set can't be fetched, so nothing is good
+	a = NewJWKSAuthenticator(ts.URL+"/nothere", time.Hour)
+	ts.Close()
+	require.Error(t, a.Authenticate("sensor1", newToken(t, "RS256", "rsa1", rsaKey, claims)))
+}
+
+// Fetching the keys again doesn't hold up the tokens signed with the known ones.
+func TestJWKSAuthenticatorSlowRefresh(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa1", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		},
+	}
+
+	var fetches int32
+
+	release := make(chan struct{})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&fetches, 1) > 1 {
+			<-release
+		}
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	now := time.Now()
+
+	a := NewJWKSAuthenticator(ts.URL, time.Minute)
+	a.now = func() time.Time { return now }
+
+	token := newToken(t, "RS256", "rsa1", rsaKey, map[string]interface{}{"sub": "sensor1", "exp": now.Add(time.Hour).Unix()})
+
+	require.NoError(t, a.Authenticate("sensor1", token))
+
+	now = now.Add(time.Minute)
+
+	for i := 0; i < 3; i++ {
+		done := make(chan error, 1)
+
+		go func() {
+			done <- a.Authenticate("sensor1", token)
+		}()
+
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+
+		case <-time.After(time.Second):
+			t.Fatal("Waiting for the keys to be fetched")
+		}
+	}
+
+	for i := 0; i < 100 && atomic.LoadInt32(&fetches) < 2; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// Only fetched once more, however many tokens came in meanwhile
+	require.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
+
+// newToken returns a JWT with the claims, signed by key using alg.
+func newToken(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+
+	signed := jwtEncode(t, header) + "." + jwtEncode(t, claims)
+
+	hash := jwtAlgs[alg]
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var sig []byte
+
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(hash.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.Hash(hash), digest)
+		require.NoError(t, err)
+
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		require.NoError(t, err)
+
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+
+	default:
+		panic(fmt.Sprintf("unexpected key %T", key))
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func jwtEncode(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -18,14 +18,24 @@ type mockAuthenticator bool
 
 var _ Authenticator = (*mockAuthenticator)(nil)
 
+type mockAuthorizer bool
+
+var _ Authorizer = (*mockAuthorizer)(nil)
+
 var (
 	mockSuccessAuthenticator mockAuthenticator = true
 	mockFailureAuthenticator mockAuthenticator = false
+
+	mockAllowAuthorizer mockAuthorizer = true
+	mockDenyAuthorizer  mockAuthorizer = false
 )
 
 func init() {
 	Register("mockSuccess", mockSuccessAuthenticator)
 	Register("mockFailure", mockFailureAuthenticator)
+
+	RegisterAuthorizer("mockAllow", mockAllowAuthorizer)
+	RegisterAuthorizer("mockDeny", mockDenyAuthorizer)
 }
 
 func (this mockAuthenticator) Authenticate(id string, cred interface{}) error {
@@ -35,3 +45,11 @@ func (this mockAuthenticator) Authenticate(id string, cred interface{}) error {
 
 	return ErrAuthFailure
 }
+
+func (this mockAuthorizer) Authorize(clientId, username string, topic []byte, access Access) error {
+	if this == true {
+		return nil
+	}
+
+	return ErrNotAuthorized
+}
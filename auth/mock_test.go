@@ -39,3 +39,102 @@ func TestMockFailureAuthenticator(t *testing.T) {
 	require.NoError(t, err)
 	require.Error(t, mgr.Authenticate("", ""))
 }
+
+func TestMockAuthorizers(t *testing.T) {
+	mgr, err := NewAuthorizerManager("mockAllow")
+	require.NoError(t, err)
+	require.NoError(t, mgr.Authorize("", "", []byte("abc"), ReadWrite))
+
+	mgr, err = NewAuthorizerManager("mockDeny")
+	require.NoError(t, err)
+	require.Equal(t, ErrNotAuthorized, mgr.Authorize("", "", []byte("abc"), Read))
+
+	_, err = NewAuthorizerManager("nothere")
+	require.Error(t, err)
+}
+
+func TestManagerSetProvider(t *testing.T) {
+	mgr, err := NewManager("mockSuccess")
+	require.NoError(t, err)
+
+	require.NoError(t, mgr.SetProvider("mockFailure"))
+	require.Error(t, mgr.Authenticate("", ""))
+	require.Error(t, mgr.SetProvider("nothere"))
+	require.Error(t, mgr.Authenticate("", ""))
+
+	amgr, err := NewAuthorizerManager("mockAllow")
+	require.NoError(t, err)
+
+	require.NoError(t, amgr.SetProvider("mockDeny"))
+	require.Equal(t, ErrNotAuthorized, amgr.Authorize("", "", []byte("abc"), Read))
+	require.Error(t, amgr.SetProvider("nothere"))
+}
+
+// echoAuthenticator authenticates the clients that send back the challenge they get
+// with the "ECHO" method.
+type echoAuthenticator struct {
+	mockAuthenticator
+}
+
+type echoExchange struct {
+	sent bool
+}
+
+func (this echoAuthenticator) StartAuth(id, method string) (AuthExchange, error) {
+	if method != "ECHO" {
+		return nil, ErrAuthMethodNotSupported
+	}
+
+	return &echoExchange{}, nil
+}
+
+func (this *echoExchange) Next(data []byte) ([]byte, bool, error) {
+	if !this.sent {
+		this.sent = true
+		return []byte("challenge"), false, nil
+	}
+
+	if string(data) != "challenge" {
+		return nil, false, ErrAuthFailure
+	}
+
+	return nil, true, nil
+}
+
+func TestManagerStartAuth(t *testing.T) {
+	mgr, err := NewManager("mockSuccess")
+	require.NoError(t, err)
+
+	_, err = mgr.StartAuth("", "ECHO")
+	require.Equal(t, ErrAuthMethodNotSupported, err)
+
+	Register("echo", echoAuthenticator{})
+	defer Unregister("echo")
+
+	mgr, err = NewManager("echo")
+	require.NoError(t, err)
+
+	_, err = mgr.StartAuth("", "SCRAM-SHA-1")
+	require.Equal(t, ErrAuthMethodNotSupported, err)
+
+	x, err := mgr.StartAuth("", "ECHO")
+	require.NoError(t, err)
+
+	resp, done, err := x.Next(nil)
+	require.NoError(t, err)
+	require.False(t, done)
+	require.Equal(t, "challenge", string(resp))
+
+	_, done, err = x.Next(resp)
+	require.NoError(t, err)
+	require.True(t, done)
+
+	x, err = mgr.StartAuth("", "ECHO")
+	require.NoError(t, err)
+
+	_, _, err = x.Next(nil)
+	require.NoError(t, err)
+
+	_, _, err = x.Next([]byte("wrong"))
+	require.Equal(t, ErrAuthFailure, err)
+}
@@ -15,57 +15,160 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/surge/glog"
+	"github.com/surgemq/surgemq/auth"
 	"github.com/surgemq/surgemq/service"
+	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/topics"
 )
 
 var (
 	keepAlive        int
+	maxKeepAlive     int
 	connectTimeout   int
 	ackTimeout       int
 	timeoutRetries   int
+	willDelay        int
+	messageTTL       time.Duration
+	slowConsumer     int // seconds a client's outgoing queue can stay full before it's disconnected, 0 to wait
 	authenticator    string
+	aclFile          string // path to the access control list file, if topics should be restricted
 	sessionsProvider string
+	sessionsDB       string        // path to the BoltDB file for the "bolt" sessions provider
+	sessionsSync     time.Duration // how often the "bolt" sessions provider writes out all sessions
 	topicsProvider   string
+	retainedDB       string // path to the BoltDB file for retained messages, if they should be kept
 	cpuprofile       string
-	wsAddr           string // HTTPS websocket address eg. :8080
-	wssAddr          string // HTTPS websocket address, eg. :8081
-	wssCertPath      string // path to HTTPS public key
-	wssKeyPath       string // path to HTTPS private key
+	configFile       string        // path to the JSON configuration file, reloaded on SIGHUP
+	wsAddr           string        // HTTPS websocket address eg. :8080
+	unixSock         string        // path to the Unix domain socket, eg. /var/run/surgemq.sock
+	proxyAddr        string        // address for clients behind a proxy sending the PROXY protocol, eg. :1885
+	wssAddr          string        // HTTPS websocket address, eg. :8081
+	wssCertPath      string        // path to HTTPS public key
+	wssKeyPath       string        // path to HTTPS private key
+	metricsAddr      string        // HTTP address for the Prometheus metrics, eg. :9090
+	adminAddr        string        // HTTP address for the admin API, eg. 127.0.0.1:9091
+	shutdownTimeout  time.Duration // how long to wait for the clients to drain when stopping
+	clusterAddr      string        // address the other cluster nodes connect to, eg. :7946
+	clusterPeers     string        // comma separated addresses of the cluster nodes
+	mqttsnAddr       string        // UDP address for MQTT-SN clients, eg. :1884
 )
 
 func init() {
 	flag.IntVar(&keepAlive, "keepalive", service.DefaultKeepAlive, "Keepalive (sec)")
+	flag.IntVar(&maxKeepAlive, "maxkeepalive", 0, "Max Keepalive (sec) clients can ask for, 0 for no maximum")
 	flag.IntVar(&connectTimeout, "connecttimeout", service.DefaultConnectTimeout, "Connect Timeout (sec)")
 	flag.IntVar(&ackTimeout, "acktimeout", service.DefaultAckTimeout, "Ack Timeout (sec)")
 	flag.IntVar(&timeoutRetries, "retries", service.DefaultTimeoutRetries, "Timeout Retries")
+	flag.IntVar(&willDelay, "willdelay", 0, "Will Delay (sec), the will isn't sent if the client reconnects before then")
+	flag.DurationVar(&messageTTL, "ttl", 0, "Message TTL, retained and offline messages are dropped once it's passed")
+	flag.IntVar(&slowConsumer, "slowconsumer", 0, "Slow Consumer Timeout (sec), QoS 0 messages to a client that isn't reading are dropped until then, 0 to wait")
 	flag.StringVar(&authenticator, "auth", service.DefaultAuthenticator, "Authenticator Type")
+	flag.StringVar(&aclFile, "acl", "", "Access control list file for restricting the topics clients can use")
 	flag.StringVar(&sessionsProvider, "sessions", service.DefaultSessionsProvider, "Session Provider Type")
+	flag.StringVar(&sessionsDB, "sessionsdb", "sessions.db", "BoltDB file for the bolt Session Provider")
+	flag.DurationVar(&sessionsSync, "sessionssync", time.Minute, "Sync interval for the bolt Session Provider, 0 to disable")
 	flag.StringVar(&topicsProvider, "topics", service.DefaultTopicsProvider, "Topics Provider Type")
+	flag.StringVar(&retainedDB, "retaineddb", "", "BoltDB file for keeping retained messages across restarts")
 	flag.StringVar(&cpuprofile, "cpuprofile", "", "CPU Profile Filename")
+	flag.StringVar(&configFile, "config", "", "JSON configuration file for the listeners, limits and auth, reloaded on SIGHUP")
 	flag.StringVar(&wsAddr, "wsaddr", "", "HTTP websocket address, eg. ':8080'")
+	flag.StringVar(&unixSock, "unixsock", "", "Unix domain socket path, eg. '/var/run/surgemq.sock'")
+	flag.StringVar(&proxyAddr, "proxyaddr", "", "Address for clients behind a proxy that sends the PROXY protocol, eg. ':1885'")
 	flag.StringVar(&wssAddr, "wssaddr", "", "HTTPS websocket address, eg. ':8081'")
 	flag.StringVar(&wssCertPath, "wsscertpath", "", "HTTPS server public key file")
 	flag.StringVar(&wssKeyPath, "wsskeypath", "", "HTTPS server private key file")
+	flag.StringVar(&metricsAddr, "metricsaddr", "", "HTTP address for Prometheus metrics at /metrics, eg. ':9090'")
+	flag.StringVar(&adminAddr, "adminaddr", "", "HTTP address for the admin API at /admin/, eg. '127.0.0.1:9091'")
+	flag.DurationVar(&shutdownTimeout, "shutdowntimeout", 10*time.Second, "How long to wait for clients to drain on shutdown")
+	flag.StringVar(&clusterAddr, "clusteraddr", "", "Address for the other cluster nodes to connect to, eg. ':7946'")
+	flag.StringVar(&clusterPeers, "clusterpeers", "", "Comma separated addresses of the cluster nodes, eg. 'node1:7946,node2:7946'")
+	flag.StringVar(&mqttsnAddr, "mqttsnaddr", "", "UDP address for MQTT-SN clients, eg. ':1884'")
 	flag.Parse()
 }
 
 func main() {
+	if sessionsProvider == "bolt" {
+		p, err := sessions.NewBoltProvider(sessionsDB, sessionsSync)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		sessions.Register("bolt", p)
+	}
+
+	if aclFile != "" {
+		a, err := auth.NewFileAuthorizer(aclFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		auth.RegisterAuthorizer("acl", a)
+	}
+
 	svr := &service.Server{
 		KeepAlive:        keepAlive,
+		MaxKeepAlive:     maxKeepAlive,
 		ConnectTimeout:   connectTimeout,
 		AckTimeout:       ackTimeout,
 		TimeoutRetries:   timeoutRetries,
+		WillDelay:        willDelay,
+		MessageTTL:       messageTTL,
 		SessionsProvider: sessionsProvider,
 		TopicsProvider:   topicsProvider,
 	}
 
+	if aclFile != "" {
+		svr.Authorizer = "acl"
+	}
+
+	if slowConsumer > 0 {
+		svr.SlowConsumer = service.DropSlowConsumer
+		svr.SlowConsumerTimeout = slowConsumer
+	}
+
+	if clusterAddr != "" {
+		svr.Cluster = &service.Cluster{
+			ListenAddr: clusterAddr,
+			Discovery:  service.NewStaticDiscovery(strings.Split(clusterPeers, ",")...),
+		}
+	}
+
+	if mqttsnAddr != "" {
+		svr.MQTTSNGateways = []*service.MQTTSNGateway{{ListenAddr: mqttsnAddr}}
+	}
+
+	if configFile != "" {
+		c, err := service.LoadConfig(configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := c.Apply(svr); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if retainedDB != "" {
+		s, err := topics.NewBoltStore(retainedDB)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		svr.RetainedStore = s
+	}
+
 	var f *os.File
 	var err error
 
@@ -78,8 +181,26 @@ func main() {
 		pprof.StartCPUProfile(f)
 	}
 
+	if configFile != "" {
+		hupchan := make(chan os.Signal, 1)
+		signal.Notify(hupchan, syscall.SIGHUP)
+
+		go func() {
+			for range hupchan {
+				c, err := service.LoadConfig(configFile)
+				if err == nil {
+					err = svr.Reload(c)
+				}
+
+				if err != nil {
+					glog.Errorf("surgemq/main: Error reloading %s: %v", configFile, err)
+				}
+			}
+		}()
+	}
+
 	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, os.Interrupt, os.Kill)
+	signal.Notify(sigchan, os.Interrupt, os.Kill, syscall.SIGTERM)
 	go func() {
 		sig := <-sigchan
 		glog.Errorf("Existing due to trapped signal; %v", sig)
@@ -90,24 +211,77 @@ func main() {
 			f.Close()
 		}
 
-		svr.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := svr.Shutdown(ctx); err != nil {
+			glog.Errorf("surgemq/main: %v", err)
+		}
 
 		os.Exit(0)
 	}()
 
 	mqttaddr := "tcp://:1883"
 
-	if len(wsAddr) > 0 || len(wssAddr) > 0 {
-		addr := "tcp://127.0.0.1:1883"
-		AddWebsocketHandler("/mqtt", addr)
-		/* start a plain websocket listener */
-		if len(wsAddr) > 0 {
-			go ListenAndServeWebsocket(wsAddr)
-		}
-		/* start a secure websocket listener */
-		if len(wssAddr) > 0 && len(wssCertPath) > 0 && len(wssKeyPath) > 0 {
-			go ListenAndServeWebsocketSecure(wssAddr, wssCertPath, wssKeyPath)
-		}
+	/* start a plain websocket listener */
+	if len(wsAddr) > 0 {
+		go func() {
+			if err := svr.ListenAndServeWebsocket("ws://" + wsAddr + "/mqtt"); err != nil {
+				glog.Errorf("surgemq/main: %v", err)
+			}
+		}()
+	}
+
+	/* start a secure websocket listener, that proxies to the plain MQTT listener */
+	if len(wssAddr) > 0 && len(wssCertPath) > 0 && len(wssKeyPath) > 0 {
+		AddWebsocketHandler("/mqtt", "tcp://127.0.0.1:1883")
+		go ListenAndServeWebsocketSecure(wssAddr, wssCertPath, wssKeyPath)
+	}
+
+	/* start a Unix domain socket listener */
+	if len(unixSock) > 0 {
+		go func() {
+			if err := svr.ListenAndServe("unix://" + unixSock); err != nil {
+				glog.Errorf("surgemq/main: %v", err)
+			}
+		}()
+	}
+
+	/* start a listener for clients behind HAProxy, AWS NLB, etc. */
+	if len(proxyAddr) > 0 {
+		svr.Listeners = append(svr.Listeners, &service.Listener{URI: "tcp://" + proxyAddr, ProxyProtocol: true})
+	}
+
+	/* start the listeners from the configuration file, and the proxy one */
+	if len(svr.Listeners) > 0 {
+		go func() {
+			if err := svr.Serve(); err != nil {
+				glog.Errorf("surgemq/main: %v", err)
+			}
+		}()
+	}
+
+	/* serve the metrics for Prometheus to scrape */
+	if len(metricsAddr) > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", svr.MetricsHandler())
+
+		go func() {
+			if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+				glog.Errorf("surgemq/main: %v", err)
+			}
+		}()
+	}
+
+	if len(adminAddr) > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/admin/", http.StripPrefix("/admin", svr.AdminHandler()))
+
+		go func() {
+			if err := http.ListenAndServe(adminAddr, mux); err != nil {
+				glog.Errorf("surgemq/main: %v", err)
+			}
+		}()
 	}
 
 	/* create plain MQTT listener */
@@ -0,0 +1,186 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logger is what the other SurgeMQ packages log through. A Logger can be
+// backed by glog, which is the default, or adapted to zap, logrus, log/slog and the
+// like.
+//
+// Each part of the server logs with a Subsystem field, e.g., "cluster" or
+// "sessions", so its messages can be told apart, or dropped with Levels.
+package logger
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/surge/glog"
+)
+
+// Subsystem is the key of the field naming the part of SurgeMQ a message is from.
+const Subsystem = "subsystem"
+
+// Level is the severity of a message.
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarningLevel
+	ErrorLevel
+
+	// OffLevel is above all the others, so nothing gets logged.
+	OffLevel
+)
+
+// Logger logs printf style messages at different levels. Implementations must be
+// safe to use from different goroutines.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+
+	// With returns a Logger that adds the fields, given as key and value pairs, to
+	// every message, after the fields this Logger already adds.
+	With(keyvals ...interface{}) Logger
+}
+
+// NewGlogLogger returns a Logger that logs with glog. The fields are added at the
+// end of each message as key=value pairs.
+func NewGlogLogger() Logger {
+	return glogLogger{}
+}
+
+type glogLogger struct {
+	fields string
+}
+
+func (this glogLogger) Debugf(format string, args ...interface{}) {
+	if this.fields == "" {
+		glog.Debugf(format, args...)
+	} else {
+		glog.Debugf(format+"%s", append(args, this.fields)...)
+	}
+}
+
+func (this glogLogger) Infof(format string, args ...interface{}) {
+	if this.fields == "" {
+		glog.Infof(format, args...)
+	} else {
+		glog.Infof(format+"%s", append(args, this.fields)...)
+	}
+}
+
+func (this glogLogger) Warningf(format string, args ...interface{}) {
+	if this.fields == "" {
+		glog.Warningf(format, args...)
+	} else {
+		glog.Warningf(format+"%s", append(args, this.fields)...)
+	}
+}
+
+func (this glogLogger) Errorf(format string, args ...interface{}) {
+	if this.fields == "" {
+		glog.Errorf(format, args...)
+	} else {
+		glog.Errorf(format+"%s", append(args, this.fields)...)
+	}
+}
+
+func (this glogLogger) With(keyvals ...interface{}) Logger {
+	var buf bytes.Buffer
+
+	buf.WriteString(this.fields)
+
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 < len(keyvals) {
+			fmt.Fprintf(&buf, " %v=%v", keyvals[i], keyvals[i+1])
+		} else {
+			fmt.Fprintf(&buf, " %v=", keyvals[i])
+		}
+	}
+
+	return glogLogger{fields: buf.String()}
+}
+
+// Levels returns a Logger that drops the messages below the level set for their
+// Subsystem in subsystems, or below min for the subsystems not in there. The rest
+// are passed on to l. E.g., to only log the errors of the sessions package:
+//
+//	logger.Levels(l, logger.DebugLevel, map[string]logger.Level{"sessions": logger.ErrorLevel})
+func Levels(l Logger, min Level, subsystems map[string]Level) Logger {
+	return levelLogger{l: l, min: min, subsystems: subsystems}
+}
+
+type levelLogger struct {
+	l          Logger
+	min        Level
+	subsystems map[string]Level
+}
+
+func (this levelLogger) Debugf(format string, args ...interface{}) {
+	if this.min <= DebugLevel {
+		this.l.Debugf(format, args...)
+	}
+}
+
+func (this levelLogger) Infof(format string, args ...interface{}) {
+	if this.min <= InfoLevel {
+		this.l.Infof(format, args...)
+	}
+}
+
+func (this levelLogger) Warningf(format string, args ...interface{}) {
+	if this.min <= WarningLevel {
+		this.l.Warningf(format, args...)
+	}
+}
+
+func (this levelLogger) Errorf(format string, args ...interface{}) {
+	if this.min <= ErrorLevel {
+		this.l.Errorf(format, args...)
+	}
+}
+
+func (this levelLogger) With(keyvals ...interface{}) Logger {
+	min := this.min
+
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] != Subsystem {
+			continue
+		}
+
+		if s, ok := keyvals[i+1].(string); ok {
+			if lvl, ok := this.subsystems[s]; ok {
+				min = lvl
+			}
+		}
+	}
+
+	return levelLogger{l: this.l.With(keyvals...), min: min, subsystems: this.subsystems}
+}
+
+// Discard is a Logger that drops every message.
+var Discard Logger = discardLogger{}
+
+type discardLogger struct{}
+
+func (discardLogger) Debugf(format string, args ...interface{})   {}
+func (discardLogger) Infof(format string, args ...interface{})    {}
+func (discardLogger) Warningf(format string, args ...interface{}) {}
+func (discardLogger) Errorf(format string, args ...interface{})   {}
+
+func (this discardLogger) With(keyvals ...interface{}) Logger {
+	return this
+}
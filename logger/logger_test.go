@@ -0,0 +1,96 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordLogger struct {
+	lines  *[]string
+	fields string
+}
+
+func (this recordLogger) log(level, format string, args ...interface{}) {
+	*this.lines = append(*this.lines, level+" "+fmt.Sprintf(format, args...)+this.fields)
+}
+
+func (this recordLogger) Debugf(format string, args ...interface{}) {
+	this.log("D", format, args...)
+}
+
+func (this recordLogger) Infof(format string, args ...interface{}) {
+	this.log("I", format, args...)
+}
+
+func (this recordLogger) Warningf(format string, args ...interface{}) {
+	this.log("W", format, args...)
+}
+
+func (this recordLogger) Errorf(format string, args ...interface{}) {
+	this.log("E", format, args...)
+}
+
+func (this recordLogger) With(keyvals ...interface{}) Logger {
+	return recordLogger{lines: this.lines, fields: this.fields + fmt.Sprint(keyvals)}
+}
+
+func TestLevels(t *testing.T) {
+	var lines []string
+
+	l := Levels(recordLogger{lines: &lines}, InfoLevel, map[string]Level{
+		"sessions": ErrorLevel,
+		"cluster":  DebugLevel,
+	})
+
+	l.Debugf("dropped")
+	l.Infof("kept %d", 1)
+
+	s := l.With(Subsystem, "sessions")
+	s.Warningf("dropped")
+	s.Errorf("kept %d", 2)
+
+	c := l.With(Subsystem, "cluster")
+	c.Debugf("kept %d", 3)
+
+	o := l.With(Subsystem, "other", "node", "a")
+	o.Debugf("dropped")
+	o.Warningf("kept %d", 4)
+
+	require.Equal(t, []string{
+		"I kept 1",
+		"E kept 2[subsystem sessions]",
+		"D kept 3[subsystem cluster]",
+		"W kept 4[subsystem other node a]",
+	}, lines)
+}
+
+func TestLevelsOff(t *testing.T) {
+	var lines []string
+
+	l := Levels(recordLogger{lines: &lines}, OffLevel, nil)
+	l.Errorf("dropped")
+	l.With(Subsystem, "server").Errorf("dropped")
+
+	require.Empty(t, lines)
+}
+
+func TestDiscard(t *testing.T) {
+	Discard.Errorf("dropped")
+	require.Equal(t, Discard, Discard.With(Subsystem, "server"))
+}
@@ -0,0 +1,308 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+// AdminSubscription is a topic filter a client is subscribed to, and the QoS.
+type AdminSubscription struct {
+	Topic string `json:"topic"`
+	Qos   byte   `json:"qos"`
+}
+
+// AdminSession is the state of a client's session, as the admin API shows it.
+type AdminSession struct {
+	ClientId string `json:"client_id"`
+
+	// Connected is true if the client is connected to this server.
+	Connected bool `json:"connected"`
+
+	Subscriptions []AdminSubscription `json:"subscriptions"`
+
+	// The number of QoS 1 and 2 messages sent to the client that it hasn't acked yet,
+	// and of QoS 2 messages from the client waiting for PUBREL.
+	InflightOut int `json:"inflight_out"`
+	InflightIn  int `json:"inflight_in"`
+
+	// The number of messages queued while the client is away, or waiting for room in
+	// its inflight window while it's connected, and whether the queue overflowed.
+	Queued     int  `json:"queued"`
+	Overflowed bool `json:"overflowed,omitempty"`
+}
+
+// AdminClient is a connected client, as the admin API shows it.
+type AdminClient struct {
+	AdminSession
+
+	Username    string    `json:"username,omitempty"`
+	RemoteAddr  string    `json:"remote_addr,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	KeepAlive   int       `json:"keep_alive"`
+}
+
+// AdminRetained is a retained message, as the admin API shows it. The payload is
+// base64 encoded in the JSON.
+type AdminRetained struct {
+	Topic   string `json:"topic"`
+	Qos     byte   `json:"qos"`
+	Payload []byte `json:"payload"`
+}
+
+// AdminHandler returns an HTTP handler for operating the server. All the responses
+// are JSON. It's up to the caller to serve it, and to keep it away from the clients,
+// e.g., http.Handle("/admin/", http.StripPrefix("/admin", svr.AdminHandler())) on
+// a port only reachable by the operators. It serves:
+//
+//	GET    /clients           Lists the connected clients, as []AdminClient
+//	GET    /clients/{id}      Shows a connected client, as AdminClient
+//	DELETE /clients/{id}      Disconnects a client. Its will is published, and its
+//	                          session is kept if it's persistent.
+//	GET    /sessions/{id}     Shows the session of a client, connected or not, as
+//	                          AdminSession
+//	GET    /retained?filter=  Lists the retained messages matching the topic filter,
+//	                          or all of them if there's no filter, as []AdminRetained
+//	DELETE /retained?topic=   Deletes the retained message of the topic
+//	GET    /stats             Shows the traffic of the clients and topics, as Stats
+func (this *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/clients", this.adminClients)
+	mux.HandleFunc("/clients/", this.adminClient)
+	mux.HandleFunc("/sessions/", this.adminSession)
+	mux.HandleFunc("/retained", this.adminRetained)
+	mux.HandleFunc("/stats", this.adminStats)
+
+	return mux
+}
+
+func (this *Server) adminClients(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		adminMethodNotAllowed(w, "GET")
+		return
+	}
+
+	clients := []*AdminClient{}
+
+	for _, svc := range this.services() {
+		if !svc.isStopped() {
+			clients = append(clients, newAdminClient(svc))
+		}
+	}
+
+	sort.Sort(adminClientsById(clients))
+
+	this.adminReply(w, clients)
+}
+
+func (this *Server) adminClient(w http.ResponseWriter, req *http.Request) {
+	cid := strings.TrimPrefix(req.URL.Path, "/clients/")
+
+	svc := this.connected(cid)
+
+	switch req.Method {
+	case "GET":
+		if svc == nil {
+			http.Error(w, "Client not connected", http.StatusNotFound)
+			return
+		}
+
+		this.adminReply(w, newAdminClient(svc))
+
+	case "DELETE":
+		if svc == nil {
+			http.Error(w, "Client not connected", http.StatusNotFound)
+			return
+		}
+
+		this.log.Infof("(%s) server/adminClient: Disconnecting client", cid)
+		svc.stop()
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		adminMethodNotAllowed(w, "GET, DELETE")
+	}
+}
+
+func (this *Server) adminSession(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		adminMethodNotAllowed(w, "GET")
+		return
+	}
+
+	cid := strings.TrimPrefix(req.URL.Path, "/sessions/")
+
+	sess, err := this.sessMgr.Get(cid)
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	s := newAdminSession(sess)
+	s.Connected = this.connected(cid) != nil
+
+	this.adminReply(w, s)
+}
+
+func (this *Server) adminRetained(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		filter := req.URL.Query().Get("filter")
+		if filter == "" {
+			filter = "#"
+		}
+
+		var msgs []*message.PublishMessage
+
+		if err := this.topicsMgr.Retained([]byte(filter), &msgs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		retained := make([]*AdminRetained, 0, len(msgs))
+
+		for _, msg := range msgs {
+			retained = append(retained, &AdminRetained{
+				Topic:   string(msg.Topic()),
+				Qos:     msg.QoS(),
+				Payload: msg.Payload(),
+			})
+		}
+
+		this.adminReply(w, retained)
+
+	case "DELETE":
+		topic := req.URL.Query().Get("topic")
+		if topic == "" {
+			http.Error(w, "No topic", http.StatusBadRequest)
+			return
+		}
+
+		// Retaining a message with no payload deletes the one retained
+		msg := message.NewPublishMessage()
+		msg.SetRetain(true)
+
+		if err := msg.SetTopic([]byte(topic)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := this.topicsMgr.Retain(msg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		adminMethodNotAllowed(w, "GET, DELETE")
+	}
+}
+
+func (this *Server) adminStats(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		adminMethodNotAllowed(w, "GET")
+		return
+	}
+
+	this.adminReply(w, this.Stats())
+}
+
+// connected returns the service of the client if it's connected, or nil.
+func (this *Server) connected(cid string) *service {
+	for _, svc := range this.services() {
+		if !svc.isStopped() && svc.info != nil && svc.info.ClientId == cid {
+			return svc
+		}
+	}
+
+	return nil
+}
+
+func newAdminClient(svc *service) *AdminClient {
+	c := &AdminClient{
+		AdminSession: *newAdminSession(svc.sess),
+
+		Username:    svc.info.Username,
+		ConnectedAt: svc.info.ConnectedAt,
+		KeepAlive:   svc.keepAlive,
+	}
+
+	c.Connected = true
+
+	if svc.info.RemoteAddr != nil {
+		c.RemoteAddr = svc.info.RemoteAddr.String()
+	}
+
+	return c
+}
+
+func newAdminSession(sess *sessions.Session) *AdminSession {
+	s := &AdminSession{
+		ClientId:      sess.ID(),
+		Subscriptions: []AdminSubscription{},
+		InflightOut:   sess.Pub1ack.Len() + sess.Pub2out.Len(),
+		InflightIn:    sess.Pub2in.Len(),
+	}
+
+	if topics, qoss, err := sess.Topics(); err == nil {
+		for i, t := range topics {
+			s.Subscriptions = append(s.Subscriptions, AdminSubscription{Topic: t, Qos: qoss[i]})
+		}
+	}
+
+	sort.Sort(adminSubscriptionsByTopic(s.Subscriptions))
+
+	if sess.Offline != nil {
+		s.Queued = sess.Offline.Len()
+		s.Overflowed = sess.Offline.Overflowed()
+	}
+
+	return s
+}
+
+func (this *Server) adminReply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		this.log.Errorf("server/adminReply: Error writing response: %v", err)
+	}
+}
+
+func adminMethodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+type adminClientsById []*AdminClient
+
+func (this adminClientsById) Len() int           { return len(this) }
+func (this adminClientsById) Less(i, j int) bool { return this[i].ClientId < this[j].ClientId }
+func (this adminClientsById) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
+
+type adminSubscriptionsByTopic []AdminSubscription
+
+func (this adminSubscriptionsByTopic) Len() int           { return len(this) }
+func (this adminSubscriptionsByTopic) Less(i, j int) bool { return this[i].Topic < this[j].Topic }
+func (this adminSubscriptionsByTopic) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
@@ -0,0 +1,139 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+// adminRequest sends a request to the admin API and decodes the JSON response into v,
+// if it's not nil. It returns the response status.
+func adminRequest(t *testing.T, method, u string, v interface{}) int {
+	req, err := http.NewRequest(method, u, nil)
+	require.NoError(t, err)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	if v != nil && resp.StatusCode == http.StatusOK {
+		require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+
+	return resp.StatusCode
+}
+
+func TestServerAdmin(t *testing.T) {
+	svr, done := startNamedServer(t, "admin", "tcp://127.0.0.1:1883", &Server{})
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	hs := httptest.NewServer(svr.AdminHandler())
+	defer hs.Close()
+
+	conn := dialNamedServer(t, "127.0.0.1:1883", "abc")
+	defer conn.Close()
+
+	// A persistent session, for a client that's not connected
+	pmsg := newPersistentConnectMessage()
+	pcid := string(pmsg.ClientId())
+
+	pconn, _ := connectRawMessage(t, "tcp://127.0.0.1:1883", pmsg)
+	require.NoError(t, writeMessage(pconn, newSubscribeMessage(1)))
+	expectMessage(t, pconn, message.SUBACK)
+	pconn.Close()
+
+	var cid string
+
+	for i := 0; i < 100 && cid == ""; i++ {
+		var clients []*AdminClient
+		require.Equal(t, http.StatusOK, adminRequest(t, "GET", hs.URL+"/clients", &clients))
+
+		if len(clients) == 1 {
+			require.Equal(t, "surgemq", clients[0].Username)
+			require.True(t, clients[0].Connected)
+			require.Equal(t, []AdminSubscription{{Topic: "abc", Qos: 1}}, clients[0].Subscriptions)
+			require.NotEqual(t, "", clients[0].RemoteAddr)
+			require.False(t, clients[0].ConnectedAt.IsZero())
+
+			cid = clients[0].ClientId
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	require.NotEqual(t, pcid, cid)
+	require.NotEqual(t, "", cid, "Expecting only one client to be connected")
+
+	var client AdminClient
+	require.Equal(t, http.StatusOK, adminRequest(t, "GET", hs.URL+"/clients/"+cid, &client))
+	require.Equal(t, cid, client.ClientId)
+
+	require.Equal(t, http.StatusNotFound, adminRequest(t, "GET", hs.URL+"/clients/"+pcid, nil))
+	require.Equal(t, http.StatusMethodNotAllowed, adminRequest(t, "POST", hs.URL+"/clients", nil))
+
+	// The session of the client that's away has the messages queued for it
+	require.NoError(t, svr.Publish(newPublishMessage(0, 1), nil))
+	expectPublish(t, conn, "abc", 1)
+
+	var sess AdminSession
+	require.Equal(t, http.StatusOK, adminRequest(t, "GET", hs.URL+"/sessions/"+pcid, &sess))
+	require.False(t, sess.Connected)
+	require.Equal(t, 1, sess.Queued)
+	require.Equal(t, []AdminSubscription{{Topic: "abc", Qos: 1}}, sess.Subscriptions)
+
+	require.Equal(t, http.StatusNotFound, adminRequest(t, "GET", hs.URL+"/sessions/nobody", nil))
+
+	// Retained messages
+	for _, topic := range []string{"r/1", "r/2", "s/1"} {
+		pub := newPublishMessage(0, 0)
+		pub.SetTopic([]byte(topic))
+		pub.SetRetain(true)
+		require.NoError(t, svr.Publish(pub, nil))
+	}
+
+	var retained []*AdminRetained
+	require.Equal(t, http.StatusOK, adminRequest(t, "GET", hs.URL+"/retained?filter="+url.QueryEscape("r/+"), &retained))
+	require.Equal(t, 2, len(retained))
+	require.Equal(t, "abc", string(retained[0].Payload))
+
+	require.Equal(t, http.StatusNoContent, adminRequest(t, "DELETE", hs.URL+"/retained?topic=r/1", nil))
+
+	retained = nil
+	require.Equal(t, http.StatusOK, adminRequest(t, "GET", hs.URL+"/retained", &retained))
+	require.Equal(t, 2, len(retained))
+
+	for _, r := range retained {
+		require.NotEqual(t, "r/1", r.Topic)
+	}
+
+	// Kicking the client out
+	require.Equal(t, http.StatusNoContent, adminRequest(t, "DELETE", hs.URL+"/clients/"+cid, nil))
+	expectClosed(t, conn)
+
+	require.Equal(t, http.StatusNotFound, adminRequest(t, "GET", hs.URL+"/clients/"+cid, nil))
+}
@@ -0,0 +1,319 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBanned is returned by handleConnection when the client is turned away because
+// its client ID, username or address is banned.
+var ErrBanned = errors.New("service: Client is banned")
+
+// BanKind is what a Ban applies to.
+type BanKind string
+
+const (
+	BanKindClientID BanKind = "client_id"
+	BanKindUsername BanKind = "username"
+	BanKindAddr     BanKind = "addr"
+)
+
+// Ban is a client ID, username or CIDR range that's not allowed to connect.
+type Ban struct {
+	Kind  BanKind `json:"kind"`
+	Value string  `json:"value"`
+
+	// When the ban is lifted, the zero time if it never is
+	Expires time.Time `json:"expires"`
+}
+
+// bans are the bans of a server. Expired bans are ignored, and removed the next time
+// a ban is added.
+type bans struct {
+	ids   map[string]time.Time
+	users map[string]time.Time
+	nets  map[string]banNet
+	mu    sync.RWMutex
+}
+
+type banNet struct {
+	ipnet   *net.IPNet
+	expires time.Time
+}
+
+// BanClientID stops the client ID from connecting, for as long as d, or for good if
+// d is 0. The client connected with it, if any, is disconnected.
+func (this *Server) BanClientID(id string, d time.Duration) {
+	this.bans.add(BanKindClientID, id, nil, banExpiry(d))
+	this.kickBanned()
+}
+
+// BanUsername stops the clients authenticated as username from connecting, for as
+// long as d, or for good if d is 0. The ones connected already are disconnected.
+func (this *Server) BanUsername(username string, d time.Duration) {
+	this.bans.add(BanKindUsername, username, nil, banExpiry(d))
+	this.kickBanned()
+}
+
+// BanAddr stops the clients at addr, an IP address or a CIDR range such as
+// "10.0.0.0/8", from connecting, for as long as d, or for good if d is 0. Their
+// connections are closed as soon as they are accepted, without reading the CONNECT
+// message. The ones connected already are disconnected.
+func (this *Server) BanAddr(addr string, d time.Duration) error {
+	ipnet, err := parseBanAddr(addr)
+	if err != nil {
+		return err
+	}
+
+	this.bans.add(BanKindAddr, ipnet.String(), ipnet, banExpiry(d))
+	this.kickBanned()
+
+	return nil
+}
+
+// Unban lifts a ban added by BanClientID, BanUsername or BanAddr. It returns false
+// if there was no such ban.
+func (this *Server) Unban(kind BanKind, value string) bool {
+	if kind == BanKindAddr {
+		ipnet, err := parseBanAddr(value)
+		if err != nil {
+			return false
+		}
+
+		value = ipnet.String()
+	}
+
+	return this.bans.remove(kind, value)
+}
+
+// Bans returns the bans that have not expired yet, sorted by kind and value.
+func (this *Server) Bans() []Ban {
+	return this.bans.list(time.Now())
+}
+
+// kickBanned disconnects the connected clients that are banned.
+func (this *Server) kickBanned() {
+	for _, svc := range this.services() {
+		if svc.info == nil {
+			continue
+		}
+
+		if this.bans.banned(svc.info.ClientId, svc.info.Username, svc.remoteIP(), time.Now()) {
+			this.log.Infof("(%s) server/kickBanned: Disconnecting banned client", svc.cid())
+			svc.stop()
+		}
+	}
+}
+
+// remoteIP returns the IP address of the client, or "" if it's not known.
+func (this *service) remoteIP() string {
+	if conn, ok := this.conn.(net.Conn); ok {
+		return remoteIP(conn)
+	}
+
+	return ""
+}
+
+func banExpiry(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(d)
+}
+
+func banExpired(expires, now time.Time) bool {
+	return !expires.IsZero() && !now.Before(expires)
+}
+
+// parseBanAddr returns the range for a CIDR range, or for a single IP address.
+func parseBanAddr(addr string) (*net.IPNet, error) {
+	if strings.Contains(addr, "/") {
+		_, ipnet, err := net.ParseCIDR(addr)
+		return ipnet, err
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, &net.ParseError{Type: "IP address", Text: addr}
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func (this *bans) add(kind BanKind, value string, ipnet *net.IPNet, expires time.Time) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.ids == nil {
+		this.ids = make(map[string]time.Time)
+		this.users = make(map[string]time.Time)
+		this.nets = make(map[string]banNet)
+	}
+
+	this.prune(time.Now())
+
+	switch kind {
+	case BanKindClientID:
+		this.ids[value] = expires
+
+	case BanKindUsername:
+		this.users[value] = expires
+
+	case BanKindAddr:
+		this.nets[value] = banNet{ipnet: ipnet, expires: expires}
+	}
+}
+
+func (this *bans) remove(kind BanKind, value string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var ok bool
+
+	switch kind {
+	case BanKindClientID:
+		_, ok = this.ids[value]
+		delete(this.ids, value)
+
+	case BanKindUsername:
+		_, ok = this.users[value]
+		delete(this.users, value)
+
+	case BanKindAddr:
+		_, ok = this.nets[value]
+		delete(this.nets, value)
+	}
+
+	return ok
+}
+
+// prune removes the bans that have expired by now. The caller must hold mu.
+func (this *bans) prune(now time.Time) {
+	for id, expires := range this.ids {
+		if banExpired(expires, now) {
+			delete(this.ids, id)
+		}
+	}
+
+	for user, expires := range this.users {
+		if banExpired(expires, now) {
+			delete(this.users, user)
+		}
+	}
+
+	for k, n := range this.nets {
+		if banExpired(n.expires, now) {
+			delete(this.nets, k)
+		}
+	}
+}
+
+// banned returns true if any of the client ID, the username or the IP address is
+// banned at now. Empty ones are not checked.
+func (this *bans) banned(id, username, ip string, now time.Time) bool {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	if expires, ok := this.ids[id]; ok && id != "" && !banExpired(expires, now) {
+		return true
+	}
+
+	if expires, ok := this.users[username]; ok && username != "" && !banExpired(expires, now) {
+		return true
+	}
+
+	return this.addrBanned(ip, now)
+}
+
+// addrBanned returns true if the IP address is in a range banned at now. The caller
+// must hold mu.
+func (this *bans) addrBanned(ip string, now time.Time) bool {
+	if len(this.nets) == 0 {
+		return false
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, n := range this.nets {
+		if n.ipnet.Contains(addr) && !banExpired(n.expires, now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bannedAddr is addrBanned for the accept path.
+func (this *bans) bannedAddr(ip string, now time.Time) bool {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return this.addrBanned(ip, now)
+}
+
+func (this *bans) list(now time.Time) []Ban {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	bans := []Ban{}
+
+	for id, expires := range this.ids {
+		if !banExpired(expires, now) {
+			bans = append(bans, Ban{Kind: BanKindClientID, Value: id, Expires: expires})
+		}
+	}
+
+	for user, expires := range this.users {
+		if !banExpired(expires, now) {
+			bans = append(bans, Ban{Kind: BanKindUsername, Value: user, Expires: expires})
+		}
+	}
+
+	for k, n := range this.nets {
+		if !banExpired(n.expires, now) {
+			bans = append(bans, Ban{Kind: BanKindAddr, Value: k, Expires: n.expires})
+		}
+	}
+
+	sort.Sort(bansByKind(bans))
+
+	return bans
+}
+
+type bansByKind []Ban
+
+func (this bansByKind) Len() int      { return len(this) }
+func (this bansByKind) Swap(i, j int) { this[i], this[j] = this[j], this[i] }
+func (this bansByKind) Less(i, j int) bool {
+	if this[i].Kind != this[j].Kind {
+		return this[i].Kind < this[j].Kind
+	}
+
+	return this[i].Value < this[j].Value
+}
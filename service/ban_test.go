@@ -0,0 +1,129 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestServerBan(t *testing.T) {
+	svr, done := startNamedServer(t, "bans", "tcp://127.0.0.1:1883", &Server{})
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	// Wait for the server to be up
+	dialNamedServer(t, "127.0.0.1:1883", "x").Close()
+
+	connect := func(cid string) (net.Conn, message.ConnackCode) {
+		cmsg := newConnectMessage()
+		cmsg.SetClientId([]byte(cid))
+
+		conn, err := net.Dial("tcp", "127.0.0.1:1883")
+		require.NoError(t, err)
+
+		require.NoError(t, writeMessage(conn, cmsg))
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		connack, err := getConnackMessage(conn, 0)
+		require.NoError(t, err)
+
+		return conn, connack.ReturnCode()
+	}
+
+	// Connected clients are disconnected, and can't come back
+	conn, code := connect("banned")
+	defer conn.Close()
+	require.Equal(t, message.ConnectionAccepted, code)
+
+	svr.BanClientID("banned", 0)
+	expectClosed(t, conn)
+
+	conn, code = connect("banned")
+	defer conn.Close()
+	require.Equal(t, message.ErrNotAuthorized, code)
+	expectClosed(t, conn)
+
+	// Others are fine
+	conn, code = connect("other")
+	defer conn.Close()
+	require.Equal(t, message.ConnectionAccepted, code)
+
+	require.Equal(t, []Ban{{Kind: BanKindClientID, Value: "banned"}}, svr.Bans())
+
+	require.True(t, svr.Unban(BanKindClientID, "banned"))
+	require.False(t, svr.Unban(BanKindClientID, "banned"))
+
+	conn2, code := connect("banned")
+	defer conn2.Close()
+	require.Equal(t, message.ConnectionAccepted, code)
+
+	// Addresses are turned away before the CONNECT, until the ban expires
+	require.Error(t, svr.BanAddr("not an address", 0))
+	require.NoError(t, svr.BanAddr("127.0.0.0/8", time.Millisecond*300))
+
+	expectClosed(t, conn)
+	expectClosed(t, conn2)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:1883")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, newConnectMessage()))
+	expectClosed(t, conn)
+
+	time.Sleep(time.Millisecond * 300)
+
+	require.Empty(t, svr.Bans())
+
+	conn, code = connect("other")
+	defer conn.Close()
+	require.Equal(t, message.ConnectionAccepted, code)
+
+	// And usernames once they're authenticated
+	svr.BanUsername("surgemq", time.Minute)
+	expectClosed(t, conn)
+
+	conn, code = connect("other")
+	defer conn.Close()
+	require.Equal(t, message.ErrNotAuthorized, code)
+}
+
+func TestParseBanAddr(t *testing.T) {
+	for addr, want := range map[string]string{
+		"10.1.2.3":    "10.1.2.3/32",
+		"10.1.2.3/8":  "10.0.0.0/8",
+		"::1":         "::1/128",
+		"fd00::/8":    "fd00::/8",
+		"10.1.2":      "",
+		"10.1.2.3/33": "",
+	} {
+		ipnet, err := parseBanAddr(addr)
+		if want == "" {
+			require.Error(t, err, addr)
+			continue
+		}
+
+		require.NoError(t, err, addr)
+		require.Equal(t, want, ipnet.String())
+	}
+}
@@ -0,0 +1,449 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logger"
+)
+
+const (
+	DefaultBridgeClientId   = "surgemq-bridge"
+	DefaultBridgeKeepAlive  = 60
+	DefaultBridgeMinBackoff = time.Second
+	DefaultBridgeMaxBackoff = time.Minute * 2
+)
+
+// The most messages a bridge remembers having sent to the remote broker on a
+// BridgeBoth topic, waiting for them to come back so they can be dropped.
+const maxBridgeEchoes = 1024
+
+var errBridgeNotConnected = errors.New("Bridge is not connected")
+
+// BridgeDirection is the way a Bridge forwards the messages of a BridgeTopic.
+type BridgeDirection int
+
+const (
+	// BridgeOut forwards the messages published on this server to the remote broker.
+	BridgeOut BridgeDirection = iota
+
+	// BridgeIn forwards the messages published on the remote broker to this server.
+	BridgeIn
+
+	// BridgeBoth forwards the messages both ways. Messages that came from the other
+	// side are not sent back.
+	BridgeBoth
+)
+
+// BridgeTopic is a topic filter whose messages are forwarded by a Bridge, like the
+// "topic" lines of a mosquitto bridge.
+type BridgeTopic struct {
+	// Filter is the topic filter of the messages to forward, without the prefixes.
+	Filter string
+
+	// Direction is the way the messages are forwarded.
+	Direction BridgeDirection
+
+	// Qos is the highest QoS the messages are forwarded with. Messages published with
+	// a higher QoS are forwarded with this one instead.
+	Qos byte
+
+	// LocalPrefix and RemotePrefix are put in front of Filter on this server and on
+	// the remote broker. When a message is forwarded, the prefix of the side it came
+	// from is replaced by the prefix of the other side. For example, with a Filter
+	// of "sensors/#", a LocalPrefix of "site1/" and no RemotePrefix, a message
+	// published on "site1/sensors/temp" here is published on "sensors/temp" on the
+	// remote broker.
+	LocalPrefix  string
+	RemotePrefix string
+}
+
+// Bridge connects the server, as a client, to a remote MQTT broker and forwards the
+// messages of its topics from one to the other. If the connection to the remote
+// broker is lost, it keeps trying to connect again, waiting twice as long after each
+// failed attempt, from MinBackoff up to MaxBackoff. Messages to forward to the remote
+// broker while it's not connected are dropped.
+//
+// Only TCP connections to the remote broker are supported, i.e., the URI scheme must
+// be "tcp".
+type Bridge struct {
+	// URI is where the remote broker is, e.g., "tcp://10.0.0.1:1883".
+	URI string
+
+	// ClientId is the client ID the bridge connects to the remote broker with. It has
+	// to be unique across the bridges of the server. If not set then default to
+	// "surgemq-bridge".
+	ClientId string
+
+	// Username and Password are sent to the remote broker in the CONNECT message, if
+	// set.
+	Username string
+	Password string
+
+	// CleanSession is the CleanSession flag sent to the remote broker. If not set
+	// then the remote broker keeps the bridge's session while it's disconnected.
+	CleanSession bool
+
+	// The number of seconds to keep the connection to the remote broker live if
+	// there's no data. If not set then default to 60 seconds.
+	KeepAlive int
+
+	// How long to wait before trying to connect again, at first and at most. If not
+	// set then default to 1 second and 2 minutes.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Topics are the topic filters whose messages are forwarded.
+	Topics []BridgeTopic
+
+	svr *Server
+	log logger.Logger
+
+	// The client connected to the remote broker, nil while it's not connected.
+	// Protected by mu.
+	client *Client
+	mu     sync.RWMutex
+
+	// The functions subscribed on this server and on the remote broker, one for each
+	// of Topics. Only the ones for the topic's direction are subscribed.
+	outs []OnPublishFunc
+	ins  []OnPublishFunc
+
+	// The messages from the remote broker being published on this server right now,
+	// so they're not forwarded back. Protected by imu.
+	inbound map[*message.PublishMessage]struct{}
+	imu     sync.Mutex
+
+	// The messages sent to the remote broker on BridgeBoth topics, by remote topic
+	// and payload, that the remote broker will send back. Protected by emu.
+	echoes map[string]int
+	emu    sync.Mutex
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (this *Bridge) checkConfiguration() error {
+	if this.URI == "" {
+		return fmt.Errorf("bridge/checkConfiguration: No URI")
+	}
+
+	if len(this.Topics) == 0 {
+		return fmt.Errorf("bridge/checkConfiguration: (%s) No topics", this.URI)
+	}
+
+	for _, t := range this.Topics {
+		if t.Filter == "" {
+			return fmt.Errorf("bridge/checkConfiguration: (%s) Empty topic filter", this.URI)
+		}
+
+		if !message.ValidQos(t.Qos) {
+			return fmt.Errorf("bridge/checkConfiguration: (%s) Invalid QoS %d for topic %q", this.URI, t.Qos, t.Filter)
+		}
+
+		if t.Direction < BridgeOut || t.Direction > BridgeBoth {
+			return fmt.Errorf("bridge/checkConfiguration: (%s) Invalid direction %d for topic %q", this.URI, t.Direction, t.Filter)
+		}
+	}
+
+	if this.ClientId == "" {
+		this.ClientId = DefaultBridgeClientId
+	}
+
+	if this.KeepAlive == 0 {
+		this.KeepAlive = DefaultBridgeKeepAlive
+	}
+
+	if this.MinBackoff == 0 {
+		this.MinBackoff = DefaultBridgeMinBackoff
+	}
+
+	if this.MaxBackoff == 0 {
+		this.MaxBackoff = DefaultBridgeMaxBackoff
+	}
+
+	if this.MaxBackoff < this.MinBackoff {
+		this.MaxBackoff = this.MinBackoff
+	}
+
+	return nil
+}
+
+// start subscribes to the topics forwarded out on the server, and starts connecting
+// to the remote broker.
+func (this *Bridge) start(svr *Server) error {
+	this.svr = svr
+	this.log = svr.Logger.With(logger.Subsystem, "bridge")
+	this.inbound = make(map[*message.PublishMessage]struct{})
+	this.echoes = make(map[string]int)
+	this.quit = make(chan struct{})
+
+	this.outs = make([]OnPublishFunc, len(this.Topics))
+	this.ins = make([]OnPublishFunc, len(this.Topics))
+
+	for i := range this.Topics {
+		t := &this.Topics[i]
+
+		this.outs[i] = func(msg *message.PublishMessage) error {
+			return this.forwardOut(t, msg)
+		}
+
+		this.ins[i] = func(msg *message.PublishMessage) error {
+			return this.forwardIn(t, msg)
+		}
+
+		if t.Direction == BridgeIn {
+			continue
+		}
+
+		// Subscribed with the highest QoS so messages with a higher QoS than the
+		// topic's aren't skipped. They're capped when forwarded instead.
+		if _, err := svr.topicsMgr.Subscribe([]byte(t.LocalPrefix+t.Filter), message.QosExactlyOnce, &this.outs[i]); err != nil {
+			this.unsubscribe()
+			return fmt.Errorf("bridge/start: (%s) Error subscribing to %q: %v", this.URI, t.LocalPrefix+t.Filter, err)
+		}
+	}
+
+	this.wg.Add(1)
+	go this.run()
+
+	return nil
+}
+
+// stop disconnects from the remote broker and stops forwarding messages.
+func (this *Bridge) stop() {
+	select {
+	case <-this.quit:
+		return
+
+	default:
+	}
+
+	close(this.quit)
+	this.wg.Wait()
+
+	this.unsubscribe()
+}
+
+func (this *Bridge) unsubscribe() {
+	for i, t := range this.Topics {
+		if t.Direction != BridgeIn {
+			this.svr.topicsMgr.Unsubscribe([]byte(t.LocalPrefix+t.Filter), &this.outs[i])
+		}
+	}
+}
+
+// run keeps the bridge connected to the remote broker until it's stopped.
+func (this *Bridge) run() {
+	defer this.wg.Done()
+
+	backoff := this.MinBackoff
+
+	for {
+		c, err := this.connect()
+		if err != nil {
+			this.log.Errorf("bridge/run: (%s) Error connecting: %v; retrying in %v", this.URI, err, backoff)
+		} else {
+			this.log.Infof("bridge/run: (%s) Connected", this.URI)
+			backoff = this.MinBackoff
+
+			select {
+			case <-this.quit:
+				this.disconnect(c)
+				return
+
+			case <-c.svc.stopped:
+			}
+
+			this.disconnect(c)
+			this.log.Errorf("bridge/run: (%s) Connection lost; retrying in %v", this.URI, backoff)
+		}
+
+		select {
+		case <-this.quit:
+			return
+
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > this.MaxBackoff {
+			backoff = this.MaxBackoff
+		}
+	}
+}
+
+// connect connects to the remote broker and subscribes to the topics forwarded in.
+func (this *Bridge) connect() (*Client, error) {
+	msg := message.NewConnectMessage()
+	msg.SetVersion(4)
+	msg.SetCleanSession(this.CleanSession)
+	msg.SetKeepAlive(uint16(this.KeepAlive))
+
+	if err := msg.SetClientId([]byte(this.ClientId)); err != nil {
+		return nil, err
+	}
+
+	if this.Username != "" {
+		msg.SetUsername([]byte(this.Username))
+		msg.SetPassword([]byte(this.Password))
+	}
+
+	c := &Client{Logger: this.log}
+
+	if err := c.Connect(this.URI, msg); err != nil {
+		return nil, err
+	}
+
+	for i, t := range this.Topics {
+		if t.Direction == BridgeOut {
+			continue
+		}
+
+		sub := message.NewSubscribeMessage()
+		sub.SetPacketId(c.svc.sess.NextPacketId())
+		sub.AddTopic([]byte(t.RemotePrefix+t.Filter), t.Qos)
+
+		if err := c.Subscribe(sub, nil, this.ins[i]); err != nil {
+			c.Disconnect()
+			return nil, err
+		}
+	}
+
+	this.mu.Lock()
+	this.client = c
+	this.mu.Unlock()
+
+	return c, nil
+}
+
+func (this *Bridge) disconnect(c *Client) {
+	this.mu.Lock()
+	this.client = nil
+	this.mu.Unlock()
+
+	c.Disconnect()
+	<-c.svc.stopped
+}
+
+// forwardOut publishes a message from this server on the remote broker, unless it
+// came from there.
+func (this *Bridge) forwardOut(t *BridgeTopic, msg *message.PublishMessage) error {
+	this.imu.Lock()
+	_, ok := this.inbound[msg]
+	this.imu.Unlock()
+
+	if ok {
+		return nil
+	}
+
+	this.mu.RLock()
+	c := this.client
+	this.mu.RUnlock()
+
+	if c == nil || c.svc.isStopped() {
+		return errBridgeNotConnected
+	}
+
+	out := newBridgeMessage(msg, t.RemotePrefix+strings.TrimPrefix(string(msg.Topic()), t.LocalPrefix), t.Qos)
+	if out.QoS() != message.QosAtMostOnce {
+		out.SetPacketId(c.svc.sess.NextPacketId())
+	}
+
+	if t.Direction == BridgeBoth {
+		this.addEcho(out)
+	}
+
+	return c.Publish(out, nil)
+}
+
+// forwardIn publishes a message from the remote broker on this server, unless it was
+// sent there by this bridge.
+func (this *Bridge) forwardIn(t *BridgeTopic, msg *message.PublishMessage) error {
+	if t.Direction == BridgeBoth && this.isEcho(msg) {
+		return nil
+	}
+
+	in := newBridgeMessage(msg, t.LocalPrefix+strings.TrimPrefix(string(msg.Topic()), t.RemotePrefix), t.Qos)
+	in.SetRetain(msg.Retain())
+
+	this.imu.Lock()
+	this.inbound[in] = struct{}{}
+	this.imu.Unlock()
+
+	defer func() {
+		this.imu.Lock()
+		delete(this.inbound, in)
+		this.imu.Unlock()
+	}()
+
+	return this.svr.Publish(in, nil)
+}
+
+func (this *Bridge) addEcho(msg *message.PublishMessage) {
+	this.emu.Lock()
+	defer this.emu.Unlock()
+
+	// The remote broker may not send them all back, e.g., if it doesn't allow the
+	// bridge to subscribe, so don't let them pile up.
+	if len(this.echoes) >= maxBridgeEchoes {
+		this.echoes = make(map[string]int)
+	}
+
+	this.echoes[echoKey(msg)]++
+}
+
+func (this *Bridge) isEcho(msg *message.PublishMessage) bool {
+	this.emu.Lock()
+	defer this.emu.Unlock()
+
+	k := echoKey(msg)
+
+	switch n := this.echoes[k]; n {
+	case 0:
+		return false
+
+	case 1:
+		delete(this.echoes, k)
+
+	default:
+		this.echoes[k] = n - 1
+	}
+
+	return true
+}
+
+func echoKey(msg *message.PublishMessage) string {
+	return string(msg.Topic()) + "\x00" + string(msg.Payload())
+}
+
+// newBridgeMessage copies msg to topic, with the QoS capped at qos.
+func newBridgeMessage(msg *message.PublishMessage, topic string, qos byte) *message.PublishMessage {
+	if msg.QoS() < qos {
+		qos = msg.QoS()
+	}
+
+	out := message.NewPublishMessage()
+	out.SetTopic([]byte(topic))
+	out.SetQoS(qos)
+	out.SetPayload(msg.Payload())
+
+	return out
+}
@@ -0,0 +1,252 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestBridgeConfiguration(t *testing.T) {
+	for _, b := range []*Bridge{
+		{Topics: []BridgeTopic{{Filter: "a/#"}}},
+		{URI: "tcp://127.0.0.1:1885"},
+		{URI: "tcp://127.0.0.1:1885", Topics: []BridgeTopic{{}}},
+		{URI: "tcp://127.0.0.1:1885", Topics: []BridgeTopic{{Filter: "a/#", Qos: 3}}},
+		{URI: "tcp://127.0.0.1:1885", Topics: []BridgeTopic{{Filter: "a/#", Direction: 3}}},
+	} {
+		require.Error(t, b.checkConfiguration())
+	}
+
+	b := &Bridge{
+		URI:        "tcp://127.0.0.1:1885",
+		MaxBackoff: time.Millisecond,
+		Topics:     []BridgeTopic{{Filter: "a/#"}},
+	}
+
+	require.NoError(t, b.checkConfiguration())
+	require.Equal(t, DefaultBridgeClientId, b.ClientId)
+	require.Equal(t, DefaultBridgeKeepAlive, b.KeepAlive)
+	require.Equal(t, DefaultBridgeMinBackoff, b.MinBackoff)
+	require.Equal(t, DefaultBridgeMinBackoff, b.MaxBackoff)
+}
+
+func TestBridgeMessage(t *testing.T) {
+	msg := newPublishMessage(1, 2)
+	msg.SetRetain(true)
+
+	out := newBridgeMessage(msg, "site1/abc", 1)
+	require.Equal(t, "site1/abc", string(out.Topic()))
+	require.Equal(t, byte(1), out.QoS())
+	require.Equal(t, msg.Payload(), out.Payload())
+	require.False(t, out.Retain())
+
+	out = newBridgeMessage(newPublishMessage(0, 0), "abc", 2)
+	require.Equal(t, byte(0), out.QoS())
+}
+
+func TestBridgeEcho(t *testing.T) {
+	b := &Bridge{echoes: make(map[string]int)}
+
+	msg := newPublishMessage(1, 1)
+
+	b.addEcho(msg)
+	b.addEcho(msg)
+
+	require.True(t, b.isEcho(msg))
+	require.True(t, b.isEcho(msg))
+	require.False(t, b.isEcho(msg))
+
+	for i := 0; i < maxBridgeEchoes+1; i++ {
+		b.addEcho(newPayloadMessage(1, 1, string(rune('a'+i%26))+string(rune(i))))
+	}
+
+	require.True(t, len(b.echoes) <= maxBridgeEchoes)
+}
+
+// waitForBridge waits until the bridge is connected and, if topic is not empty,
+// subscribed to it on the remote broker.
+func waitForBridge(t *testing.T, b *Bridge, remote *Server, topic string) {
+	if topic != "" {
+		waitForSubscriber(t, remote, topic)
+	}
+
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	for i := 0; i < 200; i++ {
+		b.mu.RLock()
+		c := b.client
+		b.mu.RUnlock()
+
+		if c != nil && !c.svc.isStopped() {
+			if topic == "" {
+				return
+			}
+
+			require.NoError(t, c.svc.topicsMgr.Subscribers([]byte(topic), 0, &subs, &qoss))
+			if len(subs) > 0 {
+				return
+			}
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	t.Fatalf("Bridge not connected")
+}
+
+func expectPublish(t *testing.T, conn net.Conn, topic string, qos byte) {
+	msg := expectMessage(t, conn, message.PUBLISH).(*message.PublishMessage)
+	require.Equal(t, topic, string(msg.Topic()))
+	require.Equal(t, qos, msg.QoS())
+
+	if qos == message.QosAtLeastOnce {
+		ack := message.NewPubackMessage()
+		ack.SetPacketId(msg.PacketId())
+		require.NoError(t, writeMessage(conn, ack))
+	}
+}
+
+// Messages are forwarded both ways with the prefixes swapped and the QoS capped, and
+// none of them come back to where they were first published.
+func TestBridgeForward(t *testing.T) {
+	remote, rdone := startNamedServer(t, "bridgeremote", "tcp://127.0.0.1:1885", &Server{})
+	defer func() {
+		require.NoError(t, remote.Close())
+		require.NoError(t, <-rdone)
+	}()
+
+	rconn := dialNamedServer(t, "127.0.0.1:1885", "#")
+	defer rconn.Close()
+
+	b := &Bridge{
+		URI:      "tcp://127.0.0.1:1885",
+		ClientId: "bridge1",
+		Topics: []BridgeTopic{
+			{Filter: "sensors/#", Direction: BridgeBoth, Qos: 1, LocalPrefix: "site1/"},
+			{Filter: "cmd/#", Direction: BridgeIn, Qos: 0, RemotePrefix: "site1/"},
+			{Filter: "alerts/#", Direction: BridgeOut, Qos: 0},
+		},
+	}
+
+	local, ldone := startNamedServer(t, "bridgelocal", "tcp://127.0.0.1:1883", &Server{Bridges: []*Bridge{b}})
+	defer func() {
+		require.NoError(t, local.Close())
+		require.NoError(t, <-ldone)
+	}()
+
+	lconn := dialNamedServer(t, "127.0.0.1:1883", "#")
+	defer lconn.Close()
+
+	waitForBridge(t, b, remote, "site1/cmd/x")
+	waitForSubscriber(t, local, "alerts/x")
+
+	// Out, with the local prefix taken away
+	pub := newPublishMessage(1, 1)
+	pub.SetTopic([]byte("site1/sensors/temp"))
+	require.NoError(t, writeMessage(lconn, pub))
+	expectMessage(t, lconn, message.PUBACK)
+	expectPublish(t, lconn, "site1/sensors/temp", 1)
+
+	expectPublish(t, rconn, "sensors/temp", 1)
+	expectNoMessage(t, rconn)
+	expectNoMessage(t, lconn)
+
+	// In, with the local prefix added
+	pub = newPublishMessage(2, 1)
+	pub.SetTopic([]byte("sensors/hum"))
+	require.NoError(t, writeMessage(rconn, pub))
+	expectMessage(t, rconn, message.PUBACK)
+	expectPublish(t, rconn, "sensors/hum", 1)
+
+	expectPublish(t, lconn, "site1/sensors/hum", 1)
+	expectNoMessage(t, lconn)
+	expectNoMessage(t, rconn)
+
+	// In only, with the remote prefix taken away
+	pub = newPublishMessage(0, 0)
+	pub.SetTopic([]byte("site1/cmd/reboot"))
+	require.NoError(t, writeMessage(rconn, pub))
+	expectPublish(t, rconn, "site1/cmd/reboot", 0)
+
+	expectPublish(t, lconn, "cmd/reboot", 0)
+
+	// Not out
+	pub = newPublishMessage(0, 0)
+	pub.SetTopic([]byte("cmd/reboot"))
+	require.NoError(t, writeMessage(lconn, pub))
+
+	expectPublish(t, lconn, "cmd/reboot", 0)
+	expectNoMessage(t, rconn)
+
+	// Out only, with the QoS capped
+	pub = newPublishMessage(3, 1)
+	pub.SetTopic([]byte("alerts/fire"))
+	require.NoError(t, writeMessage(lconn, pub))
+	expectMessage(t, lconn, message.PUBACK)
+	expectPublish(t, lconn, "alerts/fire", 1)
+
+	expectPublish(t, rconn, "alerts/fire", 0)
+	expectNoMessage(t, lconn)
+}
+
+// The bridge keeps trying until the remote broker is up, and connects again after
+// the remote broker restarts.
+func TestBridgeReconnect(t *testing.T) {
+	b := &Bridge{
+		URI:        "tcp://127.0.0.1:1885",
+		ClientId:   "bridge2",
+		MinBackoff: time.Millisecond * 10,
+		MaxBackoff: time.Millisecond * 50,
+		Topics:     []BridgeTopic{{Filter: "abc", Direction: BridgeOut, Qos: 1}},
+	}
+
+	local, ldone := startNamedServer(t, "bridgelocal", "tcp://127.0.0.1:1883", &Server{Bridges: []*Bridge{b}})
+	defer func() {
+		require.NoError(t, local.Close())
+		require.NoError(t, <-ldone)
+	}()
+
+	lconn := dialNamedServer(t, "127.0.0.1:1883", "xyz")
+	defer lconn.Close()
+
+	for i := 0; i < 2; i++ {
+		// Give the bridge a few tries before the remote broker is up
+		time.Sleep(time.Millisecond * 100)
+
+		remote, rdone := startNamedServer(t, "bridgeremote", "tcp://127.0.0.1:1885", &Server{})
+
+		rconn := dialNamedServer(t, "127.0.0.1:1885", "abc")
+
+		waitForSubscriber(t, local, "abc")
+		waitForBridge(t, b, remote, "")
+
+		require.NoError(t, writeMessage(lconn, newPublishMessage(uint16(i+1), 1)))
+		expectMessage(t, lconn, message.PUBACK)
+
+		expectPublish(t, rconn, "abc", 1)
+
+		rconn.Close()
+		require.NoError(t, remote.Close())
+		require.NoError(t, <-rdone)
+	}
+}
@@ -18,8 +18,10 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var (
@@ -30,6 +32,10 @@ const (
 	defaultBufferSize     = 1024 * 256
 	defaultReadBlockSize  = 8192
 	defaultWriteBlockSize = 8192
+
+	// The number of reads in a row that can return no data and no error before we
+	// give up on the reader. Same as bufio's limit.
+	maxEmptyReads = 100
 )
 
 type sequence struct {
@@ -135,6 +141,7 @@ func (this *buffer) ReadFrom(r io.Reader) (int64, error) {
 	defer this.Close()
 
 	total := int64(0)
+	empty := 0
 
 	for {
 		if this.isDone() {
@@ -155,6 +162,7 @@ func (this *buffer) ReadFrom(r io.Reader) (int64, error) {
 		n, err := r.Read(this.buf[pstart:pend])
 
 		if n > 0 {
+			empty = 0
 			total += int64(n)
 			_, err := this.WriteCommit(n)
 			if err != nil {
@@ -165,12 +173,37 @@ func (this *buffer) ReadFrom(r io.Reader) (int64, error) {
 		if err != nil {
 			return total, err
 		}
+
+		// A reader that keeps returning nothing, but no error either, would have us
+		// spinning here forever.
+		if n == 0 {
+			empty++
+			if empty >= maxEmptyReads {
+				return total, io.ErrNoProgress
+			}
+		}
 	}
 }
 
 func (this *buffer) WriteTo(w io.Writer) (int64, error) {
+	return this.WriteToBatched(w, defaultWriteBlockSize, 0)
+}
+
+// WriteToBatched is WriteTo, except it writes up to size bytes at a time, and waits up
+// to interval for size bytes to be ready before writing what there is. The data is
+// written as net.Buffers, so when it wraps around the end of the ring it's still a
+// single writev(2) on TCP connections, instead of being copied first.
+func (this *buffer) WriteToBatched(w io.Writer, size int, interval time.Duration) (int64, error) {
 	defer this.Close()
 
+	if int64(size) > this.size {
+		return 0, bufio.ErrBufferFull
+	}
+
+	if size <= 0 {
+		return 0, bufio.ErrNegativeCount
+	}
+
 	total := int64(0)
 
 	for {
@@ -178,30 +211,96 @@ func (this *buffer) WriteTo(w io.Writer) (int64, error) {
 			return total, io.EOF
 		}
 
-		p, err := this.ReadPeek(defaultWriteBlockSize)
+		if interval > 0 {
+			this.waitForBatch(size, interval)
+		}
 
-		// There's some data, let's process it first
-		if len(p) > 0 {
-			n, err := w.Write(p)
-			total += int64(n)
-			//glog.Debugf("Wrote %d bytes, totaling %d bytes", n, total)
+		bufs, err := this.peekBuffers(size)
+		if err != nil {
+			return total, err
+		}
 
-			if err != nil {
-				return total, err
-			}
+		n, err := bufs.WriteTo(w)
+		total += n
 
-			_, err = this.ReadCommit(n)
-			if err != nil {
-				return total, err
-			}
+		if err != nil {
+			return total, err
 		}
 
-		if err != ErrBufferInsufficientData && err != nil {
+		if _, err = this.ReadCommit(int(n)); err != nil {
 			return total, err
 		}
 	}
 }
 
+// waitForBatch waits for some data, then up to d for n bytes to be ready. It returns
+// early if the buffer is closed.
+func (this *buffer) waitForBatch(n int, d time.Duration) {
+	this.ccond.L.Lock()
+	defer this.ccond.L.Unlock()
+
+	for this.Len() == 0 {
+		if this.isDone() {
+			return
+		}
+
+		this.cwait++
+		this.ccond.Wait()
+	}
+
+	if this.Len() >= n {
+		return
+	}
+
+	expired := false
+
+	t := time.AfterFunc(d, func() {
+		this.ccond.L.Lock()
+		expired = true
+		this.ccond.Broadcast()
+		this.ccond.L.Unlock()
+	})
+	defer t.Stop()
+
+	for !expired && this.Len() < n && !this.isDone() {
+		this.cwait++
+		this.ccond.Wait()
+	}
+}
+
+// peekBuffers is ReadPeek, except the data that wraps around the end of the ring comes
+// back as a second slice rather than copied into tmp.
+func (this *buffer) peekBuffers(n int) (net.Buffers, error) {
+	cpos := this.cseq.get()
+	ppos := this.pseq.get()
+
+	// If there's no data, then let's wait until there is some data
+	this.ccond.L.Lock()
+	for ; cpos >= ppos; ppos = this.pseq.get() {
+		if this.isDone() {
+			this.ccond.L.Unlock()
+			return nil, io.EOF
+		}
+
+		this.cwait++
+		this.ccond.Wait()
+	}
+	this.ccond.L.Unlock()
+
+	m := ppos - cpos
+	if m > int64(n) {
+		m = int64(n)
+	}
+
+	cindex := cpos & this.mask
+
+	if cindex+m > this.size {
+		return net.Buffers{this.buf[cindex:], this.buf[0 : m-(this.size-cindex)]}, nil
+	}
+
+	return net.Buffers{this.buf[cindex : cindex+m]}, nil
+}
+
 func (this *buffer) Read(p []byte) (int, error) {
 	if this.isDone() && this.Len() == 0 {
 		//glog.Debugf("isDone and len = %d", this.Len())
@@ -269,6 +368,7 @@ func (this *buffer) Read(p []byte) (int, error) {
 		this.ccond.L.Lock()
 		for ppos = this.pseq.get(); cpos >= ppos; ppos = this.pseq.get() {
 			if this.isDone() {
+				this.ccond.L.Unlock()
 				return 0, io.EOF
 			}
 
@@ -325,6 +425,7 @@ func (this *buffer) ReadPeek(n int) ([]byte, error) {
 	this.ccond.L.Lock()
 	for ; cpos >= ppos; ppos = this.pseq.get() {
 		if this.isDone() {
+			this.ccond.L.Unlock()
 			return nil, io.EOF
 		}
 
@@ -389,6 +490,7 @@ func (this *buffer) ReadWait(n int) ([]byte, error) {
 	this.ccond.L.Lock()
 	for ; next > ppos; ppos = this.pseq.get() {
 		if this.isDone() {
+			this.ccond.L.Unlock()
 			return nil, io.EOF
 		}
 
@@ -543,6 +645,7 @@ func (this *buffer) waitForWriteSpace(n int) (int64, int, error) {
 		this.pcond.L.Lock()
 		for cpos = this.cseq.get(); wrap > cpos; cpos = this.cseq.get() {
 			if this.isDone() {
+				this.pcond.L.Unlock()
 				return 0, 0, io.EOF
 			}
 
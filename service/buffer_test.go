@@ -15,8 +15,11 @@
 package service
 
 import (
+	"bufio"
 	"bytes"
 	"io"
+	"io/ioutil"
+	"net"
 	"testing"
 	"time"
 
@@ -82,11 +85,139 @@ func TestBufferPeek(t *testing.T) {
 	peekBuffer(t, buf, 1000)
 }
 
+// writeRecorder records the size of each write.
+type writeRecorder struct {
+	writes []int
+}
+
+func (this *writeRecorder) Write(p []byte) (int, error) {
+	this.writes = append(this.writes, len(p))
+	return len(p), nil
+}
+
+func TestBufferWriteToBatched(t *testing.T) {
+	buf, err := newBuffer(16384)
+	require.NoError(t, err)
+
+	_, err = buf.WriteToBatched(ioutil.Discard, 16385, 0)
+	require.Equal(t, bufio.ErrBufferFull, err)
+
+	buf, err = newBuffer(16384)
+	require.NoError(t, err)
+
+	_, err = buf.WriteToBatched(ioutil.Discard, 0, 0)
+	require.Equal(t, bufio.ErrNegativeCount, err)
+
+	// Everything that's there goes out at once, in two parts when it wraps
+	buf, err = newBuffer(16384)
+	require.NoError(t, err)
+
+	_, err = buf.Write(make([]byte, 10000))
+	require.NoError(t, err)
+
+	_, err = buf.ReadCommit(10000)
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		_, err = buf.Write(make([]byte, 100))
+		require.NoError(t, err)
+	}
+
+	w := &writeRecorder{}
+
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		buf.Close()
+	}()
+
+	n, err := buf.WriteToBatched(w, 16384, 0)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, int64(10000), n)
+	require.Equal(t, []int{16384 - 10000, 10000 - (16384 - 10000)}, w.writes)
+}
+
+func TestBufferWriteToBatchedInterval(t *testing.T) {
+	buf, err := newBuffer(16384)
+	require.NoError(t, err)
+
+	// Written a bit at a time, but it waits for 1000 bytes
+	go func() {
+		for i := 0; i < 15; i++ {
+			buf.Write(make([]byte, 100))
+			time.Sleep(time.Millisecond * 10)
+		}
+	}()
+
+	w := &writeRecorder{}
+
+	go func() {
+		time.Sleep(time.Millisecond * 500)
+		buf.Close()
+	}()
+
+	n, err := buf.WriteToBatched(w, 1000, time.Second)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, int64(1500), n)
+	require.Equal(t, []int{1000, 500}, w.writes)
+}
+
 func BenchmarkBufferConsumerProducerRead(b *testing.B) {
 	buf, _ := newBuffer(0)
 	benchmarkRead(b, buf)
 }
 
+// zeroReader is a misbehaving reader that never returns any data, or any error.
+type zeroReader struct {
+	reads int
+}
+
+func (this *zeroReader) Read(p []byte) (int, error) {
+	this.reads++
+	return 0, nil
+}
+
+func TestBufferReadFromZeroReader(t *testing.T) {
+	buf, err := newBuffer(16384)
+	require.NoError(t, err)
+
+	r := &zeroReader{}
+	done := make(chan struct{})
+
+	go func() {
+		n, err := buf.ReadFrom(r)
+		require.Equal(t, io.ErrNoProgress, err)
+		require.Equal(t, int64(0), n)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		require.Equal(t, maxEmptyReads, r.reads)
+
+	case <-time.After(time.Millisecond * 100):
+		buf.Close()
+		require.FailNow(t, "ReadFrom() is spinning on a reader that returns no data")
+	}
+}
+
+func TestGetMessageBufferZeroReader(t *testing.T) {
+	conn := &zeroConn{}
+
+	_, err := getMessageBuffer(conn)
+	require.Equal(t, io.ErrNoProgress, err)
+	require.Equal(t, maxEmptyReads, conn.reads)
+}
+
+// zeroConn is a net.Conn that behaves like zeroReader.
+type zeroConn struct {
+	net.Conn
+	zeroReader
+}
+
+func (this *zeroConn) Read(p []byte) (int, error) {
+	return this.zeroReader.Read(p)
+}
+
 func testFillBuffer(t *testing.T, bufsize, ringsize int64) *buffer {
 	buf, err := newBuffer(ringsize)
 
@@ -220,3 +351,77 @@ func benchmarkRead(b *testing.B, buf *buffer) {
 		i += l
 	}
 }
+
+// The sender writing 64 byte messages to a TCP connection one at a time, in blocks of
+// 8KB like WriteTo(), and in batches of the default WriteFlushSize, with and without
+// waiting for them to fill up.
+func BenchmarkSenderPerMessage(b *testing.B) {
+	benchmarkSender(b, 64, 0)
+}
+
+func BenchmarkSenderWriteTo(b *testing.B) {
+	benchmarkSender(b, defaultWriteBlockSize, 0)
+}
+
+func BenchmarkSenderBatched(b *testing.B) {
+	benchmarkSender(b, DefaultWriteFlushSize, 0)
+}
+
+func BenchmarkSenderBatchedInterval(b *testing.B) {
+	benchmarkSender(b, DefaultWriteFlushSize, time.Millisecond)
+}
+
+func benchmarkSender(b *testing.B, size int, interval time.Duration) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		io.Copy(ioutil.Discard, conn)
+		conn.Close()
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf, _ := newBuffer(defaultBufferSize)
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := buf.WriteToBatched(conn, size, interval)
+		done <- err
+	}()
+
+	p := make([]byte, 64)
+
+	b.SetBytes(int64(len(p)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := buf.Write(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for buf.Len() > 0 {
+		time.Sleep(time.Microsecond * 100)
+	}
+
+	b.StopTimer()
+
+	buf.Close()
+
+	if err := <-done; err != io.EOF {
+		b.Fatal(err)
+	}
+}
@@ -15,13 +15,18 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"net/url"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logger"
 	"github.com/surgemq/surgemq/sessions"
 	"github.com/surgemq/surgemq/topics"
 )
@@ -30,6 +35,34 @@ const (
 	minKeepAlive = 30
 )
 
+// ErrConnectionLost is returned by the Client's Context methods when the connection is
+// lost before the ack comes back.
+var ErrConnectionLost = errors.New("service: Connection lost")
+
+const (
+	DefaultReconnectMinBackoff = time.Second
+	DefaultReconnectMaxBackoff = time.Minute * 2
+)
+
+// ReconnectPolicy decides how a Client connects again after it loses the connection
+// to the server. It waits twice as long after each failed attempt, from MinBackoff
+// up to MaxBackoff.
+type ReconnectPolicy struct {
+	// How long to wait before connecting again, at first and at most. If not set then
+	// default to 1 second and 2 minutes.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// MaxRetries is the number of attempts to connect again before giving up. If not
+	// set then the client keeps trying until Disconnect() is called.
+	MaxRetries int
+
+	// Jitter is the fraction, from 0 to 1, of each wait that's random, so clients that
+	// lost their connections at the same time don't all come back at once. If not set
+	// then there's no jitter.
+	Jitter float64
+}
+
 // Client is a library implementation of the MQTT client that, as best it can, complies
 // with the MQTT 3.1 and 3.1.1 specs.
 type Client struct {
@@ -49,31 +82,120 @@ type Client struct {
 	// If no set then default to 3 retries.
 	TimeoutRetries int
 
+	// The maximum size in bytes of any message from the server, header included.
+	// The client disconnects if a bigger one comes in. If not set then there's no
+	// limit.
+	MaxPacketSize int
+
+	// Reconnect, if set, makes the client connect again when it loses the connection,
+	// with the same CONNECT message, so the same client ID. The session carries on
+	// where it left off. The QoS 1 and 2 messages the server hadn't acked are sent
+	// again, and, unless the server kept the subscriptions, i.e., the CONNACK doesn't
+	// have the session present flag set, the client subscribes to its topics again.
+	// Messages published while the client is not connected are not queued, Publish()
+	// returns an error instead. If not set then the client stays disconnected.
+	Reconnect *ReconnectPolicy
+
+	// OnConnectionLost and OnReconnect, if set, are called when the client loses the
+	// connection, and once it's connected again. Only used if Reconnect is set.
+	OnConnectionLost func()
+	OnReconnect      func()
+
+	// Logger is what the client logs through, with the "client" logger.Subsystem. If
+	// not set then default to glog.
+	Logger logger.Logger
+
+	// ResponseTopicPrefix is the first level of the topics the responses to Request()
+	// are published to. If not set then default to "responses".
+	ResponseTopicPrefix string
+
+	// Store, if set, keeps the client's session, so the QoS 1 and 2 messages the
+	// server hasn't acked yet, and the QoS 2 messages from the server waiting for
+	// PUBREL, survive the process crashing or restarting. The session is saved every
+	// time they change, and picked up by the next Connect() with the same client ID
+	// and CleanSession set to 0, which sends the unacked messages again. Clean
+	// sessions are not kept, and connecting with one discards the session kept. The
+	// onPublish functions can't be kept, so the client has to subscribe again for the
+	// messages from the server to get to them.
+	//
+	// If not set, but StorePath is, then default to a BoltDB file at StorePath, see
+	// sessions.NewBoltProvider, which is closed by Disconnect(). If neither is set
+	// then the session is only kept in memory.
+	Store     sessions.SessionsProvider
+	StorePath string
+
+	// Whether Store was opened by Connect(), from StorePath
+	ownStore bool
+
+	// dial, if set, opens the connection to the server instead of the URI, e.g., for
+	// the clients of an MQTTSNGateway, which connect to the server in memory
+	dial func() (net.Conn, error)
+
+	log logger.Logger
+
+	// The requests waiting for their responses, once the first one has been made.
+	// Protected by rmu.
+	resps *responses
+	rmu   sync.Mutex
+
+	// The service for the current connection. Protected by mu once Connect() returns.
 	svc *service
+	mu  sync.Mutex
+
+	// Closed by Disconnect() so the client stops reconnecting
+	quit   chan struct{}
+	closed bool
+	wg     sync.WaitGroup
 }
 
 // Connect is for MQTT clients to open a connection to a remote server. It needs to
-// know the URI, e.g., "tcp://127.0.0.1:1883", so it knows where to connect to. It also
-// needs to be supplied with the MQTT CONNECT message.
-func (this *Client) Connect(uri string, msg *message.ConnectMessage) (err error) {
+// know the URI, e.g., "tcp://127.0.0.1:1883", so it knows where to connect to. It can
+// also be a Unix domain socket, e.g., "unix:///var/run/surgemq.sock". It also needs
+// to be supplied with the MQTT CONNECT message.
+func (this *Client) Connect(uri string, msg *message.ConnectMessage) error {
 	this.checkConfiguration()
 
 	if msg == nil {
 		return fmt.Errorf("msg is nil")
 	}
 
-	u, err := url.Parse(uri)
+	if this.Store == nil && this.StorePath != "" {
+		store, err := sessions.NewBoltProvider(this.StorePath, 0)
+		if err != nil {
+			return err
+		}
+
+		this.Store = store
+		this.ownStore = true
+	}
+
+	svc, err := this.connect(uri, msg, nil)
 	if err != nil {
+		this.closeStore()
 		return err
 	}
 
-	if u.Scheme != "tcp" {
-		return ErrInvalidConnectionType
+	this.svc = svc
+
+	if this.Reconnect != nil {
+		this.Reconnect.checkConfiguration()
+
+		this.quit = make(chan struct{})
+
+		this.wg.Add(1)
+		go this.reconnect(uri, msg)
 	}
 
-	conn, err := net.Dial(u.Scheme, u.Host)
+	return nil
+}
+
+// connect opens a connection to the server and starts a service for it. If prev is
+// not nil then it's the service of the connection that was lost, and its session is
+// resumed.
+func (this *Client) connect(uri string, msg *message.ConnectMessage, prev *service) (svc *service, err error) {
+	conn, err := this.open(uri)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer func() {
@@ -87,53 +209,175 @@ func (this *Client) Connect(uri string, msg *message.ConnectMessage) (err error)
 	}
 
 	if err = writeMessage(conn, msg); err != nil {
-		return err
+		return nil, err
 	}
 
 	conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(this.ConnectTimeout)))
 
-	resp, err := getConnackMessage(conn)
+	resp, err := getConnackMessage(conn, this.MaxPacketSize)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if resp.ReturnCode() != message.ConnectionAccepted {
-		return resp.ReturnCode()
+		return nil, resp.ReturnCode()
 	}
 
-	this.svc = &service{
-		id:     atomic.AddUint64(&gsvcid, 1),
-		client: true,
-		conn:   conn,
+	svc = &service{
+		id:      atomic.AddUint64(&gsvcid, 1),
+		client:  true,
+		conn:    conn,
+		stopped: make(chan struct{}),
 
 		keepAlive:      int(msg.KeepAlive()),
 		connectTimeout: this.ConnectTimeout,
 		ackTimeout:     this.AckTimeout,
 		timeoutRetries: this.TimeoutRetries,
+		maxPacketSize:  this.MaxPacketSize,
+		log:            this.log,
 	}
 
-	err = this.getSession(this.svc, msg, resp)
-	if err != nil {
-		return err
+	// Whether the session was kept in the Store by an earlier process
+	var restored bool
+
+	if prev != nil {
+		svc.sess = prev.sess
+		svc.store = prev.store
+		svc.topicsMgr = prev.topicsMgr
+	} else {
+		restored, err = this.getSession(svc, msg, resp)
+		if err != nil {
+			return nil, err
+		}
+
+		p := topics.NewMemProvider()
+		topics.Register(svc.sess.ID(), p)
+
+		svc.topicsMgr, err = topics.NewManager(svc.sess.ID())
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	p := topics.NewMemProvider()
-	topics.Register(this.svc.sess.ID(), p)
+	if err := svc.start(); err != nil {
+		svc.stop()
+		return nil, err
+	}
 
-	this.svc.topicsMgr, err = topics.NewManager(this.svc.sess.ID())
+	svc.inStat.increment(int64(msg.Len()))
+	svc.outStat.increment(int64(resp.Len()))
+
+	if prev != nil || restored {
+		svc.resendInflight()
+	}
+
+	if prev != nil && !resp.SessionPresent() {
+		svc.resubscribe()
+	}
+
+	return svc, nil
+}
+
+// open opens the connection to the server at uri.
+func (this *Client) open(uri string) (net.Conn, error) {
+	if this.dial != nil {
+		return this.dial()
+	}
+
+	u, err := url.Parse(uri)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if err := this.svc.start(); err != nil {
-		this.svc.stop()
-		return err
+	if u.Scheme != "tcp" && u.Scheme != "unix" {
+		return nil, ErrInvalidConnectionType
 	}
 
-	this.svc.inStat.increment(int64(msg.Len()))
-	this.svc.outStat.increment(int64(resp.Len()))
+	network, addr := dialAddr(u)
 
-	return nil
+	return net.Dial(network, addr)
+}
+
+// reconnect waits for the connection to be lost, then connects again, until the
+// client is disconnected or it runs out of retries.
+func (this *Client) reconnect(uri string, msg *message.ConnectMessage) {
+	defer this.wg.Done()
+
+	for {
+		svc := this.service()
+
+		select {
+		case <-this.quit:
+			return
+
+		case <-svc.stopped:
+		}
+
+		// Disconnect() stops the service too, that's not a lost connection
+		select {
+		case <-this.quit:
+			return
+
+		default:
+		}
+
+		this.log.Infof("(%s) client/reconnect: Connection lost", svc.cid())
+
+		if this.OnConnectionLost != nil {
+			this.OnConnectionLost()
+		}
+
+		backoff := this.Reconnect.MinBackoff
+
+		for attempt := 1; ; attempt++ {
+			wait := backoff - time.Duration(this.Reconnect.Jitter*rand.Float64()*float64(backoff))
+
+			select {
+			case <-this.quit:
+				return
+
+			case <-time.After(wait):
+			}
+
+			nsvc, err := this.connect(uri, msg, svc)
+			if err == nil {
+				this.mu.Lock()
+				if this.closed {
+					this.mu.Unlock()
+					nsvc.stop()
+					return
+				}
+
+				this.svc = nsvc
+				this.mu.Unlock()
+
+				this.log.Infof("(%s) client/reconnect: Connected again after %d attempt(s)", svc.cid(), attempt)
+				break
+			}
+
+			if this.Reconnect.MaxRetries > 0 && attempt >= this.Reconnect.MaxRetries {
+				this.log.Errorf("(%s) client/reconnect: Giving up after %d attempt(s): %v", svc.cid(), attempt, err)
+				return
+			}
+
+			this.log.Debugf("(%s) client/reconnect: Error connecting: %v", svc.cid(), err)
+
+			if backoff *= 2; backoff > this.Reconnect.MaxBackoff {
+				backoff = this.Reconnect.MaxBackoff
+			}
+		}
+
+		if this.OnReconnect != nil {
+			this.OnReconnect()
+		}
+	}
+}
+
+func (this *Client) service() *service {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.svc
 }
 
 // Publish sends a single MQTT PUBLISH message to the server. On completion, the
@@ -142,7 +386,7 @@ func (this *Client) Connect(uri string, msg *message.ConnectMessage) (err error)
 // onComplete is called when PUBACK is received. For QOS 2 messages, onComplete is
 // called after the PUBCOMP message is received.
 func (this *Client) Publish(msg *message.PublishMessage, onComplete OnCompleteFunc) error {
-	return this.svc.publish(msg, onComplete)
+	return this.service().publish(msg, onComplete)
 }
 
 // Subscribe sends a single SUBSCRIBE message to the server. The SUBSCRIBE message
@@ -155,7 +399,23 @@ func (this *Client) Publish(msg *message.PublishMessage, onComplete OnCompleteFu
 // So in effect, the client can supply different onPublish functions for different
 // topics.
 func (this *Client) Subscribe(msg *message.SubscribeMessage, onComplete OnCompleteFunc, onPublish OnPublishFunc) error {
-	return this.svc.subscribe(msg, onComplete, onPublish)
+	return this.service().subscribe(msg, onComplete, onPublish)
+}
+
+// SubscribeHandlers is like Subscribe, except each of the topic filters in the
+// SUBSCRIBE message has its own onPublish function, keyed by the filter. Messages
+// from the server are handed to the functions of all the filters they match,
+// wildcards included, so there's no need to look at the topic to work out what to do
+// with a message. Subscribing to a filter again replaces its onPublish function.
+func (this *Client) SubscribeHandlers(msg *message.SubscribeMessage, onComplete OnCompleteFunc, handlers map[string]OnPublishFunc) error {
+	hs := make(map[string]*OnPublishFunc, len(handlers))
+
+	for filter, onPublish := range handlers {
+		onPublish := onPublish
+		hs[filter] = &onPublish
+	}
+
+	return this.service().subscribeHandlers(msg, onComplete, hs)
 }
 
 // Unsubscribe sends a single UNSUBSCRIBE message to the server. The UNSUBSCRIBE
@@ -164,27 +424,176 @@ func (this *Client) Subscribe(msg *message.SubscribeMessage, onComplete OnComple
 // the supplied onComplete function is called. The client will no longer handle
 // messages from the server for those unsubscribed topics.
 func (this *Client) Unsubscribe(msg *message.UnsubscribeMessage, onComplete OnCompleteFunc) error {
-	return this.svc.unsubscribe(msg, onComplete)
+	return this.service().unsubscribe(msg, onComplete)
 }
 
 // Ping sends a single PINGREQ message to the server. PINGREQ/PINGRESP messages are
 // mainly used by the client to keep a heartbeat to the server so the connection won't
 // be dropped.
 func (this *Client) Ping(onComplete OnCompleteFunc) error {
-	return this.svc.ping(onComplete)
+	return this.service().ping(onComplete)
+}
+
+// PublishContext is like Publish, except it waits for the message to be acked, which
+// for QoS 0 messages is as soon as it's sent. It returns ctx.Err() if ctx is done
+// first, in which case the message may still be acked later.
+func (this *Client) PublishContext(ctx context.Context, msg *message.PublishMessage) error {
+	svc := this.service()
+	done := make(chan error, 1)
+
+	if err := svc.publish(msg, onCompleteChan(done)); err != nil {
+		return err
+	}
+
+	return this.wait(ctx, svc, done)
+}
+
+// SubscribeContext is like Subscribe, except it waits for the SUBACK message. It
+// returns an error if the server didn't accept any of the topics, or ctx.Err() if
+// ctx is done first.
+func (this *Client) SubscribeContext(ctx context.Context, msg *message.SubscribeMessage, onPublish OnPublishFunc) error {
+	svc := this.service()
+	done := make(chan error, 1)
+
+	if err := svc.subscribe(msg, onCompleteChan(done), onPublish); err != nil {
+		return err
+	}
+
+	return this.wait(ctx, svc, done)
+}
+
+// UnsubscribeContext is like Unsubscribe, except it waits for the UNSUBACK message.
+// It returns ctx.Err() if ctx is done first.
+func (this *Client) UnsubscribeContext(ctx context.Context, msg *message.UnsubscribeMessage) error {
+	svc := this.service()
+	done := make(chan error, 1)
+
+	if err := svc.unsubscribe(msg, onCompleteChan(done)); err != nil {
+		return err
+	}
+
+	return this.wait(ctx, svc, done)
+}
+
+// PingContext is like Ping, except it waits for the PINGRESP message. It returns
+// ctx.Err() if ctx is done first.
+func (this *Client) PingContext(ctx context.Context) error {
+	svc := this.service()
+	done := make(chan error, 1)
+
+	if err := svc.ping(onCompleteChan(done)); err != nil {
+		return err
+	}
+
+	return this.wait(ctx, svc, done)
+}
+
+// wait waits for the ack cycle of a message sent by svc to complete, or for ctx to be
+// done. If the client doesn't reconnect then there won't be an ack once the
+// connection is lost, so it stops waiting then as well. If it does reconnect, QoS 1
+// and 2 messages are sent again and acked on the new connection.
+func (this *Client) wait(ctx context.Context, svc *service, done chan error) error {
+	var stopped chan struct{}
+	if this.Reconnect == nil {
+		stopped = svc.stopped
+	}
+
+	select {
+	case err := <-done:
+		return err
+
+	case <-ctx.Done():
+		return ctx.Err()
+
+	case <-stopped:
+		// The ack may have made it in just before the connection was lost
+		select {
+		case err := <-done:
+			return err
+
+		default:
+			return ErrConnectionLost
+		}
+	}
+}
+
+// onCompleteChan returns an OnCompleteFunc that sends the result of the ack cycle on
+// done, which must have room for it.
+func onCompleteChan(done chan error) OnCompleteFunc {
+	return func(msg, ack message.Message, err error) error {
+		done <- err
+		return nil
+	}
 }
 
 // Disconnect sends a single DISCONNECT message to the server. The client immediately
 // terminates after the sending of the DISCONNECT message.
 func (this *Client) Disconnect() {
 	//msg := message.NewDisconnectMessage()
-	this.svc.stop()
+	this.mu.Lock()
+	closed := this.closed
+	this.closed = true
+	svc := this.svc
+	this.mu.Unlock()
+
+	if this.quit != nil && !closed {
+		close(this.quit)
+	}
+
+	svc.stop()
+	this.wg.Wait()
+
+	if !closed {
+		this.closeStore()
+	}
 }
 
-func (this *Client) getSession(svc *service, req *message.ConnectMessage, resp *message.ConnackMessage) error {
-	//id := string(req.ClientId())
-	svc.sess = &sessions.Session{}
-	return svc.sess.Init(req)
+// closeStore closes the Store if it was opened from StorePath.
+func (this *Client) closeStore() {
+	if !this.ownStore {
+		return
+	}
+
+	if err := this.Store.Close(); err != nil {
+		this.log.Errorf("client/closeStore: Error closing session store: %v", err)
+	}
+
+	this.Store = nil
+	this.ownStore = false
+}
+
+// getSession sets up the session for the first connection. With a Store, and
+// CleanSession set to 0, it's the session kept in the Store if there's one, in
+// which case getSession returns true.
+func (this *Client) getSession(svc *service, req *message.ConnectMessage, resp *message.ConnackMessage) (bool, error) {
+	if this.Store == nil {
+		svc.sess = &sessions.Session{}
+		return false, svc.sess.Init(req)
+	}
+
+	id := string(req.ClientId())
+	svc.store = this.Store
+
+	if req.CleanSession() {
+		this.Store.Del(id)
+	} else if sess, err := this.Store.Get(id); err == nil {
+		svc.sess = sess
+		return true, sess.Update(req)
+	}
+
+	sess, err := this.Store.New(id)
+	if err != nil {
+		return false, err
+	}
+
+	if err := sess.Init(req); err != nil {
+		this.Store.Del(id)
+		return false, err
+	}
+
+	svc.sess = sess
+
+	return false, nil
 }
 
 func (this *Client) checkConfiguration() {
@@ -203,4 +612,34 @@ func (this *Client) checkConfiguration() {
 	if this.TimeoutRetries == 0 {
 		this.TimeoutRetries = DefaultTimeoutRetries
 	}
+
+	if this.Logger == nil {
+		this.Logger = logger.NewGlogLogger()
+	}
+
+	if this.ResponseTopicPrefix == "" {
+		this.ResponseTopicPrefix = DefaultResponseTopicPrefix
+	}
+
+	this.log = this.Logger.With(logger.Subsystem, "client")
+}
+
+func (this *ReconnectPolicy) checkConfiguration() {
+	if this.MinBackoff == 0 {
+		this.MinBackoff = DefaultReconnectMinBackoff
+	}
+
+	if this.MaxBackoff == 0 {
+		this.MaxBackoff = DefaultReconnectMaxBackoff
+	}
+
+	if this.MaxBackoff < this.MinBackoff {
+		this.MaxBackoff = this.MinBackoff
+	}
+
+	if this.Jitter < 0 {
+		this.Jitter = 0
+	} else if this.Jitter > 1 {
+		this.Jitter = 1
+	}
 }
@@ -0,0 +1,548 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/topics"
+)
+
+// acceptConnect accepts a connection on ln, checks the CONNECT message and sends back
+// a CONNACK, without the session present flag.
+func acceptConnect(t *testing.T, ln net.Listener, cid string) net.Conn {
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+
+	msg := expectMessage(t, conn, message.CONNECT)
+	require.Equal(t, cid, string(msg.(*message.ConnectMessage).ClientId()))
+
+	require.NoError(t, writeMessage(conn, message.NewConnackMessage()))
+
+	return conn
+}
+
+func TestClientReconnect(t *testing.T) {
+	// The server is played by the test, so it can drop the connection at any point
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	lost := make(chan struct{}, 1)
+	reconnected := make(chan struct{}, 1)
+
+	c := &Client{
+		Reconnect: &ReconnectPolicy{
+			MinBackoff: time.Millisecond * 10,
+			MaxBackoff: time.Millisecond * 50,
+			Jitter:     0.5,
+		},
+		OnConnectionLost: func() { lost <- struct{}{} },
+		OnReconnect:      func() { reconnected <- struct{}{} },
+	}
+
+	cmsg := newConnectMessage()
+	cmsg.SetWillFlag(false)
+	cmsg.SetWillQos(0)
+	cid := string(cmsg.ClientId())
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.Connect("tcp://"+ln.Addr().String(), cmsg)
+	}()
+
+	conn := acceptConnect(t, ln, cid)
+	require.NoError(t, <-errc)
+	defer c.Disconnect()
+
+	received := make(chan string, 1)
+	subscribed := make(chan error, 1)
+
+	sub := newSubscribeMessage(1)
+	sub.SetPacketId(1)
+
+	require.NoError(t, c.Subscribe(sub, func(msg, ack message.Message, err error) error {
+		subscribed <- err
+		return nil
+	}, func(msg *message.PublishMessage) error {
+		received <- string(msg.Payload())
+		return nil
+	}))
+
+	msg := expectMessage(t, conn, message.SUBSCRIBE)
+	suback := message.NewSubackMessage()
+	suback.SetPacketId(msg.PacketId())
+	suback.AddReturnCode(1)
+	require.NoError(t, writeMessage(conn, suback))
+	require.NoError(t, <-subscribed)
+
+	// The server goes away without acking the message
+	acked := make(chan error, 1)
+
+	require.NoError(t, c.Publish(newPublishMessage(7, 1), func(msg, ack message.Message, err error) error {
+		acked <- err
+		return nil
+	}))
+
+	msg = expectMessage(t, conn, message.PUBLISH)
+	require.False(t, msg.(*message.PublishMessage).Dup())
+	conn.Close()
+
+	<-lost
+
+	// The client is back with the same client ID, sends the message again, and, since
+	// the session wasn't kept, subscribes again
+	conn = acceptConnect(t, ln, cid)
+	defer conn.Close()
+
+	<-reconnected
+
+	msg = expectMessage(t, conn, message.PUBLISH)
+	require.True(t, msg.(*message.PublishMessage).Dup())
+	require.Equal(t, uint16(7), msg.PacketId())
+
+	puback := message.NewPubackMessage()
+	puback.SetPacketId(7)
+	require.NoError(t, writeMessage(conn, puback))
+	require.NoError(t, <-acked)
+
+	msg = expectMessage(t, conn, message.SUBSCRIBE)
+	require.Equal(t, [][]byte{[]byte("abc")}, msg.(*message.SubscribeMessage).Topics())
+	require.Equal(t, []byte{1}, msg.(*message.SubscribeMessage).Qos())
+
+	suback = message.NewSubackMessage()
+	suback.SetPacketId(msg.PacketId())
+	suback.AddReturnCode(1)
+	require.NoError(t, writeMessage(conn, suback))
+
+	// The messages for the first subscription still get to where they should
+	require.NoError(t, writeMessage(conn, newPublishMessage(0, 0)))
+	require.Equal(t, "abc", <-received)
+}
+
+func TestClientStore(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	dir, err := ioutil.TempDir("", "surgemq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	uri := "tcp://" + ln.Addr().String()
+	path := filepath.Join(dir, "client.db")
+
+	cmsg := newPersistentConnectMessage()
+	cid := string(cmsg.ClientId())
+
+	connect := func() (*Client, net.Conn) {
+		c := &Client{StorePath: path}
+
+		errc := make(chan error, 1)
+		go func() {
+			errc <- c.Connect(uri, cmsg)
+		}()
+
+		conn := acceptConnect(t, ln, cid)
+		require.NoError(t, <-errc)
+
+		return c, conn
+	}
+
+	// The server gets a QoS 1 message it never acks, and sends a QoS 2 message it
+	// never releases, before the client goes away
+	c, conn := connect()
+
+	require.NoError(t, c.Publish(newPublishMessage(7, 1), nil))
+	expectMessage(t, conn, message.PUBLISH)
+
+	require.NoError(t, writeMessage(conn, newPayloadMessage(9, 2, "once")))
+	expectMessage(t, conn, message.PUBREC)
+
+	conn.Close()
+	<-c.svc.stopped
+	c.Disconnect()
+	topics.Unregister(cid)
+
+	// The next client with the same ID picks up where it left off
+	c, conn = connect()
+	defer conn.Close()
+	defer topics.Unregister(cid)
+	defer c.Disconnect()
+
+	msg := expectMessage(t, conn, message.PUBLISH)
+	require.True(t, msg.(*message.PublishMessage).Dup())
+	require.Equal(t, uint16(7), msg.PacketId())
+
+	received := make(chan string, 1)
+
+	sub := newSubscribeMessage(1)
+	sub.SetPacketId(1)
+
+	require.NoError(t, c.Subscribe(sub, nil, func(msg *message.PublishMessage) error {
+		received <- string(msg.Payload())
+		return nil
+	}))
+
+	msg = expectMessage(t, conn, message.SUBSCRIBE)
+
+	suback := message.NewSubackMessage()
+	suback.SetPacketId(msg.PacketId())
+	suback.AddReturnCode(1)
+	require.NoError(t, writeMessage(conn, suback))
+
+	require.NoError(t, writeMessage(conn, newPubrelMessage(9)))
+	expectMessage(t, conn, message.PUBCOMP)
+	require.Equal(t, "once", <-received)
+}
+
+func TestClientReconnectGivesUp(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	lost := make(chan struct{}, 1)
+
+	c := &Client{
+		Reconnect: &ReconnectPolicy{
+			MinBackoff: time.Millisecond * 10,
+			MaxRetries: 2,
+		},
+		OnConnectionLost: func() { lost <- struct{}{} },
+		OnReconnect:      func() { t.Error("Not expecting to reconnect") },
+	}
+
+	cmsg := newConnectMessage()
+	cmsg.SetWillFlag(false)
+	cmsg.SetWillQos(0)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.Connect("tcp://"+ln.Addr().String(), cmsg)
+	}()
+
+	conn := acceptConnect(t, ln, string(cmsg.ClientId()))
+	require.NoError(t, <-errc)
+
+	// Nothing is listening any more, so all the attempts fail
+	ln.Close()
+	conn.Close()
+
+	<-lost
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expecting the client to give up")
+	}
+
+	require.Error(t, c.Publish(newPublishMessage(1, 0), nil))
+	c.Disconnect()
+}
+
+func TestClientSubscribeHandlers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	c := &Client{}
+
+	cmsg := newConnectMessage()
+	cmsg.SetWillFlag(false)
+	cmsg.SetWillQos(0)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.Connect("tcp://"+ln.Addr().String(), cmsg)
+	}()
+
+	conn := acceptConnect(t, ln, string(cmsg.ClientId()))
+	defer conn.Close()
+	require.NoError(t, <-errc)
+	defer c.Disconnect()
+
+	received := make(chan string, 10)
+
+	handler := func(name string) OnPublishFunc {
+		return func(msg *message.PublishMessage) error {
+			received <- name + " " + string(msg.Topic())
+			return nil
+		}
+	}
+
+	subscribe := func(pktid uint16, handlers map[string]OnPublishFunc) {
+		sub := message.NewSubscribeMessage()
+		sub.SetPacketId(pktid)
+
+		for filter := range handlers {
+			sub.AddTopic([]byte(filter), 0)
+		}
+
+		subscribed := make(chan error, 1)
+
+		require.NoError(t, c.SubscribeHandlers(sub, func(msg, ack message.Message, err error) error {
+			subscribed <- err
+			return nil
+		}, handlers))
+
+		msg := expectMessage(t, conn, message.SUBSCRIBE)
+		suback := message.NewSubackMessage()
+		suback.SetPacketId(msg.PacketId())
+
+		for range handlers {
+			suback.AddReturnCode(0)
+		}
+
+		require.NoError(t, writeMessage(conn, suback))
+		require.NoError(t, <-subscribed)
+	}
+
+	publish := func(topic string) {
+		pub := newPublishMessage(0, 0)
+		pub.SetTopic([]byte(topic))
+		require.NoError(t, writeMessage(conn, pub))
+	}
+
+	subscribe(1, map[string]OnPublishFunc{
+		"a/+": handler("a"),
+		"b/#": handler("b"),
+	})
+
+	publish("a/1")
+	require.Equal(t, "a a/1", <-received)
+
+	publish("b/1/2")
+	require.Equal(t, "b b/1/2", <-received)
+
+	// Subscribing to the filter again replaces its handler
+	subscribe(2, map[string]OnPublishFunc{"a/+": handler("c")})
+
+	publish("a/2")
+	require.Equal(t, "c a/2", <-received)
+
+	publish("b/2")
+	require.Equal(t, "b b/2", <-received)
+
+	select {
+	case s := <-received:
+		t.Fatalf("Not expecting %q", s)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// Every filter needs a handler
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketId(3)
+	sub.AddTopic([]byte("d"), 0)
+	require.Error(t, c.SubscribeHandlers(sub, nil, map[string]OnPublishFunc{"e": handler("e")}))
+}
+
+func TestClientContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	c := &Client{}
+
+	cmsg := newConnectMessage()
+	cmsg.SetWillFlag(false)
+	cmsg.SetWillQos(0)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.Connect("tcp://"+ln.Addr().String(), cmsg)
+	}()
+
+	conn := acceptConnect(t, ln, string(cmsg.ClientId()))
+	defer conn.Close()
+	require.NoError(t, <-errc)
+	defer c.Disconnect()
+
+	// The test plays the server, so the calls are made in the background
+	call := func(f func() error) chan error {
+		errc := make(chan error, 1)
+		go func() {
+			errc <- f()
+		}()
+
+		return errc
+	}
+
+	ctx := context.Background()
+
+	// QoS 0 messages are done once they're sent
+	require.NoError(t, c.PublishContext(ctx, newPublishMessage(0, 0)))
+	expectMessage(t, conn, message.PUBLISH)
+
+	// QoS 1 messages wait for the PUBACK
+	errc = call(func() error { return c.PublishContext(ctx, newPublishMessage(1, 1)) })
+	expectMessage(t, conn, message.PUBLISH)
+
+	select {
+	case err := <-errc:
+		t.Fatalf("Not expecting PublishContext to return before the PUBACK, got %v", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	puback := message.NewPubackMessage()
+	puback.SetPacketId(1)
+	require.NoError(t, writeMessage(conn, puback))
+	require.NoError(t, <-errc)
+
+	// The SUBACK says whether the topics were accepted
+	sub := newSubscribeMessage(1)
+	sub.SetPacketId(2)
+	sub.AddTopic([]byte("def"), 1)
+
+	errc = call(func() error {
+		return c.SubscribeContext(ctx, sub, func(msg *message.PublishMessage) error { return nil })
+	})
+
+	msg := expectMessage(t, conn, message.SUBSCRIBE)
+	suback := message.NewSubackMessage()
+	suback.SetPacketId(msg.PacketId())
+	suback.AddReturnCode(1)
+	suback.AddReturnCode(message.QosFailure)
+	require.NoError(t, writeMessage(conn, suback))
+	require.Error(t, <-errc)
+
+	unsub := newUnsubscribeMessage()
+	unsub.SetPacketId(3)
+
+	errc = call(func() error { return c.UnsubscribeContext(ctx, unsub) })
+
+	msg = expectMessage(t, conn, message.UNSUBSCRIBE)
+	unsuback := message.NewUnsubackMessage()
+	unsuback.SetPacketId(msg.PacketId())
+	require.NoError(t, writeMessage(conn, unsuback))
+	require.NoError(t, <-errc)
+
+	errc = call(func() error { return c.PingContext(ctx) })
+	expectMessage(t, conn, message.PINGREQ)
+	require.NoError(t, writeMessage(conn, message.NewPingrespMessage()))
+	require.NoError(t, <-errc)
+
+	// No ack in time
+	tctx, cancel := context.WithTimeout(ctx, time.Millisecond*50)
+	defer cancel()
+
+	require.Equal(t, context.DeadlineExceeded, c.PublishContext(tctx, newPublishMessage(4, 2)))
+	expectMessage(t, conn, message.PUBLISH)
+
+	// No ack ever, since the connection is gone
+	errc = call(func() error { return c.PingContext(ctx) })
+	expectMessage(t, conn, message.PINGREQ)
+	conn.Close()
+
+	require.Equal(t, ErrConnectionLost, <-errc)
+}
+
+func TestClientRequest(t *testing.T) {
+	var wg sync.WaitGroup
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+
+	uri := "tcp://127.0.0.1:1883"
+	u, err := url.Parse(uri)
+	require.NoError(t, err, "Error parsing URL")
+
+	wg.Add(1)
+	go startServiceN(t, u, &wg, ready1, ready2, 2)
+
+	<-ready1
+
+	connect := func(cid string) *Client {
+		cmsg := newConnectMessage()
+		cmsg.SetClientId([]byte(cid))
+
+		c := &Client{}
+		require.NoError(t, c.Connect(uri, cmsg))
+
+		return c
+	}
+
+	responder := connect("responder")
+	defer topics.Unregister(responder.svc.sess.ID())
+
+	requester := connect("requester")
+	defer topics.Unregister(requester.svc.sess.ID())
+
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketId(1)
+	sub.AddTopic([]byte("svc/upper"), 1)
+
+	require.NoError(t, responder.SubscribeContext(context.Background(), sub, func(msg *message.PublishMessage) error {
+		_, _, payload, err := DecodeRequest(msg.Payload())
+		if err != nil {
+			return err
+		}
+
+		return responder.Respond(msg, bytes.ToUpper(payload), nil)
+	}))
+
+	resp, err := requester.Request("svc/upper", []byte("hello"), time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "HELLO", string(resp))
+
+	// Each request gets its own response
+	resp, err = requester.Request("svc/upper", []byte("again"), time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "AGAIN", string(resp))
+
+	// No one is listening
+	_, err = requester.Request("svc/lower", []byte("hello"), time.Millisecond*100)
+	require.Equal(t, ErrRequestTimeout, err)
+
+	responder.Disconnect()
+	requester.Disconnect()
+
+	close(ready2)
+
+	wg.Wait()
+}
+
+func TestEncodeRequest(t *testing.T) {
+	b, err := EncodeRequest([]byte("responses/a/1"), []byte("1"), []byte("hello"))
+	require.NoError(t, err)
+
+	topic, correlation, payload, err := DecodeRequest(b)
+	require.NoError(t, err)
+	require.Equal(t, "responses/a/1", string(topic))
+	require.Equal(t, "1", string(correlation))
+	require.Equal(t, "hello", string(payload))
+
+	// Not a request
+	_, _, _, err = DecodeRequest([]byte("hello"))
+	require.Equal(t, ErrInvalidRequest, err)
+
+	_, _, _, err = DecodeRequest(b[:5])
+	require.Equal(t, ErrInvalidRequest, err)
+}
@@ -0,0 +1,1088 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logger"
+	"github.com/surgemq/surgemq/topics"
+)
+
+const (
+	DefaultClusterRefreshInterval = time.Second * 5
+	DefaultClusterTakeoverTimeout = time.Second
+)
+
+// How long to wait for another node to answer the hello, or to take a frame, before
+// giving up on the connection.
+const clusterTimeout = time.Second * 5
+
+// How often to check whether a node has connected back while handing a session over.
+const clusterLinkWait = time.Millisecond * 10
+
+var errClusterNotConnected = errors.New("Cluster node is not connected")
+
+// Discovery finds the other nodes of a cluster. Peers is called when the cluster
+// starts, and then every RefreshInterval, so nodes can come and go.
+type Discovery interface {
+	// Peers returns the cluster addresses of the nodes, e.g., "10.0.0.2:7946". It's
+	// fine for the list to include this node.
+	Peers() ([]string, error)
+}
+
+type staticDiscovery []string
+
+// NewStaticDiscovery returns a Discovery for a fixed list of nodes.
+func NewStaticDiscovery(addrs ...string) Discovery {
+	return staticDiscovery(addrs)
+}
+
+func (this staticDiscovery) Peers() ([]string, error) {
+	return this, nil
+}
+
+type dnsDiscovery struct {
+	name string
+	port int
+}
+
+// NewDNSDiscovery returns a Discovery that looks up the addresses of name, e.g., a
+// headless Kubernetes service, and expects the nodes to listen on port at each.
+func NewDNSDiscovery(name string, port int) Discovery {
+	return &dnsDiscovery{name: name, port: port}
+}
+
+func (this *dnsDiscovery) Peers() ([]string, error) {
+	hosts, err := net.LookupHost(this.name)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, len(hosts))
+	for i, h := range hosts {
+		addrs[i] = net.JoinHostPort(h, strconv.Itoa(this.port))
+	}
+
+	return addrs, nil
+}
+
+// The kinds of frames the nodes send each other
+const (
+	clusterHello byte = iota
+	clusterSubscribe
+	clusterUnsubscribe
+	clusterPublish
+	clusterRetain
+	clusterTakeover
+	clusterSession
+	clusterAuth
+)
+
+// clusterFrame is what the nodes send each other. Only the fields for the kind of
+// frame are set.
+type clusterFrame struct {
+	Kind byte
+
+	// The node ID, for clusterHello
+	Node string
+
+	// The topic filter subscribed or unsubscribed on the node
+	Filter string
+
+	// The encoded PUBLISH message, for clusterPublish and clusterRetain
+	Msg []byte
+
+	// The client whose session is taken over, for clusterTakeover, and the same Seq
+	// along with the encoded session, if the node had it, for clusterSession
+	ClientId string
+	Seq      uint64
+	Session  []byte
+
+	// The challenge in each node's clusterHello, and the answer to the other node's,
+	// which proves it knows the Secret. The node dialed answers in its clusterHello,
+	// the node dialing in a clusterAuth right after.
+	Nonce []byte
+	Proof []byte
+}
+
+// clusterLink is a connection this node dialed to another node, which is where all
+// the frames for the other node are sent.
+type clusterLink struct {
+	addr string
+	node string
+
+	conn net.Conn
+	enc  *gob.Encoder
+	mu   sync.Mutex
+}
+
+func (this *clusterLink) send(f *clusterFrame) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.conn.SetWriteDeadline(time.Now().Add(clusterTimeout))
+
+	if err := this.enc.Encode(f); err != nil {
+		this.conn.Close()
+		return err
+	}
+
+	return nil
+}
+
+// clusterPeer is a connection another node dialed to this node, which is where all
+// the frames from the other node come in. It's the subscriber of the other node's
+// topic filters in the cluster's routes.
+type clusterPeer struct {
+	node    string
+	filters map[string]struct{}
+}
+
+// Cluster lets several servers act as one. The nodes tell each other the topic
+// filters subscribed by their clients, and each PUBLISH message is forwarded to the
+// nodes with matching subscriptions, so clients connected to different nodes can
+// talk to each other. Retained messages are copied to all the nodes. When a client
+// connects to a node, any other node it was connected to is asked to disconnect it
+// and hand over its session, so a client with a persistent session can move between
+// nodes.
+//
+// Each node dials all the others, found through Discovery, and keeps trying every
+// RefreshInterval for the ones it's not connected to. Messages for a node that's not
+// connected are dropped. Shared subscriptions get one copy of each message for each
+// node that has members of the group.
+//
+// The nodes trust each other completely: the messages from the other nodes skip the
+// authorizer and the payload filters, and any node can take over any session. So
+// only the nodes can be allowed to connect, see Secret and TLSConfig.
+type Cluster struct {
+	// NodeId identifies the node. It has to be unique across the cluster. If not set
+	// then default to the host name and ListenAddr.
+	NodeId string
+
+	// ListenAddr is the address the node accepts the connections from the other nodes
+	// on, e.g., ":7946". It must never be reachable from outside the cluster, even
+	// with a Secret or TLSConfig.
+	ListenAddr string
+
+	// Secret is shared by all the nodes. If set then the nodes prove to each other
+	// that they know it when they connect, and the connections from anyone who
+	// doesn't are closed before any frame is taken. It doesn't keep the frames from
+	// being read, or changed, on the way, see TLSConfig for that.
+	Secret string
+
+	// TLSConfig, if set, is used for the connections between the nodes, both ways. It
+	// needs the node's certificate, and the CA of the other nodes' certificates in
+	// both RootCAs and ClientCAs, with ClientAuth set to
+	// tls.RequireAndVerifyClientCert, so only the nodes can connect.
+	TLSConfig *tls.Config
+
+	// Discovery finds the other nodes.
+	Discovery Discovery
+
+	// How often Discovery is asked for the nodes, and the ones not connected are
+	// dialed again. If not set then default to 5 seconds.
+	RefreshInterval time.Duration
+
+	// How long a node waits for the others to hand over the session of a client that
+	// connects. If not set then default to 1 second.
+	TakeoverTimeout time.Duration
+
+	svr *Server
+	ln  net.Listener
+	log logger.Logger
+
+	// The links to the other nodes by node ID, and the addresses dialed, or being
+	// dialed, with whether they turned out to be this node. Protected by mu.
+	links  map[string]*clusterLink
+	dialed map[string]bool
+	mu     sync.Mutex
+
+	// The topic filters subscribed on this node, each with the local subscribers.
+	// Protected by smu, which is also held while the changes are sent, so they reach
+	// the other nodes in order.
+	filters map[string]map[clusterSub]struct{}
+	smu     sync.Mutex
+
+	// The topic filters subscribed on the other nodes, with a clusterPeer for each
+	// node as the subscriber
+	routes topics.TopicsProvider
+
+	// Subscribed to everything on this server, to forward the messages to the other
+	// nodes
+	onpub OnPublishFunc
+
+	// The messages from the other nodes being published, or retained, on this server
+	// right now, so they're not sent back. Protected by imu.
+	inbound map[*message.PublishMessage]struct{}
+	imu     sync.Mutex
+
+	// The takeovers waiting for the other nodes to answer, by Seq. Protected by pmu.
+	seq     uint64
+	pending map[uint64]chan []byte
+	pmu     sync.Mutex
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// clusterSub is a local subscriber of a topic filter, which may be a shared
+// subscription for the filter.
+type clusterSub struct {
+	topic string
+	sub   interface{}
+}
+
+func (this *Cluster) checkConfiguration() error {
+	if this.ListenAddr == "" {
+		return fmt.Errorf("cluster/checkConfiguration: No listen address")
+	}
+
+	if this.Discovery == nil {
+		return fmt.Errorf("cluster/checkConfiguration: No discovery")
+	}
+
+	if this.NodeId == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+
+		this.NodeId = host + this.ListenAddr
+	}
+
+	if this.RefreshInterval == 0 {
+		this.RefreshInterval = DefaultClusterRefreshInterval
+	}
+
+	if this.TakeoverTimeout == 0 {
+		this.TakeoverTimeout = DefaultClusterTakeoverTimeout
+	}
+
+	this.links = make(map[string]*clusterLink)
+	this.dialed = make(map[string]bool)
+	this.filters = make(map[string]map[clusterSub]struct{})
+	this.routes = topics.NewMemProvider()
+	this.inbound = make(map[*message.PublishMessage]struct{})
+	this.pending = make(map[uint64]chan []byte)
+	this.quit = make(chan struct{})
+
+	this.onpub = func(msg *message.PublishMessage) error {
+		return this.forward(msg)
+	}
+
+	return nil
+}
+
+// start listens for the other nodes, and starts dialing them.
+func (this *Cluster) start(svr *Server) error {
+	this.svr = svr
+	this.log = svr.Logger.With(logger.Subsystem, "cluster")
+
+	ln, err := net.Listen("tcp", this.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	if this.TLSConfig != nil {
+		ln = tls.NewListener(ln, this.TLSConfig)
+	}
+
+	this.ln = ln
+
+	if _, err := svr.topicsMgr.Subscribe([]byte(topics.MWC), message.QosExactlyOnce, &this.onpub); err != nil {
+		ln.Close()
+		return err
+	}
+
+	this.wg.Add(2)
+	go this.acceptLoop()
+	go this.refreshLoop()
+
+	this.log.Infof("cluster/start: (%s) Listening on %s", this.NodeId, this.ListenAddr)
+
+	if this.Secret == "" && this.TLSConfig == nil {
+		this.log.Warningf("cluster/start: (%s) No Secret or TLSConfig, anyone who can reach %s is trusted as a node", this.NodeId, this.ListenAddr)
+	}
+
+	return nil
+}
+
+// stop disconnects from the other nodes.
+func (this *Cluster) stop() {
+	select {
+	case <-this.quit:
+		return
+
+	default:
+	}
+
+	close(this.quit)
+	this.ln.Close()
+
+	this.mu.Lock()
+	for _, l := range this.links {
+		l.conn.Close()
+	}
+	this.mu.Unlock()
+
+	this.wg.Wait()
+
+	this.svr.topicsMgr.Unsubscribe([]byte(topics.MWC), &this.onpub)
+}
+
+func (this *Cluster) isStopped() bool {
+	select {
+	case <-this.quit:
+		return true
+
+	default:
+	}
+
+	return false
+}
+
+func (this *Cluster) refreshLoop() {
+	defer this.wg.Done()
+
+	tick := time.NewTicker(this.RefreshInterval)
+	defer tick.Stop()
+
+	for {
+		this.refresh()
+
+		select {
+		case <-this.quit:
+			return
+
+		case <-tick.C:
+		}
+	}
+}
+
+// refresh dials the nodes that are not connected.
+func (this *Cluster) refresh() {
+	addrs, err := this.Discovery.Peers()
+	if err != nil {
+		this.log.Errorf("cluster/refresh: (%s) Error discovering nodes: %v", this.NodeId, err)
+		return
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, addr := range addrs {
+		if _, ok := this.dialed[addr]; ok || addr == "" {
+			continue
+		}
+
+		this.dialed[addr] = false
+
+		this.wg.Add(1)
+		go this.dial(addr)
+	}
+}
+
+// dial connects to the node at addr and, once it knows who it is, tells it about all
+// the topic filters and retained messages on this node.
+func (this *Cluster) dial(addr string) {
+	defer this.wg.Done()
+
+	self := false
+
+	defer func() {
+		this.mu.Lock()
+		if self {
+			this.dialed[addr] = true
+		} else {
+			delete(this.dialed, addr)
+		}
+		this.mu.Unlock()
+	}()
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	if this.TLSConfig != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: clusterTimeout}, "tcp", addr, this.TLSConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, clusterTimeout)
+	}
+
+	if err != nil {
+		this.log.Debugf("cluster/dial: (%s) Error connecting to %s: %v", this.NodeId, addr, err)
+		return
+	}
+	defer conn.Close()
+
+	l := &clusterLink{
+		addr: addr,
+		conn: conn,
+		enc:  gob.NewEncoder(conn),
+	}
+
+	nonce, err := clusterNonce()
+	if err != nil {
+		this.log.Errorf("cluster/dial: (%s) %v", this.NodeId, err)
+		return
+	}
+
+	if err := l.send(&clusterFrame{Kind: clusterHello, Node: this.NodeId, Nonce: nonce}); err != nil {
+		return
+	}
+
+	dec := gob.NewDecoder(conn)
+
+	var hello clusterFrame
+
+	conn.SetReadDeadline(time.Now().Add(clusterTimeout))
+
+	if err := dec.Decode(&hello); err != nil || hello.Kind != clusterHello {
+		this.log.Errorf("cluster/dial: (%s) No hello from %s: %v", this.NodeId, addr, err)
+		return
+	}
+
+	if this.Secret != "" && !hmac.Equal(hello.Proof, this.proof("listener", hello.Node, nonce)) {
+		this.log.Errorf("cluster/dial: (%s) %s at %s doesn't know the secret", this.NodeId, hello.Node, addr)
+		return
+	}
+
+	if hello.Node == this.NodeId {
+		self = true
+		return
+	}
+
+	if this.Secret != "" {
+		if err := l.send(&clusterFrame{Kind: clusterAuth, Proof: this.proof("dialer", this.NodeId, hello.Nonce)}); err != nil {
+			return
+		}
+	}
+
+	l.node = hello.Node
+
+	if !this.addLink(l) {
+		return
+	}
+
+	defer this.removeLink(l)
+
+	this.log.Infof("cluster/dial: (%s) Connected to %s at %s", this.NodeId, l.node, addr)
+
+	this.sendRetained(l)
+
+	// Nothing else comes in on the link, so this only returns once it's closed
+	conn.SetReadDeadline(time.Time{})
+	dec.Decode(&hello)
+
+	this.log.Infof("cluster/dial: (%s) Disconnected from %s", this.NodeId, l.node)
+}
+
+// addLink sends all the topic filters subscribed on this node to the other node, and
+// makes it the link to that node, so it gets the changes too. It returns false if
+// there's already a link to the node.
+func (this *Cluster) addLink(l *clusterLink) bool {
+	this.smu.Lock()
+	defer this.smu.Unlock()
+
+	this.mu.Lock()
+	_, ok := this.links[l.node]
+	if !ok && !this.isStopped() {
+		this.links[l.node] = l
+	}
+	this.mu.Unlock()
+
+	if ok {
+		return false
+	}
+
+	for f := range this.filters {
+		if err := l.send(&clusterFrame{Kind: clusterSubscribe, Filter: f}); err != nil {
+			break
+		}
+	}
+
+	return true
+}
+
+func (this *Cluster) removeLink(l *clusterLink) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.links[l.node] == l {
+		delete(this.links, l.node)
+	}
+}
+
+func (this *Cluster) link(node string) *clusterLink {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.links[node]
+}
+
+func (this *Cluster) allLinks() []*clusterLink {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	links := make([]*clusterLink, 0, len(this.links))
+	for _, l := range this.links {
+		links = append(links, l)
+	}
+
+	return links
+}
+
+// broadcast sends the frame to all the other nodes.
+func (this *Cluster) broadcast(f *clusterFrame) {
+	for _, l := range this.allLinks() {
+		if err := l.send(f); err != nil {
+			this.log.Errorf("cluster/broadcast: (%s) Error sending to %s: %v", this.NodeId, l.node, err)
+		}
+	}
+}
+
+func (this *Cluster) sendRetained(l *clusterLink) {
+	// The link could be slow, so the retained messages are not collected first
+	err := this.svr.topicsMgr.RetainedEach([]byte(topics.MWC), func(msg *message.PublishMessage) error {
+		b, err := encodePublish(msg)
+		if err != nil {
+			return nil
+		}
+
+		return l.send(&clusterFrame{Kind: clusterRetain, Msg: b})
+	})
+
+	if err != nil {
+		this.log.Errorf("cluster/sendRetained: (%s) %v", this.NodeId, err)
+	}
+}
+
+func (this *Cluster) acceptLoop() {
+	defer this.wg.Done()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	var conns sync.Map
+	defer conns.Range(func(k, _ interface{}) bool {
+		k.(net.Conn).Close()
+		return true
+	})
+
+	for {
+		conn, err := this.ln.Accept()
+		if err != nil {
+			if !this.isStopped() {
+				this.log.Errorf("cluster/acceptLoop: (%s) %v", this.NodeId, err)
+			}
+
+			return
+		}
+
+		conns.Store(conn, nil)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conns.Delete(conn)
+
+			this.serve(conn)
+		}()
+	}
+}
+
+// serve handles the frames from another node.
+func (this *Cluster) serve(conn net.Conn) {
+	defer conn.Close()
+
+	dec := gob.NewDecoder(conn)
+
+	var f clusterFrame
+
+	conn.SetReadDeadline(time.Now().Add(clusterTimeout))
+
+	if err := dec.Decode(&f); err != nil || f.Kind != clusterHello {
+		this.log.Errorf("cluster/serve: (%s) No hello from %s: %v", this.NodeId, conn.RemoteAddr(), err)
+		return
+	}
+
+	nonce, err := clusterNonce()
+	if err != nil {
+		this.log.Errorf("cluster/serve: (%s) %v", this.NodeId, err)
+		return
+	}
+
+	hello := &clusterFrame{Kind: clusterHello, Node: this.NodeId, Nonce: nonce}
+	if this.Secret != "" {
+		hello.Proof = this.proof("listener", this.NodeId, f.Nonce)
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(clusterTimeout))
+
+	if err := gob.NewEncoder(conn).Encode(hello); err != nil {
+		return
+	}
+
+	if f.Node == this.NodeId {
+		return
+	}
+
+	// Nothing from the other node is taken until it has proven it knows the secret
+	if this.Secret != "" {
+		var auth clusterFrame
+
+		if err := dec.Decode(&auth); err != nil || auth.Kind != clusterAuth || !hmac.Equal(auth.Proof, this.proof("dialer", f.Node, nonce)) {
+			this.log.Errorf("cluster/serve: (%s) %s at %s doesn't know the secret", this.NodeId, f.Node, conn.RemoteAddr())
+			return
+		}
+	}
+
+	// Connect back right away rather than on the next refresh
+	if this.link(f.Node) == nil {
+		this.wg.Add(1)
+		go func() {
+			defer this.wg.Done()
+			this.refresh()
+		}()
+	}
+
+	p := &clusterPeer{
+		node:    f.Node,
+		filters: make(map[string]struct{}),
+	}
+
+	defer func() {
+		for filter := range p.filters {
+			this.routes.Unsubscribe([]byte(filter), p)
+		}
+	}()
+
+	conn.SetReadDeadline(time.Time{})
+
+	for {
+		f = clusterFrame{}
+
+		if err := dec.Decode(&f); err != nil {
+			if !this.isStopped() {
+				this.log.Debugf("cluster/serve: (%s) Connection from %s closed: %v", this.NodeId, p.node, err)
+			}
+
+			return
+		}
+
+		switch f.Kind {
+		case clusterSubscribe:
+			if _, err := this.routes.Subscribe([]byte(f.Filter), message.QosExactlyOnce, p); err != nil {
+				this.log.Errorf("cluster/serve: (%s) Error subscribing %s to %q: %v", this.NodeId, p.node, f.Filter, err)
+			} else {
+				p.filters[f.Filter] = struct{}{}
+			}
+
+		case clusterUnsubscribe:
+			if _, ok := p.filters[f.Filter]; ok {
+				this.routes.Unsubscribe([]byte(f.Filter), p)
+				delete(p.filters, f.Filter)
+			}
+
+		case clusterPublish, clusterRetain:
+			msg := message.NewPublishMessage()
+			if _, err := msg.Decode(f.Msg); err != nil {
+				this.log.Errorf("cluster/serve: (%s) Error decoding message from %s: %v", this.NodeId, p.node, err)
+				continue
+			}
+
+			this.deliver(msg, f.Kind == clusterRetain)
+
+		case clusterTakeover:
+			this.wg.Add(1)
+			go this.handover(p.node, f.ClientId, f.Seq)
+
+		case clusterSession:
+			this.pmu.Lock()
+			ch, ok := this.pending[f.Seq]
+			this.pmu.Unlock()
+
+			if ok {
+				ch <- f.Session
+			}
+		}
+	}
+}
+
+// proof returns the answer of the node to the challenge in nonce, as the node
+// dialed, or the node dialing, which is role.
+func (this *Cluster) proof(role, node string, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(this.Secret))
+	mac.Write([]byte(role + "\x00" + node + "\x00"))
+	mac.Write(nonce)
+
+	return mac.Sum(nil)
+}
+
+// clusterNonce returns a new random challenge for the other node.
+func clusterNonce() ([]byte, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// deliver publishes, or retains, a message from another node on this server.
+func (this *Cluster) deliver(msg *message.PublishMessage, retain bool) {
+	this.imu.Lock()
+	this.inbound[msg] = struct{}{}
+	this.imu.Unlock()
+
+	defer func() {
+		this.imu.Lock()
+		delete(this.inbound, msg)
+		this.imu.Unlock()
+	}()
+
+	if retain {
+		if err := retainMessage(this.svr.topicsMgr, msg, this.svr.retainTTL()); err != nil {
+			this.log.Errorf("cluster/deliver: (%s) Error retaining message: %v", this.NodeId, err)
+		}
+
+		return
+	}
+
+	if err := this.svr.Publish(msg, nil); err != nil {
+		this.log.Errorf("cluster/deliver: (%s) Error publishing message: %v", this.NodeId, err)
+	}
+}
+
+func (this *Cluster) isInbound(msg *message.PublishMessage) bool {
+	this.imu.Lock()
+	defer this.imu.Unlock()
+
+	_, ok := this.inbound[msg]
+	return ok
+}
+
+// forward sends a message published on this server to each of the other nodes with
+// a matching subscription, once.
+func (this *Cluster) forward(msg *message.PublishMessage) error {
+	if this.isInbound(msg) {
+		return nil
+	}
+
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	if err := this.routes.Subscribers(msg.Topic(), msg.QoS(), &subs, &qoss); err != nil {
+		return err
+	}
+
+	if len(subs) == 0 {
+		return nil
+	}
+
+	nodes := make(map[string]struct{}, len(subs))
+	for _, s := range subs {
+		nodes[s.(*clusterPeer).node] = struct{}{}
+	}
+
+	b, err := encodePublish(msg)
+	if err != nil {
+		return err
+	}
+
+	for node := range nodes {
+		l := this.link(node)
+		if l == nil {
+			err = errClusterNotConnected
+			continue
+		}
+
+		if serr := l.send(&clusterFrame{Kind: clusterPublish, Msg: b}); serr != nil {
+			err = serr
+		}
+	}
+
+	return err
+}
+
+// takeover asks the other nodes to disconnect the client, if it's connected to them,
+// and hand over its session. It returns the session from the node that had it, or
+// nil if none did, or didn't answer in time.
+func (this *Cluster) takeover(cid string) []byte {
+	links := this.allLinks()
+	if len(links) == 0 {
+		return nil
+	}
+
+	seq := atomic.AddUint64(&this.seq, 1)
+	ch := make(chan []byte, len(links))
+
+	this.pmu.Lock()
+	this.pending[seq] = ch
+	this.pmu.Unlock()
+
+	defer func() {
+		this.pmu.Lock()
+		delete(this.pending, seq)
+		this.pmu.Unlock()
+	}()
+
+	n := 0
+	for _, l := range links {
+		if err := l.send(&clusterFrame{Kind: clusterTakeover, ClientId: cid, Seq: seq}); err == nil {
+			n++
+		}
+	}
+
+	timer := time.NewTimer(this.TakeoverTimeout)
+	defer timer.Stop()
+
+	var sess []byte
+
+	for ; n > 0; n-- {
+		select {
+		case b := <-ch:
+			if b != nil {
+				sess = b
+			}
+
+		case <-timer.C:
+			this.log.Errorf("cluster/takeover: (%s) Timed out waiting for the session of %s", this.NodeId, cid)
+			return sess
+
+		case <-this.quit:
+			return sess
+		}
+	}
+
+	return sess
+}
+
+// handover disconnects the client if it's connected to this node, and sends its
+// session, if there's one, to the node taking it over.
+func (this *Cluster) handover(node, cid string, seq uint64) {
+	defer this.wg.Done()
+
+	// The node taking over may have connected to this one before this one has
+	// connected back, so give it a little time.
+	l := this.link(node)
+
+	for end := time.Now().Add(this.TakeoverTimeout); l == nil && time.Now().Before(end) && !this.isStopped(); {
+		time.Sleep(clusterLinkWait)
+		l = this.link(node)
+	}
+
+	if l == nil {
+		this.log.Errorf("cluster/handover: (%s) Not connected to %s, keeping the session of %s", this.NodeId, node, cid)
+		return
+	}
+
+	sess := this.svr.handoverSession(cid)
+
+	if err := l.send(&clusterFrame{Kind: clusterSession, ClientId: cid, Seq: seq, Session: sess}); err != nil {
+		this.log.Errorf("cluster/handover: (%s) Error sending the session of %s to %s: %v", this.NodeId, cid, node, err)
+	}
+}
+
+// clusterObserver tells the other nodes about the topic filters subscribed on this
+// node, and the messages retained.
+type clusterObserver struct {
+	c *Cluster
+}
+
+var _ topics.Observer = clusterObserver{}
+
+func (this clusterObserver) Subscribed(topic []byte, subscriber interface{}) {
+	filter, ok := this.filter(topic, subscriber)
+	if !ok {
+		return
+	}
+
+	c := this.c
+
+	c.smu.Lock()
+	defer c.smu.Unlock()
+
+	subs, ok := c.filters[filter]
+	if !ok {
+		subs = make(map[clusterSub]struct{})
+		c.filters[filter] = subs
+	}
+
+	subs[clusterSub{string(topic), subscriber}] = struct{}{}
+
+	if !ok {
+		c.broadcast(&clusterFrame{Kind: clusterSubscribe, Filter: filter})
+	}
+}
+
+func (this clusterObserver) Unsubscribed(topic []byte, subscriber interface{}) {
+	filter, ok := this.filter(topic, subscriber)
+	if !ok {
+		return
+	}
+
+	c := this.c
+
+	c.smu.Lock()
+	defer c.smu.Unlock()
+
+	subs, ok := c.filters[filter]
+	if !ok {
+		return
+	}
+
+	delete(subs, clusterSub{string(topic), subscriber})
+
+	if len(subs) == 0 {
+		delete(c.filters, filter)
+		c.broadcast(&clusterFrame{Kind: clusterUnsubscribe, Filter: filter})
+	}
+}
+
+func (this clusterObserver) Retained(msg *message.PublishMessage) {
+	if this.c.isInbound(msg) {
+		return
+	}
+
+	b, err := encodePublish(msg)
+	if err != nil {
+		this.c.log.Errorf("cluster/Retained: (%s) %v", this.c.NodeId, err)
+		return
+	}
+
+	this.c.broadcast(&clusterFrame{Kind: clusterRetain, Msg: b})
+}
+
+// filter returns the topic filter the other nodes need to know about for the
+// subscription, which for a shared subscription is the filter without the $share
+// prefix. It returns false for the cluster's own subscription.
+func (this clusterObserver) filter(topic []byte, subscriber interface{}) (string, bool) {
+	if fn, ok := subscriber.(*OnPublishFunc); ok && fn == &this.c.onpub {
+		return "", false
+	}
+
+	if topics.IsShared(topic) {
+		_, filter, err := topics.SplitShared(topic)
+		if err != nil {
+			return "", false
+		}
+
+		topic = filter
+	}
+
+	return string(topic), true
+}
+
+func encodePublish(msg *message.PublishMessage) ([]byte, error) {
+	b := make([]byte, msg.Len())
+
+	if _, err := msg.Encode(b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// takeoverSession takes over the session of a client from the other nodes of the
+// cluster, if one of them has it, and keeps it in the session store so the client
+// picks up where it left off. The other nodes disconnect the client if it's still
+// connected to them, even if it wants a clean session.
+func (this *Server) takeoverSession(cid string, clean bool) {
+	b := this.Cluster.takeover(cid)
+	if b == nil || clean {
+		return
+	}
+
+	// Whatever was left on this node, from the last time the client was here, is
+	// older than the session the client had on the other node.
+	this.dropSession(cid)
+
+	sess, err := this.sessMgr.New(cid)
+	if err != nil {
+		this.log.Errorf("server/takeoverSession: (%s) %v", cid, err)
+		return
+	}
+
+	if err := sess.UnmarshalBinary(b); err != nil {
+		this.log.Errorf("server/takeoverSession: (%s) Error decoding session: %v", cid, err)
+		this.sessMgr.Del(cid)
+		return
+	}
+
+	if err := this.sessMgr.Save(cid); err != nil {
+		this.log.Errorf("server/takeoverSession: (%s) Error saving session: %v", cid, err)
+	}
+}
+
+// handoverSession disconnects the client if it's connected, and returns its session,
+// if there's one, removing it from this server.
+func (this *Server) handoverSession(cid string) []byte {
+	for _, svc := range this.services() {
+		if svc.sess != nil && svc.sess.ID() == cid {
+			this.log.Infof("(%s) server/handoverSession: Client connected to another node, disconnecting.", svc.cid())
+			svc.stop()
+		}
+	}
+
+	sess, err := this.sessMgr.Get(cid)
+	if err != nil {
+		return nil
+	}
+
+	b, err := sess.MarshalBinary()
+	if err != nil {
+		this.log.Errorf("server/handoverSession: (%s) Error encoding session: %v", cid, err)
+		return nil
+	}
+
+	this.dropSession(cid)
+
+	return b
+}
+
+// dropSession removes the session of a client that's not connected, along with the
+// subscriptions of its offline queue.
+func (this *Server) dropSession(cid string) {
+	sess, err := this.sessMgr.Get(cid)
+	if err != nil {
+		return
+	}
+
+	if topics, _, err := sess.Topics(); err == nil && sess.Offline != nil {
+		for _, t := range topics {
+			this.topicsMgr.Unsubscribe([]byte(t), sess.Offline)
+		}
+	}
+
+	this.sessMgr.Del(cid)
+}
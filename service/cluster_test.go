@@ -0,0 +1,368 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/gob"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestStaticDiscovery(t *testing.T) {
+	addrs, err := NewStaticDiscovery("10.0.0.1:7946", "10.0.0.2:7946").Peers()
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1:7946", "10.0.0.2:7946"}, addrs)
+}
+
+func TestDNSDiscovery(t *testing.T) {
+	addrs, err := NewDNSDiscovery("localhost", 7946).Peers()
+	require.NoError(t, err)
+	require.Contains(t, addrs, "127.0.0.1:7946")
+}
+
+func TestClusterConfiguration(t *testing.T) {
+	require.Error(t, (&Cluster{Discovery: NewStaticDiscovery()}).checkConfiguration())
+	require.Error(t, (&Cluster{ListenAddr: ":7946"}).checkConfiguration())
+
+	c := &Cluster{ListenAddr: ":7946", Discovery: NewStaticDiscovery()}
+	require.NoError(t, c.checkConfiguration())
+	require.NotEqual(t, "", c.NodeId)
+	require.Equal(t, DefaultClusterRefreshInterval, c.RefreshInterval)
+	require.Equal(t, DefaultClusterTakeoverTimeout, c.TakeoverTimeout)
+}
+
+var clusterDiscovery = NewStaticDiscovery("127.0.0.1:7946", "127.0.0.1:7947")
+
+// startClusterNodes starts two servers, on ports 1883 and 1886, that are nodes of
+// the same cluster. The configure funcs, if any, are called with the index and the
+// Cluster of each node before it starts.
+func startClusterNodes(t *testing.T, configure ...func(i int, c *Cluster)) (*Server, *Server, func()) {
+	var (
+		svrs  []*Server
+		dones []chan error
+	)
+
+	for i, port := range []string{"1883", "1886"} {
+		c := &Cluster{
+			NodeId:          "node" + port,
+			ListenAddr:      []string{"127.0.0.1:7946", "127.0.0.1:7947"}[i],
+			Discovery:       clusterDiscovery,
+			RefreshInterval: time.Millisecond * 20,
+		}
+
+		for _, f := range configure {
+			f(i, c)
+		}
+
+		svr, done := startNamedServer(t, "cluster"+port, "tcp://127.0.0.1:"+port, &Server{
+			Cluster: c,
+		})
+
+		svrs = append(svrs, svr)
+		dones = append(dones, done)
+	}
+
+	return svrs[0], svrs[1], func() {
+		for i, svr := range svrs {
+			require.NoError(t, svr.Close())
+			require.NoError(t, <-dones[i])
+		}
+	}
+}
+
+// waitForRoute waits until the other nodes of the cluster have told it about a
+// subscription to topic.
+func waitForRoute(t *testing.T, c *Cluster, topic string) {
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	for i := 0; i < 200; i++ {
+		require.NoError(t, c.routes.Subscribers([]byte(topic), 0, &subs, &qoss))
+		if len(subs) > 0 {
+			return
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	t.Fatalf("No route for topic %q", topic)
+}
+
+// Messages published on one node reach the subscribers on the other, once, and so do
+// the retained messages.
+func TestClusterForward(t *testing.T) {
+	a, b, stop := startClusterNodes(t)
+	defer stop()
+
+	aconn := dialNamedServer(t, "127.0.0.1:1883", "a/#")
+	defer aconn.Close()
+
+	bconn := dialNamedServer(t, "127.0.0.1:1886", "b/#")
+	defer bconn.Close()
+
+	// Overlapping subscriptions still only get the message across once
+	bconn2 := dialNamedServer(t, "127.0.0.1:1886", "b/+")
+	defer bconn2.Close()
+
+	waitForRoute(t, a.Cluster, "b/x")
+	waitForRoute(t, b.Cluster, "a/x")
+
+	pub := newPublishMessage(1, 1)
+	pub.SetTopic([]byte("b/x"))
+	require.NoError(t, writeMessage(aconn, pub))
+	expectMessage(t, aconn, message.PUBACK)
+
+	expectPublish(t, bconn, "b/x", 1)
+	expectPublish(t, bconn2, "b/x", 1)
+	expectNoMessage(t, bconn)
+	expectNoMessage(t, bconn2)
+	expectNoMessage(t, aconn)
+
+	pub = newPublishMessage(2, 0)
+	pub.SetTopic([]byte("a/y"))
+	require.NoError(t, writeMessage(bconn, pub))
+
+	expectPublish(t, aconn, "a/y", 0)
+	expectNoMessage(t, aconn)
+
+	// Retained on one node, delivered by the other
+	pub = newPublishMessage(3, 1)
+	pub.SetTopic([]byte("r/1"))
+	pub.SetRetain(true)
+	require.NoError(t, writeMessage(aconn, pub))
+	expectMessage(t, aconn, message.PUBACK)
+
+	var msgs []*message.PublishMessage
+
+	for i := 0; i < 100 && len(msgs) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+		require.NoError(t, b.topicsMgr.Retained([]byte("r/1"), &msgs))
+	}
+
+	rconn := dialNamedServer(t, "127.0.0.1:1886", "r/#")
+	defer rconn.Close()
+
+	expectPublish(t, rconn, "r/1", 1)
+
+	// Subscriptions that are gone don't get messages across anymore
+	bconn.Close()
+	bconn2.Close()
+
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, a.Cluster.routes.Subscribers([]byte("b/x"), 0, &subs, &qoss))
+		if len(subs) == 0 {
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	require.Equal(t, 0, len(subs))
+}
+
+// dialClusterNode connects the client to a node, and returns whether the session was
+// present.
+func dialClusterNode(t *testing.T, addr string, msg *message.ConnectMessage) (net.Conn, bool) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	require.NoError(t, writeMessage(conn, msg))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+	connack, err := getConnackMessage(conn, 0)
+	require.NoError(t, err)
+	require.Equal(t, message.ConnectionAccepted, connack.ReturnCode())
+
+	return conn, connack.SessionPresent()
+}
+
+// A client with a persistent session that moves to another node takes its session
+// along, including the messages queued while it was away, and is disconnected from
+// the node it was on.
+func TestClusterTakeover(t *testing.T) {
+	a, b, stop := startClusterNodes(t)
+	defer stop()
+
+	// Make sure the nodes are connected both ways
+	pconn := dialNamedServer(t, "127.0.0.1:1883", "x")
+	defer pconn.Close()
+
+	sconn := dialNamedServer(t, "127.0.0.1:1886", "x")
+	defer sconn.Close()
+
+	waitForRoute(t, a.Cluster, "x")
+	waitForRoute(t, b.Cluster, "x")
+
+	for i := 0; i < 200 && (len(a.Cluster.allLinks()) == 0 || len(b.Cluster.allLinks()) == 0); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	cmsg := newPersistentConnectMessage()
+
+	conn, present := dialClusterNode(t, "127.0.0.1:1883", cmsg)
+	require.False(t, present)
+
+	require.NoError(t, writeMessage(conn, newSubscribeMessage(1)))
+	expectMessage(t, conn, message.SUBACK)
+
+	conn.Close()
+
+	// Queued on the first node while the client is away
+	for i := 0; i < 100 && len(a.services()) > 1; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	require.NoError(t, writeMessage(pconn, newPublishMessage(1, 1)))
+	expectMessage(t, pconn, message.PUBACK)
+
+	conn, present = dialClusterNode(t, "127.0.0.1:1886", cmsg)
+	require.True(t, present)
+
+	expectPublish(t, conn, "abc", 1)
+
+	_, err := a.sessMgr.Get(string(cmsg.ClientId()))
+	require.Error(t, err)
+
+	// Subscribed on the second node now
+	require.NoError(t, writeMessage(pconn, newPublishMessage(2, 1)))
+	expectMessage(t, pconn, message.PUBACK)
+
+	expectPublish(t, conn, "abc", 1)
+
+	// Connecting to the first node again disconnects it from the second
+	conn2, present := dialClusterNode(t, "127.0.0.1:1883", cmsg)
+	defer conn2.Close()
+	require.True(t, present)
+
+	expectClosed(t, conn)
+}
+
+// Nodes with the same secret connect, and whoever doesn't know it can't send any
+// frame.
+func TestClusterSecret(t *testing.T) {
+	a, b, stop := startClusterNodes(t, func(i int, c *Cluster) {
+		c.Secret = "verysecret"
+	})
+	defer stop()
+
+	conn := dialNamedServer(t, "127.0.0.1:1886", "x")
+	defer conn.Close()
+
+	waitForRoute(t, a.Cluster, "x")
+
+	// Hello, then straight to taking over the client's session
+	rogue, err := net.Dial("tcp", "127.0.0.1:7947")
+	require.NoError(t, err)
+	defer rogue.Close()
+
+	rogue.SetDeadline(time.Now().Add(time.Second))
+
+	enc, dec := gob.NewEncoder(rogue), gob.NewDecoder(rogue)
+
+	var f clusterFrame
+
+	require.NoError(t, enc.Encode(&clusterFrame{Kind: clusterHello, Node: "rogue", Nonce: []byte("0123456789abcdef")}))
+	require.NoError(t, dec.Decode(&f))
+	require.Equal(t, clusterHello, f.Kind)
+
+	require.NoError(t, enc.Encode(&clusterFrame{Kind: clusterTakeover, ClientId: b.services()[0].cid(), Seq: 1}))
+	require.Error(t, dec.Decode(&f), "Expecting the connection to be closed")
+
+	// The client is still connected
+	require.NoError(t, writeMessage(conn, message.NewPingreqMessage()))
+	expectMessage(t, conn, message.PINGRESP)
+}
+
+// A node with the wrong secret doesn't connect, so it doesn't get the other's
+// subscriptions.
+func TestClusterWrongSecret(t *testing.T) {
+	a, _, stop := startClusterNodes(t, func(i int, c *Cluster) {
+		c.Secret = []string{"verysecret", "notsosecret"}[i]
+	})
+	defer stop()
+
+	conn2 := dialNamedServer(t, "127.0.0.1:1886", "x")
+	defer conn2.Close()
+
+	time.Sleep(time.Millisecond * 200)
+
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	require.NoError(t, a.Cluster.routes.Subscribers([]byte("x"), 0, &subs, &qoss))
+	require.Equal(t, 0, len(subs))
+	require.Equal(t, 0, len(a.Cluster.allLinks()))
+}
+
+// The nodes connect over TLS, with the certificates from the same CA.
+func TestClusterTLS(t *testing.T) {
+	ca := newCertificate(t, "surgemq ca", nil)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	a, b, stop := startClusterNodes(t, func(i int, c *Cluster) {
+		c.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{newCertificate(t, c.NodeId, &ca)},
+			RootCAs:      pool,
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}
+	})
+	defer stop()
+
+	aconn := dialNamedServer(t, "127.0.0.1:1883", "a/#")
+	defer aconn.Close()
+
+	bconn := dialNamedServer(t, "127.0.0.1:1886", "b/#")
+	defer bconn.Close()
+
+	waitForRoute(t, a.Cluster, "b/x")
+	waitForRoute(t, b.Cluster, "a/x")
+
+	pub := newPublishMessage(1, 1)
+	pub.SetTopic([]byte("b/x"))
+	require.NoError(t, writeMessage(aconn, pub))
+	expectMessage(t, aconn, message.PUBACK)
+
+	expectPublish(t, bconn, "b/x", 1)
+
+	// Without a certificate there's no getting in
+	rogue, err := net.Dial("tcp", "127.0.0.1:7947")
+	require.NoError(t, err)
+	defer rogue.Close()
+
+	rogue.SetDeadline(time.Now().Add(time.Second))
+
+	require.NoError(t, gob.NewEncoder(rogue).Encode(&clusterFrame{Kind: clusterHello, Node: "rogue"}))
+
+	var f clusterFrame
+	require.Error(t, gob.NewDecoder(rogue).Decode(&f))
+}
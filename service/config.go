@@ -0,0 +1,406 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/surgemq/surgemq/auth"
+)
+
+// Config is the part of the configuration of a Server that can be kept in a file,
+// see LoadConfig, and changed while the server is running, see Server.Reload. The
+// fields are the Server and Listener fields of the same names, and the same
+// defaults apply to the ones left out.
+type Config struct {
+	// Listeners replace Server.Listeners. If there are none then the listeners are
+	// left as they are.
+	Listeners []ListenerConfig `json:"listeners,omitempty"`
+
+	MaxConnections      int `json:"max_connections,omitempty"`
+	MaxConnectionsPerIP int `json:"max_connections_per_ip,omitempty"`
+	MaxPublishRate      int `json:"max_publish_rate,omitempty"`
+	MaxPayloadSize      int `json:"max_payload_size,omitempty"`
+	MaxPacketSize       int `json:"max_packet_size,omitempty"`
+	MaxInflight         int `json:"max_inflight,omitempty"`
+	ReceiveMaximum      int `json:"receive_maximum,omitempty"`
+	OfflineQueueSize    int `json:"offline_queue_size,omitempty"`
+
+	// In seconds, same as the Server fields
+	KeepAlive      int `json:"keep_alive,omitempty"`
+	ConnectTimeout int `json:"connect_timeout,omitempty"`
+	AckTimeout     int `json:"ack_timeout,omitempty"`
+	TimeoutRetries int `json:"timeout_retries,omitempty"`
+	MaxKeepAlive   int `json:"max_keep_alive,omitempty"`
+	SessionExpiry  int `json:"session_expiry,omitempty"`
+
+	Authenticator string `json:"authenticator,omitempty"`
+	Authorizer    string `json:"authorizer,omitempty"`
+
+	// ACLFile is the access control list file to use as the authorizer, unless
+	// Authorizer is set. See auth.NewFileAuthorizer. It's read again every time the
+	// configuration is applied, so the server picks up the changes to it.
+	ACLFile string `json:"acl_file,omitempty"`
+}
+
+// ListenerConfig is the configuration of a Listener. See the Listener fields of the
+// same names.
+type ListenerConfig struct {
+	URI            string `json:"uri"`
+	CertFile       string `json:"cert_file,omitempty"`
+	KeyFile        string `json:"key_file,omitempty"`
+	Authenticator  string `json:"authenticator,omitempty"`
+	MaxConnections int    `json:"max_connections,omitempty"`
+	ProxyProtocol  bool   `json:"proxy_protocol,omitempty"`
+	ConnectTimeout int    `json:"connect_timeout,omitempty"`
+	AckTimeout     int    `json:"ack_timeout,omitempty"`
+	TimeoutRetries int    `json:"timeout_retries,omitempty"`
+	MaxKeepAlive   int    `json:"max_keep_alive,omitempty"`
+}
+
+// LoadConfig reads the configuration in the JSON file at path, e.g.,
+//
+//	{
+//		"listeners": [
+//			{"uri": "tcp://0.0.0.0:1883"},
+//			{"uri": "ssl://0.0.0.0:8883", "cert_file": "server.pem", "key_file": "server.key"}
+//		],
+//		"max_connections": 10000,
+//		"max_payload_size": 65536,
+//		"ack_timeout": 30,
+//		"acl_file": "surgemq.acl"
+//	}
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("server/LoadConfig: Error parsing %s: %v", path, err)
+	}
+
+	return c, nil
+}
+
+// Apply sets up svr, which must not have been started yet, with the configuration.
+// Serve() then starts the listeners. Use Server.Reload once it's running.
+func (this *Config) Apply(svr *Server) error {
+	if this.ACLFile != "" {
+		acl, err := auth.NewFileAuthorizer(this.ACLFile)
+		if err != nil {
+			return err
+		}
+
+		registerACL(this.ACLFile, acl)
+	}
+
+	this.apply(svr)
+
+	if len(this.Listeners) > 0 {
+		svr.Listeners = make([]*Listener, 0, len(this.Listeners))
+
+		for _, lc := range this.Listeners {
+			l := &Listener{}
+			lc.apply(l)
+
+			svr.Listeners = append(svr.Listeners, l)
+		}
+	}
+
+	return nil
+}
+
+// apply sets the fields of svr, other than the listeners.
+func (this *Config) apply(svr *Server) {
+	svr.MaxConnections = this.MaxConnections
+	svr.MaxConnectionsPerIP = this.MaxConnectionsPerIP
+	svr.MaxPublishRate = this.MaxPublishRate
+	svr.MaxPayloadSize = this.MaxPayloadSize
+	svr.MaxPacketSize = this.MaxPacketSize
+	svr.MaxInflight = this.MaxInflight
+	svr.ReceiveMaximum = this.ReceiveMaximum
+	svr.OfflineQueueSize = this.OfflineQueueSize
+	svr.KeepAlive = this.KeepAlive
+	svr.ConnectTimeout = this.ConnectTimeout
+	svr.AckTimeout = this.AckTimeout
+	svr.TimeoutRetries = this.TimeoutRetries
+	svr.MaxKeepAlive = this.MaxKeepAlive
+	svr.SessionExpiry = this.SessionExpiry
+	svr.Authenticator = this.Authenticator
+	svr.Authorizer = this.authorizer()
+}
+
+// authorizer returns the name of the authorizer, which is the one the ACL file is
+// registered as if Authorizer is not set.
+func (this *Config) authorizer() string {
+	if this.Authorizer == "" && this.ACLFile != "" {
+		return aclName(this.ACLFile)
+	}
+
+	return this.Authorizer
+}
+
+func (this ListenerConfig) apply(l *Listener) {
+	l.URI = this.URI
+	l.CertFile = this.CertFile
+	l.KeyFile = this.KeyFile
+	l.Authenticator = this.Authenticator
+	l.MaxConnections = this.MaxConnections
+	l.ProxyProtocol = this.ProxyProtocol
+	l.ConnectTimeout = this.ConnectTimeout
+	l.AckTimeout = this.AckTimeout
+	l.TimeoutRetries = this.TimeoutRetries
+	l.MaxKeepAlive = this.MaxKeepAlive
+}
+
+// aclName is the name the ACL file at path is registered as.
+func aclName(path string) string {
+	return "acl:" + path
+}
+
+// registerACL registers the ACL read from the file at path, in place of the one read
+// from it before, if any.
+func registerACL(path string, acl auth.Authorizer) {
+	auth.UnregisterAuthorizer(aclName(path))
+	auth.RegisterAuthorizer(aclName(path), acl)
+}
+
+// reloading is a listener that Reload() is about to keep or start.
+type reloading struct {
+	c ListenerConfig
+
+	// The listener that's running, or the new one
+	l *Listener
+
+	// The network listener opened for a new listener, nil for one that's running
+	ln net.Listener
+
+	// For a listener that's running, the certificate loaded again from CertFile and
+	// KeyFile, if they're set, and the authentication manager for Authenticator
+	cert    *tls.Certificate
+	authMgr *auth.Manager
+}
+
+// Reload applies the configuration to the server while it's running, without
+// dropping any of the clients connected. In particular,
+//
+//   - Listeners not in the configuration are closed, and new ones are started. The
+//     ones that are running are kept, with their certificates loaded again, so the
+//     certificate files can be replaced by renewed ones. Changing whether a running
+//     listener uses TLS, or the PROXY protocol, takes a restart.
+//
+//   - The ACL file is read again, and the authorizer changes right away for all the
+//     clients. The authenticators only check the clients connecting from then on.
+//
+//   - The limits and timeouts apply to the clients connecting from then on. The ones
+//     connected already keep the ones they got when they connected, except for
+//     MaxConnections and MaxConnectionsPerIP, which count them all.
+//
+// If any part of the configuration can't be applied then none of it is, and the
+// error is returned. Only the listeners in Server.Listeners, i.e., the ones started
+// by Serve() or a previous Reload(), are managed by Reload().
+func (this *Server) Reload(c *Config) error {
+	if err := this.checkConfiguration(); err != nil {
+		return err
+	}
+
+	this.rmu.Lock()
+	defer this.rmu.Unlock()
+
+	// Everything that can fail is done first, so nothing changes if it does
+	var acl auth.Authorizer
+
+	if c.ACLFile != "" {
+		a, err := auth.NewFileAuthorizer(c.ACLFile)
+		if err != nil {
+			return err
+		}
+
+		acl = a
+	}
+
+	authenticator := c.Authenticator
+	if authenticator == "" {
+		authenticator = DefaultAuthenticator
+	}
+
+	if _, err := auth.NewManager(authenticator); err != nil {
+		return err
+	}
+
+	authorizer := c.authorizer()
+	if authorizer == "" {
+		authorizer = DefaultAuthorizer
+	}
+
+	if acl == nil || authorizer != aclName(c.ACLFile) {
+		if _, err := auth.NewAuthorizerManager(authorizer); err != nil {
+			return err
+		}
+	}
+
+	rs, removed, err := this.reloadListeners(c)
+	if err != nil {
+		return err
+	}
+
+	// Then it's all applied at once
+	if acl != nil {
+		registerACL(c.ACLFile, acl)
+	}
+
+	this.cmu.Lock()
+	this.mu.Lock()
+
+	c.apply(this)
+	this.setDefaults()
+
+	this.authMgr.SetProvider(this.Authenticator)
+	this.authzMgr.SetProvider(this.Authorizer)
+
+	var closing []net.Listener
+
+	if len(c.Listeners) > 0 {
+		this.Listeners = make([]*Listener, 0, len(rs))
+
+		for _, r := range rs {
+			if r.ln == nil {
+				r.c.apply(r.l)
+				r.l.authMgr = r.authMgr
+
+				if r.cert != nil {
+					r.l.setCertificate(r.cert)
+				}
+			}
+
+			this.Listeners = append(this.Listeners, r.l)
+		}
+
+		for ln, l := range this.listeners {
+			if removed[l] {
+				delete(this.listeners, ln)
+				closing = append(closing, ln)
+			}
+		}
+	}
+
+	this.mu.Unlock()
+	this.cmu.Unlock()
+
+	// The clients connected on the listeners closed stay connected
+	for _, ln := range closing {
+		ln.Close()
+	}
+
+	for _, r := range rs {
+		if r.ln == nil {
+			continue
+		}
+
+		go func(l *Listener, ln net.Listener) {
+			if err := this.serve(l, ln); err != nil {
+				this.log.Errorf("server/Reload: Listener %s stopped: %v", l.URI, err)
+			}
+		}(r.l, r.ln)
+	}
+
+	this.log.Infof("server/Reload: Configuration reloaded")
+
+	return nil
+}
+
+// reloadListeners prepares the listeners in the configuration, opening the new ones
+// and loading the certificates of the ones that are running, and returns them along
+// with the running listeners that are not in the configuration.
+func (this *Server) reloadListeners(c *Config) (rs []reloading, removed map[*Listener]bool, err error) {
+	if len(c.Listeners) == 0 {
+		return nil, nil, nil
+	}
+
+	defer func() {
+		if err != nil {
+			for _, r := range rs {
+				if r.ln != nil {
+					r.ln.Close()
+				}
+			}
+		}
+	}()
+
+	this.cmu.RLock()
+	running := make(map[string]*Listener, len(this.Listeners))
+	for _, l := range this.Listeners {
+		running[l.URI] = l
+	}
+	this.cmu.RUnlock()
+
+	removed = make(map[*Listener]bool, len(running))
+	for _, l := range running {
+		removed[l] = true
+	}
+
+	for _, lc := range c.Listeners {
+		l, ok := running[lc.URI]
+		if !ok {
+			l = &Listener{}
+			lc.apply(l)
+
+			ln, err := this.listen(l)
+			if err != nil {
+				return rs, nil, err
+			}
+
+			rs = append(rs, reloading{c: lc, l: l, ln: ln})
+			continue
+		}
+
+		delete(removed, l)
+
+		tlsBefore := l.CertFile != "" || l.KeyFile != ""
+		tlsAfter := lc.CertFile != "" || lc.KeyFile != ""
+
+		if l.ProxyProtocol != lc.ProxyProtocol || tlsBefore != tlsAfter {
+			return rs, nil, fmt.Errorf("server/Reload: Changing TLS or the PROXY protocol for %s takes a restart", lc.URI)
+		}
+
+		r := reloading{c: lc, l: l}
+
+		if tlsAfter {
+			cert, err := tls.LoadX509KeyPair(lc.CertFile, lc.KeyFile)
+			if err != nil {
+				return rs, nil, err
+			}
+
+			r.cert = &cert
+		}
+
+		if lc.Authenticator != "" {
+			if r.authMgr, err = auth.NewManager(lc.Authenticator); err != nil {
+				return rs, nil, err
+			}
+		}
+
+		rs = append(rs, r)
+	}
+
+	return rs, removed, nil
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/topics"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "surgemq.json")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{
+		"listeners": [
+			{"uri": "tcp://127.0.0.1:1883", "max_connections": 10},
+			{"uri": "ssl://127.0.0.1:8883", "cert_file": "server.pem", "key_file": "server.key"}
+		],
+		"max_payload_size": 1024,
+		"ack_timeout": 30,
+		"acl_file": "surgemq.acl"
+	}`), 0600))
+
+	c, err := LoadConfig(path)
+	require.NoError(t, err)
+
+	require.Equal(t, &Config{
+		Listeners: []ListenerConfig{
+			{URI: "tcp://127.0.0.1:1883", MaxConnections: 10},
+			{URI: "ssl://127.0.0.1:8883", CertFile: "server.pem", KeyFile: "server.key"},
+		},
+		MaxPayloadSize: 1024,
+		AckTimeout:     30,
+		ACLFile:        "surgemq.acl",
+	}, c)
+
+	svr := &Server{}
+	c.ACLFile = ""
+	require.NoError(t, c.Apply(svr))
+	require.Equal(t, 1024, svr.MaxPayloadSize)
+	require.Equal(t, 2, len(svr.Listeners))
+	require.Equal(t, 10, svr.Listeners[0].MaxConnections)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"listeners": {}}`), 0600))
+
+	_, err = LoadConfig(path)
+	require.Error(t, err)
+}
+
+func TestServerReload(t *testing.T) {
+	topics.Unregister("reload")
+	topics.Register("reload", topics.NewMemProvider())
+
+	sessions.Unregister("reload")
+	sessions.Register("reload", sessions.NewMemProvider())
+
+	dir := t.TempDir()
+	acl := filepath.Join(dir, "surgemq.acl")
+	require.NoError(t, ioutil.WriteFile(acl, []byte("topic readwrite abc\n"), 0600))
+
+	c := &Config{
+		Listeners:     []ListenerConfig{{URI: "tcp://127.0.0.1:1883"}},
+		Authenticator: authenticator,
+		ACLFile:       acl,
+	}
+
+	svr := &Server{
+		SessionsProvider: "reload",
+		TopicsProvider:   "reload",
+	}
+	require.NoError(t, c.Apply(svr))
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- svr.Serve()
+	}()
+
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	conn, code := dialListener(t, "tcp", "127.0.0.1:1883")
+	defer conn.Close()
+	require.Equal(t, message.ConnectionAccepted, code)
+
+	require.NoError(t, writeMessage(conn, newSubscribeMessage(1)))
+	suback := expectMessage(t, conn, message.SUBACK).(*message.SubackMessage)
+	require.Equal(t, []byte{1}, suback.ReturnCodes())
+
+	// A bad configuration changes nothing
+	require.Error(t, svr.Reload(&Config{Authenticator: "nothere"}))
+	require.Error(t, svr.Reload(&Config{ACLFile: filepath.Join(dir, "nothere.acl")}))
+
+	// Move the listener, lower the limits and take the client's access away
+	require.NoError(t, ioutil.WriteFile(acl, []byte("topic readwrite def\n"), 0600))
+
+	c.Listeners = []ListenerConfig{{URI: "tcp://127.0.0.1:1884"}}
+	c.MaxPayloadSize = 8
+	require.NoError(t, svr.Reload(c))
+
+	// The client is still connected, with the new ACL
+	require.NoError(t, writeMessage(conn, newSubscribeMessage(1)))
+	suback = expectMessage(t, conn, message.SUBACK).(*message.SubackMessage)
+	require.Equal(t, []byte{message.QosFailure}, suback.ReturnCodes())
+
+	// New clients connect on the new listener only, and get the new limits
+	_, err := net.Dial("tcp", "127.0.0.1:1883")
+	require.Error(t, err)
+
+	conn2, code := dialListener(t, "tcp", "127.0.0.1:1884")
+	defer conn2.Close()
+	require.Equal(t, message.ConnectionAccepted, code)
+
+	require.NoError(t, writeMessage(conn2, newPayloadMessage(1, 1, strings.Repeat("x", 9))))
+	expectClosed(t, conn2)
+
+	require.NoError(t, writeMessage(conn, newPayloadMessage(2, 1, strings.Repeat("x", 9))))
+	expectMessage(t, conn, message.PUBACK)
+
+	require.Equal(t, 8, svr.MaxPayloadSize)
+	require.Equal(t, DefaultAckTimeout, svr.AckTimeout)
+	require.Equal(t, 1, len(svr.Listeners))
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync"
+
+	"github.com/surgemq/message"
+)
+
+// Connector forwards the messages published on the server to another system. It gets
+// the messages by subscribing to the topics it forwards with Server.Subscribe, so it
+// sees the messages from the clients, Publish(), the bridges and the other nodes of
+// the cluster alike. See KafkaConnector.
+type Connector interface {
+	// Start checks the configuration, fills in the defaults, subscribes to the topics
+	// of the connector and starts forwarding. It's called as the server starts.
+	Start(svr *Server) error
+
+	// Stop unsubscribes from the topics, and returns once the messages waiting to be
+	// forwarded have been sent, or given up on. It's called once all the clients are
+	// gone.
+	Stop()
+}
+
+// ForwardFunc is what a Connector subscribes to its topics with. It's called with
+// each message published to them, and calls done once the message is safely with
+// the other system, or with an error if it never will be, e.g., because the connector
+// is stopping. done must be called once, and can be called from any goroutine. The
+// message is only valid until ForwardFunc returns, so what's kept must be copied.
+//
+// The QoS 1 and 2 messages from the clients are only acked, with the PUBACK or
+// PUBCOMP, once all the connectors they are forwarded to are done with them, so the
+// clients send them again if they are not. All the other messages, i.e., QoS 0
+// messages, and the ones from Publish(), the bridges and the cluster, are forwarded
+// on a best effort basis.
+type ForwardFunc func(msg *message.PublishMessage, done func(error))
+
+// Subscribe subscribes fn to the messages published to the topic filter, whatever
+// their QoS. It's meant for the connectors to call from Start.
+func (this *Server) Subscribe(filter []byte, fn *ForwardFunc) error {
+	_, err := this.topicsMgr.Subscribe(filter, message.QosExactlyOnce, fn)
+	return err
+}
+
+// Unsubscribe unsubscribes fn from the topic filter.
+func (this *Server) Unsubscribe(filter []byte, fn *ForwardFunc) error {
+	return this.topicsMgr.Unsubscribe(filter, fn)
+}
+
+// heldAck is the ack of an incoming QoS 1 or 2 message, held back until the connectors
+// the message is forwarded to are done with it. pending is the number of them still
+// forwarding it, plus one until the message has been published, and failed is set if
+// any of them gave up. Both are protected by the service's amu.
+type heldAck struct {
+	svc   *service
+	mtype message.MessageType
+	pktid uint16
+	topic []byte
+
+	pending int
+	failed  bool
+}
+
+// holdAck queues the ack of an incoming message, which is only sent once release()
+// has been called, and the connectors are done with the message. The acks are sent
+// in the order they are queued, as the client expects.
+func (this *service) holdAck(mtype message.MessageType, pktid uint16, topic []byte) *heldAck {
+	a := &heldAck{
+		svc:     this,
+		mtype:   mtype,
+		pktid:   pktid,
+		topic:   append([]byte(nil), topic...),
+		pending: 1,
+	}
+
+	this.amu.Lock()
+	this.acks = append(this.acks, a)
+	this.amu.Unlock()
+
+	return a
+}
+
+// forward returns the done function for a connector forwarding the message.
+func (this *heldAck) forward() func(error) {
+	this.svc.amu.Lock()
+	this.pending++
+	this.svc.amu.Unlock()
+
+	var once sync.Once
+
+	return func(err error) {
+		once.Do(func() { this.done(err) })
+	}
+}
+
+// release is called once the message has been published to all its subscribers.
+func (this *heldAck) release() {
+	this.done(nil)
+}
+
+func (this *heldAck) done(err error) {
+	svc := this.svc
+
+	svc.amu.Lock()
+
+	if err != nil {
+		this.failed = true
+	}
+
+	this.pending--
+
+	flush := !svc.flushing && svc.acks[0].pending == 0
+	if flush {
+		svc.flushing = true
+	}
+
+	svc.amu.Unlock()
+
+	if flush {
+		go svc.flushAcks()
+	}
+}
+
+// flushAcks sends the held acks that are ready, in order, until it gets to one that's
+// still waiting for the connectors. If a message couldn't be forwarded, the client is
+// disconnected instead, so it sends the message again once it reconnects.
+func (this *service) flushAcks() {
+	for {
+		this.amu.Lock()
+
+		if len(this.acks) == 0 || this.acks[0].pending > 0 {
+			this.flushing = false
+			this.amu.Unlock()
+			return
+		}
+
+		a := this.acks[0]
+		this.acks[0] = nil
+		this.acks = this.acks[1:]
+
+		this.amu.Unlock()
+
+		if a.failed {
+			this.log.Errorf("(%s) Message to topic %q was not forwarded, disconnecting.", this.cid(), string(a.topic))
+			this.stop()
+			return
+		}
+
+		if err := this.writeAck(a.mtype, a.pktid, a.topic); err != nil {
+			this.log.Debugf("(%s) Error sending %s: %v", this.cid(), a.mtype, err)
+		}
+	}
+}
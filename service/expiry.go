@@ -0,0 +1,218 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/topics"
+)
+
+// TopicTTL sets how long messages published to the topics matching Filter live.
+// Retained messages are removed once they expire, and queued messages for offline
+// clients are dropped. If TTL is 0 then the messages never expire.
+type TopicTTL struct {
+	Filter string
+	TTL    time.Duration
+}
+
+// checkExpiry sets up the matching of topics to Server.TopicTTLs.
+func (this *Server) checkExpiry() error {
+	if len(this.TopicTTLs) == 0 {
+		return nil
+	}
+
+	this.ttls = topics.NewMemProvider()
+
+	for i := range this.TopicTTLs {
+		t := &this.TopicTTLs[i]
+
+		if _, err := this.ttls.Subscribe([]byte(t.Filter), message.QosExactlyOnce, t); err != nil {
+			return fmt.Errorf("server/checkExpiry: Invalid topic filter %q: %v", t.Filter, err)
+		}
+	}
+
+	return nil
+}
+
+// expiring returns whether any messages expire at all.
+func (this *Server) expiring() bool {
+	return this.MessageTTL > 0 || len(this.TopicTTLs) > 0
+}
+
+// messageTTL returns how long the message lives. The first of TopicTTLs matching
+// the topic wins, otherwise it's MessageTTL.
+func (this *Server) messageTTL(msg *message.PublishMessage) time.Duration {
+	if this.ttls == nil {
+		return this.MessageTTL
+	}
+
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	if err := this.ttls.Subscribers(msg.Topic(), message.QosAtMostOnce, &subs, &qoss); err != nil || len(subs) == 0 {
+		return this.MessageTTL
+	}
+
+	for i := range this.TopicTTLs {
+		for _, s := range subs {
+			if s == &this.TopicTTLs[i] {
+				return this.TopicTTLs[i].TTL
+			}
+		}
+	}
+
+	return this.MessageTTL
+}
+
+// retainMessage retains the message, which expires after ttl returns, if it's set.
+func retainMessage(mgr *topics.Manager, msg *message.PublishMessage, ttl func(*message.PublishMessage) time.Duration) error {
+	if ttl != nil {
+		if d := ttl(msg); d > 0 {
+			return mgr.RetainUntil(msg, time.Now().Add(d))
+		}
+	}
+
+	return mgr.Retain(msg)
+}
+
+// retainTTL returns the function for retainMessage(), which is nil if nothing expires.
+func (this *Server) retainTTL() func(*message.PublishMessage) time.Duration {
+	if !this.expiring() {
+		return nil
+	}
+
+	return this.messageTTL
+}
+
+// startExpiry starts looking for expired messages and sessions. Sessions can be given
+// an expiry by the hooks, so it's started even if nothing else expires.
+func (this *Server) startExpiry() {
+	this.expiryOnce.Do(func() {
+		go this.expiryLoop()
+	})
+}
+
+// expiryLoop removes the expired retained messages, the expired messages in the
+// offline queues, and the expired sessions, every ExpiryInterval seconds until the
+// server quits.
+func (this *Server) expiryLoop() {
+	tick := time.NewTicker(time.Second * time.Duration(this.ExpiryInterval))
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-this.quit:
+			return
+
+		case now := <-tick.C:
+			this.expire(now)
+		}
+	}
+}
+
+func (this *Server) expire(now time.Time) {
+	this.reapSessions(now)
+
+	if !this.expiring() {
+		return
+	}
+
+	n, err := this.topicsMgr.Expire(now)
+	if err != nil && err != topics.ErrExpiryNotSupported {
+		this.log.Errorf("server/expire: Error expiring retained messages: %v", err)
+	}
+
+	var m int
+
+	err = this.sessMgr.Range(func(sess *sessions.Session) bool {
+		m += sess.ExpireOffline(now)
+		return true
+	})
+
+	if err != nil && err != sessions.ErrRangeNotSupported {
+		this.log.Errorf("server/expire: Error expiring offline messages: %v", err)
+	}
+
+	if n > 0 || m > 0 {
+		this.log.Debugf("server/expire: Expired %d retained and %d offline messages", n, m)
+	}
+}
+
+// reapSessions removes the persistent sessions that have expired by now, along with
+// their offline queues.
+func (this *Server) reapSessions(now time.Time) {
+	var expired []*sessions.Session
+
+	err := this.sessMgr.Range(func(sess *sessions.Session) bool {
+		if e := sess.Expiry(); !e.IsZero() && !now.Before(e) {
+			expired = append(expired, sess)
+		}
+
+		return true
+	})
+
+	if err != nil {
+		if err != sessions.ErrRangeNotSupported {
+			this.log.Errorf("server/reapSessions: Error expiring sessions: %v", err)
+		}
+
+		return
+	}
+
+	var n int
+
+	for _, sess := range expired {
+		if this.reapSession(sess, now) {
+			n++
+		}
+	}
+
+	if n > 0 {
+		this.log.Debugf("server/reapSessions: Expired %d sessions", n)
+	}
+}
+
+// reapSession removes the session, and unsubscribes its offline queue, unless its
+// client has come back since it was found to have expired.
+func (this *Server) reapSession(sess *sessions.Session, now time.Time) bool {
+	this.sessMu.Lock()
+	defer this.sessMu.Unlock()
+
+	// The provider may have moved on to another session for the client, e.g., one
+	// saved by another server sharing the store.
+	if cur, err := this.sessMgr.Get(sess.ID()); err != nil || cur != sess {
+		return false
+	}
+
+	if !sess.Expire(now) {
+		return false
+	}
+
+	if topics, _, err := sess.Topics(); err == nil {
+		for _, t := range topics {
+			this.topicsMgr.Unsubscribe([]byte(t), sess.Offline)
+		}
+	}
+
+	this.sessMgr.Del(sess.ID())
+
+	return true
+}
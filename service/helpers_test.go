@@ -17,16 +17,30 @@ package service
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"math/big"
 	"net"
 	"net/url"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/surge/glog"
 	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logger"
 	"github.com/surgemq/surgemq/sessions"
 	"github.com/surgemq/surgemq/topics"
 )
@@ -70,6 +84,14 @@ func runClientServerTests(t testing.TB, f func(*Client)) {
 }
 
 func startServiceN(t testing.TB, u *url.URL, wg *sync.WaitGroup, ready1, ready2 chan struct{}, cnt int) {
+	svr := &Server{
+		Authenticator: authenticator,
+	}
+
+	startServer(t, svr, u, wg, ready1, ready2, cnt)
+}
+
+func startServer(t testing.TB, svr *Server, u *url.URL, wg *sync.WaitGroup, ready1, ready2 chan struct{}, cnt int) {
 	defer wg.Done()
 
 	topics.Unregister("mem")
@@ -86,16 +108,12 @@ func startServiceN(t testing.TB, u *url.URL, wg *sync.WaitGroup, ready1, ready2
 
 	close(ready1)
 
-	svr := &Server{
-		Authenticator: authenticator,
-	}
-
 	for i := 0; i < cnt; i++ {
 		conn, err := ln.Accept()
 		require.NoError(t, err)
 
-		_, err = svr.handleConnection(conn)
-		if authenticator == "mockFailure" {
+		_, err = svr.handleConnection(conn, nil)
+		if svr.Authenticator == "mockFailure" {
 			require.Error(t, err)
 			return
 		} else {
@@ -132,6 +150,75 @@ func connectToServer(t testing.TB, uri string) *Client {
 	return c
 }
 
+// expectMessage reads the next message from the connection and checks its type.
+func expectMessage(t testing.TB, conn net.Conn, mtype message.MessageType) message.Message {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	buf, err := getMessageBuffer(conn)
+	require.NoError(t, err)
+
+	msg, err := message.MessageType(buf[0] >> 4).New()
+	require.NoError(t, err)
+
+	_, err = msg.Decode(buf)
+	require.NoError(t, err)
+	require.Equal(t, mtype, msg.Type(), "Unexpected %s message", msg.Name())
+
+	return msg
+}
+
+// expectNoMessage checks that nothing more comes in on the connection for a bit.
+func expectNoMessage(t testing.TB, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+
+	_, err := getMessageBuffer(conn)
+	require.True(t, isTimeout(err), "Expecting timeout, got %v", err)
+}
+
+// expectClosed reads from the connection until the server closes it.
+func expectClosed(t testing.TB, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	for {
+		_, err := getMessageBuffer(conn)
+		if err != nil {
+			require.False(t, isTimeout(err), "Expecting the connection to be closed")
+			return
+		}
+	}
+}
+
+// connectRaw opens a plain connection to the server and completes the CONNECT
+// handshake, without starting any of the service goroutines. This lets the tests
+// drive the wire protocol directly.
+func connectRaw(t testing.TB, uri string) net.Conn {
+	conn, _ := connectRawMessage(t, uri, newConnectMessage())
+	return conn
+}
+
+// connectRawMessage is like connectRaw, except it sends the CONNECT message given
+// and also returns the CONNACK.
+func connectRawMessage(t testing.TB, uri string, msg *message.ConnectMessage) (net.Conn, *message.ConnackMessage) {
+	u, err := url.Parse(uri)
+	require.NoError(t, err)
+
+	network, addr := dialAddr(u)
+
+	conn, err := net.Dial(network, addr)
+	require.NoError(t, err)
+
+	err = writeMessage(conn, msg)
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	resp, err := getConnackMessage(conn, 0)
+	require.NoError(t, err)
+	require.Equal(t, message.ConnectionAccepted, resp.ReturnCode())
+
+	return conn, resp
+}
+
 func newPubrelMessage(pktid uint16) *message.PubrelMessage {
 	msg := message.NewPubrelMessage()
 	msg.SetPacketId(pktid)
@@ -149,6 +236,13 @@ func newPublishMessage(pktid uint16, qos byte) *message.PublishMessage {
 	return msg
 }
 
+func newPayloadMessage(pktid uint16, qos byte, payload string) *message.PublishMessage {
+	msg := newPublishMessage(pktid, qos)
+	msg.SetPayload([]byte(payload))
+
+	return msg
+}
+
 func newPublishMessageLarge(pktid uint16, qos byte) *message.PublishMessage {
 	msg := message.NewPublishMessage()
 	msg.SetPacketId(pktid)
@@ -188,6 +282,17 @@ func newConnectMessage() *message.ConnectMessage {
 	return msg
 }
 
+// newPersistentConnectMessage returns a CONNECT message for a session that's kept
+// after the client disconnects, and without a will.
+func newPersistentConnectMessage() *message.ConnectMessage {
+	msg := newConnectMessage()
+	msg.SetCleanSession(false)
+	msg.SetWillFlag(false)
+	msg.SetWillQos(0)
+
+	return msg
+}
+
 func newConnectMessageBuffer() *bufio.Reader {
 	msgBytes := []byte{
 		byte(message.CONNECT << 4),
@@ -218,3 +323,238 @@ func newConnectMessageBuffer() *bufio.Reader {
 
 	return bufio.NewReader(bytes.NewBuffer(msgBytes))
 }
+
+// newCertificate creates a key pair and a certificate for it, signed by parent. If
+// parent is nil then the certificate is a self-signed CA.
+func newCertificate(t testing.TB, cn string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := tmpl, interface{}(key)
+
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeCertificate writes the certificate and private key to PEM files in dir.
+func writeCertificate(t testing.TB, dir, name string, cert tls.Certificate) (string, string) {
+	kb, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	require.NoError(t, err)
+
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600)
+	require.NoError(t, err)
+
+	return certFile, keyFile
+}
+
+// startNamedServer starts svr on uri with its own sessions and topics, registered as
+// name, so it doesn't share them with the other servers in the same test.
+func startNamedServer(t testing.TB, name, uri string, svr *Server) (*Server, chan error) {
+	topics.Unregister(name)
+	topics.Register(name, topics.NewMemProvider())
+
+	sessions.Unregister(name)
+	sessions.Register(name, sessions.NewMemProvider())
+
+	svr.Authenticator = authenticator
+	svr.SessionsProvider = name
+	svr.TopicsProvider = name
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- svr.ListenAndServe(uri)
+	}()
+
+	return svr, done
+}
+
+// dialNamedServer connects to the server started by startNamedServer(), giving it a
+// chance to start listening first, and subscribes to filter.
+func dialNamedServer(t testing.TB, addr, filter string) net.Conn {
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	require.NoError(t, err)
+	require.NoError(t, writeMessage(conn, newConnectMessage()))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	connack, err := getConnackMessage(conn, 0)
+	require.NoError(t, err)
+	require.Equal(t, message.ConnectionAccepted, connack.ReturnCode())
+
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketId(1)
+	sub.AddTopic([]byte(filter), 1)
+
+	require.NoError(t, writeMessage(conn, sub))
+	expectMessage(t, conn, message.SUBACK)
+
+	return conn
+}
+
+// waitForSubscriber waits until someone has subscribed to topic on the server.
+func waitForSubscriber(t testing.TB, svr *Server, topic string) {
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	for i := 0; i < 200; i++ {
+		if svr.topicsMgr != nil {
+			require.NoError(t, svr.topicsMgr.Subscribers([]byte(topic), 0, &subs, &qoss))
+			if len(subs) > 0 {
+				return
+			}
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	t.Fatalf("No subscriber for topic %q", topic)
+}
+
+// recordLogger is a logger.Logger that keeps the Info messages containing match,
+// and sends everything to glog as usual.
+type recordLogger struct {
+	logger.Logger
+
+	match string
+	mu    *sync.Mutex
+	lines *[]string
+}
+
+func newRecordLogger(match string) recordLogger {
+	return recordLogger{
+		Logger: logger.NewGlogLogger(),
+		match:  match,
+		mu:     &sync.Mutex{},
+		lines:  &[]string{},
+	}
+}
+
+func (this recordLogger) Infof(format string, args ...interface{}) {
+	this.Logger.Infof(format, args...)
+
+	line := fmt.Sprintf(format, args...)
+	if !strings.Contains(line, this.match) {
+		return
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	*this.lines = append(*this.lines, line)
+}
+
+func (this recordLogger) With(keyvals ...interface{}) logger.Logger {
+	return recordLogger{
+		Logger: this.Logger.With(keyvals...),
+		match:  this.match,
+		mu:     this.mu,
+		lines:  this.lines,
+	}
+}
+
+// Lines returns the messages kept so far.
+func (this recordLogger) Lines() []string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return append([]string(nil), *this.lines...)
+}
+
+// recordTracer is a Tracer that keeps the spans it starts, in the order they were
+// started. The name of the parent of each span is taken from the context.
+type recordTracer struct {
+	mu    sync.Mutex
+	spans []*recordSpan
+	ended chan *recordSpan
+}
+
+type recordSpan struct {
+	name   string
+	parent string
+	attrs  map[string]interface{}
+	err    error
+
+	ended chan *recordSpan
+}
+
+type spanKey struct{}
+
+func newRecordTracer() *recordTracer {
+	return &recordTracer{ended: make(chan *recordSpan, 100)}
+}
+
+func (this *recordTracer) Start(ctx context.Context, name string, attrs map[string]interface{}) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(string)
+
+	span := &recordSpan{name: name, parent: parent, attrs: attrs, ended: this.ended}
+
+	this.mu.Lock()
+	this.spans = append(this.spans, span)
+	this.mu.Unlock()
+
+	return context.WithValue(ctx, spanKey{}, name), span
+}
+
+func (this *recordSpan) End(err error) {
+	this.err = err
+	this.ended <- this
+}
+
+// waitEnded waits for n spans to end, and returns them in the order they ended.
+func (this *recordTracer) waitEnded(t testing.TB, n int) []*recordSpan {
+	var spans []*recordSpan
+
+	for i := 0; i < n; i++ {
+		select {
+		case s := <-this.ended:
+			spans = append(spans, s)
+		case <-time.After(time.Second):
+			require.FailNow(t, "Timed out waiting for spans to end")
+		}
+	}
+
+	return spans
+}
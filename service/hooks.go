@@ -0,0 +1,247 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/surgemq/message"
+)
+
+// ClientInfo describes the client a hook is called for. The same ClientInfo is passed
+// to all the hooks called for a connection, from OnConnect to OnDisconnect, so hooks
+// can tell the connections of a client apart. It must not be modified.
+type ClientInfo struct {
+	// The client ID, as assigned by the server if the client didn't send one
+	ClientId string
+
+	// The username the client was authenticated as, and the claims the authenticator
+	// found, if any
+	Username string
+	Claims   map[string]interface{}
+
+	// The address the client connected from, and when
+	RemoteAddr  net.Addr
+	ConnectedAt time.Time
+}
+
+// ClientTimeouts are the timeouts used for a client connection, in seconds, and its
+// limits. See the Server fields of the same names.
+type ClientTimeouts struct {
+	// The keep alive the client asked for in CONNECT, up to MaxKeepAlive. The client
+	// is disconnected once it's been silent for one and a half times as long.
+	KeepAlive int
+
+	AckTimeout     int
+	TimeoutRetries int
+
+	// How long the client's session is kept once it has gone away, if it's a
+	// persistent session. MQTT 3.1.1 has no way for the client to ask for it, so a
+	// hook can set it, e.g., from a claim. For MQTT 5.0 clients it's already the
+	// session expiry interval they asked for, if shorter than the server's. If 0
+	// then the session is kept until the client comes back.
+	SessionExpiry int
+
+	// The maximum number of QoS 1 and 2 messages sent to the client that it hasn't
+	// acked yet. If 0 then there's no limit.
+	MaxInflight int
+}
+
+// Hooks are the functions called by the server at different points in the life of
+// a client connection and of the messages it sends and receives. They are called
+// from the goroutine processing the client's messages, so they should not block for
+// long. Any of them can be left nil.
+type Hooks struct {
+	// OnConnect is called once the client is authenticated, before its session is set
+	// up. If it returns an error then the client is sent a CONNACK with the not
+	// authorized return code and disconnected.
+	OnConnect func(c *ClientInfo, msg *message.ConnectMessage) error
+
+	// OnTimeouts is called once all the OnConnect hooks have let the client in, with
+	// the timeouts from the server or listener settings. It can change them for the
+	// client, e.g., based on its username or claims.
+	OnTimeouts func(c *ClientInfo, t *ClientTimeouts)
+
+	// OnDisconnect is called once the connection of a client that OnConnect let in is
+	// closed, whatever the reason.
+	OnDisconnect func(c *ClientInfo)
+
+	// OnSubscribe is called for each topic filter in a SUBSCRIBE from the client that
+	// the authorizer allows. It returns the QoS to subscribe at, which can't be higher
+	// than the QoS asked for. If it returns an error then the filter is not subscribed
+	// and gets a failure return code in the SUBACK.
+	OnSubscribe func(c *ClientInfo, topic []byte, qos byte) (byte, error)
+
+	// OnPublish is called for each PUBLISH from the client, including its will, once
+	// the ack cycle is over and the authorizer has allowed it, before it's retained
+	// and delivered to the subscribers. It returns the message to publish, which can
+	// be msg itself, modified, or another message. If it returns an error then the
+	// message is dropped. It has been acked already, since there's no way to NAK a
+	// PUBLISH in MQTT 3.1.1.
+	OnPublish func(c *ClientInfo, msg *message.PublishMessage) (*message.PublishMessage, error)
+
+	// OnDeliver is called for each PUBLISH about to be sent to the client, after
+	// Server.TransformOutbound. The message may be shared with other clients, so it
+	// must not be modified.
+	OnDeliver func(c *ClientInfo, msg *message.PublishMessage)
+
+	// OnSlowConsumer is called when the client is disconnected for not reading its
+	// messages fast enough, with the number of QoS 0 messages dropped for it before
+	// then. See SlowConsumerPolicy. OnDisconnect is called after it, as usual. It's
+	// called from the goroutine that found the client's outgoing queue full.
+	OnSlowConsumer func(c *ClientInfo, dropped int64)
+
+	// TraceContext is called for each PUBLISH from the client when the server has a
+	// Tracer, before anything else is done with it. It returns the context with the
+	// span to make the parent of the message's SpanPublish, e.g., one extracted from
+	// the payload, or a topic level, with the trace context the client put in there,
+	// so the trace carries on through the server. ctx is what the TraceContext hook
+	// before it returned, or context.Background() for the first one.
+	TraceContext func(ctx context.Context, c *ClientInfo, msg *message.PublishMessage) context.Context
+}
+
+// hookConnect runs the OnConnect hooks, in order, until one of them rejects the client.
+func (this *service) hookConnect(msg *message.ConnectMessage) error {
+	for _, h := range this.hooks {
+		if h.OnConnect == nil {
+			continue
+		}
+
+		if err := h.OnConnect(this.info, msg); err != nil {
+			this.log.Infof("(%s) Connection rejected by hook: %v", this.info.ClientId, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hookTimeouts runs the OnTimeouts hooks, in order, each getting the timeouts left by
+// the one before it, and sets the ones the service uses.
+func (this *service) hookTimeouts(t *ClientTimeouts) {
+	for _, h := range this.hooks {
+		if h.OnTimeouts != nil {
+			h.OnTimeouts(this.info, t)
+		}
+	}
+
+	if t.KeepAlive <= 0 {
+		t.KeepAlive = minKeepAlive
+	}
+
+	this.keepAlive = t.KeepAlive
+	this.ackTimeout = t.AckTimeout
+	this.timeoutRetries = t.TimeoutRetries
+	this.sessionExpiry = t.SessionExpiry
+	this.maxInflight = t.MaxInflight
+}
+
+func (this *service) hookDisconnect() {
+	if this.info == nil {
+		return
+	}
+
+	for _, h := range this.hooks {
+		if h.OnDisconnect != nil {
+			h.OnDisconnect(this.info)
+		}
+	}
+}
+
+// hookSubscribe runs the OnSubscribe hooks, in order, each getting the QoS returned by
+// the one before it. It returns false if one of them rejects the subscription.
+func (this *service) hookSubscribe(topic []byte, qos byte) (byte, bool) {
+	for _, h := range this.hooks {
+		if h.OnSubscribe == nil {
+			continue
+		}
+
+		hqos, err := h.OnSubscribe(this.info, topic, qos)
+		if err != nil {
+			this.log.Infof("(%s) Subscription to topic %q rejected by hook: %v", this.cid(), string(topic), err)
+			return 0, false
+		}
+
+		if hqos < qos {
+			qos = hqos
+		}
+	}
+
+	return qos, true
+}
+
+// hookPublish runs the OnPublish hooks, in order, each getting the message returned by
+// the one before it. It returns false if one of them drops the message.
+func (this *service) hookPublish(msg *message.PublishMessage) (*message.PublishMessage, bool) {
+	for _, h := range this.hooks {
+		if h.OnPublish == nil {
+			continue
+		}
+
+		hmsg, err := h.OnPublish(this.info, msg)
+		if err != nil {
+			this.log.Infof("(%s) Message to topic %q dropped by hook: %v", this.cid(), string(msg.Topic()), err)
+			return nil, false
+		}
+
+		if hmsg == nil {
+			return nil, false
+		}
+
+		msg = hmsg
+	}
+
+	return msg, true
+}
+
+func (this *service) hookDeliver(msg *message.PublishMessage) {
+	for _, h := range this.hooks {
+		if h.OnDeliver != nil {
+			h.OnDeliver(this.info, msg)
+		}
+	}
+}
+
+// hookTraceContext runs the TraceContext hooks, in order, each getting the context
+// returned by the one before it.
+func (this *service) hookTraceContext(msg *message.PublishMessage) context.Context {
+	ctx := context.Background()
+
+	for _, h := range this.hooks {
+		if h.TraceContext == nil {
+			continue
+		}
+
+		if hctx := h.TraceContext(ctx, this.info, msg); hctx != nil {
+			ctx = hctx
+		}
+	}
+
+	return ctx
+}
+
+func (this *service) hookSlowConsumer(dropped int64) {
+	if this.info == nil {
+		return
+	}
+
+	for _, h := range this.hooks {
+		if h.OnSlowConsumer != nil {
+			h.OnSlowConsumer(this.info, dropped)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+// hookLog keeps track of the hooks called, in the order they were called.
+type hookLog struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (this *hookLog) add(event string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.events = append(this.events, event)
+}
+
+func (this *hookLog) has(event string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, e := range this.events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newHookSubscribeMessage(pktid uint16, topics ...string) *message.SubscribeMessage {
+	msg := message.NewSubscribeMessage()
+	msg.SetPacketId(pktid)
+
+	for _, t := range topics {
+		msg.AddTopic([]byte(t), message.QosAtLeastOnce)
+	}
+
+	return msg
+}
+
+func TestServerHooks(t *testing.T) {
+	var log hookLog
+
+	errRejected := errors.New("Rejected")
+
+	filter := &Hooks{
+		OnConnect: func(c *ClientInfo, msg *message.ConnectMessage) error {
+			if c.ClientId == "banned" {
+				return errRejected
+			}
+
+			if c.RemoteAddr != nil {
+				log.add("connect " + c.ClientId + " " + c.Username)
+			}
+
+			return nil
+		},
+
+		OnSubscribe: func(c *ClientInfo, topic []byte, qos byte) (byte, error) {
+			switch string(topic) {
+			case "secret":
+				return 0, errRejected
+
+			case "low":
+				return message.QosAtMostOnce, nil
+			}
+
+			return qos, nil
+		},
+
+		OnPublish: func(c *ClientInfo, msg *message.PublishMessage) (*message.PublishMessage, error) {
+			if string(msg.Topic()) == "drop" {
+				return nil, errRejected
+			}
+
+			msg.SetPayload(bytes.ToUpper(msg.Payload()))
+			return msg, nil
+		},
+	}
+
+	audit := &Hooks{
+		OnPublish: func(c *ClientInfo, msg *message.PublishMessage) (*message.PublishMessage, error) {
+			log.add("publish " + c.ClientId + " " + string(msg.Payload()))
+			return msg, nil
+		},
+
+		OnDeliver: func(c *ClientInfo, msg *message.PublishMessage) {
+			log.add("deliver " + c.ClientId + " " + string(msg.Topic()))
+		},
+
+		OnDisconnect: func(c *ClientInfo) {
+			log.add("disconnect " + c.ClientId)
+		},
+	}
+
+	svr, done := startNamedServer(t, "hooks", "tcp://127.0.0.1:1883", &Server{
+		Hooks: []*Hooks{filter, audit},
+	})
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	// Wait for the server to be up
+	dialNamedServer(t, "127.0.0.1:1883", "x").Close()
+
+	// Rejected by OnConnect
+	cmsg := newConnectMessage()
+	cmsg.SetClientId([]byte("banned"))
+
+	conn, err := net.Dial("tcp", "127.0.0.1:1883")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, cmsg))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	connack, err := getConnackMessage(conn, 0)
+	require.NoError(t, err)
+	require.Equal(t, message.ErrNotAuthorized, connack.ReturnCode())
+	expectClosed(t, conn)
+
+	require.False(t, log.has("disconnect banned"))
+
+	// Subscriptions rejected and downgraded by OnSubscribe
+	cmsg = newConnectMessage()
+	cmsg.SetWillFlag(false)
+	cmsg.SetWillQos(0)
+	cmsg.SetClientId([]byte("hooked"))
+
+	conn, _ = connectRawMessage(t, "tcp://127.0.0.1:1883", cmsg)
+	defer conn.Close()
+
+	require.True(t, log.has("connect hooked surgemq"))
+
+	require.NoError(t, writeMessage(conn, newHookSubscribeMessage(1, "abc", "secret", "low", "drop")))
+
+	suback := expectMessage(t, conn, message.SUBACK).(*message.SubackMessage)
+	require.Equal(t, []byte{message.QosAtLeastOnce, message.QosFailure, message.QosAtMostOnce, message.QosAtLeastOnce}, suback.ReturnCodes())
+
+	// Changed by OnPublish, and seen changed by the next hook
+	require.NoError(t, writeMessage(conn, newPayloadMessage(0, 0, "hello")))
+
+	msg := expectMessage(t, conn, message.PUBLISH).(*message.PublishMessage)
+	require.Equal(t, "HELLO", string(msg.Payload()))
+
+	require.True(t, log.has("publish hooked HELLO"))
+	require.True(t, log.has("deliver hooked abc"))
+
+	// Dropped by OnPublish
+	pub := newPublishMessage(0, 0)
+	pub.SetTopic([]byte("drop"))
+	require.NoError(t, writeMessage(conn, pub))
+
+	expectNoMessage(t, conn)
+
+	conn.Close()
+
+	for i := 0; i < 100 && !log.has("disconnect hooked"); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	require.True(t, log.has("disconnect hooked"))
+}
@@ -0,0 +1,394 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logger"
+)
+
+const (
+	DefaultKafkaBatchSize     = 100
+	DefaultKafkaFlushInterval = time.Millisecond * 100
+	DefaultKafkaQueueSize     = 10000
+	DefaultKafkaMinBackoff    = time.Millisecond * 100
+	DefaultKafkaMaxBackoff    = time.Second * 30
+)
+
+var _ Connector = (*KafkaConnector)(nil)
+
+var errKafkaStopped = errors.New("Kafka connector is stopped")
+
+// KafkaMessage is a message to produce to a Kafka topic.
+type KafkaMessage struct {
+	Topic string
+	Key   []byte
+	Value []byte
+}
+
+// KafkaProducer produces messages to Kafka. It's meant to wrap a Kafka client, e.g.,
+// a sarama.SyncProducer, so the server doesn't depend on any one of them. SendMessages
+// must not return until Kafka has acknowledged all the messages, and must return an
+// error if it hasn't for any of them, in which case they are all sent again.
+type KafkaProducer interface {
+	SendMessages(msgs []*KafkaMessage) error
+}
+
+// KafkaRule maps the MQTT messages of a topic filter to a Kafka topic and key. Topic
+// and Key can have placeholders in them, "{topic}" for the MQTT topic, and "{1}",
+// "{2}", and so on, for its levels. For example, with a Topic of "telemetry-{2}" and a
+// Key of "{3}", a message published on "site1/temp/sensor4" goes to the Kafka topic
+// "telemetry-temp" with the key "sensor4".
+type KafkaRule struct {
+	// Filter is the MQTT topic filter of the messages to forward.
+	Filter string
+
+	// Topic is the Kafka topic the messages go to. If not set then default to the MQTT
+	// topic with the "/" replaced by ".".
+	Topic string
+
+	// Key is the key of the Kafka messages. If not set then default to the MQTT topic,
+	// so the messages of a topic stay in order.
+	Key string
+}
+
+// KafkaConnector forwards the messages matching its rules to Kafka, once for each rule
+// a message matches. The payload of the MQTT message is the value of the Kafka one.
+//
+// Messages are queued as they are published, and sent in batches, once BatchSize of
+// them are waiting or every FlushInterval, whichever comes first. A batch that Kafka
+// doesn't acknowledge is sent again, waiting twice as long after each failed attempt,
+// from MinBackoff up to MaxBackoff, until it is. In the meantime the queue fills up,
+// and once it's full the clients publishing the messages are held up until there's
+// room again. Messages still queued when the server is closed get one more try before
+// they are dropped.
+//
+// The QoS 1 and 2 messages from the clients are delivered at least once, since their
+// PUBACK, or PUBCOMP, is only sent once Kafka has acknowledged them. The clients send
+// the ones dropped as the server is closed again once they reconnect, except for the
+// QoS 2 messages they have released already with PUBREL. All the other messages,
+// i.e., QoS 0 messages, and the ones from Publish(), the bridges and the cluster, are
+// delivered at most once. See ForwardFunc.
+type KafkaConnector struct {
+	// Producer is what sends the messages to Kafka.
+	Producer KafkaProducer
+
+	// Rules are the topic filters whose messages are forwarded, and where to.
+	Rules []KafkaRule
+
+	// The most messages sent at once, and how long messages wait for a batch to fill
+	// up. If not set then default to 100 messages and 100 milliseconds.
+	BatchSize     int
+	FlushInterval time.Duration
+
+	// The most messages waiting to be sent. If not set then default to 10000 messages.
+	QueueSize int
+
+	// How long to wait before sending a batch again, at first and at most. If not set
+	// then default to 100 milliseconds and 30 seconds.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	svr *Server
+	log logger.Logger
+
+	// The functions subscribed to the topic filters of the rules
+	subs []ForwardFunc
+
+	queue chan *kafkaPending
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// kafkaPending is a message waiting to be sent to Kafka, and the function to call
+// once it has been, or has been given up on.
+type kafkaPending struct {
+	msg  *KafkaMessage
+	done func(error)
+}
+
+func (this *KafkaConnector) checkConfiguration() error {
+	if this.Producer == nil {
+		return fmt.Errorf("kafka/checkConfiguration: No producer")
+	}
+
+	if len(this.Rules) == 0 {
+		return fmt.Errorf("kafka/checkConfiguration: No rules")
+	}
+
+	for _, r := range this.Rules {
+		if r.Filter == "" {
+			return fmt.Errorf("kafka/checkConfiguration: Empty topic filter")
+		}
+	}
+
+	if this.BatchSize == 0 {
+		this.BatchSize = DefaultKafkaBatchSize
+	}
+
+	if this.FlushInterval == 0 {
+		this.FlushInterval = DefaultKafkaFlushInterval
+	}
+
+	if this.QueueSize == 0 {
+		this.QueueSize = DefaultKafkaQueueSize
+	}
+
+	if this.MinBackoff == 0 {
+		this.MinBackoff = DefaultKafkaMinBackoff
+	}
+
+	if this.MaxBackoff == 0 {
+		this.MaxBackoff = DefaultKafkaMaxBackoff
+	}
+
+	if this.MaxBackoff < this.MinBackoff {
+		this.MaxBackoff = this.MinBackoff
+	}
+
+	return nil
+}
+
+// Start checks the configuration, and starts forwarding the messages matching the
+// rules to Kafka.
+func (this *KafkaConnector) Start(svr *Server) error {
+	if err := this.checkConfiguration(); err != nil {
+		return err
+	}
+
+	this.svr = svr
+	this.log = svr.Logger.With(logger.Subsystem, "kafka")
+	this.queue = make(chan *kafkaPending, this.QueueSize)
+	this.quit = make(chan struct{})
+
+	this.subs = make([]ForwardFunc, len(this.Rules))
+
+	for i := range this.Rules {
+		r := &this.Rules[i]
+
+		this.subs[i] = func(msg *message.PublishMessage, done func(error)) {
+			this.forward(r, msg, done)
+		}
+
+		if err := svr.Subscribe([]byte(r.Filter), &this.subs[i]); err != nil {
+			this.unsubscribe(i)
+			return fmt.Errorf("kafka/start: Error subscribing to %q: %v", r.Filter, err)
+		}
+	}
+
+	this.wg.Add(1)
+	go this.run()
+
+	return nil
+}
+
+// Stop stops forwarding, once the messages queued have been sent, or given up on.
+func (this *KafkaConnector) Stop() {
+	if this.quit == nil {
+		return
+	}
+
+	select {
+	case <-this.quit:
+		return
+
+	default:
+	}
+
+	this.unsubscribe(len(this.Rules))
+
+	close(this.quit)
+	this.wg.Wait()
+}
+
+// unsubscribe unsubscribes the first n rules.
+func (this *KafkaConnector) unsubscribe(n int) {
+	for i := 0; i < n; i++ {
+		this.svr.Unsubscribe([]byte(this.Rules[i].Filter), &this.subs[i])
+	}
+}
+
+// forward queues the message for Kafka, waiting for room in the queue if it's full.
+// done is called once Kafka has acknowledged it, or it's dropped.
+func (this *KafkaConnector) forward(r *KafkaRule, msg *message.PublishMessage, done func(error)) {
+	topic := string(msg.Topic())
+
+	km := &KafkaMessage{
+		Topic: strings.Replace(topic, "/", ".", -1),
+		Key:   []byte(topic),
+		Value: append([]byte(nil), msg.Payload()...),
+	}
+
+	if r.Topic != "" {
+		km.Topic = expandKafkaTemplate(r.Topic, topic)
+	}
+
+	if r.Key != "" {
+		km.Key = []byte(expandKafkaTemplate(r.Key, topic))
+	}
+
+	select {
+	case this.queue <- &kafkaPending{msg: km, done: done}:
+
+	case <-this.quit:
+		this.log.Errorf("kafka/forward: Connector is stopped, dropping message to %q", topic)
+		done(errKafkaStopped)
+	}
+}
+
+// run sends the queued messages to Kafka until the connector is stopped.
+func (this *KafkaConnector) run() {
+	defer this.wg.Done()
+
+	tick := time.NewTicker(this.FlushInterval)
+	defer tick.Stop()
+
+	batch := make([]*kafkaPending, 0, this.BatchSize)
+
+	for {
+		select {
+		case p := <-this.queue:
+			if batch = append(batch, p); len(batch) < this.BatchSize {
+				continue
+			}
+
+		case <-tick.C:
+			if len(batch) == 0 {
+				continue
+			}
+
+		case <-this.quit:
+			// Send what's left before going. Nothing else takes from the queue, so
+			// it has at least n messages in it.
+			for n := len(this.queue); n > 0; n-- {
+				if batch = append(batch, <-this.queue); len(batch) == this.BatchSize {
+					this.send(batch)
+					batch = batch[:0]
+				}
+			}
+
+			if len(batch) > 0 {
+				this.send(batch)
+			}
+
+			return
+		}
+
+		this.send(batch)
+		batch = batch[:0]
+	}
+}
+
+// send sends the batch to Kafka, again and again until it's acknowledged. Once the
+// connector is stopping, the batch only gets one more try.
+func (this *KafkaConnector) send(batch []*kafkaPending) {
+	msgs := make([]*KafkaMessage, len(batch))
+	for i, p := range batch {
+		msgs[i] = p.msg
+	}
+
+	backoff := this.MinBackoff
+
+	for {
+		err := this.Producer.SendMessages(msgs)
+		if err == nil {
+			for _, p := range batch {
+				p.done(nil)
+			}
+
+			return
+		}
+
+		select {
+		case <-this.quit:
+			this.log.Errorf("kafka/send: Connector is stopped, dropping %d messages: %v", len(batch), err)
+
+			for _, p := range batch {
+				p.done(err)
+			}
+
+			return
+
+		default:
+		}
+
+		this.log.Errorf("kafka/send: Error sending %d messages: %v; retrying in %v", len(batch), err, backoff)
+
+		timer := time.NewTimer(backoff)
+
+		select {
+		case <-timer.C:
+
+		case <-this.quit:
+			timer.Stop()
+		}
+
+		if backoff *= 2; backoff > this.MaxBackoff {
+			backoff = this.MaxBackoff
+		}
+	}
+}
+
+// expandKafkaTemplate replaces the placeholders in tmpl, "{topic}" and "{1}", "{2}",
+// and so on, with the MQTT topic and its levels. Placeholders for levels the topic
+// doesn't have, or that are not known, are left as they are.
+func expandKafkaTemplate(tmpl, topic string) string {
+	if strings.IndexByte(tmpl, '{') < 0 {
+		return tmpl
+	}
+
+	levels := strings.Split(topic, "/")
+
+	var b bytes.Buffer
+
+	for {
+		i := strings.IndexByte(tmpl, '{')
+		if i < 0 {
+			break
+		}
+
+		j := strings.IndexByte(tmpl[i:], '}')
+		if j < 0 {
+			break
+		}
+
+		b.WriteString(tmpl[:i])
+
+		name := tmpl[i+1 : i+j]
+
+		if n, err := strconv.Atoi(name); err == nil && n >= 1 && n <= len(levels) {
+			b.WriteString(levels[n-1])
+		} else if name == "topic" {
+			b.WriteString(topic)
+		} else {
+			b.WriteString(tmpl[i : i+j+1])
+		}
+
+		tmpl = tmpl[i+j+1:]
+	}
+
+	b.WriteString(tmpl)
+
+	return b.String()
+}
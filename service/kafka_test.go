@@ -0,0 +1,222 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+// testProducer keeps the messages sent to it. The first failures batches fail.
+type testProducer struct {
+	mu       sync.Mutex
+	msgs     []*KafkaMessage
+	batches  int
+	failures int
+}
+
+func (this *testProducer) SendMessages(msgs []*KafkaMessage) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.batches++; this.batches <= this.failures {
+		return errors.New("Not enough in-sync replicas")
+	}
+
+	this.msgs = append(this.msgs, msgs...)
+	return nil
+}
+
+func (this *testProducer) sent() []*KafkaMessage {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return append([]*KafkaMessage(nil), this.msgs...)
+}
+
+func TestExpandKafkaTemplate(t *testing.T) {
+	require.Equal(t, "telemetry", expandKafkaTemplate("telemetry", "site1/temp/sensor4"))
+	require.Equal(t, "telemetry-temp", expandKafkaTemplate("telemetry-{2}", "site1/temp/sensor4"))
+	require.Equal(t, "sensor4.site1", expandKafkaTemplate("{3}.{1}", "site1/temp/sensor4"))
+	require.Equal(t, "all/site1/temp", expandKafkaTemplate("all/{topic}", "site1/temp"))
+	require.Equal(t, "x{4}{name}", expandKafkaTemplate("x{4}{name}", "site1/temp/sensor4"))
+	require.Equal(t, "x{1", expandKafkaTemplate("x{1", "site1"))
+}
+
+func TestKafkaConnectorConfiguration(t *testing.T) {
+	require.Error(t, (&KafkaConnector{Rules: []KafkaRule{{Filter: "#"}}}).checkConfiguration())
+	require.Error(t, (&KafkaConnector{Producer: &testProducer{}}).checkConfiguration())
+	require.Error(t, (&KafkaConnector{Producer: &testProducer{}, Rules: []KafkaRule{{}}}).checkConfiguration())
+
+	c := &KafkaConnector{Producer: &testProducer{}, Rules: []KafkaRule{{Filter: "#"}}}
+	require.NoError(t, c.checkConfiguration())
+	require.Equal(t, DefaultKafkaBatchSize, c.BatchSize)
+	require.Equal(t, DefaultKafkaQueueSize, c.QueueSize)
+	require.Equal(t, DefaultKafkaMaxBackoff, c.MaxBackoff)
+}
+
+// Messages from clients and from Publish() all get to Kafka, mapped by the rules, even
+// when Kafka doesn't take them the first time.
+func TestKafkaConnectorForward(t *testing.T) {
+	p := &testProducer{failures: 2}
+
+	svr, done := startNamedServer(t, "kafka", "tcp://127.0.0.1:1883", &Server{
+		Connectors: []Connector{
+			&KafkaConnector{
+				Producer: p,
+				Rules: []KafkaRule{
+					{Filter: "sensors/+/temp", Topic: "temp", Key: "{2}"},
+					{Filter: "abc"},
+				},
+				BatchSize:     2,
+				FlushInterval: time.Millisecond * 10,
+				MinBackoff:    time.Millisecond * 10,
+			},
+		},
+	})
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	conn := dialNamedServer(t, "127.0.0.1:1883", "x")
+	defer conn.Close()
+
+	for i, qos := range []byte{0, 1, 2} {
+		pub := newPayloadMessage(uint16(i+1), qos, "21.5")
+		pub.SetTopic([]byte("sensors/s1/temp"))
+		require.NoError(t, writeMessage(conn, pub))
+	}
+
+	// The PUBACK waits for Kafka, the PUBREC doesn't
+	expectMessage(t, conn, message.PUBREC)
+	expectMessage(t, conn, message.PUBACK)
+	require.NoError(t, writeMessage(conn, newPubrelMessage(3)))
+	expectMessage(t, conn, message.PUBCOMP)
+
+	require.NoError(t, svr.Publish(newPublishMessage(0, 0), nil))
+
+	// Not forwarded
+	pub := newPublishMessage(0, 0)
+	pub.SetTopic([]byte("sensors/s1/humidity"))
+	require.NoError(t, svr.Publish(pub, nil))
+
+	var msgs []*KafkaMessage
+
+	for i := 0; i < 200 && len(msgs) < 4; i++ {
+		time.Sleep(time.Millisecond * 10)
+		msgs = p.sent()
+	}
+
+	require.Equal(t, 4, len(msgs))
+
+	var temps int
+
+	for _, km := range msgs {
+		switch km.Topic {
+		case "temp":
+			temps++
+			require.Equal(t, "s1", string(km.Key))
+			require.Equal(t, "21.5", string(km.Value))
+
+		case "abc":
+			require.Equal(t, "abc", string(km.Key))
+			require.Equal(t, "abc", string(km.Value))
+
+		default:
+			t.Fatalf("Unexpected Kafka topic %q", km.Topic)
+		}
+	}
+
+	require.Equal(t, 3, temps)
+}
+
+// The PUBACK isn't sent until Kafka has the message, and the ones after it wait too,
+// even for the messages that are not forwarded.
+func TestKafkaConnectorAck(t *testing.T) {
+	p := &testProducer{failures: 1000}
+
+	svr, done := startNamedServer(t, "kafka", "tcp://127.0.0.1:1883", &Server{
+		Connectors: []Connector{
+			&KafkaConnector{
+				Producer:      p,
+				Rules:         []KafkaRule{{Filter: "abc"}},
+				FlushInterval: time.Millisecond * 10,
+				MinBackoff:    time.Millisecond * 10,
+				MaxBackoff:    time.Millisecond * 10,
+			},
+		},
+	})
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	conn := dialNamedServer(t, "127.0.0.1:1883", "x")
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, newPublishMessage(1, 1)))
+
+	pub := newPublishMessage(2, 1)
+	pub.SetTopic([]byte("xyz"))
+	require.NoError(t, writeMessage(conn, pub))
+
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	_, err := getMessageBuffer(conn)
+	require.Error(t, err, "Expecting no PUBACK until Kafka has the message")
+
+	p.mu.Lock()
+	p.failures = 0
+	p.mu.Unlock()
+
+	ack := expectMessage(t, conn, message.PUBACK).(*message.PubackMessage)
+	require.Equal(t, uint16(1), ack.PacketId())
+
+	ack = expectMessage(t, conn, message.PUBACK).(*message.PubackMessage)
+	require.Equal(t, uint16(2), ack.PacketId())
+
+	require.Equal(t, 1, len(p.sent()))
+}
+
+// The messages still queued are sent before Close() returns.
+func TestKafkaConnectorStop(t *testing.T) {
+	p := &testProducer{}
+
+	svr, done := startNamedServer(t, "kafka", "tcp://127.0.0.1:1883", &Server{
+		Connectors: []Connector{
+			&KafkaConnector{
+				Producer:      p,
+				Rules:         []KafkaRule{{Filter: "abc"}},
+				FlushInterval: time.Hour,
+			},
+		},
+	})
+
+	dialNamedServer(t, "127.0.0.1:1883", "x").Close()
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, svr.Publish(newPublishMessage(0, 0), nil))
+	}
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+
+	require.Equal(t, 5, len(p.sent()))
+}
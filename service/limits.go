@@ -0,0 +1,146 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrTooManyConnections is returned by handleConnection when the client is turned
+	// away because of MaxConnections or MaxConnectionsPerIP.
+	ErrTooManyConnections = errors.New("service: Too many connections")
+
+	// ErrSlowConsumer is returned when sending a message to a client that's being
+	// disconnected because its outgoing queue is full. See DisconnectSlowConsumer.
+	ErrSlowConsumer = errors.New("service: Outgoing queue is full")
+
+	// ErrPacketTooLarge is returned when the header of an incoming message says it's
+	// bigger than the MaxPacketSize of the server or client. The connection is closed
+	// without reading the rest of it.
+	ErrPacketTooLarge = errors.New("service: Packet too large")
+
+	errPublishRateExceed = errors.New("Too many incoming PUBLISH messages")
+	errPayloadTooLarge   = errors.New("PUBLISH payload too large")
+)
+
+// admit takes up one of the connections allowed by MaxConnections and
+// MaxConnectionsPerIP for the client at ip, and by the MaxConnections of l if it's
+// not nil. It returns false, and takes up nothing, if there are none left. Otherwise
+// the returned func gives the connection back, and it's fine to call it more than
+// once.
+func (this *Server) admit(ip string, l *Listener) (func(), bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.MaxConnections > 0 && this.nconns >= this.MaxConnections {
+		return nil, false
+	}
+
+	if this.MaxConnectionsPerIP > 0 && this.ipconns[ip] >= this.MaxConnectionsPerIP {
+		return nil, false
+	}
+
+	if l != nil && l.MaxConnections > 0 && l.nconns >= l.MaxConnections {
+		return nil, false
+	}
+
+	if this.ipconns == nil {
+		this.ipconns = make(map[string]int)
+	}
+
+	this.nconns++
+	this.ipconns[ip]++
+
+	if l != nil {
+		l.nconns++
+	}
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			this.mu.Lock()
+			defer this.mu.Unlock()
+
+			this.nconns--
+
+			if this.ipconns[ip]--; this.ipconns[ip] <= 0 {
+				delete(this.ipconns, ip)
+			}
+
+			if l != nil {
+				l.nconns--
+			}
+		})
+	}, true
+}
+
+// remoteIP returns the IP address the client connected from. For WebSocket
+// connections that's from the HTTP request, since the remote address of the
+// connection itself is the client's origin.
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+
+	if ws, ok := conn.(interface {
+		Request() *http.Request
+	}); ok && ws.Request() != nil {
+		addr = ws.Request().RemoteAddr
+	}
+
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
+
+// rateLimiter is a token bucket that allows rate events a second, on average, and
+// bursts of up to rate events. Not safe for concurrent use.
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// allow returns true if the event at now is within the rate.
+func (this *rateLimiter) allow(now time.Time) bool {
+	this.tokens += now.Sub(this.last).Seconds() * this.rate
+	if this.tokens > this.rate {
+		this.tokens = this.rate
+	}
+
+	this.last = now
+
+	if this.tokens < 1 {
+		return false
+	}
+
+	this.tokens--
+
+	return true
+}
@@ -0,0 +1,339 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/topics"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+
+	l := newRateLimiter(2)
+	l.last = now
+
+	require.True(t, l.allow(now))
+	require.True(t, l.allow(now))
+	require.False(t, l.allow(now))
+
+	now = now.Add(time.Millisecond * 500)
+	require.True(t, l.allow(now))
+	require.False(t, l.allow(now))
+
+	// It never saves up more than a second's worth
+	now = now.Add(time.Hour)
+	require.True(t, l.allow(now))
+	require.True(t, l.allow(now))
+	require.False(t, l.allow(now))
+}
+
+func TestServerAdmit(t *testing.T) {
+	svr := &Server{
+		MaxConnections:      3,
+		MaxConnectionsPerIP: 2,
+	}
+
+	r1, ok := svr.admit("10.0.0.1", nil)
+	require.True(t, ok)
+
+	_, ok = svr.admit("10.0.0.1", nil)
+	require.True(t, ok)
+
+	_, ok = svr.admit("10.0.0.1", nil)
+	require.False(t, ok)
+
+	r3, ok := svr.admit("10.0.0.2", nil)
+	require.True(t, ok)
+
+	_, ok = svr.admit("10.0.0.3", nil)
+	require.False(t, ok)
+
+	// Giving back the same connection twice only counts once
+	r1()
+	r1()
+
+	_, ok = svr.admit("10.0.0.3", nil)
+	require.True(t, ok)
+
+	_, ok = svr.admit("10.0.0.2", nil)
+	require.False(t, ok)
+
+	r3()
+	require.Equal(t, 2, svr.nconns)
+	require.Equal(t, map[string]int{"10.0.0.1": 1, "10.0.0.3": 1}, svr.ipconns)
+}
+
+func TestServerMaxConnections(t *testing.T) {
+	topics.Unregister("mem")
+	topics.Register("mem", topics.NewMemProvider())
+
+	sessions.Unregister("mem")
+	sessions.Register("mem", sessions.NewMemProvider())
+
+	svr := &Server{
+		Authenticator:  authenticator,
+		MaxConnections: 2,
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- svr.ListenAndServe("tcp://127.0.0.1:1883")
+	}()
+
+	dial := func() (net.Conn, message.ConnackCode) {
+		var (
+			conn net.Conn
+			err  error
+		)
+
+		for i := 0; i < 100; i++ {
+			if conn, err = net.Dial("tcp", "127.0.0.1:1883"); err == nil {
+				break
+			}
+
+			time.Sleep(time.Millisecond * 10)
+		}
+
+		require.NoError(t, err)
+		require.NoError(t, writeMessage(conn, newConnectMessage()))
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		connack, err := getConnackMessage(conn, 0)
+		require.NoError(t, err)
+
+		return conn, connack.ReturnCode()
+	}
+
+	c1, code := dial()
+	require.Equal(t, message.ConnectionAccepted, code)
+
+	c2, code := dial()
+	require.Equal(t, message.ConnectionAccepted, code)
+	defer c2.Close()
+
+	c3, code := dial()
+	require.Equal(t, message.ErrServerUnavailable, code)
+	c3.Close()
+
+	// The connection is given back once the service has stopped
+	c1.Close()
+
+	for i := 0; i < 100; i++ {
+		c4, code := dial()
+		c4.Close()
+
+		if code == message.ConnectionAccepted {
+			break
+		}
+
+		require.True(t, i < 99, "Connection was not given back")
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+}
+
+func TestServiceMaxPayloadSize(t *testing.T) {
+	var wg sync.WaitGroup
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+
+	uri := "tcp://127.0.0.1:1883"
+	u, err := url.Parse(uri)
+	require.NoError(t, err, "Error parsing URL")
+
+	svr := &Server{
+		Authenticator:  authenticator,
+		MaxPayloadSize: 8,
+	}
+
+	wg.Add(1)
+	go startServer(t, svr, u, &wg, ready1, ready2, 1)
+
+	<-ready1
+
+	conn := connectRaw(t, uri)
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, newPayloadMessage(1, 1, "12345678")))
+	expectMessage(t, conn, message.PUBACK)
+
+	require.NoError(t, writeMessage(conn, newPayloadMessage(2, 1, strings.Repeat("x", 9))))
+	expectClosed(t, conn)
+
+	close(ready2)
+
+	wg.Wait()
+}
+
+func TestServiceMaxPacketSize(t *testing.T) {
+	var wg sync.WaitGroup
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+
+	uri := "tcp://127.0.0.1:1883"
+	u, err := url.Parse(uri)
+	require.NoError(t, err, "Error parsing URL")
+
+	svr := &Server{
+		Authenticator: authenticator,
+		MaxPacketSize: 64,
+	}
+
+	wg.Add(1)
+	go startServer(t, svr, u, &wg, ready1, ready2, 1)
+
+	<-ready1
+
+	conn := connectRaw(t, uri)
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, newPayloadMessage(1, 1, "12345678")))
+	expectMessage(t, conn, message.PUBACK)
+
+	// Only the header is sent. The server mustn't wait for the ~256MB it says follow.
+	require.NoError(t, writeMessageBuffer(conn, []byte{0x32, 0xff, 0xff, 0xff, 0x7f}))
+	expectClosed(t, conn)
+
+	// Nor for a CONNECT that's too big
+	conn2, err := net.Dial(u.Scheme, u.Host)
+	require.NoError(t, err)
+	defer conn2.Close()
+
+	msg := newConnectMessage()
+	msg.SetUsername([]byte(strings.Repeat("x", 64)))
+
+	require.NoError(t, writeMessage(conn2, msg))
+	expectClosed(t, conn2)
+
+	close(ready2)
+
+	wg.Wait()
+}
+
+func TestReadMessageBufferMaxPacketSize(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go c1.Write([]byte{0x30, 0xff, 0xff, 0xff, 0x7f})
+
+	_, err := readMessageBuffer(c2, 1024)
+	require.Equal(t, ErrPacketTooLarge, err)
+}
+
+func TestServiceMaxPublishRate(t *testing.T) {
+	var wg sync.WaitGroup
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+
+	uri := "tcp://127.0.0.1:1883"
+	u, err := url.Parse(uri)
+	require.NoError(t, err, "Error parsing URL")
+
+	svr := &Server{
+		Authenticator:  authenticator,
+		MaxPublishRate: 3,
+	}
+
+	wg.Add(1)
+	go startServer(t, svr, u, &wg, ready1, ready2, 1)
+
+	<-ready1
+
+	conn := connectRaw(t, uri)
+	defer conn.Close()
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, writeMessage(conn, newPublishMessage(uint16(i), 1)))
+		expectMessage(t, conn, message.PUBACK)
+	}
+
+	require.NoError(t, writeMessage(conn, newPublishMessage(4, 1)))
+	expectClosed(t, conn)
+
+	close(ready2)
+
+	wg.Wait()
+}
+
+func TestServiceMaxInflight(t *testing.T) {
+	svr, done := startNamedServer(t, "inflight", "tcp://127.0.0.1:1883", &Server{
+		MaxInflight: 2,
+	})
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	sub := dialNamedServer(t, "127.0.0.1:1883", "abc")
+	defer sub.Close()
+
+	cmsg := newConnectMessage()
+	cmsg.SetClientId([]byte("publisher"))
+
+	pub, _ := connectRawMessage(t, "tcp://127.0.0.1:1883", cmsg)
+	defer pub.Close()
+
+	for i := 1; i <= 4; i++ {
+		require.NoError(t, writeMessage(pub, newPayloadMessage(uint16(i), 1, strconv.Itoa(i))))
+		expectMessage(t, pub, message.PUBACK)
+	}
+
+	// Only as many as the window holds until the subscriber acks them
+	var ids []uint16
+
+	for i := 1; i <= 2; i++ {
+		msg := expectMessage(t, sub, message.PUBLISH).(*message.PublishMessage)
+		require.Equal(t, strconv.Itoa(i), string(msg.Payload()))
+		ids = append(ids, msg.PacketId())
+	}
+
+	expectNoMessage(t, sub)
+
+	svr.updateMetrics()
+	require.Equal(t, 2, svr.Metrics().Queued)
+
+	for i, id := range ids {
+		ack := message.NewPubackMessage()
+		ack.SetPacketId(id)
+		require.NoError(t, writeMessage(sub, ack))
+
+		msg := expectMessage(t, sub, message.PUBLISH).(*message.PublishMessage)
+		require.Equal(t, strconv.Itoa(i+3), string(msg.Payload()))
+	}
+
+	expectNoMessage(t, sub)
+
+	svr.updateMetrics()
+	require.Equal(t, 0, svr.Metrics().Queued)
+}
@@ -0,0 +1,443 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/auth"
+	"golang.org/x/net/websocket"
+)
+
+// Listener is one of the endpoints a Server accepts clients on. All the listeners
+// of a server share its sessions, subscriptions and retained messages, so clients
+// on one can talk to the clients on the others. See Server.Listeners and Serve().
+type Listener struct {
+	// URI is where to listen. The scheme can be
+	//
+	// - "tcp", e.g., "tcp://0.0.0.0:1883", or any other network net.Listen() knows.
+	// - "ssl", "tls" or "mqtts" for TCP with TLS, e.g., "ssl://0.0.0.0:8883".
+	// - "ws" for MQTT over WebSocket, e.g., "ws://0.0.0.0:8080/mqtt", or "wss" for
+	//   WebSocket with TLS. If there's no path then clients can connect on any path.
+	// - "unix" for a Unix domain socket, e.g., "unix:///var/run/surgemq.sock". All
+	//   the clients on it count as the same IP address for MaxConnectionsPerIP.
+	URI string
+
+	// The TLS configuration, and the files with the certificate and matching private
+	// key, in PEM format, for the TLS schemes. Setting any of them also turns on TLS
+	// for "tcp". If TLSConfig is not set then default to Server.TLSConfig.
+	TLSConfig *tls.Config
+	CertFile  string
+	KeyFile   string
+
+	// Authenticator is used instead of Server.Authenticator for the clients on this
+	// listener. If not set then default to Server.Authenticator.
+	Authenticator string
+
+	// The maximum number of clients connected on this listener at the same time,
+	// on top of Server.MaxConnections. If not set then there's no limit.
+	MaxConnections int
+
+	// ProxyProtocol is for listeners behind a proxy, e.g., HAProxy or AWS NLB, that
+	// sends a PROXY protocol header, v1 or v2, ahead of each connection. The client
+	// address in the header is then used for MaxConnectionsPerIP, and is what hooks
+	// and the admin API see as the client's RemoteAddr. Connections without a valid
+	// header are closed. If not set then clients connect directly.
+	ProxyProtocol bool
+
+	// The timeouts for the clients on this listener, e.g., longer ones for clients on
+	// mobile networks. See the Server fields of the same names. If not set then
+	// default to the Server ones.
+	ConnectTimeout int
+	AckTimeout     int
+	TimeoutRetries int
+	MaxKeepAlive   int
+
+	// The authentication manager for Authenticator, if it's set
+	authMgr *auth.Manager
+
+	// The certificate loaded from CertFile and KeyFile, if they're set. It's handed
+	// to the TLS handshakes by getCertificate, so Reload() can swap it for a renewed
+	// one without closing the listener. Protected by certMu.
+	cert   *tls.Certificate
+	certMu sync.RWMutex
+
+	// Number of clients connected on the listener. Protected by the server's mu.
+	nconns int
+}
+
+// tlsConfig returns the TLS configuration to use, or nil if the listener doesn't
+// use TLS.
+func (this *Listener) tlsConfig(u *url.URL, def *tls.Config) (*tls.Config, error) {
+	switch u.Scheme {
+	case "ssl", "tls", "mqtts", "wss":
+
+	default:
+		if this.TLSConfig == nil && this.CertFile == "" && this.KeyFile == "" {
+			return nil, nil
+		}
+	}
+
+	config := &tls.Config{}
+	if this.TLSConfig != nil {
+		config = this.TLSConfig.Clone()
+	} else if def != nil {
+		config = def.Clone()
+	}
+
+	if this.CertFile != "" || this.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(this.CertFile, this.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		this.setCertificate(&cert)
+
+		config.Certificates = nil
+		config.GetCertificate = this.getCertificate
+	}
+
+	if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		return nil, fmt.Errorf("server/listen: No server certificate for %s", this.URI)
+	}
+
+	return config, nil
+}
+
+func (this *Listener) setCertificate(cert *tls.Certificate) {
+	this.certMu.Lock()
+	defer this.certMu.Unlock()
+
+	this.cert = cert
+}
+
+func (this *Listener) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	this.certMu.RLock()
+	defer this.certMu.RUnlock()
+
+	return this.cert, nil
+}
+
+// dialAddr returns the network and address to listen on, or dial, for the URI.
+func dialAddr(u *url.URL) (string, string) {
+	switch u.Scheme {
+	case "ssl", "tls", "mqtts", "ws", "wss":
+		return "tcp", u.Host
+
+	case "unix":
+		return "unix", u.Host + u.Path
+	}
+
+	return u.Scheme, u.Host
+}
+
+// Serve listens on all the Listeners at the same time. If any of them can't be
+// opened then none are, and the error is returned. Otherwise it should not return
+// until Close() is called, or if there's some critical error that stops one of the
+// listeners, in which case the others are closed as well.
+func (this *Server) Serve() error {
+	if len(this.Listeners) == 0 {
+		return fmt.Errorf("server/Serve: No listeners")
+	}
+
+	lns := make([]net.Listener, 0, len(this.Listeners))
+
+	for _, l := range this.Listeners {
+		ln, err := this.listen(l)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+
+			return err
+		}
+
+		lns = append(lns, ln)
+	}
+
+	errs := make(chan error, len(lns))
+
+	for i, ln := range lns {
+		go func(l *Listener, ln net.Listener) {
+			errs <- this.serve(l, ln)
+		}(this.Listeners[i], ln)
+	}
+
+	var err error
+
+	for range lns {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+
+			for _, ln := range lns {
+				ln.Close()
+			}
+		}
+	}
+
+	// Reload() may have closed them all, and started others, while the server goes on
+	if err == nil {
+		<-this.quit
+	}
+
+	return err
+}
+
+// listen opens the network listener for l.
+func (this *Server) listen(l *Listener) (net.Listener, error) {
+	if err := this.checkConfiguration(); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(l.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := l.tlsConfig(u, this.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.Authenticator != "" && l.authMgr == nil {
+		if l.authMgr, err = auth.NewManager(l.Authenticator); err != nil {
+			return nil, err
+		}
+	}
+
+	network, addr := dialAddr(u)
+
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The PROXY header comes before anything else, including the TLS handshake
+	if l.ProxyProtocol {
+		ln = &proxyListener{
+			Listener: ln,
+			timeout:  time.Second * time.Duration(this.connectTimeout(l)),
+		}
+	}
+
+	if config != nil {
+		ln = tls.NewListener(ln, config)
+	}
+
+	return ln, nil
+}
+
+// serve handles the clients connecting on ln, which is the listener for l, until
+// it's closed. ln is closed when this returns.
+func (this *Server) serve(l *Listener, ln net.Listener) error {
+	defer ln.Close()
+
+	// Don't start listening if Close() or Shutdown() has already been called
+	if !this.addListener(l, ln) {
+		return nil
+	}
+	defer this.removeListener(ln)
+
+	this.startMetrics()
+	this.startExpiry()
+	this.startStats()
+
+	if err := this.startPeers(); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(l.URI)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme == "ws" || u.Scheme == "wss" {
+		err = this.serveWebsocket(l, ln, u.Path)
+	} else {
+		err = this.accept(l, ln)
+	}
+
+	select {
+	case <-this.quit:
+		return nil
+
+	default:
+	}
+
+	// Closed by Reload()
+	if !this.listening(ln) {
+		return nil
+	}
+
+	return err
+}
+
+// accept handles the clients connecting on ln until it's closed.
+func (this *Server) accept(l *Listener, ln net.Listener) error {
+	this.log.Infof("server/ListenAndServe: server is ready...")
+
+	var tempDelay time.Duration // how long to sleep on accept failure
+
+	for {
+		conn, err := ln.Accept()
+
+		if err != nil {
+			// http://zhen.org/blog/graceful-shutdown-of-go-net-dot-listeners/
+			select {
+			case <-this.quit:
+				return nil
+
+			default:
+			}
+
+			if !this.listening(ln) {
+				return nil
+			}
+
+			// Borrowed from go1.3.3/src/pkg/net/http/server.go:1699
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				this.log.Errorf("server/ListenAndServe: Accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+
+		go this.handleConnection(conn, l)
+	}
+}
+
+// serveWebsocket handles the clients connecting using MQTT over WebSocket on ln until
+// it's closed.
+func (this *Server) serveWebsocket(l *Listener, ln net.Listener, path string) error {
+	if path == "" {
+		path = "/"
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, websocket.Server{
+		Handshake: websocketHandshake,
+		Handler: func(ws *websocket.Conn) {
+			this.handleWebsocket(ws, l)
+		},
+	})
+
+	this.log.Infof("server/ListenAndServeWebsocket: server is ready...")
+
+	return (&http.Server{Handler: mux}).Serve(ln)
+}
+
+// addListener adds ln, the listener for l, to the listeners closed by Close(). It
+// returns false if the server has already been closed.
+func (this *Server) addListener(l *Listener, ln net.Listener) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	select {
+	case <-this.quit:
+		return false
+
+	default:
+	}
+
+	if this.listeners == nil {
+		this.listeners = make(map[net.Listener]*Listener)
+	}
+
+	this.listeners[ln] = l
+
+	return true
+}
+
+func (this *Server) removeListener(ln net.Listener) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	delete(this.listeners, ln)
+}
+
+// listening returns true if ln is still one of the server's listeners, i.e., it
+// hasn't been removed by Reload().
+func (this *Server) listening(ln net.Listener) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	_, ok := this.listeners[ln]
+	return ok
+}
+
+// connectTimeout returns the number of seconds to wait for the CONNECT message from
+// clients on the listener, which can be nil.
+func (this *Server) connectTimeout(l *Listener) int {
+	if l != nil && l.ConnectTimeout > 0 {
+		return l.ConnectTimeout
+	}
+
+	return this.ConnectTimeout
+}
+
+// timeouts returns the timeouts for a client on the listener, which can be nil. The
+// keep alive is the one the client asked for in req, up to the MaxKeepAlive of the
+// listener or the server.
+func (this *Server) timeouts(l *Listener, req *message.ConnectMessage) ClientTimeouts {
+	t := ClientTimeouts{
+		KeepAlive:      int(req.KeepAlive()),
+		AckTimeout:     this.AckTimeout,
+		TimeoutRetries: this.TimeoutRetries,
+		SessionExpiry:  this.SessionExpiry,
+		MaxInflight:    this.MaxInflight,
+	}
+
+	max := this.MaxKeepAlive
+
+	if l != nil {
+		if l.AckTimeout > 0 {
+			t.AckTimeout = l.AckTimeout
+		}
+
+		if l.TimeoutRetries > 0 {
+			t.TimeoutRetries = l.TimeoutRetries
+		}
+
+		if l.MaxKeepAlive > 0 {
+			max = l.MaxKeepAlive
+		}
+	}
+
+	switch {
+	case max > 0 && (t.KeepAlive == 0 || t.KeepAlive > max):
+		t.KeepAlive = max
+
+	case t.KeepAlive == 0:
+		t.KeepAlive = minKeepAlive
+	}
+
+	return t
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/topics"
+)
+
+// dialListener connects to addr on network, giving the server a chance to start
+// listening first, and returns the CONNACK return code.
+func dialListener(t *testing.T, network, addr string) (net.Conn, message.ConnackCode) {
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial(network, addr); err == nil {
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	require.NoError(t, err)
+	require.NoError(t, writeMessage(conn, newConnectMessage()))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	connack, err := getConnackMessage(conn, 0)
+	require.NoError(t, err)
+
+	return conn, connack.ReturnCode()
+}
+
+func TestServerServe(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "surgemq.sock")
+
+	svr, _ := startNamedServer(t, "serve", "tcp://127.0.0.1:1883", &Server{})
+	svr.Listeners = []*Listener{
+		{URI: "tcp://127.0.0.1:1884"},
+		{URI: "unix://" + sock, MaxConnections: 1},
+		{URI: "tcp://127.0.0.1:1885", Authenticator: "mockFailure"},
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- svr.Serve()
+	}()
+
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	// Clients on all the listeners share the same subscriptions
+	uconn, code := dialListener(t, "unix", sock)
+	defer uconn.Close()
+	require.Equal(t, message.ConnectionAccepted, code)
+
+	require.NoError(t, writeMessage(uconn, newSubscribeMessage(1)))
+	expectMessage(t, uconn, message.SUBACK)
+
+	tconn, code := dialListener(t, "tcp", "127.0.0.1:1884")
+	defer tconn.Close()
+	require.Equal(t, message.ConnectionAccepted, code)
+
+	require.NoError(t, writeMessage(tconn, newPublishMessage(1, 1)))
+	expectMessage(t, tconn, message.PUBACK)
+	expectPublish(t, uconn, "abc", 1)
+
+	// Each listener has its own limits and authenticator
+	conn, code := dialListener(t, "unix", sock)
+	conn.Close()
+	require.Equal(t, message.ErrServerUnavailable, code)
+
+	conn, code = dialListener(t, "tcp", "127.0.0.1:1885")
+	conn.Close()
+	require.Equal(t, message.ErrBadUsernameOrPassword, code)
+}
+
+func TestServerServeListenError(t *testing.T) {
+	topics.Unregister("serveerror")
+	topics.Register("serveerror", topics.NewMemProvider())
+
+	sessions.Unregister("serveerror")
+	sessions.Register("serveerror", sessions.NewMemProvider())
+
+	svr := &Server{
+		Authenticator:    authenticator,
+		SessionsProvider: "serveerror",
+		TopicsProvider:   "serveerror",
+		Listeners: []*Listener{
+			{URI: "tcp://127.0.0.1:1883"},
+			{URI: "ssl://127.0.0.1:8883"},
+		},
+	}
+	defer svr.Close()
+
+	// There's no certificate for the TLS listener, so none of them are opened
+	require.Error(t, svr.Serve())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:1883")
+	require.NoError(t, err)
+	ln.Close()
+}
+
+func TestServerTimeouts(t *testing.T) {
+	svr := &Server{AckTimeout: 20, TimeoutRetries: 3}
+
+	keepAlive := func(l *Listener, ka uint16) int {
+		req := newConnectMessage()
+		req.SetKeepAlive(ka)
+		return svr.timeouts(l, req).KeepAlive
+	}
+
+	// Clients get what they ask for, or the minimum if they ask for none
+	require.Equal(t, 600, keepAlive(nil, 600))
+	require.Equal(t, minKeepAlive, keepAlive(nil, 0))
+
+	svr.MaxKeepAlive = 120
+	require.Equal(t, 60, keepAlive(nil, 60))
+	require.Equal(t, 120, keepAlive(nil, 600))
+	require.Equal(t, 120, keepAlive(nil, 0))
+
+	// The listener settings come first
+	l := &Listener{MaxKeepAlive: 90, AckTimeout: 5, ConnectTimeout: 10}
+	require.Equal(t, 90, keepAlive(l, 600))
+	require.Equal(t, 10, svr.connectTimeout(l))
+	require.Equal(t, svr.ConnectTimeout, svr.connectTimeout(&Listener{}))
+
+	req := newConnectMessage()
+	require.Equal(t, ClientTimeouts{KeepAlive: int(req.KeepAlive()), AckTimeout: 5, TimeoutRetries: 3}, svr.timeouts(l, req))
+}
+
+// A hook can shorten the keep alive of a client, which is then disconnected once it's
+// been silent for that long.
+func TestServerTimeoutsHook(t *testing.T) {
+	svr, done := startNamedServer(t, "timeoutshook", "tcp://127.0.0.1:1883", &Server{
+		Hooks: []*Hooks{{
+			OnTimeouts: func(c *ClientInfo, t *ClientTimeouts) {
+				t.KeepAlive = 1
+				t.AckTimeout = 7
+			},
+		}},
+	})
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	conn := dialNamedServer(t, "127.0.0.1:1883", "abc")
+	defer conn.Close()
+
+	svcs := svr.services()
+	require.Equal(t, 1, len(svcs))
+	require.Equal(t, 1, svcs[0].keepAlive)
+	require.Equal(t, 7, svcs[0].ackTimeout)
+
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(time.Second * 5))
+
+	_, err := getMessageBuffer(conn)
+	require.Error(t, err)
+	require.False(t, isTimeout(err), "Expecting the connection to be closed")
+	require.True(t, time.Since(start) < time.Second*3)
+}
@@ -0,0 +1,308 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics is a snapshot of the server internals. The counts are kept as things
+// happen and are always current. The rest are expensive to compute, so they are
+// only refreshed every MetricsInterval seconds and may be slightly stale.
+type Metrics struct {
+	// Number of clients connected right now
+	Connections int64
+
+	// Number of clients that have connected since the server started
+	ConnectionsTotal int64
+
+	// Number of CONNECT messages turned away because the username and password
+	// were not valid
+	AuthFailures int64
+
+	// Number of PUBLISH messages received from clients, by QoS
+	MessagesReceived [3]int64
+
+	// Number of PUBLISH messages sent to clients, by QoS
+	MessagesSent [3]int64
+
+	// Number of messages that could not be delivered to a subscriber, or to a
+	// client's offline queue
+	MessagesDropped int64
+
+	// Number of clients disconnected for not reading their messages fast enough. See
+	// SlowConsumerPolicy.
+	SlowConsumers int64
+
+	// Number of bytes read from and written to the clients
+	BytesReceived int64
+	BytesSent     int64
+
+	// When the topic tree and the buffers were last walked
+	TopicsUpdated time.Time
+
+	// Number of bytes waiting in the incoming and outgoing buffers of all the
+	// clients, and the total size of those buffers
+	BufferUsed int
+	BufferSize int
+
+	// Number of messages waiting in the sessions of the connected clients for room in
+	// their inflight window. See MaxInflight.
+	Queued int
+
+	// Number of nodes in the subscription topic tree
+	TopicNodes int
+
+	// Number of subscriptions in the subscription topic tree
+	Subscriptions int
+
+	// Number of retained messages
+	RetainedMessages int
+
+	// Total size in bytes of all the retained messages
+	RetainedBytes int
+}
+
+// counters are the server wide counts behind Metrics. They are updated by all the
+// services as things happen, so only ever use atomic operations on them. All the
+// methods can be called on a nil *counters, e.g., from a client side service, and
+// do nothing.
+type counters struct {
+	connections      int64
+	connectionsTotal int64
+	authFailures     int64
+	received         [3]int64
+	sent             [3]int64
+	dropped          int64
+	slowConsumers    int64
+	bytesReceived    int64
+	bytesSent        int64
+}
+
+func (this *counters) connected() {
+	if this != nil {
+		atomic.AddInt64(&this.connections, 1)
+		atomic.AddInt64(&this.connectionsTotal, 1)
+	}
+}
+
+func (this *counters) disconnected() {
+	if this != nil {
+		atomic.AddInt64(&this.connections, -1)
+	}
+}
+
+func (this *counters) authFailed() {
+	if this != nil {
+		atomic.AddInt64(&this.authFailures, 1)
+	}
+}
+
+func (this *counters) receivedPublish(qos byte) {
+	if this != nil && int(qos) < len(this.received) {
+		atomic.AddInt64(&this.received[qos], 1)
+	}
+}
+
+func (this *counters) sentPublish(qos byte) {
+	if this != nil && int(qos) < len(this.sent) {
+		atomic.AddInt64(&this.sent[qos], 1)
+	}
+}
+
+func (this *counters) droppedMessage() {
+	if this != nil {
+		atomic.AddInt64(&this.dropped, 1)
+	}
+}
+
+func (this *counters) slowConsumer() {
+	if this != nil {
+		atomic.AddInt64(&this.slowConsumers, 1)
+	}
+}
+
+func (this *counters) receivedBytes(n int64) {
+	if this != nil {
+		atomic.AddInt64(&this.bytesReceived, n)
+	}
+}
+
+func (this *counters) sentBytes(n int64) {
+	if this != nil {
+		atomic.AddInt64(&this.bytesSent, n)
+	}
+}
+
+// Metrics returns the latest snapshot of the server metrics.
+func (this *Server) Metrics() Metrics {
+	this.mmu.RLock()
+	m := this.metrics
+	this.mmu.RUnlock()
+
+	c := &this.counters
+
+	m.Connections = atomic.LoadInt64(&c.connections)
+	m.ConnectionsTotal = atomic.LoadInt64(&c.connectionsTotal)
+	m.AuthFailures = atomic.LoadInt64(&c.authFailures)
+	m.MessagesDropped = atomic.LoadInt64(&c.dropped)
+	m.SlowConsumers = atomic.LoadInt64(&c.slowConsumers)
+	m.BytesReceived = atomic.LoadInt64(&c.bytesReceived)
+	m.BytesSent = atomic.LoadInt64(&c.bytesSent)
+
+	for i := range c.received {
+		m.MessagesReceived[i] = atomic.LoadInt64(&c.received[i])
+		m.MessagesSent[i] = atomic.LoadInt64(&c.sent[i])
+	}
+
+	return m
+}
+
+// MetricsHandler returns an HTTP handler that serves Metrics() in the Prometheus
+// text format, for Prometheus to scrape. It's up to the caller to serve it, e.g.,
+// http.Handle("/metrics", svr.MetricsHandler()).
+func (this *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writePrometheus(w, this.Metrics())
+	})
+}
+
+// writePrometheus writes the metrics in the Prometheus text exposition format.
+func writePrometheus(w io.Writer, m Metrics) {
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP surgemq_%s %s\n# TYPE surgemq_%s %s\n", name, help, name, typ)
+	}
+
+	value := func(name string, v interface{}) {
+		fmt.Fprintf(w, "surgemq_%s %v\n", name, v)
+	}
+
+	byQos := func(name string, vs [3]int64) {
+		for qos, v := range vs {
+			fmt.Fprintf(w, "surgemq_%s{qos=\"%d\"} %d\n", name, qos, v)
+		}
+	}
+
+	metric("connections", "gauge", "Number of clients connected.")
+	value("connections", m.Connections)
+
+	metric("connections_total", "counter", "Number of clients that have connected.")
+	value("connections_total", m.ConnectionsTotal)
+
+	metric("auth_failures_total", "counter", "Number of connections refused for bad credentials.")
+	value("auth_failures_total", m.AuthFailures)
+
+	metric("messages_received_total", "counter", "Number of PUBLISH messages received from clients.")
+	byQos("messages_received_total", m.MessagesReceived)
+
+	metric("messages_sent_total", "counter", "Number of PUBLISH messages sent to clients.")
+	byQos("messages_sent_total", m.MessagesSent)
+
+	metric("messages_dropped_total", "counter", "Number of messages that could not be delivered.")
+	value("messages_dropped_total", m.MessagesDropped)
+
+	metric("slow_consumers_total", "counter", "Number of clients disconnected for not reading fast enough.")
+	value("slow_consumers_total", m.SlowConsumers)
+
+	metric("bytes_received_total", "counter", "Number of bytes read from clients.")
+	value("bytes_received_total", m.BytesReceived)
+
+	metric("bytes_sent_total", "counter", "Number of bytes written to clients.")
+	value("bytes_sent_total", m.BytesSent)
+
+	metric("buffer_used_bytes", "gauge", "Number of bytes waiting in the client buffers.")
+	value("buffer_used_bytes", m.BufferUsed)
+
+	metric("buffer_size_bytes", "gauge", "Total size of the client buffers.")
+	value("buffer_size_bytes", m.BufferSize)
+
+	metric("queued_messages", "gauge", "Number of messages waiting for room in the inflight window of the clients.")
+	value("queued_messages", m.Queued)
+
+	metric("topic_nodes", "gauge", "Number of nodes in the subscription topic tree.")
+	value("topic_nodes", m.TopicNodes)
+
+	metric("subscriptions", "gauge", "Number of subscriptions.")
+	value("subscriptions", m.Subscriptions)
+
+	metric("retained_messages", "gauge", "Number of retained messages.")
+	value("retained_messages", m.RetainedMessages)
+
+	metric("retained_bytes", "gauge", "Total size of the retained messages.")
+	value("retained_bytes", m.RetainedBytes)
+}
+
+func (this *Server) startMetrics() {
+	this.metricsOnce.Do(func() {
+		go this.metricsLoop()
+	})
+}
+
+// metricsLoop refreshes the expensive metrics every MetricsInterval seconds until
+// the server quits.
+func (this *Server) metricsLoop() {
+	this.updateMetrics()
+
+	tick := time.NewTicker(time.Second * time.Duration(this.MetricsInterval))
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-this.quit:
+			return
+
+		case <-tick.C:
+			this.updateMetrics()
+		}
+	}
+}
+
+func (this *Server) updateMetrics() {
+	var used, size, queued int
+
+	for _, svc := range this.services() {
+		u, s := svc.buffered()
+		used += u
+		size += s
+
+		if svc.sess != nil {
+			queued += svc.sess.Offline.Len()
+		}
+	}
+
+	this.mmu.Lock()
+	defer this.mmu.Unlock()
+
+	this.metrics.TopicsUpdated = time.Now()
+	this.metrics.BufferUsed = used
+	this.metrics.BufferSize = size
+	this.metrics.Queued = queued
+
+	st, err := this.topicsMgr.Stats()
+	if err != nil {
+		this.log.Debugf("server/updateMetrics: %v", err)
+		return
+	}
+
+	this.metrics.TopicNodes = st.Nodes
+	this.metrics.Subscriptions = st.Subscriptions
+	this.metrics.RetainedMessages = st.Retained
+	this.metrics.RetainedBytes = st.RetainedBytes
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/topics"
+)
+
+func TestServerMetricsTopics(t *testing.T) {
+	topics.Unregister("mem")
+	topics.Register("mem", topics.NewMemProvider())
+
+	svr := &Server{}
+	require.NoError(t, svr.checkConfiguration())
+
+	svr.updateMetrics()
+	m := svr.Metrics()
+	require.Equal(t, 0, m.TopicNodes)
+	require.Equal(t, 0, m.Subscriptions)
+	require.False(t, m.TopicsUpdated.IsZero())
+
+	var onpub OnPublishFunc = func(msg *message.PublishMessage) error { return nil }
+
+	_, err := svr.topicsMgr.Subscribe([]byte("a/b/c"), 1, &onpub)
+	require.NoError(t, err)
+
+	_, err = svr.topicsMgr.Subscribe([]byte("a/b/d"), 1, &onpub)
+	require.NoError(t, err)
+
+	// Not refreshed yet, so the snapshot should still be the old one
+	require.Equal(t, 0, svr.Metrics().TopicNodes)
+
+	svr.updateMetrics()
+	m = svr.Metrics()
+	require.Equal(t, 4, m.TopicNodes)
+	require.Equal(t, 2, m.Subscriptions)
+
+	err = svr.topicsMgr.Unsubscribe([]byte("a/b/d"), &onpub)
+	require.NoError(t, err)
+
+	svr.updateMetrics()
+	m = svr.Metrics()
+	require.Equal(t, 3, m.TopicNodes)
+	require.Equal(t, 1, m.Subscriptions)
+}
+
+func TestServerMetricsCounters(t *testing.T) {
+	var wg sync.WaitGroup
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+
+	uri := "tcp://127.0.0.1:1883"
+	u, err := url.Parse(uri)
+	require.NoError(t, err, "Error parsing URL")
+
+	svr := &Server{
+		Authenticator: authenticator,
+	}
+
+	wg.Add(1)
+	go startServer(t, svr, u, &wg, ready1, ready2, 2)
+
+	<-ready1
+
+	sub := connectRaw(t, uri)
+	defer sub.Close()
+
+	require.NoError(t, writeMessage(sub, newSubscribeMessage(1)))
+	expectMessage(t, sub, message.SUBACK)
+
+	pub := connectRaw(t, uri)
+	defer pub.Close()
+
+	require.NoError(t, writeMessage(pub, newPublishMessage(1, 1)))
+	expectMessage(t, pub, message.PUBACK)
+
+	require.NoError(t, writeMessage(pub, newPublishMessage(0, 0)))
+
+	expectMessage(t, sub, message.PUBLISH)
+	expectMessage(t, sub, message.PUBLISH)
+
+	m := svr.Metrics()
+	require.Equal(t, int64(2), m.Connections)
+	require.Equal(t, int64(2), m.ConnectionsTotal)
+	require.Equal(t, [3]int64{1, 1, 0}, m.MessagesReceived)
+	require.Equal(t, [3]int64{1, 1, 0}, m.MessagesSent)
+	require.Equal(t, int64(0), m.MessagesDropped)
+	require.True(t, m.BytesReceived > 0)
+	require.True(t, m.BytesSent > 0)
+
+	svr.updateMetrics()
+	m = svr.Metrics()
+	require.Equal(t, 4*defaultBufferSize, m.BufferSize)
+
+	close(ready2)
+
+	wg.Wait()
+
+	m = svr.Metrics()
+	require.Equal(t, int64(0), m.Connections)
+	require.Equal(t, int64(2), m.ConnectionsTotal)
+}
+
+func TestServerMetricsAuthFailures(t *testing.T) {
+	var wg sync.WaitGroup
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+
+	uri := "tcp://127.0.0.1:1883"
+	u, err := url.Parse(uri)
+	require.NoError(t, err, "Error parsing URL")
+
+	svr := &Server{
+		Authenticator: "mockFailure",
+	}
+
+	wg.Add(1)
+	go startServer(t, svr, u, &wg, ready1, ready2, 1)
+
+	<-ready1
+
+	conn, err := net.Dial(u.Scheme, u.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, newConnectMessage()))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	resp, err := getConnackMessage(conn, 0)
+	require.NoError(t, err)
+	require.Equal(t, message.ErrBadUsernameOrPassword, resp.ReturnCode())
+
+	wg.Wait()
+
+	m := svr.Metrics()
+	require.Equal(t, int64(1), m.AuthFailures)
+	require.Equal(t, int64(0), m.ConnectionsTotal)
+}
+
+func TestServerMetricsHandler(t *testing.T) {
+	svr := &Server{}
+	svr.counters.connected()
+	svr.counters.receivedPublish(2)
+	svr.counters.droppedMessage()
+	svr.counters.slowConsumer()
+
+	w := httptest.NewRecorder()
+	svr.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	require.Equal(t, 200, w.Code)
+	require.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain"))
+
+	body := w.Body.String()
+	require.Contains(t, body, "# TYPE surgemq_connections gauge\nsurgemq_connections 1\n")
+	require.Contains(t, body, "surgemq_messages_received_total{qos=\"0\"} 0\n")
+	require.Contains(t, body, "surgemq_messages_received_total{qos=\"2\"} 1\n")
+	require.Contains(t, body, "surgemq_messages_dropped_total 1\n")
+	require.Contains(t, body, "surgemq_slow_consumers_total 1\n")
+
+	// A nil *counters, as on the client side, does nothing.
+	var c *counters
+	c.connected()
+	c.sentPublish(1)
+}
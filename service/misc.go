@@ -23,22 +23,37 @@ import (
 	"github.com/surgemq/message"
 )
 
-func getConnectMessage(conn io.Closer) (*message.ConnectMessage, error) {
-	buf, err := getMessageBuffer(conn)
+// getConnectMessage reads a CONNECT message from conn. If max is more than 0 then
+// messages bigger than max bytes are rejected with ErrPacketTooLarge. MQTT 5.0
+// CONNECT messages are returned in their MQTT 3.1.1 form, along with what else the
+// client asked for, which is nil for the other versions.
+func getConnectMessage(conn io.Closer, max int) (*message.ConnectMessage, *mqtt5, error) {
+	buf, err := readMessageBuffer(conn, max)
 	if err != nil {
 		//glog.Debugf("Receive error: %v", err)
-		return nil, err
+		return nil, nil, err
+	}
+
+	b, v5, err := fromConnect5(buf)
+	if err != nil {
+		return nil, v5, err
+	}
+
+	if v5 != nil {
+		buf = b
 	}
 
 	msg := message.NewConnectMessage()
 
 	_, err = msg.Decode(buf)
 	//glog.Debugf("Received: %s", msg)
-	return msg, err
+	return msg, v5, err
 }
 
-func getConnackMessage(conn io.Closer) (*message.ConnackMessage, error) {
-	buf, err := getMessageBuffer(conn)
+// getConnackMessage reads a CONNACK message from conn, with the same max as
+// getConnectMessage.
+func getConnackMessage(conn io.Closer, max int) (*message.ConnackMessage, error) {
+	buf, err := readMessageBuffer(conn, max)
 	if err != nil {
 		//glog.Debugf("Receive error: %v", err)
 		return nil, err
@@ -64,6 +79,13 @@ func writeMessage(conn io.Closer, msg message.Message) error {
 }
 
 func getMessageBuffer(c io.Closer) ([]byte, error) {
+	return readMessageBuffer(c, 0)
+}
+
+// readMessageBuffer reads a whole message from c. If max is more than 0 then a
+// message whose header says it's bigger than max bytes is rejected with
+// ErrPacketTooLarge before anything is allocated for the rest of it.
+func readMessageBuffer(c io.Closer, max int) ([]byte, error) {
 	if c == nil {
 		return nil, ErrInvalidConnectionType
 	}
@@ -82,6 +104,9 @@ func getMessageBuffer(c io.Closer) ([]byte, error) {
 
 		// total bytes read
 		l int = 0
+
+		// number of reads in a row that returned nothing
+		empty int = 0
 	)
 
 	// Let's read enough bytes to get the message header (msg type, remaining length)
@@ -99,9 +124,15 @@ func getMessageBuffer(c io.Closer) ([]byte, error) {
 
 		// Technically i don't think we will ever get here
 		if n == 0 {
+			empty++
+			if empty >= maxEmptyReads {
+				return nil, io.ErrNoProgress
+			}
 			continue
 		}
 
+		empty = 0
+
 		buf = append(buf, b...)
 		l += n
 
@@ -114,6 +145,10 @@ func getMessageBuffer(c io.Closer) ([]byte, error) {
 
 	// Get the remaining length of the message
 	remlen, _ := binary.Uvarint(buf[1:])
+	if max > 0 && int(remlen)+l > max {
+		return nil, ErrPacketTooLarge
+	}
+
 	buf = append(buf, make([]byte, remlen)...)
 
 	for l < len(buf) {
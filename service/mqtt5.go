@@ -0,0 +1,861 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/auth"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+// MQTT 5.0 clients are served on the same listeners as the MQTT 3.1.1 ones. The
+// packets they send are rewritten into their MQTT 3.1.1 form as they come in, and
+// the ones sent to them are rewritten into the MQTT 5.0 form as they go out, so the
+// rest of the server mostly deals with MQTT 3.1.1. What MQTT 3.1.1 has no room for
+// is kept on the side: the properties of the PUBLISH messages, which are passed on
+// to the subscribers that speak MQTT 5.0, the reason codes of the acks, and the
+// AUTH messages of enhanced authentication. The other properties the clients send
+// are dropped, other than the ones the server acts on in CONNECT: Session Expiry
+// Interval, Receive Maximum, and Authentication Method and Data.
+
+const (
+	// The protocol level of MQTT 5.0 in the CONNECT message
+	mqtt5Level = 5
+
+	// The MQTT 5.0 AUTH message, which MQTT 3.1.1 has as reserved
+	auth5 message.MessageType = 15
+)
+
+// The MQTT 5.0 properties the server reads or writes
+const (
+	propSubscriptionId          = 0x0b
+	propSessionExpiry           = 0x11
+	propAssignedClientId        = 0x12
+	propServerKeepAlive         = 0x13
+	propAuthMethod              = 0x15
+	propAuthData                = 0x16
+	propReceiveMaximum          = 0x21
+	propTopicAlias              = 0x23
+	propMaximumPacketSize       = 0x27
+	propSubscriptionIdAvailable = 0x29
+)
+
+// The MQTT 5.0 reason codes the server sends, other than the ones converted from
+// the MQTT 3.1.1 CONNACK return codes.
+const (
+	reasonDisconnectWithWill  = 0x04
+	reasonNoSubscribers       = 0x10
+	reasonContinueAuth        = 0x18
+	reasonReauthenticate      = 0x19
+	reasonProtocolError       = 0x82
+	reasonImplementationError = 0x83
+	reasonNotAuthorized       = 0x87
+	reasonBadAuthMethod       = 0x8c
+	reasonPacketIdNotFound    = 0x92
+	reasonBadPayloadFormat    = 0x99
+)
+
+// The kinds of values of the MQTT 5.0 properties, other than the fixed size ones,
+// whose kind is their size.
+const (
+	propVarint = -1
+	propString = -2
+	propPair   = -3
+)
+
+// props5 is the kind of value of each MQTT 5.0 property, by identifier.
+var props5 = map[byte]int{
+	0x01: 1, 0x02: 4, 0x03: propString, 0x08: propString, 0x09: propString,
+	0x0b: propVarint, 0x11: 4, 0x12: propString, 0x13: 2, 0x15: propString,
+	0x16: propString, 0x17: 1, 0x18: 4, 0x19: 1, 0x1a: propString, 0x1c: propString,
+	0x1f: propString, 0x21: 2, 0x22: 2, 0x23: 2, 0x24: 1, 0x25: 1, 0x26: propPair,
+	0x27: 4, 0x28: 1, 0x29: 1, 0x2a: 1,
+}
+
+var (
+	// errMalformed5 is returned for MQTT 5.0 messages that can't be rewritten, since
+	// they don't parse.
+	errMalformed5 = errors.New("mqtt5: Malformed packet")
+
+	// errAuth5 is returned for MQTT 5.0 AUTH messages, which have no MQTT 3.1.1 form,
+	// once what's in them is kept. See reauthenticate().
+	errAuth5 = errors.New("mqtt5: Authentication exchange")
+
+	// errDisconnectWithWill is returned for MQTT 5.0 DISCONNECT messages asking for
+	// the will to be published, which stops the service without clearing the will.
+	errDisconnectWithWill = errors.New("mqtt5: Disconnect with will message")
+)
+
+// mqtt5 is what's kept for a client that connected with MQTT 5.0.
+type mqtt5 struct {
+	// What the client asked for in its CONNECT message. A 0 receiveMaximum means
+	// the client didn't say.
+	cleanStart     bool
+	sessionExpiry  uint32
+	receiveMaximum uint16
+
+	// The number of topic filters in each UNSUBSCRIBE message, by packet ID, until
+	// the UNSUBACK goes out with a reason code for each.
+	unsubs map[uint16]int
+	umu    sync.Mutex
+
+	// The reason codes of the PUBACK, PUBREC, PUBREL and PUBCOMP messages on their way
+	// out that don't say Success, by type and packet ID. Protected by umu.
+	reasons map[ack5]byte
+
+	// The Authentication Method the client connected with, if any, and the manager
+	// that authenticated it. The reason code and the Authentication Data of the AUTH
+	// message last received, and the exchange re-authenticating the client, if one
+	// is under way, are only used by the processor.
+	authMethod []byte
+	authMgr    *auth.Manager
+	authReason byte
+	authData   []byte
+	exchange   auth.AuthExchange
+
+	// The properties of the PUBLISH message last rewritten, and the ones of the QoS 2
+	// messages waiting for PUBREL, by packet ID. Only used by the processor.
+	props  []byte
+	props2 map[uint16][]byte
+
+	// The incoming message last rewritten, which the decoded message refers to until
+	// the next one.
+	in []byte
+}
+
+// ack5 is the type and packet ID of an ack.
+type ack5 struct {
+	mtype message.MessageType
+	pktid uint16
+}
+
+// msgProps5 keeps the properties of the PUBLISH messages from MQTT 5.0 clients, by
+// message, as they are handed to the subscribers, so the subscribers that speak MQTT
+// 5.0 get them too. The copies made for the subscribers are added as they are sent.
+// Messages that are sent later, i.e., queued offline or for room in the inflight
+// window, or retained, or rewritten by TransformOutbound, go out without them.
+type msgProps5 struct {
+	props map[*message.PublishMessage][]byte
+	n     int32
+	mu    sync.RWMutex
+}
+
+// fromConnect5 rewrites the MQTT 5.0 CONNECT message in b into MQTT 3.1.1. It
+// returns nil for anything else. The clean session flag of the rewritten message
+// says whether the session ends with the connection, which is when the client asks
+// for a Session Expiry Interval of 0, or doesn't send a client ID.
+func fromConnect5(b []byte) ([]byte, *mqtt5, error) {
+	body, err := body5(b)
+	if err != nil || len(body) < 10 || string(body[:6]) != "\x00\x04MQTT" || body[6] != mqtt5Level {
+		return nil, nil, err
+	}
+
+	v5 := &mqtt5{
+		cleanStart: body[7]&0x02 != 0,
+		unsubs:     make(map[uint16]int),
+		reasons:    make(map[ack5]byte),
+		props2:     make(map[uint16][]byte),
+	}
+
+	props, rest, err := section5(body[10:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = walkProps5(props, func(id byte, v []byte) error {
+		switch id {
+		case propSessionExpiry:
+			v5.sessionExpiry = binary.BigEndian.Uint32(v)
+
+		case propReceiveMaximum:
+			if v5.receiveMaximum = binary.BigEndian.Uint16(v); v5.receiveMaximum == 0 {
+				return errMalformed5
+			}
+
+		case propAuthMethod:
+			v5.authMethod = append([]byte(nil), v[2:]...)
+
+		case propAuthData:
+			v5.authData = append([]byte(nil), v[2:]...)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, v5, err
+	}
+
+	// The client ID is the first thing in the payload, and the will properties come
+	// right after it if there's a will.
+	cid, rest, err := string5(rest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	flags := body[7] &^ 0x02
+	if v5.sessionExpiry == 0 || len(cid) == 2 {
+		flags |= 0x02
+	}
+
+	if flags&0x04 != 0 {
+		if _, rest, err = section5(rest); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return packet5(nil, b[0], body[:6], []byte{4, flags}, body[8:10], cid, rest), v5, nil
+}
+
+// from rewrites the MQTT 5.0 message of type mtype in b into MQTT 3.1.1. The result
+// is only good until the next message.
+func (this *mqtt5) from(mtype message.MessageType, b []byte) ([]byte, error) {
+	body, err := body5(b)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mtype {
+	case message.PUBLISH:
+		topic, rest, err := string5(body)
+		if err != nil {
+			return nil, err
+		}
+
+		var pktid []byte
+
+		if b[0]&0x06 != 0 {
+			if len(rest) < 2 {
+				return nil, errMalformed5
+			}
+
+			pktid, rest = rest[:2], rest[2:]
+		}
+
+		props, payload, err := section5(rest)
+		if err != nil {
+			return nil, err
+		}
+
+		// Topic aliases are never allowed, since the CONNACK doesn't say any are, and
+		// subscription identifiers are for the server to send.
+		err = walkProps5(props, func(id byte, v []byte) error {
+			switch id {
+			case propTopicAlias:
+				return fmt.Errorf("mqtt5: Topic alias not allowed")
+
+			case propSubscriptionId:
+				return fmt.Errorf("mqtt5: Subscription identifier not allowed in PUBLISH")
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// The properties of QoS 2 messages are kept until the PUBREL, along with the
+		// message, and the others until the next message.
+		this.props = append(this.props[:0], props...)
+
+		if b[0]&0x06 == 0x04 {
+			if len(props) > 0 {
+				this.props2[binary.BigEndian.Uint16(pktid)] = append([]byte(nil), props...)
+			} else {
+				delete(this.props2, binary.BigEndian.Uint16(pktid))
+			}
+		}
+
+		this.in = packet5(this.in[:0], b[0], topic, pktid, payload)
+
+	case message.PUBACK, message.PUBREC, message.PUBREL, message.PUBCOMP:
+		if len(body) < 2 {
+			return nil, errMalformed5
+		}
+
+		// A PUBREC with an error reason code ends the exchange, as the PUBCOMP would.
+		first := b[0]
+		if mtype == message.PUBREC && len(body) > 2 && body[2] >= 0x80 {
+			first = byte(message.PUBCOMP)<<4 | message.PUBCOMP.DefaultFlags()
+		}
+
+		this.in = packet5(this.in[:0], first, body[:2])
+
+	case message.SUBSCRIBE:
+		if len(body) < 2 {
+			return nil, errMalformed5
+		}
+
+		_, rest, err := section5(body[2:])
+		if err != nil {
+			return nil, err
+		}
+
+		// Only the QoS is kept from the subscription options. No Local, Retain As
+		// Published and Retain Handling are ignored.
+		for filters := rest; len(filters) > 0; filters = filters[1:] {
+			if _, filters, err = string5(filters); err != nil || len(filters) == 0 {
+				return nil, errMalformed5
+			}
+
+			filters[0] &= 0x03
+		}
+
+		this.in = packet5(this.in[:0], b[0], body[:2], rest)
+
+	case message.UNSUBSCRIBE:
+		if len(body) < 2 {
+			return nil, errMalformed5
+		}
+
+		_, rest, err := section5(body[2:])
+		if err != nil {
+			return nil, err
+		}
+
+		n := 0
+		for filters := rest; len(filters) > 0; n++ {
+			if _, filters, err = string5(filters); err != nil {
+				return nil, err
+			}
+		}
+
+		this.umu.Lock()
+		this.unsubs[binary.BigEndian.Uint16(body)] = n
+		this.umu.Unlock()
+
+		this.in = packet5(this.in[:0], b[0], body[:2], rest)
+
+	case message.DISCONNECT:
+		if len(body) > 0 && body[0] == reasonDisconnectWithWill {
+			return nil, errDisconnectWithWill
+		}
+
+		this.in = packet5(this.in[:0], b[0])
+
+	case auth5:
+		// No reason code means Success, and only the Authentication Method and Data
+		// properties are allowed.
+		this.authReason, this.authData = 0, this.authData[:0]
+
+		var method []byte
+
+		if len(body) > 0 {
+			this.authReason = body[0]
+		}
+
+		if len(body) > 1 {
+			props, _, err := section5(body[1:])
+			if err != nil {
+				return nil, err
+			}
+
+			err = walkProps5(props, func(id byte, v []byte) error {
+				switch id {
+				case propAuthMethod:
+					method = v[2:]
+
+				case propAuthData:
+					this.authData = append(this.authData, v[2:]...)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if this.authMethod == nil || string(method) != string(this.authMethod) {
+			return nil, fmt.Errorf("mqtt5: AUTH with the wrong Authentication Method %q", method)
+		}
+
+		return nil, errAuth5
+
+	default:
+		return b, nil
+	}
+
+	return this.in, nil
+}
+
+// to appends the MQTT 3.1.1 message in b to dst, rewritten into MQTT 5.0, with props
+// if it's a PUBLISH message. The acks say the reason codes set for them, and the
+// UNSUBACK says Success for each topic filter.
+func (this *mqtt5) to(dst, b, props []byte) []byte {
+	body, err := body5(b)
+	if err != nil {
+		return append(dst, b...)
+	}
+
+	switch mtype := message.MessageType(b[0] >> 4); mtype {
+	case message.PUBLISH:
+		i := 2 + int(binary.BigEndian.Uint16(body))
+		if b[0]&0x06 != 0 {
+			i += 2
+		}
+
+		return packet5(dst, b[0], body[:i], varint5(nil, len(props)), props, body[i:])
+
+	case message.PUBACK, message.PUBREC, message.PUBREL, message.PUBCOMP:
+		key := ack5{mtype, binary.BigEndian.Uint16(body)}
+
+		this.umu.Lock()
+		reason, ok := this.reasons[key]
+		delete(this.reasons, key)
+		this.umu.Unlock()
+
+		if ok {
+			return packet5(dst, b[0], body[:2], []byte{reason})
+		}
+
+	case message.SUBACK:
+		return packet5(dst, b[0], body[:2], []byte{0}, body[2:])
+
+	case message.UNSUBACK:
+		this.umu.Lock()
+		n, ok := this.unsubs[binary.BigEndian.Uint16(body)]
+		delete(this.unsubs, binary.BigEndian.Uint16(body))
+		this.umu.Unlock()
+
+		if !ok {
+			n = 1
+		}
+
+		return packet5(dst, b[0], body[:2], make([]byte, n+1))
+	}
+
+	return append(dst, b...)
+}
+
+// reason has the ack of type mtype for pktid say reason instead of Success, once
+// it's sent.
+func (this *mqtt5) reason(mtype message.MessageType, pktid uint16, reason byte) {
+	this.umu.Lock()
+	this.reasons[ack5{mtype, pktid}] = reason
+	this.umu.Unlock()
+}
+
+// takeProps2 returns the properties of the QoS 2 message with pktid, which are no
+// longer kept after that.
+func (this *mqtt5) takeProps2(pktid uint16) []byte {
+	props := this.props2[pktid]
+	delete(this.props2, pktid)
+
+	return props
+}
+
+// auth returns the AUTH message with reason, and data if it's not nil.
+func (this *mqtt5) auth(reason byte, data []byte) []byte {
+	props := appendString5([]byte{propAuthMethod}, this.authMethod)
+	if data != nil {
+		props = appendString5(append(props, propAuthData), data)
+	}
+
+	return packet5(nil, byte(auth5)<<4, []byte{reason}, varint5(nil, len(props)), props)
+}
+
+// timeouts applies what the client asked for to t: a Session Expiry Interval
+// shorter than the server's, and a Receive Maximum lower than the server's
+// MaxInflight.
+func (this *mqtt5) timeouts(t *ClientTimeouts) {
+	if this.sessionExpiry > 0 && this.sessionExpiry != 0xffffffff && (t.SessionExpiry <= 0 || int64(this.sessionExpiry) < int64(t.SessionExpiry)) {
+		t.SessionExpiry = int(this.sessionExpiry)
+	}
+
+	if this.receiveMaximum > 0 && (t.MaxInflight <= 0 || int(this.receiveMaximum) < t.MaxInflight) {
+		t.MaxInflight = int(this.receiveMaximum)
+	}
+}
+
+// connackProps returns the properties of the CONNACK for the client of svc: where
+// the server went with something other than what the client asked for in req, what
+// it doesn't support, and the last of authData if the client authenticated with an
+// Authentication Method.
+func (this *mqtt5) connackProps(svc *service, req *message.ConnectMessage, assigned bool, authData []byte) []byte {
+	var props []byte
+
+	if this.authMethod != nil {
+		props = appendString5(append(props, propAuthMethod), this.authMethod)
+
+		if authData != nil {
+			props = appendString5(append(props, propAuthData), authData)
+		}
+	}
+
+	if assigned {
+		props = append(props, propAssignedClientId)
+		props = appendString5(props, req.ClientId())
+	}
+
+	if svc.keepAlive != int(req.KeepAlive()) {
+		props = append(props, propServerKeepAlive, byte(svc.keepAlive>>8), byte(svc.keepAlive))
+	}
+
+	// The session is kept until the client comes back if there's no expiry
+	var expiry uint32
+	if !req.CleanSession() {
+		if expiry = uint32(svc.sessionExpiry); svc.sessionExpiry <= 0 {
+			expiry = 0xffffffff
+		}
+	}
+
+	if expiry != this.sessionExpiry {
+		props = append(props, propSessionExpiry, byte(expiry>>24), byte(expiry>>16), byte(expiry>>8), byte(expiry))
+	}
+
+	if svc.receiveMaximum > 0 && svc.receiveMaximum < 0xffff {
+		props = append(props, propReceiveMaximum, byte(svc.receiveMaximum>>8), byte(svc.receiveMaximum))
+	}
+
+	if svc.maxPacketSize > 0 {
+		max := uint32(svc.maxPacketSize)
+		props = append(props, propMaximumPacketSize, byte(max>>24), byte(max>>16), byte(max>>8), byte(max))
+	}
+
+	return append(props, propSubscriptionIdAvailable, 0)
+}
+
+// authenticate5 authenticates the client of req with the Authentication Method it
+// connected with, sending what the authenticator has for it in AUTH messages on conn,
+// and reading the ones it sends back, until the authenticator is done. It returns the
+// Authentication Data for the CONNACK, if any. The whole exchange has to fit in the
+// time the client has to connect.
+func (this *Server) authenticate5(authMgr *auth.Manager, conn net.Conn, req *message.ConnectMessage, v5 *mqtt5, max int) ([]byte, error) {
+	x, err := authMgr.StartAuth(string(req.Username()), string(v5.authMethod))
+	if err != nil {
+		return nil, err
+	}
+
+	data := v5.authData
+
+	for {
+		resp, done, err := x.Next(data)
+		if err != nil || done {
+			return resp, err
+		}
+
+		if err = writeMessageBuffer(conn, v5.auth(reasonContinueAuth, resp)); err != nil {
+			return nil, err
+		}
+
+		b, err := readMessageBuffer(conn, max)
+		if err != nil {
+			return nil, err
+		}
+
+		if mtype := message.MessageType(b[0] >> 4); mtype != auth5 {
+			return nil, fmt.Errorf("mqtt5: Expecting AUTH, got %s", mtype)
+		}
+
+		if _, err = v5.from(auth5, b); err != errAuth5 {
+			return nil, err
+		}
+
+		if v5.authReason != reasonContinueAuth {
+			return nil, fmt.Errorf("mqtt5: Unexpected AUTH with reason code %#x", v5.authReason)
+		}
+
+		data = v5.authData
+	}
+}
+
+// reauthenticate goes on with the re-authentication of the client with the AUTH
+// message it just sent, which starts a new one if it says Re-authenticate. The client
+// is disconnected if it fails, and keeps its session and subscriptions otherwise.
+func (this *service) reauthenticate() error {
+	v5 := this.v5
+
+	switch {
+	case v5.authReason == reasonReauthenticate:
+		x, err := v5.authMgr.StartAuth(this.username, string(v5.authMethod))
+		if err != nil {
+			return this.disconnect5(reasonNotAuthorized, err)
+		}
+
+		v5.exchange = x
+
+	case v5.authReason != reasonContinueAuth || v5.exchange == nil:
+		return this.disconnect5(reasonProtocolError, fmt.Errorf("mqtt5: Unexpected AUTH with reason code %#x", v5.authReason))
+	}
+
+	resp, done, err := v5.exchange.Next(v5.authData)
+	if err != nil {
+		v5.exchange = nil
+		this.counters.authFailed()
+		return this.disconnect5(reasonNotAuthorized, err)
+	}
+
+	reason := byte(reasonContinueAuth)
+	if done {
+		reason, v5.exchange = 0, nil
+	}
+
+	return this.writeBytes(v5.auth(reason, resp))
+}
+
+// disconnect5 sends the DISCONNECT message with reason to the client, and returns err.
+func (this *service) disconnect5(reason byte, err error) error {
+	this.writeBytes(packet5(nil, byte(message.DISCONNECT)<<4, []byte{reason}))
+	return err
+}
+
+// nak5 has the PUBACK of msg, a QoS 1 message from the client, say reason, if the
+// client speaks MQTT 5.0.
+func (this *service) nak5(msg *message.PublishMessage, reason byte) {
+	if this.v5 != nil && msg.QoS() == message.QosAtLeastOnce {
+		this.v5.reason(message.PUBACK, msg.PacketId(), reason)
+	}
+}
+
+// notFound5 has the ack of type mtype for pktid say Packet Identifier not found if
+// ackq has no message waiting for it, and the client speaks MQTT 5.0.
+func (this *service) notFound5(mtype message.MessageType, ackq *sessions.Ackqueue, pktid uint16) {
+	if this.v5 != nil && !ackq.Has(pktid) {
+		this.v5.reason(mtype, pktid, reasonPacketIdNotFound)
+	}
+}
+
+// refuse5 returns the reason code for the PUBREC of msg, a QoS 2 message from the
+// client, if it won't be published, or 0 if it might be, or the client doesn't speak
+// MQTT 5.0. The message isn't kept if it won't be, since the client doesn't send the
+// PUBREL for it then.
+func (this *service) refuse5(msg *message.PublishMessage) byte {
+	if this.v5 == nil {
+		return 0
+	}
+
+	if !this.authorize(msg.Topic(), auth.Write) {
+		return reasonNotAuthorized
+	}
+
+	if ok, _ := this.payloads.check(msg); !ok {
+		return reasonBadPayloadFormat
+	}
+
+	return 0
+}
+
+// add keeps props for msg until del(msg). It does nothing if there are no props.
+func (this *msgProps5) add(msg *message.PublishMessage, props []byte) {
+	if this == nil || len(props) == 0 {
+		return
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.props == nil {
+		this.props = make(map[*message.PublishMessage][]byte)
+	}
+
+	this.props[msg] = props
+	atomic.StoreInt32(&this.n, int32(len(this.props)))
+}
+
+// alias has msg, a copy of orig, go with the properties of orig too, until del(msg).
+func (this *msgProps5) alias(msg, orig *message.PublishMessage) {
+	this.add(msg, this.get(orig))
+}
+
+// del stops keeping the properties of msg.
+func (this *msgProps5) del(msg *message.PublishMessage) {
+	if this == nil || atomic.LoadInt32(&this.n) == 0 {
+		return
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	delete(this.props, msg)
+	atomic.StoreInt32(&this.n, int32(len(this.props)))
+}
+
+// get returns the properties of msg, if any.
+func (this *msgProps5) get(msg *message.PublishMessage) []byte {
+	if this == nil || atomic.LoadInt32(&this.n) == 0 {
+		return nil
+	}
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return this.props[msg]
+}
+
+// connack5 returns the MQTT 5.0 CONNACK message for resp, with props.
+func connack5(resp *message.ConnackMessage, props []byte) []byte {
+	var flags byte
+	if resp.SessionPresent() {
+		flags = 1
+	}
+
+	return packet5(nil, byte(message.CONNACK)<<4, []byte{flags, reason5(resp.ReturnCode())}, varint5(nil, len(props)), props)
+}
+
+// reason5 converts a MQTT 3.1.1 CONNACK return code into the MQTT 5.0 reason code.
+func reason5(code message.ConnackCode) byte {
+	switch code {
+	case message.ConnectionAccepted:
+		return 0x00
+	case message.ErrInvalidProtocolVersion:
+		return 0x84
+	case message.ErrIdentifierRejected:
+		return 0x85
+	case message.ErrServerUnavailable:
+		return 0x88
+	case message.ErrBadUsernameOrPassword:
+		return 0x86
+	case message.ErrNotAuthorized:
+		return 0x87
+	}
+
+	return 0x80
+}
+
+// writeConnack writes resp to conn, in the MQTT 5.0 form with props if v5 isn't nil.
+func writeConnack(conn io.Closer, resp *message.ConnackMessage, v5 *mqtt5, props []byte) error {
+	if v5 == nil {
+		return writeMessage(conn, resp)
+	}
+
+	return writeMessageBuffer(conn, connack5(resp, props))
+}
+
+// body5 returns what follows the fixed header of the message in b.
+func body5(b []byte) ([]byte, error) {
+	if len(b) < 2 {
+		return nil, errMalformed5
+	}
+
+	l, n := binary.Uvarint(b[1:])
+	if n <= 0 || n > 4 || int(l) != len(b)-1-n {
+		return nil, errMalformed5
+	}
+
+	return b[1+n:], nil
+}
+
+// section5 splits b into the properties at the start of it, and the rest.
+func section5(b []byte) ([]byte, []byte, error) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || n > 4 || uint64(len(b)-n) < l {
+		return nil, nil, errMalformed5
+	}
+
+	return b[n : n+int(l)], b[n+int(l):], nil
+}
+
+// string5 splits b into the length prefixed string at the start of it, prefix
+// included, and the rest.
+func string5(b []byte) ([]byte, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, errMalformed5
+	}
+
+	n := 2 + int(binary.BigEndian.Uint16(b))
+	if len(b) < n {
+		return nil, nil, errMalformed5
+	}
+
+	return b[:n], b[n:], nil
+}
+
+// walkProps5 calls f with the identifier and the value of each of the properties
+// in b, until f returns an error.
+func walkProps5(b []byte, f func(id byte, v []byte) error) error {
+	for len(b) > 0 {
+		kind, ok := props5[b[0]]
+		if !ok {
+			return errMalformed5
+		}
+
+		id, v := b[0], b[1:]
+
+		var (
+			n   int
+			err error
+		)
+
+		switch kind {
+		case propVarint:
+			if _, n = binary.Uvarint(v); n <= 0 || n > 4 {
+				return errMalformed5
+			}
+
+		case propString:
+			var s []byte
+			s, _, err = string5(v)
+			n = len(s)
+
+		case propPair:
+			var k, s []byte
+			if k, _, err = string5(v); err == nil {
+				s, _, err = string5(v[len(k):])
+			}
+			n = len(k) + len(s)
+
+		default:
+			n = kind
+		}
+
+		if err != nil || len(v) < n {
+			return errMalformed5
+		}
+
+		if err := f(id, v[:n]); err != nil {
+			return err
+		}
+
+		b = v[n:]
+	}
+
+	return nil
+}
+
+// packet5 appends a message to dst, with the first byte of the fixed header and the
+// parts that follow it.
+func packet5(dst []byte, first byte, parts ...[]byte) []byte {
+	l := 0
+	for _, p := range parts {
+		l += len(p)
+	}
+
+	dst = append(dst, first)
+	dst = varint5(dst, l)
+
+	for _, p := range parts {
+		dst = append(dst, p...)
+	}
+
+	return dst
+}
+
+// varint5 appends n to dst as a variable byte integer.
+func varint5(dst []byte, n int) []byte {
+	var b [binary.MaxVarintLen32]byte
+	return append(dst, b[:binary.PutUvarint(b[:], uint64(n))]...)
+}
+
+// appendString5 appends s to dst as a length prefixed string.
+func appendString5(dst, s []byte) []byte {
+	dst = append(dst, byte(len(s)>>8), byte(len(s)))
+	return append(dst, s...)
+}
@@ -0,0 +1,473 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/auth"
+)
+
+func TestFromConnect5(t *testing.T) {
+	// Clean start, will, username, 30 secs keep alive, Session Expiry Interval 300,
+	// Receive Maximum 10, client ID "v5", will with a Will Delay Interval.
+	b := packet5(nil, byte(message.CONNECT)<<4,
+		[]byte{0, 4, 'M', 'Q', 'T', 'T', 5, 0x80 | 0x04 | 0x02, 0, 30},
+		[]byte{8, propSessionExpiry, 0, 0, 1, 44, propReceiveMaximum, 0, 10},
+		[]byte{0, 2, 'v', '5'},
+		[]byte{5, 0x18, 0, 0, 0, 5},
+		[]byte{0, 4, 'w', 'i', 'l', 'l'},
+		[]byte{0, 4, 'g', 'o', 'n', 'e'},
+		[]byte{0, 4, 'u', 's', 'e', 'r'},
+	)
+
+	b, v5, err := fromConnect5(b)
+	require.NoError(t, err)
+	require.NotNil(t, v5)
+	require.True(t, v5.cleanStart)
+	require.Equal(t, uint32(300), v5.sessionExpiry)
+	require.Equal(t, uint16(10), v5.receiveMaximum)
+
+	msg := message.NewConnectMessage()
+	_, err = msg.Decode(b)
+	require.NoError(t, err)
+	require.Equal(t, byte(4), msg.Version())
+	require.False(t, msg.CleanSession(), "The session is kept for a while")
+	require.Equal(t, uint16(30), msg.KeepAlive())
+	require.Equal(t, "v5", string(msg.ClientId()))
+	require.Equal(t, "will", string(msg.WillTopic()))
+	require.Equal(t, "gone", string(msg.WillMessage()))
+	require.Equal(t, "user", string(msg.Username()))
+
+	// Not MQTT 5.0
+	b, v5, err = fromConnect5(newConnectMessageBytes(t))
+	require.NoError(t, err)
+	require.Nil(t, v5)
+	require.Nil(t, b)
+
+	// Enhanced authentication
+	b = packet5(nil, byte(message.CONNECT)<<4,
+		[]byte{0, 4, 'M', 'Q', 'T', 'T', 5, 0x02, 0, 30},
+		[]byte{12, propAuthMethod, 0, 4, 'S', 'C', 'R', 'A', propAuthData, 0, 2, 'h', 'i'},
+		[]byte{0, 2, 'v', '5'},
+	)
+
+	_, v5, err = fromConnect5(b)
+	require.NoError(t, err)
+	require.Equal(t, "SCRA", string(v5.authMethod))
+	require.Equal(t, "hi", string(v5.authData))
+}
+
+func TestMQTT5Rewrite(t *testing.T) {
+	v5 := &mqtt5{
+		unsubs:     make(map[uint16]int),
+		reasons:    make(map[ack5]byte),
+		props2:     make(map[uint16][]byte),
+		authMethod: []byte("ECHO"),
+	}
+
+	// PUBLISH, QoS 1, with a Message Expiry Interval, which is kept
+	b, err := v5.from(message.PUBLISH, packet5(nil, byte(message.PUBLISH)<<4|0x02,
+		[]byte{0, 3, 'a', '/', 'b', 0, 7},
+		[]byte{5, 0x02, 0, 0, 0, 60},
+		[]byte("hello"),
+	))
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x02, 0, 0, 0, 60}, v5.props)
+
+	pub := message.NewPublishMessage()
+	_, err = pub.Decode(b)
+	require.NoError(t, err)
+	require.Equal(t, "a/b", string(pub.Topic()))
+	require.Equal(t, uint16(7), pub.PacketId())
+	require.Equal(t, "hello", string(pub.Payload()))
+
+	// PUBLISH, QoS 2, with a user property, which is kept until the PUBREL
+	_, err = v5.from(message.PUBLISH, packet5(nil, byte(message.PUBLISH)<<4|0x04,
+		[]byte{0, 3, 'a', '/', 'b', 0, 8},
+		[]byte{7, 0x26, 0, 1, 'k', 0, 1, 'v'},
+		[]byte("hello"),
+	))
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x26, 0, 1, 'k', 0, 1, 'v'}, v5.takeProps2(8))
+	require.Nil(t, v5.takeProps2(8))
+
+	// Topic aliases and subscription identifiers aren't allowed
+	_, err = v5.from(message.PUBLISH, packet5(nil, byte(message.PUBLISH)<<4,
+		[]byte{0, 3, 'a', '/', 'b'},
+		[]byte{3, propTopicAlias, 0, 1},
+	))
+	require.Error(t, err)
+
+	_, err = v5.from(message.PUBLISH, packet5(nil, byte(message.PUBLISH)<<4,
+		[]byte{0, 3, 'a', '/', 'b'},
+		[]byte{2, propSubscriptionId, 1},
+	))
+	require.Error(t, err)
+
+	// SUBSCRIBE with No Local and Retain As Published
+	b, err = v5.from(message.SUBSCRIBE, packet5(nil, byte(message.SUBSCRIBE)<<4|0x02,
+		[]byte{0, 8, 0},
+		[]byte{0, 3, 'a', '/', 'b', 0x0c | 0x01},
+	))
+	require.NoError(t, err)
+
+	sub := message.NewSubscribeMessage()
+	_, err = sub.Decode(b)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("a/b")}, sub.Topics())
+	require.Equal(t, []byte{1}, sub.Qos())
+
+	// PUBREC with an error ends the exchange
+	b, err = v5.from(message.PUBREC, []byte{byte(message.PUBREC) << 4, 4, 0, 7, 0x80, 0})
+	require.NoError(t, err)
+	require.Equal(t, []byte{byte(message.PUBCOMP) << 4, 2, 0, 7}, b)
+
+	// UNSUBSCRIBE of two filters gets an UNSUBACK with two reason codes
+	_, err = v5.from(message.UNSUBSCRIBE, packet5(nil, byte(message.UNSUBSCRIBE)<<4|0x02,
+		[]byte{0, 9, 0},
+		[]byte{0, 3, 'a', '/', 'b'},
+		[]byte{0, 1, 'c'},
+	))
+	require.NoError(t, err)
+	require.Equal(t, []byte{byte(message.UNSUBACK) << 4, 5, 0, 9, 0, 0, 0},
+		v5.to(nil, []byte{byte(message.UNSUBACK) << 4, 2, 0, 9}, nil))
+
+	// DISCONNECT with will
+	_, err = v5.from(message.DISCONNECT, []byte{byte(message.DISCONNECT) << 4, 1, reasonDisconnectWithWill})
+	require.Equal(t, errDisconnectWithWill, err)
+
+	// AUTH, with the Authentication Method the client connected with only
+	_, err = v5.from(auth5, packet5(nil, byte(auth5)<<4,
+		[]byte{reasonContinueAuth, 12, propAuthMethod, 0, 4, 'E', 'C', 'H', 'O', propAuthData, 0, 2, 'h', 'i'},
+	))
+	require.Equal(t, errAuth5, err)
+	require.Equal(t, byte(reasonContinueAuth), v5.authReason)
+	require.Equal(t, "hi", string(v5.authData))
+
+	_, err = v5.from(auth5, packet5(nil, byte(auth5)<<4,
+		[]byte{reasonReauthenticate, 7, propAuthMethod, 0, 4, 'S', 'C', 'R', 'A'},
+	))
+	require.Error(t, err)
+	require.NotEqual(t, errAuth5, err)
+
+	// The outgoing PUBLISH gets the properties, if any, and the SUBACK empty ones
+	require.Equal(t, []byte{byte(message.PUBLISH)<<4 | 0x02, 8, 0, 1, 'a', 0, 3, 0, 'h', 'i'},
+		v5.to(nil, []byte{byte(message.PUBLISH)<<4 | 0x02, 7, 0, 1, 'a', 0, 3, 'h', 'i'}, nil))
+
+	require.Equal(t, []byte{byte(message.PUBLISH) << 4, 9, 0, 1, 'a', 3, 0x01, 0x01, 0x01, 'h', 'i'},
+		v5.to(nil, []byte{byte(message.PUBLISH) << 4, 5, 0, 1, 'a', 'h', 'i'}, []byte{0x01, 0x01, 0x01}))
+
+	require.Equal(t, []byte{byte(message.SUBACK) << 4, 4, 0, 8, 0, 1},
+		v5.to(nil, []byte{byte(message.SUBACK) << 4, 3, 0, 8, 1}, nil))
+
+	// The acks say the reason code set for them, once
+	v5.reason(message.PUBACK, 7, reasonNoSubscribers)
+
+	require.Equal(t, []byte{byte(message.PUBACK) << 4, 3, 0, 7, reasonNoSubscribers},
+		v5.to(nil, []byte{byte(message.PUBACK) << 4, 2, 0, 7}, nil))
+
+	require.Equal(t, []byte{byte(message.PUBACK) << 4, 2, 0, 7},
+		v5.to(nil, []byte{byte(message.PUBACK) << 4, 2, 0, 7}, nil))
+}
+
+// MQTT 5.0 and 3.1.1 clients share the server.
+func TestServiceMQTT5(t *testing.T) {
+	svr, done := startNamedServer(t, "mqtt5", "tcp://127.0.0.1:1883", &Server{})
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", "127.0.0.1:1883"); err == nil {
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// No client ID, so the server assigns one
+	require.NoError(t, writeMessageBuffer(conn, packet5(nil, byte(message.CONNECT)<<4,
+		[]byte{0, 4, 'M', 'Q', 'T', 'T', 5, 0x02, 0, 30, 0},
+		[]byte{0, 0},
+	)))
+
+	connack := expectBuffer5(t, conn, message.CONNACK)
+	require.Equal(t, byte(0), connack[1], "Expecting Success")
+
+	props, _, err := section5(connack[2:])
+	require.NoError(t, err)
+
+	var cid string
+
+	require.NoError(t, walkProps5(props, func(id byte, v []byte) error {
+		if id == propAssignedClientId {
+			cid = string(v[2:])
+		}
+		return nil
+	}))
+
+	require.True(t, strings.HasPrefix(cid, "internalclient"), "Expecting an assigned client ID, got %q", cid)
+
+	require.NoError(t, writeMessageBuffer(conn, packet5(nil, byte(message.SUBSCRIBE)<<4|0x02,
+		[]byte{0, 1, 0},
+		[]byte{0, 3, 'a', 'b', 'c', 0x01},
+	)))
+
+	require.Equal(t, []byte{0, 1, 0, 1}, expectBuffer5(t, conn, message.SUBACK))
+
+	waitForSubscriber(t, svr, "abc")
+
+	pubconn := connectRaw(t, "tcp://127.0.0.1:1883")
+	defer pubconn.Close()
+
+	require.NoError(t, writeMessage(pubconn, newPayloadMessage(1, 1, "hi")))
+	expectMessage(t, pubconn, message.PUBACK)
+
+	pub := expectBuffer5(t, conn, message.PUBLISH)
+	require.Equal(t, []byte{0, 3, 'a', 'b', 'c'}, pub[:5])
+	require.Equal(t, []byte{0, 'h', 'i'}, pub[7:])
+
+	// PUBACK with a reason code and no properties
+	require.NoError(t, writeMessageBuffer(conn, packet5(nil, byte(message.PUBACK)<<4, pub[5:7], []byte{0, 0})))
+
+	// The user property goes with the message, and the PUBACK follows it
+	require.NoError(t, writeMessageBuffer(conn, packet5(nil, byte(message.PUBLISH)<<4|0x02,
+		[]byte{0, 3, 'a', 'b', 'c', 0, 2},
+		[]byte{7, 0x26, 0, 1, 'k', 0, 1, 'v'},
+		[]byte("hi"),
+	)))
+
+	pub = expectBuffer5(t, conn, message.PUBLISH)
+	require.Equal(t, []byte{7, 0x26, 0, 1, 'k', 0, 1, 'v', 'h', 'i'}, pub[7:])
+	require.NoError(t, writeMessageBuffer(conn, packet5(nil, byte(message.PUBACK)<<4, pub[5:7])))
+
+	require.Equal(t, []byte{0, 2}, expectBuffer5(t, conn, message.PUBACK))
+
+	// No one is subscribed to xyz
+	require.NoError(t, writeMessageBuffer(conn, packet5(nil, byte(message.PUBLISH)<<4|0x02,
+		[]byte{0, 3, 'x', 'y', 'z', 0, 3, 0},
+		[]byte("hi"),
+	)))
+
+	require.Equal(t, []byte{0, 3, reasonNoSubscribers}, expectBuffer5(t, conn, message.PUBACK))
+
+	// No QoS 2 message is waiting for a PUBREL with packet ID 4
+	require.NoError(t, writeMessageBuffer(conn, packet5(nil, byte(message.PUBREL)<<4|0x02, []byte{0, 4})))
+	require.Equal(t, []byte{0, 4, reasonPacketIdNotFound}, expectBuffer5(t, conn, message.PUBCOMP))
+
+	require.NoError(t, writeMessageBuffer(conn, packet5(nil, byte(message.UNSUBSCRIBE)<<4|0x02,
+		[]byte{0, 2, 0},
+		[]byte{0, 3, 'a', 'b', 'c'},
+		[]byte{0, 3, 'x', '/', 'y'},
+	)))
+
+	require.Equal(t, []byte{0, 2, 0, 0, 0}, expectBuffer5(t, conn, message.UNSUBACK))
+
+	require.NoError(t, writeMessageBuffer(conn, []byte{byte(message.DISCONNECT) << 4, 1, 0}))
+	expectClosed(t, conn)
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+}
+
+// echoAuthenticator authenticates the MQTT 5.0 clients that send back the challenge
+// they get with the "ECHO" Authentication Method, and the others like mockSuccess.
+type echoAuthenticator struct{}
+
+type echoExchange struct {
+	sent bool
+}
+
+func (this echoAuthenticator) Authenticate(id string, cred interface{}) error {
+	return nil
+}
+
+func (this echoAuthenticator) StartAuth(id, method string) (auth.AuthExchange, error) {
+	if method != "ECHO" {
+		return nil, auth.ErrAuthMethodNotSupported
+	}
+
+	return &echoExchange{}, nil
+}
+
+func (this *echoExchange) Next(data []byte) ([]byte, bool, error) {
+	if !this.sent {
+		this.sent = true
+		return []byte("challenge"), false, nil
+	}
+
+	if string(data) != "challenge" {
+		return nil, false, auth.ErrAuthFailure
+	}
+
+	return []byte("ok"), true, nil
+}
+
+func TestServiceMQTT5Auth(t *testing.T) {
+	auth.Register("echo5", echoAuthenticator{})
+	defer auth.Unregister("echo5")
+
+	old := authenticator
+	authenticator = "echo5"
+	defer func() { authenticator = old }()
+
+	svr, done := startNamedServer(t, "mqtt5", "tcp://127.0.0.1:1883", &Server{})
+
+	dial := func(method string) net.Conn {
+		var (
+			conn net.Conn
+			err  error
+		)
+
+		for i := 0; i < 100; i++ {
+			if conn, err = net.Dial("tcp", "127.0.0.1:1883"); err == nil {
+				break
+			}
+
+			time.Sleep(time.Millisecond * 10)
+		}
+
+		require.NoError(t, err)
+
+		require.NoError(t, writeMessageBuffer(conn, packet5(nil, byte(message.CONNECT)<<4,
+			[]byte{0, 4, 'M', 'Q', 'T', 'T', 5, 0x02, 0, 30},
+			[]byte{byte(3 + len(method)), propAuthMethod, 0, byte(len(method))},
+			[]byte(method),
+			[]byte{0, 2, 'v', '5'},
+		)))
+
+		return conn
+	}
+
+	// The AUTH messages of the ECHO method
+	authMsg := func(reason byte, data string) []byte {
+		v5 := &mqtt5{authMethod: []byte("ECHO")}
+		if data == "" {
+			return v5.auth(reason, nil)
+		}
+
+		return v5.auth(reason, []byte(data))
+	}
+
+	expectAuth := func(conn net.Conn, reason byte, data string) {
+		body := expectBuffer5(t, conn, auth5)
+		require.Equal(t, authMsg(reason, data)[2:], body)
+	}
+
+	// The authenticator doesn't know the method
+	conn := dial("SCRA")
+	defer conn.Close()
+
+	require.Equal(t, []byte{0, reasonBadAuthMethod, 0}, expectBuffer5(t, conn, message.CONNACK))
+	expectClosed(t, conn)
+
+	// The client gets the challenge wrong
+	conn = dial("ECHO")
+	defer conn.Close()
+
+	expectAuth(conn, reasonContinueAuth, "challenge")
+	require.NoError(t, writeMessageBuffer(conn, authMsg(reasonContinueAuth, "wrong")))
+
+	connack := expectBuffer5(t, conn, message.CONNACK)
+	require.Equal(t, byte(reasonNotAuthorized), connack[1])
+	expectClosed(t, conn)
+
+	// The client gets it right, and the CONNACK has the last of the data
+	conn = dial("ECHO")
+	defer conn.Close()
+
+	expectAuth(conn, reasonContinueAuth, "challenge")
+	require.NoError(t, writeMessageBuffer(conn, authMsg(reasonContinueAuth, "challenge")))
+
+	connack = expectBuffer5(t, conn, message.CONNACK)
+	require.Equal(t, byte(0), connack[1], "Expecting Success")
+
+	props, _, err := section5(connack[2:])
+	require.NoError(t, err)
+
+	var method, data string
+
+	require.NoError(t, walkProps5(props, func(id byte, v []byte) error {
+		switch id {
+		case propAuthMethod:
+			method = string(v[2:])
+
+		case propAuthData:
+			data = string(v[2:])
+		}
+		return nil
+	}))
+
+	require.Equal(t, "ECHO", method)
+	require.Equal(t, "ok", data)
+
+	// Re-authentication, which goes the same way
+	require.NoError(t, writeMessageBuffer(conn, authMsg(reasonReauthenticate, "")))
+	expectAuth(conn, reasonContinueAuth, "challenge")
+	require.NoError(t, writeMessageBuffer(conn, authMsg(reasonContinueAuth, "challenge")))
+	expectAuth(conn, 0, "ok")
+
+	// The client is still connected
+	require.NoError(t, writeMessageBuffer(conn, []byte{byte(message.PINGREQ) << 4, 0}))
+	expectBuffer5(t, conn, message.PINGRESP)
+
+	// And is disconnected when it gets it wrong
+	require.NoError(t, writeMessageBuffer(conn, authMsg(reasonReauthenticate, "")))
+	expectAuth(conn, reasonContinueAuth, "challenge")
+	require.NoError(t, writeMessageBuffer(conn, authMsg(reasonContinueAuth, "wrong")))
+
+	require.Equal(t, []byte{reasonNotAuthorized}, expectBuffer5(t, conn, message.DISCONNECT))
+	expectClosed(t, conn)
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+}
+
+// expectBuffer5 reads the next message from the connection, checks its type, and
+// returns what follows the fixed header.
+func expectBuffer5(t testing.TB, conn net.Conn, mtype message.MessageType) []byte {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	buf, err := getMessageBuffer(conn)
+	require.NoError(t, err)
+	require.Equal(t, mtype, message.MessageType(buf[0]>>4))
+
+	body, err := body5(buf)
+	require.NoError(t, err)
+
+	return body
+}
+
+// newConnectMessageBytes returns the CONNECT message of newConnectMessage(), encoded.
+func newConnectMessageBytes(t testing.TB) []byte {
+	msg := newConnectMessage()
+
+	b := make([]byte, msg.Len())
+	_, err := msg.Encode(b)
+	require.NoError(t, err)
+
+	return b
+}
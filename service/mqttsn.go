@@ -0,0 +1,1164 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logger"
+)
+
+const (
+	DefaultMQTTSNKeepAlive     = 60
+	DefaultMQTTSNRetryInterval = time.Second * 10
+	DefaultMQTTSNRetries       = 3
+	DefaultMQTTSNMaxBuffered   = 100
+)
+
+// How often the gateway looks for lost clients, messages to send again, and
+// connections to the server to keep alive
+const snTick = time.Millisecond * 250
+
+// The largest MQTT-SN message, with the 3 byte length
+const snMaxPacketSize = 65535
+
+// How long a client that disconnects has for its last messages to get to the server
+const snDrainTimeout = time.Second
+
+// MQTTSNGateway lets MQTT-SN 1.2 clients, e.g., sensors on a UDP network, use the
+// server as if they were MQTT clients. Each client that connects to the gateway is
+// connected to the server in memory, as an MQTT client with the same client ID, so
+// it has a session, subscriptions and a will like any other, and is subject to the
+// same authorization, limits and bans, by its UDP address.
+//
+// The topic names the clients register, or subscribe to, are given topic IDs per
+// client, and the gateway registers the topics of the messages it sends to a client
+// with it before the first one. Topics can also be predefined, with the same IDs for
+// all the clients, or be short topic names of 2 characters.
+//
+// Clients that go to sleep, by sending a DISCONNECT with a duration, keep their
+// subscriptions, and the messages to them are buffered until they wake up with a
+// PINGREQ, or connect again. The gateway sends the QoS 1 and 2 messages to the
+// clients again every RetryInterval until they are acked, up to Retries times. It
+// acks them to the server as soon as they are handed to the gateway though, so if a
+// client doesn't ack them they are lost.
+//
+// A client that doesn't send anything for one and a half times its keep alive, or
+// sleep duration, is considered lost. Its connection to the server is closed without
+// a DISCONNECT, so its will is published. Clients that connect with CleanSession
+// set to 0 keep their session on the server, but have to subscribe again to get the
+// messages from it.
+type MQTTSNGateway struct {
+	// ListenAddr is the UDP address the clients send to, e.g., ":1884".
+	ListenAddr string
+
+	// GatewayId is the ID of the gateway in the GWINFO messages sent to the clients
+	// looking for one.
+	GatewayId byte
+
+	// PredefinedTopics are the topic names the clients can use without registering
+	// them, by topic ID. The IDs can't be 0 or 0xffff.
+	PredefinedTopics map[uint16]string
+
+	// AllowQosMinusOne lets clients publish QoS -1 messages, to predefined topics or
+	// short topic names, without connecting. They are published without being
+	// authenticated or authorized, so it should only be set for trusted networks.
+	AllowQosMinusOne bool
+
+	// Username and Password are sent to the server in the CONNECT message of every
+	// client, if set, since MQTT-SN doesn't have them.
+	Username string
+	Password string
+
+	// The number of seconds the connections to the server are kept alive for. The
+	// gateway pings the server on behalf of the clients, so it has nothing to do with
+	// their keep alive. If not set then default to 60 seconds.
+	KeepAlive int
+
+	// How long to wait for a client to ack a message before sending it again, and how
+	// many times to do so before giving up. If not set then default to 10 seconds
+	// and 3 times.
+	RetryInterval time.Duration
+	Retries       int
+
+	// MaxBuffered is the most messages kept for a sleeping client. Once there are that
+	// many the oldest ones are dropped. If not set then default to 100.
+	MaxBuffered int
+
+	svr *Server
+	log logger.Logger
+
+	conn net.PacketConn
+
+	// PredefinedTopics the other way around
+	predefined map[string]uint16
+
+	// The clients, by UDP address. Protected by mu.
+	clients map[string]*snClient
+	mu      sync.Mutex
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+type snState int
+
+const (
+	snWaitingWillTopic snState = iota
+	snWaitingWillMsg
+	snConnecting
+	snActive
+	snAsleep
+)
+
+// snClient is an MQTT-SN client of the gateway, and its connection to the server.
+// Its lock is taken before the gateway's, if both are needed.
+type snClient struct {
+	gw   *MQTTSNGateway
+	addr net.Addr
+	id   string
+
+	state snState
+
+	// The keep alive, or sleep duration, and when the last message came in
+	duration time.Duration
+	lastSeen time.Time
+
+	// The CONNECT message for the server, while the will is being asked for
+	req *message.ConnectMessage
+
+	// The connection to the server, and when it was last pinged. nil until the server
+	// accepts the client, and once the client is gone.
+	client   *Client
+	lastPing time.Time
+
+	// Set once the client has been taken out of the gateway
+	gone bool
+
+	// The topic names registered with the client, and their IDs
+	topics map[uint16]string
+	ids    map[string]uint16
+	nextId uint16
+
+	// The messages sent to the client that it hasn't acked yet, by message ID
+	inflight  map[uint16]*snInflight
+	nextMsgId uint16
+
+	// The messages waiting for the client to ack the REGISTER of their topic, by
+	// topic ID
+	waitReg map[uint16][]*message.PublishMessage
+
+	// The messages kept while the client is asleep
+	buffered []*message.PublishMessage
+
+	// The message IDs of the QoS 2 messages from the client waiting for PUBREL
+	qos2in map[uint16]bool
+
+	mu sync.Mutex
+}
+
+type snInflight struct {
+	pkt   []byte
+	sent  time.Time
+	tries int
+
+	// For a REGISTER, the topic ID being registered, 0 otherwise
+	topicId uint16
+}
+
+// snConn is the server's end of the in-memory connection of an MQTT-SN client, which
+// is known by the client's UDP address.
+type snConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (this snConn) RemoteAddr() net.Addr {
+	return this.addr
+}
+
+func (this *MQTTSNGateway) checkConfiguration() error {
+	if this.ListenAddr == "" {
+		return fmt.Errorf("mqttsn/checkConfiguration: No listen address")
+	}
+
+	this.predefined = make(map[string]uint16, len(this.PredefinedTopics))
+
+	for id, topic := range this.PredefinedTopics {
+		if id == 0 || id == 0xffff {
+			return fmt.Errorf("mqttsn/checkConfiguration: (%s) Invalid predefined topic ID %d", this.ListenAddr, id)
+		}
+
+		if topic == "" || strings.ContainsAny(topic, "#+") {
+			return fmt.Errorf("mqttsn/checkConfiguration: (%s) Invalid predefined topic %q", this.ListenAddr, topic)
+		}
+
+		this.predefined[topic] = id
+	}
+
+	if this.KeepAlive == 0 {
+		this.KeepAlive = DefaultMQTTSNKeepAlive
+	}
+
+	if this.RetryInterval == 0 {
+		this.RetryInterval = DefaultMQTTSNRetryInterval
+	}
+
+	if this.Retries == 0 {
+		this.Retries = DefaultMQTTSNRetries
+	}
+
+	if this.MaxBuffered == 0 {
+		this.MaxBuffered = DefaultMQTTSNMaxBuffered
+	}
+
+	return nil
+}
+
+// start opens the UDP socket and starts handling the clients.
+func (this *MQTTSNGateway) start(svr *Server) error {
+	this.svr = svr
+	this.log = svr.Logger.With(logger.Subsystem, "mqttsn")
+	this.clients = make(map[string]*snClient)
+	this.quit = make(chan struct{})
+
+	conn, err := net.ListenPacket("udp", this.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("mqttsn/start: (%s) %v", this.ListenAddr, err)
+	}
+
+	this.conn = conn
+
+	this.wg.Add(2)
+	go this.run()
+	go this.tick()
+
+	this.log.Infof("mqttsn/start: (%s) Gateway is ready", this.ListenAddr)
+
+	return nil
+}
+
+// stop closes the UDP socket, and the connections of all the clients.
+func (this *MQTTSNGateway) stop() {
+	select {
+	case <-this.quit:
+		return
+
+	default:
+	}
+
+	close(this.quit)
+	this.conn.Close()
+
+	this.mu.Lock()
+	clients := make([]*snClient, 0, len(this.clients))
+	for _, sc := range this.clients {
+		clients = append(clients, sc)
+	}
+	this.clients = make(map[string]*snClient)
+	this.mu.Unlock()
+
+	for _, sc := range clients {
+		if c := sc.end(); c != nil {
+			c.Disconnect()
+		}
+	}
+
+	this.wg.Wait()
+}
+
+// run reads the messages from the clients until the gateway is stopped.
+func (this *MQTTSNGateway) run() {
+	defer this.wg.Done()
+
+	buf := make([]byte, snMaxPacketSize)
+
+	for {
+		n, addr, err := this.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-this.quit:
+				return
+
+			default:
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+
+			this.log.Errorf("mqttsn/run: (%s) Error reading: %v", this.ListenAddr, err)
+			return
+		}
+
+		// The messages are handed on to the server, so they can't share buf
+		typ, body, err := parseSNPacket(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			this.log.Debugf("mqttsn/run: (%s) Dropping message from %s: %v", this.ListenAddr, addr, err)
+			continue
+		}
+
+		this.handle(addr, typ, body)
+	}
+}
+
+func (this *MQTTSNGateway) handle(addr net.Addr, typ byte, body []byte) {
+	switch typ {
+	case snSearchGw:
+		this.write(addr, newSNPacket(snGwInfo, this.GatewayId))
+		return
+
+	case snConnect:
+		this.connect(addr, body)
+		return
+
+	case snPublish:
+		if snQos(body[0]) == snQosMinusOne {
+			this.publishQosMinusOne(addr, body)
+			return
+		}
+	}
+
+	this.mu.Lock()
+	sc := this.clients[addr.String()]
+	this.mu.Unlock()
+
+	if sc == nil {
+		// Let the client know it has to connect first
+		if typ != snDisconnect {
+			this.write(addr, newSNPacket(snDisconnect))
+		}
+
+		return
+	}
+
+	sc.handle(typ, body)
+}
+
+// connect handles a CONNECT message, which either wakes up a sleeping client or
+// starts a new one, in place of any the address had.
+func (this *MQTTSNGateway) connect(addr net.Addr, body []byte) {
+	flags := body[0]
+	duration := time.Second * time.Duration(binary.BigEndian.Uint16(body[2:]))
+	cid := string(body[4:])
+
+	this.mu.Lock()
+	prev := this.clients[addr.String()]
+	this.mu.Unlock()
+
+	if prev != nil && prev.wake(cid, flags, duration) {
+		return
+	}
+
+	req := message.NewConnectMessage()
+	req.SetVersion(4)
+	req.SetCleanSession(flags&snFlagClean != 0)
+	req.SetKeepAlive(uint16(this.KeepAlive))
+
+	if err := req.SetClientId([]byte(cid)); err != nil {
+		this.write(addr, newSNPacket(snConnack, snRejectedNotSupported))
+		return
+	}
+
+	if this.Username != "" {
+		req.SetUsername([]byte(this.Username))
+		req.SetPassword([]byte(this.Password))
+	}
+
+	sc := &snClient{
+		gw:       this,
+		addr:     addr,
+		id:       cid,
+		state:    snConnecting,
+		duration: duration,
+		lastSeen: time.Now(),
+		req:      req,
+		topics:   make(map[uint16]string),
+		ids:      make(map[string]uint16),
+		inflight: make(map[uint16]*snInflight),
+		waitReg:  make(map[uint16][]*message.PublishMessage),
+		qos2in:   make(map[uint16]bool),
+	}
+
+	if flags&snFlagWill != 0 {
+		sc.state = snWaitingWillTopic
+	}
+
+	this.mu.Lock()
+	this.clients[addr.String()] = sc
+	this.mu.Unlock()
+
+	if prev != nil {
+		if c := prev.end(); c != nil {
+			c.Disconnect()
+		}
+	}
+
+	if sc.state == snWaitingWillTopic {
+		this.write(addr, newSNPacket(snWillTopicReq))
+		return
+	}
+
+	this.wg.Add(1)
+	go sc.connect()
+}
+
+// publishQosMinusOne publishes a QoS -1 message, from a client that may not be
+// connected, as a QoS 0 message.
+func (this *MQTTSNGateway) publishQosMinusOne(addr net.Addr, body []byte) {
+	if !this.AllowQosMinusOne {
+		this.log.Debugf("mqttsn/publishQosMinusOne: (%s) Dropping QoS -1 message from %s", this.ListenAddr, addr)
+		return
+	}
+
+	var topic string
+
+	switch body[0] & snTopicIdMask {
+	case snTopicPredefined:
+		topic = this.PredefinedTopics[binary.BigEndian.Uint16(body[1:])]
+
+	case snTopicShort:
+		topic = string(body[1:3])
+	}
+
+	if topic == "" {
+		return
+	}
+
+	msg := message.NewPublishMessage()
+	msg.SetQoS(message.QosAtMostOnce)
+	msg.SetRetain(body[0]&snFlagRetain != 0)
+	msg.SetPayload(body[5:])
+
+	if err := msg.SetTopic([]byte(topic)); err != nil {
+		return
+	}
+
+	if err := this.svr.Publish(msg, nil); err != nil {
+		this.log.Errorf("mqttsn/publishQosMinusOne: (%s) Error publishing message from %s: %v", this.ListenAddr, addr, err)
+	}
+}
+
+// remove takes sc out of the gateway, and returns false if it wasn't in there.
+func (this *MQTTSNGateway) remove(sc *snClient) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.clients[sc.addr.String()] != sc {
+		return false
+	}
+
+	delete(this.clients, sc.addr.String())
+
+	return true
+}
+
+// tick looks after the clients every snTick until the gateway is stopped.
+func (this *MQTTSNGateway) tick() {
+	defer this.wg.Done()
+
+	tick := time.NewTicker(snTick)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-this.quit:
+			return
+
+		case now := <-tick.C:
+			this.mu.Lock()
+			clients := make([]*snClient, 0, len(this.clients))
+			for _, sc := range this.clients {
+				clients = append(clients, sc)
+			}
+			this.mu.Unlock()
+
+			for _, sc := range clients {
+				if sc.check(now) || !this.remove(sc) {
+					continue
+				}
+
+				this.log.Infof("mqttsn/tick: (%s) Client %s is lost", this.ListenAddr, sc.addr)
+
+				// Closed without a DISCONNECT, so the will is published
+				if c := sc.end(); c != nil {
+					c.Disconnect()
+				}
+			}
+		}
+	}
+}
+
+func (this *MQTTSNGateway) write(addr net.Addr, pkt []byte) {
+	if _, err := this.conn.WriteTo(pkt, addr); err != nil {
+		this.log.Debugf("mqttsn/write: (%s) Error writing to %s: %v", this.ListenAddr, addr, err)
+	}
+}
+
+// dial returns the function that connects a client at addr to the server, in memory.
+func (this *MQTTSNGateway) dial(addr net.Addr) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go this.svr.handleConnection(snConn{server, addr}, nil)
+
+		return client, nil
+	}
+}
+
+// connect connects the client to the server, and lets it know how that went.
+func (this *snClient) connect() {
+	defer this.gw.wg.Done()
+
+	c := &Client{
+		Logger: this.gw.log,
+		dial:   this.gw.dial(this.addr),
+	}
+
+	this.mu.Lock()
+	req := this.req
+	this.req = nil
+	this.mu.Unlock()
+
+	if err := c.Connect("", req); err != nil {
+		this.gw.log.Infof("mqttsn/connect: (%s) Client %s was not accepted: %v", this.gw.ListenAddr, this.addr, err)
+
+		if this.gw.remove(this) {
+			this.write(newSNPacket(snConnack, snRejectedNotSupported))
+		}
+
+		return
+	}
+
+	this.mu.Lock()
+
+	if this.gone {
+		this.mu.Unlock()
+		c.Disconnect()
+		return
+	}
+
+	this.client = c
+	this.lastPing = time.Now()
+	this.state = snActive
+	this.write(newSNPacket(snConnack, snAccepted))
+
+	this.mu.Unlock()
+
+	this.gw.wg.Add(1)
+	go this.watch(c)
+}
+
+// watch waits for the connection to the server to be closed, and disconnects the
+// client if it was closed by the server.
+func (this *snClient) watch(c *Client) {
+	defer this.gw.wg.Done()
+
+	<-c.svc.stopped
+
+	if this.gw.remove(this) {
+		this.end()
+		this.write(newSNPacket(snDisconnect))
+	}
+}
+
+// end marks the client as gone, and returns its connection to the server, if it has
+// one, for the caller to close.
+func (this *snClient) end() *Client {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	c := this.client
+	this.client = nil
+	this.gone = true
+
+	return c
+}
+
+// wake handles a CONNECT from a client that's already connected, or asleep, and
+// returns false if it has to be connected again instead.
+func (this *snClient) wake(cid string, flags byte, duration time.Duration) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.state != snActive && this.state != snAsleep {
+		return false
+	}
+
+	if flags&(snFlagClean|snFlagWill) != 0 || cid != this.id {
+		return false
+	}
+
+	this.state = snActive
+	this.duration = duration
+	this.lastSeen = time.Now()
+	this.write(newSNPacket(snConnack, snAccepted))
+	this.flush()
+
+	return true
+}
+
+// check sends the messages the client hasn't acked again, and pings the server if
+// it's time to. It returns false if the client is lost.
+func (this *snClient) check(now time.Time) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.duration > 0 && now.Sub(this.lastSeen) > this.duration*3/2 {
+		return false
+	}
+
+	for id, in := range this.inflight {
+		if now.Sub(in.sent) < this.gw.RetryInterval {
+			continue
+		}
+
+		if in.tries >= this.gw.Retries {
+			delete(this.inflight, id)
+
+			if in.topicId != 0 {
+				this.forget(in.topicId)
+			}
+
+			continue
+		}
+
+		snSetDup(in.pkt)
+
+		in.sent = now
+		in.tries++
+		this.write(in.pkt)
+	}
+
+	if this.client != nil && now.Sub(this.lastPing) >= time.Second*time.Duration(this.gw.KeepAlive)/2 {
+		this.lastPing = now
+
+		if err := this.client.Ping(nil); err != nil {
+			this.gw.log.Debugf("mqttsn/check: (%s) Error pinging the server for %s: %v", this.gw.ListenAddr, this.addr, err)
+		}
+	}
+
+	return true
+}
+
+func (this *snClient) handle(typ byte, body []byte) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.lastSeen = time.Now()
+
+	switch this.state {
+	case snWaitingWillTopic:
+		if typ == snWillTopic {
+			this.willTopic(body)
+		}
+		return
+
+	case snWaitingWillMsg:
+		if typ == snWillMsg {
+			this.req.SetWillMessage(body)
+			this.state = snConnecting
+
+			this.gw.wg.Add(1)
+			go this.connect()
+		}
+		return
+
+	case snConnecting:
+		return
+
+	case snAsleep:
+		switch typ {
+		case snPingreq, snDisconnect, snPuback, snPubrec, snPubcomp, snRegack:
+		default:
+			return
+		}
+	}
+
+	switch typ {
+	case snRegister:
+		this.register(body)
+
+	case snRegack:
+		this.regack(body)
+
+	case snPublish:
+		this.publish(body)
+
+	case snPuback:
+		id := binary.BigEndian.Uint16(body[2:])
+		delete(this.inflight, id)
+
+		if body[4] == snRejectedTopicId {
+			this.forget(binary.BigEndian.Uint16(body))
+		}
+
+	case snPubrec:
+		id := binary.BigEndian.Uint16(body)
+
+		if in, ok := this.inflight[id]; ok {
+			in.pkt = newSNPacket(snPubrel, id)
+			in.sent = time.Now()
+			in.tries = 0
+		}
+
+		this.write(newSNPacket(snPubrel, id))
+
+	case snPubrel:
+		id := binary.BigEndian.Uint16(body)
+		delete(this.qos2in, id)
+		this.write(newSNPacket(snPubcomp, id))
+
+	case snPubcomp:
+		delete(this.inflight, binary.BigEndian.Uint16(body))
+
+	case snSubscribe:
+		this.subscribe(body)
+
+	case snUnsubscribe:
+		this.unsubscribe(body)
+
+	case snPingreq:
+		// A sleeping client that's awake for a moment, to get its messages
+		if this.state == snAsleep && len(body) > 0 {
+			this.state = snActive
+			this.flush()
+			this.state = snAsleep
+		}
+
+		this.write(newSNPacket(snPingresp))
+
+	case snDisconnect:
+		this.disconnect(body)
+	}
+}
+
+// willTopic handles the WILLTOPIC message, which is empty if there's no will after
+// all.
+func (this *snClient) willTopic(body []byte) {
+	if len(body) == 0 {
+		this.state = snConnecting
+
+		this.gw.wg.Add(1)
+		go this.connect()
+
+		return
+	}
+
+	this.req.SetWillFlag(true)
+	this.req.SetWillQos(snQos(body[0]))
+	this.req.SetWillRetain(body[0]&snFlagRetain != 0)
+	this.req.SetWillTopic(body[1:])
+
+	this.state = snWaitingWillMsg
+	this.write(newSNPacket(snWillMsgReq))
+}
+
+func (this *snClient) register(body []byte) {
+	msgId, topic := binary.BigEndian.Uint16(body[2:]), string(body[4:])
+
+	if topic == "" || strings.ContainsAny(topic, "#+") {
+		this.write(newSNPacket(snRegack, uint16(0), msgId, snRejectedNotSupported))
+		return
+	}
+
+	this.write(newSNPacket(snRegack, this.topicId(topic), msgId, snAccepted))
+}
+
+// regack handles the client's answer to a REGISTER from the gateway, and sends the
+// messages that were waiting for it.
+func (this *snClient) regack(body []byte) {
+	id, msgId := binary.BigEndian.Uint16(body), binary.BigEndian.Uint16(body[2:])
+
+	in, ok := this.inflight[msgId]
+	if !ok || in.topicId != id {
+		return
+	}
+
+	delete(this.inflight, msgId)
+
+	if body[4] != snAccepted {
+		this.forget(id)
+		return
+	}
+
+	msgs := this.waitReg[id]
+	delete(this.waitReg, id)
+
+	for _, msg := range msgs {
+		this.send(msg)
+	}
+}
+
+// publish hands a PUBLISH message from the client to the server.
+func (this *snClient) publish(body []byte) {
+	flags := body[0]
+	id, msgId := binary.BigEndian.Uint16(body[1:]), binary.BigEndian.Uint16(body[3:])
+	qos := snQos(flags)
+
+	topic, ok := this.topicName(flags&snTopicIdMask, body[1:3])
+	if !ok {
+		this.write(newSNPacket(snPuback, id, msgId, snRejectedTopicId))
+		return
+	}
+
+	// Already handed to the server
+	if qos == message.QosExactlyOnce && this.qos2in[msgId] {
+		this.write(newSNPacket(snPubrec, msgId))
+		return
+	}
+
+	msg := message.NewPublishMessage()
+	msg.SetQoS(qos)
+	msg.SetRetain(flags&snFlagRetain != 0)
+	msg.SetPayload(body[5:])
+
+	if err := msg.SetTopic([]byte(topic)); err != nil {
+		this.write(newSNPacket(snPuback, id, msgId, snRejectedNotSupported))
+		return
+	}
+
+	var onComplete OnCompleteFunc
+
+	if qos != message.QosAtMostOnce {
+		msg.SetPacketId(this.client.svc.sess.NextPacketId())
+	}
+
+	if qos == message.QosAtLeastOnce {
+		onComplete = func(msg, ack message.Message, err error) error {
+			if err == nil {
+				this.write(newSNPacket(snPuback, id, msgId, snAccepted))
+			}
+			return nil
+		}
+	}
+
+	if err := this.client.Publish(msg, onComplete); err != nil {
+		if qos != message.QosAtMostOnce {
+			this.write(newSNPacket(snPuback, id, msgId, snRejectedCongestion))
+		}
+		return
+	}
+
+	if qos == message.QosExactlyOnce {
+		this.qos2in[msgId] = true
+		this.write(newSNPacket(snPubrec, msgId))
+	}
+}
+
+// subscribe subscribes the client to a topic on the server. Topic names without
+// wildcards are registered, so the client knows the topic ID of the messages.
+func (this *snClient) subscribe(body []byte) {
+	flags, msgId := body[0], binary.BigEndian.Uint16(body[1:])
+
+	qos := snQos(flags)
+	if qos == snQosMinusOne {
+		qos = message.QosAtMostOnce
+	}
+
+	topic, id, ok := this.subscription(flags, body[3:])
+	if !ok {
+		this.write(newSNPacket(snSuback, flags&snQosMask, uint16(0), msgId, snRejectedTopicId))
+		return
+	}
+
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketId(this.client.svc.sess.NextPacketId())
+
+	if err := sub.AddTopic([]byte(topic), qos); err != nil {
+		this.write(newSNPacket(snSuback, flags&snQosMask, uint16(0), msgId, snRejectedNotSupported))
+		return
+	}
+
+	onComplete := func(msg, ack message.Message, err error) error {
+		if err != nil {
+			this.write(newSNPacket(snSuback, flags&snQosMask, id, msgId, snRejectedNotSupported))
+			return nil
+		}
+
+		granted := ack.(*message.SubackMessage).ReturnCodes()[0]
+		this.write(newSNPacket(snSuback, snFlags(granted, false, false, 0), id, msgId, snAccepted))
+
+		return nil
+	}
+
+	if err := this.client.Subscribe(sub, onComplete, this.fromServer); err != nil {
+		this.write(newSNPacket(snSuback, flags&snQosMask, id, msgId, snRejectedCongestion))
+	}
+}
+
+func (this *snClient) unsubscribe(body []byte) {
+	flags, msgId := body[0], binary.BigEndian.Uint16(body[1:])
+
+	topic, _, ok := this.subscription(flags, body[3:])
+	if !ok {
+		this.write(newSNPacket(snUnsuback, msgId))
+		return
+	}
+
+	unsub := message.NewUnsubscribeMessage()
+	unsub.SetPacketId(this.client.svc.sess.NextPacketId())
+	unsub.AddTopic([]byte(topic))
+
+	onComplete := func(msg, ack message.Message, err error) error {
+		this.write(newSNPacket(snUnsuback, msgId))
+		return nil
+	}
+
+	if err := this.client.Unsubscribe(unsub, onComplete); err != nil {
+		this.write(newSNPacket(snUnsuback, msgId))
+	}
+}
+
+// subscription returns the topic filter of a SUBSCRIBE or UNSUBSCRIBE message, and
+// the topic ID the client knows it by, which is 0 for filters with wildcards.
+func (this *snClient) subscription(flags byte, b []byte) (string, uint16, bool) {
+	switch flags & snTopicIdMask {
+	case snTopicNormal:
+		topic := string(b)
+
+		if topic == "" {
+			return "", 0, false
+		}
+
+		if strings.ContainsAny(topic, "#+") {
+			return topic, 0, true
+		}
+
+		return topic, this.topicId(topic), true
+
+	case snTopicPredefined, snTopicShort:
+		if len(b) < 2 {
+			return "", 0, false
+		}
+
+		topic, ok := this.topicName(flags&snTopicIdMask, b)
+
+		return topic, binary.BigEndian.Uint16(b), ok
+	}
+
+	return "", 0, false
+}
+
+// disconnect puts the client to sleep, if there's a duration, or disconnects it from
+// the server.
+func (this *snClient) disconnect(body []byte) {
+	if len(body) >= 2 {
+		if d := binary.BigEndian.Uint16(body); d > 0 {
+			this.state = snAsleep
+			this.duration = time.Second * time.Duration(d)
+			this.write(newSNPacket(snDisconnect))
+			return
+		}
+	}
+
+	this.gw.remove(this)
+	this.write(newSNPacket(snDisconnect))
+
+	c := this.client
+	this.client = nil
+	this.gone = true
+
+	this.gw.wg.Add(1)
+	go func() {
+		defer this.gw.wg.Done()
+
+		// The server drops the will once it sees the DISCONNECT
+		if _, err := c.svc.writeMessage(message.NewDisconnectMessage()); err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), snDrainTimeout)
+			c.svc.drain(ctx)
+			cancel()
+		}
+
+		c.Disconnect()
+	}()
+}
+
+// fromServer is subscribed on the client's connection to the server, and sends the
+// messages from the server on to the client, or keeps them while it's asleep.
+func (this *snClient) fromServer(msg *message.PublishMessage) error {
+	out := message.NewPublishMessage()
+	out.SetTopic(append([]byte(nil), msg.Topic()...))
+	out.SetPayload(append([]byte(nil), msg.Payload()...))
+	out.SetQoS(msg.QoS())
+	out.SetRetain(msg.Retain())
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.gone {
+		return nil
+	}
+
+	if this.state == snAsleep {
+		if len(this.buffered) >= this.gw.MaxBuffered {
+			this.buffered = this.buffered[1:]
+		}
+
+		this.buffered = append(this.buffered, out)
+
+		return nil
+	}
+
+	this.send(out)
+
+	return nil
+}
+
+// flush sends the messages kept while the client was asleep.
+func (this *snClient) flush() {
+	msgs := this.buffered
+	this.buffered = nil
+
+	for _, msg := range msgs {
+		this.send(msg)
+	}
+}
+
+// send sends a message to the client, once its topic is registered with it.
+func (this *snClient) send(msg *message.PublishMessage) {
+	topic := string(msg.Topic())
+
+	var (
+		id  uint16
+		typ byte
+	)
+
+	if pid, ok := this.gw.predefined[topic]; ok {
+		id, typ = pid, snTopicPredefined
+	} else if len(topic) == 2 {
+		id, typ = binary.BigEndian.Uint16(msg.Topic()), snTopicShort
+	} else if rid, ok := this.ids[topic]; ok {
+		id, typ = rid, snTopicNormal
+
+		// Still being registered
+		if msgs, ok := this.waitReg[id]; ok {
+			this.waitReg[id] = append(msgs, msg)
+			return
+		}
+	} else {
+		id = this.topicId(topic)
+
+		msgId := this.msgId()
+		pkt := newSNPacket(snRegister, id, msgId, topic)
+
+		this.inflight[msgId] = &snInflight{pkt: pkt, sent: time.Now(), topicId: id}
+		this.waitReg[id] = []*message.PublishMessage{msg}
+		this.write(pkt)
+
+		return
+	}
+
+	var msgId uint16
+	if msg.QoS() != message.QosAtMostOnce {
+		msgId = this.msgId()
+	}
+
+	pkt := newSNPacket(snPublish, snFlags(msg.QoS(), msg.Retain(), false, typ), id, msgId, msg.Payload())
+
+	if msg.QoS() != message.QosAtMostOnce {
+		this.inflight[msgId] = &snInflight{pkt: pkt, sent: time.Now()}
+	}
+
+	this.write(pkt)
+}
+
+// topicName returns the topic name of a topic ID of the given type, from a PUBLISH or
+// SUBSCRIBE message.
+func (this *snClient) topicName(typ byte, b []byte) (string, bool) {
+	switch typ {
+	case snTopicNormal:
+		topic, ok := this.topics[binary.BigEndian.Uint16(b)]
+		return topic, ok
+
+	case snTopicPredefined:
+		topic, ok := this.gw.PredefinedTopics[binary.BigEndian.Uint16(b)]
+		return topic, ok
+
+	case snTopicShort:
+		return string(b[:2]), true
+	}
+
+	return "", false
+}
+
+// topicId returns the topic ID registered for the topic name, registering it if it
+// isn't.
+func (this *snClient) topicId(topic string) uint16 {
+	if id, ok := this.ids[topic]; ok {
+		return id
+	}
+
+	for {
+		if this.nextId++; this.nextId == 0 || this.nextId == 0xffff {
+			continue
+		}
+
+		if _, ok := this.topics[this.nextId]; !ok {
+			break
+		}
+	}
+
+	this.topics[this.nextId] = topic
+	this.ids[topic] = this.nextId
+
+	return this.nextId
+}
+
+// forget takes a topic ID the client rejected out of the registered ones, along
+// with the messages that were waiting for it.
+func (this *snClient) forget(id uint16) {
+	if topic, ok := this.topics[id]; ok {
+		delete(this.ids, topic)
+		delete(this.topics, id)
+	}
+
+	delete(this.waitReg, id)
+}
+
+// msgId returns the next message ID that's not in use.
+func (this *snClient) msgId() uint16 {
+	for {
+		if this.nextMsgId++; this.nextMsgId == 0 {
+			continue
+		}
+
+		if _, ok := this.inflight[this.nextMsgId]; !ok {
+			return this.nextMsgId
+		}
+	}
+}
+
+func (this *snClient) write(pkt []byte) {
+	this.gw.write(this.addr, pkt)
+}
+
+// snSetDup sets the DUP flag of a PUBLISH message that's sent again.
+func snSetDup(pkt []byte) {
+	hdr := 1
+	if pkt[0] == 0x01 {
+		hdr = 3
+	}
+
+	if pkt[hdr] == snPublish {
+		pkt[hdr+1] |= snFlagDup
+	}
+}
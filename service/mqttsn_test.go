@@ -0,0 +1,282 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestSNPacket(t *testing.T) {
+	pkt := newSNPacket(snRegister, uint16(1), uint16(2), "abc")
+	require.Equal(t, []byte{9, snRegister, 0, 1, 0, 2, 'a', 'b', 'c'}, pkt)
+
+	typ, body, err := parseSNPacket(pkt)
+	require.NoError(t, err)
+	require.Equal(t, snRegister, typ)
+	require.Equal(t, []byte{0, 1, 0, 2, 'a', 'b', 'c'}, body)
+
+	// Too long for a 1 byte length
+	pkt = newSNPacket(snPublish, snFlags(1, true, false, snTopicNormal), uint16(1), uint16(2), strings.Repeat("x", 300))
+	require.Equal(t, []byte{0x01, 0x01, 0x35, snPublish, 0x30}, pkt[:5])
+
+	typ, body, err = parseSNPacket(pkt)
+	require.NoError(t, err)
+	require.Equal(t, snPublish, typ)
+	require.Equal(t, 305, len(body))
+	require.Equal(t, byte(1), snQos(body[0]))
+
+	snSetDup(pkt)
+	require.Equal(t, snFlagDup, pkt[4]&snFlagDup)
+
+	for _, b := range [][]byte{
+		{2},
+		{3, snPingreq},
+		{2, 0x42},
+		{4, snPublish, 0, 0},
+		{0x01, 0, 3, snPingreq},
+	} {
+		_, _, err := parseSNPacket(b)
+		require.Error(t, err)
+	}
+}
+
+func TestMQTTSNGatewayConfiguration(t *testing.T) {
+	for _, g := range []*MQTTSNGateway{
+		{},
+		{ListenAddr: ":1884", PredefinedTopics: map[uint16]string{0: "abc"}},
+		{ListenAddr: ":1884", PredefinedTopics: map[uint16]string{1: "abc/#"}},
+	} {
+		require.Error(t, g.checkConfiguration())
+	}
+
+	g := &MQTTSNGateway{ListenAddr: ":1884", PredefinedTopics: map[uint16]string{1: "abc"}}
+
+	require.NoError(t, g.checkConfiguration())
+	require.Equal(t, DefaultMQTTSNKeepAlive, g.KeepAlive)
+	require.Equal(t, DefaultMQTTSNRetryInterval, g.RetryInterval)
+	require.Equal(t, DefaultMQTTSNRetries, g.Retries)
+	require.Equal(t, DefaultMQTTSNMaxBuffered, g.MaxBuffered)
+	require.Equal(t, uint16(1), g.predefined["abc"])
+}
+
+func snWrite(t *testing.T, conn net.Conn, typ byte, parts ...interface{}) {
+	_, err := conn.Write(newSNPacket(typ, parts...))
+	require.NoError(t, err)
+}
+
+func snExpect(t *testing.T, conn net.Conn, typ byte) []byte {
+	buf := make([]byte, snMaxPacketSize)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+
+	mtype, body, err := parseSNPacket(buf[:n])
+	require.NoError(t, err)
+	require.Equal(t, typ, mtype)
+
+	return body
+}
+
+func snExpectNothing(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+
+	_, err := conn.Read(make([]byte, snMaxPacketSize))
+	require.True(t, isTimeout(err), "Expecting timeout, got %v", err)
+}
+
+func snDialConnect(t *testing.T, cid string, flags byte, duration uint16) net.Conn {
+	conn, err := net.Dial("udp", "127.0.0.1:1884")
+	require.NoError(t, err)
+
+	snWrite(t, conn, snConnect, flags, byte(0x01), duration, cid)
+
+	if flags&snFlagWill == 0 {
+		require.Equal(t, []byte{snAccepted}, snExpect(t, conn, snConnack))
+	}
+
+	return conn
+}
+
+func TestMQTTSNGateway(t *testing.T) {
+	svr, done := startNamedServer(t, "mqttsn", "tcp://127.0.0.1:1883", &Server{
+		MQTTSNGateways: []*MQTTSNGateway{{
+			ListenAddr:       "127.0.0.1:1884",
+			GatewayId:        7,
+			PredefinedTopics: map[uint16]string{1: "sensors/temp"},
+		}},
+	})
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	// The gateway has started once the server accepts connections
+	sub := dialNamedServer(t, "127.0.0.1:1883", "sensors/#")
+	defer sub.Close()
+
+	sensor := snDialConnect(t, "sensor1", snFlagClean, 10)
+	defer sensor.Close()
+
+	snWrite(t, sensor, snSearchGw, byte(0))
+	require.Equal(t, []byte{7}, snExpect(t, sensor, snGwInfo))
+
+	// Registered topic
+	snWrite(t, sensor, snRegister, uint16(0), uint16(1), "sensors/humidity")
+	regack := snExpect(t, sensor, snRegack)
+	require.Equal(t, []byte{0, 1, snAccepted}, regack[2:])
+	id := binary.BigEndian.Uint16(regack)
+
+	snWrite(t, sensor, snPublish, snFlags(1, false, false, snTopicNormal), id, uint16(2), "40")
+	require.Equal(t, []byte{byte(id >> 8), byte(id), 0, 2, snAccepted}, snExpect(t, sensor, snPuback))
+	expectPublish(t, sub, "sensors/humidity", 1)
+
+	// Predefined topic, QoS 2, sent twice
+	for i := 0; i < 2; i++ {
+		snWrite(t, sensor, snPublish, snFlags(2, false, i > 0, snTopicPredefined), uint16(1), uint16(3), "21")
+		require.Equal(t, []byte{0, 3}, snExpect(t, sensor, snPubrec))
+	}
+
+	snWrite(t, sensor, snPubrel, uint16(3))
+	require.Equal(t, []byte{0, 3}, snExpect(t, sensor, snPubcomp))
+	expectPublish(t, sub, "sensors/temp", 1)
+	expectNoMessage(t, sub)
+
+	// Topic ID the sensor doesn't have
+	snWrite(t, sensor, snPublish, snFlags(0, false, false, snTopicNormal), uint16(100), uint16(0), "x")
+	require.Equal(t, []byte{0, 100, 0, 0, snRejectedTopicId}, snExpect(t, sensor, snPuback))
+
+	// A topic name without wildcards is registered by subscribing
+	snWrite(t, sensor, snSubscribe, snFlags(1, false, false, snTopicNormal), uint16(4), "cmd/sensor1")
+	suback := snExpect(t, sensor, snSuback)
+	require.Equal(t, []byte{0, 4, snAccepted}, suback[3:])
+	require.Equal(t, byte(1), snQos(suback[0]))
+	cmd := binary.BigEndian.Uint16(suback[1:])
+
+	msg := newPayloadMessage(0, 0, "on")
+	msg.SetTopic([]byte("cmd/sensor1"))
+	require.NoError(t, svr.Publish(msg, nil))
+
+	pub := snExpect(t, sensor, snPublish)
+	require.Equal(t, snFlags(0, false, false, snTopicNormal), pub[0])
+	require.Equal(t, cmd, binary.BigEndian.Uint16(pub[1:]))
+	require.Equal(t, "on", string(pub[5:]))
+
+	// With wildcards, the topics of the messages are registered with the sensor first
+	snWrite(t, sensor, snSubscribe, snFlags(1, false, false, snTopicNormal), uint16(5), "all/#")
+	suback = snExpect(t, sensor, snSuback)
+	require.Equal(t, []byte{0, 0, 0, 5, snAccepted}, suback[1:])
+
+	msg = newPayloadMessage(1, 1, "off")
+	msg.SetTopic([]byte("all/off"))
+	require.NoError(t, svr.Publish(msg, nil))
+
+	reg := snExpect(t, sensor, snRegister)
+	require.Equal(t, "all/off", string(reg[4:]))
+	snExpectNothing(t, sensor)
+
+	snWrite(t, sensor, snRegack, reg[:2], reg[2:4], snAccepted)
+
+	pub = snExpect(t, sensor, snPublish)
+	require.Equal(t, byte(1), snQos(pub[0]))
+	require.Equal(t, reg[:2], pub[1:3])
+	require.Equal(t, "off", string(pub[5:]))
+
+	snWrite(t, sensor, snPuback, pub[1:3], pub[3:5], snAccepted)
+
+	// Asleep, the messages are kept until the sensor wakes up
+	snWrite(t, sensor, snDisconnect, uint16(10))
+	snExpect(t, sensor, snDisconnect)
+
+	require.NoError(t, svr.Publish(msg, nil))
+	snExpectNothing(t, sensor)
+
+	snWrite(t, sensor, snPingreq, "sensor1")
+	pub = snExpect(t, sensor, snPublish)
+	require.Equal(t, "off", string(pub[5:]))
+	snWrite(t, sensor, snPuback, pub[1:3], pub[3:5], snAccepted)
+	snExpect(t, sensor, snPingresp)
+
+	// Gone for good
+	snWrite(t, sensor, snDisconnect)
+	snExpect(t, sensor, snDisconnect)
+
+	snWrite(t, sensor, snPingreq)
+	snExpect(t, sensor, snDisconnect)
+
+	// Never connected
+	other, err := net.Dial("udp", "127.0.0.1:1884")
+	require.NoError(t, err)
+	defer other.Close()
+
+	snWrite(t, other, snPublish, snFlags(1, false, false, snTopicPredefined), uint16(1), uint16(1), "22")
+	snExpect(t, other, snDisconnect)
+
+	// QoS -1 isn't allowed
+	snWrite(t, other, snPublish, snFlags(snQosMinusOne, false, false, snTopicPredefined), uint16(1), uint16(0), "22")
+	snExpectNothing(t, other)
+	expectNoMessage(t, sub)
+}
+
+// A sensor that goes quiet is lost, and its will is published.
+func TestMQTTSNGatewayWill(t *testing.T) {
+	svr, done := startNamedServer(t, "mqttsnwill", "tcp://127.0.0.1:1883", &Server{
+		MQTTSNGateways: []*MQTTSNGateway{{
+			ListenAddr:       "127.0.0.1:1884",
+			AllowQosMinusOne: true,
+			PredefinedTopics: map[uint16]string{1: "sensors/temp"},
+		}},
+	})
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	sub := dialNamedServer(t, "127.0.0.1:1883", "sensors/#")
+	defer sub.Close()
+
+	// Published without connecting
+	other, err := net.Dial("udp", "127.0.0.1:1884")
+	require.NoError(t, err)
+	defer other.Close()
+
+	snWrite(t, other, snPublish, snFlags(snQosMinusOne, false, false, snTopicPredefined), uint16(1), uint16(0), "22")
+	expectPublish(t, sub, "sensors/temp", 0)
+
+	sensor := snDialConnect(t, "sensor2", snFlagClean|snFlagWill, 1)
+	defer sensor.Close()
+
+	snExpect(t, sensor, snWillTopicReq)
+	snWrite(t, sensor, snWillTopic, snFlags(0, false, false, 0), "sensors/sensor2")
+	snExpect(t, sensor, snWillMsgReq)
+	snWrite(t, sensor, snWillMsg, "gone")
+	require.Equal(t, []byte{snAccepted}, snExpect(t, sensor, snConnack))
+
+	// Lost after one and a half seconds
+	time.Sleep(time.Second)
+
+	msg := expectMessage(t, sub, message.PUBLISH).(*message.PublishMessage)
+	require.Equal(t, "sensors/sensor2", string(msg.Topic()))
+	require.Equal(t, "gone", string(msg.Payload()))
+	require.Equal(t, message.QosAtMostOnce, msg.QoS())
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The MQTT-SN 1.2 message types the gateway knows about
+const (
+	snAdvertise    byte = 0x00
+	snSearchGw     byte = 0x01
+	snGwInfo       byte = 0x02
+	snConnect      byte = 0x04
+	snConnack      byte = 0x05
+	snWillTopicReq byte = 0x06
+	snWillTopic    byte = 0x07
+	snWillMsgReq   byte = 0x08
+	snWillMsg      byte = 0x09
+	snRegister     byte = 0x0a
+	snRegack       byte = 0x0b
+	snPublish      byte = 0x0c
+	snPuback       byte = 0x0d
+	snPubcomp      byte = 0x0e
+	snPubrec       byte = 0x0f
+	snPubrel       byte = 0x10
+	snSubscribe    byte = 0x12
+	snSuback       byte = 0x13
+	snUnsubscribe  byte = 0x14
+	snUnsuback     byte = 0x15
+	snPingreq      byte = 0x16
+	snPingresp     byte = 0x17
+	snDisconnect   byte = 0x18
+)
+
+// The bits of the flags field
+const (
+	snFlagDup     byte = 0x80
+	snFlagRetain  byte = 0x10
+	snFlagWill    byte = 0x08
+	snFlagClean   byte = 0x04
+	snQosShift         = 5
+	snQosMask     byte = 0x60
+	snTopicIdMask byte = 0x03
+)
+
+// The topic ID types, in the last 2 bits of the flags
+const (
+	snTopicNormal     byte = 0x00
+	snTopicPredefined byte = 0x01
+	snTopicShort      byte = 0x02
+)
+
+// The QoS of the PUBLISH messages sent without connecting, which is 3 in the flags
+const snQosMinusOne byte = 3
+
+// The return codes
+const (
+	snAccepted             byte = 0x00
+	snRejectedCongestion   byte = 0x01
+	snRejectedTopicId      byte = 0x02
+	snRejectedNotSupported byte = 0x03
+)
+
+// The minimum length of the body of each message type, i.e., what follows the message
+// type. Types not in here are not supported.
+var snMinLen = map[byte]int{
+	snSearchGw:    1,
+	snConnect:     4,
+	snWillTopic:   0,
+	snWillMsg:     0,
+	snRegister:    4,
+	snRegack:      5,
+	snPublish:     5,
+	snPuback:      5,
+	snPubcomp:     2,
+	snPubrec:      2,
+	snPubrel:      2,
+	snSubscribe:   3,
+	snUnsubscribe: 3,
+	snPingreq:     0,
+	snDisconnect:  0,
+}
+
+var errSNInvalidPacket = errors.New("Invalid MQTT-SN packet")
+
+// parseSNPacket returns the message type and the body of the MQTT-SN message in b,
+// checking the length is what the header says, and long enough for the type.
+func parseSNPacket(b []byte) (byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, errSNInvalidPacket
+	}
+
+	length, hdr := int(b[0]), 1
+
+	// A length of 1 means the length is in the next 2 bytes
+	if b[0] == 0x01 {
+		if len(b) < 4 {
+			return 0, nil, errSNInvalidPacket
+		}
+
+		length, hdr = int(binary.BigEndian.Uint16(b[1:])), 3
+	}
+
+	if length != len(b) || length < hdr+1 {
+		return 0, nil, errSNInvalidPacket
+	}
+
+	typ, body := b[hdr], b[hdr+1:]
+
+	min, ok := snMinLen[typ]
+	if !ok {
+		return typ, nil, fmt.Errorf("Unsupported MQTT-SN message type 0x%02x", typ)
+	}
+
+	if len(body) < min {
+		return typ, nil, errSNInvalidPacket
+	}
+
+	return typ, body, nil
+}
+
+// newSNPacket returns the MQTT-SN message of the type, with the fields in parts put
+// one after the other. Each part is a []byte, a string, a byte or a uint16.
+func newSNPacket(typ byte, parts ...interface{}) []byte {
+	body := make([]byte, 0, 16)
+
+	for _, p := range parts {
+		switch p := p.(type) {
+		case []byte:
+			body = append(body, p...)
+
+		case string:
+			body = append(body, p...)
+
+		case byte:
+			body = append(body, p)
+
+		case uint16:
+			body = append(body, byte(p>>8), byte(p))
+
+		default:
+			panic(fmt.Sprintf("newSNPacket: Unexpected %T", p))
+		}
+	}
+
+	length := len(body) + 2
+
+	if length < 256 {
+		return append([]byte{byte(length), typ}, body...)
+	}
+
+	length += 2
+
+	return append([]byte{0x01, byte(length >> 8), byte(length), typ}, body...)
+}
+
+func snQos(flags byte) byte {
+	return (flags & snQosMask) >> snQosShift
+}
+
+func snFlags(qos byte, retain, dup bool, topicIdType byte) byte {
+	flags := qos<<snQosShift | topicIdType
+
+	if retain {
+		flags |= snFlagRetain
+	}
+
+	if dup {
+		flags |= snFlagDup
+	}
+
+	return flags
+}
@@ -0,0 +1,451 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/topics"
+)
+
+// DefaultInvalidPayloadPrefix is the prefix of the topics invalid payloads are
+// published to with AnnotatePayload.
+const DefaultInvalidPayloadPrefix = "invalid/"
+
+// PayloadFunc checks the payload of a message published to topic. It returns the
+// payload to publish, which is payload itself unless it's rewritten, or an error
+// if the payload is not valid. The payload must not be modified in place.
+type PayloadFunc func(topic, payload []byte) ([]byte, error)
+
+// InvalidPayloadPolicy is what a PayloadFilter does with the messages whose payload
+// its PayloadFunc rejects.
+type InvalidPayloadPolicy int
+
+const (
+	// RejectPayload drops the message. It's been acked already, since there's no way
+	// to NAK a PUBLISH in MQTT 3.1.1, so the publisher doesn't know.
+	RejectPayload InvalidPayloadPolicy = iota
+
+	// AnnotatePayload publishes the message to the topic with the filter's
+	// InvalidPrefix in front, instead of its own, with the payload replaced by a JSON
+	// object with the error and the original payload, base64 encoded:
+	//
+	//	{"topic": "sensors/temp", "error": "...", "payload": "..."}
+	//
+	// so the subscribers of the topic don't get it, but it can be looked into.
+	AnnotatePayload
+)
+
+// PayloadFilter checks, and can rewrite, the payloads of the messages published to
+// the topics matching Filter, before they are retained and delivered.
+type PayloadFilter struct {
+	Filter string
+
+	// Check is called with each message published to the topics matching Filter.
+	// See ValidJSON, CompactJSON and JSONSchema for some ready made ones.
+	Check PayloadFunc
+
+	// OnInvalid is what's done with the messages Check rejects.
+	OnInvalid InvalidPayloadPolicy
+
+	// InvalidPrefix is put in front of the topic of the messages published with
+	// AnnotatePayload. If not set then default to "invalid/".
+	InvalidPrefix string
+}
+
+// payloadFilters matches topics to Server.PayloadFilters.
+type payloadFilters struct {
+	filters []PayloadFilter
+	tree    topics.TopicsProvider
+}
+
+// newPayloadFilters returns the payloadFilters for filters, nil if there are none.
+func newPayloadFilters(filters []PayloadFilter) (*payloadFilters, error) {
+	if len(filters) == 0 {
+		return nil, nil
+	}
+
+	this := &payloadFilters{
+		filters: append([]PayloadFilter(nil), filters...),
+		tree:    topics.NewMemProvider(),
+	}
+
+	for i := range this.filters {
+		f := &this.filters[i]
+
+		if f.Check == nil {
+			return nil, fmt.Errorf("server/newPayloadFilters: No Check function for topic filter %q", f.Filter)
+		}
+
+		if f.OnInvalid < RejectPayload || f.OnInvalid > AnnotatePayload {
+			return nil, fmt.Errorf("server/newPayloadFilters: Invalid policy %d for topic filter %q", f.OnInvalid, f.Filter)
+		}
+
+		if f.InvalidPrefix == "" {
+			f.InvalidPrefix = DefaultInvalidPayloadPrefix
+		}
+
+		if _, err := this.tree.Subscribe([]byte(f.Filter), message.QosExactlyOnce, f); err != nil {
+			return nil, fmt.Errorf("server/newPayloadFilters: Invalid topic filter %q: %v", f.Filter, err)
+		}
+	}
+
+	return this, nil
+}
+
+// check runs the filters matching the topic of msg on it, in the order they were
+// given, each getting the payload returned by the one before it. The payload and,
+// for AnnotatePayload, the topic of msg are replaced. It returns false if the
+// message is rejected, and the error of the filter that found the payload invalid,
+// if any. Nothing is checked on a nil *payloadFilters.
+func (this *payloadFilters) check(msg *message.PublishMessage) (bool, error) {
+	if this == nil {
+		return true, nil
+	}
+
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	if err := this.tree.Subscribers(msg.Topic(), message.QosAtMostOnce, &subs, &qoss); err != nil || len(subs) == 0 {
+		return true, nil
+	}
+
+	payload := msg.Payload()
+
+	for i := range this.filters {
+		f := &this.filters[i]
+
+		if !containsSubscriber(subs, f) {
+			continue
+		}
+
+		p, err := f.Check(msg.Topic(), payload)
+		if err == nil {
+			payload = p
+			continue
+		}
+
+		if f.OnInvalid == RejectPayload {
+			return false, err
+		}
+
+		annotated, jerr := json.Marshal(struct {
+			Topic   string `json:"topic"`
+			Error   string `json:"error"`
+			Payload []byte `json:"payload"`
+		}{string(msg.Topic()), err.Error(), msg.Payload()})
+		if jerr != nil {
+			return false, jerr
+		}
+
+		if terr := msg.SetTopic([]byte(f.InvalidPrefix + string(msg.Topic()))); terr != nil {
+			return false, terr
+		}
+
+		msg.SetPayload(annotated)
+
+		return true, err
+	}
+
+	msg.SetPayload(payload)
+
+	return true, nil
+}
+
+func containsSubscriber(subs []interface{}, sub interface{}) bool {
+	for _, s := range subs {
+		if s == sub {
+			return true
+		}
+	}
+
+	return false
+}
+
+var errNotJSON = errors.New("Payload is not valid JSON")
+
+// ValidJSON rejects payloads that aren't valid JSON.
+func ValidJSON(topic, payload []byte) ([]byte, error) {
+	if !json.Valid(payload) {
+		return nil, errNotJSON
+	}
+
+	return payload, nil
+}
+
+// CompactJSON rejects payloads that aren't valid JSON, and re-encodes the others
+// without the insignificant white space.
+func CompactJSON(topic, payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := json.Compact(&buf, payload); err != nil {
+		return nil, errNotJSON
+	}
+
+	return buf.Bytes(), nil
+}
+
+// JSONSchema returns a PayloadFunc that rejects the payloads that aren't JSON valid
+// against schema. Only the structural keywords of JSON Schema are supported: type,
+// enum, properties, required, additionalProperties, as a boolean, items, minimum,
+// maximum, minLength and maxLength. Schemas with other keywords, or with references,
+// are not accepted, rather than checked less than they say.
+func JSONSchema(schema []byte) (PayloadFunc, error) {
+	s, err := compileJSONSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(topic, payload []byte) ([]byte, error) {
+		var v interface{}
+
+		if err := json.Unmarshal(payload, &v); err != nil {
+			return nil, errNotJSON
+		}
+
+		if err := s.validate(v, "$"); err != nil {
+			return nil, err
+		}
+
+		return payload, nil
+	}, nil
+}
+
+type jsonSchema struct {
+	Type                 jsonTypes              `json:"type"`
+	Enum                 []interface{}          `json:"enum"`
+	Properties           map[string]*jsonSchema `json:"-"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"-"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+}
+
+// jsonTypes is the type keyword, which is either one type or a list of them.
+type jsonTypes []string
+
+func (this *jsonTypes) UnmarshalJSON(b []byte) error {
+	var t string
+
+	if err := json.Unmarshal(b, &t); err == nil {
+		*this = jsonTypes{t}
+		return nil
+	}
+
+	return json.Unmarshal(b, (*[]string)(this))
+}
+
+// The keywords of the schemas that aren't validation keywords, which are ignored
+var jsonSchemaAnnotations = map[string]bool{
+	"$schema":     true,
+	"$id":         true,
+	"title":       true,
+	"description": true,
+	"default":     true,
+	"examples":    true,
+}
+
+func compileJSONSchema(b []byte) (*jsonSchema, error) {
+	var raw map[string]json.RawMessage
+
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("JSONSchema: %v", err)
+	}
+
+	s := &jsonSchema{}
+
+	if p, ok := raw["properties"]; ok {
+		var props map[string]json.RawMessage
+
+		if err := json.Unmarshal(p, &props); err != nil {
+			return nil, fmt.Errorf("JSONSchema: %v", err)
+		}
+
+		s.Properties = make(map[string]*jsonSchema, len(props))
+
+		for name, ps := range props {
+			ss, err := compileJSONSchema(ps)
+			if err != nil {
+				return nil, err
+			}
+
+			s.Properties[name] = ss
+		}
+	}
+
+	if p, ok := raw["items"]; ok {
+		ss, err := compileJSONSchema(p)
+		if err != nil {
+			return nil, err
+		}
+
+		s.Items = ss
+	}
+
+	for k := range raw {
+		if jsonSchemaAnnotations[k] || k == "properties" || k == "items" {
+			delete(raw, k)
+		}
+	}
+
+	// Decoded again without the subschemas and annotations, so any keyword left that
+	// jsonSchema doesn't have is an error
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("JSONSchema: %v", err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(s); err != nil {
+		return nil, fmt.Errorf("JSONSchema: %v", err)
+	}
+
+	for _, t := range s.Type {
+		switch t {
+		case "object", "array", "string", "number", "integer", "boolean", "null":
+		default:
+			return nil, fmt.Errorf("JSONSchema: Unknown type %q", t)
+		}
+	}
+
+	return s, nil
+}
+
+// validate checks v, decoded from JSON, against the schema. path is where v is in
+// the payload, for the error.
+func (this *jsonSchema) validate(v interface{}, path string) error {
+	if len(this.Type) > 0 && !this.Type.match(v) {
+		return fmt.Errorf("%s: Expecting %v, got %s", path, []string(this.Type), jsonTypeOf(v))
+	}
+
+	if len(this.Enum) > 0 {
+		found := false
+
+		for _, e := range this.Enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("%s: Not one of %v", path, this.Enum)
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range this.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: Missing property %q", path, name)
+			}
+		}
+
+		for name, pv := range v {
+			ps, ok := this.Properties[name]
+			if !ok {
+				if this.AdditionalProperties != nil && !*this.AdditionalProperties {
+					return fmt.Errorf("%s: Unexpected property %q", path, name)
+				}
+
+				continue
+			}
+
+			if err := ps.validate(pv, path+"."+name); err != nil {
+				return err
+			}
+		}
+
+	case []interface{}:
+		if this.Items != nil {
+			for i, iv := range v {
+				if err := this.Items.validate(iv, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+
+	case string:
+		n := len([]rune(v))
+
+		if this.MinLength != nil && n < *this.MinLength {
+			return fmt.Errorf("%s: Shorter than %d", path, *this.MinLength)
+		}
+
+		if this.MaxLength != nil && n > *this.MaxLength {
+			return fmt.Errorf("%s: Longer than %d", path, *this.MaxLength)
+		}
+
+	case float64:
+		if this.Minimum != nil && v < *this.Minimum {
+			return fmt.Errorf("%s: Less than %v", path, *this.Minimum)
+		}
+
+		if this.Maximum != nil && v > *this.Maximum {
+			return fmt.Errorf("%s: More than %v", path, *this.Maximum)
+		}
+	}
+
+	return nil
+}
+
+func (this jsonTypes) match(v interface{}) bool {
+	t := jsonTypeOf(v)
+
+	for _, want := range this {
+		if want == t || want == "number" && t == "integer" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func jsonTypeOf(v interface{}) string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return "object"
+
+	case []interface{}:
+		return "array"
+
+	case string:
+		return "string"
+
+	case float64:
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return "integer"
+		}
+		return "number"
+
+	case bool:
+		return "boolean"
+	}
+
+	return "null"
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestJSONSchema(t *testing.T) {
+	check, err := JSONSchema([]byte(`{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"title": "Reading",
+		"type": "object",
+		"required": ["sensor", "value"],
+		"additionalProperties": false,
+		"properties": {
+			"sensor": {"type": "string", "minLength": 1, "maxLength": 8},
+			"value": {"type": "number", "minimum": -40, "maximum": 85},
+			"unit": {"enum": ["C", "F"]},
+			"tags": {"type": "array", "items": {"type": "string"}},
+			"count": {"type": ["integer", "null"]}
+		}
+	}`))
+	require.NoError(t, err)
+
+	for _, p := range []string{
+		`{"sensor": "t1", "value": 21.5}`,
+		`{"sensor": "t1", "value": -40, "unit": "C", "tags": ["a", "b"], "count": 3}`,
+		`{"sensor": "t1", "value": 85, "count": null}`,
+	} {
+		out, err := check([]byte("abc"), []byte(p))
+		require.NoError(t, err, p)
+		require.Equal(t, p, string(out))
+	}
+
+	for _, p := range []string{
+		`not json`,
+		`[]`,
+		`{"sensor": "t1"}`,
+		`{"sensor": "", "value": 1}`,
+		`{"sensor": "t123456789", "value": 1}`,
+		`{"sensor": "t1", "value": 86}`,
+		`{"sensor": "t1", "value": "21"}`,
+		`{"sensor": "t1", "value": 1, "unit": "K"}`,
+		`{"sensor": "t1", "value": 1, "tags": [1]}`,
+		`{"sensor": "t1", "value": 1, "count": 1.5}`,
+		`{"sensor": "t1", "value": 1, "other": true}`,
+	} {
+		_, err := check([]byte("abc"), []byte(p))
+		require.Error(t, err, p)
+	}
+
+	for _, s := range []string{
+		`[]`,
+		`{"type": "thing"}`,
+		`{"$ref": "#/definitions/reading"}`,
+		`{"properties": {"a": {"pattern": "^a"}}}`,
+		`{"items": [{"type": "string"}]}`,
+		`{"additionalProperties": {"type": "string"}}`,
+	} {
+		_, err := JSONSchema([]byte(s))
+		require.Error(t, err, s)
+	}
+}
+
+func TestCompactJSON(t *testing.T) {
+	out, err := CompactJSON(nil, []byte("{ \"a\": [1, 2],\n \"b\": true }"))
+	require.NoError(t, err)
+	require.Equal(t, `{"a":[1,2],"b":true}`, string(out))
+
+	_, err = CompactJSON(nil, []byte("{"))
+	require.Error(t, err)
+
+	_, err = ValidJSON(nil, []byte("{"))
+	require.Error(t, err)
+}
+
+func TestPayloadFilters(t *testing.T) {
+	pf, err := newPayloadFilters(nil)
+	require.NoError(t, err)
+	require.Nil(t, pf)
+
+	ok, err := pf.check(newPublishMessage(0, 0))
+	require.True(t, ok)
+	require.NoError(t, err)
+
+	for _, filters := range [][]PayloadFilter{
+		{{Filter: "a/#"}},
+		{{Filter: "a/#", Check: ValidJSON, OnInvalid: 2}},
+		{{Filter: "a/#/b", Check: ValidJSON}},
+	} {
+		_, err := newPayloadFilters(filters)
+		require.Error(t, err)
+	}
+
+	pf, err = newPayloadFilters([]PayloadFilter{
+		{Filter: "a/#", Check: CompactJSON},
+		{Filter: "a/strict", Check: ValidJSON},
+		{Filter: "a/+", Check: ValidJSON, OnInvalid: AnnotatePayload},
+		{Filter: "b", Check: func(topic, payload []byte) ([]byte, error) {
+			return append([]byte("b:"), payload...), nil
+		}},
+	})
+	require.NoError(t, err)
+
+	// Rewritten by the first filter, and checked by the others
+	msg := newPayloadMessage(0, 0, `{ "a": 1 }`)
+	msg.SetTopic([]byte("a/b"))
+
+	ok, err = pf.check(msg)
+	require.True(t, ok)
+	require.NoError(t, err)
+	require.Equal(t, "a/b", string(msg.Topic()))
+	require.Equal(t, `{"a":1}`, string(msg.Payload()))
+
+	// Rejected by the first filter matching
+	msg = newPayloadMessage(0, 0, "x")
+	msg.SetTopic([]byte("a/strict"))
+
+	ok, err = pf.check(msg)
+	require.False(t, ok)
+	require.Error(t, err)
+
+	// Annotated
+	pf.filters[0].OnInvalid = AnnotatePayload
+
+	msg = newPayloadMessage(0, 0, "x")
+	msg.SetTopic([]byte("a/b"))
+
+	ok, err = pf.check(msg)
+	require.True(t, ok)
+	require.Error(t, err)
+	require.Equal(t, "invalid/a/b", string(msg.Topic()))
+
+	var annotated struct {
+		Topic   string
+		Error   string
+		Payload []byte
+	}
+
+	require.NoError(t, json.Unmarshal(msg.Payload(), &annotated))
+	require.Equal(t, "a/b", annotated.Topic)
+	require.Equal(t, errNotJSON.Error(), annotated.Error)
+	require.Equal(t, "x", string(annotated.Payload))
+
+	// Not matched by any of them
+	msg = newPayloadMessage(0, 0, "x")
+	msg.SetTopic([]byte("c"))
+
+	ok, err = pf.check(msg)
+	require.True(t, ok)
+	require.NoError(t, err)
+	require.Equal(t, "x", string(msg.Payload()))
+
+	msg.SetTopic([]byte("b"))
+
+	ok, err = pf.check(msg)
+	require.True(t, ok)
+	require.NoError(t, err)
+	require.Equal(t, "b:x", string(msg.Payload()))
+}
+
+func TestServerPayloadFilters(t *testing.T) {
+	svr, done := startNamedServer(t, "payloads", "tcp://127.0.0.1:1883", &Server{
+		PayloadFilters: []PayloadFilter{
+			{Filter: "abc", Check: CompactJSON},
+			{Filter: "def", Check: ValidJSON, OnInvalid: AnnotatePayload},
+		},
+	})
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	sub := dialNamedServer(t, "127.0.0.1:1883", "#")
+	defer sub.Close()
+
+	pub := dialNamedServer(t, "127.0.0.1:1883", "nothing")
+	defer pub.Close()
+
+	require.NoError(t, writeMessage(pub, newPayloadMessage(1, 1, "[1, 2]")))
+	expectMessage(t, pub, message.PUBACK)
+
+	msg := expectMessage(t, sub, message.PUBLISH).(*message.PublishMessage)
+	require.Equal(t, "abc", string(msg.Topic()))
+	require.Equal(t, "[1,2]", string(msg.Payload()))
+
+	ack := message.NewPubackMessage()
+	ack.SetPacketId(msg.PacketId())
+	require.NoError(t, writeMessage(sub, ack))
+
+	// Still acked, but dropped
+	require.NoError(t, writeMessage(pub, newPayloadMessage(2, 1, "[1, 2")))
+	expectMessage(t, pub, message.PUBACK)
+	expectNoMessage(t, sub)
+
+	msg = newPayloadMessage(0, 0, "[1, 2")
+	msg.SetTopic([]byte("def"))
+	require.NoError(t, writeMessage(pub, msg))
+
+	msg = expectMessage(t, sub, message.PUBLISH).(*message.PublishMessage)
+	require.Equal(t, "invalid/def", string(msg.Topic()))
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"math/bits"
+	"sync"
+
+	"github.com/surgemq/message"
+)
+
+const (
+	// The buffers are pooled by size, in powers of 2, from 64 bytes up to the size
+	// of the largest MQTT packet. Larger ones are not pooled.
+	minBufferBits = 6
+	maxBufferBits = 28
+)
+
+var (
+	bufferPools [maxBufferBits + 1]sync.Pool
+
+	// The messages of each type for decoding incoming packets into, and for sending.
+	// They are kept apart since a decoded message refers to the buffer it was decoded
+	// from, and changing it would change the buffer.
+	inPools  [message.RESERVED2 + 1]sync.Pool
+	outPools [message.RESERVED2 + 1]sync.Pool
+)
+
+// pooled returns whether the incoming messages of the type can be pooled. The other
+// ones, e.g., PUBLISH and SUBSCRIBE, can be held on to by subscribers, hooks and
+// the stores, so they are left to the garbage collector.
+func pooled(mtype message.MessageType) bool {
+	switch mtype {
+	case message.PUBACK, message.PUBREC, message.PUBREL, message.PUBCOMP,
+		message.SUBACK, message.UNSUBACK, message.PINGREQ, message.PINGRESP:
+		return true
+	}
+
+	return false
+}
+
+// getBuffer returns a buffer of n bytes, from the pool if there's one in it. The
+// content is not cleared. It should be given back with putBuffer() once it's no
+// longer used.
+func getBuffer(n int) *[]byte {
+	i := bufferIndex(n)
+	if i > maxBufferBits {
+		b := make([]byte, n)
+		return &b
+	}
+
+	if b, ok := bufferPools[i].Get().(*[]byte); ok {
+		*b = (*b)[:n]
+		return b
+	}
+
+	b := make([]byte, n, 1<<uint(i))
+	return &b
+}
+
+// putBuffer gives back a buffer from getBuffer(). It must not be used after.
+func putBuffer(b *[]byte) {
+	c := cap(*b)
+
+	i := bufferIndex(c)
+	if i > maxBufferBits || c != 1<<uint(i) {
+		return
+	}
+
+	bufferPools[i].Put(b)
+}
+
+// bufferIndex returns the pool for buffers of n bytes.
+func bufferIndex(n int) int {
+	if n <= 1<<minBufferBits {
+		return minBufferBits
+	}
+
+	return bits.Len(uint(n - 1))
+}
+
+// getMessage returns a message of the type for decoding an incoming packet into,
+// from the pool if it's one of the types that are pooled.
+func getMessage(mtype message.MessageType) (message.Message, error) {
+	if pooled(mtype) {
+		if msg, ok := inPools[mtype].Get().(message.Message); ok {
+			return msg, nil
+		}
+	}
+
+	return mtype.New()
+}
+
+// putMessage gives back a message from getMessage() once it's been processed. It
+// must not be used after. Messages of the types that are not pooled are left alone.
+func putMessage(msg message.Message) {
+	if mtype := msg.Type(); pooled(mtype) {
+		inPools[mtype].Put(msg)
+	}
+}
+
+// getAck returns a PUBACK, PUBREC, PUBREL or PUBCOMP message to send for pktid.
+func getAck(mtype message.MessageType, pktid uint16) message.Message {
+	msg, ok := outPools[mtype].Get().(message.Message)
+	if !ok {
+		msg, _ = mtype.New()
+	}
+
+	msg.(interface {
+		SetPacketId(uint16)
+	}).SetPacketId(pktid)
+
+	return msg
+}
+
+// getPublish returns a PUBLISH message to send. It's not cleared, so all of its
+// fields should be set.
+func getPublish() *message.PublishMessage {
+	if msg, ok := outPools[message.PUBLISH].Get().(*message.PublishMessage); ok {
+		return msg
+	}
+
+	return message.NewPublishMessage()
+}
+
+// putSent gives back a message from getAck() or getPublish() once it's been sent.
+// It must not be used after.
+func putSent(msg message.Message) {
+	outPools[msg.Type()].Put(msg)
+}
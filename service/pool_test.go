@@ -0,0 +1,174 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+func TestBufferPool(t *testing.T) {
+	for _, test := range []struct {
+		n, cap int
+	}{
+		{0, 64},
+		{1, 64},
+		{64, 64},
+		{65, 128},
+		{1000, 1024},
+		{1024, 1024},
+		{1 << 20, 1 << 20},
+	} {
+		b := getBuffer(test.n)
+		require.Equal(t, test.n, len(*b))
+		require.Equal(t, test.cap, cap(*b))
+		putBuffer(b)
+	}
+
+	// Too large to pool
+	b := getBuffer(1<<maxBufferBits + 1)
+	require.Equal(t, 1<<maxBufferBits+1, len(*b))
+	putBuffer(b)
+}
+
+func TestMessagePool(t *testing.T) {
+	ack := getAck(message.PUBACK, 7)
+	require.Equal(t, message.PUBACK, ack.Type())
+	require.Equal(t, uint16(7), ack.PacketId())
+	putSent(ack)
+
+	ack = getAck(message.PUBACK, 8)
+	require.Equal(t, uint16(8), ack.PacketId())
+
+	buf := make([]byte, ack.Len())
+	_, err := ack.Encode(buf)
+	require.NoError(t, err)
+	putSent(ack)
+
+	msg, err := getMessage(message.PUBACK)
+	require.NoError(t, err)
+
+	_, err = msg.Decode(buf)
+	require.NoError(t, err)
+	require.Equal(t, uint16(8), msg.PacketId())
+	putMessage(msg)
+
+	// PUBLISH messages are never pooled when they come in
+	pub, err := getMessage(message.PUBLISH)
+	require.NoError(t, err)
+	putMessage(pub)
+
+	pub2, err := getMessage(message.PUBLISH)
+	require.NoError(t, err)
+	require.True(t, pub != pub2)
+}
+
+func TestServiceOutboundPooled(t *testing.T) {
+	svc := &service{sess: &sessions.Session{}}
+
+	msg := newPublishMessage(1, 1)
+
+	out := svc.outbound(msg)
+	out.SetDup(true)
+	putSent(out)
+
+	out = svc.outbound(msg)
+	require.False(t, out.Dup())
+	require.Equal(t, msg.QoS(), out.QoS())
+	require.Equal(t, msg.Topic(), out.Topic())
+	require.Equal(t, msg.Payload(), out.Payload())
+}
+
+// benchmarkAck sends, and then reads back, b.N PUBACK messages through a ring
+// buffer, using the pool or not.
+func benchmarkAck(b *testing.B, pool bool) {
+	svc := &service{}
+	svc.out, _ = newBuffer(16384)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var ack message.Message
+
+		if pool {
+			ack = getAck(message.PUBACK, uint16(i))
+		} else {
+			m := message.NewPubackMessage()
+			m.SetPacketId(uint16(i))
+			ack = m
+		}
+
+		if _, err := svc.writeMessage(ack); err != nil {
+			b.Fatal(err)
+		}
+
+		buf, err := svc.out.ReadPeek(ack.Len())
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		var in message.Message
+
+		if pool {
+			putSent(ack)
+			in, _ = getMessage(message.PUBACK)
+		} else {
+			in, _ = message.PUBACK.New()
+		}
+
+		if _, err := in.Decode(buf); err != nil {
+			b.Fatal(err)
+		}
+
+		if pool {
+			putMessage(in)
+		}
+
+		svc.out.ReadCommit(len(buf))
+	}
+}
+
+func BenchmarkAck(b *testing.B) {
+	benchmarkAck(b, false)
+}
+
+func BenchmarkAckPooled(b *testing.B) {
+	benchmarkAck(b, true)
+}
+
+// BenchmarkWriteMessageWrap writes PUBLISH messages that never fit at the end of
+// the ring buffer, so they are encoded into a temporary buffer first.
+func BenchmarkWriteMessageWrap(b *testing.B) {
+	svc := &service{}
+	svc.out, _ = newBuffer(16384)
+
+	msg := newPublishMessage(1, 1)
+	msg.SetPayload(make([]byte, 10000))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := svc.writeMessage(msg); err != nil {
+			b.Fatal(err)
+		}
+
+		svc.out.ReadCommit(msg.Len())
+	}
+}
@@ -15,18 +15,30 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"reflect"
+	"runtime"
+	"sync/atomic"
+	"time"
 
-	"github.com/surge/glog"
 	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/auth"
+	"github.com/surgemq/surgemq/logger"
 	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/topics"
+)
+
+const (
+	// Number of retained messages to send before checking if the service is done
+	retainedChunkSize = 256
 )
 
 var (
-	errDisconnect = errors.New("Disconnect")
+	errDisconnect       = errors.New("Disconnect")
+	errReceiveMaxExceed = errors.New("Too many incoming QoS 2 messages waiting for PUBREL")
 )
 
 // processor() reads messages from the incoming buffer and processes them
@@ -43,7 +55,7 @@ func (this *service) processor() {
 		//glog.Debugf("(%s) Stopping processor", this.cid())
 	}()
 
-	glog.Debugf("(%s) Starting processor", this.cid())
+	this.log.Debugf("(%s) Starting processor", this.cid())
 
 	this.wgStarted.Done()
 
@@ -52,15 +64,33 @@ func (this *service) processor() {
 		mtype, total, err := this.peekMessageSize()
 		if err != nil {
 			//if err != io.EOF {
-			glog.Errorf("(%s) Error peeking next message size: %v", this.cid(), err)
+			this.log.Errorf("(%s) Error peeking next message size: %v", this.cid(), err)
 			//}
 			return
 		}
 
 		msg, n, err := this.peekMessage(mtype, total)
+		if err == errDisconnectWithWill {
+			return
+		}
+
+		// AUTH messages are done with by the time they are committed
+		if err == errAuth5 {
+			if err = this.reauthenticate(); err == nil {
+				_, err = this.in.ReadCommit(total)
+			}
+
+			if err != nil {
+				this.log.Errorf("(%s) Error re-authenticating: %v", this.cid(), err)
+				return
+			}
+
+			continue
+		}
+
 		if err != nil {
 			//if err != io.EOF {
-			glog.Errorf("(%s) Error peeking next message: %v", this.cid(), err)
+			this.log.Errorf("(%s) Error peeking next message: %v", this.cid(), err)
 			//}
 			return
 		}
@@ -68,22 +98,41 @@ func (this *service) processor() {
 		//glog.Debugf("(%s) Received: %s", this.cid(), msg)
 
 		this.inStat.increment(int64(n))
+		this.counters.receivedBytes(int64(n))
+		atomic.StoreInt64(&this.lastActivity, time.Now().UnixNano())
+
+		// Check what the decoder doesn't. See Lenient.
+		if err = this.validateIncoming(msg); err != nil {
+			this.log.Errorf("(%s) Invalid %s: %v", this.cid(), msg.Name(), err)
+			return
+		}
 
 		// 5. Process the read message
 		err = this.processIncoming(msg)
 		if err != nil {
-			if err != errDisconnect {
-				glog.Errorf("(%s) Error processing %s: %v", this.cid(), msg.Name(), err)
-			} else {
+			if err == errDisconnect {
+				return
+			}
+
+			this.log.Errorf("(%s) Error processing %s: %v", this.cid(), msg.Name(), err)
+
+			// The client is flooding us with QoS 2 messages faster than it's releasing
+			// them, or going over the other limits. Drop the connection rather than
+			// keep growing the ack queue, or spend more on it.
+			if err == errReceiveMaxExceed || err == errPublishRateExceed || err == errPayloadTooLarge {
 				return
 			}
 		}
 
+		// The message is done with, and the buffer it was decoded from is about to be
+		// reused
+		putMessage(msg)
+
 		// 7. We should commit the bytes in the buffer so we can move on
 		_, err = this.in.ReadCommit(total)
 		if err != nil {
 			if err != io.EOF {
-				glog.Errorf("(%s) Error committing %d read bytes: %v", this.cid(), total, err)
+				this.log.Errorf("(%s) Error committing %d read bytes: %v", this.cid(), total, err)
 			}
 			return
 		}
@@ -114,28 +163,54 @@ func (this *service) processIncoming(msg message.Message) error {
 		// For PUBACK message, it means QoS 1, we should send to ack queue
 		this.sess.Pub1ack.Ack(msg)
 		this.processAcked(this.sess.Pub1ack)
+		this.persistSession()
+		this.sendQueued()
 
 	case *message.PubrecMessage:
 		// For PUBREC message, it means QoS 2, we should send to ack queue, and send back PUBREL
+		this.trace("Received", message.PUBREC, msg.PacketId(), nil)
+
+		this.notFound5(message.PUBREL, this.sess.Pub2out, msg.PacketId())
+
 		if err = this.sess.Pub2out.Ack(msg); err != nil {
 			break
 		}
 
-		resp := message.NewPubrelMessage()
-		resp.SetPacketId(msg.PacketId())
-		_, err = this.writeMessage(resp)
+		this.persistSession()
+
+		resp := getAck(message.PUBREL, msg.PacketId())
+		if _, err = this.writeMessage(resp); err == nil {
+			this.trace("Sent", message.PUBREL, resp.PacketId(), nil)
+		}
+		putSent(resp)
 
 	case *message.PubrelMessage:
 		// For PUBREL message, it means QoS 2, we should send to ack queue, and send back PUBCOMP
+		this.notFound5(message.PUBCOMP, this.sess.Pub2in, msg.PacketId())
+
 		if err = this.sess.Pub2in.Ack(msg); err != nil {
 			break
 		}
 
+		// The PUBCOMP waits for the connectors instead
+		if this.holdAcks {
+			this.held = this.holdAck(message.PUBCOMP, msg.PacketId(), nil)
+			this.processAcked(this.sess.Pub2in)
+			this.held.release()
+			this.held = nil
+
+			this.persistSession()
+			break
+		}
+
 		this.processAcked(this.sess.Pub2in)
+		this.persistSession()
 
-		resp := message.NewPubcompMessage()
-		resp.SetPacketId(msg.PacketId())
-		_, err = this.writeMessage(resp)
+		resp := getAck(message.PUBCOMP, msg.PacketId())
+		if _, err = this.writeMessage(resp); err == nil {
+			this.trace("Sent", message.PUBCOMP, resp.PacketId(), nil)
+		}
+		putSent(resp)
 
 	case *message.PubcompMessage:
 		// For PUBCOMP message, it means QoS 2, we should send to ack queue
@@ -144,6 +219,8 @@ func (this *service) processIncoming(msg message.Message) error {
 		}
 
 		this.processAcked(this.sess.Pub2out)
+		this.persistSession()
+		this.sendQueued()
 
 	case *message.SubscribeMessage:
 		// For SUBSCRIBE message, we should add subscriber, then send back SUBACK
@@ -182,7 +259,7 @@ func (this *service) processIncoming(msg message.Message) error {
 	}
 
 	if err != nil {
-		glog.Debugf("(%s) Error processing acked message: %v", this.cid(), err)
+		this.log.Debugf("(%s) Error processing acked message: %v", this.cid(), err)
 	}
 
 	return err
@@ -193,28 +270,32 @@ func (this *service) processAcked(ackq *sessions.Ackqueue) {
 		// Let's get the messages from the saved message byte slices.
 		msg, err := ackmsg.Mtype.New()
 		if err != nil {
-			glog.Errorf("process/processAcked: Unable to creating new %s message: %v", ackmsg.Mtype, err)
+			this.log.Errorf("process/processAcked: Unable to creating new %s message: %v", ackmsg.Mtype, err)
 			continue
 		}
 
 		if _, err := msg.Decode(ackmsg.Msgbuf); err != nil {
-			glog.Errorf("process/processAcked: Unable to decode %s message: %v", ackmsg.Mtype, err)
+			this.log.Errorf("process/processAcked: Unable to decode %s message: %v", ackmsg.Mtype, err)
 			continue
 		}
 
 		ack, err := ackmsg.State.New()
 		if err != nil {
-			glog.Errorf("process/processAcked: Unable to creating new %s message: %v", ackmsg.State, err)
+			this.log.Errorf("process/processAcked: Unable to creating new %s message: %v", ackmsg.State, err)
 			continue
 		}
 
 		if _, err := ack.Decode(ackmsg.Ackbuf); err != nil {
-			glog.Errorf("process/processAcked: Unable to decode %s message: %v", ackmsg.State, err)
+			this.log.Errorf("process/processAcked: Unable to decode %s message: %v", ackmsg.State, err)
 			continue
 		}
 
 		//glog.Debugf("(%s) Processing acked message: %v", this.cid(), ack)
 
+		if pmsg, ok := msg.(*message.PublishMessage); ok {
+			this.trace("Received", ackmsg.State, ackmsg.Pktid, pmsg.Topic())
+		}
+
 		// - PUBACK if it's QoS 1 message. This is on the client side.
 		// - PUBREL if it's QoS 2 message. This is on the server side.
 		// - PUBCOMP if it's QoS 2 message. This is on the client side.
@@ -224,12 +305,23 @@ func (this *service) processAcked(ackq *sessions.Ackqueue) {
 		case message.PUBREL:
 			// If ack is PUBREL, that means the QoS 2 message sent by a remote client is
 			// releassed, so let's publish it to other subscribers.
-			if err = this.onPublish(msg.(*message.PublishMessage)); err != nil {
-				glog.Errorf("(%s) Error processing ack'ed %s message: %v", this.cid(), ackmsg.Mtype, err)
+			pmsg := msg.(*message.PublishMessage)
+
+			if this.v5 != nil {
+				this.msgProps.add(pmsg, this.v5.takeProps2(ackmsg.Pktid))
+			}
+
+			ctx, span := this.releaseTrace(pmsg)
+
+			if err = this.onPublish(ctx, pmsg); err != nil {
+				this.log.Errorf("(%s) Error processing ack'ed %s message: %v", this.cid(), ackmsg.Mtype, err)
 			}
 
+			span.End(err)
+			this.msgProps.del(pmsg)
+
 		case message.PUBACK, message.PUBCOMP, message.SUBACK, message.UNSUBACK, message.PINGRESP:
-			glog.Debugf("process/processAcked: %s", ack)
+			this.log.Debugf("process/processAcked: %s", ack)
 			// If ack is PUBACK, that means the QoS 1 message sent by this service got
 			// ack'ed. There's nothing to do other than calling onComplete() below.
 
@@ -248,7 +340,7 @@ func (this *service) processAcked(ackq *sessions.Ackqueue) {
 			err = nil
 
 		default:
-			glog.Errorf("(%s) Invalid ack message type %s.", this.cid(), ackmsg.State)
+			this.log.Errorf("(%s) Invalid ack message type %s.", this.cid(), ackmsg.State)
 			continue
 		}
 
@@ -256,10 +348,10 @@ func (this *service) processAcked(ackq *sessions.Ackqueue) {
 		if ackmsg.OnComplete != nil {
 			onComplete, ok := ackmsg.OnComplete.(OnCompleteFunc)
 			if !ok {
-				glog.Errorf("process/processAcked: Error type asserting onComplete function: %v", reflect.TypeOf(ackmsg.OnComplete))
+				this.log.Errorf("process/processAcked: Error type asserting onComplete function: %v", reflect.TypeOf(ackmsg.OnComplete))
 			} else if onComplete != nil {
 				if err := onComplete(msg, ack, nil); err != nil {
-					glog.Errorf("process/processAcked: Error running onComplete(): %v", err)
+					this.log.Errorf("process/processAcked: Error running onComplete(): %v", err)
 				}
 			}
 		}
@@ -271,33 +363,123 @@ func (this *service) processAcked(ackq *sessions.Ackqueue) {
 // If QoS == 1, we should send back PUBACK, then take the next step
 // If QoS == 2, we need to put it in the ack queue, send back PUBREC
 func (this *service) processPublish(msg *message.PublishMessage) error {
+	this.trace("Received", message.PUBLISH, msg.PacketId(), msg.Topic())
+	this.counters.receivedPublish(msg.QoS())
+	atomic.AddInt64(&this.publishedIn, 1)
+
+	if this.maxPayloadSize > 0 && len(msg.Payload()) > this.maxPayloadSize {
+		return errPayloadTooLarge
+	}
+
+	if this.publishLimit != nil && !this.publishLimit.allow(time.Now()) {
+		return errPublishRateExceed
+	}
+
+	// The properties of the message from a MQTT 5.0 client go with it to the
+	// subscribers. The ones of QoS 2 messages are kept until the PUBREL.
+	if this.v5 != nil && msg.QoS() != message.QosExactlyOnce {
+		this.msgProps.add(msg, this.v5.props)
+		defer this.msgProps.del(msg)
+	}
+
 	switch msg.QoS() {
 	case message.QosExactlyOnce:
-		this.sess.Pub2in.Wait(msg, nil)
+		// A PUBLISH with the packet ID of a message still waiting for PUBREL is sent
+		// again by the client, e.g., because the PUBREC got lost. The message is only
+		// published once the PUBREL comes in, so all it needs is another PUBREC.
+		// Retransmitted messages don't count against the limit since they don't add
+		// to the ack queue.
+		if this.sess.Pub2in.Has(msg.PacketId()) {
+			this.log.Debugf("(%s) Received duplicate PUBLISH, Packet ID=%d", this.cid(), msg.PacketId())
+		} else {
+			if this.receiveMaximum > 0 && this.sess.Pub2in.Len() >= this.receiveMaximum {
+				return errReceiveMaxExceed
+			}
 
-		resp := message.NewPubrecMessage()
-		resp.SetPacketId(msg.PacketId())
+			// MQTT 5.0 clients are told right away if the message won't be published
+			if reason := this.refuse5(msg); reason != 0 {
+				this.counters.droppedMessage()
+				this.v5.takeProps2(msg.PacketId())
+				this.v5.reason(message.PUBREC, msg.PacketId(), reason)
 
-		_, err := this.writeMessage(resp)
-		return err
+				return this.writeAck(message.PUBREC, msg.PacketId(), msg.Topic())
+			}
+
+			if err := this.sess.Pub2in.Wait(msg, nil); err != nil {
+				return err
+			}
+
+			this.persistSession()
+
+			ctx, span := this.startPublish(msg)
+			this.waitTrace(ctx, span, msg.PacketId())
+		}
+
+		return this.writeAck(message.PUBREC, msg.PacketId(), msg.Topic())
 
 	case message.QosAtLeastOnce:
-		resp := message.NewPubackMessage()
-		resp.SetPacketId(msg.PacketId())
+		ctx, span := this.startPublish(msg)
+
+		// The PUBACK waits for the connectors instead
+		if this.holdAcks {
+			this.held = this.holdAck(message.PUBACK, msg.PacketId(), msg.Topic())
+			err := this.onPublish(ctx, msg)
+			this.held.release()
+			this.held = nil
 
-		if _, err := this.writeMessage(resp); err != nil {
+			span.End(err)
 			return err
 		}
 
-		return this.onPublish(msg)
+		// MQTT 5.0 clients get the PUBACK once the message is published, so it can
+		// say why it wasn't.
+		if this.v5 != nil {
+			err := this.onPublish(ctx, msg)
+			if err == nil {
+				err = this.writeAck(message.PUBACK, msg.PacketId(), msg.Topic())
+			}
+
+			span.End(err)
+			return err
+		}
+
+		resp := getAck(message.PUBACK, msg.PacketId())
+
+		_, err := this.writeMessage(resp)
+		if err == nil {
+			this.trace("Sent", message.PUBACK, resp.PacketId(), msg.Topic())
+		}
+
+		putSent(resp)
+
+		if err == nil {
+			err = this.onPublish(ctx, msg)
+		}
+
+		span.End(err)
+		return err
 
 	case message.QosAtMostOnce:
-		return this.onPublish(msg)
+		return this.publishTraced(msg)
 	}
 
 	return fmt.Errorf("(%s) invalid message QoS %d.", this.cid(), msg.QoS())
 }
 
+// writeAck sends the ack of type mtype for the message from the client with pktid,
+// whose topic is traced along with it.
+func (this *service) writeAck(mtype message.MessageType, pktid uint16, topic []byte) error {
+	resp := getAck(mtype, pktid)
+	defer putSent(resp)
+
+	if _, err := this.writeMessage(resp); err != nil {
+		return err
+	}
+
+	this.trace("Sent", mtype, pktid, topic)
+	return nil
+}
+
 // For SUBSCRIBE message, we should add subscriber, then send back SUBACK
 func (this *service) processSubscribe(msg *message.SubscribeMessage) error {
 	resp := message.NewSubackMessage()
@@ -306,26 +488,42 @@ func (this *service) processSubscribe(msg *message.SubscribeMessage) error {
 	// Subscribe to the different topics
 	var retcodes []byte
 
-	topics := msg.Topics()
 	qos := msg.Qos()
 
-	this.rmsgs = this.rmsgs[0:0]
+	// The topic filters to send the retained messages for
+	var retained [][]byte
+
+	for i, t := range msg.Topics() {
+		if !this.authorize(t, auth.Read) {
+			retcodes = append(retcodes, message.QosFailure)
+			continue
+		}
+
+		sqos, ok := this.hookSubscribe(t, qos[i])
+		if !ok {
+			retcodes = append(retcodes, message.QosFailure)
+			continue
+		}
 
-	for i, t := range topics {
-		rqos, err := this.topicsMgr.Subscribe(t, qos[i], &this.onpub)
+		rqos, err := this.topicsMgr.Subscribe(t, sqos, &this.onpub)
 		if err != nil {
 			return err
 		}
-		this.sess.AddTopic(string(t), qos[i])
+		this.sess.AddTopic(string(t), sqos)
 
 		retcodes = append(retcodes, rqos)
 
-		// yeah I am not checking errors here. If there's an error we don't want the
-		// subscription to stop, just let it go.
-		this.topicsMgr.Retained(t, &this.rmsgs)
-		glog.Debugf("(%s) topic = %s, retained count = %d", this.cid(), string(t), len(this.rmsgs))
+		// Retained messages are not sent for shared subscriptions.
+		if topics.IsShared(t) {
+			continue
+		}
+
+		// The filter is in the incoming buffer, which is reused once msg is processed
+		retained = append(retained, append([]byte(nil), t...))
 	}
 
+	this.saveSession()
+
 	if err := resp.AddReturnCodes(retcodes); err != nil {
 		return err
 	}
@@ -334,16 +532,60 @@ func (this *service) processSubscribe(msg *message.SubscribeMessage) error {
 		return err
 	}
 
-	for _, rm := range this.rmsgs {
-		if err := this.publish(rm, nil); err != nil {
-			glog.Errorf("service/processSubscribe: Error publishing retained message: %v", err)
-			return err
-		}
+	// Find and deliver the retained messages in the background. A subscription to a
+	// broad wildcard could match a huge number of them, and we don't want to hold up
+	// processing of the incoming messages for this client until they are all sent.
+	if len(retained) > 0 {
+		this.wgStopped.Add(1)
+		go this.deliverRetained(retained)
 	}
 
 	return nil
 }
 
+// deliverRetained() sends the retained messages for the topic filters to the client,
+// as the topics provider finds them. Writes to the outgoing buffer block when the
+// buffer is full, so this goes only as fast as the client is reading. Every
+// retainedChunkSize messages we check to see if the service has stopped, in which
+// case there's no point in continuing.
+func (this *service) deliverRetained(filters [][]byte) {
+	defer this.wgStopped.Done()
+
+	i := 0
+
+	for _, t := range filters {
+		err := this.topicsMgr.RetainedEach(t, func(rm *message.PublishMessage) error {
+			if i++; i%retainedChunkSize == 0 {
+				if this.isDone() {
+					return io.EOF
+				}
+
+				runtime.Gosched()
+			}
+
+			rm, ok := this.transformOutbound(rm)
+			if !ok {
+				return nil
+			}
+
+			this.hookDeliver(rm)
+
+			return this.publishOutbound(rm, nil)
+		})
+
+		if err == io.EOF {
+			return
+		}
+
+		if err != nil {
+			this.log.Errorf("(%s) service/deliverRetained: Error publishing retained messages for %q: %v", this.cid(), string(t), err)
+			return
+		}
+
+		this.log.Debugf("(%s) topic = %s, retained count = %d", this.cid(), string(t), i)
+	}
+}
+
 // For UNSUBSCRIBE message, we should remove the subscriber, and send back UNSUBACK
 func (this *service) processUnsubscribe(msg *message.UnsubscribeMessage) error {
 	topics := msg.Topics()
@@ -353,6 +595,8 @@ func (this *service) processUnsubscribe(msg *message.UnsubscribeMessage) error {
 		this.sess.RemoveTopic(string(t))
 	}
 
+	this.saveSession()
+
 	resp := message.NewUnsubackMessage()
 	resp.SetPacketId(msg.PacketId())
 
@@ -363,33 +607,136 @@ func (this *service) processUnsubscribe(msg *message.UnsubscribeMessage) error {
 // onPublish() is called when the server receives a PUBLISH message AND have completed
 // the ack cycle. This method will get the list of subscribers based on the publish
 // topic, and publishes the message to the list of subscribers.
-func (this *service) onPublish(msg *message.PublishMessage) error {
+func (this *service) onPublish(ctx context.Context, msg *message.PublishMessage) error {
+	_, span := this.startSpan(ctx, SpanAuthorize, nil)
+
+	// There's no way to NAK a PUBLISH in MQTT 3.1.1, so the message has been acked
+	// already, and is just not published. The PUBACK says why for MQTT 5.0 clients.
+	if !this.authorize(msg.Topic(), auth.Write) {
+		span.End(errPublishNotAuthorized)
+		this.counters.droppedMessage()
+		this.nak5(msg, reasonNotAuthorized)
+		return nil
+	}
+
+	topic := msg.Topic()
+
+	ok, err := this.payloads.check(msg)
+	if err != nil {
+		this.log.Infof("(%s) Message to topic %q has an invalid payload: %v", this.cid(), string(topic), err)
+	}
+
+	if !ok {
+		span.End(errPayloadRejected)
+		this.counters.droppedMessage()
+		this.nak5(msg, reasonBadPayloadFormat)
+		return nil
+	}
+
+	pub := msg
+
+	msg, ok = this.hookPublish(msg)
+	if !ok {
+		span.End(errPublishDropped)
+		this.counters.droppedMessage()
+		this.nak5(pub, reasonImplementationError)
+		return nil
+	}
+
+	if msg != pub {
+		this.msgProps.alias(msg, pub)
+		defer this.msgProps.del(msg)
+	}
+
+	span.End(nil)
+
 	if msg.Retain() {
-		if err := this.topicsMgr.Retain(msg); err != nil {
-			glog.Errorf("(%s) Error retaining message: %v", this.cid(), err)
+		if err := retainMessage(this.topicsMgr, msg, this.ttl); err != nil {
+			this.log.Errorf("(%s) Error retaining message: %v", this.cid(), err)
 		}
 	}
 
-	err := this.topicsMgr.Subscribers(msg.Topic(), msg.QoS(), &this.subs, &this.qoss)
+	_, span = this.startSpan(ctx, SpanMatch, nil)
+
+	err = this.topicsMgr.Subscribers(msg.Topic(), msg.QoS(), &this.subs, &this.qoss)
+	span.End(err)
+
 	if err != nil {
-		glog.Errorf("(%s) Error retrieving subscribers list: %v", this.cid(), err)
+		this.log.Errorf("(%s) Error retrieving subscribers list: %v", this.cid(), err)
 		return err
 	}
 
 	msg.SetRetain(false)
 
+	n := countSubscribers(this.subs)
+	if n == 0 {
+		this.nak5(pub, reasonNoSubscribers)
+	}
+
+	this.topicStats.published(msg.Topic(), n)
+
+	done := this.startFanout(ctx, msg)
+	defer done()
+
 	//glog.Debugf("(%s) Publishing to topic %q and %d subscribers", this.cid(), string(msg.Topic()), len(this.subs))
 	for _, s := range this.subs {
 		if s != nil {
-			fn, ok := s.(*OnPublishFunc)
-			if !ok {
-				glog.Errorf("Invalid onPublish Function")
+			if err := deliver(s, msg, this.held, this.counters, this.log); err == ErrInvalidSubscriber {
+				this.log.Errorf("Invalid onPublish Function")
 				return fmt.Errorf("Invalid onPublish Function")
-			} else {
-				(*fn)(msg)
 			}
 		}
 	}
 
 	return nil
 }
+
+// countSubscribers returns the number of subscribers returned by the topics manager.
+func countSubscribers(subs []interface{}) int {
+	n := 0
+
+	for _, s := range subs {
+		if s != nil {
+			n++
+		}
+	}
+
+	return n
+}
+
+// deliver hands a PUBLISH message to one of the subscribers returned by the topics
+// manager. That's either a connected client's OnPublishFunc, the offline queue of a
+// client that's away, or a connector's ForwardFunc, which holds up ack until it's done
+// with the message, if ack is not nil. Messages that can't be delivered are counted
+// as dropped.
+func deliver(sub interface{}, msg *message.PublishMessage, ack *heldAck, c *counters, log logger.Logger) error {
+	switch fn := sub.(type) {
+	case *ForwardFunc:
+		done := func(error) {}
+		if ack != nil {
+			done = ack.forward()
+		}
+
+		(*fn)(msg, done)
+		return nil
+
+	case *OnPublishFunc:
+		if err := (*fn)(msg); err != nil {
+			c.droppedMessage()
+			return err
+		}
+
+		return nil
+
+	case *sessions.Offlinequeue:
+		if err := fn.Push(msg); err != nil {
+			log.Debugf("Error queueing offline message: %v", err)
+			c.droppedMessage()
+			return err
+		}
+
+		return nil
+	}
+
+	return ErrInvalidSubscriber
+}
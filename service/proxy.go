@@ -0,0 +1,222 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalidProxyHeader is returned when reading from a connection on a listener
+	// with ProxyProtocol set, if the connection doesn't start with a valid PROXY
+	// protocol header.
+	ErrInvalidProxyHeader = errors.New("service: Invalid PROXY protocol header")
+
+	// The signature the PROXY protocol v2 header starts with
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// The longest PROXY protocol v1 header, including the CRLF
+	proxyV1MaxLen = 107
+)
+
+// proxyListener is a net.Listener for connections that start with a PROXY protocol
+// header, e.g., from HAProxy or AWS NLB. The header is read on first use of the
+// connection, so Accept() is not held up by slow clients.
+type proxyListener struct {
+	net.Listener
+
+	// How long to wait for the header
+	timeout time.Duration
+}
+
+func (this *proxyListener) Accept() (net.Conn, error) {
+	conn, err := this.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyConn{
+		Conn:    conn,
+		r:       bufio.NewReaderSize(conn, proxyV1MaxLen),
+		timeout: this.timeout,
+	}, nil
+}
+
+// proxyConn is a connection that starts with a PROXY protocol header. RemoteAddr()
+// returns the address of the client the proxy got the connection from.
+type proxyConn struct {
+	net.Conn
+
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (this *proxyConn) Read(b []byte) (int, error) {
+	this.once.Do(this.readHeader)
+
+	if this.err != nil {
+		return 0, this.err
+	}
+
+	return this.r.Read(b)
+}
+
+func (this *proxyConn) RemoteAddr() net.Addr {
+	this.once.Do(this.readHeader)
+
+	if this.remote != nil {
+		return this.remote
+	}
+
+	return this.Conn.RemoteAddr()
+}
+
+func (this *proxyConn) readHeader() {
+	this.Conn.SetReadDeadline(time.Now().Add(this.timeout))
+	defer this.Conn.SetReadDeadline(time.Time{})
+
+	this.remote, this.err = readProxyHeader(this.r)
+	if this.err != nil {
+		this.Conn.Close()
+	}
+}
+
+// readProxyHeader reads a PROXY protocol header, v1 or v2, from r and returns the
+// source address in it. If the header doesn't have an address, e.g., a health check
+// from the proxy itself, then the address is nil.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(b, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+
+	if bytes.HasPrefix(b, []byte("PROXY ")) {
+		return readProxyV1(r)
+	}
+
+	return nil, ErrInvalidProxyHeader
+}
+
+// readProxyV1 reads the human-readable header, e.g.,
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 1883\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return nil, ErrInvalidProxyHeader
+		}
+
+		return nil, err
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the binary header.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("service: Unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL connections are from the proxy itself, and keep their own address
+	switch hdr[12] & 0xf {
+	case 0:
+		return nil, nil
+
+	case 1:
+
+	default:
+		return nil, ErrInvalidProxyHeader
+	}
+
+	var n int
+
+	switch hdr[13] >> 4 {
+	case 1:
+		n = net.IPv4len
+
+	case 2:
+		n = net.IPv6len
+
+	default:
+		// Unix sockets and unknown families don't have an IP address
+		return nil, nil
+	}
+
+	if len(body) < 2*n+4 {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	return &net.TCPAddr{
+		IP:   net.IP(body[:n]),
+		Port: int(binary.BigEndian.Uint16(body[2*n:])),
+	}, nil
+}
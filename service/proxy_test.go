@@ -0,0 +1,166 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+// proxyV2Header returns a PROXY protocol v2 header for a TCP over IPv4 connection
+// from src. If src is nil then it's a LOCAL connection.
+func proxyV2Header(src *net.TCPAddr) []byte {
+	var buf bytes.Buffer
+
+	buf.Write(proxyV2Signature)
+
+	if src == nil {
+		buf.Write([]byte{0x20, 0x00, 0, 0})
+		return buf.Bytes()
+	}
+
+	buf.Write([]byte{0x21, 0x11, 0, 12})
+	buf.Write(src.IP.To4())
+	buf.Write(net.IPv4(127, 0, 0, 1).To4())
+	binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(1883))
+
+	return buf.Bytes()
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, test := range []struct {
+		header string
+		addr   string
+		err    bool
+	}{
+		{"PROXY TCP4 10.0.0.1 127.0.0.1 5000 1883\r\n", "10.0.0.1:5000", false},
+		{"PROXY TCP6 2001:db8::1 ::1 5000 1883\r\n", "[2001:db8::1]:5000", false},
+		{"PROXY UNKNOWN\r\n", "", false},
+		{string(proxyV2Header(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6000})), "10.0.0.2:6000", false},
+		{string(proxyV2Header(nil)), "", false},
+		{"PROXY TCP4 10.0.0.1 127.0.0.1 5000\r\n", "", true},
+		{"PROXY TCP4 2001:db8::1 ::1 5000 1883\r\n", "", true},
+		{"PROXY TCP4 10.0.0.1 127.0.0.1 5000 1883\n", "", true},
+		{"PROXY " + string(bytes.Repeat([]byte("x"), 200)) + "\r\n", "", true},
+		{"\x10\x0c\x00\x04MQTT\x04\x02\x00\x0a\x00\x00", "", true},
+	} {
+		r := bufio.NewReaderSize(bytes.NewBufferString(test.header+"rest"), proxyV1MaxLen)
+
+		addr, err := readProxyHeader(r)
+		if test.err {
+			require.Error(t, err, test.header)
+			continue
+		}
+
+		require.NoError(t, err, test.header)
+
+		if test.addr == "" {
+			require.Nil(t, addr, test.header)
+		} else {
+			require.Equal(t, test.addr, addr.String(), test.header)
+		}
+
+		// What's after the header is left for the connection
+		rest, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, "rest", string(rest))
+	}
+}
+
+func TestServerProxyProtocol(t *testing.T) {
+	addrs := make(chan net.Addr, 10)
+
+	svr, _ := startNamedServer(t, "proxy", "tcp://127.0.0.1:1883", &Server{
+		MaxConnectionsPerIP: 1,
+		Hooks: []*Hooks{{
+			OnConnect: func(c *ClientInfo, msg *message.ConnectMessage) error {
+				addrs <- c.RemoteAddr
+				return nil
+			},
+		}},
+	})
+	svr.Listeners = []*Listener{{URI: "tcp://127.0.0.1:1884", ProxyProtocol: true}}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- svr.Serve()
+	}()
+
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	dial := func(header []byte) (net.Conn, message.ConnackCode) {
+		var (
+			conn net.Conn
+			err  error
+		)
+
+		for i := 0; i < 100; i++ {
+			if conn, err = net.Dial("tcp", "127.0.0.1:1884"); err == nil {
+				break
+			}
+
+			time.Sleep(time.Millisecond * 10)
+		}
+
+		require.NoError(t, err)
+
+		_, err = conn.Write(header)
+		require.NoError(t, err)
+		require.NoError(t, writeMessage(conn, newConnectMessage()))
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		connack, err := getConnackMessage(conn, 0)
+		require.NoError(t, err)
+
+		return conn, connack.ReturnCode()
+	}
+
+	// The clients all connect from the proxy, but are known by their own address
+	c1, code := dial([]byte("PROXY TCP4 10.0.0.1 127.0.0.1 5000 1884\r\n"))
+	defer c1.Close()
+	require.Equal(t, message.ConnectionAccepted, code)
+	require.Equal(t, "10.0.0.1:5000", (<-addrs).String())
+
+	c2, code := dial(proxyV2Header(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6000}))
+	defer c2.Close()
+	require.Equal(t, message.ConnectionAccepted, code)
+	require.Equal(t, "10.0.0.2:6000", (<-addrs).String())
+
+	c3, code := dial([]byte("PROXY TCP4 10.0.0.1 127.0.0.1 5001 1884\r\n"))
+	c3.Close()
+	require.Equal(t, message.ErrServerUnavailable, code)
+
+	// Connections without the header are turned away
+	conn, err := net.Dial("tcp", "127.0.0.1:1884")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, newConnectMessage()))
+	expectClosed(t, conn)
+}
@@ -0,0 +1,270 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/surgemq/message"
+)
+
+// DefaultResponseTopicPrefix is where the responses to the requests of a Client go,
+// if Client.ResponseTopicPrefix is not set.
+const DefaultResponseTopicPrefix = "responses"
+
+var (
+	// ErrRequestTimeout is returned by Client.Request when the response doesn't come
+	// back in time.
+	ErrRequestTimeout = errors.New("service: Timed out waiting for the response")
+
+	// ErrInvalidRequest is returned by DecodeRequest, and Client.Respond, for a
+	// message that's not a request.
+	ErrInvalidRequest = errors.New("service: Invalid request")
+)
+
+// EncodeRequest returns the payload of a request, which carries the topic the response
+// is to be published to, and the correlation data that goes with it, along with the
+// payload. MQTT 3.1.1, unlike MQTT 5, has no PUBLISH properties to put them in, so
+// they are in front of the payload, each encoded as an MQTT string, i.e., with its
+// length in 2 bytes first.
+func EncodeRequest(responseTopic, correlation, payload []byte) ([]byte, error) {
+	if len(responseTopic) > 65535 || len(correlation) > 65535 {
+		return nil, ErrInvalidRequest
+	}
+
+	b := make([]byte, 0, 4+len(responseTopic)+len(correlation)+len(payload))
+	b = appendRequestString(b, responseTopic)
+	b = appendRequestString(b, correlation)
+
+	return append(b, payload...), nil
+}
+
+// DecodeRequest returns the response topic, the correlation data and the payload of
+// a request encoded with EncodeRequest.
+func DecodeRequest(b []byte) (responseTopic, correlation, payload []byte, err error) {
+	if responseTopic, b, err = readRequestString(b); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if correlation, b, err = readRequestString(b); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if len(responseTopic) == 0 {
+		return nil, nil, nil, ErrInvalidRequest
+	}
+
+	return responseTopic, correlation, b, nil
+}
+
+func appendRequestString(b, s []byte) []byte {
+	var n [2]byte
+	binary.BigEndian.PutUint16(n[:], uint16(len(s)))
+
+	return append(append(b, n[:]...), s...)
+}
+
+func readRequestString(b []byte) ([]byte, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, ErrInvalidRequest
+	}
+
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, ErrInvalidRequest
+	}
+
+	return b[2 : 2+n], b[2+n:], nil
+}
+
+// responses are the requests of a Client waiting for their responses. Each request
+// gets a response topic of its own, under a topic filter the client is subscribed
+// to, and the last level of the topic is the correlation data.
+type responses struct {
+	// The response topics are prefix + "/" + the correlation data
+	prefix string
+
+	next    uint64
+	waiting map[string]chan []byte
+	mu      sync.Mutex
+}
+
+// add returns the correlation data for a new request, and the channel its response
+// is sent on.
+func (this *responses) add() (string, chan []byte) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.next++
+	id := strconv.FormatUint(this.next, 36)
+
+	ch := make(chan []byte, 1)
+	this.waiting[id] = ch
+
+	return id, ch
+}
+
+func (this *responses) remove(id string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	delete(this.waiting, id)
+}
+
+// onPublish hands a response to the request waiting for it. Responses that come
+// back after their request has given up are dropped.
+func (this *responses) onPublish(msg *message.PublishMessage) error {
+	id := strings.TrimPrefix(string(msg.Topic()), this.prefix+"/")
+
+	this.mu.Lock()
+	ch, ok := this.waiting[id]
+	delete(this.waiting, id)
+	this.mu.Unlock()
+
+	if ok {
+		ch <- msg.Payload()
+	}
+
+	return nil
+}
+
+// Request publishes a request to the topic, and waits for the response, for as long
+// as timeout. See RequestContext.
+func (this *Client) Request(topic string, payload []byte, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp, err := this.RequestContext(ctx, topic, payload)
+	if err == context.DeadlineExceeded {
+		return nil, ErrRequestTimeout
+	}
+
+	return resp, err
+}
+
+// RequestContext publishes a request to the topic, and returns the payload of the
+// response, or ctx.Err() if ctx is done first. The request is a QoS 1 PUBLISH, with
+// the payload encoded by EncodeRequest along with a response topic and correlation
+// data of its own, see Respond.
+//
+// The response topics are under ResponseTopicPrefix, followed by a level that's
+// random for each client, which the client subscribes to the first time it makes a
+// request. Once the client speaks MQTT 5, they can go in the PUBLISH properties
+// instead, and the rest stays the same.
+func (this *Client) RequestContext(ctx context.Context, topic string, payload []byte) ([]byte, error) {
+	r, err := this.responses(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	id, ch := r.add()
+	defer r.remove(id)
+
+	b, err := EncodeRequest([]byte(r.prefix+"/"+id), []byte(id), payload)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := message.NewPublishMessage()
+	if err := msg.SetTopic([]byte(topic)); err != nil {
+		return nil, err
+	}
+
+	msg.SetQoS(message.QosAtLeastOnce)
+	msg.SetPacketId(this.service().sess.NextPacketId())
+	msg.SetPayload(b)
+
+	if err := this.PublishContext(ctx, msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Respond publishes the response to a request made with Request, at the QoS of the
+// request. The payload of the request itself is returned by DecodeRequest.
+func (this *Client) Respond(req *message.PublishMessage, payload []byte, onComplete OnCompleteFunc) error {
+	topic, _, _, err := DecodeRequest(req.Payload())
+	if err != nil {
+		return err
+	}
+
+	msg := message.NewPublishMessage()
+	if err := msg.SetTopic(topic); err != nil {
+		return err
+	}
+
+	if err := msg.SetQoS(req.QoS()); err != nil {
+		return err
+	}
+
+	if msg.QoS() != message.QosAtMostOnce {
+		msg.SetPacketId(this.service().sess.NextPacketId())
+	}
+
+	msg.SetPayload(payload)
+
+	return this.Publish(msg, onComplete)
+}
+
+// responses returns the requests waiting for their responses, after subscribing to
+// the response topics if it's the first request.
+func (this *Client) responses(ctx context.Context) (*responses, error) {
+	this.rmu.Lock()
+	defer this.rmu.Unlock()
+
+	if this.resps != nil {
+		return this.resps, nil
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	r := &responses{
+		prefix:  this.ResponseTopicPrefix + "/" + hex.EncodeToString(b),
+		waiting: make(map[string]chan []byte),
+	}
+
+	msg := message.NewSubscribeMessage()
+	msg.SetPacketId(this.service().sess.NextPacketId())
+
+	if err := msg.AddTopic([]byte(r.prefix+"/+"), message.QosAtLeastOnce); err != nil {
+		return nil, err
+	}
+
+	if err := this.SubscribeContext(ctx, msg, r.onPublish); err != nil {
+		return nil, err
+	}
+
+	this.resps = r
+
+	return r, nil
+}
@@ -19,9 +19,9 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
-	"github.com/surge/glog"
 	"github.com/surgemq/message"
 )
 
@@ -47,20 +47,23 @@ func (this *service) receiver() {
 	defer func() {
 		// Let's recover from panic
 		if r := recover(); r != nil {
-			glog.Errorf("(%s) Recovering from panic: %v", this.cid(), r)
+			this.log.Errorf("(%s) Recovering from panic: %v", this.cid(), r)
 		}
 
 		this.wgStopped.Done()
 
-		glog.Debugf("(%s) Stopping receiver", this.cid())
+		this.log.Debugf("(%s) Stopping receiver", this.cid())
 	}()
 
-	glog.Debugf("(%s) Starting receiver", this.cid())
+	this.log.Debugf("(%s) Starting receiver", this.cid())
 
 	this.wgStarted.Done()
 
 	switch conn := this.conn.(type) {
 	case net.Conn:
+		// This includes *websocket.Conn, which reads the payload of the data frames as
+		// a stream, answers pings, and passes the read deadline on to the underlying
+		// connection.
 		//glog.Debugf("server/handleConnection: Setting read deadline to %d", time.Second*time.Duration(this.keepAlive))
 		keepAlive := time.Second * time.Duration(this.keepAlive)
 		r := timeoutReader{
@@ -73,17 +76,14 @@ func (this *service) receiver() {
 
 			if err != nil {
 				if err != io.EOF {
-					glog.Errorf("(%s) error reading from connection: %v", this.cid(), err)
+					this.log.Errorf("(%s) error reading from connection: %v", this.cid(), err)
 				}
 				return
 			}
 		}
 
-	//case *websocket.Conn:
-	//	glog.Errorf("(%s) Websocket: %v", this.cid(), ErrInvalidConnectionType)
-
 	default:
-		glog.Errorf("(%s) %v", this.cid(), ErrInvalidConnectionType)
+		this.log.Errorf("(%s) %v", this.cid(), ErrInvalidConnectionType)
 	}
 }
 
@@ -92,36 +92,39 @@ func (this *service) sender() {
 	defer func() {
 		// Let's recover from panic
 		if r := recover(); r != nil {
-			glog.Errorf("(%s) Recovering from panic: %v", this.cid(), r)
+			this.log.Errorf("(%s) Recovering from panic: %v", this.cid(), r)
 		}
 
 		this.wgStopped.Done()
 
-		glog.Debugf("(%s) Stopping sender", this.cid())
+		this.log.Debugf("(%s) Stopping sender", this.cid())
 	}()
 
-	glog.Debugf("(%s) Starting sender", this.cid())
+	this.log.Debugf("(%s) Starting sender", this.cid())
 
 	this.wgStarted.Done()
 
+	size := this.flushSize
+	if size <= 0 {
+		size = defaultWriteBlockSize
+	}
+
 	switch conn := this.conn.(type) {
 	case net.Conn:
+		// This includes *websocket.Conn, which sends each write as a single frame.
 		for {
-			_, err := this.out.WriteTo(conn)
+			_, err := this.out.WriteToBatched(conn, size, this.flushInterval)
 
 			if err != nil {
 				if err != io.EOF {
-					glog.Errorf("(%s) error writing data: %v", this.cid(), err)
+					this.log.Errorf("(%s) error writing data: %v", this.cid(), err)
 				}
 				return
 			}
 		}
 
-	//case *websocket.Conn:
-	//	glog.Errorf("(%s) Websocket not supported", this.cid())
-
 	default:
-		glog.Errorf("(%s) Invalid connection type", this.cid())
+		this.log.Errorf("(%s) Invalid connection type", this.cid())
 	}
 }
 
@@ -174,6 +177,12 @@ func (this *service) peekMessageSize() (message.MessageType, int, error) {
 
 	mtype := message.MessageType(b[0] >> 4)
 
+	// Reject the message before the buffer has to make room for it.
+	if this.maxPacketSize > 0 && total > this.maxPacketSize {
+		this.log.Errorf("(%s) %s of %d bytes, max %d", this.cid(), mtype, total, this.maxPacketSize)
+		return mtype, total, ErrPacketTooLarge
+	}
+
 	return mtype, total, err
 }
 
@@ -205,13 +214,42 @@ func (this *service) peekMessage(mtype message.MessageType, total int) (message.
 		}
 	}
 
-	msg, err = mtype.New()
+	// Fix up the reserved flags before decoding, since the decoder will reject them.
+	if flags := b[0] & 0x0f; mtype != message.PUBLISH && flags != mtype.DefaultFlags() && this.lenient {
+		this.log.Warningf("(%s) Invalid %s flags, expecting %d, got %d. Ignoring.", this.cid(), mtype, mtype.DefaultFlags(), flags)
+		b[0] = byte(mtype)<<4 | mtype.DefaultFlags()
+	}
+
+	// MQTT 5.0 messages are decoded from their MQTT 3.1.1 form, which can be of
+	// another type.
+	if this.v5 != nil {
+		if b, err = this.v5.from(mtype, b); err != nil {
+			return nil, 0, err
+		}
+
+		mtype = message.MessageType(b[0] >> 4)
+	}
+
+	msg, err = getMessage(mtype)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	n, err = msg.Decode(b)
-	return msg, n, err
+	if err != nil {
+		return msg, n, err
+	}
+
+	// The caller commits total bytes regardless, so any extra bytes are skipped.
+	if n < len(b) {
+		if !this.lenient {
+			return msg, n, fmt.Errorf("sendrecv/peekMessage: %d extra bytes at the end of %s", len(b)-n, mtype)
+		}
+
+		this.log.Warningf("(%s) %d extra bytes at the end of %s. Ignoring.", this.cid(), len(b)-n, mtype)
+	}
+
+	return msg, n, nil
 }
 
 // readMessage() reads and copies a message from the buffer. The buffer bytes are
@@ -229,22 +267,39 @@ func (this *service) readMessage(mtype message.MessageType, total int) (message.
 		return nil, 0, err
 	}
 
-	if len(this.intmp) < total {
-		this.intmp = make([]byte, total)
+	// The message decoded refers to intmp, so it's kept until the next message
+	if this.intmp == nil || cap(*this.intmp) < total {
+		if this.intmp != nil {
+			putBuffer(this.intmp)
+		}
+
+		this.intmp = getBuffer(total)
 	}
 
+	*this.intmp = (*this.intmp)[:total]
+
 	// Read until we get total bytes
-	l := 0
+	l, empty := 0, 0
 	for l < total {
-		n, err = this.in.Read(this.intmp[l:])
+		n, err = this.in.Read((*this.intmp)[l:])
 		l += n
-		glog.Debugf("read %d bytes, total %d", n, l)
+		this.log.Debugf("read %d bytes, total %d", n, l)
 		if err != nil {
 			return nil, 0, err
 		}
+
+		// Don't spin forever if the reads keep coming back empty without an error.
+		if n == 0 {
+			empty++
+			if empty >= maxEmptyReads {
+				return nil, 0, io.ErrNoProgress
+			}
+		} else {
+			empty = 0
+		}
 	}
 
-	b = this.intmp[:total]
+	b = (*this.intmp)[:total]
 
 	msg, err = mtype.New()
 	if err != nil {
@@ -255,8 +310,214 @@ func (this *service) readMessage(mtype message.MessageType, total int) (message.
 	return msg, n, err
 }
 
-// writeMessage() writes a message to the outgoing buffer
+// writeMessage() encodes a message and queues it for the outgoing buffer. It's safe
+// to call from any goroutine, and only waits if the queue is full. Services that
+// haven't started yet have no queue, and write to the outgoing buffer directly.
 func (this *service) writeMessage(msg message.Message) (int, error) {
+	if this.outq == nil {
+		return this.writeBuffer(msg)
+	}
+
+	if this.isDone() {
+		return 0, io.EOF
+	}
+
+	b, err := this.encode(msg)
+	if err != nil {
+		return 0, err
+	}
+
+	n := len(*b)
+
+	// Only QoS 0 messages can be dropped for a slow consumer
+	pub, ok := msg.(*message.PublishMessage)
+	droppable := ok && pub.QoS() == message.QosAtMostOnce
+
+	if err := this.enqueue(b, droppable); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// writeBytes queues the message encoded in b for the outgoing buffer, like
+// writeMessage, for the MQTT 5.0 messages that have no MQTT 3.1.1 form.
+func (this *service) writeBytes(b []byte) error {
+	if this.isDone() {
+		return io.EOF
+	}
+
+	buf := getBuffer(len(b))
+	*buf = append((*buf)[:0], b...)
+
+	return this.enqueue(buf, false)
+}
+
+// encode returns msg encoded in a buffer from the pool, rewritten into MQTT 5.0 if
+// that's what the client speaks.
+func (this *service) encode(msg message.Message) (*[]byte, error) {
+	b := getBuffer(msg.Len())
+
+	n, err := msg.Encode(*b)
+	if err != nil {
+		putBuffer(b)
+		return nil, err
+	}
+
+	*b = (*b)[:n]
+
+	if this.v5 != nil {
+		var props []byte
+		if pub, ok := msg.(*message.PublishMessage); ok {
+			props = this.msgProps.get(pub)
+		}
+
+		// The properties, and the reason codes, are all it adds
+		b5 := getBuffer(n + 8 + len(props))
+		*b5 = this.v5.to((*b5)[:0], *b, props)
+
+		putBuffer(b)
+		b = b5
+	}
+
+	return b, nil
+}
+
+// enqueue adds an encoded message to the outgoing queue, and puts the buffer back in
+// the pool if it doesn't. If the queue is full then it's up to the slowConsumer
+// policy.
+func (this *service) enqueue(b *[]byte, droppable bool) error {
+	n := int64(len(*b))
+	atomic.AddInt64(&this.queued, n)
+
+	select {
+	case this.outq <- b:
+		return nil
+
+	default:
+	}
+
+	var timeout <-chan time.Time
+
+	switch this.slowConsumer {
+	case DisconnectSlowConsumer:
+		atomic.AddInt64(&this.queued, -n)
+		putBuffer(b)
+
+		this.evict()
+		return ErrSlowConsumer
+
+	case DropSlowConsumer:
+		now := time.Now().UnixNano()
+		atomic.CompareAndSwapInt64(&this.stalled, 0, now)
+
+		left := this.slowTimeout - time.Duration(now-atomic.LoadInt64(&this.stalled))
+		if left <= 0 {
+			atomic.AddInt64(&this.queued, -n)
+			putBuffer(b)
+
+			this.evict()
+			return ErrSlowConsumer
+		}
+
+		if droppable {
+			atomic.AddInt64(&this.queued, -n)
+			putBuffer(b)
+
+			atomic.AddInt64(&this.slowDropped, 1)
+			this.counters.droppedMessage()
+			return nil
+		}
+
+		timer := time.NewTimer(left)
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case this.outq <- b:
+		return nil
+
+	case <-timeout:
+		atomic.AddInt64(&this.queued, -n)
+		putBuffer(b)
+
+		this.evict()
+		return ErrSlowConsumer
+
+	case <-this.done:
+		atomic.AddInt64(&this.queued, -n)
+		putBuffer(b)
+
+		return io.EOF
+	}
+}
+
+// evict disconnects the client for not reading its messages fast enough. It doesn't
+// wait for the service to stop, since it's called by whoever is sending the client a
+// message.
+func (this *service) evict() {
+	if !atomic.CompareAndSwapInt64(&this.evicted, 0, 1) {
+		return
+	}
+
+	this.log.Errorf("(%s) Outgoing queue is full, disconnecting slow consumer.", this.cid())
+
+	this.counters.slowConsumer()
+	this.hookSlowConsumer(atomic.LoadInt64(&this.slowDropped))
+
+	go this.stop()
+}
+
+// writer() moves the messages queued by writeMessage() into the outgoing buffer, in
+// the order they were queued. It's the only one writing to the buffer once the
+// service has started.
+func (this *service) writer() {
+	defer func() {
+		// Let's recover from panic
+		if r := recover(); r != nil {
+			this.log.Errorf("(%s) Recovering from panic: %v", this.cid(), r)
+		}
+
+		this.wgStopped.Done()
+
+		this.log.Debugf("(%s) Stopping writer", this.cid())
+	}()
+
+	this.log.Debugf("(%s) Starting writer", this.cid())
+
+	this.wgStarted.Done()
+
+	for {
+		select {
+		case b := <-this.outq:
+			m, err := this.out.Write(*b)
+
+			atomic.AddInt64(&this.queued, -int64(len(*b)))
+			putBuffer(b)
+
+			// Something went out, so the queue isn't stalled
+			atomic.StoreInt64(&this.stalled, 0)
+
+			if err != nil {
+				if err != io.EOF {
+					this.log.Errorf("(%s) error writing to outgoing buffer: %v", this.cid(), err)
+				}
+				return
+			}
+
+			this.outStat.increment(int64(m))
+			this.counters.sentBytes(int64(m))
+
+		case <-this.done:
+			return
+		}
+	}
+}
+
+// writeBuffer() writes a message to the outgoing buffer
+func (this *service) writeBuffer(msg message.Message) (int, error) {
 	var (
 		l    int = msg.Len()
 		m, n int
@@ -269,37 +530,42 @@ func (this *service) writeMessage(msg message.Message) (int, error) {
 		return 0, ErrBufferNotReady
 	}
 
-	// This is to serialize writes to the underlying buffer. Multiple goroutines could
-	// potentially get here because of calling Publish() or Subscribe() or other
-	// functions that will send messages. For example, if a message is received in
-	// another connetion, and the message needs to be published to this client, then
-	// the Publish() function is called, and at the same time, another client could
-	// do exactly the same thing.
-	//
-	// Not an ideal fix though. If possible we should remove mutex and be lockfree.
-	// Mainly because when there's a large number of goroutines that want to publish
-	// to this client, then they will all block. However, this will do for now.
-	//
-	// FIXME: Try to find a better way than a mutex...if possible.
 	this.wmu.Lock()
 	defer this.wmu.Unlock()
 
+	// MQTT 5.0 messages don't encode to msg.Len() bytes
+	if this.v5 != nil {
+		b, err := this.encode(msg)
+		if err != nil {
+			return 0, err
+		}
+		defer putBuffer(b)
+
+		if m, err = this.out.Write(*b); err != nil {
+			return m, err
+		}
+
+		this.outStat.increment(int64(m))
+		this.counters.sentBytes(int64(m))
+
+		return m, nil
+	}
+
 	buf, wrap, err = this.out.WriteWait(l)
 	if err != nil {
 		return 0, err
 	}
 
 	if wrap {
-		if len(this.outtmp) < l {
-			this.outtmp = make([]byte, l)
-		}
+		tmp := getBuffer(l)
+		defer putBuffer(tmp)
 
-		n, err = msg.Encode(this.outtmp[0:])
+		n, err = msg.Encode(*tmp)
 		if err != nil {
 			return 0, err
 		}
 
-		m, err = this.out.Write(this.outtmp[0:n])
+		m, err = this.out.Write((*tmp)[0:n])
 		if err != nil {
 			return m, err
 		}
@@ -316,6 +582,7 @@ func (this *service) writeMessage(msg message.Message) (int, error) {
 	}
 
 	this.outStat.increment(int64(m))
+	this.counters.sentBytes(int64(m))
 
 	return m, nil
 }
@@ -17,10 +17,15 @@ package service
 import (
 	"bytes"
 	"io"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logger"
+	"github.com/surgemq/surgemq/sessions"
 )
 
 func TestReadMessageSuccess(t *testing.T) {
@@ -200,7 +205,7 @@ func TestWriteMessage(t *testing.T) {
 
 func newTestBuffer(t *testing.T, msgBytes []byte) *service {
 	buf := bytes.NewBuffer(msgBytes)
-	svc := &service{}
+	svc := &service{log: logger.NewGlogLogger()}
 	var err error
 
 	svc.in, err = newBuffer(16384)
@@ -214,3 +219,171 @@ func newTestBuffer(t *testing.T, msgBytes []byte) *service {
 
 	return svc
 }
+
+func TestWriteMessageQueued(t *testing.T) {
+	var err error
+
+	svc := &service{sess: &sessions.Session{}, log: logger.NewGlogLogger()}
+	svc.out, err = newBuffer(1024 * 64)
+	require.NoError(t, err)
+
+	svc.outq = make(chan *[]byte, 16)
+	svc.done = make(chan struct{})
+
+	svc.wgStarted.Add(1)
+	svc.wgStopped.Add(1)
+	go svc.writer()
+
+	// Publishers write at the same time, each with its own packet IDs
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				if _, err := svc.writeMessage(newPublishMessage(uint16(i*100+j+1), 1)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	// Every message comes out of the buffer whole, and in order for each publisher
+	last := make(map[int]int)
+
+	for n := 0; n < 400; n++ {
+		b, err := svc.out.ReadWait(2)
+		require.NoError(t, err)
+
+		l := int(b[1]) + 2
+		b, err = svc.out.ReadWait(l)
+		require.NoError(t, err)
+
+		msg := message.NewPublishMessage()
+		_, err = msg.Decode(b)
+		require.NoError(t, err)
+
+		id := int(msg.PacketId()) - 1
+		require.Equal(t, last[id/100], id%100)
+		last[id/100] = id%100 + 1
+
+		_, err = svc.out.ReadCommit(l)
+		require.NoError(t, err)
+	}
+
+	wg.Wait()
+
+	for i := 0; i < 4; i++ {
+		require.Equal(t, 100, last[i])
+	}
+
+	require.Equal(t, int64(0), atomic.LoadInt64(&svc.queued))
+
+	close(svc.done)
+	svc.wgStopped.Wait()
+
+	_, err = svc.writeMessage(newPublishMessage(1, 1))
+	require.Equal(t, io.EOF, err)
+}
+
+func TestServerSlowConsumer(t *testing.T) {
+	svr, done := startNamedServer(t, "slowconsumer", "tcp://127.0.0.1:1883", &Server{
+		OutgoingQueue: 4,
+		SlowConsumer:  DisconnectSlowConsumer,
+	})
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	// This one subscribes, but never reads anything
+	slow := dialNamedServer(t, "127.0.0.1:1883", "abc")
+	defer slow.Close()
+
+	pub := dialNamedServer(t, "127.0.0.1:1883", "xyz")
+	defer pub.Close()
+
+	// The server keeps reading from the publisher, instead of waiting on the slow one
+	payload := make([]byte, 1024*32)
+	pub.SetWriteDeadline(time.Now().Add(time.Second * 5))
+
+	for i := 0; i < 400; i++ {
+		msg := newPublishMessage(0, 0)
+		msg.SetPayload(payload)
+
+		require.NoError(t, writeMessage(pub, msg))
+	}
+
+	expectClosed(t, slow)
+	require.Equal(t, int64(1), svr.Metrics().SlowConsumers)
+
+	// The publisher is still fine
+	ping := message.NewPingreqMessage()
+	require.NoError(t, writeMessage(pub, ping))
+	expectMessage(t, pub, message.PINGRESP)
+}
+
+func TestServerSlowConsumerDrop(t *testing.T) {
+	evicted := make(chan int64, 1)
+
+	svr, done := startNamedServer(t, "slowconsumerdrop", "tcp://127.0.0.1:1883", &Server{
+		OutgoingQueue:       4,
+		SlowConsumer:        DropSlowConsumer,
+		SlowConsumerTimeout: 1,
+		Hooks: []*Hooks{{
+			OnSlowConsumer: func(c *ClientInfo, dropped int64) { evicted <- dropped },
+		}},
+	})
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	slow := dialNamedServer(t, "127.0.0.1:1883", "abc")
+	defer slow.Close()
+
+	pub := dialNamedServer(t, "127.0.0.1:1883", "xyz")
+	defer pub.Close()
+
+	publish := func(n int) {
+		payload := make([]byte, 1024*32)
+		pub.SetWriteDeadline(time.Now().Add(time.Second * 5))
+
+		for i := 0; i < n; i++ {
+			msg := newPublishMessage(0, 0)
+			msg.SetPayload(payload)
+
+			require.NoError(t, writeMessage(pub, msg))
+		}
+
+		ping := message.NewPingreqMessage()
+		require.NoError(t, writeMessage(pub, ping))
+		expectMessage(t, pub, message.PINGRESP)
+	}
+
+	// The QoS 0 messages that don't fit are dropped, and the client stays connected
+	// until it's been stalled for a second
+	publish(400)
+	require.Equal(t, int64(0), svr.Metrics().SlowConsumers)
+
+	time.Sleep(time.Millisecond * 1200)
+	publish(1)
+
+	select {
+	case dropped := <-evicted:
+		require.True(t, dropped > 0)
+
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expecting the slow consumer to be disconnected")
+	}
+
+	expectClosed(t, slow)
+
+	m := svr.Metrics()
+	require.Equal(t, int64(1), m.SlowConsumers)
+	require.True(t, m.MessagesDropped > 0)
+}
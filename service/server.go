@@ -15,18 +15,19 @@
 package service
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
-	"net/url"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/surge/glog"
 	"github.com/surgemq/message"
 	"github.com/surgemq/surgemq/auth"
+	"github.com/surgemq/surgemq/logger"
 	"github.com/surgemq/surgemq/sessions"
 	"github.com/surgemq/surgemq/topics"
 )
@@ -36,16 +37,97 @@ var (
 	ErrInvalidSubscriber      error = errors.New("service: Invalid subscriber")
 	ErrBufferNotReady         error = errors.New("service: buffer is not ready")
 	ErrBufferInsufficientData error = errors.New("service: buffer has insufficient data.")
+	ErrServerClosed           error = errors.New("service: Server is closed")
 )
 
 const (
-	DefaultKeepAlive        = 300
-	DefaultConnectTimeout   = 2
-	DefaultAckTimeout       = 20
-	DefaultTimeoutRetries   = 3
-	DefaultSessionsProvider = "mem"
-	DefaultAuthenticator    = "mockSuccess"
-	DefaultTopicsProvider   = "mem"
+	DefaultKeepAlive           = 300
+	DefaultConnectTimeout      = 2
+	DefaultAckTimeout          = 20
+	DefaultTimeoutRetries      = 3
+	DefaultSessionsProvider    = "mem"
+	DefaultAuthenticator       = "mockSuccess"
+	DefaultAuthorizer          = "mockAllow"
+	DefaultTopicsProvider      = "mem"
+	DefaultReceiveMaximum      = 1024
+	DefaultMetricsInterval     = 60
+	DefaultOfflineQueueSize    = 1000
+	DefaultExpiryInterval      = 60
+	DefaultOutgoingQueue       = 1024
+	DefaultWriteFlushSize      = 1024 * 64
+	DefaultSlowConsumerTimeout = 30
+	DefaultStatsInterval       = 60
+	DefaultMaxTopicStats       = 10000
+)
+
+// Strictness controls how the server deals with clients that don't quite follow the
+// spec.
+type Strictness int
+
+const (
+	// Strict disconnects a client on any protocol violation, as the spec requires.
+	Strict Strictness = iota
+
+	// Lenient tolerates the following violations. Everything else still causes a
+	// disconnect.
+	//
+	// - Reserved flags in the fixed header of a non-PUBLISH packet set to the wrong
+	//   value, e.g., SUBSCRIBE, UNSUBSCRIBE or PUBREL sent with flags 0. The flags
+	//   are corrected, with a warning, and the packet is processed as usual.
+	//
+	// - Extra bytes at the end of a packet, inside the remaining length, that are
+	//   not part of any field, e.g., PINGREQ with a remaining length of 1. The
+	//   extra bytes are skipped, with a warning.
+	//
+	// - Topic names and filters that are not valid UTF-8 or contain U+0000, and
+	//   PUBLISH topic names with wildcards. They're handed to the topics provider
+	//   as they are, which doesn't deliver messages for topic names with wildcards.
+	//
+	// - The DUP flag set on a QoS 0 PUBLISH, and a packet ID of 0 on a PUBLISH,
+	//   SUBSCRIBE or UNSUBSCRIBE that needs one. Both are used as they are.
+	//
+	// - A will topic that's not a valid topic name in CONNECT, and a zero length
+	//   client ID without a clean session. The client is assigned an ID, and given
+	//   a clean session, as usual, if the message package lets it through.
+	//
+	// The rest of the CONNECT packet is always checked strictly.
+	Lenient
+)
+
+// TakeoverPolicy decides what happens when a client connects with the client ID of a
+// client that's already connected.
+type TakeoverPolicy int
+
+const (
+	// DisconnectOld disconnects the client that's already connected, as the spec
+	// requires. Its will is published, same as if its connection was lost.
+	DisconnectOld TakeoverPolicy = iota
+
+	// DisconnectOldNoWill disconnects the client that's already connected without
+	// publishing its will.
+	DisconnectOldNoWill
+
+	// RejectNew turns away the new client with the identifier rejected return code,
+	// and leaves the one that's already connected alone.
+	RejectNew
+)
+
+// SlowConsumerPolicy decides what happens when a message is sent to a client whose
+// outgoing queue is full, because the client isn't reading fast enough.
+type SlowConsumerPolicy int
+
+const (
+	// BlockSlowConsumer waits for room in the queue. Publishers to the client, and
+	// the client's own acks, wait along with it.
+	BlockSlowConsumer SlowConsumerPolicy = iota
+
+	// DisconnectSlowConsumer disconnects the client, and the message is not sent.
+	DisconnectSlowConsumer
+
+	// DropSlowConsumer drops QoS 0 messages, and waits for room in the queue for the
+	// others. If the queue stays full, with nothing going out, for longer than
+	// Server.SlowConsumerTimeout, the client is disconnected.
+	DropSlowConsumer
 )
 
 // Server is a library implementation of the MQTT server that, as best it can, complies
@@ -67,10 +149,125 @@ type Server struct {
 	// If no set then default to 3 retries.
 	TimeoutRetries int
 
+	// The most seconds a client can ask for as its keep alive in CONNECT. Clients
+	// asking for more, or for none at all, get this instead, and are disconnected
+	// once they've been silent for one and a half times as long. If not set then
+	// clients get what they ask for. See also Listener.MaxKeepAlive.
+	MaxKeepAlive int
+
+	// The maximum number of incoming QoS 2 messages a client can have waiting for
+	// PUBREL at any one time. A client that exceeds this is disconnected.
+	// If not set then default to 1024 messages.
+	ReceiveMaximum int
+
+	// The maximum number of QoS 1 and 2 messages sent to a client that it hasn't
+	// acked yet, so constrained devices aren't swamped. Further messages wait in the
+	// client's session, in the same queue as the messages kept while it's away and
+	// with the same OfflineQueueSize limit, until acks make room for them. Hooks can
+	// change it per client, see ClientTimeouts. If not set then there's no limit.
+	MaxInflight int
+
+	// The maximum number of QoS 1 and 2 messages queued for a client with a persistent
+	// session, i.e., CleanSession set to 0, while it's disconnected. The messages are
+	// delivered when the client reconnects. If not set then default to 1000 messages.
+	// If negative then messages are not queued.
+	OfflineQueueSize int
+
+	// OfflineQueuePolicy decides what happens when a client's offline queue is full.
+	// See sessions.OverflowPolicy. If not set then default to sessions.DropOldest.
+	OfflineQueuePolicy sessions.OverflowPolicy
+
+	// How long PUBLISH messages live once they come in. Retained messages are removed
+	// once they expire, and so are the messages queued for offline clients. TopicTTLs
+	// set it for some topics, the first one matching is used. If not set then the
+	// messages never expire.
+	MessageTTL time.Duration
+	TopicTTLs  []TopicTTL
+
+	// The number of seconds a persistent session, i.e., CleanSession set to 0, is kept
+	// once its client has gone away, along with its offline queue. Hooks can change
+	// it per client, see ClientTimeouts. If not set then sessions are kept until
+	// their client comes back.
+	SessionExpiry int
+
+	// The number of seconds between looking for expired messages and sessions. If not
+	// set then default to 60 seconds.
+	ExpiryInterval int
+
+	// The maximum number of messages waiting to go into each client's outgoing buffer.
+	// Messages to a client are encoded by whoever sends them, e.g., the publisher, and
+	// queued, so the senders don't wait on each other. If not set then default to
+	// 1024 messages.
+	OutgoingQueue int
+
+	// SlowConsumer decides what happens when a client's outgoing queue is full. See
+	// SlowConsumerPolicy. If not set then default to BlockSlowConsumer.
+	SlowConsumer SlowConsumerPolicy
+
+	// The number of seconds a client's outgoing queue can stay full before the client
+	// is disconnected, with DropSlowConsumer. If not set then default to 30 seconds.
+	SlowConsumerTimeout int
+
+	// The most bytes written to a client's connection at once. Whatever is waiting in
+	// the outgoing buffer goes out in a single write, up to WriteFlushSize, so a burst
+	// of small messages costs one system call instead of one each. It can't be more
+	// than the 256KB of the outgoing buffer. If not set then default to 64KB.
+	WriteFlushSize int
+
+	// How long the sender waits for WriteFlushSize bytes to be ready before writing
+	// what there is. Under load this makes for fewer and bigger writes, at the cost of
+	// up to WriteFlushInterval of latency for each message. If not set then the sender
+	// doesn't wait.
+	WriteFlushInterval time.Duration
+
+	// The maximum number of clients connected at the same time, and from the same
+	// IP address. Clients over the limit get a CONNACK with the server unavailable
+	// return code. If not set then there's no limit. See also Listener.MaxConnections.
+	MaxConnections      int
+	MaxConnectionsPerIP int
+
+	// The maximum number of PUBLISH messages a second each client can send, on
+	// average. A client can also send this many at once. Clients going over are
+	// disconnected. If not set then there's no limit.
+	MaxPublishRate int
+
+	// The maximum size in bytes of the payload of the PUBLISH messages from clients.
+	// Clients sending bigger ones are disconnected. If not set then there's no limit.
+	MaxPayloadSize int
+
+	// The maximum size in bytes of any message from clients, header included, CONNECT
+	// too. Clients sending bigger ones are disconnected as soon as the header is read,
+	// before any room is made for the rest. If not set then there's no limit.
+	MaxPacketSize int
+
+	// The number of seconds to wait before publishing the will of a client whose
+	// connection was lost. If the client connects again, with the same client ID,
+	// before then, the will is not published. Wills still waiting when the server is
+	// closed are dropped. If not set then the will is published right away.
+	WillDelay int
+
+	// Takeover decides what happens when a client connects with the client ID of one
+	// that's already connected. See TakeoverPolicy. If not set then default to
+	// DisconnectOld.
+	Takeover TakeoverPolicy
+
+	// StrictMode decides whether recoverable protocol violations are tolerated or
+	// cause a disconnect. See Lenient for the list of violations that are tolerated.
+	// If not set then default to Strict.
+	StrictMode Strictness
+
 	// Authenticator is the authenticator used to check username and password sent
-	// in the CONNECT message. If not set then default to "mockSuccess".
+	// in the CONNECT message. Clients that connect over TLS with a certificate are
+	// checked by their certificate instead if the authenticator can do that, see
+	// auth.CertAuthenticator. If not set then default to "mockSuccess".
 	Authenticator string
 
+	// Authorizer is the authorizer that decides which topics each client can
+	// subscribe and publish to. Subscriptions that are not allowed get a failure
+	// return code in the SUBACK, and messages that are not allowed are acked but
+	// dropped. If not set then default to "mockAllow", which allows everything.
+	Authorizer string
+
 	// SessionsProvider is the session store that keeps all the Session objects.
 	// This is the store to check if CleanSession is set to 0 in the CONNECT message.
 	// If not set then default to "mem".
@@ -80,21 +277,140 @@ type Server struct {
 	// If not set then default to "mem".
 	TopicsProvider string
 
+	// SharedBalancer creates the Balancer that decides which subscriber of a shared
+	// subscription, i.e., "$share/{group}/{filter}", gets each message. It's ignored
+	// if the topics provider doesn't support it. If not set then default to
+	// topics.NewRoundRobinBalancer.
+	SharedBalancer topics.NewBalancerFunc
+
+	// RetainedStore is where the retained messages are kept so they survive a
+	// restart, e.g., topics.NewBoltStore(). The messages in it are loaded when the
+	// server starts, and it's closed along with the server. If not set then the
+	// retained messages are only kept in memory.
+	RetainedStore topics.RetainedStore
+
+	// Listeners are the endpoints Serve() accepts clients on, e.g., TCP, TLS, WebSocket
+	// and Unix domain sockets, all at the same time. See Listener.
+	Listeners []*Listener
+
+	// TLSConfig is the TLS configuration used by ListenAndServeTLS(). To require,
+	// and verify, client certificates, set ClientAuth to tls.RequireAndVerifyClientCert
+	// and ClientCAs to the pool of CAs the client certificates must be signed by.
+	// If not set then default to the zero tls.Config.
+	TLSConfig *tls.Config
+
+	// TransformOutbound, if set, is called for every PUBLISH message just before it's
+	// sent to a subscriber, so the message can be tailored per client or not sent at
+	// all. The message passed in is shared by all the subscribers, so it must not be
+	// modified. Return a new message instead.
+	TransformOutbound TransformFunc
+
+	// PayloadFilters check, and can rewrite, the payloads of the messages published by
+	// the clients, wills included, to the topics matching their filters. They are
+	// applied once the authorizer has allowed the message, before the OnPublish hooks,
+	// and all the filters matching the topic are, in order. Messages published with
+	// Publish() are not checked. If not set then payloads are not checked.
+	PayloadFilters []PayloadFilter
+
+	// Hooks are called, in order, as clients connect, subscribe, publish and get
+	// messages, and when they disconnect, so traffic can be audited, filtered or
+	// changed. See Hooks. If not set then there are no hooks.
+	Hooks []*Hooks
+
+	// Webhooks send the events of the server to HTTP endpoints. They are started
+	// along with the server, and stopped once all the clients are gone, after the
+	// last events are sent. See Webhook. If not set then there are no webhooks.
+	Webhooks []*Webhook
+
+	// Connectors forward the messages published on the server to other systems, e.g.,
+	// a KafkaConnector. They are started along with the server, and stopped once all
+	// the clients are gone, after the messages they have queued are sent. If not set
+	// then there are no connectors.
+	Connectors []Connector
+
+	// TracePackets, if set, logs the packet ID and topic of every PUBLISH message
+	// received or sent, and of each of its acks, so a single message can be followed
+	// through the server. Acks of messages sent by the server are logged once the
+	// ack cycle for the message completes. This is meant for debugging, e.g., when
+	// QoS 1 messages don't seem to get acked, as it logs several lines per message.
+	TracePackets bool
+
+	// Logger is what the server, and its clusters, bridges, webhooks and connectors,
+	// log through. Each of them adds a logger.Subsystem field, so their messages can
+	// be told apart, or silenced with logger.Levels. The sessions package is set to
+	// log through it too. If not set then default to glog.
+	Logger logger.Logger
+
+	// Tracer, if set, starts the spans that follow each PUBLISH from the clients
+	// through the server, from when it's received, through the authorizer and the
+	// topic match, to its delivery to each subscriber and their ack. See SpanPublish
+	// for the spans, and Hooks.TraceContext for continuing the client's trace. If not
+	// set then there's no tracing.
+	Tracer Tracer
+
+	// Cluster, if set, makes the server a node of a cluster of servers that act as
+	// one. It's started along with the server, and stopped when it's closed. See
+	// Cluster for how the nodes work together.
+	Cluster *Cluster
+
+	// Bridges are the remote brokers the server connects to, as a client, to forward
+	// messages to and from. They are started along with the server, and stopped when
+	// it's closed. If not set then there are no bridges.
+	Bridges []*Bridge
+
+	// MQTTSNGateways are the UDP addresses MQTT-SN clients, e.g., sensors, connect to
+	// the server on. They are started along with the server, and stopped when it's
+	// closed. If not set then there are no gateways.
+	MQTTSNGateways []*MQTTSNGateway
+
+	// The number of seconds between walks of the topic tree to refresh the topic
+	// estimates in Metrics(). If not set then default to 60 seconds.
+	MetricsInterval int
+
+	// OnStats, if set, is called with Stats() every StatsInterval seconds, e.g., to
+	// export the traffic of each client and topic to a time series database. It's
+	// called from a goroutine of its own, and the next call waits for it to return.
+	// StatsInterval defaults to 60 seconds.
+	OnStats       func(Stats)
+	StatsInterval int
+
+	// The maximum number of topics Stats() keeps the counts of. Topics published to
+	// once there are this many are not counted. If not set then default to 10000.
+	MaxTopicStats int
+
 	// authMgr is the authentication manager that we are going to use for authenticating
 	// incoming connections
 	authMgr *auth.Manager
 
+	// authzMgr is the authorization manager that decides what the clients can do
+	authzMgr *auth.AuthorizerManager
+
 	// sessMgr is the sessions manager for keeping track of the sessions
 	sessMgr *sessions.Manager
 
 	// topicsMgr is the topics manager for keeping track of subscriptions
 	topicsMgr *topics.Manager
 
+	// hooks are the Hooks, followed by the hooks of the Webhooks
+	hooks []*Hooks
+
+	// msgProps are the properties of the PUBLISH messages from the MQTT 5.0 clients on
+	// their way to the subscribers
+	msgProps msgProps5
+
+	// log is Logger with the "server" subsystem
+	log logger.Logger
+
+	// tracing wraps Tracer, if set
+	tracing *tracing
+
 	// The quit channel for the server. If the server detects that this channel
 	// is closed, then it's a signal for it to shutdown as well.
 	quit chan struct{}
 
-	ln net.Listener
+	// The listeners that are running, for all of ListenAndServe(), Serve(), etc.,
+	// and the Listener each is for. Protected by mu.
+	listeners map[net.Listener]*Listener
 
 	// A list of services created by the server. We keep track of them so we can
 	// gracefully shut them down if they are still alive when the server goes down.
@@ -103,76 +419,97 @@ type Server struct {
 	// Mutex for updating svcs
 	mu sync.Mutex
 
-	// A indicator on whether this server is running
-	running int32
+	// The wills waiting for WillDelay to pass, by client ID. Protected by mu.
+	wills map[string]*time.Timer
+
+	// Serializes looking up the sessions of the clients connecting, and removing the
+	// ones that have expired, so a session isn't removed as it's being resumed.
+	sessMu sync.Mutex
+
+	// The client IDs, usernames and addresses that are not allowed to connect. See
+	// BanClientID.
+	bans bans
+
+	// Number of connections, in all and by IP address, for MaxConnections and
+	// MaxConnectionsPerIP. Protected by mu.
+	nconns  int
+	ipconns map[string]int
 
 	// A indicator on whether this server has already checked configuration
 	configOnce sync.Once
 
-	subs []interface{}
-	qoss []byte
+	// Protects the settings Reload() can change, from the clients connecting, and
+	// makes sure only one Reload() runs at a time
+	cmu sync.RWMutex
+	rmu sync.Mutex
+
+	// Latest metrics snapshot, and the mutex for updating it
+	metrics Metrics
+	mmu     sync.RWMutex
+
+	// The counts for Metrics(), updated by all the services
+	counters counters
+
+	// The counts by topic for Stats(), and makes sure only one statsLoop() runs
+	topicStats *topicStats
+	statsOnce  sync.Once
+
+	// Makes sure only one metricsLoop() runs, whichever listener starts first
+	metricsOnce sync.Once
+
+	// Matches topics to TopicTTLs, and makes sure only one expiryLoop() runs
+	ttls       topics.TopicsProvider
+	expiryOnce sync.Once
+
+	// Matches topics to PayloadFilters
+	payloads *payloadFilters
+
+	// Makes sure the cluster and the bridges are only started once, whichever
+	// listener starts first, and whether they were
+	peersOnce sync.Once
+	peersUp   bool
 }
 
 // ListenAndServe listents to connections on the URI requested, and handles any
 // incoming MQTT client sessions. It should not return until Close() is called
 // or if there's some critical error that stops the server from running. The URI
 // supplied should be of the form "protocol://host:port" that can be parsed by
-// url.Parse(). For example, an URI could be "tcp://0.0.0.0:1883".
+// url.Parse(). For example, an URI could be "tcp://0.0.0.0:1883". See Listener.URI
+// for the other schemes. It can be called more than once, for different URIs, to
+// listen on all of them at the same time. Serve() does that for Listeners.
 func (this *Server) ListenAndServe(uri string) error {
-	defer atomic.CompareAndSwapInt32(&this.running, 1, 0)
+	return this.listenAndServe(&Listener{URI: uri})
+}
 
-	if !atomic.CompareAndSwapInt32(&this.running, 0, 1) {
-		return fmt.Errorf("server/ListenAndServe: Server is already running")
+// ListenAndServeTLS is like ListenAndServe, except that the clients connect using
+// TLS, based on TLSConfig. The certificate and matching private key for the server
+// are loaded from certFile and keyFile, which should be in PEM format. They can
+// be left empty if TLSConfig already has the certificates. The URI scheme can be
+// "tcp", or any of "ssl", "tls" and "mqtts" to mean TCP with TLS. For example, an
+// URI could be "ssl://0.0.0.0:8883".
+func (this *Server) ListenAndServeTLS(uri, certFile, keyFile string) error {
+	config := this.TLSConfig
+	if config == nil {
+		config = &tls.Config{}
 	}
 
-	this.quit = make(chan struct{})
-
-	u, err := url.Parse(uri)
-	if err != nil {
-		return err
-	}
+	return this.listenAndServe(&Listener{
+		URI:       uri,
+		TLSConfig: config,
+		CertFile:  certFile,
+		KeyFile:   keyFile,
+	})
+}
 
-	this.ln, err = net.Listen(u.Scheme, u.Host)
+// listenAndServe opens the listener for l, then handles the clients connecting on
+// it.
+func (this *Server) listenAndServe(l *Listener) error {
+	ln, err := this.listen(l)
 	if err != nil {
 		return err
 	}
-	defer this.ln.Close()
-
-	glog.Infof("server/ListenAndServe: server is ready...")
-
-	var tempDelay time.Duration // how long to sleep on accept failure
-
-	for {
-		conn, err := this.ln.Accept()
-
-		if err != nil {
-			// http://zhen.org/blog/graceful-shutdown-of-go-net-dot-listeners/
-			select {
-			case <-this.quit:
-				return nil
-
-			default:
-			}
 
-			// Borrowed from go1.3.3/src/pkg/net/http/server.go:1699
-			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				if tempDelay == 0 {
-					tempDelay = 5 * time.Millisecond
-				} else {
-					tempDelay *= 2
-				}
-				if max := 1 * time.Second; tempDelay > max {
-					tempDelay = max
-				}
-				glog.Errorf("server/ListenAndServe: Accept error: %v; retrying in %v", err, tempDelay)
-				time.Sleep(tempDelay)
-				continue
-			}
-			return err
-		}
-
-		go this.handleConnection(conn)
-	}
+	return this.serve(l, ln)
 }
 
 // Publish sends a single MQTT PUBLISH message to the server. On completion, the
@@ -186,25 +523,31 @@ func (this *Server) Publish(msg *message.PublishMessage, onComplete OnCompleteFu
 	}
 
 	if msg.Retain() {
-		if err := this.topicsMgr.Retain(msg); err != nil {
-			glog.Errorf("Error retaining message: %v", err)
+		if err := retainMessage(this.topicsMgr, msg, this.retainTTL()); err != nil {
+			this.log.Errorf("Error retaining message: %v", err)
 		}
 	}
 
-	if err := this.topicsMgr.Subscribers(msg.Topic(), msg.QoS(), &this.subs, &this.qoss); err != nil {
+	// Publish can be called from anywhere, e.g., by the bridges, so the subscribers
+	// are not kept in the server between calls.
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	if err := this.topicsMgr.Subscribers(msg.Topic(), msg.QoS(), &subs, &qoss); err != nil {
 		return err
 	}
 
 	msg.SetRetain(false)
 
-	//glog.Debugf("(server) Publishing to topic %q and %d subscribers", string(msg.Topic()), len(this.subs))
-	for _, s := range this.subs {
+	this.topicStats.published(msg.Topic(), countSubscribers(subs))
+
+	//glog.Debugf("(server) Publishing to topic %q and %d subscribers", string(msg.Topic()), len(subs))
+	for _, s := range subs {
 		if s != nil {
-			fn, ok := s.(*OnPublishFunc)
-			if !ok {
-				glog.Errorf("Invalid onPublish Function")
-			} else {
-				(*fn)(msg)
+			if err := deliver(s, msg, nil, &this.counters, this.log); err == ErrInvalidSubscriber {
+				this.log.Errorf("Invalid onPublish Function")
 			}
 		}
 	}
@@ -212,20 +555,214 @@ func (this *Server) Publish(msg *message.PublishMessage, onComplete OnCompleteFu
 	return nil
 }
 
+// Broadcast sends a PUBLISH message to every connected client, whether or not the
+// client is subscribed to the topic, e.g., for maintenance notices on "$SYS/notice".
+// The message is queued to each client without waiting. Clients that don't have
+// room for it in their outgoing buffer, i.e., slow consumers, are skipped. Since
+// this is an operator override, TransformOutbound is not applied. It returns the
+// number of clients the message was queued to.
+func (this *Server) Broadcast(topic string, payload []byte, qos byte) (int, error) {
+	if err := this.checkConfiguration(); err != nil {
+		return 0, err
+	}
+
+	msg := message.NewPublishMessage()
+
+	if err := msg.SetTopic([]byte(topic)); err != nil {
+		return 0, err
+	}
+
+	if err := msg.SetQoS(qos); err != nil {
+		return 0, err
+	}
+
+	msg.SetPayload(payload)
+
+	cnt := 0
+
+	for _, svc := range this.services() {
+		ok, err := svc.tryPublish(msg)
+		if err != nil {
+			this.log.Errorf("(%s) server/Broadcast: %v", svc.cid(), err)
+			continue
+		}
+
+		if !ok {
+			this.log.Infof("(%s) server/Broadcast: Outgoing buffer is full, skipping.", svc.cid())
+			continue
+		}
+
+		cnt++
+	}
+
+	return cnt, nil
+}
+
 // Close terminates the server by shutting down all the client connections and closing
 // the listener. It will, as best it can, clean up after itself.
 func (this *Server) Close() error {
+	// Make sure the quit channel exists, in case Close() races with the server
+	// starting up.
+	if err := this.checkConfiguration(); err != nil {
+		return err
+	}
+
+	this.stopListening()
+	this.stopPeers()
+
+	for _, svc := range this.services() {
+		this.log.Infof("Stopping service %d", svc.id)
+		svc.stop()
+	}
+
+	this.closeManagers()
+
+	return nil
+}
+
+// Shutdown is like Close, except that the clients are let go gracefully. The server
+// stops accepting new connections right away, then waits for what's left in each
+// client's outgoing buffer to be sent before closing the connection. The sessions
+// are saved as the clients go, and the session store is closed once they're all
+// gone. If ctx is done before then, the remaining connections are closed without
+// waiting and ctx.Err() is returned. A server that's been shut down can't be
+// started again.
+func (this *Server) Shutdown(ctx context.Context) error {
+	if err := this.checkConfiguration(); err != nil {
+		return err
+	}
+
+	this.stopListening()
+	this.stopPeers()
+
+	var wg sync.WaitGroup
+
+	// Connections that were accepted just before the listeners closed may still be
+	// coming in, so keep going until there are none left.
+	for svcs := this.services(); len(svcs) > 0; svcs = this.services() {
+		for _, svc := range svcs {
+			wg.Add(1)
+			go func(svc *service) {
+				defer wg.Done()
+
+				this.log.Infof("Draining service %d", svc.id)
+				svc.drain(ctx)
+				svc.stop()
+			}(svc)
+		}
+
+		wg.Wait()
+	}
+
+	this.closeManagers()
+
+	return ctx.Err()
+}
+
+// stopListening closes the quit channel and the listeners, so no new connections
+// are accepted. It's safe to call more than once.
+func (this *Server) stopListening() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
 	// By closing the quit channel, we are telling the server to stop accepting new
 	// connection.
-	close(this.quit)
+	select {
+	case <-this.quit:
+	default:
+		close(this.quit)
+	}
 
-	// We then close the net.Listener, which will force Accept() to return if it's
+	// We then close the net.Listeners, which will force Accept() to return if it's
 	// blocked waiting for new connections.
-	this.ln.Close()
+	for ln := range this.listeners {
+		ln.Close()
+	}
+}
 
-	for _, svc := range this.svcs {
-		glog.Infof("Stopping service %d", svc.id)
-		svc.stop()
+// startPeers starts the cluster, the bridges and the MQTT-SN gateways, the first time
+// it's called.
+func (this *Server) startPeers() error {
+	var err error
+
+	this.peersOnce.Do(func() {
+		if this.Cluster != nil {
+			if err = this.Cluster.start(this); err != nil {
+				return
+			}
+		}
+
+		for i, b := range this.Bridges {
+			if err = b.start(this); err != nil {
+				for _, b := range this.Bridges[:i] {
+					b.stop()
+				}
+
+				if this.Cluster != nil {
+					this.Cluster.stop()
+				}
+
+				return
+			}
+		}
+
+		for i, g := range this.MQTTSNGateways {
+			if err = g.start(this); err != nil {
+				for _, g := range this.MQTTSNGateways[:i] {
+					g.stop()
+				}
+
+				for _, b := range this.Bridges {
+					b.stop()
+				}
+
+				if this.Cluster != nil {
+					this.Cluster.stop()
+				}
+
+				return
+			}
+		}
+
+		this.peersUp = true
+	})
+
+	return err
+}
+
+// stopPeers stops the cluster, the bridges and the MQTT-SN gateways, if they have
+// been started.
+func (this *Server) stopPeers() {
+	this.peersOnce.Do(func() {})
+
+	if !this.peersUp {
+		return
+	}
+
+	for _, g := range this.MQTTSNGateways {
+		g.stop()
+	}
+
+	for _, b := range this.Bridges {
+		b.stop()
+	}
+
+	if this.Cluster != nil {
+		this.Cluster.stop()
+	}
+}
+
+// closeManagers closes the sessions and topics managers, and stops the connectors and
+// webhooks, once all the services have stopped.
+func (this *Server) closeManagers() {
+	this.stopWills()
+
+	for _, c := range this.Connectors {
+		c.Stop()
+	}
+
+	for _, w := range this.Webhooks {
+		w.stop()
 	}
 
 	if this.sessMgr != nil {
@@ -235,12 +772,11 @@ func (this *Server) Close() error {
 	if this.topicsMgr != nil {
 		this.topicsMgr.Close()
 	}
-
-	return nil
 }
 
-// HandleConnection is for the broker to handle an incoming connection from a client
-func (this *Server) handleConnection(c io.Closer) (svc *service, err error) {
+// HandleConnection is for the broker to handle an incoming connection from a client.
+// l is the listener the client connected on, if any.
+func (this *Server) handleConnection(c io.Closer, l *Listener) (svc *service, err error) {
 	if c == nil {
 		return nil, ErrInvalidConnectionType
 	}
@@ -256,11 +792,53 @@ func (this *Server) handleConnection(c io.Closer) (svc *service, err error) {
 		return nil, err
 	}
 
+	// Turn away connections that got through just before the server was closed
+	select {
+	case <-this.quit:
+		return nil, ErrServerClosed
+
+	default:
+	}
+
 	conn, ok := c.(net.Conn)
 	if !ok {
 		return nil, ErrInvalidConnectionType
 	}
 
+	ip := remoteIP(conn)
+
+	if this.bans.bannedAddr(ip, time.Now()) {
+		this.log.Infof("server/handleConnection: Closing connection from banned address %s", ip)
+		return nil, ErrBanned
+	}
+
+	// The settings Reload() can change are read under cmu, but it's not held while
+	// waiting on the client, or on the authenticator.
+	this.cmu.RLock()
+	connectTimeout, maxPacketSize := this.connectTimeout(l), this.MaxPacketSize
+	this.cmu.RUnlock()
+
+	// Take up one of the connections allowed. It's given back when the service
+	// stops, or right away if the client doesn't get that far.
+	release, ok := this.admit(ip, l)
+	if !ok {
+		conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(connectTimeout)))
+
+		if _, v5, err := getConnectMessage(conn, maxPacketSize); err == nil {
+			resp := message.NewConnackMessage()
+			resp.SetReturnCode(message.ErrServerUnavailable)
+			writeConnack(conn, resp, v5, nil)
+		}
+
+		return nil, ErrTooManyConnections
+	}
+
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+
 	// To establish a connection, we must
 	// 1. Read and decode the message.ConnectMessage from the wire
 	// 2. If no decoding errors, then authenticate using username and password.
@@ -274,97 +852,428 @@ func (this *Server) handleConnection(c io.Closer) (svc *service, err error) {
 	// a CONNACK error. If it's CONNACK error, send the proper CONNACK error back
 	// to client. Exit regardless of error type.
 
-	conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(this.ConnectTimeout)))
+	conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(connectTimeout)))
 
 	resp := message.NewConnackMessage()
 
-	req, err := getConnectMessage(conn)
+	req, v5, err := getConnectMessage(conn, maxPacketSize)
 	if err != nil {
 		if cerr, ok := err.(message.ConnackCode); ok {
 			//glog.Debugf("request   message: %s\nresponse message: %s\nerror           : %v", mreq, resp, err)
 			resp.SetReturnCode(cerr)
 			resp.SetSessionPresent(false)
-			writeMessage(conn, resp)
+			writeConnack(conn, resp, v5, nil)
 		}
 		return nil, err
 	}
 
+	if this.StrictMode != Lenient {
+		if err = validateConnect(req); err != nil {
+			if cerr, ok := err.(message.ConnackCode); ok {
+				resp.SetReturnCode(cerr)
+				writeConnack(conn, resp, v5, nil)
+			}
+			return nil, err
+		}
+	}
+
 	// Authenticate the user, if error, return error and exit
-	if err = this.authMgr.Authenticate(string(req.Username()), string(req.Password())); err != nil {
+	this.cmu.RLock()
+	authMgr := this.authMgr
+	if l != nil && l.authMgr != nil {
+		authMgr = l.authMgr
+	}
+	this.cmu.RUnlock()
+
+	var (
+		username string
+		claims   map[string]interface{}
+		authData []byte
+	)
+
+	// MQTT 5.0 clients with an Authentication Method go through enhanced
+	// authentication instead.
+	if v5 != nil && v5.authMethod != nil {
+		username, v5.authMgr = string(req.Username()), authMgr
+		authData, err = this.authenticate5(authMgr, conn, req, v5, maxPacketSize)
+	} else {
+		username, claims, err = this.authenticate(authMgr, conn, req)
+	}
+
+	if err != nil {
+		this.counters.authFailed()
 		resp.SetReturnCode(message.ErrBadUsernameOrPassword)
 		resp.SetSessionPresent(false)
-		writeMessage(conn, resp)
+
+		switch {
+		case err == auth.ErrAuthMethodNotSupported:
+			writeMessageBuffer(conn, packet5(nil, byte(message.CONNACK)<<4, []byte{0, reasonBadAuthMethod, 0}))
+
+		case v5 != nil && v5.authMethod != nil:
+			resp.SetReturnCode(message.ErrNotAuthorized)
+			writeConnack(conn, resp, v5, nil)
+
+		default:
+			writeConnack(conn, resp, v5, nil)
+		}
+
 		return nil, err
 	}
 
-	if req.KeepAlive() == 0 {
-		req.SetKeepAlive(minKeepAlive)
+	this.cmu.RLock()
+
+	timeouts := this.timeouts(l, req)
+	if v5 != nil {
+		v5.timeouts(&timeouts)
 	}
 
 	svc = &service{
 		id:     atomic.AddUint64(&gsvcid, 1),
 		client: false,
 
-		keepAlive:      int(req.KeepAlive()),
-		connectTimeout: this.ConnectTimeout,
-		ackTimeout:     this.AckTimeout,
-		timeoutRetries: this.TimeoutRetries,
+		keepAlive:      timeouts.KeepAlive,
+		connectTimeout: connectTimeout,
+		ackTimeout:     timeouts.AckTimeout,
+		timeoutRetries: timeouts.TimeoutRetries,
+		receiveMaximum: this.ReceiveMaximum,
+		maxInflight:    timeouts.MaxInflight,
+		maxPayloadSize: this.MaxPayloadSize,
+		maxPacketSize:  this.MaxPacketSize,
+		offlineSize:    this.OfflineQueueSize,
+		offlinePolicy:  this.OfflineQueuePolicy,
+		outqSize:       this.OutgoingQueue,
+		slowConsumer:   this.SlowConsumer,
+		slowTimeout:    time.Second * time.Duration(this.SlowConsumerTimeout),
+		flushSize:      this.WriteFlushSize,
+		flushInterval:  this.WriteFlushInterval,
+		ttl:            this.retainTTL(),
+		transformOut:   this.TransformOutbound,
+		payloads:       this.payloads,
+		hooks:          this.hooks,
+		lenient:        this.StrictMode == Lenient,
+		tracePackets:   this.TracePackets,
+		holdAcks:       len(this.Connectors) > 0,
+		log:            this.Logger.With(logger.Subsystem, "service"),
+		tracing:        this.tracing,
+
+		username: username,
+		claims:   claims,
+
+		conn:       conn,
+		sessMgr:    this.sessMgr,
+		topicsMgr:  this.topicsMgr,
+		authzMgr:   this.authzMgr,
+		counters:   &this.counters,
+		topicStats: this.topicStats,
+		release:    release,
+		v5:         v5,
+		msgProps:   &this.msgProps,
+	}
+
+	if this.MaxPublishRate > 0 {
+		svc.publishLimit = newRateLimiter(this.MaxPublishRate)
+	}
+
+	this.cmu.RUnlock()
+
+	// Check to see if the client supplied an ID, if not, generate one and set
+	// clean session.
+	assigned := len(req.ClientId()) == 0
+	if assigned {
+		req.SetClientId([]byte(fmt.Sprintf("internalclient%d", svc.id)))
+		req.SetCleanSession(true)
+	}
+
+	svc.info = &ClientInfo{
+		ClientId:    string(req.ClientId()),
+		Username:    username,
+		Claims:      claims,
+		RemoteAddr:  conn.RemoteAddr(),
+		ConnectedAt: time.Now(),
+	}
+
+	if this.bans.banned(svc.info.ClientId, username, "", time.Now()) {
+		this.log.Infof("(%s) server/handleConnection: Connection rejected, client is banned", svc.info.ClientId)
+		resp.SetReturnCode(message.ErrNotAuthorized)
+		writeConnack(conn, resp, v5, nil)
+		return nil, ErrBanned
+	}
+
+	if err = svc.hookConnect(req); err != nil {
+		resp.SetReturnCode(message.ErrNotAuthorized)
+		writeConnack(conn, resp, v5, nil)
+		return nil, err
+	}
+
+	svc.hookTimeouts(&timeouts)
+
+	if err = this.takeover(svc.info.ClientId); err != nil {
+		resp.SetReturnCode(message.ErrIdentifierRejected)
+		writeConnack(conn, resp, v5, nil)
+		svc.hookDisconnect()
+		return nil, err
+	}
+
+	if this.WillDelay > 0 {
+		this.cancelWill(svc.info.ClientId)
 
-		conn:      conn,
-		sessMgr:   this.sessMgr,
-		topicsMgr: this.topicsMgr,
+		svc.delayWill = func(will *message.PublishMessage) {
+			this.delayWill(svc, will)
+		}
 	}
 
 	err = this.getSession(svc, req, resp)
 	if err != nil {
+		svc.hookDisconnect()
 		return nil, err
 	}
 
 	resp.SetReturnCode(message.ConnectionAccepted)
 
-	if err = writeMessage(c, resp); err != nil {
+	var props []byte
+	if v5 != nil {
+		props = v5.connackProps(svc, req, assigned, authData)
+	}
+
+	if err = writeConnack(c, resp, v5, props); err != nil {
+		this.discardSession(svc, resp)
+		svc.hookDisconnect()
 		return nil, err
 	}
 
 	svc.inStat.increment(int64(req.Len()))
 	svc.outStat.increment(int64(resp.Len()))
+	svc.lastActivity = time.Now().UnixNano()
+	this.counters.receivedBytes(int64(req.Len()))
+	this.counters.sentBytes(int64(resp.Len()))
+
+	// Counted before start(), since stop() counts the disconnect even if start()
+	// fails.
+	this.counters.connected()
 
 	if err := svc.start(); err != nil {
 		svc.stop()
 		return nil, err
 	}
 
-	//this.mu.Lock()
-	//this.svcs = append(this.svcs, svc)
-	//this.mu.Unlock()
+	this.addService(svc)
+
+	// Banned while it was connecting, after kickBanned() went through the services
+	if this.bans.banned(svc.info.ClientId, username, ip, time.Now()) {
+		svc.stop()
+		return nil, ErrBanned
+	}
 
-	glog.Infof("(%s) server/handleConnection: Connection established.", svc.cid())
+	this.log.Infof("(%s) server/handleConnection: Connection established.", svc.cid())
 
 	return svc, nil
 }
 
+// authenticate checks the client's credentials and returns its username, and the
+// claims the authenticator found, if any. Clients connecting over TLS with a
+// certificate are authenticated with it if the authenticator supports that, and
+// are then known by the identity in the certificate. Otherwise it's the username
+// and password in the CONNECT message. Clients that sent no username are known by
+// the sub claim, if there's one.
+func (this *Server) authenticate(authMgr *auth.Manager, conn net.Conn, req *message.ConnectMessage) (string, map[string]interface{}, error) {
+	if tc, ok := conn.(interface {
+		ConnectionState() tls.ConnectionState
+	}); ok {
+		state := tc.ConnectionState()
+
+		if len(state.PeerCertificates) > 0 {
+			id, err := authMgr.AuthenticateCert(&state)
+			if err != auth.ErrCertAuthNotSupported {
+				return id, nil, err
+			}
+		}
+	}
+
+	username := string(req.Username())
+
+	claims, err := authMgr.AuthenticateClaims(username, string(req.Password()))
+	if err != nil {
+		return "", nil, err
+	}
+
+	if sub, ok := claims["sub"].(string); ok && username == "" {
+		username = sub
+	}
+
+	return username, claims, nil
+}
+
+// takeover deals with the client that's already connected with the client ID, if
+// there's one, according to the Takeover policy. It returns an error if the new
+// client should be turned away.
+func (this *Server) takeover(cid string) error {
+	old := this.connected(cid)
+	if old == nil {
+		return nil
+	}
+
+	switch this.Takeover {
+	case RejectNew:
+		return fmt.Errorf("server/takeover: Client %q is already connected", cid)
+
+	case DisconnectOldNoWill:
+		old.sess.Cmsg.SetWillFlag(false)
+	}
+
+	this.log.Infof("(%s) server/takeover: Client connected again, disconnecting the old connection.", cid)
+	old.stop()
+
+	return nil
+}
+
+// delayWill publishes the will of the service once WillDelay has passed, unless the
+// client has connected again by then.
+func (this *Server) delayWill(svc *service, will *message.PublishMessage) {
+	cid := svc.sess.ID()
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.wills == nil {
+		this.wills = make(map[string]*time.Timer)
+	}
+
+	var t *time.Timer
+
+	t = time.AfterFunc(time.Second*time.Duration(this.WillDelay), func() {
+		this.mu.Lock()
+		if this.wills[cid] != t {
+			this.mu.Unlock()
+			return
+		}
+
+		delete(this.wills, cid)
+		this.mu.Unlock()
+
+		this.log.Infof("(%s) server/delayWill: Client didn't come back. Sending Will.", cid)
+		svc.publishTraced(will)
+	})
+
+	this.wills[cid] = t
+}
+
+// cancelWill stops the will of the client from being published, if it's waiting.
+func (this *Server) cancelWill(cid string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if t, ok := this.wills[cid]; ok {
+		this.log.Debugf("(%s) server/cancelWill: Client came back, not sending Will.", cid)
+		t.Stop()
+		delete(this.wills, cid)
+	}
+}
+
+// stopWills drops the wills that are still waiting.
+func (this *Server) stopWills() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for cid, t := range this.wills {
+		t.Stop()
+		delete(this.wills, cid)
+	}
+}
+
+// addService keeps track of a newly connected service. Services that have stopped
+// since the last one was added are dropped at the same time.
+func (this *Server) addService(svc *service) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	svcs := this.svcs[:0]
+	for _, s := range this.svcs {
+		if !s.isStopped() {
+			svcs = append(svcs, s)
+		}
+	}
+
+	for i := len(svcs); i < len(this.svcs); i++ {
+		this.svcs[i] = nil
+	}
+
+	this.svcs = append(svcs, svc)
+}
+
+// services returns a copy of the list of services that are still running.
+func (this *Server) services() []*service {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	svcs := make([]*service, 0, len(this.svcs))
+	for _, svc := range this.svcs {
+		if !svc.isStopped() {
+			svcs = append(svcs, svc)
+		}
+	}
+
+	return svcs
+}
+
 func (this *Server) checkConfiguration() error {
 	var err error
 
 	this.configOnce.Do(func() {
-		if this.KeepAlive == 0 {
-			this.KeepAlive = DefaultKeepAlive
+		this.quit = make(chan struct{})
+
+		if this.Logger == nil {
+			this.Logger = logger.NewGlogLogger()
+		}
+
+		this.log = this.Logger.With(logger.Subsystem, "server")
+
+		if this.Tracer != nil {
+			this.tracing = newTracing(this.Tracer)
+		}
+
+		this.setDefaults()
+
+		if this.MetricsInterval == 0 {
+			this.MetricsInterval = DefaultMetricsInterval
+		}
+
+		if this.StatsInterval == 0 {
+			this.StatsInterval = DefaultStatsInterval
 		}
 
-		if this.ConnectTimeout == 0 {
-			this.ConnectTimeout = DefaultConnectTimeout
+		if this.MaxTopicStats == 0 {
+			this.MaxTopicStats = DefaultMaxTopicStats
 		}
 
-		if this.AckTimeout == 0 {
-			this.AckTimeout = DefaultAckTimeout
+		this.topicStats = newTopicStats(this.MaxTopicStats)
+
+		if this.OutgoingQueue == 0 {
+			this.OutgoingQueue = DefaultOutgoingQueue
 		}
 
-		if this.TimeoutRetries == 0 {
-			this.TimeoutRetries = DefaultTimeoutRetries
+		if this.SlowConsumerTimeout == 0 {
+			this.SlowConsumerTimeout = DefaultSlowConsumerTimeout
 		}
 
-		if this.Authenticator == "" {
-			this.Authenticator = "mockSuccess"
+		if this.WriteFlushSize == 0 {
+			this.WriteFlushSize = DefaultWriteFlushSize
+		}
+
+		if this.WriteFlushSize < 0 || this.WriteFlushSize > defaultBufferSize {
+			err = fmt.Errorf("server/checkConfiguration: WriteFlushSize must be between 1 and %d", defaultBufferSize)
+			return
+		}
+
+		if this.ExpiryInterval == 0 {
+			this.ExpiryInterval = DefaultExpiryInterval
+		}
+
+		if err = this.checkExpiry(); err != nil {
+			return
+		}
+
+		if this.payloads, err = newPayloadFilters(this.PayloadFilters); err != nil {
+			return
 		}
 
 		this.authMgr, err = auth.NewManager(this.Authenticator)
@@ -372,6 +1281,11 @@ func (this *Server) checkConfiguration() error {
 			return
 		}
 
+		this.authzMgr, err = auth.NewAuthorizerManager(this.Authorizer)
+		if err != nil {
+			return
+		}
+
 		if this.SessionsProvider == "" {
 			this.SessionsProvider = "mem"
 		}
@@ -381,18 +1295,115 @@ func (this *Server) checkConfiguration() error {
 			return
 		}
 
+		this.sessMgr.SetLogger(this.Logger.With(logger.Subsystem, "sessions"))
+
 		if this.TopicsProvider == "" {
 			this.TopicsProvider = "mem"
 		}
 
 		this.topicsMgr, err = topics.NewManager(this.TopicsProvider)
+		if err != nil {
+			return
+		}
 
-		return
+		if this.SharedBalancer == nil {
+			this.SharedBalancer = topics.NewRoundRobinBalancer
+		}
+
+		if err := this.topicsMgr.SetBalancer(this.SharedBalancer); err != nil {
+			this.log.Debugf("server/checkConfiguration: %v", err)
+		}
+
+		if this.Cluster != nil {
+			if err = this.Cluster.checkConfiguration(); err != nil {
+				return
+			}
+
+			this.topicsMgr.SetObserver(clusterObserver{this.Cluster})
+		}
+
+		for _, b := range this.Bridges {
+			if err = b.checkConfiguration(); err != nil {
+				return
+			}
+		}
+
+		for _, g := range this.MQTTSNGateways {
+			if err = g.checkConfiguration(); err != nil {
+				return
+			}
+		}
+
+		this.hooks = append([]*Hooks(nil), this.Hooks...)
+
+		for _, w := range this.Webhooks {
+			if err = w.checkConfiguration(); err != nil {
+				return
+			}
+
+			this.hooks = append(this.hooks, w.hooks())
+		}
+
+		if this.RetainedStore != nil {
+			if err = this.topicsMgr.SetRetainedStore(this.RetainedStore); err != nil {
+				return
+			}
+		}
+
+		for i, c := range this.Connectors {
+			if err = c.Start(this); err != nil {
+				for _, c := range this.Connectors[:i] {
+					c.Stop()
+				}
+
+				return
+			}
+		}
+
+		for _, w := range this.Webhooks {
+			w.start(this.Logger.With(logger.Subsystem, "webhook"))
+		}
 	})
 
 	return err
 }
 
+// setDefaults fills in the defaults of the settings Reload() can change, for the ones
+// that have them.
+func (this *Server) setDefaults() {
+	if this.KeepAlive == 0 {
+		this.KeepAlive = DefaultKeepAlive
+	}
+
+	if this.ConnectTimeout == 0 {
+		this.ConnectTimeout = DefaultConnectTimeout
+	}
+
+	if this.AckTimeout == 0 {
+		this.AckTimeout = DefaultAckTimeout
+	}
+
+	if this.TimeoutRetries == 0 {
+		this.TimeoutRetries = DefaultTimeoutRetries
+	}
+
+	if this.ReceiveMaximum == 0 {
+		this.ReceiveMaximum = DefaultReceiveMaximum
+	}
+
+	if this.OfflineQueueSize == 0 {
+		this.OfflineQueueSize = DefaultOfflineQueueSize
+	}
+
+	if this.Authenticator == "" {
+		this.Authenticator = DefaultAuthenticator
+	}
+
+	if this.Authorizer == "" {
+		this.Authorizer = DefaultAuthorizer
+	}
+}
+
 func (this *Server) getSession(svc *service, req *message.ConnectMessage, resp *message.ConnackMessage) error {
 	// If CleanSession is set to 0, the server MUST resume communications with the
 	// client based on state from the current session, as identified by the client
@@ -406,19 +1417,38 @@ func (this *Server) getSession(svc *service, req *message.ConnectMessage, resp *
 
 	var err error
 
-	// Check to see if the client supplied an ID, if not, generate one and set
-	// clean session.
-	if len(req.ClientId()) == 0 {
-		req.SetClientId([]byte(fmt.Sprintf("internalclient%d", svc.id)))
-		req.SetCleanSession(true)
+	cid := string(req.ClientId())
+
+	// Get the session of the client from the other nodes, if it was connected to one
+	// of them, before checking the session store.
+	clean := req.CleanSession()
+	if svc.v5 != nil {
+		clean = svc.v5.cleanStart
 	}
 
-	cid := string(req.ClientId())
+	if this.Cluster != nil {
+		this.takeoverSession(cid, clean)
+	}
+
+	// The session can't expire while it's being looked up
+	this.sessMu.Lock()
+	defer this.sessMu.Unlock()
 
 	// If CleanSession is NOT set, check the session store for existing session.
-	// If found, return it.
-	if !req.CleanSession() {
-		if svc.sess, err = this.sessMgr.Get(cid); err == nil {
+	// If found, return it. For MQTT 5.0 clients it's Clean Start that says whether
+	// to, and the clean session flag only whether the session outlasts the
+	// connection.
+	if !clean {
+		if svc.sess, err = this.sessMgr.Get(cid); err == nil && !svc.sess.Resume() {
+			svc.sess = nil
+		} else if err == nil && svc.sess.Offline.Overflowed() {
+			this.log.Infof("(%s) server/getSession: Offline queue overflowed, discarding session.", svc.cid())
+			svc.stopOffline()
+			this.sessMgr.Del(cid)
+			svc.sess = nil
+		}
+
+		if svc.sess != nil {
 			resp.SetSessionPresent(true)
 
 			if err := svc.sess.Update(req); err != nil {
@@ -436,9 +1466,21 @@ func (this *Server) getSession(svc *service, req *message.ConnectMessage, resp *
 		resp.SetSessionPresent(false)
 
 		if err := svc.sess.Init(req); err != nil {
+			this.sessMgr.Del(cid)
 			return err
 		}
 	}
 
 	return nil
 }
+
+// discardSession removes the session created for a connection that went away
+// before the client received the CONNACK. The client doesn't know the session
+// exists, so keeping it around would just leak it. Sessions that are resumed from
+// a previous connection are left alone.
+func (this *Server) discardSession(svc *service, resp *message.ConnackMessage) {
+	if svc.sess != nil && !resp.SessionPresent() {
+		this.log.Debugf("(%s) server/discardSession: Connection closed before CONNACK, removing session.", svc.cid())
+		this.sessMgr.Del(svc.sess.ID())
+	}
+}
@@ -15,13 +15,16 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"sync"
 	"sync/atomic"
+	"time"
 
-	"github.com/surge/glog"
 	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/auth"
+	"github.com/surgemq/surgemq/logger"
 	"github.com/surgemq/surgemq/sessions"
 	"github.com/surgemq/surgemq/topics"
 )
@@ -29,8 +32,16 @@ import (
 type (
 	OnCompleteFunc func(msg, ack message.Message, err error) error
 	OnPublishFunc  func(msg *message.PublishMessage) error
+
+	// TransformFunc is called with the client ID and a PUBLISH message about to be
+	// delivered to that client. It returns the message to deliver instead, and false
+	// if the message should not be delivered to the client at all.
+	TransformFunc func(cid string, msg *message.PublishMessage) (*message.PublishMessage, bool)
 )
 
+// How often drain() checks whether the outgoing buffer is empty
+const drainInterval = time.Millisecond * 10
+
 type stat struct {
 	bytes int64
 	msgs  int64
@@ -70,15 +81,113 @@ type service struct {
 	// If no set then default to 3 retries.
 	timeoutRetries int
 
+	// The number of seconds the session is kept once the client is gone, if it's a
+	// persistent session. If 0 then it's kept until the client comes back.
+	sessionExpiry int
+
+	// The maximum number of incoming QoS 2 messages waiting for PUBREL. If 0 then
+	// there's no limit.
+	receiveMaximum int
+
+	// The maximum number of outgoing QoS 1 and 2 messages waiting for acks. The ones
+	// past that wait in the session's offline queue. Server side only. If 0 then
+	// there's no limit. imu keeps the messages in order while they move in and out
+	// of the queue.
+	maxInflight int
+	imu         sync.Mutex
+
+	// The maximum size of the payload of incoming PUBLISH messages, and how many of
+	// them can come in a second. If 0, or nil, then there's no limit.
+	maxPayloadSize int
+	publishLimit   *rateLimiter
+
+	// The maximum size of any incoming message, header included. If 0 then there's
+	// no limit, other than the size of the input buffer.
+	maxPacketSize int
+
+	// The maximum number of messages in the session's offline queue, and what to do
+	// when it's full. If offlineSize is negative then messages are not queued.
+	offlineSize   int
+	offlinePolicy sessions.OverflowPolicy
+
+	// How long the messages published by the client, and the ones queued for it while
+	// it's offline, live. Server side only. If nil then they never expire.
+	ttl func(msg *message.PublishMessage) time.Duration
+
+	// Transforms, or suppresses, PUBLISH messages before they are sent to the client.
+	// Server side only. If nil then messages are delivered as is.
+	transformOut TransformFunc
+
+	// Checks the payloads of the messages published by the client. Server side only.
+	// If nil then they aren't checked. See Server.PayloadFilters.
+	payloads *payloadFilters
+
+	// The hooks to call, and the client they are called for, which is also what the
+	// admin API shows for the client. Server side only. See Server.Hooks.
+	hooks []*Hooks
+	info  *ClientInfo
+
+	// Publishes the will once the server's WillDelay has passed. Server side only. If
+	// nil then the will is published right away.
+	delayWill func(will *message.PublishMessage)
+
+	// Whether to tolerate recoverable protocol violations from the client instead
+	// of disconnecting. See Lenient.
+	lenient bool
+
+	// Whether to log each PUBLISH and its acks. See Server.TracePackets.
+	tracePackets bool
+
+	// Whether to hold back the acks of the QoS 1 and 2 messages from the client until
+	// the connectors are done with them, which is the case if the server has any, and
+	// the acks held, in order. held is the one for the message being published by the
+	// processor, if any. acks and flushing are protected by amu. See ForwardFunc.
+	holdAcks bool
+	held     *heldAck
+	acks     []*heldAck
+	flushing bool
+	amu      sync.Mutex
+
+	// What's kept for a client that connected with MQTT 5.0, whose messages are
+	// rewritten on the way in and out. Server side only. If nil then the client
+	// speaks MQTT 3.1 or 3.1.1.
+	v5 *mqtt5
+
+	// The properties of the PUBLISH messages from the MQTT 5.0 clients, which are the
+	// server's. Server side only.
+	msgProps *msgProps5
+
+	// What the service logs through
+	log logger.Logger
+
+	// The server's Tracer, if it has one, and the SpanPublish of the QoS 2 messages
+	// waiting for PUBREL, by packet ID. traces is protected by tmu.
+	tracing *tracing
+	traces  map[uint16]publishTrace
+	tmu     sync.Mutex
+
 	// Network connection for this service
 	conn io.Closer
 
 	// Session manager for tracking all the clients
 	sessMgr *sessions.Manager
 
+	// Where the client keeps its session across restarts. Client side only. If nil
+	// then the session is only kept in memory. See Client.Store.
+	store sessions.SessionsProvider
+
 	// Topics manager for all the client subscriptions
 	topicsMgr *topics.Manager
 
+	// Authorization manager for checking the topics the client subscribes and
+	// publishes to. Server side only. If nil then everything is allowed.
+	authzMgr *auth.AuthorizerManager
+
+	// The username the client connected with, and the claims it was authenticated
+	// with, if any, for the authorization manager
+	username string
+	claims   map[string]interface{}
+
 	// sess is the session object for this MQTT session. It keeps track session variables
 	// such as ClientId, KeepAlive, Username, etc
 	sess *sessions.Session
@@ -87,7 +196,31 @@ type service struct {
 	wgStarted sync.WaitGroup
 	wgStopped sync.WaitGroup
 
-	// writeMessage mutex - serializes writes to the outgoing buffer.
+	// The messages encoded by writeMessage(), waiting for writer() to put them in the
+	// outgoing buffer, and the number of bytes in them. Created by start().
+	outq   chan *[]byte
+	queued int64
+
+	// The length of outq, and what to do when it's full. If outqSize is 0 then
+	// default to DefaultOutgoingQueue.
+	outqSize     int
+	slowConsumer SlowConsumerPolicy
+	slowTimeout  time.Duration
+
+	// The most bytes sender() writes at once, and how long it waits for that many. If
+	// flushSize is 0 then default to writing 8KB at a time, without waiting.
+	flushSize     int
+	flushInterval time.Duration
+
+	// When outq was found full with nothing going out, in UnixNano, or 0 if it's not
+	// stalled, and the number of QoS 0 messages dropped because of it. See
+	// DropSlowConsumer.
+	stalled     int64
+	slowDropped int64
+	evicted     int64
+
+	// Serializes writes to the outgoing buffer for services that haven't started,
+	// which have no writer() and write to it directly.
 	wmu sync.Mutex
 
 	// Whether this is service is closed or not.
@@ -97,6 +230,10 @@ type service struct {
 	// then exit.
 	done chan struct{}
 
+	// Closed once stop() has finished, so the owner of a client knows when the
+	// connection is gone. Client side only.
+	stopped chan struct{}
+
 	// Incoming data buffer. Bytes are read from the connection and put in here.
 	in *buffer
 
@@ -115,17 +252,35 @@ type service struct {
 	inStat  stat
 	outStat stat
 
-	intmp  []byte
-	outtmp []byte
+	// Number of PUBLISH messages received and sent, and when the last packet was
+	// received, in Unix nanoseconds, for Stats()
+	publishedIn  int64
+	publishedOut int64
+	lastActivity int64
 
-	subs  []interface{}
-	qoss  []byte
-	rmsgs []*message.PublishMessage
+	// The server wide counts for Metrics(). Nil on the client side.
+	counters *counters
+
+	// The counts by topic for Stats(). Nil on the client side.
+	topicStats *topicStats
+
+	// Gives back the connection taken up from the server's limits when the service
+	// stops. Nil on the client side.
+	release func()
+
+	// The buffer readMessage() reads into, from the pool
+	intmp *[]byte
+
+	subs []interface{}
+	qoss []byte
 }
 
 func (this *service) start() error {
 	var err error
 
+	// The session logs through the same Logger as the service
+	this.sess.SetLogger(this.log)
+
 	// Create the incoming ring buffer
 	this.in, err = newBuffer(defaultBufferSize)
 	if err != nil {
@@ -138,12 +293,32 @@ func (this *service) start() error {
 		return err
 	}
 
+	// Create the queue for the outgoing buffer
+	size := this.outqSize
+	if size <= 0 {
+		size = DefaultOutgoingQueue
+	}
+
+	this.outq = make(chan *[]byte, size)
+	this.done = make(chan struct{})
+
 	// If this is a server
 	if !this.client {
 		// Creat the onPublishFunc so it can be used for published messages
 		this.onpub = func(msg *message.PublishMessage) error {
-			if err := this.publish(msg, nil); err != nil {
-				glog.Errorf("service/onPublish: Error publishing message: %v", err)
+			span, onComplete := this.startDeliver(msg)
+
+			msg, ok := this.transformOutbound(msg)
+			if !ok {
+				span.End(nil)
+				return nil
+			}
+
+			this.hookDeliver(msg)
+
+			if err := this.publishOutbound(msg, onComplete); err != nil {
+				span.End(err)
+				this.log.Errorf("service/onPublish: Error publishing message: %v", err)
 				return err
 			}
 
@@ -173,6 +348,11 @@ func (this *service) start() error {
 	this.wgStopped.Add(1)
 	go this.receiver()
 
+	// Writer is responsible for moving the queued messages into the buffer.
+	this.wgStarted.Add(1)
+	this.wgStopped.Add(1)
+	go this.writer()
+
 	// Sender is responsible for writing data in the buffer into the connection.
 	this.wgStarted.Add(1)
 	this.wgStopped.Add(1)
@@ -181,6 +361,19 @@ func (this *service) start() error {
 	// Wait for all the goroutines to start before returning
 	this.wgStarted.Wait()
 
+	// Finish the QoS 1 and 2 flows from the last connection, if this is a recovered
+	// session, then deliver whatever was queued while the client was away
+	if !this.client {
+		// The messages past the inflight window wait in the same queue
+		if this.maxInflight > 0 {
+			this.limitOffline()
+		}
+
+		this.resendInflight()
+		this.stopOffline()
+		this.deliverOffline()
+	}
+
 	return nil
 }
 
@@ -190,7 +383,7 @@ func (this *service) stop() {
 	defer func() {
 		// Let's recover from panic
 		if r := recover(); r != nil {
-			glog.Errorf("(%s) Recovering from panic: %v", this.cid(), r)
+			this.log.Errorf("(%s) Recovering from panic: %v", this.cid(), r)
 		}
 	}()
 
@@ -199,15 +392,21 @@ func (this *service) stop() {
 		return
 	}
 
+	this.counters.disconnected()
+
+	if this.release != nil {
+		defer this.release()
+	}
+
 	// Close quit channel, effectively telling all the goroutines it's time to quit
 	if this.done != nil {
-		glog.Debugf("(%s) closing this.done", this.cid())
+		this.log.Debugf("(%s) closing this.done", this.cid())
 		close(this.done)
 	}
 
 	// Close the network connection
 	if this.conn != nil {
-		glog.Debugf("(%s) closing this.conn", this.cid())
+		this.log.Debugf("(%s) closing this.conn", this.cid())
 		this.conn.Close()
 	}
 
@@ -217,18 +416,21 @@ func (this *service) stop() {
 	// Wait for all the goroutines to stop.
 	this.wgStopped.Wait()
 
-	glog.Debugf("(%s) Received %d bytes in %d messages.", this.cid(), this.inStat.bytes, this.inStat.msgs)
-	glog.Debugf("(%s) Sent %d bytes in %d messages.", this.cid(), this.outStat.bytes, this.outStat.msgs)
+	// The QoS 2 messages still waiting for PUBREL will never get it on this connection
+	this.endTraces()
+
+	this.log.Debugf("(%s) Received %d bytes in %d messages.", this.cid(), atomic.LoadInt64(&this.inStat.bytes), atomic.LoadInt64(&this.inStat.msgs))
+	this.log.Debugf("(%s) Sent %d bytes in %d messages.", this.cid(), atomic.LoadInt64(&this.outStat.bytes), atomic.LoadInt64(&this.outStat.msgs))
 
 	// Unsubscribe from all the topics for this client, only for the server side though
 	if !this.client && this.sess != nil {
 		topics, _, err := this.sess.Topics()
 		if err != nil {
-			glog.Errorf("(%s/%d): %v", this.cid(), this.id, err)
+			this.log.Errorf("(%s/%d): %v", this.cid(), this.id, err)
 		} else {
 			for _, t := range topics {
 				if err := this.topicsMgr.Unsubscribe([]byte(t), &this.onpub); err != nil {
-					glog.Errorf("(%s): Error unsubscribing topic %q: %v", this.cid(), t, err)
+					this.log.Errorf("(%s): Error unsubscribing topic %q: %v", this.cid(), t, err)
 				}
 			}
 		}
@@ -236,8 +438,13 @@ func (this *service) stop() {
 
 	// Publish will message if WillFlag is set. Server side only.
 	if !this.client && this.sess.Cmsg.WillFlag() {
-		glog.Infof("(%s) service/stop: connection unexpectedly closed. Sending Will.", this.cid())
-		this.onPublish(this.sess.Will)
+		if this.delayWill != nil {
+			this.log.Infof("(%s) service/stop: connection unexpectedly closed. Delaying Will.", this.cid())
+			this.delayWill(this.sess.Will)
+		} else {
+			this.log.Infof("(%s) service/stop: connection unexpectedly closed. Sending Will.", this.cid())
+			this.publishTraced(this.sess.Will)
+		}
 	}
 
 	// Remove the client topics manager
@@ -245,14 +452,57 @@ func (this *service) stop() {
 		topics.Unregister(this.sess.ID())
 	}
 
-	// Remove the session from session store if it's suppose to be clean session
+	// Persistent sessions are only kept for so long once the client is gone, if set.
+	// Server side only.
+	if !this.client && this.sessionExpiry > 0 {
+		this.sess.SetExpiry(time.Now().Add(time.Second * time.Duration(this.sessionExpiry)))
+	}
+
+	// Remove the session from session store if it's suppose to be clean session,
+	// otherwise make sure the store has the latest state
 	if this.sess.Cmsg.CleanSession() && this.sessMgr != nil {
 		this.sessMgr.Del(this.sess.ID())
+	} else {
+		this.saveSession()
 	}
 
+	// Queue the messages for the topics subscribed until the client comes back, if
+	// the session is to be kept. Server side only. This is done last since the
+	// client may reconnect, and take over the session, as soon as it's queueing.
+	if !this.client && !this.sess.Cmsg.CleanSession() {
+		this.startOffline()
+	}
+
+	this.hookDisconnect()
+
 	this.conn = nil
 	this.in = nil
 	this.out = nil
+
+	if this.stopped != nil {
+		close(this.stopped)
+	}
+}
+
+// drain waits until everything in the outgoing queue and buffer has been sent, the
+// client has gone away, or ctx is done, whichever comes first.
+func (this *service) drain(ctx context.Context) {
+	tick := time.NewTicker(drainInterval)
+	defer tick.Stop()
+
+	for {
+		out := this.out
+		if out == nil || (out.Len() == 0 && atomic.LoadInt64(&this.queued) == 0) || this.isDone() {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-tick.C:
+		}
+	}
 }
 
 func (this *service) publish(msg *message.PublishMessage, onComplete OnCompleteFunc) error {
@@ -262,6 +512,10 @@ func (this *service) publish(msg *message.PublishMessage, onComplete OnCompleteF
 		return fmt.Errorf("(%s) Error sending %s message: %v", this.cid(), msg.Name(), err)
 	}
 
+	this.trace("Sent", message.PUBLISH, msg.PacketId(), msg.Topic())
+	this.counters.sentPublish(msg.QoS())
+	atomic.AddInt64(&this.publishedOut, 1)
+
 	switch msg.QoS() {
 	case message.QosAtMostOnce:
 		if onComplete != nil {
@@ -271,20 +525,386 @@ func (this *service) publish(msg *message.PublishMessage, onComplete OnCompleteF
 		return nil
 
 	case message.QosAtLeastOnce:
-		return this.sess.Pub1ack.Wait(msg, onComplete)
+		if err := this.sess.Pub1ack.Wait(msg, onComplete); err != nil {
+			return err
+		}
 
 	case message.QosExactlyOnce:
-		return this.sess.Pub2out.Wait(msg, onComplete)
+		if err := this.sess.Pub2out.Wait(msg, onComplete); err != nil {
+			return err
+		}
 	}
 
+	this.persistSession()
+
 	return nil
 }
 
+// limitOffline sets the limit and the TTL of the session's offline queue.
+func (this *service) limitOffline() {
+	if this.offlineSize >= 0 {
+		this.sess.Offline.SetLimit(this.offlineSize, this.offlinePolicy)
+	}
+
+	if this.ttl != nil {
+		this.sess.Offline.SetTTL(this.ttl)
+	}
+}
+
+// startOffline subscribes the session's offline queue to the topics the client is
+// subscribed to, so messages published while the client is away are kept for it.
+func (this *service) startOffline() {
+	if this.offlineSize < 0 {
+		return
+	}
+
+	this.limitOffline()
+
+	topics, qoss, err := this.sess.Topics()
+	if err != nil {
+		this.log.Errorf("(%s) Error queueing offline messages: %v", this.cid(), err)
+		return
+	}
+
+	for i, t := range topics {
+		if _, err := this.topicsMgr.Subscribe([]byte(t), qoss[i], this.sess.Offline); err != nil {
+			this.log.Errorf("(%s) Error subscribing offline queue to topic %q: %v", this.cid(), t, err)
+		}
+	}
+}
+
+// stopOffline unsubscribes the session's offline queue, if startOffline() was
+// called when the client went away.
+func (this *service) stopOffline() {
+	topics, _, err := this.sess.Topics()
+	if err != nil {
+		return
+	}
+
+	// The queue may not be subscribed at all, so errors are expected
+	for _, t := range topics {
+		this.topicsMgr.Unsubscribe([]byte(t), this.sess.Offline)
+	}
+}
+
+// deliverOffline sends the messages queued while the client was away.
+func (this *service) deliverOffline() {
+	msgs, err := this.sess.Offline.Pop()
+	if err != nil {
+		this.log.Errorf("(%s) Error retrieving offline messages: %v", this.cid(), err)
+		return
+	}
+
+	if len(msgs) > 0 {
+		this.log.Debugf("(%s) Delivering %d offline messages", this.cid(), len(msgs))
+	}
+
+	for _, msg := range msgs {
+		if err := this.onpub(msg); err != nil {
+			return
+		}
+	}
+}
+
+// saveSession asks the session store to persist the session, so it survives a
+// restart of the server if the store supports that. Clean sessions, and the client
+// side, are left alone.
+func (this *service) saveSession() {
+	if this.client || this.sessMgr == nil || this.sess.Cmsg.CleanSession() {
+		return
+	}
+
+	if err := this.sessMgr.Save(this.sess.ID()); err != nil {
+		this.log.Errorf("(%s) Error saving session: %v", this.cid(), err)
+	}
+}
+
+// persistSession writes the session to the client's Store, if it has one, so the
+// messages waiting for acks survive a restart. It's called every time they change.
+// Clean sessions, and the server side, are left alone.
+func (this *service) persistSession() {
+	if !this.client || this.store == nil || this.sess.Cmsg.CleanSession() {
+		return
+	}
+
+	if err := this.store.Save(this.sess.ID()); err != nil {
+		this.log.Errorf("(%s) Error persisting session: %v", this.cid(), err)
+	}
+}
+
+// tryPublish is like publish, except it won't wait for room in the outgoing buffer.
+// It returns false if the message didn't fit and wasn't sent.
+func (this *service) tryPublish(msg *message.PublishMessage) (bool, error) {
+	out := this.out
+	if out == nil {
+		return false, ErrBufferNotReady
+	}
+
+	if int64(out.Len()+msg.Len()) > out.size {
+		return false, nil
+	}
+
+	if this.outq != nil && len(this.outq) >= cap(this.outq) {
+		return false, nil
+	}
+
+	return true, this.publishOutbound(msg, nil)
+}
+
+// authorize returns true if the client is allowed the access to the topic. For a
+// shared subscription it's the topic filter, without the $share prefix, that is
+// checked.
+func (this *service) authorize(topic []byte, access auth.Access) bool {
+	if this.authzMgr == nil {
+		return true
+	}
+
+	if topics.IsShared(topic) {
+		if _, filter, err := topics.SplitShared(topic); err == nil {
+			topic = filter
+		}
+	}
+
+	if err := this.authzMgr.AuthorizeClaims(this.sess.ID(), this.username, this.claims, topic, access); err != nil {
+		this.log.Infof("(%s) Not authorized to %s topic %q: %v", this.cid(), access, string(topic), err)
+		return false
+	}
+
+	return true
+}
+
+// buffered returns the number of bytes waiting in the incoming and outgoing buffers,
+// and the outgoing queue, and the total size of the buffers.
+func (this *service) buffered() (int, int) {
+	used, size := int(atomic.LoadInt64(&this.queued)), 0
+
+	for _, buf := range []*buffer{this.in, this.out} {
+		if buf != nil {
+			used += buf.Len()
+			size += int(buf.size)
+		}
+	}
+
+	return used, size
+}
+
+// outbound returns the PUBLISH message to send to this client. QoS 1 and 2 messages
+// get a packet ID from the session, since the one they came with is the sender's
+// and could clash with messages still waiting for acks from this client. The
+// message passed in is shared with the other subscribers, so it's copied instead
+// of changed. Server side only.
+func (this *service) outbound(msg *message.PublishMessage) *message.PublishMessage {
+	if msg.QoS() == message.QosAtMostOnce {
+		return msg
+	}
+
+	out := getPublish()
+	out.SetTopic(msg.Topic())
+	out.SetQoS(msg.QoS())
+	out.SetRetain(msg.Retain())
+	out.SetDup(false)
+	out.SetPayload(msg.Payload())
+	out.SetPacketId(this.sess.NextPacketId())
+
+	return out
+}
+
+// publishOutbound sends msg, which is shared with the other subscribers, to the
+// client. The copy made by outbound(), if any, is given back to the pool once it's
+// sent, since the ack queue keeps its own. onComplete, if not nil, is called once
+// the client has acked the message. Server side only.
+//
+// If the client has as many QoS 1 and 2 messages waiting for acks as maxInflight,
+// the message is put in the session's offline queue instead, and onComplete is
+// called right away. sendQueued() sends it once the acks make room.
+func (this *service) publishOutbound(msg *message.PublishMessage, onComplete OnCompleteFunc) error {
+	if this.maxInflight > 0 && msg.QoS() != message.QosAtMostOnce {
+		this.imu.Lock()
+		defer this.imu.Unlock()
+
+		// Messages wait their turn behind the ones queued already
+		if this.sess.Offline.Len() > 0 || this.inflight() >= this.maxInflight {
+			if err := this.sess.Offline.Push(msg); err != nil {
+				return err
+			}
+
+			if onComplete != nil {
+				return onComplete(msg, nil, nil)
+			}
+
+			return nil
+		}
+	}
+
+	return this.publishCopy(msg, onComplete)
+}
+
+// publishCopy sends msg, or the copy of it made by outbound(), to the client.
+func (this *service) publishCopy(msg *message.PublishMessage, onComplete OnCompleteFunc) error {
+	out := this.outbound(msg)
+	if out != msg {
+		this.msgProps.alias(out, msg)
+	}
+
+	err := this.publish(out, onComplete)
+
+	if out != msg {
+		this.msgProps.del(out)
+		putSent(out)
+	}
+
+	return err
+}
+
+// inflight returns the number of QoS 1 and 2 messages sent to the client that it
+// hasn't acked yet.
+func (this *service) inflight() int {
+	return this.sess.Pub1ack.Len() + this.sess.Pub2out.Len()
+}
+
+// sendQueued sends the messages waiting in the session's offline queue for room in
+// the inflight window, as many as there's room for now. Server side only.
+func (this *service) sendQueued() {
+	if this.client || this.maxInflight <= 0 {
+		return
+	}
+
+	this.imu.Lock()
+	defer this.imu.Unlock()
+
+	n := this.maxInflight - this.inflight()
+	if n <= 0 || this.sess.Offline.Len() == 0 {
+		return
+	}
+
+	msgs, err := this.sess.Offline.PopN(n)
+	if err != nil {
+		this.log.Errorf("(%s) Error retrieving queued messages: %v", this.cid(), err)
+		return
+	}
+
+	for _, msg := range msgs {
+		if err := this.publishCopy(msg, nil); err != nil {
+			this.log.Errorf("(%s) Error publishing queued message: %v", this.cid(), err)
+			return
+		}
+	}
+}
+
+// resendInflight sends again the QoS 1 and 2 messages of a recovered session that
+// the client hadn't acked when it went away. PUBLISH messages are sent with the DUP
+// flag set. QoS 2 messages the client has already sent PUBREC for just need the
+// PUBREL again. They are still in the ack queues, so the acks are matched up as
+// usual.
+func (this *service) resendInflight() {
+	for _, ackq := range []*sessions.Ackqueue{this.sess.Pub1ack, this.sess.Pub2out} {
+		for _, am := range ackq.Waiting() {
+			if am.Mtype != message.PUBLISH {
+				continue
+			}
+
+			switch am.State {
+			case message.RESERVED:
+				msg := message.NewPublishMessage()
+				if _, err := msg.Decode(am.Msgbuf); err != nil {
+					this.log.Errorf("(%s) Unable to decode %s message: %v", this.cid(), am.Mtype, err)
+					continue
+				}
+
+				msg.SetDup(true)
+
+				if _, err := this.writeMessage(msg); err != nil {
+					this.log.Errorf("(%s) Error resending %s message: %v", this.cid(), msg.Name(), err)
+					return
+				}
+
+				this.trace("Resent", message.PUBLISH, msg.PacketId(), msg.Topic())
+
+			case message.PUBREC:
+				resp := message.NewPubrelMessage()
+				resp.SetPacketId(am.Pktid)
+
+				if _, err := this.writeMessage(resp); err != nil {
+					this.log.Errorf("(%s) Error resending %s message: %v", this.cid(), resp.Name(), err)
+					return
+				}
+
+				this.trace("Resent", message.PUBREL, resp.PacketId(), nil)
+			}
+		}
+	}
+}
+
+// resubscribe sends a SUBSCRIBE for all the topics in the session. It's used by the
+// client when it has connected again and the server didn't keep the session. The
+// topics manager still has the onPublish functions from the first time around, so
+// only the server needs to hear about the subscriptions again.
+func (this *service) resubscribe() {
+	topics, qoss, err := this.sess.Topics()
+	if err != nil {
+		this.log.Errorf("(%s) Unable to get topics: %v", this.cid(), err)
+		return
+	}
+
+	if len(topics) == 0 {
+		return
+	}
+
+	msg := message.NewSubscribeMessage()
+	msg.SetPacketId(this.sess.NextPacketId())
+
+	for i, t := range topics {
+		msg.AddTopic([]byte(t), qoss[i])
+	}
+
+	if _, err := this.writeMessage(msg); err != nil {
+		this.log.Errorf("(%s) Error sending %s message: %v", this.cid(), msg.Name(), err)
+		return
+	}
+
+	this.sess.Suback.Wait(msg, nil)
+}
+
+// transformOutbound runs the outbound transform, if there is one, on a message about
+// to be delivered to this client. It returns false if the message should be skipped.
+func (this *service) transformOutbound(msg *message.PublishMessage) (*message.PublishMessage, bool) {
+	if this.transformOut == nil {
+		return msg, true
+	}
+
+	tmsg, ok := this.transformOut(this.sess.ID(), msg)
+	if !ok || tmsg == nil {
+		return nil, false
+	}
+
+	return tmsg, true
+}
+
 func (this *service) subscribe(msg *message.SubscribeMessage, onComplete OnCompleteFunc, onPublish OnPublishFunc) error {
 	if onPublish == nil {
 		return fmt.Errorf("onPublish function is nil. No need to subscribe.")
 	}
 
+	handlers := make(map[string]*OnPublishFunc)
+
+	for _, t := range msg.Topics() {
+		handlers[string(t)] = &onPublish
+	}
+
+	return this.subscribeHandlers(msg, onComplete, handlers)
+}
+
+// subscribeHandlers is like subscribe, except each topic filter in the SUBSCRIBE
+// message has its own onPublish function. The functions are added to the client's
+// topics manager once the SUBACK comes back, in place of any from earlier SUBSCRIBE
+// messages for the same filters.
+func (this *service) subscribeHandlers(msg *message.SubscribeMessage, onComplete OnCompleteFunc, handlers map[string]*OnPublishFunc) error {
+	for _, t := range msg.Topics() {
+		if h, ok := handlers[string(t)]; !ok || h == nil || *h == nil {
+			return fmt.Errorf("onPublish function for topic %q is nil. No need to subscribe.", string(t))
+		}
+	}
+
 	_, err := this.writeMessage(msg)
 	if err != nil {
 		return fmt.Errorf("(%s) Error sending %s message: %v", this.cid(), msg.Name(), err)
@@ -292,7 +912,6 @@ func (this *service) subscribe(msg *message.SubscribeMessage, onComplete OnCompl
 
 	var onc OnCompleteFunc = func(msg, ack message.Message, err error) error {
 		onComplete := onComplete
-		onPublish := onPublish
 
 		if err != nil {
 			if onComplete != nil {
@@ -342,8 +961,11 @@ func (this *service) subscribe(msg *message.SubscribeMessage, onComplete OnCompl
 			if c == message.QosFailure {
 				err2 = fmt.Errorf("Failed to subscribe to '%s'\n%v", string(t), err2)
 			} else {
+				// The server replaces the subscription, so does the client
+				this.topicsMgr.Unsubscribe(t, nil)
+
 				this.sess.AddTopic(string(t), c)
-				_, err := this.topicsMgr.Subscribe(t, c, &onPublish)
+				_, err := this.topicsMgr.Subscribe(t, c, handlers[string(t)])
 				if err != nil {
 					err2 = fmt.Errorf("Failed to subscribe to '%s' (%v)\n%v", string(t), err, err2)
 				}
@@ -433,6 +1055,10 @@ func (this *service) ping(onComplete OnCompleteFunc) error {
 	return this.sess.Pingack.Wait(msg, onComplete)
 }
 
+func (this *service) isStopped() bool {
+	return atomic.LoadInt64(&this.closed) == 1
+}
+
 func (this *service) isDone() bool {
 	select {
 	case <-this.done:
@@ -444,6 +1070,21 @@ func (this *service) isDone() bool {
 	return false
 }
 
+// trace logs a PUBLISH, or one of its acks, if packet tracing is on. The topic is
+// that of the PUBLISH being acked, and is left out if it's nil. This way all the
+// packets in a flow can be matched up by packet ID and topic.
+func (this *service) trace(dir string, mtype message.MessageType, pktid uint16, topic []byte) {
+	if !this.tracePackets {
+		return
+	}
+
+	if topic == nil {
+		this.log.Infof("(%s) %s %s, Packet ID=%d", this.cid(), dir, mtype, pktid)
+	} else {
+		this.log.Infof("(%s) %s %s, Packet ID=%d, Topic=%q", this.cid(), dir, mtype, pktid, topic)
+	}
+}
+
 func (this *service) cid() string {
 	return fmt.Sprintf("%d/%s", this.id, this.sess.ID())
 }
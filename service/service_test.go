@@ -15,8 +15,20 @@
 package service
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -25,6 +37,9 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/surge/glog"
 	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/auth"
+	"github.com/surgemq/surgemq/logger"
+	"github.com/surgemq/surgemq/sessions"
 	"github.com/surgemq/surgemq/topics"
 )
 
@@ -41,6 +56,40 @@ func TestServiceConnectAuthError(t *testing.T) {
 	authenticator = old
 }
 
+// Close the connection after sending CONNECT but before reading the CONNACK. The
+// server should not keep the session it created for the connection.
+func TestServiceConnectClosedBeforeConnack(t *testing.T) {
+	topics.Unregister("mem")
+	topics.Register("mem", topics.NewMemProvider())
+
+	sessions.Unregister("mem")
+	sessions.Register("mem", sessions.NewMemProvider())
+
+	svr := &Server{
+		Authenticator: authenticator,
+	}
+
+	require.NoError(t, svr.checkConfiguration())
+
+	for _, clean := range []bool{true, false} {
+		client, server := net.Pipe()
+
+		msg := newConnectMessage()
+		msg.SetCleanSession(clean)
+
+		go func() {
+			// net.Pipe writes block until the other side has read everything, so once
+			// this returns the server has the full CONNECT message.
+			writeMessage(client, msg)
+			client.Close()
+		}()
+
+		_, err := svr.handleConnection(server, nil)
+		require.Error(t, err)
+		require.Equal(t, 0, svr.sessMgr.Count())
+	}
+}
+
 func TestServiceWillDelivery(t *testing.T) {
 	var wg sync.WaitGroup
 
@@ -197,6 +246,131 @@ func TestServiceSubRetain(t *testing.T) {
 	})
 }
 
+// Subscribe to # with lots of retained messages around. The SUBACK should come back
+// before the retained messages, and all of them should eventually arrive.
+func TestServiceSubRetainedMany(t *testing.T) {
+	runClientServerTests(t, func(c *Client) {
+		const count = 20000
+
+		tmgr, _ := topics.NewManager("mem")
+
+		for i := 0; i < count; i++ {
+			rmsg := message.NewPublishMessage()
+			rmsg.SetRetain(true)
+			rmsg.SetQoS(0)
+			rmsg.SetTopic([]byte(fmt.Sprintf("sensors/%d/temp", i)))
+			rmsg.SetPayload([]byte("this is a test"))
+
+			require.NoError(t, tmgr.Retain(rmsg))
+		}
+
+		subdone := make(chan struct{})
+		rcvdone := make(chan struct{})
+		rcvd := int64(0)
+
+		sub := message.NewSubscribeMessage()
+		sub.AddTopic([]byte("#"), 0)
+
+		c.Subscribe(sub,
+			func(msg, ack message.Message, err error) error {
+				require.True(t, atomic.LoadInt64(&rcvd) < count, "SUBACK was held up by the retained messages")
+				close(subdone)
+				return nil
+			},
+			func(msg *message.PublishMessage) error {
+				if atomic.AddInt64(&rcvd, 1) == count {
+					close(rcvdone)
+				}
+				return nil
+			})
+
+		select {
+		case <-subdone:
+		case <-time.After(time.Millisecond * 500):
+			require.FailNow(t, "Timed out waiting for subscribe response")
+		}
+
+		select {
+		case <-rcvdone:
+		case <-time.After(time.Second * 5):
+			require.FailNow(t, fmt.Sprintf("Timed out waiting for retained messages. Expecting %d, got %d.", count, atomic.LoadInt64(&rcvd)))
+		}
+	})
+}
+
+// Nothing is draining the outgoing buffer, and the retained messages don't fit in
+// it. Processing the SUBSCRIBE should still return right after the SUBACK.
+func TestServiceProcessSubscribeRetainedNonBlocking(t *testing.T) {
+	topics.Unregister("mem")
+	topics.Register("mem", topics.NewMemProvider())
+
+	tmgr, err := topics.NewManager("mem")
+	require.NoError(t, err)
+
+	const count = 2000
+	total := 0
+
+	for i := 0; i < count; i++ {
+		rmsg := message.NewPublishMessage()
+		rmsg.SetRetain(true)
+		rmsg.SetTopic([]byte(fmt.Sprintf("sensors/%d/temp", i)))
+		rmsg.SetPayload([]byte("this is a test"))
+
+		require.NoError(t, tmgr.Retain(rmsg))
+		total += rmsg.Len()
+	}
+
+	svc := &service{
+		topicsMgr: tmgr,
+		sess:      &sessions.Session{},
+		log:       logger.NewGlogLogger(),
+	}
+
+	require.NoError(t, svc.sess.Init(newConnectMessage()))
+
+	svc.out, err = newBuffer(16384)
+	require.NoError(t, err)
+	require.True(t, total > 16384)
+
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketId(1)
+	sub.AddTopic([]byte("sensors/#"), 0)
+
+	suback := message.NewSubackMessage()
+	suback.AddReturnCode(0)
+	total += suback.Len()
+
+	done := make(chan error)
+
+	go func() {
+		done <- svc.processSubscribe(sub)
+	}()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+
+	case <-time.After(time.Millisecond * 100):
+		svc.out.Close()
+		require.FailNow(t, "processSubscribe() blocked on delivering retained messages")
+	}
+
+	var out bytes.Buffer
+
+	for out.Len() < total {
+		p, err := svc.out.ReadPeek(4096)
+		if err != nil && err != ErrBufferInsufficientData {
+			require.NoError(t, err)
+		}
+
+		out.Write(p)
+		svc.out.ReadCommit(len(p))
+	}
+
+	svc.wgStopped.Wait()
+	require.Equal(t, total, out.Len())
+}
+
 // Subscribe with QoS 0, publish with QoS 0. So the client should receive all the
 // messages as QoS 0.
 func TestServiceSub0Pub0(t *testing.T) {
@@ -663,7 +837,1809 @@ func TestServiceSub2Pub2(t *testing.T) {
 	})
 }
 
-func assertPublishMessage(t *testing.T, msg *message.PublishMessage, qos byte) {
-	require.Equal(t, "abc", string(msg.Payload()))
-	require.Equal(t, qos, msg.QoS())
+// Pipeline more QoS 2 messages than the server's receive maximum without ever
+// sending PUBREL. The server should drop the connection instead of queuing them.
+func TestServiceReceiveMaximum(t *testing.T) {
+	var wg sync.WaitGroup
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+
+	uri := "tcp://127.0.0.1:1883"
+	u, err := url.Parse(uri)
+	require.NoError(t, err, "Error parsing URL")
+
+	svr := &Server{
+		Authenticator:  authenticator,
+		ReceiveMaximum: 5,
+	}
+
+	wg.Add(1)
+	go startServer(t, svr, u, &wg, ready1, ready2, 1)
+
+	<-ready1
+
+	conn := connectRaw(t, uri)
+	defer conn.Close()
+
+	for i := uint16(1); i <= 10; i++ {
+		if err := writeMessage(conn, newPublishMessage(i, 2)); err != nil {
+			break
+		}
+	}
+
+	pubrecs := 0
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	for {
+		buf, err := getMessageBuffer(conn)
+		if err != nil {
+			require.False(t, isTimeout(err), "Server did not close the connection")
+			break
+		}
+
+		require.Equal(t, message.PUBREC, message.MessageType(buf[0]>>4))
+		pubrecs++
+	}
+
+	require.True(t, pubrecs <= 5, "Expecting at most 5 PUBREC, got %d", pubrecs)
+
+	close(ready2)
+
+	wg.Wait()
+}
+
+// The client acks a message twice and goes away right after, with the acks possibly
+// still in flight as its session is removed. The second ack doesn't match any message,
+// and should just be dropped, without bringing the server down.
+func TestServicePubackOnDisconnect(t *testing.T) {
+	var wg sync.WaitGroup
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+
+	uri := "tcp://127.0.0.1:1883"
+	u, err := url.Parse(uri)
+	require.NoError(t, err, "Error parsing URL")
+
+	svr := &Server{
+		Authenticator: authenticator,
+	}
+
+	wg.Add(1)
+	go startServer(t, svr, u, &wg, ready1, ready2, 21)
+
+	<-ready1
+
+	for i := 1; i <= 20; i++ {
+		conn := connectRaw(t, uri)
+
+		require.NoError(t, writeMessage(conn, newSubscribeMessage(1)))
+
+		buf, err := getMessageBuffer(conn)
+		require.NoError(t, err)
+		require.Equal(t, message.SUBACK, message.MessageType(buf[0]>>4))
+
+		require.NoError(t, svr.Publish(newPublishMessage(uint16(i), 1), nil))
+
+		buf, err = getMessageBuffer(conn)
+		require.NoError(t, err)
+		require.Equal(t, message.PUBLISH, message.MessageType(buf[0]>>4))
+
+		pub := message.NewPublishMessage()
+		_, err = pub.Decode(buf)
+		require.NoError(t, err)
+
+		ack := message.NewPubackMessage()
+		ack.SetPacketId(pub.PacketId())
+		require.NoError(t, writeMessage(conn, ack))
+		require.NoError(t, writeMessage(conn, ack))
+
+		conn.Close()
+	}
+
+	conn := connectRaw(t, uri)
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, message.NewPingreqMessage()))
+
+	buf, err := getMessageBuffer(conn)
+	require.NoError(t, err)
+	require.Equal(t, message.PINGRESP, message.MessageType(buf[0]>>4))
+
+	close(ready2)
+
+	wg.Wait()
+}
+
+// Follow a QoS 1 message from the publisher, through the server, to the subscriber
+// and back.
+func TestServiceTracePackets(t *testing.T) {
+	var wg sync.WaitGroup
+
+	log := newRecordLogger("Packet ID=")
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+
+	uri := "tcp://127.0.0.1:1883"
+	u, err := url.Parse(uri)
+	require.NoError(t, err, "Error parsing URL")
+
+	svr := &Server{
+		Authenticator: authenticator,
+		TracePackets:  true,
+		Logger:        log,
+	}
+
+	wg.Add(1)
+	go startServer(t, svr, u, &wg, ready1, ready2, 2)
+
+	<-ready1
+
+	sub := connectRaw(t, uri)
+	defer sub.Close()
+
+	require.NoError(t, writeMessage(sub, newSubscribeMessage(1)))
+
+	buf, err := getMessageBuffer(sub)
+	require.NoError(t, err)
+	require.Equal(t, message.SUBACK, message.MessageType(buf[0]>>4))
+
+	pub := connectRaw(t, uri)
+	defer pub.Close()
+
+	require.NoError(t, writeMessage(pub, newPublishMessage(7, 1)))
+
+	buf, err = getMessageBuffer(pub)
+	require.NoError(t, err)
+	require.Equal(t, message.PUBACK, message.MessageType(buf[0]>>4))
+
+	buf, err = getMessageBuffer(sub)
+	require.NoError(t, err)
+
+	msg := message.NewPublishMessage()
+	_, err = msg.Decode(buf)
+	require.NoError(t, err)
+
+	// The subscriber gets a packet ID from its own session
+	require.Equal(t, uint16(1), msg.PacketId())
+
+	ack := message.NewPubackMessage()
+	ack.SetPacketId(msg.PacketId())
+	require.NoError(t, writeMessage(sub, ack))
+
+	// Once the PINGRESP is back the PUBACK has been processed.
+	require.NoError(t, writeMessage(sub, message.NewPingreqMessage()))
+
+	buf, err = getMessageBuffer(sub)
+	require.NoError(t, err)
+	require.Equal(t, message.PINGRESP, message.MessageType(buf[0]>>4))
+
+	close(ready2)
+
+	wg.Wait()
+
+	lines := log.Lines()
+	require.Len(t, lines, 4)
+
+	expected := []string{
+		`Received PUBLISH, Packet ID=7, Topic="abc"`,
+		`Sent PUBACK, Packet ID=7, Topic="abc"`,
+		`Sent PUBLISH, Packet ID=1, Topic="abc"`,
+		`Received PUBACK, Packet ID=1, Topic="abc"`,
+	}
+
+	for i, line := range lines {
+		require.Contains(t, line, expected[i])
+	}
+
+	// The first two are for the publisher, the other two for the subscriber.
+	cid := func(line string) string { return line[:strings.Index(line, ")")+1] }
+
+	require.Equal(t, cid(lines[0]), cid(lines[1]))
+	require.Equal(t, cid(lines[2]), cid(lines[3]))
+	require.NotEqual(t, cid(lines[0]), cid(lines[2]))
+}
+
+// The server requires client certificates signed by its CA.
+func TestServiceListenAndServeTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "surgemq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newCertificate(t, "surgemq ca", nil)
+	certFile, keyFile := writeCertificate(t, dir, "server", newCertificate(t, "127.0.0.1", &ca))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	svr := &Server{
+		Authenticator: authenticator,
+		TLSConfig: &tls.Config{
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs:  pool,
+		},
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- svr.ListenAndServeTLS("ssl://127.0.0.1:8883", certFile, keyFile)
+	}()
+
+	dial := func(certs ...tls.Certificate) (*message.ConnackMessage, error) {
+		var (
+			conn net.Conn
+			err  error
+		)
+
+		// Give the server a chance to start listening
+		for i := 0; i < 100; i++ {
+			if conn, err = tls.Dial("tcp", "127.0.0.1:8883", &tls.Config{RootCAs: pool, Certificates: certs}); err == nil {
+				break
+			}
+
+			time.Sleep(time.Millisecond * 10)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer conn.Close()
+
+		if err := writeMessage(conn, newConnectMessage()); err != nil {
+			return nil, err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		return getConnackMessage(conn, 0)
+	}
+
+	connack, err := dial(newCertificate(t, "client", &ca))
+	require.NoError(t, err)
+	require.Equal(t, message.ConnectionAccepted, connack.ReturnCode())
+
+	_, err = dial()
+	require.Error(t, err)
+
+	// Signed by some other CA
+	other := newCertificate(t, "other ca", nil)
+
+	_, err = dial(newCertificate(t, "client", &other))
+	require.Error(t, err)
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+
+	require.Error(t, (&Server{}).ListenAndServeTLS("ssl://127.0.0.1:8883", "", ""))
+}
+
+// Clients are let in by the certificate they connect with, and known by its CN.
+func TestServiceTLSCertAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "surgemq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newCertificate(t, "surgemq ca", nil)
+	certFile, keyFile := writeCertificate(t, dir, "server", newCertificate(t, "127.0.0.1", &ca))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	auth.Register("cert", auth.NewCertAuthenticator(auth.CommonName, "sensor1"))
+	defer auth.Unregister("cert")
+
+	svr := &Server{
+		Authenticator: "cert",
+		TLSConfig: &tls.Config{
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ClientCAs:  pool,
+		},
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- svr.ListenAndServeTLS("ssl://127.0.0.1:8883", certFile, keyFile)
+	}()
+
+	dial := func(certs ...tls.Certificate) message.ConnackCode {
+		var conn net.Conn
+
+		// Give the server a chance to start listening
+		for i := 0; i < 100; i++ {
+			if conn, err = tls.Dial("tcp", "127.0.0.1:8883", &tls.Config{RootCAs: pool, Certificates: certs}); err == nil {
+				break
+			}
+
+			time.Sleep(time.Millisecond * 10)
+		}
+
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, writeMessage(conn, newConnectMessage()))
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		connack, err := getConnackMessage(conn, 0)
+		require.NoError(t, err)
+
+		return connack.ReturnCode()
+	}
+
+	require.Equal(t, message.ConnectionAccepted, dial(newCertificate(t, "sensor1", &ca)))
+
+	// The service may have stopped already, now that the connection is closed
+	svr.mu.Lock()
+	require.Equal(t, 1, len(svr.svcs))
+	require.Equal(t, "sensor1", svr.svcs[0].username)
+	svr.mu.Unlock()
+
+	require.Equal(t, message.ErrBadUsernameOrPassword, dial(newCertificate(t, "sensor2", &ca)))
+
+	// No certificate, so the username and password don't get it in
+	require.Equal(t, message.ErrBadUsernameOrPassword, dial())
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+}
+
+// A client that's not using a clean session keeps its subscription across a
+// restart of the server when the sessions are kept in BoltDB.
+func TestServiceBoltSessionsRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "surgemq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sessions.db")
+
+	cmsg := newConnectMessage()
+	cmsg.SetCleanSession(false)
+
+	svr, done := startBoltServer(t, path)
+
+	conn, connack := dialBoltServer(t, cmsg)
+	require.False(t, connack.SessionPresent())
+
+	require.NoError(t, writeMessage(conn, newSubscribeMessage(1)))
+
+	buf, err := getMessageBuffer(conn)
+	require.NoError(t, err)
+	require.Equal(t, message.SUBACK, message.MessageType(buf[0]>>4))
+
+	conn.Close()
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+
+	svr, done = startBoltServer(t, path)
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	conn, connack = dialBoltServer(t, cmsg)
+	defer conn.Close()
+	require.True(t, connack.SessionPresent())
+
+	pconn, _ := dialBoltServer(t, newConnectMessage())
+	defer pconn.Close()
+
+	require.NoError(t, writeMessage(pconn, newPublishMessage(0, 0)))
+
+	buf, err = getMessageBuffer(conn)
+	require.NoError(t, err)
+
+	msg := message.NewPublishMessage()
+	_, err = msg.Decode(buf)
+	require.NoError(t, err)
+	require.Equal(t, "abc", string(msg.Topic()))
+}
+
+// The server is restarted in the middle of QoS 2 flows in both directions. They all
+// complete once the clients reconnect, and each message is delivered exactly once.
+func TestServiceQos2Restart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "surgemq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sessions.db")
+
+	smsg := newPersistentConnectMessage()
+	pmsg := newPersistentConnectMessage()
+
+	svr, done := startBoltServer(t, path)
+
+	sub, _ := dialBoltServer(t, smsg)
+
+	require.NoError(t, writeMessage(sub, newSubscribeMessage(2)))
+	expectMessage(t, sub, message.SUBACK)
+
+	pub, _ := dialBoltServer(t, pmsg)
+
+	// Messages "1" and "2" get to the subscriber. It sends PUBREC for "1" but not
+	// PUBCOMP, and doesn't ack "2" at all.
+	for _, id := range []uint16{1, 2} {
+		require.NoError(t, writeMessage(pub, newPayloadMessage(id, 2, fmt.Sprint(id))))
+		expectMessage(t, pub, message.PUBREC)
+
+		require.NoError(t, writeMessage(pub, newPubrelMessage(id)))
+		expectMessage(t, pub, message.PUBCOMP)
+	}
+
+	msg1 := expectMessage(t, sub, message.PUBLISH).(*message.PublishMessage)
+	require.Equal(t, "1", string(msg1.Payload()))
+
+	msg2 := expectMessage(t, sub, message.PUBLISH).(*message.PublishMessage)
+	require.Equal(t, "2", string(msg2.Payload()))
+
+	rec := message.NewPubrecMessage()
+	rec.SetPacketId(msg1.PacketId())
+	require.NoError(t, writeMessage(sub, rec))
+	expectMessage(t, sub, message.PUBREL)
+
+	// Message "3" is left waiting for PUBREL from the publisher
+	require.NoError(t, writeMessage(pub, newPayloadMessage(3, 2, "3")))
+	expectMessage(t, pub, message.PUBREC)
+
+	sub.Close()
+	pub.Close()
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+
+	svr, done = startBoltServer(t, path)
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	sub, connack := dialBoltServer(t, smsg)
+	defer sub.Close()
+	require.True(t, connack.SessionPresent())
+
+	// The PUBREL for "1" is sent again, then "2" with the DUP flag set
+	rel := expectMessage(t, sub, message.PUBREL)
+	require.Equal(t, msg1.PacketId(), rel.PacketId())
+
+	msg := expectMessage(t, sub, message.PUBLISH).(*message.PublishMessage)
+	require.Equal(t, msg2.PacketId(), msg.PacketId())
+	require.Equal(t, "2", string(msg.Payload()))
+	require.True(t, msg.Dup())
+
+	comp := message.NewPubcompMessage()
+	comp.SetPacketId(msg1.PacketId())
+	require.NoError(t, writeMessage(sub, comp))
+
+	completeQos2(t, sub, msg)
+
+	pub, connack = dialBoltServer(t, pmsg)
+	defer pub.Close()
+	require.True(t, connack.SessionPresent())
+
+	require.NoError(t, writeMessage(pub, newPubrelMessage(3)))
+	expectMessage(t, pub, message.PUBCOMP)
+
+	msg = expectMessage(t, sub, message.PUBLISH).(*message.PublishMessage)
+	require.Equal(t, "3", string(msg.Payload()))
+	require.False(t, msg.Dup())
+
+	completeQos2(t, sub, msg)
+
+	// Nothing else should come through
+	expectNoMessage(t, sub)
+}
+
+// A QoS 2 PUBLISH sent again before the PUBREL is only delivered once. Another
+// client publishing with the same packet ID doesn't clash with it.
+func TestServiceQos2Duplicate(t *testing.T) {
+	var wg sync.WaitGroup
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+
+	uri := "tcp://127.0.0.1:1883"
+	u, err := url.Parse(uri)
+	require.NoError(t, err, "Error parsing URL")
+
+	svr := &Server{
+		Authenticator: authenticator,
+	}
+
+	wg.Add(1)
+	go startServer(t, svr, u, &wg, ready1, ready2, 3)
+
+	<-ready1
+
+	sub := connectRaw(t, uri)
+	defer sub.Close()
+
+	require.NoError(t, writeMessage(sub, newSubscribeMessage(2)))
+	expectMessage(t, sub, message.SUBACK)
+
+	pub := connectRaw(t, uri)
+	defer pub.Close()
+
+	msg := newPayloadMessage(5, 2, "once")
+	require.NoError(t, writeMessage(pub, msg))
+	expectMessage(t, pub, message.PUBREC)
+
+	msg.SetDup(true)
+	require.NoError(t, writeMessage(pub, msg))
+	expectMessage(t, pub, message.PUBREC)
+
+	require.NoError(t, writeMessage(pub, newPubrelMessage(5)))
+	expectMessage(t, pub, message.PUBCOMP)
+
+	// The PUBREL sent again, e.g., because the PUBCOMP got lost
+	require.NoError(t, writeMessage(pub, newPubrelMessage(5)))
+	expectMessage(t, pub, message.PUBCOMP)
+
+	rmsg := expectMessage(t, sub, message.PUBLISH).(*message.PublishMessage)
+	require.Equal(t, "once", string(rmsg.Payload()))
+
+	other := connectRaw(t, uri)
+	defer other.Close()
+
+	require.NoError(t, writeMessage(other, newPayloadMessage(5, 2, "other")))
+	expectMessage(t, other, message.PUBREC)
+
+	require.NoError(t, writeMessage(other, newPubrelMessage(5)))
+	expectMessage(t, other, message.PUBCOMP)
+
+	omsg := expectMessage(t, sub, message.PUBLISH).(*message.PublishMessage)
+	require.Equal(t, "other", string(omsg.Payload()))
+	require.NotEqual(t, rmsg.PacketId(), omsg.PacketId())
+
+	completeQos2(t, sub, rmsg)
+	completeQos2(t, sub, omsg)
+	expectNoMessage(t, sub)
+
+	close(ready2)
+
+	wg.Wait()
+}
+
+func TestServiceAuthorizer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "surgemq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "acl")
+	acl := "topic read private\nuser surgemq\ntopic readwrite abc\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(acl), 0600))
+
+	a, err := auth.NewFileAuthorizer(path)
+	require.NoError(t, err)
+
+	auth.RegisterAuthorizer("acl", a)
+	defer auth.UnregisterAuthorizer("acl")
+
+	var wg sync.WaitGroup
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+
+	uri := "tcp://127.0.0.1:1883"
+	u, err := url.Parse(uri)
+	require.NoError(t, err, "Error parsing URL")
+
+	svr := &Server{
+		Authenticator: authenticator,
+		Authorizer:    "acl",
+	}
+
+	wg.Add(1)
+	go startServer(t, svr, u, &wg, ready1, ready2, 2)
+
+	<-ready1
+
+	sub := connectRaw(t, uri)
+	defer sub.Close()
+
+	submsg := message.NewSubscribeMessage()
+	submsg.SetPacketId(1)
+	submsg.AddTopic([]byte("abc"), 1)
+	submsg.AddTopic([]byte("private"), 1)
+	submsg.AddTopic([]byte("xyz"), 1)
+	submsg.AddTopic([]byte("$share/workers/xyz"), 1)
+
+	require.NoError(t, writeMessage(sub, submsg))
+
+	suback := expectMessage(t, sub, message.SUBACK).(*message.SubackMessage)
+	require.Equal(t, []byte{1, 1, message.QosFailure, message.QosFailure}, suback.ReturnCodes())
+
+	pub := connectRaw(t, uri)
+	defer pub.Close()
+
+	// Only allowed to read, so it's acked but not delivered
+	msg := newPayloadMessage(0, 0, "denied")
+	msg.SetTopic([]byte("private"))
+	require.NoError(t, writeMessage(pub, msg))
+
+	require.NoError(t, writeMessage(pub, newPayloadMessage(0, 0, "allowed")))
+
+	rmsg := expectMessage(t, sub, message.PUBLISH).(*message.PublishMessage)
+	require.Equal(t, "allowed", string(rmsg.Payload()))
+	expectNoMessage(t, sub)
+
+	close(ready2)
+
+	wg.Wait()
+}
+
+// The client's password is a JWT, and the topics it can subscribe to are in it.
+func TestServiceJWTClaims(t *testing.T) {
+	key := []byte("verysecret")
+
+	auth.Register("jwt", auth.NewJWTAuthenticator(key))
+	defer auth.Unregister("jwt")
+
+	auth.RegisterAuthorizer("claims", auth.NewClaimsAuthorizer("subscribe", "publish"))
+	defer auth.UnregisterAuthorizer("claims")
+
+	enc := base64.RawURLEncoding.EncodeToString
+	signed := enc([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc([]byte(fmt.Sprintf(`{"sub":"surgemq","exp":%d,"subscribe":["abc"]}`, time.Now().Add(time.Hour).Unix())))
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	token := signed + "." + enc(mac.Sum(nil))
+
+	var wg sync.WaitGroup
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+
+	uri := "tcp://127.0.0.1:1883"
+	u, err := url.Parse(uri)
+	require.NoError(t, err, "Error parsing URL")
+
+	svr := &Server{
+		Authenticator: "jwt",
+		Authorizer:    "claims",
+	}
+
+	wg.Add(1)
+	go startServer(t, svr, u, &wg, ready1, ready2, 1)
+
+	<-ready1
+
+	cmsg := newConnectMessage()
+	cmsg.SetWillFlag(false)
+	cmsg.SetWillQos(0)
+	cmsg.SetPassword([]byte(token))
+
+	conn, _ := connectRawMessage(t, uri, cmsg)
+	defer conn.Close()
+
+	submsg := message.NewSubscribeMessage()
+	submsg.SetPacketId(1)
+	submsg.AddTopic([]byte("abc"), 0)
+	submsg.AddTopic([]byte("xyz"), 0)
+
+	require.NoError(t, writeMessage(conn, submsg))
+
+	suback := expectMessage(t, conn, message.SUBACK).(*message.SubackMessage)
+	require.Equal(t, []byte{0, message.QosFailure}, suback.ReturnCodes())
+
+	close(ready2)
+
+	wg.Wait()
+}
+
+func TestServiceSharedSubscription(t *testing.T) {
+	var wg sync.WaitGroup
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+
+	uri := "tcp://127.0.0.1:1883"
+	u, err := url.Parse(uri)
+	require.NoError(t, err, "Error parsing URL")
+
+	svr := &Server{
+		Authenticator: authenticator,
+	}
+
+	wg.Add(1)
+	go startServer(t, svr, u, &wg, ready1, ready2, 3)
+
+	<-ready1
+
+	pub := connectRaw(t, uri)
+	defer pub.Close()
+
+	// Retained messages are not sent to shared subscriptions
+	rmsg := newPayloadMessage(1, 1, "retained")
+	rmsg.SetRetain(true)
+	require.NoError(t, writeMessage(pub, rmsg))
+	expectMessage(t, pub, message.PUBACK)
+
+	submsg := message.NewSubscribeMessage()
+	submsg.SetPacketId(1)
+	submsg.AddTopic([]byte("$share/workers/abc"), 0)
+
+	var subs []net.Conn
+
+	for i := 0; i < 2; i++ {
+		sub := connectRaw(t, uri)
+		defer sub.Close()
+
+		require.NoError(t, writeMessage(sub, submsg))
+		expectMessage(t, sub, message.SUBACK)
+
+		subs = append(subs, sub)
+	}
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, writeMessage(pub, newPayloadMessage(0, 0, fmt.Sprintf("job%d", i))))
+	}
+
+	// Round robin, so each subscriber gets every other message
+	for i, sub := range subs {
+		for j := i; j < 4; j += 2 {
+			msg := expectMessage(t, sub, message.PUBLISH).(*message.PublishMessage)
+			require.Equal(t, fmt.Sprintf("job%d", j), string(msg.Payload()))
+		}
+
+		expectNoMessage(t, sub)
+	}
+
+	close(ready2)
+
+	wg.Wait()
+}
+
+// startBoltServer starts a server on 127.0.0.1:1883 that keeps its sessions in the
+// BoltDB file at path. The channel returns what ListenAndServe() returned.
+func startBoltServer(t *testing.T, path string) (*Server, chan error) {
+	p, err := sessions.NewBoltProvider(path, 0)
+	require.NoError(t, err)
+
+	sessions.Unregister("bolt")
+	sessions.Register("bolt", p)
+
+	svr := &Server{
+		Authenticator:    authenticator,
+		SessionsProvider: "bolt",
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- svr.ListenAndServe("tcp://127.0.0.1:1883")
+	}()
+
+	return svr, done
+}
+
+// dialBoltServer connects to the server started by startBoltServer(), giving it a
+// chance to start listening first.
+func dialBoltServer(t *testing.T, msg *message.ConnectMessage) (net.Conn, *message.ConnackMessage) {
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", "127.0.0.1:1883"); err == nil {
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	require.NoError(t, err)
+	require.NoError(t, writeMessage(conn, msg))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	connack, err := getConnackMessage(conn, 0)
+	require.NoError(t, err)
+	require.Equal(t, message.ConnectionAccepted, connack.ReturnCode())
+
+	return conn, connack
+}
+
+// completeQos2 finishes the QoS 2 flow for a message the subscriber received.
+func completeQos2(t *testing.T, conn net.Conn, msg *message.PublishMessage) {
+	rec := message.NewPubrecMessage()
+	rec.SetPacketId(msg.PacketId())
+	require.NoError(t, writeMessage(conn, rec))
+
+	rel := expectMessage(t, conn, message.PUBREL)
+	require.Equal(t, msg.PacketId(), rel.PacketId())
+
+	comp := message.NewPubcompMessage()
+	comp.SetPacketId(msg.PacketId())
+	require.NoError(t, writeMessage(conn, comp))
+}
+
+// QoS 1 messages published while a persistent session's client is away are
+// delivered when it reconnects, up to the limit of the offline queue.
+func TestServiceOfflineQueue(t *testing.T) {
+	present, payloads := runOfflineQueue(t, 0, sessions.DropOldest)
+	require.True(t, present)
+	require.Equal(t, []string{"1", "2", "3"}, payloads)
+
+	present, payloads = runOfflineQueue(t, 2, sessions.DropOldest)
+	require.True(t, present)
+	require.Equal(t, []string{"2", "3"}, payloads)
+
+	present, payloads = runOfflineQueue(t, 2, sessions.DropNewest)
+	require.True(t, present)
+	require.Equal(t, []string{"1", "2"}, payloads)
+
+	present, payloads = runOfflineQueue(t, 2, sessions.Disconnect)
+	require.False(t, present)
+	require.Empty(t, payloads)
+}
+
+// runOfflineQueue subscribes a client with a persistent session, disconnects it,
+// publishes 3 QoS 1 messages, then reconnects the client. It returns whether the
+// session was still there, and the payloads of the messages delivered.
+func runOfflineQueue(t *testing.T, size int, policy sessions.OverflowPolicy) (bool, []string) {
+	var wg sync.WaitGroup
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+
+	uri := "tcp://127.0.0.1:1883"
+	u, err := url.Parse(uri)
+	require.NoError(t, err, "Error parsing URL")
+
+	svr := &Server{
+		Authenticator:      authenticator,
+		OfflineQueueSize:   size,
+		OfflineQueuePolicy: policy,
+	}
+
+	wg.Add(1)
+	go startServer(t, svr, u, &wg, ready1, ready2, 3)
+
+	<-ready1
+
+	cmsg := newPersistentConnectMessage()
+
+	conn, _ := connectRawMessage(t, uri, cmsg)
+
+	require.NoError(t, writeMessage(conn, newSubscribeMessage(1)))
+	_, err = getMessageBuffer(conn)
+	require.NoError(t, err)
+
+	conn.Close()
+
+	// Wait for the server to notice the client is gone
+	sess, err := svr.sessMgr.Get(string(cmsg.ClientId()))
+	require.NoError(t, err)
+
+	for i := 0; ; i++ {
+		require.True(t, i < 100, "Offline queue was not subscribed")
+
+		var (
+			subs []interface{}
+			qoss []byte
+		)
+
+		require.NoError(t, svr.topicsMgr.Subscribers([]byte("abc"), 1, &subs, &qoss))
+		if len(subs) == 1 && subs[0] == sess.Offline {
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	pconn := connectRaw(t, uri)
+	defer pconn.Close()
+
+	for i := 1; i <= 3; i++ {
+		msg := newPublishMessage(uint16(i), 1)
+		msg.SetPayload([]byte(fmt.Sprint(i)))
+		require.NoError(t, writeMessage(pconn, msg))
+
+		buf, err := getMessageBuffer(pconn)
+		require.NoError(t, err)
+		require.Equal(t, message.PUBACK, message.MessageType(buf[0]>>4))
+	}
+
+	// Messages are processed in order, so once this comes back all the messages
+	// have gone to the subscribers
+	require.NoError(t, writeMessage(pconn, message.NewPingreqMessage()))
+	_, err = getMessageBuffer(pconn)
+	require.NoError(t, err)
+
+	conn, connack := connectRawMessage(t, uri, cmsg)
+	defer conn.Close()
+
+	var payloads []string
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+
+		buf, err := getMessageBuffer(conn)
+		if isTimeout(err) {
+			break
+		}
+		require.NoError(t, err)
+
+		msg := message.NewPublishMessage()
+		_, err = msg.Decode(buf)
+		require.NoError(t, err)
+
+		payloads = append(payloads, string(msg.Payload()))
+	}
+
+	close(ready2)
+	wg.Wait()
+
+	return connack.SessionPresent(), payloads
+}
+
+// MQTT 5.0 clients get the MQTT 5.0 CONNACK, with properties.
+func TestServiceConnectVersion5(t *testing.T) {
+	svr := &Server{
+		Authenticator: authenticator,
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- svr.ListenAndServe("tcp://127.0.0.1:1883")
+	}()
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	// Give the server a chance to start listening
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", "127.0.0.1:1883"); err == nil {
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Protocol level 5, clean start, 60 secs keep alive, no properties, client ID "a"
+	require.NoError(t, writeMessageBuffer(conn, []byte{
+		byte(message.CONNECT << 4), 14,
+		0, 4, 'M', 'Q', 'T', 'T', 5, 2, 0, 60, 0, 0, 1, 'a',
+	}))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	// Success, with the server's Receive Maximum, and no subscription identifiers
+	buf, err := getMessageBuffer(conn)
+	require.NoError(t, err)
+	require.Equal(t, []byte{
+		byte(message.CONNACK << 4), 8,
+		0, 0, 5, propReceiveMaximum, 4, 0, propSubscriptionIdAvailable, 0,
+	}, buf)
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+}
+
+// None of the clients are subscribed, but they should all get the notice anyway.
+func TestServiceBroadcast(t *testing.T) {
+	var wg sync.WaitGroup
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+
+	uri := "tcp://127.0.0.1:1883"
+	u, err := url.Parse(uri)
+	require.NoError(t, err, "Error parsing URL")
+
+	svr := &Server{
+		Authenticator: authenticator,
+	}
+
+	const count = 3
+
+	wg.Add(1)
+	go startServer(t, svr, u, &wg, ready1, ready2, count)
+
+	<-ready1
+
+	conns := make([]net.Conn, count)
+	for i := range conns {
+		conns[i] = connectRaw(t, uri)
+		defer conns[i].Close()
+	}
+
+	for i := 0; len(svr.services()) < count; i++ {
+		require.True(t, i < 100, "Expecting %d services, got %d", count, len(svr.services()))
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	for _, qos := range []byte{0, 1} {
+		n, err := svr.Broadcast("$SYS/notice", []byte("going down for maintenance"), qos)
+		require.NoError(t, err)
+		require.Equal(t, count, n)
+
+		for _, conn := range conns {
+			buf, err := getMessageBuffer(conn)
+			require.NoError(t, err)
+
+			msg := message.NewPublishMessage()
+			_, err = msg.Decode(buf)
+			require.NoError(t, err)
+
+			require.Equal(t, "$SYS/notice", string(msg.Topic()))
+			require.Equal(t, "going down for maintenance", string(msg.Payload()))
+			require.Equal(t, qos, msg.QoS())
+
+			if qos > 0 {
+				require.NotEqual(t, 0, int(msg.PacketId()))
+			}
+		}
+	}
+
+	_, err = svr.Broadcast("$SYS/notice", []byte("bad qos"), 3)
+	require.Error(t, err)
+
+	close(ready2)
+
+	wg.Wait()
+}
+
+// SUBSCRIBE with the reserved flags cleared, like some MQTT 3.1 clients send, and
+// a PINGREQ with an extra byte at the end.
+func TestServiceStrictModeLenient(t *testing.T) {
+	conn, done := startStrictModeServer(t, Lenient)
+	defer done()
+
+	msg := newSubscribeMessage(1)
+	buf := make([]byte, msg.Len())
+	_, err := msg.Encode(buf)
+	require.NoError(t, err)
+
+	buf[0] &^= 0x0f
+	require.NoError(t, writeMessageBuffer(conn, buf))
+
+	resp, err := getMessageBuffer(conn)
+	require.NoError(t, err)
+	require.Equal(t, message.SUBACK, message.MessageType(resp[0]>>4))
+
+	require.NoError(t, writeMessageBuffer(conn, []byte{byte(message.PINGREQ) << 4, 1, 0}))
+
+	resp, err = getMessageBuffer(conn)
+	require.NoError(t, err)
+	require.Equal(t, message.PINGRESP, message.MessageType(resp[0]>>4))
+
+	// A QoS 1 PUBLISH to a topic name with a wildcard is acked, just not delivered
+	require.NoError(t, writeMessageBuffer(conn, []byte{byte(message.PUBLISH)<<4 | 2, 7, 0, 3, 'a', '/', '+', 0, 1}))
+	expectMessage(t, conn, message.PUBACK)
+
+	// A QoS 0 PUBLISH with the DUP flag set
+	require.NoError(t, writeMessageBuffer(conn, []byte{byte(message.PUBLISH)<<4 | 8, 5, 0, 3, 'a', '/', 'b'}))
+	expectNoMessage(t, conn)
+}
+
+func TestServiceStrictModeStrict(t *testing.T) {
+	for _, b := range [][]byte{
+		{byte(message.SUBSCRIBE) << 4, 8, 0, 1, 0, 3, 'a', '/', 'b', 1},
+		{byte(message.PINGREQ) << 4, 1, 0},
+		{byte(message.PUBLISH) << 4, 5, 0, 3, 'a', '/', '+'},
+		{byte(message.PUBLISH) << 4, 5, 0, 3, 'a', '/', 0xff},
+		{byte(message.PUBLISH)<<4 | 8, 5, 0, 3, 'a', '/', 'b'},
+		{byte(message.PUBLISH)<<4 | 2, 7, 0, 3, 'a', '/', 'b', 0, 0},
+		{byte(message.SUBSCRIBE)<<4 | 2, 7, 0, 1, 0, 2, 'a', '#', 1},
+		{byte(message.SUBSCRIBE)<<4 | 2, 8, 0, 1, 0, 3, 'a', '/', 'b', 0x41},
+		{byte(message.UNSUBSCRIBE)<<4 | 2, 6, 0, 1, 0, 2, 'a', '+'},
+	} {
+		conn, done := startStrictModeServer(t, Strict)
+
+		require.NoError(t, writeMessageBuffer(conn, b))
+
+		_, err := getMessageBuffer(conn)
+		require.Error(t, err)
+		require.False(t, isTimeout(err), "Server did not close the connection")
+
+		done()
+	}
+}
+
+func TestServiceStrictModeConnect(t *testing.T) {
+	conn, done := startStrictModeServer(t, Strict)
+	defer done()
+
+	u, err := url.Parse("tcp://127.0.0.1:1883")
+	require.NoError(t, err)
+
+	conn2, err := net.Dial(u.Scheme, u.Host)
+	require.NoError(t, err)
+	defer conn2.Close()
+
+	msg := newConnectMessage()
+	msg.SetWillTopic([]byte("will/#"))
+
+	require.NoError(t, writeMessage(conn2, msg))
+	expectClosed(t, conn2)
+
+	// The first client is still fine
+	require.NoError(t, writeMessage(conn, message.NewPingreqMessage()))
+	expectMessage(t, conn, message.PINGRESP)
+}
+
+func startStrictModeServer(t *testing.T, mode Strictness) (net.Conn, func()) {
+	var wg sync.WaitGroup
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+
+	uri := "tcp://127.0.0.1:1883"
+	u, err := url.Parse(uri)
+	require.NoError(t, err, "Error parsing URL")
+
+	svr := &Server{
+		Authenticator: authenticator,
+		StrictMode:    mode,
+	}
+
+	wg.Add(1)
+	go startServer(t, svr, u, &wg, ready1, ready2, 1)
+
+	<-ready1
+
+	conn := connectRaw(t, uri)
+
+	return conn, func() {
+		conn.Close()
+		close(ready2)
+		wg.Wait()
+	}
+}
+
+// Redact the payload for one subscriber, leave the other one alone, and skip
+// delivery to the publisher even though it's also subscribed.
+func TestServiceTransformOutbound(t *testing.T) {
+	var wg sync.WaitGroup
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+
+	uri := "tcp://127.0.0.1:1883"
+	u, err := url.Parse(uri)
+	require.NoError(t, err, "Error parsing URL")
+
+	var redacted, skipped string
+
+	svr := &Server{
+		Authenticator: authenticator,
+		TransformOutbound: func(cid string, msg *message.PublishMessage) (*message.PublishMessage, bool) {
+			switch cid {
+			case redacted:
+				rmsg := message.NewPublishMessage()
+				rmsg.SetTopic(msg.Topic())
+				rmsg.SetQoS(msg.QoS())
+				rmsg.SetPacketId(msg.PacketId())
+				rmsg.SetPayload([]byte("xxx"))
+				return rmsg, true
+
+			case skipped:
+				return nil, false
+			}
+
+			return msg, true
+		},
+	}
+
+	wg.Add(1)
+	go startServer(t, svr, u, &wg, ready1, ready2, 3)
+
+	<-ready1
+
+	c1 := connectToServer(t, uri)
+	require.NotNil(t, c1)
+	defer topics.Unregister(c1.svc.sess.ID())
+
+	c2 := connectToServer(t, uri)
+	require.NotNil(t, c2)
+	defer topics.Unregister(c2.svc.sess.ID())
+
+	c3 := connectToServer(t, uri)
+	require.NotNil(t, c3)
+	defer topics.Unregister(c3.svc.sess.ID())
+
+	redacted = c1.svc.sess.ID()
+	skipped = c3.svc.sess.ID()
+
+	subdone := make(chan struct{}, 3)
+	payloads := make(chan string, 3)
+
+	for _, c := range []*Client{c1, c2, c3} {
+		c.Subscribe(newSubscribeMessage(0),
+			func(msg, ack message.Message, err error) error {
+				subdone <- struct{}{}
+				return nil
+			},
+			func(msg *message.PublishMessage) error {
+				payloads <- string(msg.Payload())
+				return nil
+			})
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-subdone:
+		case <-time.After(time.Millisecond * 100):
+			require.FailNow(t, "Timed out waiting for subscribe response")
+		}
+	}
+
+	c3.Publish(newPublishMessage(0, 0), nil)
+
+	var got []string
+
+	for i := 0; i < 2; i++ {
+		select {
+		case p := <-payloads:
+			got = append(got, p)
+		case <-time.After(time.Millisecond * 100):
+			require.FailNow(t, "Timed out waiting for publish messages")
+		}
+	}
+
+	select {
+	case p := <-payloads:
+		require.FailNow(t, "Received unexpected message "+p)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	require.Contains(t, got, "xxx")
+	require.Contains(t, got, "abc")
+
+	c1.Disconnect()
+	c2.Disconnect()
+	c3.Disconnect()
+
+	close(ready2)
+
+	wg.Wait()
+}
+
+func TestServiceTracing(t *testing.T) {
+	var wg sync.WaitGroup
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+
+	uri := "tcp://127.0.0.1:1883"
+	u, err := url.Parse(uri)
+	require.NoError(t, err, "Error parsing URL")
+
+	tracer := newRecordTracer()
+
+	svr := &Server{
+		Authenticator: authenticator,
+		Tracer:        tracer,
+		Hooks: []*Hooks{{
+			TraceContext: func(ctx context.Context, c *ClientInfo, msg *message.PublishMessage) context.Context {
+				return context.WithValue(ctx, spanKey{}, "client")
+			},
+		}},
+	}
+
+	wg.Add(1)
+	go startServer(t, svr, u, &wg, ready1, ready2, 2)
+
+	<-ready1
+
+	c1 := connectToServer(t, uri)
+	require.NotNil(t, c1)
+	defer topics.Unregister(c1.svc.sess.ID())
+
+	c2 := connectToServer(t, uri)
+	require.NotNil(t, c2)
+	defer topics.Unregister(c2.svc.sess.ID())
+
+	subdone := make(chan struct{})
+	received := make(chan struct{}, 1)
+
+	c1.Subscribe(newSubscribeMessage(1),
+		func(msg, ack message.Message, err error) error {
+			close(subdone)
+			return nil
+		},
+		func(msg *message.PublishMessage) error {
+			received <- struct{}{}
+			return nil
+		})
+
+	select {
+	case <-subdone:
+	case <-time.After(time.Millisecond * 100):
+		require.FailNow(t, "Timed out waiting for subscribe response")
+	}
+
+	c2.Publish(newPublishMessage(1, 1), nil)
+
+	select {
+	case <-received:
+	case <-time.After(time.Millisecond * 100):
+		require.FailNow(t, "Timed out waiting for publish message")
+	}
+
+	// SpanDeliver only ends once c1 has acked the message
+	ended := make(map[string]*recordSpan)
+	for _, s := range tracer.waitEnded(t, 5) {
+		ended[s.name] = s
+	}
+
+	tracer.mu.Lock()
+	var started []string
+	for _, s := range tracer.spans {
+		started = append(started, s.name)
+	}
+	tracer.mu.Unlock()
+
+	require.Equal(t, []string{SpanPublish, SpanAuthorize, SpanMatch, SpanFanout, SpanDeliver}, started)
+
+	require.Equal(t, "client", ended[SpanPublish].parent)
+	require.Equal(t, c2.svc.sess.ID(), ended[SpanPublish].attrs["client_id"])
+	require.Equal(t, "abc", ended[SpanPublish].attrs["topic"])
+
+	require.Equal(t, SpanPublish, ended[SpanAuthorize].parent)
+	require.Equal(t, SpanPublish, ended[SpanMatch].parent)
+	require.Equal(t, SpanPublish, ended[SpanFanout].parent)
+	require.Equal(t, SpanFanout, ended[SpanDeliver].parent)
+	require.Equal(t, c1.svc.sess.ID(), ended[SpanDeliver].attrs["client_id"])
+
+	for _, s := range ended {
+		require.NoError(t, s.err, s.name)
+	}
+
+	c1.Disconnect()
+	c2.Disconnect()
+
+	close(ready2)
+
+	wg.Wait()
+}
+
+func assertPublishMessage(t *testing.T, msg *message.PublishMessage, qos byte) {
+	require.Equal(t, "abc", string(msg.Payload()))
+	require.Equal(t, qos, msg.QoS())
+}
+
+// Shutdown() closes the connections of the clients still connected, and saves their
+// sessions, so they pick up where they left off once the server is back.
+func TestServerShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "surgemq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sessions.db")
+
+	cmsg := newPersistentConnectMessage()
+
+	svr, done := startBoltServer(t, path)
+
+	conn, connack := dialBoltServer(t, cmsg)
+	defer conn.Close()
+	require.False(t, connack.SessionPresent())
+
+	require.NoError(t, writeMessage(conn, newSubscribeMessage(1)))
+	expectMessage(t, conn, message.SUBACK)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	require.NoError(t, svr.Shutdown(ctx))
+	require.NoError(t, <-done)
+
+	expectClosed(t, conn)
+
+	_, err = net.Dial("tcp", "127.0.0.1:1883")
+	require.Error(t, err)
+
+	svr, done = startBoltServer(t, path)
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	conn, connack = dialBoltServer(t, cmsg)
+	defer conn.Close()
+	require.True(t, connack.SessionPresent())
+}
+
+// Once the context is done, Shutdown() closes the connections without waiting any
+// longer and returns the context's error.
+func TestServerShutdownCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "surgemq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	svr, done := startBoltServer(t, filepath.Join(dir, "sessions.db"))
+
+	conn, _ := dialBoltServer(t, newConnectMessage())
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	require.Equal(t, context.Canceled, svr.Shutdown(ctx))
+	require.NoError(t, <-done)
+
+	expectClosed(t, conn)
+}
+
+// waitForClient waits until the client is connected to the server.
+func waitForClient(t testing.TB, svr *Server, cid string) {
+	for i := 0; i < 200; i++ {
+		if svr.connected(cid) != nil {
+			return
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	require.FailNow(t, "Expecting client to be connected", cid)
+}
+
+func TestServerWillDelay(t *testing.T) {
+	svr, done := startNamedServer(t, "willdelay", "tcp://127.0.0.1:1883", &Server{WillDelay: 1})
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	sconn := dialNamedServer(t, "127.0.0.1:1883", "will")
+	defer sconn.Close()
+
+	// The client comes back in time, so there's no will
+	cmsg := newConnectMessage()
+
+	conn, _ := connectRawMessage(t, "tcp://127.0.0.1:1883", cmsg)
+	waitForClient(t, svr, string(cmsg.ClientId()))
+	conn.Close()
+
+	expectNoMessage(t, sconn)
+
+	conn, _ = connectRawMessage(t, "tcp://127.0.0.1:1883", cmsg)
+	defer conn.Close()
+
+	time.Sleep(time.Second)
+	expectNoMessage(t, sconn)
+
+	// This one doesn't
+	conn2 := connectRaw(t, "tcp://127.0.0.1:1883")
+	conn2.Close()
+
+	expectNoMessage(t, sconn)
+
+	time.Sleep(time.Second)
+	expectPublish(t, sconn, "will", 1)
+}
+
+func TestServerTakeover(t *testing.T) {
+	for _, test := range []struct {
+		policy TakeoverPolicy
+		will   bool
+	}{
+		{DisconnectOld, true},
+		{DisconnectOldNoWill, false},
+	} {
+		svr, done := startNamedServer(t, "takeover", "tcp://127.0.0.1:1883", &Server{Takeover: test.policy})
+
+		sconn := dialNamedServer(t, "127.0.0.1:1883", "will")
+
+		cmsg := newConnectMessage()
+
+		conn, _ := connectRawMessage(t, "tcp://127.0.0.1:1883", cmsg)
+		waitForClient(t, svr, string(cmsg.ClientId()))
+
+		conn2, _ := connectRawMessage(t, "tcp://127.0.0.1:1883", cmsg)
+		expectClosed(t, conn)
+
+		if test.will {
+			expectPublish(t, sconn, "will", 1)
+		} else {
+			expectNoMessage(t, sconn)
+		}
+
+		// The new connection is the one that's left
+		require.NoError(t, writeMessage(conn2, message.NewPingreqMessage()))
+		expectMessage(t, conn2, message.PINGRESP)
+
+		conn.Close()
+		conn2.Close()
+		sconn.Close()
+
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}
+}
+
+func TestServerTakeoverRejectNew(t *testing.T) {
+	svr, done := startNamedServer(t, "takeover", "tcp://127.0.0.1:1883", &Server{Takeover: RejectNew})
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	sconn := dialNamedServer(t, "127.0.0.1:1883", "will")
+	defer sconn.Close()
+
+	cmsg := newConnectMessage()
+
+	conn, _ := connectRawMessage(t, "tcp://127.0.0.1:1883", cmsg)
+	defer conn.Close()
+	waitForClient(t, svr, string(cmsg.ClientId()))
+
+	conn2, err := net.Dial("tcp", "127.0.0.1:1883")
+	require.NoError(t, err)
+	defer conn2.Close()
+
+	require.NoError(t, writeMessage(conn2, cmsg))
+
+	conn2.SetReadDeadline(time.Now().Add(time.Second))
+
+	connack, err := getConnackMessage(conn2, 0)
+	require.NoError(t, err)
+	require.Equal(t, message.ErrIdentifierRejected, connack.ReturnCode())
+	expectClosed(t, conn2)
+
+	// The client that was there first is still connected
+	require.NoError(t, writeMessage(conn, message.NewPingreqMessage()))
+	expectMessage(t, conn, message.PINGRESP)
+	expectNoMessage(t, sconn)
+}
+
+func TestServerSessionExpiry(t *testing.T) {
+	svr, done := startNamedServer(t, "expiry", "tcp://127.0.0.1:1883", &Server{
+		SessionExpiry: 60,
+		Hooks: []*Hooks{{
+			OnTimeouts: func(c *ClientInfo, t *ClientTimeouts) {
+				if c.ClientId == "forever" {
+					t.SessionExpiry = 0
+				}
+			},
+		}},
+	})
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	cmsg := newPersistentConnectMessage()
+
+	conn, _ := connectRawMessage(t, "tcp://127.0.0.1:1883", cmsg)
+	require.NoError(t, writeMessage(conn, newSubscribeMessage(1)))
+	expectMessage(t, conn, message.SUBACK)
+	conn.Close()
+
+	fmsg := newPersistentConnectMessage()
+	fmsg.SetClientId([]byte("forever"))
+
+	conn, _ = connectRawMessage(t, "tcp://127.0.0.1:1883", fmsg)
+	conn.Close()
+
+	sess, err := svr.sessMgr.Get(string(cmsg.ClientId()))
+	require.NoError(t, err)
+
+	subscribers := func() int {
+		var (
+			subs []interface{}
+			qoss []byte
+		)
+
+		require.NoError(t, svr.topicsMgr.Subscribers([]byte("abc"), 1, &subs, &qoss))
+		return len(subs)
+	}
+
+	for i := 0; sess.Expiry().IsZero() || subscribers() == 0; i++ {
+		require.True(t, i < 100, "Session was not given an expiry")
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	require.True(t, sess.Expiry().After(time.Now().Add(50*time.Second)))
+
+	// Not yet
+	svr.expire(time.Now())
+	_, err = svr.sessMgr.Get(string(cmsg.ClientId()))
+	require.NoError(t, err)
+
+	svr.expire(time.Now().Add(2 * time.Minute))
+
+	_, err = svr.sessMgr.Get(string(cmsg.ClientId()))
+	require.Error(t, err)
+	require.Equal(t, 0, subscribers())
+
+	_, err = svr.sessMgr.Get("forever")
+	require.NoError(t, err)
+
+	// The client gets a new session
+	conn, connack := connectRawMessage(t, "tcp://127.0.0.1:1883", cmsg)
+	defer conn.Close()
+
+	require.False(t, connack.SessionPresent())
+}
+
+// The session expires, through the server's own expiry, while its client is coming
+// back for the message queued for it when it was away, and acking it. Whichever
+// wins, the acks that don't match any message should just be dropped, without
+// taking the connection down.
+func TestServicePubackAfterSessionExpired(t *testing.T) {
+	svr, done := startNamedServer(t, "pubackexpired", "tcp://127.0.0.1:1883", &Server{
+		SessionExpiry: 60,
+	})
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	cmsg := newPersistentConnectMessage()
+	cid := string(cmsg.ClientId())
+
+	conn, _ := connectRawMessage(t, "tcp://127.0.0.1:1883", cmsg)
+	require.NoError(t, writeMessage(conn, newSubscribeMessage(1)))
+	expectMessage(t, conn, message.SUBACK)
+
+	subscribers := func() int {
+		var (
+			subs []interface{}
+			qoss []byte
+		)
+
+		require.NoError(t, svr.topicsMgr.Subscribers([]byte("abc"), 1, &subs, &qoss))
+		return len(subs)
+	}
+
+	for i := 1; i <= 20; i++ {
+		conn.Close()
+
+		sess, err := svr.sessMgr.Get(cid)
+		require.NoError(t, err)
+
+		for j := 0; sess.Expiry().IsZero() || subscribers() == 0; j++ {
+			require.True(t, j < 100, "Session was not given an expiry")
+			time.Sleep(time.Millisecond * 10)
+		}
+
+		// Queued for the client until it comes back
+		require.NoError(t, svr.Publish(newPublishMessage(uint16(i), 1), nil))
+
+		var ewg sync.WaitGroup
+
+		quit := make(chan struct{})
+
+		ewg.Add(1)
+		go func() {
+			defer ewg.Done()
+
+			for {
+				select {
+				case <-quit:
+					return
+				default:
+					svr.expire(time.Now().Add(2 * time.Minute))
+				}
+			}
+		}()
+
+		var connack *message.ConnackMessage
+
+		conn, connack = connectRawMessage(t, "tcp://127.0.0.1:1883", cmsg)
+
+		if connack.SessionPresent() {
+			pub := expectMessage(t, conn, message.PUBLISH).(*message.PublishMessage)
+
+			ack := message.NewPubackMessage()
+			ack.SetPacketId(pub.PacketId())
+			require.NoError(t, writeMessage(conn, ack))
+
+			// Ack it twice, the second one has nothing waiting for it.
+			require.NoError(t, writeMessage(conn, ack))
+		}
+
+		close(quit)
+		ewg.Wait()
+
+		require.NoError(t, writeMessage(conn, message.NewPingreqMessage()))
+		expectMessage(t, conn, message.PINGRESP)
+
+		if !connack.SessionPresent() {
+			require.NoError(t, writeMessage(conn, newSubscribeMessage(1)))
+			expectMessage(t, conn, message.SUBACK)
+		}
+	}
+
+	defer conn.Close()
+
+	svc := svr.connected(cid)
+	require.NotNil(t, svc)
+
+	for i := 0; svc.sess.Pub1ack.Len() > 0; i++ {
+		require.True(t, i < 100, "Expecting no messages waiting for PUBACK, got %d", svc.sess.Pub1ack.Len())
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestServerMessageTTL(t *testing.T) {
+	svr, done := startNamedServer(t, "ttl", "tcp://127.0.0.1:1883", &Server{
+		TopicTTLs:      []TopicTTL{{Filter: "abc", TTL: time.Millisecond * 500}},
+		ExpiryInterval: 1,
+	})
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	pconn := dialNamedServer(t, "127.0.0.1:1883", "none")
+	defer pconn.Close()
+
+	// A client with a persistent session goes away, so messages are queued for it
+	cmsg := newPersistentConnectMessage()
+
+	conn, _ := connectRawMessage(t, "tcp://127.0.0.1:1883", cmsg)
+	require.NoError(t, writeMessage(conn, newSubscribeMessage(1)))
+	_, err := getMessageBuffer(conn)
+	require.NoError(t, err)
+	conn.Close()
+
+	sess, err := svr.sessMgr.Get(string(cmsg.ClientId()))
+	require.NoError(t, err)
+
+	for i := 0; ; i++ {
+		require.True(t, i < 100, "Offline queue was not subscribed")
+
+		var (
+			subs []interface{}
+			qoss []byte
+		)
+
+		require.NoError(t, svr.topicsMgr.Subscribers([]byte("abc"), 1, &subs, &qoss))
+		if len(subs) == 1 && subs[0] == sess.Offline {
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// Only the messages for "abc" expire
+	for i, topic := range []string{"abc", "xyz"} {
+		msg := newPublishMessage(uint16(i+1), 1)
+		msg.SetRetain(true)
+		require.NoError(t, msg.SetTopic([]byte(topic)))
+		require.NoError(t, writeMessage(pconn, msg))
+		expectMessage(t, pconn, message.PUBACK)
+	}
+
+	require.Equal(t, 1, sess.Offline.Len())
+	require.Equal(t, 500*time.Millisecond, svr.messageTTL(newPublishMessage(0, 0)))
+
+	for i := 0; sess.Offline.Len() > 0; i++ {
+		require.True(t, i < 300, "Offline message did not expire")
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	st, err := svr.topicsMgr.Stats()
+	require.NoError(t, err)
+	require.Equal(t, 1, st.Retained)
+
+	smsg := message.NewSubscribeMessage()
+	smsg.SetPacketId(1)
+	smsg.AddTopic([]byte("#"), 1)
+	require.NoError(t, writeMessage(pconn, smsg))
+	expectMessage(t, pconn, message.SUBACK)
+	expectPublish(t, pconn, "xyz", 1)
+	expectNoMessage(t, pconn)
+
+	conn, connack := connectRawMessage(t, "tcp://127.0.0.1:1883", cmsg)
+	defer conn.Close()
+
+	require.True(t, connack.SessionPresent())
+	expectNoMessage(t, conn)
 }
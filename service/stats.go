@@ -0,0 +1,254 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the traffic of each connected client, and of each topic
+// published to, as returned by Server.Stats. Unlike Metrics, which are for the
+// server as a whole, they are meant for finding the clients and topics that stand
+// out, e.g., the noisiest publishers.
+type Stats struct {
+	// When the snapshot was taken
+	Time time.Time `json:"time"`
+
+	// The connected clients, sorted by client ID
+	Clients []ClientStats `json:"clients"`
+
+	// The topics published to since the server started, sorted by topic, up to
+	// Server.MaxTopicStats of them
+	Topics []TopicStats `json:"topics"`
+}
+
+// ClientStats is the traffic of a connected client since it connected.
+type ClientStats struct {
+	ClientId    string    `json:"client_id"`
+	Username    string    `json:"username,omitempty"`
+	RemoteAddr  string    `json:"remote_addr,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+
+	// Number of PUBLISH messages received from and sent to the client
+	MessagesIn  int64 `json:"messages_in"`
+	MessagesOut int64 `json:"messages_out"`
+
+	// Number of packets of any kind, and of bytes, read from and written to the client
+	PacketsIn  int64 `json:"packets_in"`
+	PacketsOut int64 `json:"packets_out"`
+	BytesIn    int64 `json:"bytes_in"`
+	BytesOut   int64 `json:"bytes_out"`
+
+	// Number of QoS 1 and 2 messages sent to the client that it hasn't acked yet, and
+	// of messages waiting for room in its inflight window
+	Inflight int `json:"inflight"`
+	Queued   int `json:"queued"`
+
+	// When the last packet was received from the client
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// TopicStats is the traffic of a topic since the server started.
+type TopicStats struct {
+	Topic string `json:"topic"`
+
+	// Number of PUBLISH messages to the topic, from the clients and Server.Publish
+	Published int64 `json:"published"`
+
+	// Number of times the messages were handed to a subscriber, either a connected
+	// client or the offline queue of one that's away
+	Delivered int64 `json:"delivered"`
+
+	// Number of subscribers the last message to the topic went to
+	Subscribers int `json:"subscribers"`
+
+	// When the last message was published to the topic
+	LastPublished time.Time `json:"last_published"`
+}
+
+// topicStats are the counts behind Stats.Topics, by topic. Topics are added as
+// they are published to, until there are limit of them, and the counts are only
+// ever updated with atomic operations, so publishers don't wait on each other. All
+// the methods can be called on a nil *topicStats, e.g., from a client side service,
+// and do nothing.
+type topicStats struct {
+	limit  int
+	topics map[string]*topicCount
+	mu     sync.RWMutex
+}
+
+type topicCount struct {
+	published   int64
+	delivered   int64
+	subscribers int64
+	last        int64
+}
+
+func newTopicStats(limit int) *topicStats {
+	return &topicStats{
+		limit:  limit,
+		topics: make(map[string]*topicCount),
+	}
+}
+
+// published counts a message published to the topic, and handed to n subscribers.
+func (this *topicStats) published(topic []byte, n int) {
+	if this == nil {
+		return
+	}
+
+	this.mu.RLock()
+	tc, ok := this.topics[string(topic)]
+	this.mu.RUnlock()
+
+	if !ok {
+		this.mu.Lock()
+
+		if tc, ok = this.topics[string(topic)]; !ok {
+			if len(this.topics) >= this.limit {
+				this.mu.Unlock()
+				return
+			}
+
+			tc = &topicCount{}
+			this.topics[string(topic)] = tc
+		}
+
+		this.mu.Unlock()
+	}
+
+	atomic.AddInt64(&tc.published, 1)
+	atomic.AddInt64(&tc.delivered, int64(n))
+	atomic.StoreInt64(&tc.subscribers, int64(n))
+	atomic.StoreInt64(&tc.last, time.Now().UnixNano())
+}
+
+func (this *topicStats) list() []TopicStats {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	topics := make([]TopicStats, 0, len(this.topics))
+
+	for topic, tc := range this.topics {
+		topics = append(topics, TopicStats{
+			Topic:         topic,
+			Published:     atomic.LoadInt64(&tc.published),
+			Delivered:     atomic.LoadInt64(&tc.delivered),
+			Subscribers:   int(atomic.LoadInt64(&tc.subscribers)),
+			LastPublished: time.Unix(0, atomic.LoadInt64(&tc.last)),
+		})
+	}
+
+	sort.Sort(topicStatsByTopic(topics))
+
+	return topics
+}
+
+type topicStatsByTopic []TopicStats
+
+func (this topicStatsByTopic) Len() int           { return len(this) }
+func (this topicStatsByTopic) Less(i, j int) bool { return this[i].Topic < this[j].Topic }
+func (this topicStatsByTopic) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
+
+// Stats returns a snapshot of the traffic of the connected clients, and of the
+// topics. See also OnStats, for getting it periodically.
+func (this *Server) Stats() Stats {
+	st := Stats{
+		Time:    time.Now(),
+		Clients: []ClientStats{},
+		Topics:  []TopicStats{},
+	}
+
+	if err := this.checkConfiguration(); err != nil {
+		return st
+	}
+
+	for _, svc := range this.services() {
+		if svc.info == nil || svc.sess == nil {
+			continue
+		}
+
+		st.Clients = append(st.Clients, svc.stats())
+	}
+
+	sort.Sort(clientStatsById(st.Clients))
+
+	st.Topics = this.topicStats.list()
+
+	return st
+}
+
+// stats returns the traffic of the client.
+func (this *service) stats() ClientStats {
+	cs := ClientStats{
+		ClientId:     this.info.ClientId,
+		Username:     this.info.Username,
+		ConnectedAt:  this.info.ConnectedAt,
+		MessagesIn:   atomic.LoadInt64(&this.publishedIn),
+		MessagesOut:  atomic.LoadInt64(&this.publishedOut),
+		PacketsIn:    atomic.LoadInt64(&this.inStat.msgs),
+		PacketsOut:   atomic.LoadInt64(&this.outStat.msgs),
+		BytesIn:      atomic.LoadInt64(&this.inStat.bytes),
+		BytesOut:     atomic.LoadInt64(&this.outStat.bytes),
+		Inflight:     this.sess.Pub1ack.Len() + this.sess.Pub2out.Len(),
+		LastActivity: time.Unix(0, atomic.LoadInt64(&this.lastActivity)),
+	}
+
+	if this.info.RemoteAddr != nil {
+		cs.RemoteAddr = this.info.RemoteAddr.String()
+	}
+
+	if this.sess.Offline != nil {
+		cs.Queued = this.sess.Offline.Len()
+	}
+
+	return cs
+}
+
+type clientStatsById []ClientStats
+
+func (this clientStatsById) Len() int           { return len(this) }
+func (this clientStatsById) Less(i, j int) bool { return this[i].ClientId < this[j].ClientId }
+func (this clientStatsById) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
+
+func (this *Server) startStats() {
+	if this.OnStats == nil {
+		return
+	}
+
+	this.statsOnce.Do(func() {
+		go this.statsLoop()
+	})
+}
+
+// statsLoop hands Stats() to OnStats every StatsInterval seconds until the server
+// quits.
+func (this *Server) statsLoop() {
+	tick := time.NewTicker(time.Second * time.Duration(this.StatsInterval))
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-this.quit:
+			return
+
+		case <-tick.C:
+			this.OnStats(this.Stats())
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestServerStats(t *testing.T) {
+	exported := make(chan Stats, 1)
+
+	svr, done := startNamedServer(t, "stats", "tcp://127.0.0.1:1883", &Server{
+		StatsInterval: 1,
+		OnStats: func(st Stats) {
+			select {
+			case exported <- st:
+			default:
+			}
+		},
+	})
+	defer func() {
+		require.NoError(t, svr.Close())
+		require.NoError(t, <-done)
+	}()
+
+	sub := dialNamedServer(t, "127.0.0.1:1883", "abc")
+	defer sub.Close()
+
+	pub := dialNamedServer(t, "127.0.0.1:1883", "def")
+	defer pub.Close()
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, writeMessage(pub, newPublishMessage(uint16(i), 1)))
+		expectMessage(t, pub, message.PUBACK)
+		expectPublish(t, sub, "abc", 1)
+	}
+
+	// No one's subscribed to that one
+	msg := newPublishMessage(4, 0)
+	msg.SetTopic([]byte("ghi"))
+	require.NoError(t, writeMessage(pub, msg))
+
+	// Published through the server, not by a client
+	msg = newPublishMessage(0, 0)
+	msg.SetTopic([]byte("def"))
+	require.NoError(t, svr.Publish(msg, nil))
+	expectPublish(t, pub, "def", 0)
+
+	expectNoMessage(t, sub)
+
+	st := svr.Stats()
+	require.Equal(t, 2, len(st.Clients))
+
+	// The subscriber hasn't published anything
+	subst, pubst := st.Clients[0], st.Clients[1]
+	if subst.MessagesIn > 0 {
+		subst, pubst = pubst, subst
+	}
+
+	require.Equal(t, int64(0), subst.MessagesIn)
+	require.Equal(t, int64(3), subst.MessagesOut)
+	require.Equal(t, int64(4), pubst.MessagesIn)
+	require.Equal(t, int64(1), pubst.MessagesOut)
+
+	// CONNECT, SUBSCRIBE and the PUBACKs, and CONNACK, SUBACK and the PUBLISHes
+	require.Equal(t, int64(5), subst.PacketsIn)
+	require.Equal(t, int64(5), subst.PacketsOut)
+	require.True(t, subst.BytesIn > 0)
+	require.True(t, subst.BytesOut > 0)
+	require.Equal(t, 0, subst.Inflight)
+	require.WithinDuration(t, time.Now(), subst.LastActivity, time.Second)
+
+	require.Equal(t, []TopicStats{
+		{Topic: "abc", Published: 3, Delivered: 3, Subscribers: 1},
+		{Topic: "def", Published: 1, Delivered: 1, Subscribers: 1},
+		{Topic: "ghi", Published: 1},
+	}, withoutLastPublished(st.Topics))
+
+	select {
+	case st = <-exported:
+		require.Equal(t, 2, len(st.Clients))
+
+	case <-time.After(time.Second * 3):
+		t.Fatal("Stats were not exported")
+	}
+}
+
+func TestTopicStatsLimit(t *testing.T) {
+	ts := newTopicStats(2)
+
+	ts.published([]byte("abc"), 1)
+	ts.published([]byte("def"), 2)
+	ts.published([]byte("ghi"), 3)
+	ts.published([]byte("abc"), 4)
+
+	require.Equal(t, []TopicStats{
+		{Topic: "abc", Published: 2, Delivered: 5, Subscribers: 4},
+		{Topic: "def", Published: 1, Delivered: 2, Subscribers: 2},
+	}, withoutLastPublished(ts.list()))
+
+	// Client side services have none
+	var nts *topicStats
+	nts.published([]byte("abc"), 1)
+}
+
+func withoutLastPublished(topics []TopicStats) []TopicStats {
+	for i := range topics {
+		topics[i].LastPublished = time.Time{}
+	}
+
+	return topics
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/surgemq/message"
+)
+
+// The names of the spans started for each PUBLISH from a client. SpanPublish lasts
+// from when the PUBLISH is received, until it's been handed to all the subscribers,
+// which for QoS 2 includes waiting for the PUBREL. The others are its children, and
+// SpanDeliver the child of SpanFanout, one for each client the message is sent to.
+const (
+	SpanPublish   = "mqtt.publish"
+	SpanAuthorize = "mqtt.authorize"
+	SpanMatch     = "mqtt.match"
+	SpanFanout    = "mqtt.fanout"
+
+	// SpanDeliver lasts until the client acks the message, or, for QoS 0, until it's
+	// queued for the client. Messages that have to wait for room in the client's
+	// inflight window, see Server.MaxInflight, end it once they are put in the
+	// session. If the client goes away before it acks the message then the span is
+	// never ended.
+	SpanDeliver = "mqtt.deliver"
+)
+
+var (
+	errPublishNotAuthorized = errors.New("Not authorized to publish")
+	errPublishDropped       = errors.New("Dropped by hook")
+	errPayloadRejected      = errors.New("Payload rejected")
+)
+
+// Tracer starts the spans that follow a PUBLISH through the server, so it's possible
+// to find where the time goes. It's meant to wrap an OpenTelemetry tracer, or one
+// from any other tracing library, which can then be fed the attributes as it likes.
+type Tracer interface {
+	// Start starts a span named name, the child of the span in ctx, if any, and
+	// returns a context with the new span in it. attrs are the attributes of the
+	// span, e.g., "client_id" and "topic", and may be nil.
+	Start(ctx context.Context, name string, attrs map[string]interface{}) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// End ends the span. If err isn't nil then the span failed because of it.
+	End(err error)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) End(err error) {}
+
+// tracing is the Tracer of a server, shared by all its services.
+type tracing struct {
+	Tracer
+
+	// The contexts of the SpanFanout spans of the messages being handed to the
+	// subscribers right now, so the SpanDeliver spans can be their children. The
+	// subscribers are called one after the other by the publisher, so a message is
+	// only in here while that's going on. Protected by mu.
+	fanouts map[*message.PublishMessage]context.Context
+	mu      sync.Mutex
+}
+
+func newTracing(t Tracer) *tracing {
+	return &tracing{
+		Tracer:  t,
+		fanouts: make(map[*message.PublishMessage]context.Context),
+	}
+}
+
+// publishTrace is the SpanPublish of a QoS 2 message waiting for its PUBREL.
+type publishTrace struct {
+	ctx  context.Context
+	span Span
+}
+
+// startSpan starts a span with the server's Tracer, if it has one.
+func (this *service) startSpan(ctx context.Context, name string, attrs map[string]interface{}) (context.Context, Span) {
+	if this.tracing == nil {
+		return ctx, noopSpan{}
+	}
+
+	return this.tracing.Start(ctx, name, attrs)
+}
+
+// startPublish starts the SpanPublish of a message from the client. Its parent is
+// the span in the context returned by the TraceContext hooks, if any.
+func (this *service) startPublish(msg *message.PublishMessage) (context.Context, Span) {
+	if this.tracing == nil {
+		return context.Background(), noopSpan{}
+	}
+
+	return this.tracing.Start(this.hookTraceContext(msg), SpanPublish, map[string]interface{}{
+		"client_id":    this.info.ClientId,
+		"topic":        string(msg.Topic()),
+		"qos":          int(msg.QoS()),
+		"packet_id":    int(msg.PacketId()),
+		"payload_size": len(msg.Payload()),
+	})
+}
+
+// publishTraced publishes a message from the client to the subscribers, in its own
+// SpanPublish.
+func (this *service) publishTraced(msg *message.PublishMessage) error {
+	ctx, span := this.startPublish(msg)
+
+	err := this.onPublish(ctx, msg)
+	span.End(err)
+
+	return err
+}
+
+// waitTrace keeps the SpanPublish of a QoS 2 message until its PUBREL comes in.
+func (this *service) waitTrace(ctx context.Context, span Span, pktid uint16) {
+	if this.tracing == nil {
+		return
+	}
+
+	this.tmu.Lock()
+	defer this.tmu.Unlock()
+
+	if this.traces == nil {
+		this.traces = make(map[uint16]publishTrace)
+	}
+
+	this.traces[pktid] = publishTrace{ctx: ctx, span: span}
+}
+
+// releaseTrace returns the SpanPublish kept by waitTrace for a QoS 2 message, or a
+// new one if there's none, e.g., because the message was received on an earlier
+// connection.
+func (this *service) releaseTrace(msg *message.PublishMessage) (context.Context, Span) {
+	if this.tracing == nil {
+		return context.Background(), noopSpan{}
+	}
+
+	this.tmu.Lock()
+	t, ok := this.traces[msg.PacketId()]
+	delete(this.traces, msg.PacketId())
+	this.tmu.Unlock()
+
+	if !ok {
+		return this.startPublish(msg)
+	}
+
+	return t.ctx, t.span
+}
+
+// endTraces ends the spans of the QoS 2 messages still waiting for their PUBREL
+// once the connection is gone.
+func (this *service) endTraces() {
+	this.tmu.Lock()
+	defer this.tmu.Unlock()
+
+	for id, t := range this.traces {
+		t.span.End(ErrConnectionLost)
+		delete(this.traces, id)
+	}
+}
+
+// startFanout starts the SpanFanout of a message, and makes it the parent of the
+// SpanDeliver of each subscriber until the returned function is called.
+func (this *service) startFanout(ctx context.Context, msg *message.PublishMessage) func() {
+	if this.tracing == nil {
+		return func() {}
+	}
+
+	ctx, span := this.tracing.Start(ctx, SpanFanout, map[string]interface{}{
+		"subscribers": len(this.subs),
+	})
+
+	this.tracing.mu.Lock()
+	this.tracing.fanouts[msg] = ctx
+	this.tracing.mu.Unlock()
+
+	return func() {
+		this.tracing.mu.Lock()
+		delete(this.tracing.fanouts, msg)
+		this.tracing.mu.Unlock()
+
+		span.End(nil)
+	}
+}
+
+// startDeliver starts the SpanDeliver of a message about to be sent to the client,
+// and returns the OnCompleteFunc that ends it once the message is acked. It returns
+// nil and a noopSpan if the server has no Tracer.
+func (this *service) startDeliver(msg *message.PublishMessage) (Span, OnCompleteFunc) {
+	if this.tracing == nil {
+		return noopSpan{}, nil
+	}
+
+	this.tracing.mu.Lock()
+	ctx, ok := this.tracing.fanouts[msg]
+	this.tracing.mu.Unlock()
+
+	// Messages that are not being fanned out by a client, e.g., from a bridge or the
+	// cluster, get a span of their own.
+	if !ok {
+		ctx = context.Background()
+	}
+
+	_, span := this.tracing.Start(ctx, SpanDeliver, map[string]interface{}{
+		"client_id": this.info.ClientId,
+		"topic":     string(msg.Topic()),
+		"qos":       int(msg.QoS()),
+	})
+
+	return span, func(msg, ack message.Message, err error) error {
+		span.End(err)
+		return nil
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/topics"
+)
+
+// validateConnect checks the CONNECT message for the violations the message package
+// lets through. A zero length client ID is only allowed with a clean session, since
+// the ID the server assigns can't be used to pick the session up again.
+func validateConnect(req *message.ConnectMessage) error {
+	if len(req.ClientId()) == 0 && !req.CleanSession() {
+		return message.ErrIdentifierRejected
+	}
+
+	if req.WillFlag() {
+		if err := topics.ValidTopicName(req.WillTopic()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateIncoming checks the messages from the other end for the violations the
+// message package lets through. Lenient services only check the ones that can't be
+// recovered from, see Lenient.
+func (this *service) validateIncoming(msg message.Message) error {
+	// The reserved bits of the requested QoS byte must be 0
+	if msg, ok := msg.(*message.SubscribeMessage); ok {
+		for i, qos := range msg.Qos() {
+			if qos > message.QosExactlyOnce {
+				return fmt.Errorf("service/validateIncoming: Invalid requested QoS byte %#x for %q", qos, msg.Topics()[i])
+			}
+		}
+	}
+
+	if this.lenient {
+		return nil
+	}
+
+	switch msg := msg.(type) {
+	case *message.PublishMessage:
+		if err := topics.ValidTopicName(msg.Topic()); err != nil {
+			return err
+		}
+
+		if msg.QoS() == message.QosAtMostOnce {
+			if msg.Dup() {
+				return fmt.Errorf("service/validateIncoming: DUP flag set on QoS 0 PUBLISH")
+			}
+		} else if msg.PacketId() == 0 {
+			return fmt.Errorf("service/validateIncoming: QoS %d PUBLISH without a packet ID", msg.QoS())
+		}
+
+	case *message.SubscribeMessage:
+		if msg.PacketId() == 0 {
+			return fmt.Errorf("service/validateIncoming: SUBSCRIBE without a packet ID")
+		}
+
+		if len(msg.Topics()) == 0 {
+			return fmt.Errorf("service/validateIncoming: SUBSCRIBE without any topic filters")
+		}
+
+		for _, t := range msg.Topics() {
+			if err := topics.ValidTopicFilter(t); err != nil {
+				return err
+			}
+		}
+
+	case *message.UnsubscribeMessage:
+		if msg.PacketId() == 0 {
+			return fmt.Errorf("service/validateIncoming: UNSUBSCRIBE without a packet ID")
+		}
+
+		if len(msg.Topics()) == 0 {
+			return fmt.Errorf("service/validateIncoming: UNSUBSCRIBE without any topic filters")
+		}
+
+		for _, t := range msg.Topics() {
+			if err := topics.ValidTopicFilter(t); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,406 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logger"
+)
+
+// The events a Webhook can send.
+const (
+	WebhookConnect      = "connect"
+	WebhookDisconnect   = "disconnect"
+	WebhookSubscribe    = "subscribe"
+	WebhookPublish      = "publish"
+	WebhookSlowConsumer = "slow_consumer"
+)
+
+const (
+	DefaultWebhookBatchSize     = 100
+	DefaultWebhookFlushInterval = time.Second
+	DefaultWebhookMaxRetries    = 3
+	DefaultWebhookRetryBackoff  = time.Second
+	DefaultWebhookQueueSize     = 10000
+	DefaultWebhookTimeout       = time.Second * 5
+)
+
+// WebhookEvent is what a Webhook sends for each event, as JSON.
+type WebhookEvent struct {
+	// Event is the kind of event, e.g., WebhookConnect.
+	Event string `json:"event"`
+
+	// Time is when the event happened.
+	Time time.Time `json:"time"`
+
+	// The client the event is for.
+	ClientId   string `json:"client_id"`
+	Username   string `json:"username,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+
+	// The topic, or topic filter, and the QoS of subscribe and publish events, and
+	// whether the message is to be retained, for publish events.
+	Topic  string `json:"topic,omitempty"`
+	Qos    byte   `json:"qos,omitempty"`
+	Retain bool   `json:"retain,omitempty"`
+
+	// Payload is the payload of the message of publish events, if IncludePayload is
+	// set. It's base64 encoded in the JSON.
+	Payload []byte `json:"payload,omitempty"`
+
+	// Dropped is the number of QoS 0 messages dropped for the client, for
+	// slow_consumer events.
+	Dropped int64 `json:"dropped,omitempty"`
+}
+
+// Webhook POSTs the events of the server to one or more URLs, as JSON arrays of
+// WebhookEvent. Events are sent in batches, once BatchSize of them are waiting or
+// every FlushInterval, whichever comes first. A batch that can't be sent to a URL,
+// because of an error or a response status other than 2xx, is tried again up to
+// MaxRetries times, waiting twice as long each time, starting from RetryBackoff.
+// It's then dropped for that URL.
+//
+// Events are queued while they wait to be sent. If the URLs can't keep up and the
+// queue is full then new events are dropped, so the clients are never held up.
+type Webhook struct {
+	// URLs are where the events are sent. Each batch is sent to all of them.
+	URLs []string
+
+	// Events are the events to send, e.g., WebhookConnect. If not set then default to
+	// all of them except WebhookPublish.
+	Events []string
+
+	// PublishSampleRate is the fraction, from 0 to 1, of the publish events that are
+	// sent, picked at random. Only used if Events has WebhookPublish. If not set then
+	// default to 1, i.e., all of them.
+	PublishSampleRate float64
+
+	// IncludePayload, if set, sends the payload of the messages with publish events.
+	IncludePayload bool
+
+	// Header is added to every request, e.g., for an Authorization header.
+	Header http.Header
+
+	// The most events sent in one request, and how long events wait for a batch to
+	// fill up. If not set then default to 100 events and 1 second.
+	BatchSize     int
+	FlushInterval time.Duration
+
+	// The number of times to try sending a batch again, and how long to wait before
+	// the first retry. If not set then default to 3 retries and 1 second. If
+	// MaxRetries is negative then batches are not tried again.
+	MaxRetries   int
+	RetryBackoff time.Duration
+
+	// The most events waiting to be sent. If not set then default to 10000 events.
+	QueueSize int
+
+	// Client is the HTTP client the requests are sent with. If not set then default
+	// to a client with a 5 second timeout.
+	Client *http.Client
+
+	// The events to send, by kind
+	events map[string]bool
+
+	queue chan *WebhookEvent
+
+	log logger.Logger
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (this *Webhook) checkConfiguration() error {
+	if len(this.URLs) == 0 {
+		return fmt.Errorf("webhook/checkConfiguration: No URLs")
+	}
+
+	if len(this.Events) == 0 {
+		this.Events = []string{WebhookConnect, WebhookDisconnect, WebhookSubscribe, WebhookSlowConsumer}
+	}
+
+	this.events = make(map[string]bool)
+
+	for _, e := range this.Events {
+		switch e {
+		case WebhookConnect, WebhookDisconnect, WebhookSubscribe, WebhookPublish, WebhookSlowConsumer:
+			this.events[e] = true
+
+		default:
+			return fmt.Errorf("webhook/checkConfiguration: Unknown event %q", e)
+		}
+	}
+
+	if this.PublishSampleRate < 0 || this.PublishSampleRate > 1 {
+		return fmt.Errorf("webhook/checkConfiguration: Invalid publish sample rate %v", this.PublishSampleRate)
+	}
+
+	if this.PublishSampleRate == 0 {
+		this.PublishSampleRate = 1
+	}
+
+	if this.BatchSize == 0 {
+		this.BatchSize = DefaultWebhookBatchSize
+	}
+
+	if this.FlushInterval == 0 {
+		this.FlushInterval = DefaultWebhookFlushInterval
+	}
+
+	if this.MaxRetries == 0 {
+		this.MaxRetries = DefaultWebhookMaxRetries
+	}
+
+	if this.RetryBackoff == 0 {
+		this.RetryBackoff = DefaultWebhookRetryBackoff
+	}
+
+	if this.QueueSize == 0 {
+		this.QueueSize = DefaultWebhookQueueSize
+	}
+
+	if this.Client == nil {
+		this.Client = &http.Client{Timeout: DefaultWebhookTimeout}
+	}
+
+	return nil
+}
+
+// hooks returns the hooks that queue the events.
+func (this *Webhook) hooks() *Hooks {
+	h := &Hooks{}
+
+	if this.events[WebhookConnect] {
+		h.OnConnect = func(c *ClientInfo, msg *message.ConnectMessage) error {
+			this.add(this.newEvent(WebhookConnect, c))
+			return nil
+		}
+	}
+
+	if this.events[WebhookDisconnect] {
+		h.OnDisconnect = func(c *ClientInfo) {
+			this.add(this.newEvent(WebhookDisconnect, c))
+		}
+	}
+
+	if this.events[WebhookSlowConsumer] {
+		h.OnSlowConsumer = func(c *ClientInfo, dropped int64) {
+			e := this.newEvent(WebhookSlowConsumer, c)
+			e.Dropped = dropped
+
+			this.add(e)
+		}
+	}
+
+	if this.events[WebhookSubscribe] {
+		h.OnSubscribe = func(c *ClientInfo, topic []byte, qos byte) (byte, error) {
+			e := this.newEvent(WebhookSubscribe, c)
+			e.Topic = string(topic)
+			e.Qos = qos
+
+			this.add(e)
+			return qos, nil
+		}
+	}
+
+	if this.events[WebhookPublish] {
+		h.OnPublish = func(c *ClientInfo, msg *message.PublishMessage) (*message.PublishMessage, error) {
+			if this.PublishSampleRate < 1 && rand.Float64() >= this.PublishSampleRate {
+				return msg, nil
+			}
+
+			e := this.newEvent(WebhookPublish, c)
+			e.Topic = string(msg.Topic())
+			e.Qos = msg.QoS()
+			e.Retain = msg.Retain()
+
+			if this.IncludePayload {
+				e.Payload = append([]byte(nil), msg.Payload()...)
+			}
+
+			this.add(e)
+			return msg, nil
+		}
+	}
+
+	return h
+}
+
+func (this *Webhook) newEvent(event string, c *ClientInfo) *WebhookEvent {
+	e := &WebhookEvent{
+		Event:    event,
+		Time:     time.Now(),
+		ClientId: c.ClientId,
+		Username: c.Username,
+	}
+
+	if c.RemoteAddr != nil {
+		e.RemoteAddr = c.RemoteAddr.String()
+	}
+
+	return e
+}
+
+// add queues the event, or drops it if the queue is full.
+func (this *Webhook) add(e *WebhookEvent) {
+	select {
+	case this.queue <- e:
+
+	default:
+		this.log.Errorf("webhook/add: Queue is full, dropping %s event of %s", e.Event, e.ClientId)
+	}
+}
+
+func (this *Webhook) start(log logger.Logger) {
+	this.log = log
+	this.queue = make(chan *WebhookEvent, this.QueueSize)
+	this.quit = make(chan struct{})
+
+	this.wg.Add(1)
+	go this.sendLoop()
+}
+
+// stop sends the events still queued, then stops the webhook.
+func (this *Webhook) stop() {
+	if this.quit == nil {
+		return
+	}
+
+	select {
+	case <-this.quit:
+		return
+
+	default:
+	}
+
+	close(this.quit)
+	this.wg.Wait()
+}
+
+func (this *Webhook) sendLoop() {
+	defer this.wg.Done()
+
+	tick := time.NewTicker(this.FlushInterval)
+	defer tick.Stop()
+
+	batch := make([]*WebhookEvent, 0, this.BatchSize)
+
+	for {
+		select {
+		case e := <-this.queue:
+			if batch = append(batch, e); len(batch) < this.BatchSize {
+				continue
+			}
+
+		case <-tick.C:
+			if len(batch) == 0 {
+				continue
+			}
+
+		case <-this.quit:
+			// Send what's left before going. Nothing else takes from the queue, so
+			// it has at least n events in it.
+			for n := len(this.queue); n > 0; n-- {
+				if batch = append(batch, <-this.queue); len(batch) == this.BatchSize {
+					this.send(batch)
+					batch = batch[:0]
+				}
+			}
+
+			if len(batch) > 0 {
+				this.send(batch)
+			}
+
+			return
+		}
+
+		this.send(batch)
+		batch = batch[:0]
+	}
+}
+
+// send POSTs the batch to all the URLs, trying again if it fails. Once the webhook
+// is stopping, each URL only gets one more try.
+func (this *Webhook) send(batch []*WebhookEvent) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		this.log.Errorf("webhook/send: Error encoding %d events: %v", len(batch), err)
+		return
+	}
+
+	for _, u := range this.URLs {
+		backoff := this.RetryBackoff
+
+		for i := 0; ; i++ {
+			err := this.post(u, body)
+			if err == nil {
+				break
+			}
+
+			if i >= this.MaxRetries {
+				this.log.Errorf("webhook/send: Dropping %d events for %s: %v", len(batch), u, err)
+				break
+			}
+
+			this.log.Debugf("webhook/send: Error sending %d events to %s, trying again in %v: %v", len(batch), u, backoff, err)
+
+			timer := time.NewTimer(backoff)
+
+			select {
+			case <-timer.C:
+
+			case <-this.quit:
+				timer.Stop()
+				i = this.MaxRetries - 1
+			}
+
+			backoff *= 2
+		}
+	}
+}
+
+func (this *Webhook) post(u string, body []byte) error {
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	for k, v := range this.Header {
+		req.Header[k] = v
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := this.Client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected response status %q", resp.Status)
+	}
+
+	return nil
+}
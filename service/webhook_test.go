@@ -0,0 +1,196 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logger"
+)
+
+// webhookReceiver is an HTTP endpoint that keeps the batches of events it gets. The
+// first failures requests get a 500 response.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	batches  [][]*WebhookEvent
+	requests int
+	failures int
+	header   http.Header
+}
+
+func (this *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.requests++
+	this.header = r.Header
+
+	if this.requests <= this.failures {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var batch []*WebhookEvent
+
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	this.batches = append(this.batches, batch)
+}
+
+func (this *webhookReceiver) events() []*WebhookEvent {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var events []*WebhookEvent
+
+	for _, b := range this.batches {
+		events = append(events, b...)
+	}
+
+	return events
+}
+
+func TestWebhookConfiguration(t *testing.T) {
+	require.Error(t, (&Webhook{}).checkConfiguration())
+	require.Error(t, (&Webhook{URLs: []string{"http://localhost"}, Events: []string{"unknown"}}).checkConfiguration())
+	require.Error(t, (&Webhook{URLs: []string{"http://localhost"}, PublishSampleRate: 2}).checkConfiguration())
+
+	w := &Webhook{URLs: []string{"http://localhost"}}
+	require.NoError(t, w.checkConfiguration())
+	require.Equal(t, []string{WebhookConnect, WebhookDisconnect, WebhookSubscribe, WebhookSlowConsumer}, w.Events)
+	require.Equal(t, float64(1), w.PublishSampleRate)
+	require.Equal(t, DefaultWebhookBatchSize, w.BatchSize)
+	require.Equal(t, DefaultWebhookMaxRetries, w.MaxRetries)
+
+	h := w.hooks()
+	require.NotNil(t, h.OnConnect)
+	require.NotNil(t, h.OnSlowConsumer)
+	require.Nil(t, h.OnPublish)
+}
+
+// Events are sent BatchSize at a time, and whatever is left when the webhook stops.
+func TestWebhookBatch(t *testing.T) {
+	recv := &webhookReceiver{}
+
+	hs := httptest.NewServer(recv)
+	defer hs.Close()
+
+	w := &Webhook{
+		URLs:          []string{hs.URL},
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+	}
+	require.NoError(t, w.checkConfiguration())
+
+	w.start(logger.NewGlogLogger())
+
+	for i := 0; i < 5; i++ {
+		w.add(w.newEvent(WebhookConnect, &ClientInfo{ClientId: "c"}))
+	}
+
+	w.stop()
+
+	require.Equal(t, 3, len(recv.batches))
+	require.Equal(t, 2, len(recv.batches[0]))
+	require.Equal(t, 2, len(recv.batches[1]))
+	require.Equal(t, 1, len(recv.batches[2]))
+}
+
+func TestServerWebhook(t *testing.T) {
+	recv := &webhookReceiver{failures: 1}
+
+	hs := httptest.NewServer(recv)
+	defer hs.Close()
+
+	w := &Webhook{
+		URLs:           []string{hs.URL},
+		Events:         []string{WebhookConnect, WebhookDisconnect, WebhookSubscribe, WebhookPublish},
+		IncludePayload: true,
+		Header:         http.Header{"Authorization": []string{"Bearer xyz"}},
+		FlushInterval:  time.Millisecond * 10,
+		RetryBackoff:   time.Millisecond * 10,
+	}
+
+	svr, done := startNamedServer(t, "webhook", "tcp://127.0.0.1:1883", &Server{
+		Webhooks: []*Webhook{w},
+	})
+
+	// Make sure the server is up. Connections that don't get as far as CONNECT don't
+	// make any events.
+	for i := 0; i < 100; i++ {
+		if c, err := net.Dial("tcp", "127.0.0.1:1883"); err == nil {
+			c.Close()
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// Without a will, so it's not published when the connection is closed
+	cmsg := newConnectMessage()
+	cmsg.SetWillFlag(false)
+	cmsg.SetWillQos(0)
+
+	conn, _ := connectRawMessage(t, "tcp://127.0.0.1:1883", cmsg)
+
+	require.NoError(t, writeMessage(conn, newSubscribeMessage(1)))
+	expectMessage(t, conn, message.SUBACK)
+
+	require.NoError(t, writeMessage(conn, newPayloadMessage(0, 0, "hello")))
+	expectMessage(t, conn, message.PUBLISH)
+
+	conn.Close()
+
+	// The last events are sent before Close() returns
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+
+	events := recv.events()
+	require.Equal(t, 4, len(events))
+
+	require.Equal(t, WebhookConnect, events[0].Event)
+	require.NotEqual(t, "", events[0].ClientId)
+	require.Equal(t, "surgemq", events[0].Username)
+	require.NotEqual(t, "", events[0].RemoteAddr)
+
+	require.Equal(t, WebhookSubscribe, events[1].Event)
+	require.Equal(t, "abc", events[1].Topic)
+	require.Equal(t, byte(1), events[1].Qos)
+
+	require.Equal(t, WebhookPublish, events[2].Event)
+	require.Equal(t, "abc", events[2].Topic)
+	require.Equal(t, "hello", string(events[2].Payload))
+
+	require.Equal(t, WebhookDisconnect, events[3].Event)
+
+	for _, e := range events {
+		require.Equal(t, events[0].ClientId, e.ClientId)
+	}
+
+	require.True(t, recv.requests > len(recv.batches), "Expecting the failed request to be retried")
+	require.Equal(t, "Bearer xyz", recv.header.Get("Authorization"))
+	require.Equal(t, "application/json", recv.header.Get("Content-Type"))
+}
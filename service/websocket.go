@@ -0,0 +1,83 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/websocket"
+)
+
+// The WebSocket subprotocols MQTT clients ask for, in order of preference. "mqtt"
+// is what the MQTT 3.1.1 spec uses, "mqttv3.1" is from the older clients.
+var websocketProtocols = []string{"mqtt", "mqttv3.1"}
+
+// ListenAndServeWebsocket is like ListenAndServe, except that clients connect using
+// MQTT over WebSocket, e.g., from a browser. The URI supplied should be of the form
+// "ws://host:port/path", for example, "ws://0.0.0.0:8080/mqtt". If there's no path
+// then clients can connect on any path. It can run alongside ListenAndServe(), and
+// the clients from both can talk to each other. It should not return until Close()
+// is called or if there's some critical error that stops the server from running.
+func (this *Server) ListenAndServeWebsocket(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "ws" {
+		return fmt.Errorf("server/ListenAndServeWebsocket: Unsupported scheme %q, expecting \"ws\"", u.Scheme)
+	}
+
+	return this.listenAndServe(&Listener{URI: uri})
+}
+
+// handleWebsocket runs the MQTT session for a WebSocket connection. The connection
+// is closed as soon as this returns, so it waits until the session is over.
+func (this *Server) handleWebsocket(ws *websocket.Conn, l *Listener) {
+	// MQTT packets are sent in binary frames. A frame doesn't have to hold a whole
+	// packet, or just one, so the connection is read and written as a stream.
+	ws.PayloadType = websocket.BinaryFrame
+
+	svc, err := this.handleConnection(ws, l)
+	if err != nil {
+		this.log.Errorf("server/handleWebsocket: %v", err)
+		return
+	}
+
+	svc.wgStopped.Wait()
+}
+
+// websocketHandshake picks the MQTT subprotocol to use from the ones the client
+// asked for. Clients that don't ask for any are let in as well, but ones that only
+// ask for other subprotocols are not. The Origin is not checked since browser
+// clients can be served from anywhere.
+func websocketHandshake(config *websocket.Config, req *http.Request) error {
+	if len(config.Protocol) == 0 {
+		return nil
+	}
+
+	for _, p := range websocketProtocols {
+		for _, cp := range config.Protocol {
+			if p == cp {
+				config.Protocol = []string{p}
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("server/websocketHandshake: Unsupported subprotocol(s) %v", config.Protocol)
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"golang.org/x/net/websocket"
+)
+
+func dialWebsocket(t testing.TB, uri, protocol string) (*websocket.Conn, error) {
+	var (
+		ws  *websocket.Conn
+		err error
+	)
+
+	// Give the server a chance to start listening
+	for i := 0; i < 100; i++ {
+		if ws, err = websocket.Dial(uri, protocol, "http://localhost/"); err == nil {
+			ws.PayloadType = websocket.BinaryFrame
+			return ws, nil
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	return nil, err
+}
+
+// One client subscribes over WebSocket, the other publishes over plain TCP.
+func TestServiceWebsocket(t *testing.T) {
+	svr := &Server{
+		Authenticator: authenticator,
+	}
+
+	done := make(chan error, 2)
+
+	go func() {
+		done <- svr.ListenAndServe("tcp://127.0.0.1:1883")
+	}()
+
+	go func() {
+		done <- svr.ListenAndServeWebsocket("ws://127.0.0.1:1884/mqtt")
+	}()
+
+	ws, err := dialWebsocket(t, "ws://127.0.0.1:1884/mqtt", "mqtt")
+	require.NoError(t, err)
+	defer ws.Close()
+
+	require.Equal(t, []string{"mqtt"}, ws.Config().Protocol)
+
+	require.NoError(t, writeMessage(ws, newConnectMessage()))
+
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+
+	connack, err := getConnackMessage(ws, 0)
+	require.NoError(t, err)
+	require.Equal(t, message.ConnectionAccepted, connack.ReturnCode())
+
+	require.NoError(t, writeMessage(ws, newSubscribeMessage(1)))
+
+	buf, err := getMessageBuffer(ws)
+	require.NoError(t, err)
+	require.Equal(t, message.SUBACK, message.MessageType(buf[0]>>4))
+
+	conn := connectRaw(t, "tcp://127.0.0.1:1883")
+	defer conn.Close()
+
+	pub := newPublishMessageLarge(1, 1)
+	require.NoError(t, writeMessage(conn, pub))
+
+	buf, err = getMessageBuffer(conn)
+	require.NoError(t, err)
+	require.Equal(t, message.PUBACK, message.MessageType(buf[0]>>4))
+
+	buf, err = getMessageBuffer(ws)
+	require.NoError(t, err)
+
+	msg := message.NewPublishMessage()
+	_, err = msg.Decode(buf)
+	require.NoError(t, err)
+	require.Equal(t, pub.Payload(), msg.Payload())
+
+	ack := message.NewPubackMessage()
+	ack.SetPacketId(msg.PacketId())
+	require.NoError(t, writeMessage(ws, ack))
+
+	require.NoError(t, writeMessage(ws, message.NewPingreqMessage()))
+
+	buf, err = getMessageBuffer(ws)
+	require.NoError(t, err)
+	require.Equal(t, message.PINGRESP, message.MessageType(buf[0]>>4))
+
+	require.NoError(t, svr.Close())
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+
+		case <-time.After(time.Second):
+			require.FailNow(t, "Server did not stop listening")
+		}
+	}
+}
+
+func TestServiceWebsocketProtocol(t *testing.T) {
+	svr := &Server{
+		Authenticator: authenticator,
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- svr.ListenAndServeWebsocket("ws://127.0.0.1:1884/mqtt")
+	}()
+
+	ws, err := dialWebsocket(t, "ws://127.0.0.1:1884/mqtt", "mqttv3.1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"mqttv3.1"}, ws.Config().Protocol)
+	ws.Close()
+
+	_, err = websocket.Dial("ws://127.0.0.1:1884/mqtt", "chat", "http://localhost/")
+	require.Error(t, err)
+
+	require.NoError(t, svr.Close())
+	require.NoError(t, <-done)
+
+	require.Error(t, (&Server{}).ListenAndServeWebsocket("tcp://127.0.0.1:1884"))
+}
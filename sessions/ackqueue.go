@@ -21,6 +21,7 @@ import (
 	"sync"
 
 	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logger"
 )
 
 var (
@@ -78,7 +79,8 @@ type Ackqueue struct {
 	ring []ackmsg
 	emap map[uint16]int64
 
-	ackdone []ackmsg
+	// What the queue logs through, that of its session. If nil then default to glog.
+	log logger.Logger
 
 	mu sync.Mutex
 }
@@ -90,17 +92,33 @@ func newAckqueue(n int) *Ackqueue {
 	}
 
 	return &Ackqueue{
-		size:    m,
-		mask:    m - 1,
-		count:   0,
-		head:    0,
-		tail:    0,
-		ring:    make([]ackmsg, m),
-		emap:    make(map[uint16]int64, m),
-		ackdone: make([]ackmsg, 0),
+		size:  m,
+		mask:  m - 1,
+		count: 0,
+		head:  0,
+		tail:  0,
+		ring:  make([]ackmsg, m),
+		emap:  make(map[uint16]int64, m),
 	}
 }
 
+// setLogger sets the Logger the queue logs through.
+func (this *Ackqueue) setLogger(l logger.Logger) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.log = l
+}
+
+// logger returns what the queue logs through. Called with mu held.
+func (this *Ackqueue) logger() logger.Logger {
+	if this.log == nil {
+		return defaultLogger
+	}
+
+	return this.log
+}
+
 // Wait() copies the message into a waiting queue, and waits for the corresponding
 // ack message to be received.
 func (this *Ackqueue) Wait(msg message.Message, onComplete interface{}) error {
@@ -123,12 +141,18 @@ func (this *Ackqueue) Wait(msg message.Message, onComplete interface{}) error {
 		this.insert(msg.PacketId(), msg, onComplete)
 
 	case *message.PingreqMessage:
+		// Kept encoded, same as the other messages, so it can be decoded once acked
 		this.ping = ackmsg{
 			Mtype:      message.PINGREQ,
 			State:      message.RESERVED,
+			Msgbuf:     make([]byte, msg.Len()),
 			OnComplete: onComplete,
 		}
 
+		if _, err := msg.Encode(this.ping.Msgbuf); err != nil {
+			return err
+		}
+
 	default:
 		return errWaitMessage
 	}
@@ -137,6 +161,8 @@ func (this *Ackqueue) Wait(msg message.Message, onComplete interface{}) error {
 }
 
 // Ack() takes the ack message supplied and updates the status of messages waiting.
+// Acks that don't match any message waiting, e.g., a PUBACK for a message sent in a
+// session that has expired since, or one that's been retransmitted, are ignored.
 func (this *Ackqueue) Ack(msg message.Message) error {
 	this.mu.Lock()
 	defer this.mu.Unlock()
@@ -158,13 +184,20 @@ func (this *Ackqueue) Ack(msg message.Message) error {
 				return err
 			}
 			//glog.Debugf("Acked: %v", msg)
-			//} else {
-			//glog.Debugf("Cannot ack %s message with packet ID %d", msg.Type(), msg.PacketId())
+		} else {
+			this.logger().Debugf("ackqueue/Ack: Ignoring %s, no message waiting with packet ID %d", msg.Name(), msg.PacketId())
 		}
 
 	case message.PINGRESP:
 		if this.ping.Mtype == message.PINGREQ {
 			this.ping.State = message.PINGRESP
+
+			this.ping.Ackbuf = make([]byte, msg.Len())
+
+			_, err := msg.Encode(this.ping.Ackbuf)
+			if err != nil {
+				return err
+			}
 		}
 
 	default:
@@ -174,15 +207,17 @@ func (this *Ackqueue) Ack(msg message.Message) error {
 	return nil
 }
 
-// Acked() returns the list of messages that have completed the ack cycle.
+// Acked() returns the list of messages that have completed the ack cycle. The list
+// belongs to the caller, so it stays valid even if the queue is acked again, say by
+// another connection sharing the same session, while the caller goes through it.
 func (this *Ackqueue) Acked() []ackmsg {
 	this.mu.Lock()
 	defer this.mu.Unlock()
 
-	this.ackdone = this.ackdone[0:0]
+	var ackdone []ackmsg
 
 	if this.ping.State == message.PINGRESP {
-		this.ackdone = append(this.ackdone, this.ping)
+		ackdone = append(ackdone, this.ping)
 		this.ping = ackmsg{}
 	}
 
@@ -190,7 +225,7 @@ FORNOTEMPTY:
 	for !this.empty() {
 		switch this.ring[this.head].State {
 		case message.PUBACK, message.PUBREL, message.PUBCOMP, message.SUBACK, message.UNSUBACK:
-			this.ackdone = append(this.ackdone, this.ring[this.head])
+			ackdone = append(ackdone, this.ring[this.head])
 			this.removeHead()
 
 		default:
@@ -198,7 +233,69 @@ FORNOTEMPTY:
 		}
 	}
 
-	return this.ackdone
+	return ackdone
+}
+
+// Len() returns the number of messages still waiting for the ack cycle to complete.
+func (this *Ackqueue) Len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.len()
+}
+
+// Has() returns true if a message with the packet ID is in the queue.
+func (this *Ackqueue) Has(pktid uint16) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	_, ok := this.emap[pktid]
+	return ok
+}
+
+// Waiting() returns the messages still waiting for the ack cycle to complete, oldest
+// first, e.g., to send them again when the client reconnects. The list belongs to
+// the caller. OnComplete is not included.
+func (this *Ackqueue) Waiting() []ackmsg {
+	return this.messages()
+}
+
+// messages returns a copy of the messages still waiting for the ack cycle to
+// complete, oldest first. OnComplete is left out, so it's safe to persist them.
+func (this *Ackqueue) messages() []ackmsg {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	msgs := make([]ackmsg, 0, this.count)
+
+	for i, n := this.head, int64(0); n < this.count; i, n = this.increment(i), n+1 {
+		am := this.ring[i]
+		am.OnComplete = nil
+		msgs = append(msgs, am)
+	}
+
+	return msgs
+}
+
+// restore puts back messages returned by messages(), after a restart for example.
+func (this *Ackqueue) restore(msgs []ackmsg) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, am := range msgs {
+		if _, ok := this.emap[am.Pktid]; ok {
+			continue
+		}
+
+		if this.full() {
+			this.grow()
+		}
+
+		this.ring[this.tail] = am
+		this.emap[am.Pktid] = this.tail
+		this.tail = this.increment(this.tail)
+		this.count++
+	}
 }
 
 func (this *Ackqueue) insert(pktid uint16, msg message.Message, onComplete interface{}) error {
@@ -237,7 +334,7 @@ func (this *Ackqueue) insert(pktid uint16, msg message.Message, onComplete inter
 
 		// If this is a publish message, then the DUP flag must be set. This is the
 		// only scenario in which we will receive duplicate messages.
-		if pm.Dup() {
+		if !pm.Dup() {
 			return fmt.Errorf("ack/insert: duplicate packet ID for PUBLISH message, but DUP flag is not set")
 		}
 
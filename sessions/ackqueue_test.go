@@ -15,7 +15,10 @@
 package sessions
 
 import (
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/surgemq/message"
@@ -48,3 +51,122 @@ func TestAckQueueOutOfOrder(t *testing.T) {
 
 	require.Equal(t, 2, len(acked))
 }
+
+func TestAckQueueAckNotWaiting(t *testing.T) {
+	q := newAckqueue(5)
+
+	q.Wait(newPublishMessage(1, 1), nil)
+
+	ack := message.NewPubackMessage()
+	ack.SetPacketId(2)
+	require.NoError(t, q.Ack(ack))
+
+	require.Equal(t, 0, len(q.Acked()))
+	require.Equal(t, 1, q.Len())
+}
+
+func TestAckQueuePing(t *testing.T) {
+	q := newAckqueue(5)
+
+	require.NoError(t, q.Wait(message.NewPingreqMessage(), nil))
+	require.Equal(t, 0, len(q.Acked()))
+
+	require.NoError(t, q.Ack(message.NewPingrespMessage()))
+
+	acked := q.Acked()
+	require.Equal(t, 1, len(acked))
+
+	// The messages can be decoded, same as the other acked ones
+	msg, err := acked[0].Mtype.New()
+	require.NoError(t, err)
+	_, err = msg.Decode(acked[0].Msgbuf)
+	require.NoError(t, err)
+
+	ack, err := acked[0].State.New()
+	require.NoError(t, err)
+	_, err = ack.Decode(acked[0].Ackbuf)
+	require.NoError(t, err)
+
+	require.Equal(t, 0, len(q.Acked()))
+}
+
+// Two connections sharing the same session can both be going through the acked
+// messages at the same time. Each message should be handed out exactly once.
+func TestAckQueueAckedConcurrent(t *testing.T) {
+	const count = 1000
+
+	q := newAckqueue(16)
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		seen = make(map[uint16]int)
+	)
+
+	done := make(chan struct{})
+
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				acked := q.Acked()
+
+				for _, am := range acked {
+					runtime.Gosched()
+
+					mu.Lock()
+					seen[am.Pktid]++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for i := 1; i <= count; i++ {
+		require.NoError(t, q.Wait(newPublishMessage(uint16(i), 1), nil))
+
+		ack := message.NewPubackMessage()
+		ack.SetPacketId(uint16(i))
+		require.NoError(t, q.Ack(ack))
+
+		// Ack it again, as though it was retransmitted after the message is gone.
+		require.NoError(t, q.Ack(ack))
+	}
+
+	for i := 0; q.Len() > 0; i++ {
+		require.True(t, i < 100, "Acked messages were not all picked up")
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	close(done)
+	wg.Wait()
+
+	require.Equal(t, count, len(seen))
+
+	for pktid, n := range seen {
+		require.Equal(t, 1, n, "Packet ID %d acked %d times", pktid, n)
+	}
+}
+
+func TestAckQueueDuplicatePublish(t *testing.T) {
+	q := newAckqueue(4)
+
+	msg := newPublishMessage(7, 2)
+	require.NoError(t, q.Wait(msg, nil))
+
+	// Sent again by the client, it must have the DUP flag set
+	require.Error(t, q.insert(msg.PacketId(), msg, nil))
+
+	msg.SetDup(true)
+	require.NoError(t, q.Wait(msg, nil))
+
+	require.Equal(t, 1, q.Len())
+}
@@ -0,0 +1,246 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	_ SessionsProvider = (*boltProvider)(nil)
+	_ RangeProvider    = (*boltProvider)(nil)
+	_ LoggingProvider  = (*boltProvider)(nil)
+)
+
+var boltBucket = []byte("sessions")
+
+// boltProvider keeps the sessions in memory, same as memProvider, and writes them
+// to a BoltDB file so they survive a restart. Sessions are written when Save() is
+// called, every sync interval, and when the provider is closed. Clean sessions
+// only last as long as the connection, so they are never written.
+//
+// The offline queues are written along with the sessions. After a restart nothing
+// is queued for a client until it has reconnected, since the queues are not
+// subscribed to any topics again until then.
+type boltProvider struct {
+	st map[string]*Session
+	mu sync.RWMutex
+
+	db *bolt.DB
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+
+	providerLogger
+}
+
+// NewBoltProvider opens, or creates, the BoltDB file at path and loads the sessions
+// saved in it. If syncInterval is greater than 0, all the sessions are written out
+// that often, so not much is lost if the server doesn't shut down cleanly. It has
+// to be registered, e.g., Register("bolt", p), before a server can use it.
+func NewBoltProvider(path string, syncInterval time.Duration) (*boltProvider, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &boltProvider{
+		st:   make(map[string]*Session),
+		db:   db,
+		quit: make(chan struct{}),
+	}
+
+	if err := p.load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if syncInterval > 0 {
+		p.wg.Add(1)
+		go p.syncLoop(syncInterval)
+	}
+
+	return p, nil
+}
+
+func (this *boltProvider) New(id string) (*Session, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.st[id] = &Session{id: id}
+	return this.st[id], nil
+}
+
+func (this *boltProvider) Get(id string) (*Session, error) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	sess, ok := this.st[id]
+	if !ok {
+		return nil, fmt.Errorf("store/Get: No session found for key %s", id)
+	}
+
+	return sess, nil
+}
+
+func (this *boltProvider) Del(id string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	delete(this.st, id)
+
+	err := this.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(id))
+	})
+	if err != nil {
+		this.log().Errorf("store/Del: Error deleting session %s: %v", id, err)
+	}
+}
+
+func (this *boltProvider) Save(id string) error {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	sess, ok := this.st[id]
+	if !ok {
+		return fmt.Errorf("store/Save: No session found for key %s", id)
+	}
+
+	return this.save(map[string]*Session{id: sess})
+}
+
+func (this *boltProvider) Range(f func(sess *Session) bool) {
+	this.mu.RLock()
+	st := make([]*Session, 0, len(this.st))
+	for _, sess := range this.st {
+		st = append(st, sess)
+	}
+	this.mu.RUnlock()
+
+	for _, sess := range st {
+		if !f(sess) {
+			return
+		}
+	}
+}
+
+func (this *boltProvider) Count() int {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return len(this.st)
+}
+
+// Close writes out all the sessions and closes the BoltDB file.
+func (this *boltProvider) Close() error {
+	select {
+	case <-this.quit:
+		return nil
+
+	default:
+	}
+
+	close(this.quit)
+	this.wg.Wait()
+
+	err := this.sync()
+
+	if cerr := this.db.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// load reads all the saved sessions into memory.
+func (this *boltProvider) load() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(boltBucket)
+		if err != nil {
+			return err
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			sess := &Session{}
+
+			if err := sess.decode(v); err != nil {
+				return fmt.Errorf("store/load: Error decoding session %s: %v", string(k), err)
+			}
+
+			this.st[string(k)] = sess
+			return nil
+		})
+	})
+}
+
+func (this *boltProvider) syncLoop(d time.Duration) {
+	defer this.wg.Done()
+
+	tick := time.NewTicker(d)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-this.quit:
+			return
+
+		case <-tick.C:
+			if err := this.sync(); err != nil {
+				this.log().Errorf("store/syncLoop: %v", err)
+			}
+		}
+	}
+}
+
+// sync writes out all the sessions.
+func (this *boltProvider) sync() error {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return this.save(this.st)
+}
+
+// save writes the sessions in a single transaction. Sessions that are not ready
+// yet, or are clean sessions, are skipped. The caller must hold mu, so a session
+// that's being deleted doesn't get written back.
+func (this *boltProvider) save(sessions map[string]*Session) error {
+	return this.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+
+		for id, sess := range sessions {
+			v, err := sess.encode()
+			if err != nil {
+				this.log().Debugf("store/save: Skipping session %s: %v", id, err)
+				continue
+			}
+
+			if v == nil {
+				continue
+			}
+
+			if err := b.Put([]byte(id), v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
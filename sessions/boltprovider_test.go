@@ -0,0 +1,160 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoltProviderReopen(t *testing.T) {
+	path, cleanup := newBoltPath(t)
+	defer cleanup()
+
+	p, err := NewBoltProvider(path, 0)
+	require.NoError(t, err)
+
+	sess, err := p.New("surgemq")
+	require.NoError(t, err)
+
+	cmsg := newConnectMessage()
+	cmsg.SetCleanSession(false)
+	require.NoError(t, sess.Init(cmsg))
+
+	sess.AddTopic("abc", 1)
+	sess.AddTopic("xyz/#", 2)
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, sess.Pub1ack.Wait(newPublishMessage(uint16(i), 1), nil))
+	}
+
+	require.NoError(t, sess.Offline.Push(newPublishMessage(4, 1)))
+
+	require.NoError(t, p.Save("surgemq"))
+	require.NoError(t, p.Close())
+
+	p, err = NewBoltProvider(path, 0)
+	require.NoError(t, err)
+	defer p.Close()
+
+	require.Equal(t, 1, p.Count())
+
+	sess, err = p.Get("surgemq")
+	require.NoError(t, err)
+	require.Equal(t, "surgemq", sess.ID())
+	require.Equal(t, "surgemq", string(sess.Cmsg.ClientId()))
+	require.False(t, sess.Cmsg.CleanSession())
+
+	topics, qoss, err := sess.Topics()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(topics))
+	require.Equal(t, 2, len(qoss))
+
+	require.Equal(t, 3, sess.Pub1ack.Len())
+	require.Equal(t, 1, sess.Offline.Len())
+}
+
+func TestBoltProviderCleanSession(t *testing.T) {
+	path, cleanup := newBoltPath(t)
+	defer cleanup()
+
+	p, err := NewBoltProvider(path, 0)
+	require.NoError(t, err)
+
+	sess, err := p.New("surgemq")
+	require.NoError(t, err)
+	require.NoError(t, sess.Init(newConnectMessage()))
+
+	require.NoError(t, p.Save("surgemq"))
+	require.NoError(t, p.Close())
+
+	p, err = NewBoltProvider(path, 0)
+	require.NoError(t, err)
+	defer p.Close()
+
+	require.Equal(t, 0, p.Count())
+}
+
+func TestBoltProviderDel(t *testing.T) {
+	path, cleanup := newBoltPath(t)
+	defer cleanup()
+
+	p, err := NewBoltProvider(path, 0)
+	require.NoError(t, err)
+
+	sess, err := p.New("surgemq")
+	require.NoError(t, err)
+
+	cmsg := newConnectMessage()
+	cmsg.SetCleanSession(false)
+	require.NoError(t, sess.Init(cmsg))
+	require.NoError(t, p.Save("surgemq"))
+
+	p.Del("surgemq")
+	require.Equal(t, 0, p.Count())
+	require.Error(t, p.Save("surgemq"))
+	require.NoError(t, p.Close())
+
+	p, err = NewBoltProvider(path, 0)
+	require.NoError(t, err)
+	defer p.Close()
+
+	require.Equal(t, 0, p.Count())
+}
+
+func TestBoltProviderSyncLoop(t *testing.T) {
+	path, cleanup := newBoltPath(t)
+	defer cleanup()
+
+	p, err := NewBoltProvider(path, 10*time.Millisecond)
+	require.NoError(t, err)
+	defer p.Close()
+
+	sess, err := p.New("surgemq")
+	require.NoError(t, err)
+
+	cmsg := newConnectMessage()
+	cmsg.SetCleanSession(false)
+	require.NoError(t, sess.Init(cmsg))
+
+	saved := func() (ok bool) {
+		p.db.View(func(tx *bolt.Tx) error {
+			ok = tx.Bucket(boltBucket).Get([]byte("surgemq")) != nil
+			return nil
+		})
+		return
+	}
+
+	for i := 0; i < 100 && !saved(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	require.True(t, saved(), "Session was not written by the sync loop")
+}
+
+// newBoltPath returns a path for a BoltDB file in a new temp directory, and a func
+// that removes the directory.
+func newBoltPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "surgemq")
+	require.NoError(t, err)
+
+	return filepath.Join(dir, "sessions.db"), func() { os.RemoveAll(dir) }
+}
@@ -19,7 +19,10 @@ import (
 	"sync"
 )
 
-var _ SessionsProvider = (*memProvider)(nil)
+var (
+	_ SessionsProvider = (*memProvider)(nil)
+	_ RangeProvider    = (*memProvider)(nil)
+)
 
 func init() {
 	Register("mem", NewMemProvider())
@@ -66,7 +69,24 @@ func (this *memProvider) Save(id string) error {
 	return nil
 }
 
+func (this *memProvider) Range(f func(sess *Session) bool) {
+	this.mu.RLock()
+	st := make([]*Session, 0, len(this.st))
+	for _, sess := range this.st {
+		st = append(st, sess)
+	}
+	this.mu.RUnlock()
+
+	for _, sess := range st {
+		if !f(sess) {
+			return
+		}
+	}
+}
+
 func (this *memProvider) Count() int {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
 	return len(this.st)
 }
 
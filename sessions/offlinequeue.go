@@ -0,0 +1,270 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/surgemq/message"
+)
+
+var ErrOfflineQueueFull error = errors.New("Session: Offline queue full")
+
+// OverflowPolicy decides what an Offlinequeue does with a new message when it's full.
+type OverflowPolicy int
+
+const (
+	// DropOldest makes room for the new message by dropping the oldest one queued.
+	DropOldest OverflowPolicy = iota
+
+	// DropNewest keeps the messages already queued and drops the new one.
+	DropNewest
+
+	// Disconnect drops all the queued messages and the session along with them.
+	// When the client comes back it gets a new session, and finds out from the
+	// session present flag in the CONNACK that it has to subscribe again.
+	Disconnect
+)
+
+// Offlinequeue holds the QoS 1 and 2 PUBLISH messages sent to a client while it's
+// not connected, so they can be delivered when it reconnects. QoS 0 messages are
+// not queued.
+type Offlinequeue struct {
+	// The maximum number of messages queued. If 0 then there's no limit.
+	max int
+
+	policy OverflowPolicy
+
+	// Whether the queue overflowed with the Disconnect policy
+	overflowed bool
+
+	// The message bytes, oldest first, and when each of them expires. The expiry is
+	// the zero time for the messages that never do.
+	msgs    [][]byte
+	expires []time.Time
+
+	// How long each message is kept for. If nil, or it returns 0, then messages are
+	// kept until they are delivered.
+	ttl func(msg *message.PublishMessage) time.Duration
+
+	mu sync.Mutex
+}
+
+func newOfflinequeue() *Offlinequeue {
+	return &Offlinequeue{}
+}
+
+// SetLimit sets the maximum number of messages queued and what to do when there are
+// more than that. It only applies to messages queued afterwards.
+func (this *Offlinequeue) SetLimit(max int, policy OverflowPolicy) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.max = max
+	this.policy = policy
+}
+
+// SetTTL sets how long each message is kept for. Expired messages are not returned by
+// Pop(), and are removed by Expire(). It only applies to messages queued afterwards.
+func (this *Offlinequeue) SetTTL(ttl func(msg *message.PublishMessage) time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.ttl = ttl
+}
+
+// Push copies the message to the end of the queue. ErrOfflineQueueFull is returned
+// if a message had to be dropped, either this one or, with DropOldest, the oldest
+// one to make room for it. It's also returned if the queue has overflowed already
+// with the Disconnect policy.
+func (this *Offlinequeue) Push(msg *message.PublishMessage) error {
+	if msg.QoS() == message.QosAtMostOnce {
+		return nil
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.overflowed {
+		return ErrOfflineQueueFull
+	}
+
+	var dropped bool
+
+	if this.max > 0 && len(this.msgs) >= this.max {
+		switch this.policy {
+		case DropNewest:
+			return ErrOfflineQueueFull
+
+		case Disconnect:
+			this.overflowed = true
+			this.msgs = nil
+			this.expires = nil
+			return ErrOfflineQueueFull
+
+		default:
+			this.msgs[0] = nil
+			this.msgs = this.msgs[1:]
+			this.expires = this.expires[1:]
+			dropped = true
+		}
+	}
+
+	b := make([]byte, msg.Len())
+	if _, err := msg.Encode(b); err != nil {
+		return err
+	}
+
+	var expires time.Time
+
+	if this.ttl != nil {
+		if ttl := this.ttl(msg); ttl > 0 {
+			expires = time.Now().Add(ttl)
+		}
+	}
+
+	this.msgs = append(this.msgs, b)
+	this.expires = append(this.expires, expires)
+
+	if dropped {
+		return ErrOfflineQueueFull
+	}
+
+	return nil
+}
+
+// Pop removes all the messages from the queue and returns them, oldest first. The
+// messages that have expired are dropped instead.
+func (this *Offlinequeue) Pop() ([]*message.PublishMessage, error) {
+	return this.PopN(-1)
+}
+
+// PopN is like Pop, except it removes at most n messages, not counting the ones that
+// have expired. If n is negative then it removes them all.
+func (this *Offlinequeue) PopN(n int) ([]*message.PublishMessage, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if n < 0 || n > len(this.msgs) {
+		n = len(this.msgs)
+	}
+
+	msgs := make([]*message.PublishMessage, 0, n)
+	now := time.Now()
+
+	var i int
+
+	for ; i < len(this.msgs) && len(msgs) < n; i++ {
+		if expired(this.expires[i], now) {
+			continue
+		}
+
+		msg := message.NewPublishMessage()
+		if _, err := msg.Decode(this.msgs[i]); err != nil {
+			return nil, err
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	for j := 0; j < i; j++ {
+		this.msgs[j] = nil
+	}
+
+	this.msgs = this.msgs[i:]
+	this.expires = this.expires[i:]
+
+	if len(this.msgs) == 0 {
+		this.msgs = nil
+		this.expires = nil
+	}
+
+	return msgs, nil
+}
+
+// Expire removes the messages that have expired by now, and returns how many there
+// were.
+func (this *Offlinequeue) Expire(now time.Time) int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	n := 0
+
+	for i := range this.msgs {
+		if !expired(this.expires[i], now) {
+			this.msgs[n] = this.msgs[i]
+			this.expires[n] = this.expires[i]
+			n++
+		}
+	}
+
+	for i := n; i < len(this.msgs); i++ {
+		this.msgs[i] = nil
+	}
+
+	expd := len(this.msgs) - n
+
+	this.msgs = this.msgs[:n]
+	this.expires = this.expires[:n]
+
+	return expd
+}
+
+// Len returns the number of messages queued.
+func (this *Offlinequeue) Len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return len(this.msgs)
+}
+
+// Overflowed returns true if the queue overflowed with the Disconnect policy, in
+// which case the session should be discarded.
+func (this *Offlinequeue) Overflowed() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.overflowed
+}
+
+// messages returns a copy of the message bytes, and when they expire, for persisting
+// the queue.
+func (this *Offlinequeue) messages() ([][]byte, []time.Time, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return append([][]byte(nil), this.msgs...), append([]time.Time(nil), this.expires...), this.overflowed
+}
+
+// restore puts back the messages returned by messages(). Sessions persisted before
+// messages could expire have no expiries, so their messages never do.
+func (this *Offlinequeue) restore(msgs [][]byte, expires []time.Time, overflowed bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if len(expires) != len(msgs) {
+		expires = make([]time.Time, len(msgs))
+	}
+
+	this.msgs = msgs
+	this.expires = expires
+	this.overflowed = overflowed
+}
+
+func expired(expires, now time.Time) bool {
+	return !expires.IsZero() && !now.Before(expires)
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestOfflineQueueQos0(t *testing.T) {
+	q := newOfflinequeue()
+
+	require.NoError(t, q.Push(newPublishMessage(0, 0)))
+	require.Equal(t, 0, q.Len())
+}
+
+func TestOfflineQueueDropOldest(t *testing.T) {
+	q := newOfflinequeue()
+	q.SetLimit(3, DropOldest)
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, q.Push(newPublishMessage(uint16(i), 1)))
+	}
+
+	// The messages are still queued, but the oldest ones had to go
+	for i := 4; i <= 5; i++ {
+		require.Equal(t, ErrOfflineQueueFull, q.Push(newPublishMessage(uint16(i), 1)))
+	}
+
+	require.Equal(t, 3, q.Len())
+
+	msgs, err := q.Pop()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(msgs))
+
+	for i, msg := range msgs {
+		require.Equal(t, uint16(i+3), msg.PacketId())
+		require.Equal(t, "abc", string(msg.Topic()))
+	}
+
+	require.Equal(t, 0, q.Len())
+}
+
+func TestOfflineQueueDropNewest(t *testing.T) {
+	q := newOfflinequeue()
+	q.SetLimit(3, DropNewest)
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, q.Push(newPublishMessage(uint16(i), 2)))
+	}
+
+	require.Equal(t, ErrOfflineQueueFull, q.Push(newPublishMessage(4, 2)))
+
+	msgs, err := q.Pop()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(msgs))
+	require.Equal(t, uint16(1), msgs[0].PacketId())
+	require.Equal(t, uint16(3), msgs[2].PacketId())
+}
+
+func TestOfflineQueuePopN(t *testing.T) {
+	q := newOfflinequeue()
+
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, q.Push(newPublishMessage(uint16(i), 1)))
+	}
+
+	msgs, err := q.PopN(2)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(msgs))
+	require.Equal(t, uint16(1), msgs[0].PacketId())
+	require.Equal(t, uint16(2), msgs[1].PacketId())
+	require.Equal(t, 3, q.Len())
+
+	// Queued behind the ones left
+	require.NoError(t, q.Push(newPublishMessage(6, 1)))
+
+	msgs, err = q.PopN(10)
+	require.NoError(t, err)
+	require.Equal(t, 4, len(msgs))
+	require.Equal(t, uint16(3), msgs[0].PacketId())
+	require.Equal(t, uint16(6), msgs[3].PacketId())
+	require.Equal(t, 0, q.Len())
+}
+
+func TestOfflineQueueDisconnect(t *testing.T) {
+	q := newOfflinequeue()
+	q.SetLimit(2, Disconnect)
+
+	require.NoError(t, q.Push(newPublishMessage(1, 1)))
+	require.NoError(t, q.Push(newPublishMessage(2, 1)))
+	require.False(t, q.Overflowed())
+
+	require.Equal(t, ErrOfflineQueueFull, q.Push(newPublishMessage(3, 1)))
+	require.True(t, q.Overflowed())
+	require.Equal(t, 0, q.Len())
+
+	require.Equal(t, ErrOfflineQueueFull, q.Push(newPublishMessage(4, 1)))
+	require.Equal(t, 0, q.Len())
+}
+
+func TestOfflineQueueTTL(t *testing.T) {
+	q := newOfflinequeue()
+
+	// Messages for "abc" last a minute, the rest don't expire
+	q.SetTTL(func(msg *message.PublishMessage) time.Duration {
+		if string(msg.Topic()) == "abc" {
+			return time.Minute
+		}
+
+		return 0
+	})
+
+	require.NoError(t, q.Push(newPublishMessage(1, 1)))
+
+	msg := newPublishMessage(2, 1)
+	msg.SetTopic([]byte("def"))
+	require.NoError(t, q.Push(msg))
+
+	require.NoError(t, q.Push(newPublishMessage(3, 1)))
+
+	require.Equal(t, 0, q.Expire(time.Now()))
+	require.Equal(t, 3, q.Len())
+
+	// The expiries are kept along with the messages
+	msgs, expires, overflowed := q.messages()
+
+	q2 := newOfflinequeue()
+	q2.restore(msgs, expires, overflowed)
+
+	require.Equal(t, 2, q2.Expire(time.Now().Add(time.Minute)))
+	require.Equal(t, 1, q2.Len())
+
+	pmsgs, err := q2.Pop()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(pmsgs))
+	require.Equal(t, uint16(2), pmsgs[0].PacketId())
+
+	// Queues persisted without expiries never expire
+	q2.restore(msgs, nil, false)
+	require.Equal(t, 0, q2.Expire(time.Now().Add(time.Hour)))
+	require.Equal(t, 3, q2.Len())
+
+	// Messages that have expired are not popped, even before Expire() is called
+	q.SetTTL(func(msg *message.PublishMessage) time.Duration { return time.Nanosecond })
+	require.NoError(t, q.Push(newPublishMessage(4, 1)))
+	time.Sleep(time.Millisecond)
+
+	pmsgs, err = q.Pop()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(pmsgs))
+}
@@ -0,0 +1,316 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	_ SessionsProvider = (*redisProvider)(nil)
+	_ RangeProvider    = (*redisProvider)(nil)
+	_ LoggingProvider  = (*redisProvider)(nil)
+)
+
+// Deletes the session in KEYS[1] if its version is still ARGV[1]
+var redisDelVersion = redis.NewScript(1, `
+if redis.call("HGET", KEYS[1], "version") == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// DefaultRedisNamespace is what the Redis keys start with if no namespace is given.
+const DefaultRedisNamespace = "surgemq"
+
+// redisProvider keeps the sessions in Redis, so they can be shared by the servers
+// behind a load balancer. A client can connect to any of them and pick up its
+// session where it left off on another.
+//
+// Each server keeps the sessions of its clients in memory while they're connected,
+// same as memProvider, and writes them to Redis when Save() is called, which the
+// server does when the client goes away, and when the provider is closed. Each
+// session is kept in a hash, along with a version that goes up every time it's
+// saved, so Get() only loads it from Redis if another server has saved it since.
+// Clean sessions only last as long as the connection, so they are never written.
+//
+// The offline queue of a client is written along with its session, but it only
+// gets the messages published on the server the client was last connected to.
+type redisProvider struct {
+	st       map[string]*Session
+	versions map[string]int64
+	mu       sync.RWMutex
+
+	pool      *redis.Pool
+	namespace string
+	ttl       time.Duration
+
+	providerLogger
+}
+
+// NewRedisProvider returns a provider that keeps the sessions in the Redis server
+// the connections in pool are to. The keys all start with namespace, e.g., the name
+// of the cluster of servers, so different clusters can share a Redis server. If
+// it's empty then it's DefaultRedisNamespace. If ttl is greater than 0, sessions
+// are removed from Redis once they haven't been saved for that long, e.g., because
+// their client never came back. It has to be registered, e.g., Register("redis", p),
+// before a server can use it.
+//
+// The pool is not closed along with the provider, so it can be shared with the
+// retained message store, see topics.NewRedisStore.
+func NewRedisProvider(pool *redis.Pool, namespace string, ttl time.Duration) (*redisProvider, error) {
+	if namespace == "" {
+		namespace = DefaultRedisNamespace
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("PING"); err != nil {
+		return nil, err
+	}
+
+	return &redisProvider{
+		st:        make(map[string]*Session),
+		versions:  make(map[string]int64),
+		pool:      pool,
+		namespace: namespace,
+		ttl:       ttl,
+	}, nil
+}
+
+// New discards the session kept in Redis for the id, if any, since the client has
+// asked for a new one.
+func (this *redisProvider) New(id string) (*Session, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if err := this.del(id); err != nil {
+		return nil, err
+	}
+
+	this.st[id] = &Session{id: id}
+	delete(this.versions, id)
+
+	return this.st[id], nil
+}
+
+// Get returns the session kept in memory, unless it has been saved to Redis by
+// another server since this one last saw it. If Redis can't be reached, the one in
+// memory is returned if there's one.
+func (this *redisProvider) Get(id string) (*Session, error) {
+	version, data, err := this.load(id)
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	sess, ok := this.st[id]
+
+	if err != nil {
+		if !ok {
+			return nil, fmt.Errorf("store/Get: Error loading session %s: %v", id, err)
+		}
+
+		this.log().Errorf("store/Get: Error loading session %s, using the one in memory: %v", id, err)
+		return sess, nil
+	}
+
+	if data == nil || (ok && this.versions[id] == version) {
+		if !ok {
+			return nil, fmt.Errorf("store/Get: No session found for key %s", id)
+		}
+
+		return sess, nil
+	}
+
+	sess = &Session{}
+
+	if err := sess.decode(data); err != nil {
+		return nil, fmt.Errorf("store/Get: Error decoding session %s: %v", id, err)
+	}
+
+	this.st[id] = sess
+	this.versions[id] = version
+
+	return sess, nil
+}
+
+// Del removes the session from memory, and from Redis unless another server has
+// saved it since this one last did, e.g., because its client has moved on to it.
+func (this *redisProvider) Del(id string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	version, ok := this.versions[id]
+
+	delete(this.st, id)
+	delete(this.versions, id)
+
+	var err error
+
+	if ok {
+		err = this.delVersion(id, version)
+	} else {
+		err = this.del(id)
+	}
+
+	if err != nil {
+		this.log().Errorf("store/Del: Error deleting session %s: %v", id, err)
+	}
+}
+
+func (this *redisProvider) Save(id string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	sess, ok := this.st[id]
+	if !ok {
+		return fmt.Errorf("store/Save: No session found for key %s", id)
+	}
+
+	return this.save(id, sess)
+}
+
+func (this *redisProvider) Range(f func(sess *Session) bool) {
+	this.mu.RLock()
+	st := make([]*Session, 0, len(this.st))
+	for _, sess := range this.st {
+		st = append(st, sess)
+	}
+	this.mu.RUnlock()
+
+	for _, sess := range st {
+		if !f(sess) {
+			return
+		}
+	}
+}
+
+// Count returns the number of sessions kept in memory by this server.
+func (this *redisProvider) Count() int {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return len(this.st)
+}
+
+// Close writes out all the sessions kept in memory. The pool is left open.
+func (this *redisProvider) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var err error
+
+	for id, sess := range this.st {
+		if serr := this.save(id, sess); serr != nil && err == nil {
+			err = serr
+		}
+	}
+
+	this.st = make(map[string]*Session)
+	this.versions = make(map[string]int64)
+
+	return err
+}
+
+func (this *redisProvider) key(id string) string {
+	return this.namespace + ":session:" + id
+}
+
+// load reads the version and the encoded session from Redis. data is nil if there's
+// no session for the id.
+func (this *redisProvider) load(id string) (version int64, data []byte, err error) {
+	conn := this.pool.Get()
+	defer conn.Close()
+
+	vals, err := redis.Values(conn.Do("HMGET", this.key(id), "version", "data"))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(vals) != 2 || vals[1] == nil {
+		return 0, nil, nil
+	}
+
+	if version, err = redis.Int64(vals[0], nil); err != nil {
+		return 0, nil, err
+	}
+
+	data, err = redis.Bytes(vals[1], nil)
+	return version, data, err
+}
+
+// save writes the session to Redis and bumps its version, in a single transaction.
+// Sessions that are not ready yet, or are clean sessions, are skipped. The caller
+// must hold mu, so a session that's being deleted doesn't get written back.
+func (this *redisProvider) save(id string, sess *Session) error {
+	v, err := sess.encode()
+	if err != nil {
+		this.log().Debugf("store/save: Skipping session %s: %v", id, err)
+		return nil
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	conn := this.pool.Get()
+	defer conn.Close()
+
+	key := this.key(id)
+
+	conn.Send("MULTI")
+	conn.Send("HSET", key, "data", v)
+	conn.Send("HINCRBY", key, "version", 1)
+
+	if this.ttl > 0 {
+		conn.Send("PEXPIRE", key, int64(this.ttl/time.Millisecond))
+	} else {
+		conn.Send("PERSIST", key)
+	}
+
+	vals, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+
+	version, err := redis.Int64(vals[1], nil)
+	if err != nil {
+		return err
+	}
+
+	this.versions[id] = version
+
+	return nil
+}
+
+func (this *redisProvider) del(id string) error {
+	conn := this.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", this.key(id))
+	return err
+}
+
+func (this *redisProvider) delVersion(id string, version int64) error {
+	conn := this.pool.Get()
+	defer conn.Close()
+
+	_, err := redisDelVersion.Do(conn, this.key(id), version)
+	return err
+}
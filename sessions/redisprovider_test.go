@@ -0,0 +1,209 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisProviderShared(t *testing.T) {
+	pool, ns, cleanup := newRedisPool(t)
+	defer cleanup()
+
+	p1, err := NewRedisProvider(pool, ns, 0)
+	require.NoError(t, err)
+	defer p1.Close()
+
+	p2, err := NewRedisProvider(pool, ns, 0)
+	require.NoError(t, err)
+	defer p2.Close()
+
+	sess, err := p1.New("surgemq")
+	require.NoError(t, err)
+
+	cmsg := newConnectMessage()
+	cmsg.SetCleanSession(false)
+	require.NoError(t, sess.Init(cmsg))
+
+	sess.AddTopic("abc", 1)
+	require.NoError(t, sess.Pub1ack.Wait(newPublishMessage(1, 1), nil))
+	require.NoError(t, p1.Save("surgemq"))
+
+	// The client moves to the other server
+	sess2, err := p2.Get("surgemq")
+	require.NoError(t, err)
+	require.Equal(t, "surgemq", sess2.ID())
+	require.False(t, sess2.Cmsg.CleanSession())
+	require.Equal(t, 1, sess2.Pub1ack.Len())
+
+	sess2.AddTopic("xyz/#", 2)
+	require.NoError(t, p2.Save("surgemq"))
+
+	// And back, where the session in memory is out of date
+	sess1, err := p1.Get("surgemq")
+	require.NoError(t, err)
+	require.True(t, sess1 != sess)
+
+	topics, _, err := sess1.Topics()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(topics))
+
+	// It's only loaded again once it's changed
+	sess3, err := p1.Get("surgemq")
+	require.NoError(t, err)
+	require.True(t, sess1 == sess3)
+
+	// The server the client left doesn't remove the session from under the other
+	require.NoError(t, p1.Save("surgemq"))
+	p2.Del("surgemq")
+
+	_, err = p2.Get("surgemq")
+	require.NoError(t, err)
+}
+
+func TestRedisProviderCleanSession(t *testing.T) {
+	pool, ns, cleanup := newRedisPool(t)
+	defer cleanup()
+
+	p1, err := NewRedisProvider(pool, ns, 0)
+	require.NoError(t, err)
+	defer p1.Close()
+
+	p2, err := NewRedisProvider(pool, ns, 0)
+	require.NoError(t, err)
+	defer p2.Close()
+
+	sess, err := p1.New("surgemq")
+	require.NoError(t, err)
+	require.NoError(t, sess.Init(newConnectMessage()))
+	require.NoError(t, p1.Save("surgemq"))
+
+	_, err = p1.Get("surgemq")
+	require.NoError(t, err)
+
+	_, err = p2.Get("surgemq")
+	require.Error(t, err)
+}
+
+func TestRedisProviderDel(t *testing.T) {
+	pool, ns, cleanup := newRedisPool(t)
+	defer cleanup()
+
+	p1, err := NewRedisProvider(pool, ns, 0)
+	require.NoError(t, err)
+	defer p1.Close()
+
+	p2, err := NewRedisProvider(pool, ns, 0)
+	require.NoError(t, err)
+	defer p2.Close()
+
+	for _, del := range []func(){
+		func() { p1.Del("surgemq") },
+
+		// A new session replaces the saved one
+		func() { p1.New("surgemq") },
+	} {
+		sess, err := p1.New("surgemq")
+		require.NoError(t, err)
+
+		cmsg := newConnectMessage()
+		cmsg.SetCleanSession(false)
+		require.NoError(t, sess.Init(cmsg))
+		require.NoError(t, p1.Save("surgemq"))
+
+		del()
+
+		_, err = p2.Get("surgemq")
+		require.Error(t, err)
+	}
+}
+
+func TestRedisProviderTTL(t *testing.T) {
+	pool, ns, cleanup := newRedisPool(t)
+	defer cleanup()
+
+	p1, err := NewRedisProvider(pool, ns, 50*time.Millisecond)
+	require.NoError(t, err)
+	defer p1.Close()
+
+	p2, err := NewRedisProvider(pool, ns, 50*time.Millisecond)
+	require.NoError(t, err)
+	defer p2.Close()
+
+	sess, err := p1.New("surgemq")
+	require.NoError(t, err)
+
+	cmsg := newConnectMessage()
+	cmsg.SetCleanSession(false)
+	require.NoError(t, sess.Init(cmsg))
+	require.NoError(t, p1.Save("surgemq"))
+
+	_, err = p2.Get("surgemq")
+	require.NoError(t, err)
+
+	p2.Del("surgemq")
+	require.NoError(t, p1.Save("surgemq"))
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = p2.Get("surgemq")
+	require.Error(t, err)
+}
+
+// newRedisPool returns a pool of connections to the Redis server at $SURGEMQ_REDIS,
+// or localhost, a namespace of its own for the test, and a func that removes the
+// keys in the namespace and closes the pool. The test is skipped if there's no
+// Redis server.
+func newRedisPool(t *testing.T) (*redis.Pool, string, func()) {
+	addr := os.Getenv("SURGEMQ_REDIS")
+	if addr == "" {
+		addr = "127.0.0.1:6379"
+	}
+
+	pool := &redis.Pool{
+		MaxIdle: 4,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("PING"); err != nil {
+		pool.Close()
+		t.Skipf("No Redis server at %s: %v", addr, err)
+	}
+
+	ns := fmt.Sprintf("surgemq-test-%d", time.Now().UnixNano())
+
+	return pool, ns, func() {
+		conn := pool.Get()
+
+		keys, _ := redis.Strings(conn.Do("KEYS", ns+":*"))
+		for _, k := range keys {
+			conn.Do("DEL", k)
+		}
+
+		conn.Close()
+		pool.Close()
+	}
+}
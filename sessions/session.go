@@ -15,10 +15,15 @@
 package sessions
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
+	"math"
 	"sync"
+	"time"
 
 	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logger"
 )
 
 const (
@@ -45,6 +50,9 @@ type Session struct {
 	// Ack queue for outgoing PINGREQ messages
 	Pingack *Ackqueue
 
+	// Queue for PUBLISH messages sent to the client while it's disconnected
+	Offline *Offlinequeue
+
 	// cmsg is the CONNECT message
 	Cmsg *message.ConnectMessage
 
@@ -63,9 +71,21 @@ type Session struct {
 	// topics stores all the topis for this session/client
 	topics map[string]byte
 
+	// The last packet ID used for a PUBLISH message sent to the client
+	pktid uint16
+
 	// Initialized?
 	initted bool
 
+	// When the session expires once its client has gone away, the zero time if it
+	// doesn't, and whether it has expired. See Expire.
+	expires time.Time
+	expired bool
+
+	// What the session's ack queues log through. If nil then default to glog. See
+	// SetLogger.
+	log logger.Logger
+
 	// Serialize access to this session
 	mu sync.Mutex
 
@@ -109,12 +129,151 @@ func (this *Session) Init(msg *message.ConnectMessage) error {
 	this.Suback = newAckqueue(defaultQueueSize)
 	this.Unsuback = newAckqueue(defaultQueueSize)
 	this.Pingack = newAckqueue(defaultQueueSize)
+	this.Offline = newOfflinequeue()
+
+	this.setLogger()
 
 	this.initted = true
 
 	return nil
 }
 
+// SetLogger sets the Logger the session logs through, e.g., that of the server the
+// client is connected to. If not set then default to glog.
+func (this *Session) SetLogger(l logger.Logger) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.log = l
+	this.setLogger()
+}
+
+// setLogger passes the session's Logger on to its ack queues. Called with mu held.
+func (this *Session) setLogger() {
+	if this.log == nil {
+		return
+	}
+
+	for _, q := range []*Ackqueue{this.Pub1ack, this.Pub2in, this.Pub2out, this.Suback, this.Unsuback, this.Pingack} {
+		if q != nil {
+			q.setLogger(this.log)
+		}
+	}
+}
+
+// The parts of the session that are persisted by the disk backed providers
+type sessionState struct {
+	Cbuf    []byte
+	Rbuf    []byte
+	Topics  map[string]byte
+	Pub1ack []ackmsg
+	Pub2in  []ackmsg
+	Pub2out []ackmsg
+	Offline [][]byte
+
+	// When the messages in the offline queue expire
+	OfflineExpires []time.Time
+
+	// Whether the offline queue overflowed with the Disconnect policy
+	Overflowed bool
+
+	// When the session expires, if it does
+	Expires time.Time
+}
+
+// encode serializes the session so it can be restored with decode(), e.g., after
+// a restart. Only the CONNECT message, the retained message, the subscribed topics,
+// the QoS 1 and 2 PUBLISH messages waiting for acks and the offline queue are kept.
+// Clean sessions must not outlast the connection, so nothing is returned for them.
+func (this *Session) encode() ([]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if !this.initted {
+		return nil, fmt.Errorf("Session not yet initialized")
+	}
+
+	if this.Cmsg.CleanSession() {
+		return nil, nil
+	}
+
+	st := sessionState{
+		Cbuf:    this.cbuf,
+		Rbuf:    this.rbuf,
+		Topics:  this.topics,
+		Pub1ack: this.Pub1ack.messages(),
+		Pub2in:  this.Pub2in.messages(),
+		Pub2out: this.Pub2out.messages(),
+		Expires: this.expires,
+	}
+
+	st.Offline, st.OfflineExpires, st.Overflowed = this.Offline.messages()
+
+	var buf bytes.Buffer
+
+	if err := gob.NewEncoder(&buf).Encode(&st); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decode initializes the session from the bytes returned by encode().
+func (this *Session) decode(b []byte) error {
+	var st sessionState
+
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&st); err != nil {
+		return err
+	}
+
+	cmsg := message.NewConnectMessage()
+	if _, err := cmsg.Decode(st.Cbuf); err != nil {
+		return err
+	}
+
+	if err := this.Init(cmsg); err != nil {
+		return err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if len(st.Rbuf) > 0 {
+		this.rbuf = st.Rbuf
+		this.Retained = message.NewPublishMessage()
+
+		if _, err := this.Retained.Decode(this.rbuf); err != nil {
+			return err
+		}
+	}
+
+	for k, v := range st.Topics {
+		this.topics[k] = v
+	}
+
+	this.expires = st.Expires
+
+	this.Pub1ack.restore(st.Pub1ack)
+	this.Pub2in.restore(st.Pub2in)
+	this.Pub2out.restore(st.Pub2out)
+	this.Offline.restore(st.Offline, st.OfflineExpires, st.Overflowed)
+
+	return nil
+}
+
+// MarshalBinary returns the session the same way the disk backed providers keep
+// it, so it can be handed over to another server. Nothing is returned for clean
+// sessions.
+func (this *Session) MarshalBinary() ([]byte, error) {
+	return this.encode()
+}
+
+// UnmarshalBinary initializes the session from the bytes returned by MarshalBinary().
+// The session must not have been initialized yet.
+func (this *Session) UnmarshalBinary(b []byte) error {
+	return this.decode(b)
+}
+
 func (this *Session) Update(msg *message.ConnectMessage) error {
 	this.mu.Lock()
 	defer this.mu.Unlock()
@@ -198,6 +357,91 @@ func (this *Session) Topics() ([]string, []byte, error) {
 	return topics, qoss, nil
 }
 
+// NextPacketId returns the packet ID to use for the next QoS 1 or 2 PUBLISH message
+// sent to the client. IDs of messages still waiting for acks in Pub1ack or Pub2out
+// are skipped, so an ack from the client can only ever match one message.
+func (this *Session) NextPacketId() uint16 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for i := 0; i < math.MaxUint16; i++ {
+		this.pktid++
+		if this.pktid == 0 {
+			this.pktid = 1
+		}
+
+		if !this.Pub1ack.Has(this.pktid) && !this.Pub2out.Has(this.pktid) {
+			break
+		}
+	}
+
+	return this.pktid
+}
+
+// ExpireOffline removes the messages in the offline queue that have expired by now,
+// and returns how many there were.
+func (this *Session) ExpireOffline(now time.Time) int {
+	this.mu.Lock()
+	q := this.Offline
+	this.mu.Unlock()
+
+	if q == nil {
+		return 0
+	}
+
+	return q.Expire(now)
+}
+
+// SetExpiry sets when the session expires, once its client has gone away. The zero
+// time means it never does.
+func (this *Session) SetExpiry(t time.Time) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.expires = t
+}
+
+// Expiry returns when the session expires, or the zero time if it doesn't.
+func (this *Session) Expiry() time.Time {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.expires
+}
+
+// Expire marks the session as expired if its expiry has passed by now, and returns
+// whether it did. Once expired, the session can't be resumed, and should be removed
+// from the provider.
+func (this *Session) Expire(now time.Time) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.expired || this.expires.IsZero() || now.Before(this.expires) {
+		return false
+	}
+
+	this.expired = true
+
+	return true
+}
+
+// Resume clears the expiry of the session as its client comes back. It returns false
+// if the session has expired already, in which case the client gets a new one.
+func (this *Session) Resume() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.expired {
+		return false
+	}
+
+	this.expires = time.Time{}
+
+	return true
+}
+
+// ID returns the client ID. It doesn't change when the session is resumed, so it's
+// safe to call while the CONNECT message is being replaced with Update().
 func (this *Session) ID() string {
-	return string(this.Cmsg.ClientId())
+	return this.id
 }
@@ -16,9 +16,11 @@ package sessions
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logger"
 )
 
 func TestSessionInit(t *testing.T) {
@@ -54,6 +56,23 @@ func TestSessionInit(t *testing.T) {
 	require.Equal(t, 0, len(sess.topics))
 }
 
+func TestSessionSetLogger(t *testing.T) {
+	sess := &Session{}
+	l := logger.NewGlogLogger().With("client", "test")
+
+	// Before and after the queues are created
+	sess.SetLogger(l)
+	require.NoError(t, sess.Init(newConnectMessage()))
+
+	for _, q := range []*Ackqueue{sess.Pub1ack, sess.Pub2in, sess.Pub2out, sess.Suback, sess.Unsuback, sess.Pingack} {
+		require.Equal(t, l, q.log)
+	}
+
+	l = logger.NewGlogLogger()
+	sess.SetLogger(l)
+	require.Equal(t, l, sess.Pub1ack.log)
+}
+
 func TestSessionPublishAckqueue(t *testing.T) {
 	sess := &Session{}
 	cmsg := newConnectMessage()
@@ -106,3 +125,53 @@ func newPublishMessage(pktid uint16, qos byte) *message.PublishMessage {
 
 	return msg
 }
+
+func TestSessionNextPacketId(t *testing.T) {
+	sess := &Session{}
+	require.NoError(t, sess.Init(newConnectMessage()))
+
+	require.Equal(t, uint16(1), sess.NextPacketId())
+
+	// IDs still waiting for acks are skipped
+	require.NoError(t, sess.Pub1ack.Wait(newPublishMessage(2, 1), nil))
+	require.NoError(t, sess.Pub2out.Wait(newPublishMessage(3, 2), nil))
+	require.Equal(t, uint16(4), sess.NextPacketId())
+
+	// 0 is not a valid packet ID
+	sess.pktid = 65535
+	require.Equal(t, uint16(1), sess.NextPacketId())
+}
+
+func TestSessionExpire(t *testing.T) {
+	sess := &Session{}
+
+	cmsg := newConnectMessage()
+	cmsg.SetCleanSession(false)
+	require.NoError(t, sess.Init(cmsg))
+
+	now := time.Now()
+
+	// Sessions without an expiry never expire
+	require.False(t, sess.Expire(now.Add(time.Hour)))
+
+	sess.SetExpiry(now.Add(time.Minute))
+	require.False(t, sess.Expire(now))
+
+	// The expiry is kept along with the session
+	b, err := sess.MarshalBinary()
+	require.NoError(t, err)
+
+	sess2 := &Session{}
+	require.NoError(t, sess2.UnmarshalBinary(b))
+	require.True(t, sess2.Expiry().Equal(now.Add(time.Minute)))
+
+	// The client came back in time
+	require.True(t, sess2.Resume())
+	require.True(t, sess2.Expiry().IsZero())
+	require.False(t, sess2.Expire(now.Add(time.Hour)))
+
+	// It didn't
+	require.True(t, sess.Expire(now.Add(time.Minute)))
+	require.False(t, sess.Expire(now.Add(time.Minute)))
+	require.False(t, sess.Resume())
+}
@@ -20,13 +20,22 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync"
+
+	"github.com/surgemq/surgemq/logger"
 )
 
 var (
 	ErrSessionsProviderNotFound = errors.New("Session: Session provider not found")
 	ErrKeyNotAvailable          = errors.New("Session: not item found for key.")
+	ErrRangeNotSupported        = errors.New("Session: Session provider does not support going through the sessions")
+
+	providers   = make(map[string]SessionsProvider)
+	providersMu sync.RWMutex
 
-	providers = make(map[string]SessionsProvider)
+	// What the providers and the sessions log through, unless they're given a Logger
+	// of their own
+	defaultLogger logger.Logger = logger.NewGlogLogger().With(logger.Subsystem, "sessions")
 )
 
 type SessionsProvider interface {
@@ -38,6 +47,22 @@ type SessionsProvider interface {
 	Close() error
 }
 
+// RangeProvider is implemented by session providers that can go through all the
+// sessions they keep, e.g., to clean them up.
+type RangeProvider interface {
+	// Range calls f with each of the sessions until f returns false. The provider is
+	// not locked while f is called, so f can add and remove sessions.
+	Range(f func(sess *Session) bool)
+}
+
+// LoggingProvider is implemented by session providers that log, so they can log
+// through the Logger of the server using them.
+type LoggingProvider interface {
+	// SetLogger sets the Logger the provider logs through. If not set then default
+	// to glog.
+	SetLogger(l logger.Logger)
+}
+
 // Register makes a session provider available by the provided name.
 // If a Register is called twice with the same name or if the driver is nil,
 // it panics.
@@ -46,6 +71,9 @@ func Register(name string, provider SessionsProvider) {
 		panic("session: Register provide is nil")
 	}
 
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
 	if _, dup := providers[name]; dup {
 		panic("session: Register called twice for provider " + name)
 	}
@@ -54,15 +82,45 @@ func Register(name string, provider SessionsProvider) {
 }
 
 func Unregister(name string) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
 	delete(providers, name)
 }
 
+// providerLogger implements LoggingProvider for the providers it's embedded in.
+type providerLogger struct {
+	l   logger.Logger
+	lmu sync.RWMutex
+}
+
+func (this *providerLogger) SetLogger(l logger.Logger) {
+	this.lmu.Lock()
+	defer this.lmu.Unlock()
+
+	this.l = l
+}
+
+func (this *providerLogger) log() logger.Logger {
+	this.lmu.RLock()
+	defer this.lmu.RUnlock()
+
+	if this.l == nil {
+		return defaultLogger
+	}
+
+	return this.l
+}
+
 type Manager struct {
 	p SessionsProvider
 }
 
 func NewManager(providerName string) (*Manager, error) {
+	providersMu.RLock()
 	p, ok := providers[providerName]
+	providersMu.RUnlock()
+
 	if !ok {
 		return nil, fmt.Errorf("session: unknown provider %q", providerName)
 	}
@@ -93,6 +151,23 @@ func (this *Manager) Count() int {
 	return this.p.Count()
 }
 
+// SetLogger sets the Logger the provider logs through, if it's a LoggingProvider.
+func (this *Manager) SetLogger(l logger.Logger) {
+	if p, ok := this.p.(LoggingProvider); ok {
+		p.SetLogger(l)
+	}
+}
+
+// Range calls f with each of the sessions until f returns false.
+func (this *Manager) Range(f func(sess *Session) bool) error {
+	if p, ok := this.p.(RangeProvider); ok {
+		p.Range(f)
+		return nil
+	}
+
+	return ErrRangeNotSupported
+}
+
 func (this *Manager) Close() error {
 	return this.p.Close()
 }
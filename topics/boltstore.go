@@ -0,0 +1,153 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/surgemq/message"
+)
+
+var (
+	_ RetainedStore = (*boltStore)(nil)
+	_ ExpiringStore = (*boltStore)(nil)
+)
+
+var (
+	boltBucket = []byte("retained")
+
+	// When the retained messages expire, by topic, for the ones that do. It's kept
+	// apart from the messages so files written before messages could expire can
+	// still be read.
+	boltExpiresBucket = []byte("expires")
+)
+
+// boltStore is a RetainedStore, and an ExpiringStore, that keeps the retained
+// messages in a BoltDB file, keyed by topic. Every change is written out before it's applied in memory, so
+// nothing that a publisher was told about is lost if the server doesn't shut down
+// cleanly.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens, or creates, the BoltDB file at path for keeping retained
+// messages in. It should be handed to a server as its RetainedStore, or to
+// Manager.SetRetainedStore().
+func NewBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltBucket); err != nil {
+			return err
+		}
+
+		_, err := tx.CreateBucketIfNotExists(boltExpiresBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+func (this *boltStore) Load(f func(msg *message.PublishMessage) error) error {
+	return this.LoadUntil(func(msg *message.PublishMessage, expires time.Time) error {
+		return f(msg)
+	})
+}
+
+func (this *boltStore) LoadUntil(f func(msg *message.PublishMessage, expires time.Time) error) error {
+	return this.db.View(func(tx *bolt.Tx) error {
+		eb := tx.Bucket(boltExpiresBucket)
+
+		return tx.Bucket(boltBucket).ForEach(func(k, v []byte) error {
+			// The values are only good for the life of the transaction, and the
+			// decoded message points into the buffer, so decode from a copy.
+			buf := make([]byte, len(v))
+			copy(buf, v)
+
+			msg := message.NewPublishMessage()
+
+			if _, err := msg.Decode(buf); err != nil {
+				return fmt.Errorf("store/Load: Error decoding retained message %s: %v", string(k), err)
+			}
+
+			var expires time.Time
+
+			if ev := eb.Get(k); ev != nil {
+				if err := expires.UnmarshalBinary(ev); err != nil {
+					return fmt.Errorf("store/Load: Error decoding expiry of retained message %s: %v", string(k), err)
+				}
+			}
+
+			return f(msg, expires)
+		})
+	})
+}
+
+func (this *boltStore) Put(msg *message.PublishMessage) error {
+	return this.PutUntil(msg, time.Time{})
+}
+
+func (this *boltStore) PutUntil(msg *message.PublishMessage, expires time.Time) error {
+	buf := make([]byte, msg.Len())
+
+	if _, err := msg.Encode(buf); err != nil {
+		return err
+	}
+
+	var ebuf []byte
+
+	if !expires.IsZero() {
+		var err error
+
+		if ebuf, err = expires.MarshalBinary(); err != nil {
+			return err
+		}
+	}
+
+	return this.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltBucket).Put(msg.Topic(), buf); err != nil {
+			return err
+		}
+
+		if ebuf == nil {
+			return tx.Bucket(boltExpiresBucket).Delete(msg.Topic())
+		}
+
+		return tx.Bucket(boltExpiresBucket).Put(msg.Topic(), ebuf)
+	})
+}
+
+func (this *boltStore) Del(topic []byte) error {
+	return this.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltExpiresBucket).Delete(topic); err != nil {
+			return err
+		}
+
+		return tx.Bucket(boltBucket).Delete(topic)
+	})
+}
+
+func (this *boltStore) Close() error {
+	return this.db.Close()
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestBoltStoreReopen(t *testing.T) {
+	path, cleanup := newBoltPath(t)
+	defer cleanup()
+
+	s, err := NewBoltStore(path)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Put(newRetainedMessage("sport/tennis/ricardo/stats", "42")))
+	require.NoError(t, s.Put(newRetainedMessage("sport/golf", "7")))
+	require.NoError(t, s.Put(newRetainedMessage("sport/golf", "8")))
+	require.NoError(t, s.Put(newRetainedMessage("weather", "sunny")))
+	require.NoError(t, s.Del([]byte("weather")))
+	require.NoError(t, s.Del([]byte("nothing/here")))
+	require.NoError(t, s.Close())
+
+	s, err = NewBoltStore(path)
+	require.NoError(t, err)
+	defer s.Close()
+
+	msgs := make(map[string]string)
+
+	err = s.Load(func(msg *message.PublishMessage) error {
+		msgs[string(msg.Topic())] = string(msg.Payload())
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, map[string]string{
+		"sport/tennis/ricardo/stats": "42",
+		"sport/golf":                 "8",
+	}, msgs)
+}
+
+func TestMemTopicsRetainedStore(t *testing.T) {
+	path, cleanup := newBoltPath(t)
+	defer cleanup()
+
+	p := NewMemProvider()
+
+	s, err := NewBoltStore(path)
+	require.NoError(t, err)
+	require.NoError(t, p.SetRetainedStore(s))
+
+	require.NoError(t, p.Retain(newRetainedMessage("sport/tennis/ricardo/stats", "42")))
+	require.NoError(t, p.Retain(newRetainedMessage("sport/golf", "7")))
+
+	// A payload of 0 removes the retained message
+	require.NoError(t, p.Retain(newRetainedMessage("sport/golf", "")))
+
+	// Closing the provider closes the store, and the messages are only in the file
+	require.NoError(t, p.Close())
+
+	var msglist []*message.PublishMessage
+
+	require.NoError(t, p.Retained([]byte("#"), &msglist))
+	require.Equal(t, 0, len(msglist))
+
+	s, err = NewBoltStore(path)
+	require.NoError(t, err)
+	require.NoError(t, p.SetRetainedStore(s))
+	defer p.Close()
+
+	require.NoError(t, p.Retained([]byte("sport/#"), &msglist))
+	require.Equal(t, 1, len(msglist))
+	require.Equal(t, "sport/tennis/ricardo/stats", string(msglist[0].Topic()))
+	require.Equal(t, "42", string(msglist[0].Payload()))
+}
+
+func TestMemTopicsRetainedStoreExpiry(t *testing.T) {
+	path, cleanup := newBoltPath(t)
+	defer cleanup()
+
+	p := NewMemProvider()
+
+	s, err := NewBoltStore(path)
+	require.NoError(t, err)
+	require.NoError(t, p.SetRetainedStore(s))
+
+	now := time.Now()
+
+	require.NoError(t, p.RetainUntil(newRetainedMessage("sport/golf", "7"), now.Add(time.Hour)))
+	require.NoError(t, p.RetainUntil(newRetainedMessage("sport/tennis", "42"), now.Add(-time.Second)))
+	require.NoError(t, p.Retain(newRetainedMessage("weather", "sunny")))
+	require.NoError(t, p.Close())
+
+	// The expiry is kept in the file
+	s, err = NewBoltStore(path)
+	require.NoError(t, err)
+	require.NoError(t, p.SetRetainedStore(s))
+
+	n, err := p.Expire(now)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.NoError(t, p.Close())
+
+	s, err = NewBoltStore(path)
+	require.NoError(t, err)
+	defer s.Close()
+
+	msgs := make(map[string]time.Time)
+
+	err = s.LoadUntil(func(msg *message.PublishMessage, expires time.Time) error {
+		msgs[string(msg.Topic())] = expires
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, 2, len(msgs))
+	require.True(t, msgs["sport/golf"].Equal(now.Add(time.Hour)))
+	require.True(t, msgs["weather"].IsZero())
+}
+
+func newRetainedMessage(topic, payload string) *message.PublishMessage {
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte(topic))
+	msg.SetPayload([]byte(payload))
+	msg.SetRetain(true)
+
+	return msg
+}
+
+func newBoltPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "surgemq")
+	require.NoError(t, err)
+
+	return filepath.Join(dir, "retained.db"), func() { os.RemoveAll(dir) }
+}
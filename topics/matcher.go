@@ -0,0 +1,502 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/surgemq/message"
+)
+
+// errRemoved is returned by insert() when it gets to an snode that was taken out of
+// the tree while it was on its way there. The insert is started again from the root.
+var errRemoved = errors.New("memtopics/insert: Node removed")
+
+// Matcher is the subscription tree of the memory topics provider. It's exported so
+// other providers, e.g., ones that keep the subscriptions somewhere else as well,
+// can match topics the same way. It's safe to use from multiple goroutines.
+//
+// Each node in the tree has its own lock, and at most one of them is held at a
+// time, so matching a topic only ever waits for a subscribe or unsubscribe to the
+// same node. At each level only the nodes for the topic level, "+" and "#" are
+// looked at, however many other nodes there are.
+type Matcher struct {
+	root *snode
+
+	// Creates the Balancer for each new shared subscription group
+	bmu         sync.RWMutex
+	newBalancer NewBalancerFunc
+}
+
+// NewMatcher returns an empty Matcher. Shared subscription groups use the round
+// robin balancer until SetBalancer is called.
+func NewMatcher() *Matcher {
+	return &Matcher{
+		root:        newSNode(),
+		newBalancer: NewRoundRobinBalancer,
+	}
+}
+
+// Subscribe adds the subscriber to the topic filter, which can be a shared
+// subscription. It returns the QoS granted.
+func (this *Matcher) Subscribe(topic []byte, qos byte, sub interface{}) (byte, error) {
+	if !message.ValidQos(qos) {
+		return message.QosFailure, fmt.Errorf("Invalid QoS %d", qos)
+	}
+
+	if sub == nil {
+		return message.QosFailure, fmt.Errorf("Subscriber cannot be nil")
+	}
+
+	if qos > MaxQosAllowed {
+		qos = MaxQosAllowed
+	}
+
+	var group *sgroupKey
+
+	if IsShared(topic) {
+		name, filter, err := SplitShared(topic)
+		if err != nil {
+			return message.QosFailure, err
+		}
+
+		this.bmu.RLock()
+		group = &sgroupKey{name, this.newBalancer}
+		this.bmu.RUnlock()
+
+		topic = filter
+	}
+
+	for {
+		err := this.root.insert(topic, group, qos, sub)
+		if err == errRemoved {
+			continue
+		}
+
+		if err != nil {
+			return message.QosFailure, err
+		}
+
+		return qos, nil
+	}
+}
+
+// Unsubscribe takes the subscriber off the topic filter. If sub is nil then all the
+// subscribers are.
+func (this *Matcher) Unsubscribe(topic []byte, sub interface{}) error {
+	if IsShared(topic) {
+		name, filter, err := SplitShared(topic)
+		if err != nil {
+			return err
+		}
+
+		return this.root.remove(filter, &sgroupKey{name, nil}, sub)
+	}
+
+	return this.root.sremove(topic, sub)
+}
+
+// Subscribers appends the subscribers to the topic, and the QoS to send the message
+// at to each of them, to subs and qoss.
+func (this *Matcher) Subscribers(topic []byte, qos byte, subs *[]interface{}, qoss *[]byte) error {
+	if !message.ValidQos(qos) {
+		return fmt.Errorf("Invalid QoS %d", qos)
+	}
+
+	return this.root.smatch(topic, qos, subs, qoss)
+}
+
+// SetBalancer changes the Balancer used by shared subscription groups created from
+// now on. Existing groups keep theirs.
+func (this *Matcher) SetBalancer(f NewBalancerFunc) {
+	this.bmu.Lock()
+	defer this.bmu.Unlock()
+
+	this.newBalancer = f
+}
+
+// Stats adds the number of nodes, not counting the root, and subscriptions to st.
+func (this *Matcher) Stats(st *Stats) {
+	this.root.sstats(st)
+	st.Nodes--
+}
+
+// Reset takes all the subscriptions out of the tree.
+func (this *Matcher) Reset() {
+	this.root.mu.Lock()
+	defer this.root.mu.Unlock()
+
+	for _, n := range this.root.snodes {
+		n.mu.Lock()
+		n.removed = true
+		n.mu.Unlock()
+	}
+
+	this.root.subs = nil
+	this.root.qos = nil
+	this.root.sgroups = nil
+	this.root.snodes = make(map[string]*snode)
+}
+
+// subscrition nodes
+type snode struct {
+	// Guards everything below. Locks are only ever taken from the root down, and
+	// insert() and smatch() hold one at a time.
+	mu sync.RWMutex
+
+	// If this is the end of the topic string, then add subscribers here
+	subs []interface{}
+	qos  []byte
+
+	// Shared subscription groups for the topic filter ending here, by group name
+	sgroups map[string]*sgroup
+
+	// Otherwise add the next topic level here
+	snodes map[string]*snode
+
+	// Whether this has been taken out of the tree, because it was empty
+	removed bool
+}
+
+// sgroup is a shared subscription group. Each message goes to one subscriber only.
+type sgroup struct {
+	subs []interface{}
+	qos  []byte
+	bal  Balancer
+}
+
+// sgroupKey says which shared subscription group insert() and remove() are for,
+// and how to create its Balancer if it doesn't exist yet.
+type sgroupKey struct {
+	name        string
+	newBalancer NewBalancerFunc
+}
+
+func newSNode() *snode {
+	return &snode{
+		snodes: make(map[string]*snode),
+	}
+}
+
+func (this *snode) sinsert(topic []byte, qos byte, sub interface{}) error {
+	return this.insert(topic, nil, qos, sub)
+}
+
+// insert adds the subscriber to the snode for the topic, or to the shared
+// subscription group there if group is not nil. It returns errRemoved if one of the
+// snodes it went through was taken out of the tree in the meantime.
+func (this *snode) insert(topic []byte, group *sgroupKey, qos byte, sub interface{}) error {
+	this.mu.Lock()
+
+	if this.removed {
+		this.mu.Unlock()
+		return errRemoved
+	}
+
+	// If there's no more topic levels, that means we are at the matching snode
+	// to insert the subscriber. So let's see if there's such subscriber,
+	// if so, update it. Otherwise insert it.
+	if len(topic) == 0 {
+		defer this.mu.Unlock()
+
+		if group != nil {
+			return this.insertShared(group, qos, sub)
+		}
+
+		// Let's see if the subscriber is already on the list. If yes, update
+		// QoS and then return.
+		for i := range this.subs {
+			if equal(this.subs[i], sub) {
+				this.qos[i] = qos
+				return nil
+			}
+		}
+
+		// Otherwise add.
+		this.subs = append(this.subs, sub)
+		this.qos = append(this.qos, qos)
+
+		return nil
+	}
+
+	// Not the last level, so let's find or create the next level snode, and
+	// recursively call it's insert().
+
+	// ntl = next topic level
+	ntl, rem, err := nextTopicLevel(topic)
+	if err != nil {
+		this.mu.Unlock()
+		return err
+	}
+
+	level := string(ntl)
+
+	// Add snode if it doesn't already exist
+	n, ok := this.snodes[level]
+	if !ok {
+		n = newSNode()
+		this.snodes[level] = n
+	}
+
+	this.mu.Unlock()
+
+	return n.insert(rem, group, qos, sub)
+}
+
+func (this *snode) insertShared(group *sgroupKey, qos byte, sub interface{}) error {
+	if this.sgroups == nil {
+		this.sgroups = make(map[string]*sgroup)
+	}
+
+	g, ok := this.sgroups[group.name]
+	if !ok {
+		g = &sgroup{bal: group.newBalancer()}
+		this.sgroups[group.name] = g
+	}
+
+	for i := range g.subs {
+		if equal(g.subs[i], sub) {
+			g.qos[i] = qos
+			return nil
+		}
+	}
+
+	g.subs = append(g.subs, sub)
+	g.qos = append(g.qos, qos)
+
+	return nil
+}
+
+// This remove implementation ignores the QoS, as long as the subscriber
+// matches then it's removed
+func (this *snode) sremove(topic []byte, sub interface{}) error {
+	return this.remove(topic, nil, sub)
+}
+
+// remove takes the subscriber off the snode for the topic, or off the shared
+// subscription group there if group is not nil.
+func (this *snode) remove(topic []byte, group *sgroupKey, sub interface{}) error {
+	// If the topic is empty, it means we are at the final matching snode. If so,
+	// let's find the matching subscribers and remove them.
+	if len(topic) == 0 {
+		this.mu.Lock()
+		defer this.mu.Unlock()
+
+		if group != nil {
+			return this.removeShared(group, sub)
+		}
+
+		// If subscriber == nil, then it's signal to remove ALL subscribers
+		if sub == nil {
+			this.subs = this.subs[0:0]
+			this.qos = this.qos[0:0]
+			return nil
+		}
+
+		// If we find the subscriber then remove it from the list. Technically
+		// we just overwrite the slot by shifting all other items up by one.
+		for i := range this.subs {
+			if equal(this.subs[i], sub) {
+				this.subs = append(this.subs[:i], this.subs[i+1:]...)
+				this.qos = append(this.qos[:i], this.qos[i+1:]...)
+				return nil
+			}
+		}
+
+		return fmt.Errorf("memtopics/remove: No topic found for subscriber")
+	}
+
+	// Not the last level, so let's find the next level snode, and recursively
+	// call it's remove().
+
+	// ntl = next topic level
+	ntl, rem, err := nextTopicLevel(topic)
+	if err != nil {
+		return err
+	}
+
+	level := string(ntl)
+
+	// Find the snode that matches the topic level
+	this.mu.RLock()
+	n, ok := this.snodes[level]
+	this.mu.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("memtopics/remove: No topic found")
+	}
+
+	// Remove the subscriber from the next level snode
+	if err := n.remove(rem, group, sub); err != nil {
+		return err
+	}
+
+	// If there are no more subscribers and snodes to the next level we just visited
+	// let's remove it. Someone may have subscribed there since, or removed it
+	// already, so check again with both locked.
+	this.mu.Lock()
+	n.mu.Lock()
+
+	if this.snodes[level] == n && n.empty() {
+		delete(this.snodes, level)
+		n.removed = true
+	}
+
+	n.mu.Unlock()
+	this.mu.Unlock()
+
+	return nil
+}
+
+// removeShared takes the subscriber out of the group, or all of them if sub is nil.
+// The group goes away with its last subscriber.
+func (this *snode) removeShared(group *sgroupKey, sub interface{}) error {
+	g, ok := this.sgroups[group.name]
+	if !ok {
+		return fmt.Errorf("memtopics/remove: No shared subscription group %q found", group.name)
+	}
+
+	if sub == nil {
+		delete(this.sgroups, group.name)
+		return nil
+	}
+
+	for i := range g.subs {
+		if equal(g.subs[i], sub) {
+			g.subs = append(g.subs[:i], g.subs[i+1:]...)
+			g.qos = append(g.qos[:i], g.qos[i+1:]...)
+
+			if len(g.subs) == 0 {
+				delete(this.sgroups, group.name)
+			}
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("memtopics/remove: No topic found for subscriber")
+}
+
+func (this *snode) empty() bool {
+	return len(this.subs) == 0 && len(this.sgroups) == 0 && len(this.snodes) == 0
+}
+
+// smatch() returns all the subscribers that are subscribed to the topic. Given a topic
+// with no wildcards (publish topic), it returns a list of subscribers that subscribes
+// to the topic. For each of the level names, it's a match
+// - if there are subscribers to '#', then all the subscribers are added to result set
+// - if there are subscribers to '+', or to the level name, the next levels are matched
+func (this *snode) smatch(topic []byte, qos byte, subs *[]interface{}, qoss *[]byte) error {
+	// If the topic is empty, it means we are at the final matching snode. If so,
+	// let's find the subscribers that match the qos and append them to the list.
+	if len(topic) == 0 {
+		this.mu.RLock()
+		this.matchQos(qos, subs, qoss)
+		this.mu.RUnlock()
+
+		return nil
+	}
+
+	// ntl = next topic level
+	ntl, rem, err := nextTopicLevel(topic)
+	if err != nil {
+		return err
+	}
+
+	level := string(ntl)
+
+	this.mu.RLock()
+	mwc := this.snodes[MWC]
+	swc := this.snodes[SWC]
+	n := this.snodes[level]
+	this.mu.RUnlock()
+
+	// If the key is "#", then these subscribers are added to the result set
+	if mwc != nil {
+		mwc.mu.RLock()
+		mwc.matchQos(qos, subs, qoss)
+		mwc.mu.RUnlock()
+	}
+
+	if swc != nil {
+		if err := swc.smatch(rem, qos, subs, qoss); err != nil {
+			return err
+		}
+	}
+
+	if n != nil && n != swc {
+		if err := n.smatch(rem, qos, subs, qoss); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *snode) sstats(st *Stats) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	st.Nodes++
+	st.Subscriptions += len(this.subs)
+
+	for _, g := range this.sgroups {
+		st.Subscriptions += len(g.subs)
+	}
+
+	for _, n := range this.snodes {
+		n.sstats(st)
+	}
+}
+
+// The QoS of the payload messages sent in response to a subscription must be the
+// minimum of the QoS of the originally published message (in this case, it's the
+// qos parameter) and the maximum QoS granted by the server (in this case, it's
+// the QoS in the topic tree).
+//
+// It's also possible that even if the topic matches, the subscriber is not included
+// due to the QoS granted is lower than the published message QoS. For example,
+// if the client is granted only QoS 0, and the publish message is QoS 1, then this
+// client is not to be send the published message.
+//
+// For each shared subscription group, only one of the subscribers that would be
+// included is, as picked by the group's Balancer.
+func (this *snode) matchQos(qos byte, subs *[]interface{}, qoss *[]byte) {
+	for i, sub := range this.subs {
+		// If the published QoS is higher than the subscriber QoS, then we skip the
+		// subscriber. Otherwise, add to the list.
+		if qos <= this.qos[i] {
+			*subs = append(*subs, sub)
+			*qoss = append(*qoss, qos)
+		}
+	}
+
+	for _, g := range this.sgroups {
+		var members []interface{}
+
+		for i, sub := range g.subs {
+			if qos <= g.qos[i] {
+				members = append(members, sub)
+			}
+		}
+
+		if len(members) > 0 {
+			*subs = append(*subs, members[g.bal.Pick(members)])
+			*qoss = append(*qoss, qos)
+		}
+	}
+}
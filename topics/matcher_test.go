@@ -0,0 +1,218 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatcher(t *testing.T) {
+	m := NewMatcher()
+
+	_, err := m.Subscribe([]byte("sensors/+/temp"), 1, "sub1")
+	require.NoError(t, err)
+
+	_, err = m.Subscribe([]byte("sensors/#"), 0, "sub2")
+	require.NoError(t, err)
+
+	_, err = m.Subscribe([]byte("sensors/kitchen/temp"), 2, "sub3")
+	require.NoError(t, err)
+
+	_, err = m.Subscribe([]byte("$share/workers/sensors/kitchen/+"), 1, "sub4")
+	require.NoError(t, err)
+
+	qos, err := m.Subscribe([]byte("sensors/+/temp"), 3, "sub5")
+	require.Error(t, err)
+	require.Equal(t, byte(0x80), qos)
+
+	var subs []interface{}
+	var qoss []byte
+
+	err = m.Subscribers([]byte("sensors/kitchen/temp"), 1, &subs, &qoss)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(subs))
+	require.Contains(t, subs, "sub1")
+	require.Contains(t, subs, "sub3")
+	require.Contains(t, subs, "sub4")
+
+	subs, qoss = subs[0:0], qoss[0:0]
+
+	err = m.Subscribers([]byte("sensors/garage/temp"), 0, &subs, &qoss)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(subs))
+	require.Contains(t, subs, "sub1")
+	require.Contains(t, subs, "sub2")
+
+	var st Stats
+	m.Stats(&st)
+	require.Equal(t, 7, st.Nodes)
+	require.Equal(t, 4, st.Subscriptions)
+
+	// The nodes left empty are taken out of the tree
+	require.NoError(t, m.Unsubscribe([]byte("sensors/kitchen/temp"), "sub3"))
+	require.NoError(t, m.Unsubscribe([]byte("$share/workers/sensors/kitchen/+"), "sub4"))
+	require.Error(t, m.Unsubscribe([]byte("sensors/kitchen/temp"), "sub3"))
+
+	st = Stats{}
+	m.Stats(&st)
+	require.Equal(t, 4, st.Nodes)
+	require.Equal(t, 2, st.Subscriptions)
+
+	m.Reset()
+
+	st = Stats{}
+	m.Stats(&st)
+	require.Equal(t, Stats{}, st)
+}
+
+// Subscribing, unsubscribing and matching at the same time, on the same parts of
+// the tree, never loses a subscription.
+func TestMatcherConcurrent(t *testing.T) {
+	m := NewMatcher()
+
+	_, err := m.Subscribe([]byte("a/+/c"), 1, "static")
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			sub := fmt.Sprintf("sub%d", i)
+			filter := []byte(fmt.Sprintf("a/%d/c", i%2))
+
+			for j := 0; j < 1000; j++ {
+				if _, err := m.Subscribe(filter, 1, sub); err != nil {
+					t.Error(err)
+					return
+				}
+
+				var subs []interface{}
+				var qoss []byte
+
+				if err := m.Subscribers(filter, 1, &subs, &qoss); err != nil {
+					t.Error(err)
+					return
+				}
+
+				found := 0
+				for _, s := range subs {
+					if s == sub || s == "static" {
+						found++
+					}
+				}
+
+				if found != 2 {
+					t.Errorf("Expecting %s and static in %v", sub, subs)
+					return
+				}
+
+				if err := m.Unsubscribe(filter, sub); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	var st Stats
+	m.Stats(&st)
+	require.Equal(t, 3, st.Nodes)
+	require.Equal(t, 1, st.Subscriptions)
+}
+
+// benchmarkMatcher builds a tree with n subscriptions, one for each of n devices,
+// plus a few with wildcards, like a fleet of sensors would.
+func benchmarkMatcher(b *testing.B, n int) *Matcher {
+	m := NewMatcher()
+
+	for i := 0; i < n; i++ {
+		if _, err := m.Subscribe([]byte(fmt.Sprintf("devices/%d/temp", i)), 1, i); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, filter := range []string{"devices/+/temp", "devices/#", "+/+/temp"} {
+		if _, err := m.Subscribe([]byte(filter), 1, filter); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return m
+}
+
+func BenchmarkMatcherSubscribers(b *testing.B) {
+	m := benchmarkMatcher(b, 100000)
+	topic := []byte("devices/4242/temp")
+
+	subs := make([]interface{}, 0, 8)
+	qoss := make([]byte, 0, 8)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		subs, qoss = subs[0:0], qoss[0:0]
+
+		if err := m.Subscribers(topic, 1, &subs, &qoss); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMatcherSubscribersParallel(b *testing.B) {
+	m := benchmarkMatcher(b, 100000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		topic := []byte("devices/4242/temp")
+		subs := make([]interface{}, 0, 8)
+		qoss := make([]byte, 0, 8)
+
+		for pb.Next() {
+			subs, qoss = subs[0:0], qoss[0:0]
+
+			if err := m.Subscribers(topic, 1, &subs, &qoss); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkMatcherSubscribe(b *testing.B) {
+	m := benchmarkMatcher(b, 100000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		filter := []byte(fmt.Sprintf("devices/%d/humidity", i%100000))
+
+		if _, err := m.Subscribe(filter, 1, i); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
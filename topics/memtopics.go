@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/surgemq/message"
 )
@@ -28,17 +29,26 @@ var (
 )
 
 var _ TopicsProvider = (*memTopics)(nil)
+var _ StatsProvider = (*memTopics)(nil)
+var _ BalancedProvider = (*memTopics)(nil)
+var _ PersistentProvider = (*memTopics)(nil)
+var _ IteratingProvider = (*memTopics)(nil)
+
+const (
+	// Number of retained messages RetainedEach() picks each time it locks the tree
+	retainedChunkSize = 256
+)
 
 type memTopics struct {
-	// Sub/unsub mutex
-	smu sync.RWMutex
-	// Subscription tree
-	sroot *snode
+	// Subscription tree, which does its own locking
+	matcher *Matcher
 
 	// Retained message mutex
 	rmu sync.RWMutex
 	// Retained messages topic tree
 	rroot *rnode
+	// Where the retained messages are written through to, if set
+	store RetainedStore
 }
 
 func init() {
@@ -53,57 +63,34 @@ var _ TopicsProvider = (*memTopics)(nil)
 // when the server goes, everything will be gone. Use with care.
 func NewMemProvider() *memTopics {
 	return &memTopics{
-		sroot: newSNode(),
-		rroot: newRNode(),
+		matcher: NewMatcher(),
+		rroot:   newRNode(),
 	}
 }
 
 func (this *memTopics) Subscribe(topic []byte, qos byte, sub interface{}) (byte, error) {
-	if !message.ValidQos(qos) {
-		return message.QosFailure, fmt.Errorf("Invalid QoS %d", qos)
-	}
-
-	if sub == nil {
-		return message.QosFailure, fmt.Errorf("Subscriber cannot be nil")
-	}
-
-	this.smu.Lock()
-	defer this.smu.Unlock()
-
-	if qos > MaxQosAllowed {
-		qos = MaxQosAllowed
-	}
-
-	if err := this.sroot.sinsert(topic, qos, sub); err != nil {
-		return message.QosFailure, err
-	}
-
-	return qos, nil
+	return this.matcher.Subscribe(topic, qos, sub)
 }
 
 func (this *memTopics) Unsubscribe(topic []byte, sub interface{}) error {
-	this.smu.Lock()
-	defer this.smu.Unlock()
-
-	return this.sroot.sremove(topic, sub)
+	return this.matcher.Unsubscribe(topic, sub)
 }
 
 // Returned values will be invalidated by the next Subscribers call
 func (this *memTopics) Subscribers(topic []byte, qos byte, subs *[]interface{}, qoss *[]byte) error {
-	if !message.ValidQos(qos) {
-		return fmt.Errorf("Invalid QoS %d", qos)
-	}
-
-	this.smu.RLock()
-	defer this.smu.RUnlock()
-
 	*subs = (*subs)[0:0]
 	*qoss = (*qoss)[0:0]
 
-	return this.sroot.smatch(topic, qos, subs, qoss)
+	return this.matcher.Subscribers(topic, qos, subs, qoss)
 }
 
 func (this *memTopics) Retain(msg *message.PublishMessage) error {
+	return this.RetainUntil(msg, time.Time{})
+}
+
+// RetainUntil is like Retain, except the message expires at the time given. The
+// expiry is written through to the store as well if it's an ExpiringStore.
+func (this *memTopics) RetainUntil(msg *message.PublishMessage, expires time.Time) error {
 	this.rmu.Lock()
 	defer this.rmu.Unlock()
 
@@ -111,170 +98,202 @@ func (this *memTopics) Retain(msg *message.PublishMessage) error {
 	// Testing, that a payload of 0 means delete the retain message.
 	// https://eclipse.org/paho/clients/testing/
 	if len(msg.Payload()) == 0 {
+		if this.store != nil {
+			if err := this.store.Del(msg.Topic()); err != nil {
+				return err
+			}
+		}
+
 		return this.rroot.rremove(msg.Topic())
 	}
 
-	return this.rroot.rinsert(msg.Topic(), msg)
+	if this.store != nil {
+		var err error
+
+		if s, ok := this.store.(ExpiringStore); ok {
+			err = s.PutUntil(msg, expires)
+		} else {
+			err = this.store.Put(msg)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return this.rroot.rinsert(msg.Topic(), msg, expires)
 }
 
 func (this *memTopics) Retained(topic []byte, msgs *[]*message.PublishMessage) error {
 	this.rmu.RLock()
 	defer this.rmu.RUnlock()
 
-	return this.rroot.rmatch(topic, msgs)
+	return this.rroot.rmatch(topic, msgs, time.Now())
 }
 
-func (this *memTopics) Close() error {
-	this.sroot = nil
-	this.rroot = nil
-	return nil
-}
+// RetainedEach goes through the retained messages for the topic filter
+// retainedChunkSize at a time. The tree is only locked while a chunk is picked, so f
+// can take as long as it needs, e.g., waiting on a slow subscriber, without holding
+// up anyone retaining messages.
+func (this *memTopics) RetainedEach(topic []byte, f func(msg *message.PublishMessage) error) error {
+	w := &rwalk{
+		stack: []rframe{{n: this.rroot, topic: topic}},
+		now:   time.Now(),
+	}
 
-// subscrition nodes
-type snode struct {
-	// If this is the end of the topic string, then add subscribers here
-	subs []interface{}
-	qos  []byte
+	msgs := make([]*message.PublishMessage, 0, retainedChunkSize)
 
-	// Otherwise add the next topic level here
-	snodes map[string]*snode
-}
+	for len(w.stack) > 0 {
+		msgs = msgs[0:0]
 
-func newSNode() *snode {
-	return &snode{
-		snodes: make(map[string]*snode),
-	}
-}
+		this.rmu.RLock()
+		err := w.next(&msgs, retainedChunkSize)
+		this.rmu.RUnlock()
 
-func (this *snode) sinsert(topic []byte, qos byte, sub interface{}) error {
-	// If there's no more topic levels, that means we are at the matching snode
-	// to insert the subscriber. So let's see if there's such subscriber,
-	// if so, update it. Otherwise insert it.
-	if len(topic) == 0 {
-		// Let's see if the subscriber is already on the list. If yes, update
-		// QoS and then return.
-		for i := range this.subs {
-			if equal(this.subs[i], sub) {
-				this.qos[i] = qos
-				return nil
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range msgs {
+			if err := f(msg); err != nil {
+				return err
 			}
 		}
+	}
 
-		// Otherwise add.
-		this.subs = append(this.subs, sub)
-		this.qos = append(this.qos, qos)
+	return nil
+}
 
-		return nil
-	}
+// Expire removes the retained messages that have expired by now, from the store as
+// well if there's one.
+func (this *memTopics) Expire(now time.Time) (int, error) {
+	this.rmu.Lock()
+	defer this.rmu.Unlock()
 
-	// Not the last level, so let's find or create the next level snode, and
-	// recursively call it's insert().
+	var msgs []*message.PublishMessage
 
-	// ntl = next topic level
-	ntl, rem, err := nextTopicLevel(topic)
-	if err != nil {
-		return err
-	}
+	this.rroot.rexpired(now, &msgs)
 
-	level := string(ntl)
+	for _, msg := range msgs {
+		if this.store != nil {
+			if err := this.store.Del(msg.Topic()); err != nil {
+				return 0, err
+			}
+		}
 
-	// Add snode if it doesn't already exist
-	n, ok := this.snodes[level]
-	if !ok {
-		n = newSNode()
-		this.snodes[level] = n
+		if err := this.rroot.rremove(msg.Topic()); err != nil {
+			return 0, err
+		}
 	}
 
-	return n.sinsert(rem, qos, sub)
+	return len(msgs), nil
 }
 
-// This remove implementation ignores the QoS, as long as the subscriber
-// matches then it's removed
-func (this *snode) sremove(topic []byte, sub interface{}) error {
-	// If the topic is empty, it means we are at the final matching snode. If so,
-	// let's find the matching subscribers and remove them.
-	if len(topic) == 0 {
-		// If subscriber == nil, then it's signal to remove ALL subscribers
-		if sub == nil {
-			this.subs = this.subs[0:0]
-			this.qos = this.qos[0:0]
-			return nil
-		}
+// Stats walks both the subscription and retained message trees and counts what's
+// in there. The root nodes are not counted.
+func (this *memTopics) Stats() Stats {
+	var st Stats
 
-		// If we find the subscriber then remove it from the list. Technically
-		// we just overwrite the slot by shifting all other items up by one.
-		for i := range this.subs {
-			if equal(this.subs[i], sub) {
-				this.subs = append(this.subs[:i], this.subs[i+1:]...)
-				this.qos = append(this.qos[:i], this.qos[i+1:]...)
-				return nil
-			}
-		}
+	this.matcher.Stats(&st)
 
-		return fmt.Errorf("memtopics/remove: No topic found for subscriber")
+	this.rmu.RLock()
+	if this.rroot != nil {
+		this.rroot.rstats(&st)
 	}
+	this.rmu.RUnlock()
 
-	// Not the last level, so let's find the next level snode, and recursively
-	// call it's remove().
+	return st
+}
 
-	// ntl = next topic level
-	ntl, rem, err := nextTopicLevel(topic)
-	if err != nil {
-		return err
+// SetBalancer changes the Balancer used by shared subscription groups created from
+// now on. Existing groups keep theirs.
+func (this *memTopics) SetBalancer(f NewBalancerFunc) {
+	this.matcher.SetBalancer(f)
+}
+
+// SetRetainedStore loads the retained messages in the store, on top of the
+// ones already in memory, and writes all the changes from now on through to it. If
+// it's a WatchingStore, the changes made by the other servers sharing it are made in
+// memory as well.
+func (this *memTopics) SetRetainedStore(store RetainedStore) error {
+	this.rmu.Lock()
+	defer this.rmu.Unlock()
+
+	// Watching before loading means no change is missed. The changes are only made
+	// once the messages have been loaded, since they wait on rmu.
+	if s, ok := store.(WatchingStore); ok {
+		if err := s.Watch(this.watchedPut(store), this.watchedDel(store)); err != nil {
+			return err
+		}
 	}
 
-	level := string(ntl)
+	// Messages that have expired while the store was closed are loaded as well, so
+	// Expire() removes them from the store.
+	var err error
 
-	// Find the snode that matches the topic level
-	n, ok := this.snodes[level]
-	if !ok {
-		return fmt.Errorf("memtopics/remove: No topic found")
+	if s, ok := store.(ExpiringStore); ok {
+		err = s.LoadUntil(func(msg *message.PublishMessage, expires time.Time) error {
+			return this.rroot.rinsert(msg.Topic(), msg, expires)
+		})
+	} else {
+		err = store.Load(func(msg *message.PublishMessage) error {
+			return this.rroot.rinsert(msg.Topic(), msg, time.Time{})
+		})
 	}
 
-	// Remove the subscriber from the next level snode
-	if err := n.sremove(rem, sub); err != nil {
+	if err != nil {
 		return err
 	}
 
-	// If there are no more subscribers and snodes to the next level we just visited
-	// let's remove it
-	if len(n.subs) == 0 && len(n.snodes) == 0 {
-		delete(this.snodes, level)
-	}
+	this.store = store
 
 	return nil
 }
 
-// smatch() returns all the subscribers that are subscribed to the topic. Given a topic
-// with no wildcards (publish topic), it returns a list of subscribers that subscribes
-// to the topic. For each of the level names, it's a match
-// - if there are subscribers to '#', then all the subscribers are added to result set
-func (this *snode) smatch(topic []byte, qos byte, subs *[]interface{}, qoss *[]byte) error {
-	// If the topic is empty, it means we are at the final matching snode. If so,
-	// let's find the subscribers that match the qos and append them to the list.
-	if len(topic) == 0 {
-		this.matchQos(qos, subs, qoss)
-		return nil
-	}
+// watchedPut returns the function a WatchingStore calls for the messages retained
+// by the other servers. They're only kept in memory, as they're in the store
+// already. The changes made after the store has been replaced are ignored.
+func (this *memTopics) watchedPut(store RetainedStore) func(msg *message.PublishMessage, expires time.Time) {
+	return func(msg *message.PublishMessage, expires time.Time) {
+		this.rmu.Lock()
+		defer this.rmu.Unlock()
 
-	// ntl = next topic level
-	ntl, rem, err := nextTopicLevel(topic)
-	if err != nil {
-		return err
+		if this.store == store {
+			this.rroot.rinsert(msg.Topic(), msg, expires)
+		}
 	}
+}
 
-	level := string(ntl)
+// watchedDel returns the function a WatchingStore calls for the messages removed by
+// the other servers.
+func (this *memTopics) watchedDel(store RetainedStore) func(topic []byte) {
+	return func(topic []byte) {
+		this.rmu.Lock()
+		defer this.rmu.Unlock()
 
-	for k, n := range this.snodes {
-		// If the key is "#", then these subscribers are added to the result set
-		if k == MWC {
-			n.matchQos(qos, subs, qoss)
-		} else if k == SWC || k == level {
-			if err := n.smatch(rem, qos, subs, qoss); err != nil {
-				return err
-			}
+		if this.store == store {
+			this.rroot.rremove(topic)
 		}
 	}
+}
+
+// Close empties both trees, and closes the retained message store if there's one.
+// The provider is shared by every manager created with the same name, so it's left
+// in a usable state.
+func (this *memTopics) Close() error {
+	this.matcher.Reset()
+
+	this.rmu.Lock()
+	this.rroot = newRNode()
+	store := this.store
+	this.store = nil
+	this.rmu.Unlock()
+
+	// The store is closed without rmu held, since a WatchingStore waits for the
+	// changes it's making to finish.
+	if store != nil {
+		return store.Close()
+	}
 
 	return nil
 }
@@ -285,6 +304,9 @@ type rnode struct {
 	msg *message.PublishMessage
 	buf []byte
 
+	// When the retained message expires. If zero then it never does.
+	expires time.Time
+
 	// Otherwise add the next topic level here
 	rnodes map[string]*rnode
 }
@@ -295,31 +317,28 @@ func newRNode() *rnode {
 	}
 }
 
-func (this *rnode) rinsert(topic []byte, msg *message.PublishMessage) error {
+func (this *rnode) rinsert(topic []byte, msg *message.PublishMessage, expires time.Time) error {
 	// If there's no more topic levels, that means we are at the matching rnode.
 	if len(topic) == 0 {
-		l := msg.Len()
+		// Always start with a new buffer and message, never reuse the old ones. The
+		// messages returned by rmatch() are delivered to subscribers after the lock
+		// is released, so they must never change once they are in the tree.
+		buf := make([]byte, msg.Len())
 
-		// Let's reuse the buffer if there's enough space
-		if l > cap(this.buf) {
-			this.buf = make([]byte, l)
-		} else {
-			this.buf = this.buf[0:l]
-		}
-
-		if _, err := msg.Encode(this.buf); err != nil {
+		if _, err := msg.Encode(buf); err != nil {
 			return err
 		}
 
-		// Reuse the message if possible
-		if this.msg == nil {
-			this.msg = message.NewPublishMessage()
-		}
+		rmsg := message.NewPublishMessage()
 
-		if _, err := this.msg.Decode(this.buf); err != nil {
+		if _, err := rmsg.Decode(buf); err != nil {
 			return err
 		}
 
+		this.buf = buf
+		this.msg = rmsg
+		this.expires = expires
+
 		return nil
 	}
 
@@ -341,7 +360,7 @@ func (this *rnode) rinsert(topic []byte, msg *message.PublishMessage) error {
 		this.rnodes[level] = n
 	}
 
-	return n.rinsert(rem, msg)
+	return n.rinsert(rem, msg, expires)
 }
 
 // Remove the retained message for the supplied topic
@@ -351,6 +370,7 @@ func (this *rnode) rremove(topic []byte) error {
 	if len(topic) == 0 {
 		this.buf = nil
 		this.msg = nil
+		this.expires = time.Time{}
 		return nil
 	}
 
@@ -387,11 +407,11 @@ func (this *rnode) rremove(topic []byte) error {
 // rmatch() finds the retained messages for the topic and qos provided. It's somewhat
 // of a reverse match compare to match() since the supplied topic can contain
 // wildcards, whereas the retained message topic is a full (no wildcard) topic.
-func (this *rnode) rmatch(topic []byte, msgs *[]*message.PublishMessage) error {
+func (this *rnode) rmatch(topic []byte, msgs *[]*message.PublishMessage, now time.Time) error {
 	// If the topic is empty, it means we are at the final matching rnode. If so,
 	// add the retained msg to the list.
 	if len(topic) == 0 {
-		if this.msg != nil {
+		if this.msg != nil && !this.expired(now) {
 			*msgs = append(*msgs, this.msg)
 		}
 		return nil
@@ -407,18 +427,18 @@ func (this *rnode) rmatch(topic []byte, msgs *[]*message.PublishMessage) error {
 
 	if level == MWC {
 		// If '#', add all retained messages starting this node
-		this.allRetained(msgs)
+		this.allRetained(msgs, now)
 	} else if level == SWC {
 		// If '+', check all nodes at this level. Next levels must be matched.
 		for _, n := range this.rnodes {
-			if err := n.rmatch(rem, msgs); err != nil {
+			if err := n.rmatch(rem, msgs, now); err != nil {
 				return err
 			}
 		}
 	} else {
 		// Otherwise, find the matching node, go to the next level
 		if n, ok := this.rnodes[level]; ok {
-			if err := n.rmatch(rem, msgs); err != nil {
+			if err := n.rmatch(rem, msgs, now); err != nil {
 				return err
 			}
 		}
@@ -427,13 +447,112 @@ func (this *rnode) rmatch(topic []byte, msgs *[]*message.PublishMessage) error {
 	return nil
 }
 
-func (this *rnode) allRetained(msgs *[]*message.PublishMessage) {
-	if this.msg != nil {
+// rwalk is where RetainedEach() is in the retained messages tree. The rnodes still
+// to be looked at are kept on a stack, so the walk can stop, let go of the lock, and
+// carry on from there. The rnodes on the stack may have been taken out of the tree
+// in the meantime, in which case what's left in them is still used.
+type rwalk struct {
+	stack []rframe
+	now   time.Time
+}
+
+// rframe is an rnode still to be looked at, and what's left of the topic filter for
+// it. If all is set then it's under a '#', and it matches with everything below it.
+type rframe struct {
+	n     *rnode
+	topic []byte
+	all   bool
+}
+
+// next appends up to max retained messages to msgs, taking the rnodes they came from
+// off the stack. It's the same match as rmatch(), one rnode at a time.
+func (this *rwalk) next(msgs *[]*message.PublishMessage, max int) error {
+	for len(this.stack) > 0 && len(*msgs) < max {
+		last := len(this.stack) - 1
+		f := this.stack[last]
+		this.stack = this.stack[:last]
+
+		if !f.all && len(f.topic) == 0 {
+			this.add(f.n, msgs)
+			continue
+		}
+
+		level, rem := MWC, []byte(nil)
+
+		if !f.all {
+			ntl, r, err := nextTopicLevel(f.topic)
+			if err != nil {
+				return err
+			}
+
+			level, rem = string(ntl), r
+		}
+
+		switch level {
+		case MWC:
+			// If '#', add all retained messages starting this node
+			this.add(f.n, msgs)
+
+			for _, n := range f.n.rnodes {
+				this.stack = append(this.stack, rframe{n: n, all: true})
+			}
+
+		case SWC:
+			// If '+', check all nodes at this level. Next levels must be matched.
+			for _, n := range f.n.rnodes {
+				this.stack = append(this.stack, rframe{n: n, topic: rem})
+			}
+
+		default:
+			// Otherwise, find the matching node, go to the next level
+			if n, ok := f.n.rnodes[level]; ok {
+				this.stack = append(this.stack, rframe{n: n, topic: rem})
+			}
+		}
+	}
+
+	return nil
+}
+
+func (this *rwalk) add(n *rnode, msgs *[]*message.PublishMessage) {
+	if n.msg != nil && !n.expired(this.now) {
+		*msgs = append(*msgs, n.msg)
+	}
+}
+
+func (this *rnode) allRetained(msgs *[]*message.PublishMessage, now time.Time) {
+	if this.msg != nil && !this.expired(now) {
+		*msgs = append(*msgs, this.msg)
+	}
+
+	for _, n := range this.rnodes {
+		n.allRetained(msgs, now)
+	}
+}
+
+// rexpired finds all the retained messages that have expired by now.
+func (this *rnode) rexpired(now time.Time, msgs *[]*message.PublishMessage) {
+	if this.msg != nil && this.expired(now) {
 		*msgs = append(*msgs, this.msg)
 	}
 
 	for _, n := range this.rnodes {
-		n.allRetained(msgs)
+		n.rexpired(now, msgs)
+	}
+}
+
+func (this *rnode) expired(now time.Time) bool {
+	return !this.expires.IsZero() && !now.Before(this.expires)
+}
+
+func (this *rnode) rstats(st *Stats) {
+	if this.msg != nil {
+		st.Retained++
+		st.RetainedBytes += len(this.buf)
+	}
+
+	for _, n := range this.rnodes {
+		n.rstats(st)
 	}
 }
 
@@ -498,26 +617,6 @@ func nextTopicLevel(topic []byte) ([]byte, []byte, error) {
 	return topic, nil, nil
 }
 
-// The QoS of the payload messages sent in response to a subscription must be the
-// minimum of the QoS of the originally published message (in this case, it's the
-// qos parameter) and the maximum QoS granted by the server (in this case, it's
-// the QoS in the topic tree).
-//
-// It's also possible that even if the topic matches, the subscriber is not included
-// due to the QoS granted is lower than the published message QoS. For example,
-// if the client is granted only QoS 0, and the publish message is QoS 1, then this
-// client is not to be send the published message.
-func (this *snode) matchQos(qos byte, subs *[]interface{}, qoss *[]byte) {
-	for i, sub := range this.subs {
-		// If the published QoS is higher than the subscriber QoS, then we skip the
-		// subscriber. Otherwise, add to the list.
-		if qos <= this.qos[i] {
-			*subs = append(*subs, sub)
-			*qoss = append(*qoss, qos)
-		}
-	}
-}
-
 func equal(k1, k2 interface{}) bool {
 	if reflect.TypeOf(k1) != reflect.TypeOf(k2) {
 		return false
@@ -15,7 +15,9 @@
 package topics
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/surgemq/message"
@@ -394,7 +396,7 @@ func TestRNodeInsertRemove(t *testing.T) {
 
 	msg := newPublishMessageLarge([]byte("sport/tennis/player1/ricardo"), 1)
 
-	err := n.rinsert(msg.Topic(), msg)
+	err := n.rinsert(msg.Topic(), msg, time.Time{})
 
 	require.NoError(t, err)
 	require.Equal(t, 1, len(n.rnodes))
@@ -431,7 +433,7 @@ func TestRNodeInsertRemove(t *testing.T) {
 
 	msg2 := newPublishMessageLarge([]byte("sport/tennis/player1/andre"), 1)
 
-	err = n.rinsert(msg2.Topic(), msg2)
+	err = n.rinsert(msg2.Topic(), msg2, time.Time{})
 
 	require.NoError(t, err)
 	require.Equal(t, 2, len(n4.rnodes))
@@ -455,22 +457,22 @@ func TestRNodeMatch(t *testing.T) {
 	n := newRNode()
 
 	msg1 := newPublishMessageLarge([]byte("sport/tennis/ricardo/stats"), 1)
-	err := n.rinsert(msg1.Topic(), msg1)
+	err := n.rinsert(msg1.Topic(), msg1, time.Time{})
 	require.NoError(t, err)
 
 	msg2 := newPublishMessageLarge([]byte("sport/tennis/andre/stats"), 1)
-	err = n.rinsert(msg2.Topic(), msg2)
+	err = n.rinsert(msg2.Topic(), msg2, time.Time{})
 	require.NoError(t, err)
 
 	msg3 := newPublishMessageLarge([]byte("sport/tennis/andre/bio"), 1)
-	err = n.rinsert(msg3.Topic(), msg3)
+	err = n.rinsert(msg3.Topic(), msg3, time.Time{})
 	require.NoError(t, err)
 
 	var msglist []*message.PublishMessage
 
 	// ---
 
-	err = n.rmatch(msg1.Topic(), &msglist)
+	err = n.rmatch(msg1.Topic(), &msglist, time.Now())
 
 	require.NoError(t, err)
 	require.Equal(t, 1, len(msglist))
@@ -478,7 +480,7 @@ func TestRNodeMatch(t *testing.T) {
 	// ---
 
 	msglist = msglist[0:0]
-	err = n.rmatch(msg2.Topic(), &msglist)
+	err = n.rmatch(msg2.Topic(), &msglist, time.Now())
 
 	require.NoError(t, err)
 	require.Equal(t, 1, len(msglist))
@@ -486,7 +488,7 @@ func TestRNodeMatch(t *testing.T) {
 	// ---
 
 	msglist = msglist[0:0]
-	err = n.rmatch(msg3.Topic(), &msglist)
+	err = n.rmatch(msg3.Topic(), &msglist, time.Now())
 
 	require.NoError(t, err)
 	require.Equal(t, 1, len(msglist))
@@ -494,7 +496,7 @@ func TestRNodeMatch(t *testing.T) {
 	// ---
 
 	msglist = msglist[0:0]
-	err = n.rmatch([]byte("sport/tennis/andre/+"), &msglist)
+	err = n.rmatch([]byte("sport/tennis/andre/+"), &msglist, time.Now())
 
 	require.NoError(t, err)
 	require.Equal(t, 2, len(msglist))
@@ -502,7 +504,7 @@ func TestRNodeMatch(t *testing.T) {
 	// ---
 
 	msglist = msglist[0:0]
-	err = n.rmatch([]byte("sport/tennis/andre/#"), &msglist)
+	err = n.rmatch([]byte("sport/tennis/andre/#"), &msglist, time.Now())
 
 	require.NoError(t, err)
 	require.Equal(t, 2, len(msglist))
@@ -510,7 +512,7 @@ func TestRNodeMatch(t *testing.T) {
 	// ---
 
 	msglist = msglist[0:0]
-	err = n.rmatch([]byte("sport/tennis/+/stats"), &msglist)
+	err = n.rmatch([]byte("sport/tennis/+/stats"), &msglist, time.Now())
 
 	require.NoError(t, err)
 	require.Equal(t, 2, len(msglist))
@@ -518,7 +520,7 @@ func TestRNodeMatch(t *testing.T) {
 	// ---
 
 	msglist = msglist[0:0]
-	err = n.rmatch([]byte("sport/tennis/#"), &msglist)
+	err = n.rmatch([]byte("sport/tennis/#"), &msglist, time.Now())
 
 	require.NoError(t, err)
 	require.Equal(t, 3, len(msglist))
@@ -639,6 +641,307 @@ func TestMemTopicsRetained(t *testing.T) {
 	require.Equal(t, 3, len(msglist))
 }
 
+// RetainedEach finds the same messages as Retained, and doesn't hold the lock while
+// it calls f, so f can retain messages itself.
+func TestMemTopicsRetainedEach(t *testing.T) {
+	p := NewMemProvider()
+
+	for i := 0; i < retainedChunkSize*3; i++ {
+		require.NoError(t, p.Retain(newPublishMessageLarge([]byte(fmt.Sprintf("sensors/%d/temp", i)), 1)))
+	}
+
+	require.NoError(t, p.Retain(newPublishMessageLarge([]byte("sensors"), 1)))
+	require.NoError(t, p.Retain(newPublishMessageLarge([]byte("sensors/1/humidity"), 1)))
+
+	expired := newPublishMessageLarge([]byte("sensors/2/humidity"), 1)
+	require.NoError(t, p.RetainUntil(expired, time.Now().Add(-time.Second)))
+
+	for _, filter := range []string{"sensors/#", "sensors/+/temp", "sensors/1/+", "sensors", "#", "+/+/+", "other/#"} {
+		var msglist []*message.PublishMessage
+		require.NoError(t, p.Retained([]byte(filter), &msglist))
+
+		seen := make(map[string]bool)
+
+		err := p.RetainedEach([]byte(filter), func(msg *message.PublishMessage) error {
+			seen[string(msg.Topic())] = true
+			return p.Retain(newPublishMessageLarge([]byte("other/x"), 0))
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, len(msglist), len(seen), filter)
+
+		for _, msg := range msglist {
+			require.True(t, seen[string(msg.Topic())], filter)
+		}
+	}
+
+	// The error from f stops the walk
+	n := 0
+	stop := fmt.Errorf("stop")
+
+	err := p.RetainedEach([]byte("sensors/#"), func(msg *message.PublishMessage) error {
+		if n++; n == 10 {
+			return stop
+		}
+		return nil
+	})
+	require.Equal(t, stop, err)
+	require.Equal(t, 10, n)
+
+	require.Error(t, p.RetainedEach([]byte("sensors/#/temp"), func(msg *message.PublishMessage) error {
+		return nil
+	}))
+}
+
+func TestMemTopicsRetainedExpiry(t *testing.T) {
+	p := NewMemProvider()
+
+	now := time.Now()
+
+	require.NoError(t, p.RetainUntil(newRetainedMessage("sport/golf", "7"), now.Add(time.Hour)))
+	require.NoError(t, p.RetainUntil(newRetainedMessage("sport/tennis", "42"), now.Add(-time.Second)))
+	require.NoError(t, p.Retain(newRetainedMessage("sport/chess", "1")))
+
+	// Expired messages are not returned even before they are removed
+	var msglist []*message.PublishMessage
+
+	require.NoError(t, p.Retained([]byte("sport/#"), &msglist))
+	require.Equal(t, 2, len(msglist))
+
+	msglist = msglist[0:0]
+
+	require.NoError(t, p.Retained([]byte("sport/tennis"), &msglist))
+	require.Equal(t, 0, len(msglist))
+
+	require.Equal(t, 3, p.Stats().Retained)
+
+	n, err := p.Expire(now)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, 2, p.Stats().Retained)
+
+	n, err = p.Expire(now.Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, 1, p.Stats().Retained)
+
+	// Retaining the message again without an expiry means it never expires
+	require.NoError(t, p.RetainUntil(newRetainedMessage("sport/chess", "2"), now))
+	require.NoError(t, p.Retain(newRetainedMessage("sport/chess", "3")))
+
+	n, err = p.Expire(now.Add(time.Hour * 24))
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestMemTopicsStats(t *testing.T) {
+	Unregister("mem")
+	p := NewMemProvider()
+	Register("mem", p)
+
+	mgr, err := NewManager("mem")
+	require.NoError(t, err)
+
+	st, err := mgr.Stats()
+	require.NoError(t, err)
+	require.Equal(t, Stats{}, st)
+
+	_, err = mgr.Subscribe([]byte("sports/tennis/+/stats"), 1, "sub1")
+	require.NoError(t, err)
+
+	st, err = mgr.Stats()
+	require.NoError(t, err)
+	require.Equal(t, 4, st.Nodes)
+	require.Equal(t, 1, st.Subscriptions)
+
+	_, err = mgr.Subscribe([]byte("sports/tennis/+/stats"), 1, "sub2")
+	require.NoError(t, err)
+
+	_, err = mgr.Subscribe([]byte("sports/golf/#"), 1, "sub1")
+	require.NoError(t, err)
+
+	st, err = mgr.Stats()
+	require.NoError(t, err)
+	require.Equal(t, 6, st.Nodes)
+	require.Equal(t, 3, st.Subscriptions)
+
+	err = mgr.Unsubscribe([]byte("sports/golf/#"), "sub1")
+	require.NoError(t, err)
+
+	st, err = mgr.Stats()
+	require.NoError(t, err)
+	require.Equal(t, 4, st.Nodes)
+	require.Equal(t, 2, st.Subscriptions)
+
+	msg := newPublishMessageLarge([]byte("sport/tennis/ricardo/stats"), 1)
+	err = mgr.Retain(msg)
+	require.NoError(t, err)
+
+	st, err = mgr.Stats()
+	require.NoError(t, err)
+	require.Equal(t, 1, st.Retained)
+	require.Equal(t, msg.Len(), st.RetainedBytes)
+}
+
+func TestMemTopicsShared(t *testing.T) {
+	Unregister("mem")
+	p := NewMemProvider()
+	Register("mem", p)
+
+	mgr, err := NewManager("mem")
+	require.NoError(t, err)
+
+	_, err = mgr.Subscribe([]byte("$share/workers/jobs/#"), 1, "sub1")
+	require.NoError(t, err)
+
+	_, err = mgr.Subscribe([]byte("$share/workers/jobs/#"), 1, "sub2")
+	require.NoError(t, err)
+
+	_, err = mgr.Subscribe([]byte("$share/loggers/jobs/+"), 1, "sub3")
+	require.NoError(t, err)
+
+	_, err = mgr.Subscribe([]byte("jobs/#"), 1, "sub4")
+	require.NoError(t, err)
+
+	st, err := mgr.Stats()
+	require.NoError(t, err)
+	require.Equal(t, 4, st.Subscriptions)
+
+	subs := make([]interface{}, 0, 5)
+	qoss := make([]byte, 0, 5)
+	counts := make(map[interface{}]int)
+
+	for i := 0; i < 4; i++ {
+		err = mgr.Subscribers([]byte("jobs/build"), 1, &subs, &qoss)
+		require.NoError(t, err)
+		require.Equal(t, 3, len(subs))
+
+		for _, sub := range subs {
+			counts[sub]++
+		}
+	}
+
+	require.Equal(t, 2, counts["sub1"])
+	require.Equal(t, 2, counts["sub2"])
+	require.Equal(t, 4, counts["sub3"])
+	require.Equal(t, 4, counts["sub4"])
+
+	err = mgr.Unsubscribe([]byte("$share/workers/jobs/#"), "sub1")
+	require.NoError(t, err)
+
+	err = mgr.Subscribers([]byte("jobs/build"), 1, &subs, &qoss)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(subs))
+	require.Contains(t, subs, "sub2")
+
+	err = mgr.Unsubscribe([]byte("$share/workers/jobs/#"), "sub1")
+	require.Error(t, err)
+
+	err = mgr.Unsubscribe([]byte("$share/workers/jobs/#"), "sub2")
+	require.NoError(t, err)
+
+	err = mgr.Unsubscribe([]byte("$share/loggers/jobs/+"), "sub3")
+	require.NoError(t, err)
+
+	err = mgr.Subscribers([]byte("jobs/build"), 1, &subs, &qoss)
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"sub4"}, subs)
+}
+
+func TestMemTopicsSharedQos(t *testing.T) {
+	n := newSNode()
+
+	err := n.insert([]byte("jobs"), &sgroupKey{"workers", NewRoundRobinBalancer}, 0, "sub1")
+	require.NoError(t, err)
+
+	err = n.insert([]byte("jobs"), &sgroupKey{"workers", NewRoundRobinBalancer}, 2, "sub2")
+	require.NoError(t, err)
+
+	subs := make([]interface{}, 0, 5)
+	qoss := make([]byte, 0, 5)
+
+	for i := 0; i < 3; i++ {
+		err = n.smatch([]byte("jobs"), 1, &subs, &qoss)
+		require.NoError(t, err)
+		require.Equal(t, []interface{}{"sub2"}, subs)
+		subs, qoss = subs[0:0], qoss[0:0]
+	}
+}
+
+func TestMemTopicsSharedInvalid(t *testing.T) {
+	p := NewMemProvider()
+
+	_, err := p.Subscribe([]byte("$share/workers"), 1, "sub1")
+	require.Error(t, err)
+
+	_, err = p.Subscribe([]byte("$share//jobs"), 1, "sub1")
+	require.Error(t, err)
+
+	_, err = p.Subscribe([]byte("$share/+/jobs"), 1, "sub1")
+	require.Error(t, err)
+
+	_, err = p.Subscribe([]byte("$share/workers/"), 1, "sub1")
+	require.Error(t, err)
+}
+
+func TestValidTopicName(t *testing.T) {
+	require.NoError(t, ValidTopicName([]byte("sport/tennis/player1")))
+	require.NoError(t, ValidTopicName([]byte("/")))
+	require.NoError(t, ValidTopicName([]byte("caf\xc3\xa9")))
+
+	require.Error(t, ValidTopicName([]byte("")))
+	require.Error(t, ValidTopicName([]byte("sport/+/player1")))
+	require.Error(t, ValidTopicName([]byte("sport/#")))
+	require.Error(t, ValidTopicName([]byte("sport/\xff")))
+	require.Error(t, ValidTopicName([]byte("sport/\x00")))
+}
+
+func TestValidTopicFilter(t *testing.T) {
+	require.NoError(t, ValidTopicFilter([]byte("sport/tennis/player1/#")))
+	require.NoError(t, ValidTopicFilter([]byte("sport/+/player1")))
+	require.NoError(t, ValidTopicFilter([]byte("+/+")))
+	require.NoError(t, ValidTopicFilter([]byte("#")))
+	require.NoError(t, ValidTopicFilter([]byte("$share/workers/jobs/#")))
+
+	require.Error(t, ValidTopicFilter([]byte("")))
+	require.Error(t, ValidTopicFilter([]byte("sport/tennis#")))
+	require.Error(t, ValidTopicFilter([]byte("sport/#/ranking")))
+	require.Error(t, ValidTopicFilter([]byte("sport+")))
+	require.Error(t, ValidTopicFilter([]byte("sport/\xff")))
+	require.Error(t, ValidTopicFilter([]byte("$share/+/jobs")))
+}
+
+func TestBalancers(t *testing.T) {
+	subs := []interface{}{"sub1", "sub2", "sub3"}
+
+	b := NewRoundRobinBalancer()
+	for i := 0; i < 6; i++ {
+		require.Equal(t, i%3, b.Pick(subs))
+	}
+
+	b = NewRandomBalancer()
+	for i := 0; i < 6; i++ {
+		j := b.Pick(subs)
+		require.True(t, j >= 0 && j < 3)
+	}
+
+	b = NewStickyBalancer()
+	j := b.Pick(subs)
+	for i := 0; i < 6; i++ {
+		require.Equal(t, j, b.Pick(subs))
+	}
+
+	// The subscriber that was picked leaves the group.
+	gone := subs[j]
+	subs = append(subs[:j:j], subs[j+1:]...)
+
+	j = b.Pick(subs)
+	require.NotEqual(t, gone, subs[j])
+	for i := 0; i < 6; i++ {
+		require.Equal(t, j, b.Pick(subs))
+	}
+}
+
 func newPublishMessageLarge(topic []byte, qos byte) *message.PublishMessage {
 	msg := message.NewPublishMessage()
 	msg.SetTopic(topic)
@@ -0,0 +1,362 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/surgemq/message"
+)
+
+var (
+	_ RetainedStore = (*redisStore)(nil)
+	_ ExpiringStore = (*redisStore)(nil)
+	_ WatchingStore = (*redisStore)(nil)
+)
+
+// DefaultRedisNamespace is what the Redis keys start with if no namespace is given.
+const DefaultRedisNamespace = "surgemq"
+
+// How many retained messages are read from Redis at a time by Load
+const redisScanCount = 100
+
+// redisStore is a RetainedStore, an ExpiringStore and a WatchingStore that keeps the
+// retained messages in Redis, so they can be shared by the servers behind a load
+// balancer. The messages are kept in a hash, keyed by topic, and when they expire in
+// another. Every change is also published on a channel, which is how the other
+// servers sharing the messages hear about it.
+type redisStore struct {
+	pool *redis.Pool
+
+	key, expiresKey, channel string
+
+	// Tells the changes made through this store apart from the others
+	id string
+
+	// The Watch subscription, if there's one
+	psc  *redis.PubSubConn
+	quit chan struct{}
+	mu   sync.Mutex
+	wg   sync.WaitGroup
+}
+
+// redisChange is what's published on the channel for each change.
+type redisChange struct {
+	Store string
+	Topic []byte
+
+	// The encoded message, nil if it's been removed
+	Msg []byte `json:",omitempty"`
+
+	// When the message expires, in nanoseconds since the epoch, 0 if it doesn't
+	Expires int64 `json:",omitempty"`
+}
+
+// NewRedisStore returns a store that keeps retained messages in the Redis server
+// the connections in pool are to. The keys all start with namespace, e.g., the name
+// of the cluster of servers, so different clusters can share a Redis server. If
+// it's empty then it's DefaultRedisNamespace. It should be handed to a server as its
+// RetainedStore, or to Manager.SetRetainedStore().
+//
+// The pool is not closed along with the store, so it can be shared with the
+// sessions provider, see sessions.NewRedisProvider.
+func NewRedisStore(pool *redis.Pool, namespace string) (*redisStore, error) {
+	if namespace == "" {
+		namespace = DefaultRedisNamespace
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("PING"); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	return &redisStore{
+		pool:       pool,
+		key:        namespace + ":retained",
+		expiresKey: namespace + ":retained:expires",
+		channel:    namespace + ":retained:changes",
+		id:         hex.EncodeToString(b),
+		quit:       make(chan struct{}),
+	}, nil
+}
+
+func (this *redisStore) Load(f func(msg *message.PublishMessage) error) error {
+	return this.LoadUntil(func(msg *message.PublishMessage, expires time.Time) error {
+		return f(msg)
+	})
+}
+
+// LoadUntil goes through the messages redisScanCount at a time, so a lot of them
+// don't hold up Redis.
+func (this *redisStore) LoadUntil(f func(msg *message.PublishMessage, expires time.Time) error) error {
+	conn := this.pool.Get()
+	defer conn.Close()
+
+	expires, err := redis.Int64Map(conn.Do("HGETALL", this.expiresKey))
+	if err != nil {
+		return err
+	}
+
+	cursor := 0
+
+	for {
+		vals, err := redis.Values(conn.Do("HSCAN", this.key, cursor, "COUNT", redisScanCount))
+		if err != nil {
+			return err
+		}
+
+		if cursor, err = redis.Int(vals[0], nil); err != nil {
+			return err
+		}
+
+		kvs, err := redis.ByteSlices(vals[1], nil)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i+1 < len(kvs); i += 2 {
+			msg := message.NewPublishMessage()
+
+			if _, err := msg.Decode(kvs[i+1]); err != nil {
+				return fmt.Errorf("store/Load: Error decoding retained message %s: %v", string(kvs[i]), err)
+			}
+
+			if err := f(msg, unixTime(expires[string(kvs[i])])); err != nil {
+				return err
+			}
+		}
+
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+func (this *redisStore) Put(msg *message.PublishMessage) error {
+	return this.PutUntil(msg, time.Time{})
+}
+
+func (this *redisStore) PutUntil(msg *message.PublishMessage, expires time.Time) error {
+	buf := make([]byte, msg.Len())
+
+	if _, err := msg.Encode(buf); err != nil {
+		return err
+	}
+
+	change := redisChange{Store: this.id, Topic: msg.Topic(), Msg: buf}
+
+	if !expires.IsZero() {
+		change.Expires = expires.UnixNano()
+	}
+
+	b, err := json.Marshal(&change)
+	if err != nil {
+		return err
+	}
+
+	conn := this.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("HSET", this.key, msg.Topic(), buf)
+
+	if expires.IsZero() {
+		conn.Send("HDEL", this.expiresKey, msg.Topic())
+	} else {
+		conn.Send("HSET", this.expiresKey, msg.Topic(), change.Expires)
+	}
+
+	conn.Send("PUBLISH", this.channel, b)
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (this *redisStore) Del(topic []byte) error {
+	b, err := json.Marshal(&redisChange{Store: this.id, Topic: topic})
+	if err != nil {
+		return err
+	}
+
+	conn := this.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("HDEL", this.key, topic)
+	conn.Send("HDEL", this.expiresKey, topic)
+	conn.Send("PUBLISH", this.channel, b)
+
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// Watch subscribes to the changes made by the other stores. If the subscription is
+// lost it's made again, but the changes made in the meantime are missed.
+func (this *redisStore) Watch(put func(msg *message.PublishMessage, expires time.Time), del func(topic []byte)) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.psc != nil {
+		return fmt.Errorf("store/Watch: Already watching")
+	}
+
+	if err := this.subscribe(); err != nil {
+		return err
+	}
+
+	this.wg.Add(1)
+	go this.watch(put, del)
+
+	return nil
+}
+
+// Close stops watching, if the store is. The pool is left open.
+func (this *redisStore) Close() error {
+	this.mu.Lock()
+
+	select {
+	case <-this.quit:
+		this.mu.Unlock()
+		return nil
+
+	default:
+	}
+
+	close(this.quit)
+
+	if this.psc != nil {
+		this.psc.Close()
+	}
+
+	this.mu.Unlock()
+
+	this.wg.Wait()
+
+	return nil
+}
+
+// subscribe subscribes to the channel with a connection of its own, and waits until
+// Redis confirms it. The caller must hold mu.
+func (this *redisStore) subscribe() error {
+	psc := &redis.PubSubConn{Conn: this.pool.Get()}
+
+	if err := psc.Subscribe(this.channel); err != nil {
+		psc.Close()
+		return err
+	}
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Subscription:
+			this.psc = psc
+			return nil
+
+		case error:
+			psc.Close()
+			return v
+		}
+	}
+}
+
+func (this *redisStore) watch(put func(msg *message.PublishMessage, expires time.Time), del func(topic []byte)) {
+	defer this.wg.Done()
+
+	for {
+		this.mu.Lock()
+		psc := this.psc
+		this.mu.Unlock()
+
+		if psc != nil {
+			this.receive(psc, put, del)
+			psc.Close()
+		}
+
+		select {
+		case <-this.quit:
+			return
+
+		case <-time.After(time.Second):
+		}
+
+		this.mu.Lock()
+
+		select {
+		case <-this.quit:
+			this.mu.Unlock()
+			return
+
+		default:
+		}
+
+		if err := this.subscribe(); err != nil {
+			this.psc = nil
+		}
+
+		this.mu.Unlock()
+	}
+}
+
+// receive applies the changes made by the other stores until the subscription is
+// lost, or closed.
+func (this *redisStore) receive(psc *redis.PubSubConn, put func(msg *message.PublishMessage, expires time.Time), del func(topic []byte)) {
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			var change redisChange
+
+			if err := json.Unmarshal(v.Data, &change); err != nil || change.Store == this.id {
+				continue
+			}
+
+			if change.Msg == nil {
+				del(change.Topic)
+				continue
+			}
+
+			msg := message.NewPublishMessage()
+
+			if _, err := msg.Decode(change.Msg); err != nil {
+				continue
+			}
+
+			put(msg, unixTime(change.Expires))
+
+		case error:
+			return
+		}
+	}
+}
+
+// unixTime returns the time for nanoseconds since the epoch, or the zero time for 0.
+func unixTime(nsec int64) time.Time {
+	if nsec == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, nsec)
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestRedisStoreLoad(t *testing.T) {
+	pool, ns, cleanup := newRedisPool(t)
+	defer cleanup()
+
+	s, err := NewRedisStore(pool, ns)
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	require.NoError(t, s.Put(newRetainedMessage("sport/tennis/ricardo/stats", "42")))
+	require.NoError(t, s.PutUntil(newRetainedMessage("sport/golf", "7"), now.Add(time.Hour)))
+	require.NoError(t, s.Put(newRetainedMessage("sport/golf", "8")))
+	require.NoError(t, s.PutUntil(newRetainedMessage("weather", "sunny"), now.Add(time.Hour)))
+	require.NoError(t, s.Del([]byte("sport/tennis/ricardo/stats")))
+	require.NoError(t, s.Del([]byte("nothing/here")))
+	require.NoError(t, s.Close())
+
+	s, err = NewRedisStore(pool, ns)
+	require.NoError(t, err)
+	defer s.Close()
+
+	msgs := make(map[string]string)
+	expires := make(map[string]time.Time)
+
+	err = s.LoadUntil(func(msg *message.PublishMessage, e time.Time) error {
+		msgs[string(msg.Topic())] = string(msg.Payload())
+		expires[string(msg.Topic())] = e
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, map[string]string{
+		"sport/golf": "8",
+		"weather":    "sunny",
+	}, msgs)
+
+	require.True(t, expires["sport/golf"].IsZero())
+	require.True(t, expires["weather"].Equal(now.Add(time.Hour)))
+}
+
+func TestMemTopicsRedisStoreShared(t *testing.T) {
+	pool, ns, cleanup := newRedisPool(t)
+	defer cleanup()
+
+	p1 := NewMemProvider()
+	p2 := NewMemProvider()
+
+	s1, err := NewRedisStore(pool, ns)
+	require.NoError(t, err)
+	require.NoError(t, p1.SetRetainedStore(s1))
+	defer p1.Close()
+
+	require.NoError(t, p1.Retain(newRetainedMessage("sport/golf", "7")))
+
+	// Loaded from Redis
+	s2, err := NewRedisStore(pool, ns)
+	require.NoError(t, err)
+	require.NoError(t, p2.SetRetainedStore(s2))
+	defer p2.Close()
+
+	retained := func(p *memTopics, topic string) []string {
+		var msglist []*message.PublishMessage
+
+		require.NoError(t, p.Retained([]byte(topic), &msglist))
+
+		var payloads []string
+		for _, msg := range msglist {
+			payloads = append(payloads, string(msg.Payload()))
+		}
+
+		return payloads
+	}
+
+	require.Equal(t, []string{"7"}, retained(p2, "sport/golf"))
+
+	// Told about by the other store
+	require.NoError(t, p1.Retain(newRetainedMessage("sport/tennis", "42")))
+	require.NoError(t, p2.Retain(newRetainedMessage("sport/golf", "")))
+
+	for i := 0; i < 100; i++ {
+		if len(retained(p1, "sport/golf")) == 0 && len(retained(p2, "sport/tennis")) == 1 {
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	require.Empty(t, retained(p1, "sport/golf"))
+	require.Equal(t, []string{"42"}, retained(p2, "sport/tennis"))
+}
+
+// newRedisPool returns a pool of connections to the Redis server at $SURGEMQ_REDIS,
+// or localhost, a namespace of its own for the test, and a func that removes the
+// keys in the namespace and closes the pool. The test is skipped if there's no
+// Redis server.
+func newRedisPool(t *testing.T) (*redis.Pool, string, func()) {
+	addr := os.Getenv("SURGEMQ_REDIS")
+	if addr == "" {
+		addr = "127.0.0.1:6379"
+	}
+
+	pool := &redis.Pool{
+		MaxIdle: 4,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("PING"); err != nil {
+		pool.Close()
+		t.Skipf("No Redis server at %s: %v", addr, err)
+	}
+
+	ns := fmt.Sprintf("surgemq-test-%d", time.Now().UnixNano())
+
+	return pool, ns, func() {
+		conn := pool.Get()
+
+		keys, _ := redis.Strings(conn.Do("KEYS", ns+":*"))
+		for _, k := range keys {
+			conn.Do("DEL", k)
+		}
+
+		conn.Close()
+		pool.Close()
+	}
+}
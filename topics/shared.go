@@ -0,0 +1,116 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// SHARE is the first topic level of a shared subscription, "$share/{group}/{filter}".
+// All the subscribers in a group share the messages for the filter, each message
+// only going to one of them.
+const SHARE = "$share"
+
+// Balancer picks which member of a shared subscription group gets a message. Each
+// group gets its own Balancer, so it can keep state between messages. Pick may be
+// called concurrently.
+type Balancer interface {
+	// Pick returns the index of the subscriber in subs to deliver the message to.
+	// subs always has at least one subscriber.
+	Pick(subs []interface{}) int
+}
+
+// NewBalancerFunc returns a new Balancer for a shared subscription group.
+type NewBalancerFunc func() Balancer
+
+// IsShared returns true if the topic filter is for a shared subscription.
+func IsShared(topic []byte) bool {
+	return bytes.HasPrefix(topic, []byte(SHARE+SEP))
+}
+
+// SplitShared returns the group name and the topic filter of a shared subscription,
+// e.g., "workers" and "jobs/#" for "$share/workers/jobs/#".
+func SplitShared(topic []byte) (string, []byte, error) {
+	rem := topic[len(SHARE+SEP):]
+
+	i := bytes.IndexByte(rem, SEP[0])
+	if i <= 0 || i == len(rem)-1 {
+		return "", nil, fmt.Errorf("topics/SplitShared: Shared subscription %q must be of the form $share/{group}/{filter}", topic)
+	}
+
+	group := rem[:i]
+	if bytes.ContainsAny(group, _WC) {
+		return "", nil, fmt.Errorf("topics/SplitShared: Shared subscription group %q cannot contain wildcards", group)
+	}
+
+	return string(group), rem[i+1:], nil
+}
+
+// NewRoundRobinBalancer returns a Balancer that hands the messages to each of the
+// subscribers in turn. This is the default.
+func NewRoundRobinBalancer() Balancer {
+	return &roundRobinBalancer{}
+}
+
+type roundRobinBalancer struct {
+	next uint64
+}
+
+func (this *roundRobinBalancer) Pick(subs []interface{}) int {
+	return int((atomic.AddUint64(&this.next, 1) - 1) % uint64(len(subs)))
+}
+
+// NewRandomBalancer returns a Balancer that picks a subscriber at random.
+func NewRandomBalancer() Balancer {
+	return randomBalancer{}
+}
+
+type randomBalancer struct{}
+
+func (this randomBalancer) Pick(subs []interface{}) int {
+	return rand.Intn(len(subs))
+}
+
+// NewStickyBalancer returns a Balancer that keeps sending the messages to the same
+// subscriber, for as long as it's in the group. Another one is then picked at
+// random.
+func NewStickyBalancer() Balancer {
+	return &stickyBalancer{}
+}
+
+type stickyBalancer struct {
+	mu  sync.Mutex
+	sub interface{}
+}
+
+func (this *stickyBalancer) Pick(subs []interface{}) int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for i, sub := range subs {
+		if this.sub != nil && equal(sub, this.sub) {
+			return i
+		}
+	}
+
+	i := rand.Intn(len(subs))
+	this.sub = subs[i]
+
+	return i
+}
@@ -20,11 +20,17 @@
 // - + is a single level wildwcard. It must be the only character in the
 //   topic level. It represents all names in the current level.
 // - $ is a special character that says the topic is a system level topic
+// - $share/{group}/{filter} is a shared subscription, where the messages for the
+//   filter are balanced among the subscribers in the group
 package topics
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/surgemq/message"
 )
@@ -54,7 +60,26 @@ var (
 	// It probably hasn't been registered yet.
 	ErrAuthProviderNotFound = errors.New("auth: Authentication provider not found")
 
+	// ErrStatsNotSupported is returned when the provider does not keep any stats.
+	ErrStatsNotSupported = errors.New("topics: Provider does not support stats")
+
+	// ErrBalancerNotSupported is returned when the provider does not support changing
+	// how shared subscriptions are balanced.
+	ErrBalancerNotSupported = errors.New("topics: Provider does not support shared subscription balancers")
+
+	// ErrRetainedStoreNotSupported is returned when the provider cannot keep its
+	// retained messages in a RetainedStore.
+	ErrRetainedStoreNotSupported = errors.New("topics: Provider does not support retained message stores")
+
+	// ErrExpiryNotSupported is returned when the provider cannot expire retained
+	// messages.
+	ErrExpiryNotSupported = errors.New("topics: Provider does not support expiring retained messages")
+
 	providers = make(map[string]TopicsProvider)
+
+	// Clients register their own providers as they connect, so the providers are
+	// looked up and changed from different goroutines.
+	providersMu sync.RWMutex
 )
 
 // TopicsProvider
@@ -67,11 +92,113 @@ type TopicsProvider interface {
 	Close() error
 }
 
+// Stats is an estimate of the memory footprint of a topics provider.
+type Stats struct {
+	// Number of nodes in the subscription tree
+	Nodes int
+
+	// Number of subscribers across all the nodes in the subscription tree
+	Subscriptions int
+
+	// Number of retained messages
+	Retained int
+
+	// Total size in bytes of all the retained messages
+	RetainedBytes int
+}
+
+// StatsProvider is implemented by topics providers that can report how big they
+// are. Walking the topic trees is not free, so callers should not do this on every
+// operation.
+type StatsProvider interface {
+	Stats() Stats
+}
+
+// BalancedProvider is implemented by topics providers that let the strategy for
+// balancing messages among the subscribers of a shared subscription be changed.
+// Groups created afterwards get their Balancer from f.
+type BalancedProvider interface {
+	SetBalancer(f NewBalancerFunc)
+}
+
+// RetainedStore keeps the retained messages somewhere that survives a restart, e.g.,
+// a file. The topics provider still serves the retained messages from memory, and
+// writes every change through to the store.
+type RetainedStore interface {
+	// Load calls f with each of the retained messages in the store.
+	Load(f func(msg *message.PublishMessage) error) error
+
+	// Put saves the retained message, replacing the one with the same topic.
+	Put(msg *message.PublishMessage) error
+
+	// Del removes the retained message with the topic, if there's one.
+	Del(topic []byte) error
+
+	Close() error
+}
+
+// PersistentProvider is implemented by topics providers that can keep their
+// retained messages in a RetainedStore. The messages already in the store are
+// loaded when it's set. The provider closes the store when it's closed.
+type PersistentProvider interface {
+	SetRetainedStore(store RetainedStore) error
+}
+
+// ExpiringProvider is implemented by topics providers that can drop retained messages
+// once they expire. Expired messages are not returned by Retained(), even before
+// Expire() has removed them.
+type ExpiringProvider interface {
+	// RetainUntil is like Retain, except the message expires at the time given. If
+	// it's the zero time then the message never expires.
+	RetainUntil(msg *message.PublishMessage, expires time.Time) error
+
+	// Expire removes the retained messages that have expired by now, and returns how
+	// many there were.
+	Expire(now time.Time) (int, error)
+}
+
+// IteratingProvider is implemented by topics providers that can go through the
+// retained messages for a topic filter without collecting them all first, e.g., for
+// a subscription to a broad wildcard like "sensors/#".
+type IteratingProvider interface {
+	// RetainedEach calls f with each of the retained messages for the topic filter,
+	// until f returns an error, which is then returned. f may be called without any
+	// locks held, after the provider has moved on, so the messages retained or
+	// removed while it runs may or may not be seen.
+	RetainedEach(topic []byte, f func(msg *message.PublishMessage) error) error
+}
+
+// ExpiringStore is implemented by retained message stores that can keep when each
+// message expires, so the messages still expire after a restart.
+type ExpiringStore interface {
+	// LoadUntil is like Load, except f is also given when the message expires. It's
+	// the zero time for the messages that never expire.
+	LoadUntil(f func(msg *message.PublishMessage, expires time.Time) error) error
+
+	// PutUntil is like Put, except the message expires at the time given.
+	PutUntil(msg *message.PublishMessage, expires time.Time) error
+}
+
+// WatchingStore is implemented by retained message stores shared by several servers,
+// e.g., on Redis, that can tell each server about the changes the others make, so
+// they all serve the same retained messages.
+type WatchingStore interface {
+	// Watch calls put for each message retained, and del for each message removed,
+	// through the other stores sharing the data, until the store is closed. expires
+	// is the zero time for the messages that never expire. Watch returns once it's
+	// watching, so the changes made after it returns are never missed, and put and
+	// del are called from another goroutine.
+	Watch(put func(msg *message.PublishMessage, expires time.Time), del func(topic []byte)) error
+}
+
 func Register(name string, provider TopicsProvider) {
 	if provider == nil {
 		panic("topics: Register provide is nil")
 	}
 
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
 	if _, dup := providers[name]; dup {
 		panic("topics: Register called twice for provider " + name)
 	}
@@ -80,15 +207,32 @@ func Register(name string, provider TopicsProvider) {
 }
 
 func Unregister(name string) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
 	delete(providers, name)
 }
 
+// Observer is told about the subscriptions added and removed, and the messages
+// retained, through a Manager, e.g., so they can be shared with other servers. It's
+// only called when the provider didn't return an error. The calls are made from the
+// goroutines that went through the Manager, so they must not block for long.
+type Observer interface {
+	Subscribed(topic []byte, subscriber interface{})
+	Unsubscribed(topic []byte, subscriber interface{})
+	Retained(msg *message.PublishMessage)
+}
+
 type Manager struct {
 	p TopicsProvider
+	o Observer
 }
 
 func NewManager(providerName string) (*Manager, error) {
+	providersMu.RLock()
 	p, ok := providers[providerName]
+	providersMu.RUnlock()
+
 	if !ok {
 		return nil, fmt.Errorf("session: unknown provider %q", providerName)
 	}
@@ -97,11 +241,21 @@ func NewManager(providerName string) (*Manager, error) {
 }
 
 func (this *Manager) Subscribe(topic []byte, qos byte, subscriber interface{}) (byte, error) {
-	return this.p.Subscribe(topic, qos, subscriber)
+	qos, err := this.p.Subscribe(topic, qos, subscriber)
+	if err == nil && this.o != nil {
+		this.o.Subscribed(topic, subscriber)
+	}
+
+	return qos, err
 }
 
 func (this *Manager) Unsubscribe(topic []byte, subscriber interface{}) error {
-	return this.p.Unsubscribe(topic, subscriber)
+	err := this.p.Unsubscribe(topic, subscriber)
+	if err == nil && this.o != nil {
+		this.o.Unsubscribed(topic, subscriber)
+	}
+
+	return err
 }
 
 func (this *Manager) Subscribers(topic []byte, qos byte, subs *[]interface{}, qoss *[]byte) error {
@@ -109,13 +263,166 @@ func (this *Manager) Subscribers(topic []byte, qos byte, subs *[]interface{}, qo
 }
 
 func (this *Manager) Retain(msg *message.PublishMessage) error {
-	return this.p.Retain(msg)
+	err := this.p.Retain(msg)
+	if err == nil && this.o != nil {
+		this.o.Retained(msg)
+	}
+
+	return err
+}
+
+// RetainUntil is like Retain, except the message expires at the time given. If it's
+// the zero time then the message never expires, same as with Retain.
+func (this *Manager) RetainUntil(msg *message.PublishMessage, expires time.Time) error {
+	p, ok := this.p.(ExpiringProvider)
+	if !ok {
+		if expires.IsZero() {
+			return this.Retain(msg)
+		}
+
+		return ErrExpiryNotSupported
+	}
+
+	err := p.RetainUntil(msg, expires)
+	if err == nil && this.o != nil {
+		this.o.Retained(msg)
+	}
+
+	return err
+}
+
+// Expire removes the retained messages that have expired by now, and returns how
+// many there were.
+func (this *Manager) Expire(now time.Time) (int, error) {
+	if p, ok := this.p.(ExpiringProvider); ok {
+		return p.Expire(now)
+	}
+
+	return 0, ErrExpiryNotSupported
 }
 
 func (this *Manager) Retained(topic []byte, msgs *[]*message.PublishMessage) error {
 	return this.p.Retained(topic, msgs)
 }
 
+// RetainedEach calls f with each of the retained messages for the topic filter, until
+// f returns an error, which is then returned. If the provider is not an
+// IteratingProvider then the messages are all collected with Retained() first.
+func (this *Manager) RetainedEach(topic []byte, f func(msg *message.PublishMessage) error) error {
+	if p, ok := this.p.(IteratingProvider); ok {
+		return p.RetainedEach(topic, f)
+	}
+
+	var msgs []*message.PublishMessage
+
+	if err := this.p.Retained(topic, &msgs); err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		if err := f(msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *Manager) Stats() (Stats, error) {
+	if p, ok := this.p.(StatsProvider); ok {
+		return p.Stats(), nil
+	}
+
+	return Stats{}, ErrStatsNotSupported
+}
+
+func (this *Manager) SetBalancer(f NewBalancerFunc) error {
+	if p, ok := this.p.(BalancedProvider); ok {
+		p.SetBalancer(f)
+		return nil
+	}
+
+	return ErrBalancerNotSupported
+}
+
+func (this *Manager) SetRetainedStore(store RetainedStore) error {
+	if p, ok := this.p.(PersistentProvider); ok {
+		return p.SetRetainedStore(store)
+	}
+
+	return ErrRetainedStoreNotSupported
+}
+
+// SetObserver sets the Observer told about the changes made through the manager. It
+// must be set before the manager is used.
+func (this *Manager) SetObserver(o Observer) {
+	this.o = o
+}
+
 func (this *Manager) Close() error {
 	return this.p.Close()
 }
+
+// ValidTopicName returns an error if topic isn't a topic name that can be published
+// to: it must be at least one character long, valid UTF-8 without U+0000, and
+// without any wildcards.
+func ValidTopicName(topic []byte) error {
+	if err := validTopic(topic); err != nil {
+		return err
+	}
+
+	if bytes.ContainsAny(topic, _WC) {
+		return fmt.Errorf("topics/ValidTopicName: Topic name %q cannot contain wildcards", topic)
+	}
+
+	return nil
+}
+
+// ValidTopicFilter returns an error if filter isn't a topic filter that can be
+// subscribed to: it must be at least one character long, valid UTF-8 without U+0000,
+// and each wildcard must take up a whole topic level, with # only at the last one.
+// Shared subscriptions must also be of the form $share/{group}/{filter}.
+func ValidTopicFilter(filter []byte) error {
+	if err := validTopic(filter); err != nil {
+		return err
+	}
+
+	if IsShared(filter) {
+		_, f, err := SplitShared(filter)
+		if err != nil {
+			return err
+		}
+
+		filter = f
+	}
+
+	levels := bytes.Split(filter, []byte(SEP))
+
+	for i, level := range levels {
+		if len(level) > 1 && bytes.ContainsAny(level, _WC) {
+			return fmt.Errorf("topics/ValidTopicFilter: Wildcard characters '#' and '+' must occupy entire topic level in %q", filter)
+		}
+
+		if string(level) == MWC && i != len(levels)-1 {
+			return fmt.Errorf("topics/ValidTopicFilter: Multi-level wildcard found in topic filter %q and it's not at the last level", filter)
+		}
+	}
+
+	return nil
+}
+
+func validTopic(topic []byte) error {
+	if len(topic) == 0 {
+		return fmt.Errorf("topics/validTopic: Topic cannot be empty")
+	}
+
+	if !utf8.Valid(topic) {
+		return fmt.Errorf("topics/validTopic: Topic %q is not valid UTF-8", topic)
+	}
+
+	if bytes.IndexByte(topic, 0) >= 0 {
+		return fmt.Errorf("topics/validTopic: Topic %q cannot contain U+0000", topic)
+	}
+
+	return nil
+}